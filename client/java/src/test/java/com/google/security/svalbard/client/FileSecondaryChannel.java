@@ -19,6 +19,7 @@ package com.google.security.svalbard.client;
 import static java.nio.charset.StandardCharsets.UTF_8;
 
 import java.io.BufferedReader;
+import java.io.ByteArrayOutputStream;
 import java.io.IOException;
 import java.nio.file.Files;
 import java.nio.file.Paths;
@@ -27,8 +28,9 @@ import java.security.GeneralSecurityException;
 /**
  * FileSecondaryChannel is a SecondaryChannel implementation based on files.
  * A secondary channel to a user identified by 'userID' is just a file named
- * userID + "secondary_channel.txt" in the root directory of the channel,
- * and each message sent via the channel is written to the file on a separate line.
+ * hex(userID) + "_secondary_channel.txt" in the root directory of the channel,
+ * and each message sent via the channel is written to the file on a separate line,
+ * as "<time in ns since epoch> <message quoted as Go string>".
  * It is intended for testing only.
  */
 public final class FileSecondaryChannel implements SecondaryChannel {
@@ -54,7 +56,7 @@ public final class FileSecondaryChannel implements SecondaryChannel {
           "Recipient IdType '" + recipientIdType + "' not supported");
     }
     String filename = getFilename(recipientId);
-    String prefix = "SVBD:" + requestId;
+    String prefix = "SVBD:" + requestId + ":";
     try {
       return readToken(filename, prefix);
     } catch (IOException e) {
@@ -62,21 +64,128 @@ public final class FileSecondaryChannel implements SecondaryChannel {
     }
   }
 
+  /**
+   * Returns the token of the most recent message in 'filename' that has a line
+   * starting with 'prefix'.
+   */
   private String readToken(String filename, String prefix)
       throws GeneralSecurityException, IOException {
-    BufferedReader bufferedReader = Files.newBufferedReader(Paths.get(filename), UTF_8);
-    String line = bufferedReader.readLine();
-    while (line != null) {
-      if (line.startsWith(prefix)) {
-        return line.substring(prefix.length() + 1);
+    String token = null;
+    try (BufferedReader bufferedReader = Files.newBufferedReader(Paths.get(filename), UTF_8)) {
+      String line = bufferedReader.readLine();
+      while (line != null) {
+        int separator = line.indexOf(' ');
+        if (separator < 0) {
+          throw new GeneralSecurityException("Invalid line in channel file.");
+        }
+        for (String msgLine : unquote(line.substring(separator + 1)).split("\n")) {
+          if (msgLine.startsWith(prefix)) {
+            token = msgLine.substring(prefix.length());
+          }
+        }
+        line = bufferedReader.readLine();
       }
-      line = bufferedReader.readLine();
     }
-    throw new GeneralSecurityException("Token not found.");
+    if (token == null) {
+      throw new GeneralSecurityException("Token not found.");
+    }
+    return token;
   }
 
   private String getFilename(String recipientId) {
-    return Paths.get(rootDir, recipientId + "_secondary_channel.txt").toString();
+    StringBuilder encoded = new StringBuilder();
+    for (byte b : recipientId.getBytes(UTF_8)) {
+      encoded.append(String.format("%02x", b & 0xff));
+    }
+    return Paths.get(rootDir, encoded + "_secondary_channel.txt").toString();
+  }
+
+  /**
+   * Returns the string that Go's strconv.Quote turned into 'quoted'.
+   */
+  private static String unquote(String quoted) throws GeneralSecurityException {
+    int end = quoted.length() - 1;
+    if (end < 1 || quoted.charAt(0) != '"' || quoted.charAt(end) != '"') {
+      throw new GeneralSecurityException("Invalid message in channel file.");
+    }
+    ByteArrayOutputStream bytes = new ByteArrayOutputStream();
+    int i = 1;
+    while (i < end) {
+      int c = quoted.codePointAt(i);
+      if (c != '\\') {
+        writeCodePoint(bytes, c);
+        i += Character.charCount(c);
+        continue;
+      }
+      if (i + 1 >= end) {
+        throw new GeneralSecurityException("Invalid message in channel file.");
+      }
+      char escaped = quoted.charAt(i + 1);
+      i += 2;
+      switch (escaped) {
+        case 'a':
+          bytes.write(7);
+          break;
+        case 'b':
+          bytes.write('\b');
+          break;
+        case 'f':
+          bytes.write('\f');
+          break;
+        case 'n':
+          bytes.write('\n');
+          break;
+        case 'r':
+          bytes.write('\r');
+          break;
+        case 't':
+          bytes.write('\t');
+          break;
+        case 'v':
+          bytes.write(11);
+          break;
+        case '\\':
+        case '"':
+        case '\'':
+          bytes.write(escaped);
+          break;
+        case 'x':
+          bytes.write(parseHex(quoted, i, 2));
+          i += 2;
+          break;
+        case 'u':
+          writeCodePoint(bytes, parseHex(quoted, i, 4));
+          i += 4;
+          break;
+        case 'U':
+          writeCodePoint(bytes, parseHex(quoted, i, 8));
+          i += 8;
+          break;
+        default:
+          throw new GeneralSecurityException("Invalid message in channel file.");
+      }
+    }
+    return new String(bytes.toByteArray(), UTF_8);
+  }
+
+  private static int parseHex(String s, int start, int length) throws GeneralSecurityException {
+    if (start + length > s.length() - 1) {
+      throw new GeneralSecurityException("Invalid message in channel file.");
+    }
+    try {
+      return Integer.parseInt(s.substring(start, start + length), 16);
+    } catch (NumberFormatException e) {
+      throw new GeneralSecurityException("Invalid message in channel file.", e);
+    }
+  }
+
+  private static void writeCodePoint(ByteArrayOutputStream bytes, int codePoint)
+      throws GeneralSecurityException {
+    if (!Character.isValidCodePoint(codePoint)) {
+      throw new GeneralSecurityException("Invalid message in channel file.");
+    }
+    byte[] encoded = new String(Character.toChars(codePoint)).getBytes(UTF_8);
+    bytes.write(encoded, 0, encoded.length);
   }
 
   private final String rootDir;
@@ -25,6 +25,7 @@ TLS_CERT_FILENAME="$ROOT_DIR/server/testdata/test_server_certificate.crt"
 TRUSTSTORE_FILE="$ROOT_DIR/client/testing/test_truststore.jks"
 
 SERVER_BIN="$ROOT_DIR/server/go/linux_amd64_stripped/server"
+TOKEN_BIN="$ROOT_DIR/server/go/linux_amd64_stripped/filechannel_token"
 CLIENT_BIN="$ROOT_DIR/client/java/svalbard_client_cli --jvm_flag=-Djavax.net.ssl.trustStore=$TRUSTSTORE_FILE"
 MANAGER_BIN="$ROOT_DIR/client/java/server_share_manager_cli --jvm_flag=-Djavax.net.ssl.trustStore=$TRUSTSTORE_FILE"
 PORTPICKER_CLI="$ROOT_DIR/external/org_python_pypi_portpicker/portpicker_cli"
@@ -37,8 +38,7 @@ FILECHANNEL_DIR="$TEST_TMPDIR/filechannel"
 get_token() {
   local owner_id="$1"
   local request_id="$2"
-  local channel_file="$FILECHANNEL_DIR/${owner_id}_secondary_channel.txt"
-  local token=$(grep "SVBD:$request_id" $channel_file | cut -d: -f3)
+  local token=$($TOKEN_BIN -filechannel_root_dir="$FILECHANNEL_DIR" -owner_id="$owner_id" -request_id="$request_id")
   echo $token
 }
 
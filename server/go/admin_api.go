@@ -0,0 +1,454 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Package adminapi implements the HTTP API for the operators of a Svalbard
+// server.  The API is served on a separate listener that requires client
+// certificates issued by a configured CA, and every request is authorized
+// by the role mapped from the subject of the client certificate.  The API
+// never reveals any share values or owner ids: shares are referred to by
+// their share ids only, except in snapshots of the share store, which can be
+// encrypted to a key of the operators.
+package adminapi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/svalbard/server/go/channelrouter"
+	"github.com/google/svalbard/server/go/snapshot"
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+// Role is the role of an operator; each role includes the permissions
+// of the lower roles.
+type Role int
+
+// Roles of the operators.
+const (
+	// RoleNone grants no access.
+	RoleNone Role = iota
+	// RoleViewer grants access to the stats and to the share lookup.
+	RoleViewer
+	// RoleOperator additionally grants revocation of tokens, testing of
+	// the secondary channels, and snapshots of the share store.
+	RoleOperator
+)
+
+var roleNames = map[Role]string{RoleNone: "none", RoleViewer: "viewer", RoleOperator: "operator"}
+
+// String returns the name of the role.
+func (r Role) String() string {
+	return roleNames[r]
+}
+
+// Errors returned upon failures.
+var (
+	ErrInvalidRole         = errors.New("invalid role, want viewer or operator")
+	ErrInvalidRoleMapping  = errors.New("invalid role mapping, want <attribute>:<value>=<role> with attribute CN, OU or O")
+	ErrNoCACertificates    = errors.New("no CA certificates found")
+	ErrMissingShareStore   = errors.New("missing share store")
+	ErrMissingTokenStore   = errors.New("missing token store")
+	ErrMissingChannels     = errors.New("missing channels")
+	ErrMissingRoles        = errors.New("missing role mapping")
+	ErrClientCertRequired  = errors.New("client certificate required")
+	ErrPermissionDenied    = errors.New("permission denied")
+	ErrInvalidShareID      = errors.New("invalid share id")
+	ErrInvalidRevocation   = errors.New("exactly one of share_id and token is required")
+	ErrMissingOwnerIDType  = errors.New("missing owner_id_type")
+	ErrUnknownOwnerIDType  = errors.New("unknown owner id type")
+	ErrSnapshotsDisabled   = errors.New("snapshots are not enabled")
+	ErrInternalServerError = errors.New("internal server error")
+)
+
+// ParseRole parses the name of a role.
+func ParseRole(s string) (Role, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "viewer":
+		return RoleViewer, nil
+	case "operator":
+		return RoleOperator, nil
+	}
+	return RoleNone, ErrInvalidRole
+}
+
+// RoleMap maps attributes of certificate subjects, in the form
+// "<attribute>:<value>" (e.g. "CN:alice" or "OU:sre"), to roles.
+type RoleMap map[string]Role
+
+// ParseRoleMap parses a comma-separated list of "<attribute>:<value>=<role>"
+// pairs, e.g. "OU:sre=operator,CN:dashboard=viewer", where the attribute is
+// CN (common name), OU (organizational unit) or O (organization).
+func ParseRoleMap(list string) (RoleMap, error) {
+	roles := make(RoleMap)
+	if strings.TrimSpace(list) == "" {
+		return roles, nil
+	}
+	for _, pair := range strings.Split(list, ",") {
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			return nil, ErrInvalidRoleMapping
+		}
+		key := strings.TrimSpace(pair[:i])
+		kv := strings.SplitN(key, ":", 2)
+		if len(kv) != 2 || kv[1] == "" || (kv[0] != "CN" && kv[0] != "OU" && kv[0] != "O") {
+			return nil, ErrInvalidRoleMapping
+		}
+		role, err := ParseRole(pair[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		roles[key] = role
+	}
+	return roles, nil
+}
+
+// RoleOf returns the highest role mapped from any of the attributes of
+// 'subject', or RoleNone.
+func (m RoleMap) RoleOf(subject pkix.Name) Role {
+	keys := []string{"CN:" + subject.CommonName}
+	for _, ou := range subject.OrganizationalUnit {
+		keys = append(keys, "OU:"+ou)
+	}
+	for _, o := range subject.Organization {
+		keys = append(keys, "O:"+o)
+	}
+	role := RoleNone
+	for _, key := range keys {
+		if r := m[key]; r > role {
+			role = r
+		}
+	}
+	return role
+}
+
+// LoadCertPool returns a pool with the PEM-encoded certificates in 'filename'.
+func LoadCertPool(filename string) (*x509.CertPool, error) {
+	pemCerts, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		return nil, ErrNoCACertificates
+	}
+	return pool, nil
+}
+
+// TLSConfig returns a tls.Config that serves the certificates returned by
+// 'getCertificate', and requires client certificates issued by 'clientCAs'.
+func TLSConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), clientCAs *x509.CertPool) *tls.Config {
+	return &tls.Config{
+		GetCertificate: getCertificate,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		ClientCAs:      clientCAs,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// ShareStore is a share store that can check for the presence of shares
+// without retrieving them.
+type ShareStore interface {
+	// Contains returns true if the share identified by 'shareID' is present.
+	Contains(shareID string) (bool, error)
+	// Count returns the number of shares in the store.
+	Count() (int, error)
+}
+
+// TokenStore is a token store that supports bulk revocation.
+type TokenStore interface {
+	// RevokeToken invalidates the given token.
+	RevokeToken(token string) error
+	// RevokeShareTokens invalidates all tokens for the share identified by
+	// 'shareID', and returns the number of revoked tokens.
+	RevokeShareTokens(shareID string) int
+	// Count returns the number of valid tokens.
+	Count() int
+}
+
+// Channels are the secondary channels of the server.
+type Channels interface {
+	// SupportedOwnerIDTypes returns the owner id types of the channels.
+	SupportedOwnerIDTypes() []string
+	// CheckChannelHealth runs the self-test of the channel for 'idType',
+	// and returns channelrouter.ErrNotRegistered for unknown types.
+	CheckChannelHealth(idType string) error
+}
+
+// Snapshotter writes snapshots of the share store.
+type Snapshotter interface {
+	// WriteSnapshot writes a consistent snapshot to 'w', and returns its
+	// manifest.
+	WriteSnapshot(w io.Writer) (*snapshot.Manifest, error)
+}
+
+// Config contains the dependencies of an API.
+type Config struct {
+	ShareStore ShareStore
+	TokenStore TokenStore
+	Channels   Channels
+	Roles      RoleMap
+	// Snapshots (optional) enables the /snapshot endpoint.
+	Snapshots Snapshotter
+}
+
+// snapshotWriteTimeout replaces the write timeout of the listener for
+// snapshots, which can take much longer than the other requests.  It also
+// limits how long a slow client can keep the read transaction open.
+const snapshotWriteTimeout = time.Hour
+
+// API is an http.Handler that serves the admin API.
+type API struct {
+	config Config
+	routes map[string]route
+}
+
+// route is an endpoint of the API.
+type route struct {
+	method  string
+	role    Role
+	handler func(w http.ResponseWriter, r *http.Request, subject string)
+}
+
+// New returns an API with the given dependencies.
+func New(config Config) (*API, error) {
+	switch {
+	case config.ShareStore == nil:
+		return nil, ErrMissingShareStore
+	case config.TokenStore == nil:
+		return nil, ErrMissingTokenStore
+	case config.Channels == nil:
+		return nil, ErrMissingChannels
+	case len(config.Roles) == 0:
+		return nil, ErrMissingRoles
+	}
+	a := &API{config: config}
+	a.routes = map[string]route{
+		"/stats":         {"GET", RoleViewer, a.handleStats},
+		"/shares/":       {"GET", RoleViewer, a.handleShare},
+		"/tokens/revoke": {"POST", RoleOperator, a.handleRevoke},
+		"/channels/test": {"POST", RoleOperator, a.handleChannelTest},
+		"/snapshot":      {"GET", RoleOperator, a.handleSnapshot},
+	}
+	return a, nil
+}
+
+// ServeHTTP authenticates the client by its verified certificate, checks
+// that its role permits the requested endpoint, and handles the request.
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		http.Error(w, ErrClientCertRequired.Error(), http.StatusUnauthorized)
+		return
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	path := r.URL.Path
+	if strings.HasPrefix(path, "/shares/") {
+		path = "/shares/"
+	}
+	rt, ok := a.routes[path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	role := a.config.Roles.RoleOf(subject)
+	if role < rt.role {
+		slog.Warn("admin request denied", "subject", subject.String(), "role", role.String(), "path", r.URL.Path)
+		http.Error(w, ErrPermissionDenied.Error(), http.StatusForbidden)
+		return
+	}
+	if r.Method != rt.method {
+		msg := svalbardsrv.ErrExpectedGetRequest
+		if rt.method == "POST" {
+			msg = svalbardsrv.ErrExpectedPostRequest
+		}
+		http.Error(w, msg.Error(), http.StatusBadRequest)
+		return
+	}
+	rt.handler(w, r, subject.String())
+}
+
+// writeJSON writes 'v' as the JSON-encoded response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	resp, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, ErrInternalServerError.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(resp)
+}
+
+// handleStats handles requests for the stats of the server.  The response
+// is a JSON object of the form
+// {"shares": 42, "valid_tokens": 3, "owner_id_types": ["EMAIL", ...], "version": "..."}.
+func (a *API) handleStats(w http.ResponseWriter, r *http.Request, subject string) {
+	shares, err := a.config.ShareStore.Count()
+	if err != nil {
+		slog.Error("admin: counting of shares failed", "error", err)
+		http.Error(w, ErrInternalServerError.Error(), http.StatusInternalServerError)
+		return
+	}
+	idTypes := a.config.Channels.SupportedOwnerIDTypes()
+	sort.Strings(idTypes)
+	writeJSON(w, http.StatusOK, struct {
+		Shares       int      `json:"shares"`
+		ValidTokens  int      `json:"valid_tokens"`
+		OwnerIDTypes []string `json:"owner_id_types"`
+		Version      string   `json:"version"`
+	}{shares, a.config.TokenStore.Count(), idTypes, svalbardsrv.Version})
+}
+
+// isShareID returns true if 's' has the form of a share id, i.e. of
+// a hex-encoded SHA-256 hash.
+func isShareID(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == 32 && strings.ToLower(s) == s
+}
+
+// handleShare handles lookups of shares at /shares/<share id>.  The response
+// is a JSON object of the form {"share_id": "...", "exists": true|false}.
+func (a *API) handleShare(w http.ResponseWriter, r *http.Request, subject string) {
+	shareID := strings.TrimPrefix(r.URL.Path, "/shares/")
+	if !isShareID(shareID) {
+		http.Error(w, ErrInvalidShareID.Error(), http.StatusBadRequest)
+		return
+	}
+	exists, err := a.config.ShareStore.Contains(shareID)
+	if err != nil {
+		slog.Error("admin: share lookup failed", "share_id", shareID, "error", err)
+		http.Error(w, ErrInternalServerError.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("admin: share lookup", "subject", subject, "share_id", shareID, "exists", exists)
+	writeJSON(w, http.StatusOK, struct {
+		ShareID string `json:"share_id"`
+		Exists  bool   `json:"exists"`
+	}{shareID, exists})
+}
+
+// handleRevoke handles forced revocations of tokens: either of all tokens
+// for the share given by the parameter 'share_id', or of the token given
+// by the parameter 'token'.  The response is a JSON object of the form
+// {"revoked": <number of revoked tokens>}.
+func (a *API) handleRevoke(w http.ResponseWriter, r *http.Request, subject string) {
+	shareID, token := r.PostFormValue("share_id"), r.PostFormValue("token")
+	if (shareID == "") == (token == "") {
+		http.Error(w, ErrInvalidRevocation.Error(), http.StatusBadRequest)
+		return
+	}
+	revoked := 0
+	if shareID != "" {
+		if !isShareID(shareID) {
+			http.Error(w, ErrInvalidShareID.Error(), http.StatusBadRequest)
+			return
+		}
+		revoked = a.config.TokenStore.RevokeShareTokens(shareID)
+		slog.Info("admin: revoked tokens", "subject", subject, "share_id", shareID, "revoked", revoked)
+	} else {
+		if err := a.config.TokenStore.RevokeToken(token); err == nil {
+			revoked = 1
+		}
+		slog.Info("admin: revoked token", "subject", subject, "revoked", revoked)
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Revoked int `json:"revoked"`
+	}{revoked})
+}
+
+// handleChannelTest handles self-tests of the channel for the owner id type
+// given by the parameter 'owner_id_type'.  The response is a JSON object of
+// the form {"owner_id_type": "...", "status": "ok"|"failed", "error": "..."},
+// with HTTP status 502 if the test failed.
+func (a *API) handleChannelTest(w http.ResponseWriter, r *http.Request, subject string) {
+	idType := strings.TrimSpace(r.PostFormValue("owner_id_type"))
+	if idType == "" {
+		http.Error(w, ErrMissingOwnerIDType.Error(), http.StatusBadRequest)
+		return
+	}
+	err := a.config.Channels.CheckChannelHealth(idType)
+	if err == channelrouter.ErrNotRegistered {
+		http.Error(w, ErrUnknownOwnerIDType.Error(), http.StatusNotFound)
+		return
+	}
+	result := struct {
+		OwnerIDType string `json:"owner_id_type"`
+		Status      string `json:"status"`
+		Error       string `json:"error,omitempty"`
+	}{OwnerIDType: idType, Status: "ok"}
+	status := http.StatusOK
+	if err != nil {
+		result.Status, result.Error = "failed", err.Error()
+		status = http.StatusBadGateway
+	}
+	slog.Info("admin: tested channel", "subject", subject, "owner_id_type", idType, "status", result.Status)
+	writeJSON(w, status, result)
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		// An empty write would still send the status.
+		return 0, nil
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// handleSnapshot streams a snapshot of the share store (see package
+// snapshot) while the server keeps serving.  If the snapshot fails after
+// it has been started, the response is aborted, so that the client gets
+// a truncated snapshot, which does not restore.
+func (a *API) handleSnapshot(w http.ResponseWriter, r *http.Request, subject string) {
+	if a.config.Snapshots == nil {
+		http.Error(w, ErrSnapshotsDisabled.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(snapshotWriteTimeout)); err != nil {
+		slog.Warn("admin: could not extend write deadline for snapshot", "error", err)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	cw := &countingWriter{w: w}
+	manifest, err := a.config.Snapshots.WriteSnapshot(cw)
+	if err != nil {
+		slog.Error("admin: snapshot failed", "subject", subject, "written", cw.n, "error", err)
+		if cw.n == 0 {
+			http.Error(w, ErrInternalServerError.Error(), http.StatusInternalServerError)
+			return
+		}
+		panic(http.ErrAbortHandler)
+	}
+	slog.Info("admin: wrote snapshot", "subject", subject, "shares", manifest.Shares,
+		"size", manifest.Size, "sha256", manifest.SHA256, "written", cw.n)
+}
@@ -0,0 +1,392 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package adminapi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/svalbard/server/go/channelrouter"
+	"github.com/google/svalbard/server/go/inmemorysharestore"
+	"github.com/google/svalbard/server/go/shareid"
+	"github.com/google/svalbard/server/go/snapshot"
+	"github.com/google/svalbard/server/go/svalbardsrv"
+	"github.com/google/svalbard/server/go/testingtools"
+	"github.com/google/svalbard/server/go/tokenstore"
+)
+
+// testChannel is a secondary channel with a configurable self-test.
+type testChannel struct {
+	health error
+}
+
+func (c *testChannel) Send(recipient svalbardsrv.RecipientID, data svalbardsrv.TokenMsgData) error {
+	return nil
+}
+
+func (c *testChannel) CheckHealth() error {
+	return c.health
+}
+
+// testSnapshotter writes 'data' as snapshot, and then fails with 'err'.
+type testSnapshotter struct {
+	data string
+	err  error
+}
+
+func (s *testSnapshotter) WriteSnapshot(w io.Writer) (*snapshot.Manifest, error) {
+	io.WriteString(w, s.data)
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &snapshot.Manifest{Size: int64(len(s.data))}, nil
+}
+
+func newCert(t *testing.T, subject pkix.Name, issuer *testingtools.TestCertificate) *testingtools.TestCertificate {
+	cert, err := testingtools.NewTestCertificate(subject, issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestParseRoleMap(t *testing.T) {
+	var tests = []struct {
+		list string
+		want RoleMap
+		err  error
+	}{
+		{"", RoleMap{}, nil},
+		{"OU:sre=operator, CN:dashboard=viewer", RoleMap{"OU:sre": RoleOperator, "CN:dashboard": RoleViewer}, nil},
+		{"CN:a=b=Viewer", RoleMap{"CN:a=b": RoleViewer}, nil},
+		{"CN:alice=admin", nil, ErrInvalidRole},
+		{"alice=operator", nil, ErrInvalidRoleMapping},
+		{"L:Zurich=operator", nil, ErrInvalidRoleMapping},
+		{"CN:=operator", nil, ErrInvalidRoleMapping},
+		{"CN:alice", nil, ErrInvalidRoleMapping},
+	}
+	for _, tt := range tests {
+		got, err := ParseRoleMap(tt.list)
+		if err != tt.err || (err == nil && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("ParseRoleMap(%q): got [%v, %v], want [%v, %v]", tt.list, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestRoleOf(t *testing.T) {
+	roles := RoleMap{"OU:sre": RoleOperator, "CN:dashboard": RoleViewer, "O:Example": RoleViewer}
+	var tests = []struct {
+		subject pkix.Name
+		want    Role
+	}{
+		{pkix.Name{CommonName: "dashboard"}, RoleViewer},
+		{pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"dev", "sre"}}, RoleOperator},
+		{pkix.Name{CommonName: "dashboard", OrganizationalUnit: []string{"sre"}}, RoleOperator},
+		{pkix.Name{CommonName: "bob", Organization: []string{"Example"}}, RoleViewer},
+		{pkix.Name{CommonName: "mallory", OrganizationalUnit: []string{"SRE"}}, RoleNone},
+		{pkix.Name{CommonName: "sre"}, RoleNone},
+	}
+	for _, tt := range tests {
+		if got := roles.RoleOf(tt.subject); got != tt.want {
+			t.Errorf("RoleOf(%v): got [%v], want [%v]", tt.subject, got, tt.want)
+		}
+	}
+}
+
+// testAPI is an API served over mutual TLS.
+type testAPI struct {
+	addr       string
+	ca         *testingtools.TestCertificate
+	shareStore *inmemorysharestore.InMemory
+	tokenStore *tokenstore.Store
+	channel    *testChannel
+	snapshots  *testSnapshotter
+	close      func()
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	ta := &testAPI{
+		ca:         newCert(t, pkix.Name{CommonName: "Test Admin CA"}, nil),
+		shareStore: inmemorysharestore.New(),
+		channel:    &testChannel{},
+		snapshots:  &testSnapshotter{},
+	}
+	var err error
+	if ta.tokenStore, err = tokenstore.NewStore(5, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	router := channelrouter.New()
+	if err := router.Register("SMS", ta.channel); err != nil {
+		t.Fatal(err)
+	}
+	roles, err := ParseRoleMap("OU:sre=operator,CN:dashboard=viewer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := New(Config{ShareStore: ta.shareStore, TokenStore: ta.tokenStore, Channels: router, Roles: roles,
+		Snapshots: ta.snapshots})
+	if err != nil {
+		t.Fatalf("New(): unexpected error: %v", err)
+	}
+	serverCert := newCert(t, pkix.Name{CommonName: "localhost"}, ta.ca).TLSCertificate()
+	pool := x509.NewCertPool()
+	pool.AddCert(ta.ca.Cert)
+	config := TLSConfig(func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return &serverCert, nil }, pool)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: api, ErrorLog: log.New(ioutil.Discard, "", 0)}
+	go server.Serve(tls.NewListener(listener, config))
+	ta.addr = "https://" + listener.Addr().String()
+	ta.close = func() { server.Close() }
+	return ta
+}
+
+// client returns a client that authenticates with 'cert' (if not nil),
+// and trusts the CA of the API.
+func (ta *testAPI) client(cert *testingtools.TestCertificate) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(ta.ca.Cert)
+	config := &tls.Config{RootCAs: pool}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{cert.TLSCertificate()}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+}
+
+// do sends a GET request (if 'form' is nil) or a POST request to 'path',
+// and returns the status and the body of the response.
+func (ta *testAPI) do(t *testing.T, client *http.Client, path string, form url.Values) (int, string) {
+	var resp *http.Response
+	var err error
+	if form == nil {
+		resp, err = client.Get(ta.addr + path)
+	} else {
+		resp, err = client.PostForm(ta.addr+path, form)
+	}
+	if err != nil {
+		t.Fatalf("request to %s: unexpected error: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, strings.TrimSpace(string(body))
+}
+
+func TestAuthentication(t *testing.T) {
+	ta := newTestAPI(t)
+	defer ta.close()
+	otherCA := newCert(t, pkix.Name{CommonName: "Other CA"}, nil)
+	for _, cert := range []*testingtools.TestCertificate{nil, newCert(t, pkix.Name{CommonName: "dashboard"}, otherCA)} {
+		if _, err := ta.client(cert).Get(ta.addr + "/stats"); err == nil {
+			t.Errorf("GET /stats with certificate %v: got no error, want TLS handshake failure", cert)
+		}
+	}
+	// Without TLS, e.g. if the API is mistakenly served over plain HTTP.
+	w := httptest.NewRecorder()
+	api, err := New(Config{ShareStore: ta.shareStore, TokenStore: ta.tokenStore, Channels: channelrouter.New(), Roles: RoleMap{"CN:a": RoleViewer}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/stats", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /stats without TLS: got status [%v], want [%v]", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tokens, err := tokenstore.NewStore(5, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := Config{inmemorysharestore.New(), tokens, channelrouter.New(), RoleMap{"CN:a": RoleViewer}, nil}
+	var tests = []struct {
+		modify func(c *Config)
+		err    error
+	}{
+		{func(c *Config) {}, nil},
+		{func(c *Config) { c.ShareStore = nil }, ErrMissingShareStore},
+		{func(c *Config) { c.TokenStore = nil }, ErrMissingTokenStore},
+		{func(c *Config) { c.Channels = nil }, ErrMissingChannels},
+		{func(c *Config) { c.Roles = RoleMap{} }, ErrMissingRoles},
+	}
+	for i, tt := range tests {
+		config := full
+		tt.modify(&config)
+		if _, err := New(config); err != tt.err {
+			t.Errorf("test case #%d: New(): got [%v], want [%v]", i, err, tt.err)
+		}
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	ta := newTestAPI(t)
+	defer ta.close()
+	operator := ta.client(newCert(t, pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"sre"}}, ta.ca))
+	viewer := ta.client(newCert(t, pkix.Name{CommonName: "dashboard"}, ta.ca))
+	nobody := ta.client(newCert(t, pkix.Name{CommonName: "mallory"}, ta.ca))
+
+	storedID, err := shareid.GetShareID("SMS", "alice", "some secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	missingID, err := shareid.GetShareID("SMS", "bob", "some secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ta.shareStore.Store(storedID, "some share"); err != nil {
+		t.Fatal(err)
+	}
+	var tokens []string
+	for _, id := range []string{storedID, storedID, missingID} {
+		token, err := ta.tokenStore.GetNewToken(id, svalbardsrv.OpRetrieveShare)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, token)
+	}
+
+	var tests = []struct {
+		client     *http.Client
+		path       string
+		form       url.Values // nil for GET requests
+		channelErr error
+		wantStatus int
+		wantBody   string
+	}{
+		{nobody, "/stats", nil, nil, http.StatusForbidden, ErrPermissionDenied.Error()},
+		{viewer, "/stats", nil, nil, http.StatusOK,
+			`{"shares":1,"valid_tokens":3,"owner_id_types":["SMS"],"version":"` + svalbardsrv.Version + `"}`},
+		{viewer, "/stats", url.Values{}, nil, http.StatusBadRequest, svalbardsrv.ErrExpectedGetRequest.Error()},
+		{viewer, "/shares/" + storedID, nil, nil, http.StatusOK, `{"share_id":"` + storedID + `","exists":true}`},
+		{viewer, "/shares/" + missingID, nil, nil, http.StatusOK, `{"share_id":"` + missingID + `","exists":false}`},
+		{viewer, "/shares/" + strings.ToUpper(storedID), nil, nil, http.StatusBadRequest, ErrInvalidShareID.Error()},
+		{viewer, "/shares/alice", nil, nil, http.StatusBadRequest, ErrInvalidShareID.Error()},
+		{viewer, "/unknown", nil, nil, http.StatusNotFound, "404 page not found"},
+		{viewer, "/tokens/revoke", url.Values{"share_id": {storedID}}, nil, http.StatusForbidden, ErrPermissionDenied.Error()},
+		{operator, "/tokens/revoke", nil, nil, http.StatusBadRequest, svalbardsrv.ErrExpectedPostRequest.Error()},
+		{operator, "/tokens/revoke", url.Values{}, nil, http.StatusBadRequest, ErrInvalidRevocation.Error()},
+		{operator, "/tokens/revoke", url.Values{"share_id": {storedID}, "token": {tokens[2]}}, nil,
+			http.StatusBadRequest, ErrInvalidRevocation.Error()},
+		{operator, "/tokens/revoke", url.Values{"share_id": {"alice"}}, nil, http.StatusBadRequest, ErrInvalidShareID.Error()},
+		{operator, "/tokens/revoke", url.Values{"share_id": {storedID}}, nil, http.StatusOK, `{"revoked":2}`},
+		{operator, "/tokens/revoke", url.Values{"share_id": {storedID}}, nil, http.StatusOK, `{"revoked":0}`},
+		{operator, "/tokens/revoke", url.Values{"token": {tokens[2]}}, nil, http.StatusOK, `{"revoked":1}`},
+		{operator, "/tokens/revoke", url.Values{"token": {tokens[2]}}, nil, http.StatusOK, `{"revoked":0}`},
+		{viewer, "/stats", nil, nil, http.StatusOK,
+			`{"shares":1,"valid_tokens":0,"owner_id_types":["SMS"],"version":"` + svalbardsrv.Version + `"}`},
+		{viewer, "/channels/test", url.Values{"owner_id_type": {"SMS"}}, nil, http.StatusForbidden, ErrPermissionDenied.Error()},
+		{operator, "/channels/test", url.Values{"owner_id_type": {"sms"}}, nil, http.StatusOK,
+			`{"owner_id_type":"sms","status":"ok"}`},
+		{operator, "/channels/test", url.Values{"owner_id_type": {"SMS"}}, errors.New("gateway unreachable"),
+			http.StatusBadGateway, `{"owner_id_type":"SMS","status":"failed","error":"gateway unreachable"}`},
+		{operator, "/channels/test", url.Values{"owner_id_type": {"EMAIL"}}, nil, http.StatusNotFound, ErrUnknownOwnerIDType.Error()},
+		{operator, "/channels/test", url.Values{}, nil, http.StatusBadRequest, ErrMissingOwnerIDType.Error()},
+	}
+	for i, tt := range tests {
+		ta.channel.health = tt.channelErr
+		status, body := ta.do(t, tt.client, tt.path, tt.form)
+		if status != tt.wantStatus || body != tt.wantBody {
+			t.Errorf("test case #%d: %s: got [%v, %s], want [%v, %s]", i, tt.path, status, body, tt.wantStatus, tt.wantBody)
+		}
+	}
+	// The revoked tokens are not valid any more.
+	for _, token := range tokens[:2] {
+		if err := ta.tokenStore.IsTokenValidNow(token, storedID, svalbardsrv.OpRetrieveShare); err != svalbardsrv.ErrTokenNotFound {
+			t.Errorf("IsTokenValidNow(%s) after revocation: got [%v], want [%v]", token, err, svalbardsrv.ErrTokenNotFound)
+		}
+	}
+}
+
+func TestStatsResponseIsJSON(t *testing.T) {
+	ta := newTestAPI(t)
+	defer ta.close()
+	viewer := ta.client(newCert(t, pkix.Name{CommonName: "dashboard"}, ta.ca))
+	resp, err := viewer.Get(ta.addr + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type: got [%v], want [application/json]", got)
+	}
+	var stats map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Errorf("Decode(): unexpected error: %v", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	ta := newTestAPI(t)
+	defer ta.close()
+	operator := ta.client(newCert(t, pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"sre"}}, ta.ca))
+	viewer := ta.client(newCert(t, pkix.Name{CommonName: "dashboard"}, ta.ca))
+
+	if status, body := ta.do(t, viewer, "/snapshot", nil); status != http.StatusForbidden {
+		t.Errorf("GET /snapshot as viewer: got [%v, %s], want [%v, ...]", status, body, http.StatusForbidden)
+	}
+	ta.snapshots.data = strings.Repeat("snapshot data ", 100000)
+	if status, body := ta.do(t, operator, "/snapshot", nil); status != http.StatusOK || body != strings.TrimSpace(ta.snapshots.data) {
+		t.Errorf("GET /snapshot: got [%v, %d bytes], want [%v, %d bytes]", status, len(body), http.StatusOK, len(ta.snapshots.data))
+	}
+	// A snapshot that fails before writing anything is an ordinary error.
+	ta.snapshots.data, ta.snapshots.err = "", errors.New("DB closed")
+	if status, body := ta.do(t, operator, "/snapshot", nil); status != http.StatusInternalServerError {
+		t.Errorf("GET /snapshot failing: got [%v, %s], want [%v, ...]", status, body, http.StatusInternalServerError)
+	}
+	// A snapshot that fails while it is written is aborted.
+	ta.snapshots.data = strings.Repeat("snapshot data ", 100000)
+	resp, err := operator.Get(ta.addr + "/snapshot")
+	if err == nil {
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Errorf("GET /snapshot failing while written: got complete response, want error")
+	}
+
+	// Without a Snapshotter, the endpoint is disabled.
+	w := httptest.NewRecorder()
+	api, err := New(Config{ShareStore: ta.shareStore, TokenStore: ta.tokenStore, Channels: channelrouter.New(),
+		Roles: RoleMap{"CN:alice": RoleOperator}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/snapshot", nil)
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{newCert(t, pkix.Name{CommonName: "alice"}, ta.ca).Cert}}}
+	api.ServeHTTP(w, r)
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("GET /snapshot without Snapshotter: got status [%v], want [%v]", w.Code, http.StatusNotImplemented)
+	}
+}
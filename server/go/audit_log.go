@@ -0,0 +1,325 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Package auditlog implements a tamper-evident, append-only audit log of
+// the requests handled by a Svalbard server.  The records are stored as lines
+// of JSON in a file, and each record contains the hash of the line of the
+// previous record, so that any modification of a record breaks the chain.
+// Truncation of the log is detected by comparing it with heads (the sequence
+// number and the hash of the last record) recorded earlier, e.g. by exporting
+// them periodically to another system.
+//
+// If a key is configured, the hashes are HMAC-SHA256 under that key, so that
+// the chain cannot be recomputed by anybody who does not know the key.
+package auditlog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+// Errors returned when a log fails verification.
+var (
+	ErrInvalidRecord   = errors.New("invalid audit record")
+	ErrInvalidSequence = errors.New("unexpected sequence number")
+	ErrBrokenChain     = errors.New("hash chain broken")
+	ErrTruncatedRecord = errors.New("truncated audit record")
+	ErrTruncatedLog    = errors.New("audit log truncated")
+	ErrHeadMismatch    = errors.New("audit record does not match head")
+	ErrInvalidHead     = errors.New("invalid head")
+)
+
+// VerificationError describes a failed verification of a log.
+type VerificationError struct {
+	Line int // the number of the offending line, starting with 1
+	Err  error
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// Record is a single record of the audit log.
+type Record struct {
+	Seq          uint64    `json:"seq"`
+	Time         time.Time `json:"time"`
+	Operation    string    `json:"operation"`
+	ShareID      string    `json:"share_id,omitempty"`
+	ReqID        string    `json:"request_id,omitempty"`
+	ClientIPHash string    `json:"client_ip_hash,omitempty"`
+	Outcome      int       `json:"outcome"` // HTTP status of the response
+	Prev         string    `json:"prev"`    // hash of the previous record, empty for the first one
+}
+
+// Head identifies the last record of a log.
+type Head struct {
+	Seq  uint64
+	Hash string
+}
+
+// String returns the head in the form <seq>:<hash>, as parsed by ParseHead.
+func (h Head) String() string {
+	return strconv.FormatUint(h.Seq, 10) + ":" + h.Hash
+}
+
+// ParseHead parses a head of the form <seq>:<hash>.
+func ParseHead(s string) (Head, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 2 {
+		return Head{}, ErrInvalidHead
+	}
+	seq, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return Head{}, ErrInvalidHead
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil || len(parts[1]) != 2*sha256.Size {
+		return Head{}, ErrInvalidHead
+	}
+	return Head{seq, parts[1]}, nil
+}
+
+// Config contains the parameters of a Log.
+type Config struct {
+	// Key (optional) is the key for the hashes of the records and of the
+	// client IP addresses.  Without a key, the hash of a client IP address can
+	// be reversed by trying all addresses.
+	Key []byte
+	// Sync makes the log sync the file after every record.
+	Sync bool
+	// ExportHead (optional) is called with the head of the log every
+	// ExportInterval (if positive), unless the head has not changed since
+	// the last call, and by Close with the final head, so that the heads can
+	// be recorded outside the log.
+	ExportHead     func(Head)
+	ExportInterval time.Duration
+}
+
+// Log is a file-backed audit log, which implements svalbardsrv.Auditor.
+type Log struct {
+	config Config
+
+	mutex sync.Mutex
+	file  *os.File
+	head  Head
+	size  int64 // of the complete records in the file
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// Open opens the log stored in 'filename', creating the file if necessary.
+// An existing log is verified before new records are appended to it.
+// A partial last record, left by a write that did not complete (e.g. upon
+// a crash without Sync), is removed from the file, as it would break the
+// chain of the records appended after it.
+func Open(filename string, config Config) (*Log, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	head, size, err := verify(file, config.Key)
+	if vErr, ok := err.(*VerificationError); ok && vErr.Err == ErrTruncatedRecord {
+		slog.Warn("removing partial last record of audit log", "file", filename, "line", vErr.Line)
+		err = file.Truncate(size)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	l := &Log{config: config, file: file, head: head, size: size}
+	if config.ExportHead != nil && config.ExportInterval > 0 {
+		l.stop, l.stopped = make(chan struct{}), make(chan struct{})
+		go l.exportHeads(head)
+	}
+	return l, nil
+}
+
+// exportHeads passes the head of the log to the ExportHead function every
+// ExportInterval, if it has changed since 'exported', until the log is closed.
+func (l *Log) exportHeads(exported Head) {
+	defer close(l.stopped)
+	ticker := time.NewTicker(l.config.ExportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if head := l.Head(); head != exported {
+				l.config.ExportHead(head)
+				exported = head
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// Head returns the head of the log.
+func (l *Log) Head() Head {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.head
+}
+
+// Audit appends a record of 'event' to the log.
+func (l *Log) Audit(event svalbardsrv.AuditEvent) error {
+	rec := Record{
+		Time:      event.Time.UTC(),
+		Operation: event.Operation,
+		ShareID:   event.ShareID,
+		ReqID:     event.ReqID,
+		Outcome:   event.Status,
+	}
+	if event.ClientIP != nil {
+		h := newHash(l.config.Key)
+		h.Write([]byte(event.ClientIP.String()))
+		rec.ClientIPHash = hex.EncodeToString(h.Sum(nil)[:16])
+	}
+	return l.Append(rec)
+}
+
+// Append appends 'rec' to the log, setting its sequence number and the hash
+// of the previous record.  After a failure, the file is cut back to the
+// complete records.
+func (l *Log) Append(rec Record) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	rec.Seq = l.head.Seq + 1
+	rec.Prev = l.head.Hash
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		l.file.Truncate(l.size)
+		return err
+	}
+	if l.config.Sync {
+		if err := l.file.Sync(); err != nil {
+			l.file.Truncate(l.size)
+			return err
+		}
+	}
+	l.head = Head{rec.Seq, hashLine(l.config.Key, line)}
+	l.size += int64(len(line)) + 1
+	return nil
+}
+
+// Close closes the log, and passes its final head to the ExportHead
+// function, if any.
+func (l *Log) Close() error {
+	if l.stop != nil {
+		close(l.stop)
+		<-l.stopped
+	}
+	l.mutex.Lock()
+	err := l.file.Close()
+	head := l.head
+	l.mutex.Unlock()
+	if l.config.ExportHead != nil {
+		l.config.ExportHead(head)
+	}
+	return err
+}
+
+func newHash(key []byte) hash.Hash {
+	if len(key) == 0 {
+		return sha256.New()
+	}
+	return hmac.New(sha256.New, key)
+}
+
+func hashLine(key, line []byte) string {
+	h := newHash(key)
+	h.Write(line)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Verify reads a log from 'r', and verifies that its records are
+// consecutively numbered and correctly chained, using 'key' (if any).
+// In addition, for each of the given heads, recorded earlier from the same
+// log, it verifies that the log still contains the corresponding record
+// unchanged.  It returns the head of the log, or a *VerificationError.
+// A partial last record (without the final newline) is reported as
+// ErrTruncatedRecord, which unlike the other errors does not indicate
+// tampering, but a write that did not complete.
+func Verify(r io.Reader, key []byte, heads ...Head) (Head, error) {
+	head, _, err := verify(r, key, heads...)
+	return head, err
+}
+
+// verify is like Verify, but also returns the size of the complete records
+// read from 'r'.
+func verify(r io.Reader, key []byte, heads ...Head) (Head, int64, error) {
+	expected := make(map[uint64]string)
+	var maxSeq uint64
+	for _, h := range heads {
+		expected[h.Seq] = h.Hash
+		if h.Seq > maxSeq {
+			maxSeq = h.Seq
+		}
+	}
+	var head Head
+	var size int64
+	reader := bufio.NewReader(r)
+	for lineNum := 1; ; lineNum++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err == io.EOF {
+			return head, size, &VerificationError{lineNum, ErrTruncatedRecord}
+		}
+		if err != nil {
+			return head, size, err
+		}
+		size += int64(len(line))
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		var rec Record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return head, size, &VerificationError{lineNum, ErrInvalidRecord}
+		}
+		if rec.Seq != head.Seq+1 {
+			return head, size, &VerificationError{lineNum, ErrInvalidSequence}
+		}
+		if rec.Prev != head.Hash {
+			return head, size, &VerificationError{lineNum, ErrBrokenChain}
+		}
+		head = Head{rec.Seq, hashLine(key, line)}
+		if h, ok := expected[head.Seq]; ok && h != head.Hash {
+			return head, size, &VerificationError{lineNum, ErrHeadMismatch}
+		}
+	}
+	if head.Seq < maxSeq {
+		return head, size, &VerificationError{int(head.Seq) + 1, ErrTruncatedLog}
+	}
+	return head, size, nil
+}
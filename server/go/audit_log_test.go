@@ -0,0 +1,289 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package auditlog
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+func newTempDir() string {
+	dir := os.Getenv("TEST_TMPDIR")
+	if dir == "" {
+		dir = "/tmp"
+	}
+	tempDir, err := ioutil.TempDir(dir, "auditlog_test_")
+	if err != nil {
+		panic("Failure creating temp dir: " + err.Error())
+	}
+	return tempDir
+}
+
+var testEvents = []svalbardsrv.AuditEvent{
+	{time.Unix(1500000000, 0), svalbardsrv.AuditGetStorageToken, "share1", "req1", net.ParseIP("192.0.2.1"), 200},
+	{time.Unix(1500000001, 0), svalbardsrv.AuditStoreShare, "share1", "", net.ParseIP("192.0.2.1"), 200},
+	{time.Unix(1500000002, 0), svalbardsrv.AuditGetRetrievalToken, "", "req2", nil, 400},
+	{time.Unix(1500000003, 0), svalbardsrv.AuditRetrieveShare, "share1", "", net.ParseIP("2001:db8::1"), 403},
+}
+
+// writeTestLog writes 'events' to a new log in 'filename', and returns its head.
+func writeTestLog(filename string, key []byte, events []svalbardsrv.AuditEvent, t *testing.T) Head {
+	l, err := Open(filename, Config{Key: key})
+	if err != nil {
+		t.Fatalf("Open(%q) failed: %v", filename, err)
+	}
+	defer l.Close()
+	for _, event := range events {
+		if err := l.Audit(event); err != nil {
+			t.Fatalf("Audit(%v) failed: %v", event, err)
+		}
+	}
+	return l.Head()
+}
+
+func TestAuditAndVerify(t *testing.T) {
+	filename := filepath.Join(newTempDir(), "audit.log")
+	key := []byte("audit key")
+	head := writeTestLog(filename, key, testEvents[:2], t)
+	if head.Seq != 2 {
+		t.Errorf("Head() after 2 records: got %v, want seq 2", head)
+	}
+	// Reopening the log continues the chain.
+	if got := writeTestLog(filename, key, testEvents[2:], t); got.Seq != 4 {
+		t.Errorf("Head() after 4 records: got %v, want seq 4", got)
+	}
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile(%q) failed: %v", filename, err)
+	}
+	got, err := Verify(bytes.NewReader(content), key, head)
+	if err != nil || got.Seq != 4 {
+		t.Errorf("Verify(): got %v (error: %v), want seq 4", got, err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Log has %d lines, want 4", len(lines))
+	}
+	if want := `{"seq":1,"time":"2017-07-14T02:40:00Z","operation":"get_storage_token","share_id":"share1","request_id":"req1","client_ip_hash":"`; !strings.HasPrefix(lines[0], want) {
+		t.Errorf("First record: got %s, want prefix %s", lines[0], want)
+	}
+	if want := `"outcome":200,"prev":""}`; !strings.HasSuffix(lines[0], want) {
+		t.Errorf("First record: got %s, want suffix %s", lines[0], want)
+	}
+	if strings.Contains(lines[2], "client_ip_hash") {
+		t.Errorf("Record without client IP: got %s, want no client_ip_hash", lines[2])
+	}
+	if strings.Contains(string(content), "192.0.2.1") || strings.Contains(string(content), "2001:db8::1") {
+		t.Errorf("Log contains client IP addresses: %s", content)
+	}
+}
+
+func TestClientIPHash(t *testing.T) {
+	dir := newTempDir()
+	event := testEvents[0]
+	hashOf := func(name string, key []byte, ip net.IP) string {
+		filename := filepath.Join(dir, name)
+		event.ClientIP = ip
+		writeTestLog(filename, key, []svalbardsrv.AuditEvent{event}, t)
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("ReadFile(%q) failed: %v", filename, err)
+		}
+		i := bytes.Index(content, []byte(`"client_ip_hash":"`))
+		return string(content[i : i+18+32])
+	}
+	h := hashOf("a", []byte("key"), net.ParseIP("192.0.2.1"))
+	if got := hashOf("b", []byte("key"), net.ParseIP("192.0.2.1")); got != h {
+		t.Errorf("Hash of the same IP: got %s, want %s", got, h)
+	}
+	if got := hashOf("c", []byte("key"), net.ParseIP("192.0.2.2")); got == h {
+		t.Errorf("Hash of another IP: got %s, want a different hash", got)
+	}
+	if got := hashOf("d", []byte("other key"), net.ParseIP("192.0.2.1")); got == h {
+		t.Errorf("Hash under another key: got %s, want a different hash", got)
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	filename := filepath.Join(newTempDir(), "audit.log")
+	key := []byte("audit key")
+	head := writeTestLog(filename, key, testEvents, t)
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile(%q) failed: %v", filename, err)
+	}
+	lines := strings.SplitAfter(string(content), "\n")[:4]
+	// The head recorded after the first two records.
+	middle, err := Verify(strings.NewReader(lines[0]+lines[1]), key)
+	if err != nil {
+		t.Fatalf("Verify() of the first two records failed: %v", err)
+	}
+
+	var tests = []struct {
+		desc  string
+		log   string
+		key   []byte
+		heads []Head
+		line  int
+		err   error
+	}{
+		{"modified record",
+			lines[0] + strings.Replace(lines[1], `"outcome":200`, `"outcome":403`, 1) + lines[2] + lines[3],
+			key, nil, 3, ErrBrokenChain},
+		{"modified last record",
+			lines[0] + lines[1] + lines[2] + strings.Replace(lines[3], `"outcome":403`, `"outcome":200`, 1),
+			key, []Head{head}, 4, ErrHeadMismatch},
+		{"modified record with earlier head",
+			lines[0] + strings.Replace(lines[1], `"outcome":200`, `"outcome":403`, 1),
+			key, []Head{middle}, 2, ErrHeadMismatch},
+		{"removed record", lines[0] + lines[2] + lines[3], key, nil, 2, ErrInvalidSequence},
+		{"reordered records", lines[1] + lines[0] + lines[2] + lines[3], key, nil, 1, ErrInvalidSequence},
+		{"truncated record", lines[0] + lines[1] + lines[2] + lines[3][:20], key, nil, 4, ErrTruncatedRecord},
+		{"truncated log", lines[0] + lines[1], key, []Head{middle, head}, 3, ErrTruncatedLog},
+		{"empty log", "", key, []Head{head}, 1, ErrTruncatedLog},
+		{"invalid record", lines[0] + "garbage\n", key, nil, 2, ErrInvalidRecord},
+		{"wrong key", string(content), []byte("wrong key"), nil, 2, ErrBrokenChain},
+	}
+	for _, tt := range tests {
+		_, err := Verify(strings.NewReader(tt.log), tt.key, tt.heads...)
+		vErr, ok := err.(*VerificationError)
+		if !ok || vErr.Line != tt.line || vErr.Err != tt.err {
+			t.Errorf("Verify() of %s: got [%v], want [line %d: %v]", tt.desc, err, tt.line, tt.err)
+		}
+	}
+}
+
+func TestOpenRejectsTamperedLog(t *testing.T) {
+	filename := filepath.Join(newTempDir(), "audit.log")
+	writeTestLog(filename, nil, testEvents, t)
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile(%q) failed: %v", filename, err)
+	}
+	tampered := strings.Replace(string(content), "share1", "share2", 1)
+	if err := ioutil.WriteFile(filename, []byte(tampered), 0600); err != nil {
+		t.Fatalf("WriteFile(%q) failed: %v", filename, err)
+	}
+	if _, err := Open(filename, Config{}); err == nil {
+		t.Errorf("Open() of tampered log: got no error, want %v", ErrBrokenChain)
+	}
+}
+
+func TestOpenRemovesPartialLastRecord(t *testing.T) {
+	filename := filepath.Join(newTempDir(), "audit.log")
+	key := []byte("audit key")
+	head := writeTestLog(filename, key, testEvents[:2], t)
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"seq":3,"time":`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	// The partial record is removed, and the log can be continued.
+	l, err := Open(filename, Config{Key: key})
+	if err != nil {
+		t.Fatalf("Open() of log with partial last record: %v", err)
+	}
+	if got := l.Head(); got != head {
+		t.Errorf("Head() after removing partial record: got %v, want %v", got, head)
+	}
+	if err := l.Audit(testEvents[2]); err != nil {
+		t.Fatalf("Audit() failed: %v", err)
+	}
+	l.Close()
+	f, err = os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if got, err := Verify(f, key, head); err != nil || got.Seq != 3 {
+		t.Errorf("Verify() of continued log: got [%v, %v], want a head with seq 3", got, err)
+	}
+}
+
+func TestHeadsAreExported(t *testing.T) {
+	filename := filepath.Join(newTempDir(), "audit.log")
+	heads := make(chan Head, 10)
+	l, err := Open(filename, Config{ExportHead: func(h Head) { heads <- h }, ExportInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Open(%q) failed: %v", filename, err)
+	}
+	if err := l.Audit(testEvents[0]); err != nil {
+		t.Fatalf("Audit() failed: %v", err)
+	}
+	select {
+	case head := <-heads:
+		if head != l.Head() {
+			t.Errorf("Exported head: got %v, want %v", head, l.Head())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Head was not exported periodically")
+	}
+	if err := l.Audit(testEvents[1]); err != nil {
+		t.Fatalf("Audit() failed: %v", err)
+	}
+	final := l.Head()
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	// The final head is exported by Close, possibly after the ticker did.
+	var last Head
+	for len(heads) > 0 {
+		last = <-heads
+	}
+	if last != final {
+		t.Errorf("Last exported head: got %v, want %v", last, final)
+	}
+}
+
+func TestParseHead(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	var tests = []struct {
+		s    string
+		head Head
+		err  error
+	}{
+		{"12:" + hash, Head{12, hash}, nil},
+		{" 0:" + hash + "\n", Head{0, hash}, nil},
+		{"12", Head{}, ErrInvalidHead},
+		{"x:" + hash, Head{}, ErrInvalidHead},
+		{"-1:" + hash, Head{}, ErrInvalidHead},
+		{"12:abcd", Head{}, ErrInvalidHead},
+		{"12:" + strings.Repeat("xy", 32), Head{}, ErrInvalidHead},
+		{"12:" + hash + ":1", Head{}, ErrInvalidHead},
+	}
+	for _, tt := range tests {
+		head, err := ParseHead(tt.s)
+		if err != tt.err || head != tt.head {
+			t.Errorf("ParseHead(%q): got %v (error: %v), want %v (error: %v)", tt.s, head, err, tt.head, tt.err)
+		}
+	}
+	if head, err := ParseHead(Head{12, hash}.String()); err != nil || head != (Head{12, hash}) {
+		t.Errorf("ParseHead(String()): got %v (error: %v), want 12:%s", head, err, hash)
+	}
+}
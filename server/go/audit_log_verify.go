@@ -0,0 +1,69 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Binary auditlog_verify verifies an audit log written by a Svalbard server,
+// and prints its head.  It detects modified records, and (given heads
+// recorded earlier) truncation of the log.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/google/svalbard/server/go/auditlog"
+	"github.com/google/svalbard/server/go/util"
+)
+
+func main() {
+	filename := flag.String("audit_log_file", "", "audit log file to verify")
+	keyFile := flag.String("audit_log_key_file", "", "file (or env:<variable>) with the key of the audit log, if any")
+	heads := flag.String("heads", "", "comma-separated list of heads <seq>:<hash> recorded earlier, which the log must still contain")
+	flag.Parse()
+	if *filename == "" {
+		log.Fatal("Please provide -audit_log_file")
+	}
+
+	var key []byte
+	if *keyFile != "" {
+		var err error
+		if key, err = util.ReadSecret(*keyFile); err != nil {
+			log.Fatalf("Could not read key: %v", err)
+		}
+	}
+	var expected []auditlog.Head
+	if *heads != "" {
+		for _, s := range strings.Split(*heads, ",") {
+			h, err := auditlog.ParseHead(s)
+			if err != nil {
+				log.Fatalf("Invalid head [%s]: %v", s, err)
+			}
+			expected = append(expected, h)
+		}
+	}
+	file, err := os.Open(*filename)
+	if err != nil {
+		log.Fatalf("Could not open audit log: %v", err)
+	}
+	defer file.Close()
+	head, err := auditlog.Verify(file, key, expected...)
+	if err != nil {
+		log.Fatalf("Verification of audit log failed: %v", err)
+	}
+	fmt.Printf("OK: %d records, head %v\n", head.Seq, head)
+}
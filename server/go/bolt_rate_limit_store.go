@@ -0,0 +1,111 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Package boltratelimitstore implements a ratelimit.Store that uses Bolt DB
+// for persisting the states of the buckets.
+package boltratelimitstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt/bolt"
+	"github.com/google/svalbard/server/go/ratelimit"
+)
+
+// bucketName is the name of the Bolt bucket with the states.
+var bucketName = []byte("SvalbardRateLimits")
+
+// ErrInvalidState is returned when a stored state cannot be decoded.
+var ErrInvalidState = errors.New("invalid stored rate limit state")
+
+// OpenOrCreate returns an instance of ratelimit.Store that stores the states
+// of the buckets in a Bolt database that keeps the data in the specified file.
+func OpenOrCreate(filename string) (*Bolt, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketName); err != nil {
+			return fmt.Errorf("Could not initialize Bolt DB: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Bolt{
+		db: db,
+	}, nil
+}
+
+// Bolt is a ratelimit.Store implementation that uses a Bolt DB.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// Load returns all the stored bucket states.
+func (rs *Bolt) Load() (map[string]ratelimit.BucketState, error) {
+	states := make(map[string]ratelimit.BucketState)
+	err := rs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).ForEach(func(k, v []byte) error {
+			if len(v) != 16 {
+				return ErrInvalidState
+			}
+			states[string(k)] = ratelimit.BucketState{
+				Tokens:  math.Float64frombits(binary.BigEndian.Uint64(v[:8])),
+				Updated: time.Unix(0, int64(binary.BigEndian.Uint64(v[8:]))),
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// Save replaces the stored bucket states with 'states'.
+func (rs *Bolt) Save(states map[string]ratelimit.BucketState) error {
+	return rs.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(bucketName); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucket(bucketName)
+		if err != nil {
+			return err
+		}
+		for key, state := range states {
+			v := make([]byte, 16)
+			binary.BigEndian.PutUint64(v[:8], math.Float64bits(state.Tokens))
+			binary.BigEndian.PutUint64(v[8:], uint64(state.Updated.UnixNano()))
+			if err := b.Put([]byte(key), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close closes the store.
+func (rs *Bolt) Close() error {
+	return rs.db.Close()
+}
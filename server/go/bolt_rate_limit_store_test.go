@@ -0,0 +1,81 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package boltratelimitstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/svalbard/server/go/ratelimit"
+)
+
+func getDBFilePath(filename string) string {
+	d, err := ioutil.TempDir("/tmp", "test-bolt-rate-limit-")
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create temp dir: %v", err))
+	}
+	return filepath.Join(d, filename)
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	dbFilePath := getDBFilePath("save_load_test.db")
+	rs, err := OpenOrCreate(dbFilePath)
+	if err != nil {
+		t.Fatalf("OpenOrCreate() failed: %v", err)
+	}
+	if states, err := rs.Load(); err != nil || len(states) != 0 {
+		t.Errorf("Load() of a new store: got %v (error: %v), want no states", states, err)
+	}
+	now := time.Unix(1500000000, 123456789)
+	var tests = []map[string]ratelimit.BucketState{
+		{"key1": {Tokens: 1.5, Updated: now}, "key2": {Tokens: 0, Updated: now.Add(time.Second)}},
+		{"key2": {Tokens: 0.25, Updated: now.Add(time.Minute)}, "key3": {Tokens: 42, Updated: now}},
+		{},
+	}
+	for _, states := range tests {
+		if err := rs.Save(states); err != nil {
+			t.Errorf("Save(%v) failed: %v", states, err)
+			continue
+		}
+		// Re-open the store, to make sure the states are persisted.
+		if err := rs.Close(); err != nil {
+			t.Fatalf("Close() failed: %v", err)
+		}
+		if rs, err = OpenOrCreate(dbFilePath); err != nil {
+			t.Fatalf("Re-opening failed: %v", err)
+		}
+		loaded, err := rs.Load()
+		if err != nil {
+			t.Errorf("Load() after Save(%v) failed: %v", states, err)
+			continue
+		}
+		for key, state := range loaded {
+			if !state.Updated.Equal(states[key].Updated) {
+				t.Errorf("Load() after Save(%v): got time %v for %v", states, state.Updated, key)
+			}
+			loaded[key] = ratelimit.BucketState{Tokens: state.Tokens, Updated: states[key].Updated}
+		}
+		if !reflect.DeepEqual(loaded, states) {
+			t.Errorf("Load() after Save(%v): got %v", states, loaded)
+		}
+	}
+	rs.Close()
+}
@@ -16,15 +16,96 @@
 
 // Package boltsharestore implements a store for shares of a Svalbard HTTP
 // server, that uses Bolt DB for persisting the data.
+//
+// Each share is stored as a record that carries the time at which the share
+// was stored, and a checksum over the share ID, the time and the value, so
+// that corrupted records are detected when they are read.  The version of the
+// layout of the DB is kept in a separate bucket; DBs using an older layout
+// have to be upgraded offline with Migrate (see svalbardctl).
 package boltsharestore
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
 
 	bolt "github.com/etcd-io/bbolt/bolt"
 	"github.com/google/svalbard/server/go/svalbardsrv"
 )
 
+// SchemaVersion is the version of the layout of the DBs written by this
+// package.  Version 1 stored the bare share values; version 2 stores them in
+// records with a creation time and a checksum.
+const SchemaVersion = 2
+
+var (
+	sharesBucket = []byte("SvalbardShares")
+	metaBucket   = []byte("SvalbardMeta")
+	// tombstonesBucket keeps the soft-deleted shares, keyed by share ID.
+	// It is created by the first soft deletion.
+	tombstonesBucket = []byte("SvalbardTombstones")
+	// ownersBucket indexes the shares by their owners, under keys of the form
+	// <owner key>\x00<share ID>, and shareOwnersBucket keeps the owner keys
+	// by share ID.  Both are created by the first share with an owner.
+	ownersBucket      = []byte("SvalbardOwners")
+	shareOwnersBucket = []byte("SvalbardShareOwners")
+	schemaVersionKey  = []byte("schema_version")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+var (
+	// ErrLocked is returned by Open if the DB file is locked by another
+	// process, usually by a running server.
+	ErrLocked = errors.New("share store is locked, probably by a running server")
+	// ErrNeedsMigration is returned when opening a DB with an older schema.
+	ErrNeedsMigration = errors.New("share store uses an older schema, please run 'svalbardctl migrate'")
+	// ErrUnknownSchema is returned when opening a DB with a schema newer than
+	// SchemaVersion.
+	ErrUnknownSchema = errors.New("share store uses an unknown schema")
+)
+
+// CorruptRecordError reports a record of a share that fails to decode or
+// does not match its checksum.
+type CorruptRecordError struct {
+	ShareID string
+	Reason  string
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("corrupt record of share %q: %s", e.ShareID, e.Reason)
+}
+
+// Options configure how Open accesses a DB file.
+type Options struct {
+	// ReadOnly opens the DB with a shared lock, which allows several
+	// readers but no writer.
+	ReadOnly bool
+	// LockTimeout is how long to wait for the lock of the DB file before
+	// failing with ErrLocked.  Zero means one second.
+	LockTimeout time.Duration
+}
+
+// Record is a share together with its metadata, as stored in the DB.
+type Record struct {
+	ShareID string
+	Value   string
+	// Created is the time at which the share was stored, rounded down to
+	// seconds.  It is zero for shares migrated from schema version 1.
+	Created time.Time
+	// PurgeAt is the purge time of the tombstone of a soft-deleted share, and
+	// zero for the shares that are not deleted.
+	PurgeAt time.Time
+	// OwnerKey is the key under which the share is indexed by its owner, or
+	// empty if the share is not indexed.
+	OwnerKey string
+}
+
 // OpenOrCreate returns an instance of ShareStore that stores the shares
 // in a Bolt database that keeps the data in the specified file.
 // The returned Bolt implements svalbardsrv.ShareStore-interface.
@@ -34,40 +115,486 @@ func OpenOrCreate(filename string) (*Bolt, error) {
 		return nil, err
 	}
 	err = db.Update(func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucketIfNotExists([]byte("SvalbardShares")); err != nil {
-			return fmt.Errorf("Could not initialize Bolt DB: %s", err)
+		switch b := tx.Bucket(sharesBucket); {
+		case b == nil:
+			return initialize(tx)
+		case tx.Bucket(metaBucket) == nil && b.Stats().KeyN == 0:
+			// An empty DB of schema version 1 needs no migration.
+			return setSchemaVersion(tx, SchemaVersion)
 		}
-		return nil
+		return checkSchema(tx)
 	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Bolt{
+		db:  db,
+		now: time.Now,
+	}, nil
+}
+
+// Open opens an existing share store for maintenance.  Unlike OpenOrCreate
+// it does not create a missing file, and it fails with ErrLocked rather than
+// waiting for a lock held by another process.
+func Open(filename string, options *Options) (*Bolt, error) {
+	db, err := openExisting(filename, options)
 	if err != nil {
 		return nil, err
 	}
+	if err := db.View(checkSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
 	return &Bolt{
-		db: db,
+		db:  db,
+		now: time.Now,
 	}, nil
 }
 
+func openExisting(filename string, options *Options) (*bolt.DB, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+	timeout := options.LockTimeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: timeout, ReadOnly: options.ReadOnly})
+	if err == bolt.ErrTimeout {
+		return nil, ErrLocked
+	}
+	return db, err
+}
+
+func initialize(tx *bolt.Tx) error {
+	if _, err := tx.CreateBucket(sharesBucket); err != nil {
+		return fmt.Errorf("Could not initialize Bolt DB: %s", err)
+	}
+	return setSchemaVersion(tx, SchemaVersion)
+}
+
+func setSchemaVersion(tx *bolt.Tx, version int) error {
+	b, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return fmt.Errorf("Could not initialize Bolt DB: %s", err)
+	}
+	return b.Put(schemaVersionKey, []byte(fmt.Sprint(version)))
+}
+
+// schemaVersion returns the version of the layout of the DB, or 0 if the DB
+// holds no shares bucket at all.
+func schemaVersion(tx *bolt.Tx) (int, error) {
+	if tx.Bucket(sharesBucket) == nil {
+		return 0, nil
+	}
+	meta := tx.Bucket(metaBucket)
+	if meta == nil {
+		return 1, nil
+	}
+	var version int
+	if _, err := fmt.Sscan(string(meta.Get(schemaVersionKey)), &version); err != nil || version < 1 {
+		return 0, fmt.Errorf("invalid schema version [%s]", meta.Get(schemaVersionKey))
+	}
+	return version, nil
+}
+
+func checkSchema(tx *bolt.Tx) error {
+	version, err := schemaVersion(tx)
+	switch {
+	case err != nil:
+		return err
+	case version == 0:
+		return fmt.Errorf("missing bucket %s", sharesBucket)
+	case version < SchemaVersion:
+		return ErrNeedsMigration
+	case version > SchemaVersion:
+		return ErrUnknownSchema
+	}
+	return nil
+}
+
+// Record layout (schema version 2):
+//
+//	[1 byte format][8 bytes created, Unix seconds][4 bytes CRC-32C][value]
+//
+// The checksum covers the share ID, the creation time and the value.
+const (
+	recordFormat     = 1
+	recordHeaderSize = 1 + 8 + 4
+)
+
+func checksum(shareID, created, value []byte) uint32 {
+	crc := crc32.Update(0, crcTable, shareID)
+	crc = crc32.Update(crc, crcTable, created)
+	return crc32.Update(crc, crcTable, value)
+}
+
+func encodeRecord(shareID string, value []byte, created time.Time) []byte {
+	buf := make([]byte, recordHeaderSize+len(value))
+	buf[0] = recordFormat
+	if !created.IsZero() {
+		binary.BigEndian.PutUint64(buf[1:9], uint64(created.Unix()))
+	}
+	binary.BigEndian.PutUint32(buf[9:13], checksum([]byte(shareID), buf[1:9], value))
+	copy(buf[recordHeaderSize:], value)
+	return buf
+}
+
+func decodeRecord(shareID, data []byte) (Record, error) {
+	fail := func(reason string) (Record, error) {
+		return Record{}, &CorruptRecordError{ShareID: string(shareID), Reason: reason}
+	}
+	if len(data) < recordHeaderSize {
+		return fail("record too short")
+	}
+	if data[0] != recordFormat {
+		return fail(fmt.Sprintf("unknown record format %d", data[0]))
+	}
+	value := data[recordHeaderSize:]
+	if len(value) == 0 {
+		return fail("empty value")
+	}
+	if binary.BigEndian.Uint32(data[9:13]) != checksum(shareID, data[1:9], value) {
+		return fail("checksum mismatch")
+	}
+	r := Record{ShareID: string(shareID), Value: string(value)}
+	if secs := binary.BigEndian.Uint64(data[1:9]); secs != 0 {
+		r.Created = time.Unix(int64(secs), 0)
+	}
+	return r, nil
+}
+
+// migrations[i] upgrades the DB from schema version i+1 to version i+2.
+var migrations = []func(tx *bolt.Tx) error{
+	// Version 1 to 2: wrap the bare values into records of unknown age.
+	func(tx *bolt.Tx) error {
+		b := tx.Bucket(sharesBucket)
+		var keys, values [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			keys = append(keys, append([]byte(nil), k...))
+			values = append(values, encodeRecord(string(k), v, time.Time{}))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i := range keys {
+			if err := b.Put(keys[i], values[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// Migrate upgrades the DB in the given file to SchemaVersion, in a single
+// transaction.  It returns the schema version the DB had before, and fails
+// with ErrLocked if the DB is in use.
+func Migrate(filename string, options *Options) (int, error) {
+	db, err := openExisting(filename, options)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	var from int
+	err = db.Update(func(tx *bolt.Tx) error {
+		if from, err = schemaVersion(tx); err != nil {
+			return err
+		}
+		switch {
+		case from == 0:
+			return fmt.Errorf("missing bucket %s", sharesBucket)
+		case from > SchemaVersion:
+			return ErrUnknownSchema
+		}
+		for v := from; v < SchemaVersion; v++ {
+			if err := migrations[v-1](tx); err != nil {
+				return fmt.Errorf("migration from schema version %d failed: %v", v, err)
+			}
+		}
+		return setSchemaVersion(tx, SchemaVersion)
+	})
+	return from, err
+}
+
+// Compact rewrites the DB in the given file into a new file without free
+// pages, and replaces the original file with it.  It returns the sizes of
+// the file before and after, and fails with ErrLocked if the DB is in use.
+func Compact(filename string, options *Options) (int64, int64, error) {
+	src, err := openExisting(filename, options)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer src.Close()
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	tmpFilename := filename + ".compact"
+	os.Remove(tmpFilename)
+	dst, err := bolt.Open(tmpFilename, info.Mode(), nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = src.View(func(srcTx *bolt.Tx) error {
+		return dst.Update(func(dstTx *bolt.Tx) error {
+			return srcTx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				nb, err := dstTx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(nb, b)
+			})
+		})
+	})
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return 0, 0, fmt.Errorf("Could not compact Bolt DB: %v", err)
+	}
+	compacted, err := os.Stat(tmpFilename)
+	if err != nil {
+		return 0, 0, err
+	}
+	// The lock on the original file is held until the rename is done.
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		os.Remove(tmpFilename)
+		return 0, 0, err
+	}
+	return info.Size(), compacted.Size(), nil
+}
+
+func copyBucket(dst, src *bolt.Bucket) error {
+	// The keys are copied in order, so the pages can be filled completely.
+	dst.FillPercent = 1.0
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			nb, err := dst.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			return copyBucket(nb, src.Bucket(k))
+		}
+		return dst.Put(k, v)
+	})
+}
+
 // Bolt is a ShareStore implementation that uses a Bolt DB to store the shares.
 type Bolt struct {
-	db *bolt.DB
+	db                *bolt.DB
+	now               func() time.Time
+	maxSharesPerOwner int
+	maxSize           int64
+	metadataPrefix    string
+}
+
+// SetMetadataPrefix marks the records whose share IDs start with 'prefix' as
+// metadata of other shares (see shareexpiry), which Stats and Verify do not
+// count as shares.  It must be called before the store is used.
+func (ss *Bolt) SetMetadataPrefix(prefix string) {
+	ss.metadataPrefix = prefix
+}
+
+// isMetadata returns true if the record of 'shareID' holds metadata.
+func (ss *Bolt) isMetadata(shareID []byte) bool {
+	return ss.metadataPrefix != "" && bytes.HasPrefix(shareID, []byte(ss.metadataPrefix))
+}
+
+// SetMaxSharesPerOwner sets the maximal number of shares that StoreForOwner
+// indexes under a single owner to 'n' (unlimited if 0).  It must be called
+// before the store is used.
+func (ss *Bolt) SetMaxSharesPerOwner(n int) {
+	ss.maxSharesPerOwner = n
+}
+
+// SetMaxSize sets the maximal size of the data in the DB to 'bytes'
+// (unlimited if 0).  Shares that would exceed it are not stored, while
+// deletions remain possible.  The size excludes the free pages of the DB
+// file, so the file itself can be larger.  It must be called before the
+// store is used.
+func (ss *Bolt) SetMaxSize(bytes int64) {
+	ss.maxSize = bytes
 }
 
 // Store stores the given 'shareValue' under the specified 'shareID'.
 func (ss *Bolt) Store(shareID, shareValue string) error {
+	return ss.StoreForOwner(shareID, shareValue, "")
+}
+
+// StoreForOwner stores the given 'shareValue' under the specified 'shareID',
+// and indexes it under 'ownerKey', unless it is empty.
+func (ss *Bolt) StoreForOwner(shareID, shareValue, ownerKey string) error {
 	if shareID == "" {
 		return svalbardsrv.ErrInvalidShareID
 	}
 	if shareValue == "" {
 		return svalbardsrv.ErrInvalidShareValue
 	}
-	err := ss.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("SvalbardShares"))
-		if v := b.Get([]byte(shareID)); v != nil {
-			return svalbardsrv.ErrShareAlreadyExists
+	return ss.db.Update(func(tx *bolt.Tx) error {
+		return ss.add(tx, shareID, shareValue, ownerKey)
+	})
+}
+
+// Replace replaces the value of the share identified by 'shareID' with
+// 'shareValue', keeping its creation time, or stores it like Store if there
+// is no such share.  The maximal size of the DB is checked only for new
+// shares.
+func (ss *Bolt) Replace(shareID, shareValue string) error {
+	if shareID == "" {
+		return svalbardsrv.ErrInvalidShareID
+	}
+	if shareValue == "" {
+		return svalbardsrv.ErrInvalidShareValue
+	}
+	return ss.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(sharesBucket)
+		data := b.Get([]byte(shareID))
+		if data == nil {
+			return ss.add(tx, shareID, shareValue, "")
+		}
+		created := ss.now()
+		if r, err := decodeRecord([]byte(shareID), data); err == nil {
+			created = r.Created
 		}
-		return b.Put([]byte(shareID), []byte(shareValue))
+		return b.Put([]byte(shareID), encodeRecord(shareID, []byte(shareValue), created))
 	})
-	return err
+}
+
+// add stores 'shareValue' under 'shareID' within 'tx', indexed under
+// 'ownerKey' unless it is empty.
+func (ss *Bolt) add(tx *bolt.Tx, shareID, shareValue, ownerKey string) error {
+	b := tx.Bucket(sharesBucket)
+	if v := b.Get([]byte(shareID)); v != nil {
+		return svalbardsrv.ErrShareAlreadyExists
+	}
+	// A new share replaces the tombstone of a deleted one.
+	if t := tx.Bucket(tombstonesBucket); t != nil && t.Get([]byte(shareID)) != nil {
+		if err := t.Delete([]byte(shareID)); err != nil {
+			return err
+		}
+		if err := unindex(tx, shareID); err != nil {
+			return err
+		}
+	}
+	if ss.maxSize > 0 && usedSize(tx)+int64(len(shareValue)) > ss.maxSize {
+		return svalbardsrv.ErrStoreFull
+	}
+	if ownerKey != "" {
+		if err := ss.index(tx, shareID, ownerKey); err != nil {
+			return err
+		}
+	}
+	return b.Put([]byte(shareID), encodeRecord(shareID, []byte(shareValue), ss.now()))
+}
+
+// CheckCapacity returns ErrQuotaExceeded if the owner with 'ownerKey' has
+// the maximal number of shares besides the one identified by 'shareID', and
+// ErrStoreFull if the data in the DB has the maximal size.
+func (ss *Bolt) CheckCapacity(shareID, ownerKey string) error {
+	return ss.db.View(func(tx *bolt.Tx) error {
+		if ss.maxSize > 0 && usedSize(tx) >= ss.maxSize {
+			return svalbardsrv.ErrStoreFull
+		}
+		owners := tx.Bucket(ownersBucket)
+		if ss.maxSharesPerOwner == 0 || owners == nil {
+			return nil
+		}
+		n := countOwnerShares(owners, ownerKey)
+		if shareOwners := tx.Bucket(shareOwnersBucket); shareOwners != nil &&
+			string(shareOwners.Get([]byte(shareID))) == ownerKey {
+			n--
+		}
+		if n >= ss.maxSharesPerOwner {
+			return svalbardsrv.ErrQuotaExceeded
+		}
+		return nil
+	})
+}
+
+// usedSize returns the size of the data in the DB, i.e. the size of the DB
+// without the free pages.
+func usedSize(tx *bolt.Tx) int64 {
+	stats := tx.DB().Stats()
+	free := int64(stats.FreePageN+stats.PendingPageN) * int64(tx.DB().Info().PageSize)
+	return tx.Size() - free
+}
+
+// ownerIndexKey returns the key of the share identified by 'shareID' in the
+// index of the shares of the owner with 'ownerKey'.
+func ownerIndexKey(ownerKey, shareID string) []byte {
+	return []byte(ownerKey + "\x00" + shareID)
+}
+
+// index indexes the share identified by 'shareID' under 'ownerKey', unless
+// the owner has the maximal number of shares already.
+func (ss *Bolt) index(tx *bolt.Tx, shareID, ownerKey string) error {
+	owners, err := tx.CreateBucketIfNotExists(ownersBucket)
+	if err != nil {
+		return err
+	}
+	shareOwners, err := tx.CreateBucketIfNotExists(shareOwnersBucket)
+	if err != nil {
+		return err
+	}
+	if ss.maxSharesPerOwner > 0 && countOwnerShares(owners, ownerKey) >= ss.maxSharesPerOwner {
+		return svalbardsrv.ErrQuotaExceeded
+	}
+	if err := owners.Put(ownerIndexKey(ownerKey, shareID), nil); err != nil {
+		return err
+	}
+	return shareOwners.Put([]byte(shareID), []byte(ownerKey))
+}
+
+// countOwnerShares returns the number of shares indexed under 'ownerKey'.
+func countOwnerShares(owners *bolt.Bucket, ownerKey string) int {
+	n := 0
+	prefix := ownerIndexKey(ownerKey, "")
+	c := owners.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		n++
+	}
+	return n
+}
+
+// unindex removes the share identified by 'shareID' from the index of its
+// owner, if any.
+func unindex(tx *bolt.Tx, shareID string) error {
+	shareOwners := tx.Bucket(shareOwnersBucket)
+	if shareOwners == nil {
+		return nil
+	}
+	ownerKey := shareOwners.Get([]byte(shareID))
+	if ownerKey == nil {
+		return nil
+	}
+	if err := tx.Bucket(ownersBucket).Delete(ownerIndexKey(string(ownerKey), shareID)); err != nil {
+		return err
+	}
+	return shareOwners.Delete([]byte(shareID))
+}
+
+// OwnerShareIDs returns the ids of the shares indexed under 'ownerKey', sorted.
+func (ss *Bolt) OwnerShareIDs(ownerKey string) ([]string, error) {
+	var ids []string
+	err := ss.db.View(func(tx *bolt.Tx) error {
+		owners := tx.Bucket(ownersBucket)
+		if owners == nil {
+			return nil
+		}
+		prefix := ownerIndexKey(ownerKey, "")
+		c := owners.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			ids = append(ids, string(k[len(prefix):]))
+		}
+		return nil
+	})
+	return ids, err
 }
 
 // Retrieve returns the value of the share identified by 'shareID',
@@ -79,17 +606,32 @@ func (ss *Bolt) Retrieve(shareID string) (string, error) {
 	}
 	var shareValue string
 	err := ss.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("SvalbardShares"))
+		b := tx.Bucket(sharesBucket)
 		v := b.Get([]byte(shareID))
 		if v == nil {
 			return svalbardsrv.ErrShareNotFound
 		}
-		shareValue = string(v)
-		return nil
+		r, err := decodeRecord([]byte(shareID), v)
+		shareValue = r.Value
+		return err
 	})
 	return shareValue, err
 }
 
+// Contains returns true if the share identified by 'shareID' is present
+// in the store, without retrieving its value.
+func (ss *Bolt) Contains(shareID string) (bool, error) {
+	if shareID == "" {
+		return false, svalbardsrv.ErrInvalidShareID
+	}
+	var shareExists bool
+	err := ss.db.View(func(tx *bolt.Tx) error {
+		shareExists = tx.Bucket(sharesBucket).Get([]byte(shareID)) != nil
+		return nil
+	})
+	return shareExists, err
+}
+
 // Delete removes from the store the share identified by 'shareID',
 // if it is present in the store.  If no share is present, or if the
 // deletion fails for some reason, it returns an error message.
@@ -98,15 +640,410 @@ func (ss *Bolt) Delete(shareID string) error {
 		return svalbardsrv.ErrInvalidShareID
 	}
 	err := ss.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("SvalbardShares"))
+		b := tx.Bucket(sharesBucket)
 		if v := b.Get([]byte(shareID)); v == nil {
 			return svalbardsrv.ErrShareNotFound
 		}
+		if err := unindex(tx, shareID); err != nil {
+			return err
+		}
 		return b.Delete([]byte(shareID))
 	})
 	return err
 }
 
+// Count returns the number of shares in the store.
+func (ss *Bolt) Count() (int, error) {
+	var n int
+	err := ss.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(sharesBucket).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+// ShareIDs returns the ids of all shares in the store, sorted.
+func (ss *Bolt) ShareIDs() ([]string, error) {
+	var ids []string
+	err := ss.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sharesBucket).ForEach(func(k, v []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	return ids, err
+}
+
+// A tombstone is the purge time as 8 bytes of Unix time, followed by the
+// record of the share as it was before the deletion.
+const purgeTimeSize = 8
+
+// SoftDelete removes from the store the share identified by 'shareID',
+// but keeps its record as a tombstone until 'purgeAt'.
+func (ss *Bolt) SoftDelete(shareID string, purgeAt time.Time) error {
+	if shareID == "" {
+		return svalbardsrv.ErrInvalidShareID
+	}
+	return ss.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(sharesBucket)
+		v := b.Get([]byte(shareID))
+		if v == nil {
+			return svalbardsrv.ErrShareNotFound
+		}
+		t, err := tx.CreateBucketIfNotExists(tombstonesBucket)
+		if err != nil {
+			return err
+		}
+		tombstone := make([]byte, purgeTimeSize, purgeTimeSize+len(v))
+		binary.BigEndian.PutUint64(tombstone, uint64(purgeAt.Unix()))
+		if err := t.Put([]byte(shareID), append(tombstone, v...)); err != nil {
+			return err
+		}
+		return b.Delete([]byte(shareID))
+	})
+}
+
+// Undelete restores the record of the share identified by 'shareID' from
+// its tombstone, if the tombstone is not due for purging at 'now'.
+func (ss *Bolt) Undelete(shareID string, now time.Time) error {
+	if shareID == "" {
+		return svalbardsrv.ErrInvalidShareID
+	}
+	return ss.db.Update(func(tx *bolt.Tx) error {
+		t := tx.Bucket(tombstonesBucket)
+		if t == nil {
+			return svalbardsrv.ErrShareNotFound
+		}
+		v := t.Get([]byte(shareID))
+		if v == nil || !decodePurgeTime(v).After(now) {
+			return svalbardsrv.ErrShareNotFound
+		}
+		b := tx.Bucket(sharesBucket)
+		if b.Get([]byte(shareID)) != nil {
+			return svalbardsrv.ErrShareAlreadyExists
+		}
+		// Put needs a copy, as v is invalidated by the deletion.
+		record := append([]byte(nil), v[purgeTimeSize:]...)
+		if err := t.Delete([]byte(shareID)); err != nil {
+			return err
+		}
+		return b.Put([]byte(shareID), record)
+	})
+}
+
+// PurgeTime returns the purge time of the tombstone of the share identified
+// by 'shareID'.
+func (ss *Bolt) PurgeTime(shareID string) (time.Time, error) {
+	if shareID == "" {
+		return time.Time{}, svalbardsrv.ErrInvalidShareID
+	}
+	var purgeAt time.Time
+	err := ss.db.View(func(tx *bolt.Tx) error {
+		t := tx.Bucket(tombstonesBucket)
+		if t == nil {
+			return svalbardsrv.ErrShareNotFound
+		}
+		v := t.Get([]byte(shareID))
+		if v == nil {
+			return svalbardsrv.ErrShareNotFound
+		}
+		purgeAt = decodePurgeTime(v)
+		return nil
+	})
+	return purgeAt, err
+}
+
+// Purge removes the tombstones that are due for purging at 'now', in a
+// single transaction.
+func (ss *Bolt) Purge(now time.Time) (int, error) {
+	n := 0
+	err := ss.db.Update(func(tx *bolt.Tx) error {
+		t := tx.Bucket(tombstonesBucket)
+		if t == nil {
+			return nil
+		}
+		// Keys must not be deleted while iterating over the bucket.
+		var due [][]byte
+		if err := t.ForEach(func(k, v []byte) error {
+			if !decodePurgeTime(v).After(now) {
+				due = append(due, append([]byte(nil), k...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range due {
+			if err := t.Delete(k); err != nil {
+				return err
+			}
+			if err := unindex(tx, string(k)); err != nil {
+				return err
+			}
+		}
+		n = len(due)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// decodePurgeTime returns the purge time of 'tombstone', or the zero time
+// (i.e. due for purging) if it is truncated.
+func decodePurgeTime(tombstone []byte) time.Time {
+	if len(tombstone) < purgeTimeSize {
+		return time.Time{}
+	}
+	return time.Unix(int64(binary.BigEndian.Uint64(tombstone)), 0)
+}
+
+// decodeTombstone returns the record kept in 'tombstone', with its purge time.
+func decodeTombstone(shareID, tombstone []byte) (Record, error) {
+	if len(tombstone) < purgeTimeSize {
+		return Record{}, &CorruptRecordError{ShareID: string(shareID), Reason: "tombstone too short"}
+	}
+	r, err := decodeRecord(shareID, tombstone[purgeTimeSize:])
+	if err != nil {
+		return Record{}, err
+	}
+	r.PurgeAt = decodePurgeTime(tombstone)
+	return r, nil
+}
+
+// AgeBuckets are the upper bounds of the age ranges of Stats.AgeHistogram.
+var AgeBuckets = []time.Duration{
+	24 * time.Hour,
+	7 * 24 * time.Hour,
+	30 * 24 * time.Hour,
+	90 * 24 * time.Hour,
+	365 * 24 * time.Hour,
+}
+
+// Stats summarizes the contents of a share store.
+type Stats struct {
+	SchemaVersion int
+	// DBBytes is the size of the data in the DB file, including free pages.
+	DBBytes      int64
+	Shares       int
+	ValueBytes   int64
+	LargestValue int
+	// Oldest is the creation time of the oldest share of known age.
+	Oldest time.Time
+	// AgeHistogram[i] counts the shares younger than AgeBuckets[i] (and not
+	// counted in AgeHistogram[i-1]); the last entry counts the older shares.
+	AgeHistogram []int
+	// UnknownAge counts the shares migrated from schema version 1.
+	UnknownAge int
+	// Corrupt counts the records that failed to decode; see Verify.
+	Corrupt int
+	// MetadataRecords counts the records of metadata (see SetMetadataPrefix),
+	// which are not counted as shares.
+	MetadataRecords int
+	// DeletedShares counts the tombstones of soft-deleted shares.
+	DeletedShares int
+}
+
+// Stats returns statistics about the shares in the store.
+func (ss *Bolt) Stats() (*Stats, error) {
+	now := ss.now()
+	st := &Stats{
+		SchemaVersion: SchemaVersion,
+		AgeHistogram:  make([]int, len(AgeBuckets)+1),
+	}
+	err := ss.db.View(func(tx *bolt.Tx) error {
+		st.DBBytes = tx.Size()
+		if t := tx.Bucket(tombstonesBucket); t != nil {
+			st.DeletedShares = t.Stats().KeyN
+		}
+		return tx.Bucket(sharesBucket).ForEach(func(k, v []byte) error {
+			r, err := decodeRecord(k, v)
+			if err != nil {
+				st.Corrupt++
+				return nil
+			}
+			if ss.isMetadata(k) {
+				st.MetadataRecords++
+				return nil
+			}
+			st.Shares++
+			st.ValueBytes += int64(len(r.Value))
+			if len(r.Value) > st.LargestValue {
+				st.LargestValue = len(r.Value)
+			}
+			if r.Created.IsZero() {
+				st.UnknownAge++
+				return nil
+			}
+			if st.Oldest.IsZero() || r.Created.Before(st.Oldest) {
+				st.Oldest = r.Created
+			}
+			i, age := 0, now.Sub(r.Created)
+			for i < len(AgeBuckets) && age >= AgeBuckets[i] {
+				i++
+			}
+			st.AgeHistogram[i]++
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// ForEach calls fn for every record in the store within a single read
+// transaction: first for the shares in the order of their IDs, then for the
+// tombstones of the soft-deleted shares (with PurgeAt set) in the order of
+// their IDs.  The records carry the owner keys of the indexed shares.  It
+// stops at the first error of fn, or at the first record that fails to
+// decode (with a *CorruptRecordError).
+func (ss *Bolt) ForEach(fn func(Record) error) error {
+	return ss.db.View(func(tx *bolt.Tx) error {
+		shareOwners := tx.Bucket(shareOwnersBucket)
+		visit := func(r Record, err error) error {
+			if err != nil {
+				return err
+			}
+			if shareOwners != nil {
+				r.OwnerKey = string(shareOwners.Get([]byte(r.ShareID)))
+			}
+			return fn(r)
+		}
+		if err := tx.Bucket(sharesBucket).ForEach(func(k, v []byte) error {
+			return visit(decodeRecord(k, v))
+		}); err != nil {
+			return err
+		}
+		t := tx.Bucket(tombstonesBucket)
+		if t == nil {
+			return nil
+		}
+		return t.ForEach(func(k, v []byte) error {
+			return visit(decodeTombstone(k, v))
+		})
+	})
+}
+
+// Verify checks the consistency of the pages of the DB, and that every
+// record, including the tombstones, decodes and matches its checksum.  It
+// returns the number of shares checked, which excludes the metadata records
+// (see SetMetadataPrefix) and the tombstones, and the problems found; the
+// error is non-nil only if the verification itself could not be run.
+func (ss *Bolt) Verify() (int, []error, error) {
+	var n int
+	var problems []error
+	err := ss.db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			problems = append(problems, err)
+		}
+		if err := tx.Bucket(sharesBucket).ForEach(func(k, v []byte) error {
+			if !ss.isMetadata(k) {
+				n++
+			}
+			if _, err := decodeRecord(k, v); err != nil {
+				problems = append(problems, err)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		t := tx.Bucket(tombstonesBucket)
+		if t == nil {
+			return nil
+		}
+		return t.ForEach(func(k, v []byte) error {
+			if _, err := decodeTombstone(k, v); err != nil {
+				problems = append(problems, err)
+			}
+			return nil
+		})
+	})
+	return n, problems, err
+}
+
+// Import stores the given records, keeping their creation times, in a
+// single transaction: if any of the shares exists already (or has a
+// tombstone), or any record is invalid, nothing is stored.  Records with
+// PurgeAt set are stored as tombstones, and records with OwnerKey set are
+// indexed under it.
+func (ss *Bolt) Import(records []Record) error {
+	return ss.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(sharesBucket)
+		t, err := tx.CreateBucketIfNotExists(tombstonesBucket)
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			var err error
+			switch {
+			case r.ShareID == "":
+				err = svalbardsrv.ErrInvalidShareID
+			case r.Value == "":
+				err = svalbardsrv.ErrInvalidShareValue
+			case b.Get([]byte(r.ShareID)) != nil || t.Get([]byte(r.ShareID)) != nil:
+				err = svalbardsrv.ErrShareAlreadyExists
+			case r.PurgeAt.IsZero():
+				err = b.Put([]byte(r.ShareID), encodeRecord(r.ShareID, []byte(r.Value), r.Created))
+			default:
+				tombstone := make([]byte, purgeTimeSize)
+				binary.BigEndian.PutUint64(tombstone, uint64(r.PurgeAt.Unix()))
+				err = t.Put([]byte(r.ShareID), append(tombstone, encodeRecord(r.ShareID, []byte(r.Value), r.Created)...))
+			}
+			if err == nil && r.OwnerKey != "" {
+				err = ss.index(tx, r.ShareID, r.OwnerKey)
+			}
+			if err != nil {
+				return fmt.Errorf("Could not import share %q: %v", r.ShareID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Snapshot is a consistent view of a share store, as seen by a single read
+// transaction.  Writes to the store proceed while the snapshot is open.
+type Snapshot struct {
+	tx *bolt.Tx
+	// Size is the size of the DB file that WriteTo writes.
+	Size int64
+	// Shares is the number of shares in the snapshot.
+	Shares int
+	// TxID is the id of the last transaction committed to the snapshot.
+	TxID int
+}
+
+// WriteTo writes the DB file of the snapshot to w.  The result can be opened
+// with OpenOrCreate or Open.
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	return s.tx.WriteTo(w)
+}
+
+// Snapshot calls fn with a snapshot of the store, which is valid only until
+// fn returns.  While a snapshot is open, the pages freed by writes cannot be
+// reused, so the DB file may grow.
+func (ss *Bolt) Snapshot(fn func(s *Snapshot) error) error {
+	return ss.db.View(func(tx *bolt.Tx) error {
+		return fn(&Snapshot{
+			tx:     tx,
+			Size:   tx.Size(),
+			Shares: tx.Bucket(sharesBucket).Stats().KeyN,
+			TxID:   tx.ID(),
+		})
+	})
+}
+
+// CheckHealth returns nil if the underlying Bolt DB is open and writable.
+// It commits an empty write transaction, which writes the meta page of the DB.
+func (ss *Bolt) CheckHealth() error {
+	return ss.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(sharesBucket) == nil {
+			return fmt.Errorf("missing bucket SvalbardShares")
+		}
+		return nil
+	})
+}
+
 // Close closes the underlying Bolt DB, releasing the corresponding resources.
 // After Close() the ShareStore cannot be accessed any more.
 func (ss *Bolt) Close() error {
@@ -19,14 +19,18 @@ package boltsharestore
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	bolt "github.com/etcd-io/bbolt/bolt"
+	"github.com/google/svalbard/server/go/sharestoretest"
 	"github.com/google/svalbard/server/go/svalbardsrv"
 )
 
-// TODO: Add TSAN tests.
-
 func getDBFilePath(filename string) string {
 	d, err := ioutil.TempDir("/tmp", "test-bolt-")
 	if err != nil {
@@ -35,225 +39,360 @@ func getDBFilePath(filename string) string {
 	return filepath.Join(d, filename)
 }
 
-func TestBoltStoresAndRetrievesShares(t *testing.T) {
-	s, err := OpenOrCreate(getDBFilePath("store_and_retrieve_test.db"))
+func TestBoltShareStore(t *testing.T) {
+	sharestoretest.Run(t, sharestoretest.Factory{
+		New: func(t *testing.T) svalbardsrv.ShareStore {
+			s, err := OpenOrCreate(getDBFilePath("conformance_test.db"))
+			if err != nil {
+				t.Fatalf("Failed to open DB: %v", err)
+			}
+			return s
+		},
+		Reopen: func(t *testing.T, s svalbardsrv.ShareStore) svalbardsrv.ShareStore {
+			filename := s.(*Bolt).db.Path()
+			if err := s.(*Bolt).Close(); err != nil {
+				t.Fatalf("Failed to close DB: %v", err)
+			}
+			s, err := OpenOrCreate(filename)
+			if err != nil {
+				t.Fatalf("Failed to re-open DB: %v", err)
+			}
+			return s
+		},
+	})
+}
+
+func TestBoltCheckHealth(t *testing.T) {
+	s, err := OpenOrCreate(getDBFilePath("health_test.db"))
 	if err != nil {
 		t.Fatalf("Failed to open DB: %v", err)
 	}
-	tests := []struct {
-		op      string // Operation on a ShareStore object
-		shareID string
-		value   string
-	}{
-		// Add share42 and verify it exitsts.
-		{"Store", "share42", "some value"},
-		{"Retrieve", "share42", "some value"},
-		// Add share23 and verify it exitsts.
-		{"Store", "share23", "some other value"},
-		{"Retrieve", "share23", "some other value"},
-		// Add a bunch of new shares.
-		{"Store", "share1", "some value 1"},
-		{"Store", "share2", "some value 2"},
-		{"Store", "share3", "some value 3"},
-		{"Store", "share4", "some value 4"},
-		{"Store", "share5", "some value 5"},
-		{"Store", "share6", "some value 6"},
-		{"Store", "share7", "some value 7"},
-		{"Store", "share8", "some value 8"},
-		{"Store", "share9", "some value 9"},
-		// Check all stored shares exist.
-		{"Retrieve", "share42", "some value"},
-		{"Retrieve", "share23", "some other value"},
-		{"Retrieve", "share1", "some value 1"},
-		{"Retrieve", "share2", "some value 2"},
-		{"Retrieve", "share3", "some value 3"},
-		{"Retrieve", "share4", "some value 4"},
-		{"Retrieve", "share5", "some value 5"},
-		{"Retrieve", "share6", "some value 6"},
-		{"Retrieve", "share7", "some value 7"},
-		{"Retrieve", "share8", "some value 8"},
-		{"Retrieve", "share9", "some value 9"},
+	if err := s.CheckHealth(); err != nil {
+		t.Errorf("CheckHealth(): got [%v], want [nil]", err)
 	}
-	for i, tt := range tests {
-		var err error
-		var value string
-		switch tt.op {
-		case "Store":
-			err = s.Store(tt.shareID, tt.value)
-		case "Retrieve":
-			value, err = s.Retrieve(tt.shareID)
-		default:
-			panic("Unknown operation: " + tt.op)
-		}
+	s.Close()
+	if err := s.CheckHealth(); err == nil {
+		t.Errorf("CheckHealth() after Close(): got [nil], want error")
+	}
+}
+
+// createSchemaV1 creates a DB as written before records had metadata.
+func createSchemaV1(t *testing.T, filename string, shares map[string]string) {
+	db, err := bolt.Open(filename, 0600, nil)
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(sharesBucket)
 		if err != nil {
-			t.Errorf("Unexpected err of test #%d, %s(%q): %q", i, tt.op, tt.shareID, err)
+			return err
 		}
-		if tt.op == "Retrieve" && err == nil && value != tt.value {
-			t.Errorf("Unexpected value of test #%d, Retrieve(%q): got [%q], want[%q]",
-				i, tt.shareID, value, tt.value)
+		for id, value := range shares {
+			if err := b.Put([]byte(id), []byte(value)); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to fill DB: %v", err)
 	}
 }
 
-func TestDBClosingAndReopening(t *testing.T) {
-	dbFilePath := getDBFilePath("reopen_store_test.db")
-	shares := []struct {
-		shareID string
-		value   string
-	}{
-		{"share42", "some value"},
-		{"share23", "some other value"},
-		{"share1", "some value 1"},
-		{"share2", "some value 2"},
-		{"share3", "some value 3"},
-		{"share4", "some value 4"},
-		{"share5", "some value 5"},
-		{"share6", "some value 6"},
-		{"share7", "some value 7"},
-		{"share8", "some value 8"},
-		{"share9", "some value 9"},
-	}
-	// Create the ShareStore, and insert the shares.
-	ss, err := OpenOrCreate(dbFilePath)
+func TestBoltMigrate(t *testing.T) {
+	shares := map[string]string{"share1": "some value 1", "share2": "some value 2"}
+	dbFilePath := getDBFilePath("migrate_test.db")
+	createSchemaV1(t, dbFilePath, shares)
+	if _, err := OpenOrCreate(dbFilePath); err != ErrNeedsMigration {
+		t.Fatalf("OpenOrCreate() of schema version 1: got [%v], want [%v]", err, ErrNeedsMigration)
+	}
+	if _, err := Open(dbFilePath, nil); err != ErrNeedsMigration {
+		t.Fatalf("Open() of schema version 1: got [%v], want [%v]", err, ErrNeedsMigration)
+	}
+	for _, want := range []int{1, SchemaVersion} {
+		if from, err := Migrate(dbFilePath, nil); from != want || err != nil {
+			t.Errorf("Migrate(): got [%v, %v], want [%v, nil]", from, err, want)
+		}
+	}
+	s, err := OpenOrCreate(dbFilePath)
 	if err != nil {
-		t.Fatalf("Failed to create ShareStore: %v", err)
+		t.Fatalf("Failed to open migrated DB: %v", err)
 	}
-	for i, s := range shares {
-		if err := ss.Store(s.shareID, s.value); err != nil {
-			t.Errorf("Unexpected err of test #%d, Store(%q): %q", i, s.shareID, err)
+	defer s.Close()
+	for id, want := range shares {
+		if got, err := s.Retrieve(id); got != want || err != nil {
+			t.Errorf("Retrieve(%q): got [%q, %v], want [%q, nil]", id, got, err, want)
 		}
 	}
-	if err := ss.Close(); err != nil {
-		t.Fatalf("Failed to close the ShareStore: %v", err)
+	if st, err := s.Stats(); err != nil || st.UnknownAge != len(shares) {
+		t.Errorf("Stats().UnknownAge: got [%v, %v], want [%v, nil]", st, err, len(shares))
 	}
 
-	// Re-open the ShareStore, and verify the shares exist.
-	ss, err = OpenOrCreate(dbFilePath)
+	// An empty DB of schema version 1 is upgraded without migration.
+	dbFilePath = getDBFilePath("migrate_empty_test.db")
+	createSchemaV1(t, dbFilePath, nil)
+	s, err = OpenOrCreate(dbFilePath)
 	if err != nil {
-		t.Fatalf("Failed to re-open the ShareStore: %v", err)
+		t.Fatalf("OpenOrCreate() of empty schema version 1: got [%v], want [nil]", err)
 	}
-	for i, s := range shares {
-		value, err := ss.Retrieve(s.shareID)
-		if err != nil {
-			t.Errorf("Unexpected err of test #%d, Retrieve(%q): %q", i, s.shareID, err)
-			continue
-		}
-		if value != s.value {
-			t.Errorf("Unexpected value of test #%d, Retrieve(%q): got [%q], want[%q]", i, s.shareID, value, s.value)
-		}
+	s.Close()
+}
+
+func TestBoltOpenLocked(t *testing.T) {
+	dbFilePath := getDBFilePath("locked_test.db")
+	if _, err := Open(dbFilePath, nil); !os.IsNotExist(err) {
+		t.Errorf("Open() of missing file: got [%v], want not-exist error", err)
+	}
+	s, err := OpenOrCreate(dbFilePath)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	options := &Options{LockTimeout: 50 * time.Millisecond}
+	if _, err := Open(dbFilePath, options); err != ErrLocked {
+		t.Errorf("Open() while locked: got [%v], want [%v]", err, ErrLocked)
+	}
+	if _, err := Open(dbFilePath, &Options{ReadOnly: true, LockTimeout: 50 * time.Millisecond}); err != ErrLocked {
+		t.Errorf("Open(ReadOnly) while locked: got [%v], want [%v]", err, ErrLocked)
 	}
+	if _, err := Migrate(dbFilePath, options); err != ErrLocked {
+		t.Errorf("Migrate() while locked: got [%v], want [%v]", err, ErrLocked)
+	}
+	if _, _, err := Compact(dbFilePath, options); err != ErrLocked {
+		t.Errorf("Compact() while locked: got [%v], want [%v]", err, ErrLocked)
+	}
+	s.Close()
+	s, err = Open(dbFilePath, options)
+	if err != nil {
+		t.Fatalf("Open() after Close(): got [%v], want [nil]", err)
+	}
+	s.Close()
 }
 
-func TestBoltStoresAndDeletesShares(t *testing.T) {
-	s, err := OpenOrCreate(getDBFilePath("store_and_delete_test.db"))
+func TestBoltVerify(t *testing.T) {
+	dbFilePath := getDBFilePath("verify_test.db")
+	s, err := OpenOrCreate(dbFilePath)
 	if err != nil {
 		t.Fatalf("Failed to open DB: %v", err)
 	}
-	tests := []struct {
-		op      string // Operation on a ShareStore object
-		shareID string
-		value   string
-		err     error // used only for Retrieve-operations
-	}{
-		// Add a bunch of shares.
-		{"Store", "share1", "some value 1", nil},
-		{"Store", "share2", "some value 2", nil},
-		{"Store", "share3", "some value 3", nil},
-		{"Store", "share4", "some value 4", nil},
-		{"Store", "share5", "some value 5", nil},
-		{"Store", "share6", "some value 6", nil},
-		{"Store", "share7", "some value 7", nil},
-		{"Store", "share8", "some value 8", nil},
-		{"Store", "share9", "some value 9", nil},
-		// Delete some of the shares, check that they are deleted.
-		{"Delete", "share1", "", nil},
-		{"Delete", "share3", "", nil},
-		{"Delete", "share5", "", nil},
-		{"Delete", "share7", "", nil},
-		{"Delete", "share9", "", nil},
-		{"Retrieve", "share1", "", svalbardsrv.ErrShareNotFound},
-		{"Retrieve", "share3", "", svalbardsrv.ErrShareNotFound},
-		{"Retrieve", "share5", "", svalbardsrv.ErrShareNotFound},
-		{"Retrieve", "share7", "", svalbardsrv.ErrShareNotFound},
-		{"Retrieve", "share9", "", svalbardsrv.ErrShareNotFound},
-		// Non-deleted shares still exist.
-		{"Retrieve", "share2", "some value 2", nil},
-		{"Retrieve", "share4", "some value 4", nil},
-		{"Retrieve", "share6", "some value 6", nil},
-		{"Retrieve", "share8", "some value 8", nil},
+	for i := 0; i < 10; i++ {
+		s.Store(fmt.Sprintf("share%d", i), fmt.Sprintf("some value %d", i))
 	}
-	for i, tt := range tests {
-		var err error
-		var value string
-		switch tt.op {
-		case "Store":
-			err = s.Store(tt.shareID, tt.value)
-		case "Delete":
-			err = s.Delete(tt.shareID)
-		case "Retrieve":
-			value, err = s.Retrieve(tt.shareID)
-		default:
-			panic("Unknown operation: " + tt.op)
+	// Neither metadata records nor tombstones are counted as shares.
+	s.SetMetadataPrefix("expiry:")
+	s.Store("expiry:share1", "some metadata")
+	s.Store("deleted", "some value")
+	if err := s.SoftDelete("deleted", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("SoftDelete(): %v", err)
+	}
+	if n, problems, err := s.Verify(); n != 10 || len(problems) != 0 || err != nil {
+		t.Errorf("Verify(): got [%v, %v, %v], want [10, [], nil]", n, problems, err)
+	}
+	// Corrupt a value, a checksum, a tombstone, and swap two records.
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		tb := tx.Bucket(tombstonesBucket)
+		v := append([]byte(nil), tb.Get([]byte("deleted"))...)
+		v[len(v)-1] ^= 1
+		tb.Put([]byte("deleted"), v)
+		b := tx.Bucket(sharesBucket)
+		v = append([]byte(nil), b.Get([]byte("share3"))...)
+		v[len(v)-1] ^= 1
+		b.Put([]byte("share3"), v)
+		v = append([]byte(nil), b.Get([]byte("share4"))...)
+		v[9] ^= 1
+		b.Put([]byte("share4"), v)
+		v5 := append([]byte(nil), b.Get([]byte("share5"))...)
+		b.Put([]byte("share5"), b.Get([]byte("share6")))
+		return b.Put([]byte("share6"), v5)
+	})
+	if err != nil {
+		t.Fatalf("Failed to corrupt DB: %v", err)
+	}
+	n, problems, err := s.Verify()
+	if n != 10 || err != nil {
+		t.Errorf("Verify() of corrupt DB: got [%v, %v], want [10, nil]", n, err)
+	}
+	var corrupt []string
+	for _, p := range problems {
+		if e, ok := p.(*CorruptRecordError); ok {
+			corrupt = append(corrupt, e.ShareID)
+		}
+	}
+	if want := []string{"share3", "share4", "share5", "share6", "deleted"}; !reflect.DeepEqual(corrupt, want) {
+		t.Errorf("Verify() of corrupt DB: got %v, want corrupt records %v", problems, want)
+	}
+	if _, err := s.Retrieve("share3"); !strings.Contains(fmt.Sprint(err), "checksum mismatch") {
+		t.Errorf("Retrieve(%q) of corrupt record: got [%v], want checksum mismatch", "share3", err)
+	}
+	if st, err := s.Stats(); err != nil || st.Shares != 6 || st.Corrupt != 4 || st.MetadataRecords != 1 {
+		t.Errorf("Stats() of corrupt DB: got [%+v, %v], want 6 shares, 4 corrupt and 1 metadata record", st, err)
+	}
+	s.Close()
+}
+
+func TestBoltStats(t *testing.T) {
+	s, err := OpenOrCreate(getDBFilePath("stats_test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer s.Close()
+	now := time.Unix(1500000000, 0)
+	day := 24 * time.Hour
+	for i, age := range []time.Duration{0, time.Hour, 2 * day, 40 * day, 400 * day, 800 * day} {
+		s.now = func() time.Time { return now.Add(-age) }
+		if err := s.Store(fmt.Sprintf("share%d", i), strings.Repeat("x", i+1)); err != nil {
+			t.Fatalf("Store(): %v", err)
 		}
-		if err != tt.err {
-			t.Errorf("Unexpected err of test #%d, %s(%q): got [%q], want[%q]",
-				i, tt.op, tt.shareID, err, tt.err)
+	}
+	s.now = func() time.Time { return now }
+	s.SetMetadataPrefix("expiry:")
+	if err := s.Store("expiry:share0", "some metadata"); err != nil {
+		t.Fatalf("Store(): %v", err)
+	}
+	if err := s.Store("deleted", "some value"); err != nil {
+		t.Fatalf("Store(): %v", err)
+	}
+	if err := s.SoftDelete("deleted", now.Add(day)); err != nil {
+		t.Fatalf("SoftDelete(): %v", err)
+	}
+	st, err := s.Stats()
+	if err != nil {
+		t.Fatalf("Stats(): got [%v], want [nil]", err)
+	}
+	want := &Stats{
+		SchemaVersion:   SchemaVersion,
+		DBBytes:         st.DBBytes,
+		Shares:          6,
+		ValueBytes:      21,
+		LargestValue:    6,
+		Oldest:          now.Add(-800 * day),
+		AgeHistogram:    []int{2, 1, 0, 1, 0, 2},
+		MetadataRecords: 1,
+		DeletedShares:   1,
+	}
+	if !reflect.DeepEqual(st, want) {
+		t.Errorf("Stats(): got [%+v], want [%+v]", st, want)
+	}
+	if st.DBBytes == 0 {
+		t.Errorf("Stats().DBBytes: got [0], want > 0")
+	}
+}
+
+func TestBoltMaxSize(t *testing.T) {
+	s, err := OpenOrCreate(getDBFilePath("max_size_test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer s.Close()
+	s.SetMaxSize(64 << 10)
+	value := strings.Repeat("x", 1024)
+	n := 0
+	for ; n < 100; n++ {
+		if err := s.Store(fmt.Sprintf("share%d", n), value); err != nil {
+			if err != svalbardsrv.ErrStoreFull {
+				t.Fatalf("Store() of share #%d: got [%v], want [%v]", n, err, svalbardsrv.ErrStoreFull)
+			}
+			break
 		}
-		if tt.op == "Retrieve" && err == nil && value != tt.value {
-			t.Errorf("Unexpected value of test #%d, Retrieve(%q): got [%q], want[%q]",
-				i, tt.shareID, value, tt.value)
+	}
+	if n == 0 || n == 100 {
+		t.Fatalf("Store() of 1kB shares into 64kB: got %d shares stored, want more than 0 and less than 100", n)
+	}
+	// Shares can still be replaced.
+	if err := s.Replace("share0", strings.Repeat("y", 1024)); err != nil {
+		t.Errorf("Replace() in full store: got [%v], want [nil]", err)
+	}
+	if err := s.Replace(fmt.Sprintf("share%d", n), value); err != svalbardsrv.ErrStoreFull {
+		t.Errorf("Replace() of new share in full store: got [%v], want [%v]", err, svalbardsrv.ErrStoreFull)
+	}
+	// Deletions free space for new shares.
+	for i := 0; i < n; i++ {
+		if err := s.Delete(fmt.Sprintf("share%d", i)); err != nil {
+			t.Fatalf("Delete(): %v", err)
 		}
 	}
+	if err := s.Store("share", value); err != nil {
+		t.Errorf("Store() after Delete(): got [%v], want [nil]", err)
+	}
 }
 
-func TestBoltOperationErrors(t *testing.T) {
-	s, err := OpenOrCreate(getDBFilePath("operation_errors_test.db"))
+func TestBoltImport(t *testing.T) {
+	s, err := OpenOrCreate(getDBFilePath("import_test.db"))
 	if err != nil {
 		t.Fatalf("Failed to open DB: %v", err)
 	}
+	defer s.Close()
+	s.Store("share1", "some value 1")
+	created := time.Unix(1500000000, 0)
+	purgeAt := time.Unix(1600000000, 0)
+	records := []Record{
+		{ShareID: "share2", Value: "some value 2", Created: created},
+		{ShareID: "share3", Value: "some value 3", OwnerKey: "owner1"},
+		{ShareID: "share4", Value: "some value 4", Created: created, PurgeAt: purgeAt, OwnerKey: "owner1"},
+	}
 	tests := []struct {
-		op      string // Operation on a ShareStore object
-		shareID string
-		value   string
-		err     error // used only for Retrieve-operations
+		records []Record
+		err     string
 	}{
-		// Invalid requests.
-		{"Store", "", "some value", svalbardsrv.ErrInvalidShareID},
-		{"Retrieve", "", "some value", svalbardsrv.ErrInvalidShareID},
-		{"Delete", "", "some value", svalbardsrv.ErrInvalidShareID},
-		{"Store", "someShareID", "", svalbardsrv.ErrInvalidShareValue},
-		// share42 does not exist yet.
-		{"Retrieve", "share42", "some other value", svalbardsrv.ErrShareNotFound},
-		// Add share42 and verify it exitsts.
-		{"Store", "share42", "some other value", nil},
-		{"Retrieve", "share42", "some other value", nil},
-		// Delete share42.
-		{"Delete", "share42", "", nil},
-		{"Retrieve", "share42", "some other value", svalbardsrv.ErrShareNotFound},
-		// Try deleting non-existing shares.
-		{"Delete", "share42", "", svalbardsrv.ErrShareNotFound},
-		{"Delete", "someOtherShare", "", svalbardsrv.ErrShareNotFound},
+		{append(records, Record{ShareID: "share1", Value: "other value", Created: created}), svalbardsrv.ErrShareAlreadyExists.Error()},
+		{append(records, Record{Value: "other value", Created: created}), svalbardsrv.ErrInvalidShareID.Error()},
+		{append(records, Record{ShareID: "share5", Created: created}), svalbardsrv.ErrInvalidShareValue.Error()},
+		{records, ""},
+		{records, svalbardsrv.ErrShareAlreadyExists.Error()},
+		{[]Record{{ShareID: "share4", Value: "other value"}}, svalbardsrv.ErrShareAlreadyExists.Error()},
 	}
 	for i, tt := range tests {
-		var err error
-		var value string
-		switch tt.op {
-		case "Store":
-			err = s.Store(tt.shareID, tt.value)
-		case "Delete":
-			err = s.Delete(tt.shareID)
-		case "Retrieve":
-			value, err = s.Retrieve(tt.shareID)
-		default:
-			panic("Unknown operation: " + tt.op)
-		}
-		if err != tt.err {
-			t.Errorf("Unexpected err of test #%d, %s(%q): got [%q], want[%q]",
-				i, tt.op, tt.shareID, err, tt.err)
+		err := s.Import(tt.records)
+		if (err == nil) != (tt.err == "") || err != nil && !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Import() #%d: got [%v], want [%v]", i, err, tt.err)
 		}
-		if tt.op == "Retrieve" && err == nil && value != tt.value {
-			t.Errorf("Unexpected value of test #%d, Retrieve(%q): got [%q], want[%q]",
-				i, tt.shareID, value, tt.value)
+	}
+	var got []Record
+	s.ForEach(func(r Record) error {
+		got = append(got, r)
+		return nil
+	})
+	want := []Record{{ShareID: "share1", Value: "some value 1", Created: got[0].Created}, records[0], records[1], records[2]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ForEach() after Import(): got %v, want %v", got, want)
+	}
+	if got, err := s.PurgeTime("share4"); err != nil || !got.Equal(purgeAt) {
+		t.Errorf("PurgeTime() after Import(): got [%v, %v], want [%v, nil]", got, err, purgeAt)
+	}
+	if ids, err := s.OwnerShareIDs("owner1"); err != nil || !reflect.DeepEqual(ids, []string{"share3", "share4"}) {
+		t.Errorf("OwnerShareIDs() after Import(): got [%v, %v], want [[share3 share4], nil]", ids, err)
+	}
+}
+
+func TestBoltCompact(t *testing.T) {
+	dbFilePath := getDBFilePath("compact_test.db")
+	s, err := OpenOrCreate(dbFilePath)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	value := strings.Repeat("x", 1000)
+	for i := 0; i < 1000; i++ {
+		s.Store(fmt.Sprintf("share%d", i), value)
+	}
+	for i := 10; i < 1000; i++ {
+		s.Delete(fmt.Sprintf("share%d", i))
+	}
+	s.Close()
+	before, after, err := Compact(dbFilePath, nil)
+	if err != nil || after >= before {
+		t.Fatalf("Compact(): got [%v, %v, %v], want smaller size and nil", before, after, err)
+	}
+	s, err = Open(dbFilePath, nil)
+	if err != nil {
+		t.Fatalf("Failed to open compacted DB: %v", err)
+	}
+	defer s.Close()
+	if n, problems, err := s.Verify(); n != 10 || len(problems) != 0 || err != nil {
+		t.Errorf("Verify() of compacted DB: got [%v, %v, %v], want [10, [], nil]", n, problems, err)
+	}
+	for i := 0; i < 10; i++ {
+		if got, err := s.Retrieve(fmt.Sprintf("share%d", i)); got != value || err != nil {
+			t.Errorf("Retrieve(share%d) of compacted DB: got [%d bytes, %v], want [%d bytes, nil]", i, len(got), err, len(value))
 		}
 	}
 }
@@ -0,0 +1,206 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Package certreloader provides TLS certificates that are reloaded from their
+// files when the files change, so that renewed certificates are served
+// without restarting the server.  Connections that are already established
+// keep using the certificate they were started with.
+package certreloader
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultPollInterval is the default interval in which the files are checked
+// for changes.
+const DefaultPollInterval = 10 * time.Second
+
+// ErrNoCertificate is returned if no certificate could be loaded.
+var ErrNoCertificate = errors.New("no certificate loaded")
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// Reloader holds the certificate loaded from a pair of certificate and key
+// files, and provides it via GetCertificate.  If loading of a new version of
+// the files fails (e.g. when the certificate has been written but the key
+// not yet), the previous certificate is kept and loading is retried at the
+// next check.
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mutex  sync.RWMutex
+	cert   *tls.Certificate
+	stamps [2]fileStamp
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	watchers sync.WaitGroup
+}
+
+// New returns a Reloader with the certificate loaded from 'certFile' and
+// 'keyFile', which must contain a PEM-encoded key pair.
+func New(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		stop:     make(chan struct{}),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate; it is meant to be used
+// as tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.cert == nil {
+		return nil, ErrNoCertificate
+	}
+	return r.cert, nil
+}
+
+// TLSConfig returns a tls.Config that serves the current certificate.
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: r.GetCertificate}
+}
+
+// Leaf returns the parsed current certificate.
+func (r *Reloader) Leaf() (*x509.Certificate, error) {
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
+
+// Reload loads the certificate from the files, regardless of whether they
+// have changed.  If loading fails, the previous certificate is kept.
+func (r *Reloader) Reload() error {
+	stamps, err := r.readStamps()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	r.cert = &cert
+	r.stamps = stamps
+	r.mutex.Unlock()
+	return nil
+}
+
+// ReloadIfChanged reloads the certificate if any of the files has changed
+// since the last successful load, and returns true if it did.
+func (r *Reloader) ReloadIfChanged() (bool, error) {
+	stamps, err := r.readStamps()
+	if err != nil {
+		return false, err
+	}
+	r.mutex.RLock()
+	changed := stamps != r.stamps
+	r.mutex.RUnlock()
+	if !changed {
+		return false, nil
+	}
+	if err := r.Reload(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// readStamps returns the stamps of the certificate and the key file.
+func (r *Reloader) readStamps() ([2]fileStamp, error) {
+	var stamps [2]fileStamp
+	for i, filename := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return stamps, err
+		}
+		stamps[i] = fileStamp{info.ModTime(), info.Size()}
+	}
+	return stamps, nil
+}
+
+// Watch starts checking the files for changes every 'interval' (or
+// DefaultPollInterval if zero), until Close is called.
+func (r *Reloader) Watch(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	r.watchers.Add(1)
+	go func() {
+		defer r.watchers.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var failing bool
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+			}
+			reloaded, err := r.ReloadIfChanged()
+			switch {
+			case err != nil && !failing:
+				// Log the failure once, as the files may be in the middle
+				// of being replaced.
+				slog.Error("certreloader: could not reload certificate", "cert_file", r.certFile, "error", err)
+				failing = true
+			case reloaded:
+				r.logReload()
+				failing = false
+			case err == nil:
+				failing = false
+			}
+		}
+	}()
+}
+
+// logReload logs the subject and the expiry of the current certificate.
+func (r *Reloader) logReload() {
+	leaf, err := r.Leaf()
+	if err != nil {
+		slog.Error("certreloader: could not parse reloaded certificate", "cert_file", r.certFile, "error", err)
+		return
+	}
+	slog.Info("certreloader: reloaded certificate", "cert_file", r.certFile,
+		"subject", leaf.Subject.String(), "not_after", leaf.NotAfter)
+}
+
+// Close stops watching the files, if Watch was called.
+func (r *Reloader) Close() error {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+	r.watchers.Wait()
+	return nil
+}
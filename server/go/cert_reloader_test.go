@@ -0,0 +1,204 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package certreloader
+
+import (
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/svalbard/server/go/testingtools"
+)
+
+// testFiles are the certificate and key files of a Reloader under test.
+type testFiles struct {
+	certFile, keyFile string
+	generation        int
+}
+
+func newTestFiles(t *testing.T) (*testFiles, func()) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "svalbard_certreloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := &testFiles{certFile: filepath.Join(dir, "cert.pem"), keyFile: filepath.Join(dir, "key.pem")}
+	return files, func() { os.RemoveAll(dir) }
+}
+
+// rotate writes a new certificate to the files, and returns its serial.
+func (f *testFiles) rotate(t *testing.T) *big.Int {
+	cert, err := testingtools.NewTestCertificate(pkix.Name{CommonName: "localhost"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.WriteFiles(f.certFile, f.keyFile); err != nil {
+		t.Fatal(err)
+	}
+	f.touch(t)
+	return cert.Cert.SerialNumber
+}
+
+// touch sets a new modification time of the files, so that changes are
+// detected even if the file system has a coarse time resolution.
+func (f *testFiles) touch(t *testing.T) {
+	f.generation++
+	mtime := time.Now().Add(time.Duration(f.generation) * time.Minute)
+	for _, filename := range []string{f.certFile, f.keyFile} {
+		if err := os.Chtimes(filename, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func servedSerial(t *testing.T, r *Reloader) *big.Int {
+	leaf, err := r.Leaf()
+	if err != nil {
+		t.Fatalf("Leaf(): unexpected error: %v", err)
+	}
+	return leaf.SerialNumber
+}
+
+func TestNew(t *testing.T) {
+	files, cleanup := newTestFiles(t)
+	defer cleanup()
+	if _, err := New(files.certFile, files.keyFile); err == nil {
+		t.Errorf("New() with missing files: got no error, want error")
+	}
+	serial := files.rotate(t)
+	r, err := New(files.certFile, files.keyFile)
+	if err != nil {
+		t.Fatalf("New(): unexpected error: %v", err)
+	}
+	defer r.Close()
+	if got := servedSerial(t, r); got.Cmp(serial) != 0 {
+		t.Errorf("Leaf().SerialNumber: got [%v], want [%v]", got, serial)
+	}
+}
+
+func TestReloadIfChanged(t *testing.T) {
+	files, cleanup := newTestFiles(t)
+	defer cleanup()
+	serial := files.rotate(t)
+	r, err := New(files.certFile, files.keyFile)
+	if err != nil {
+		t.Fatalf("New(): unexpected error: %v", err)
+	}
+	defer r.Close()
+
+	if reloaded, err := r.ReloadIfChanged(); reloaded || err != nil {
+		t.Errorf("ReloadIfChanged() of unchanged files: got [%v, %v], want [false, nil]", reloaded, err)
+	}
+
+	// A new certificate with the old key fails to load, and the old
+	// certificate is kept.
+	oldKey, err := ioutil.ReadFile(files.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSerial := files.rotate(t)
+	if err := ioutil.WriteFile(files.keyFile, oldKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	files.touch(t)
+	if reloaded, err := r.ReloadIfChanged(); reloaded || err == nil {
+		t.Errorf("ReloadIfChanged() of mismatched files: got [%v, %v], want [false, error]", reloaded, err)
+	}
+	if got := servedSerial(t, r); got.Cmp(serial) != 0 {
+		t.Errorf("Leaf().SerialNumber after failed reload: got [%v], want [%v]", got, serial)
+	}
+
+	newSerial = files.rotate(t)
+	if reloaded, err := r.ReloadIfChanged(); !reloaded || err != nil {
+		t.Errorf("ReloadIfChanged() of new files: got [%v, %v], want [true, nil]", reloaded, err)
+	}
+	if got := servedSerial(t, r); got.Cmp(newSerial) != 0 {
+		t.Errorf("Leaf().SerialNumber after reload: got [%v], want [%v]", got, newSerial)
+	}
+}
+
+// dialSerial returns the serial of the certificate served at 'addr'.
+func dialSerial(t *testing.T, addr string) *big.Int {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Dial(%s): unexpected error: %v", addr, err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber
+}
+
+func TestRotationUnderLiveListener(t *testing.T) {
+	files, cleanup := newTestFiles(t)
+	defer cleanup()
+	serial := files.rotate(t)
+	r, err := New(files.certFile, files.keyFile)
+	if err != nil {
+		t.Fatalf("New(): unexpected error: %v", err)
+	}
+	defer r.Close()
+	r.Watch(10 * time.Millisecond)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("ok"))
+		}),
+	}
+	go server.Serve(tls.NewListener(listener, r.TLSConfig()))
+	defer server.Close()
+	addr := listener.Addr().String()
+	if got := dialSerial(t, addr); got.Cmp(serial) != 0 {
+		t.Fatalf("served certificate: got serial [%v], want [%v]", got, serial)
+	}
+
+	// A keep-alive connection established before the rotation.
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	get := func() *big.Int {
+		resp, err := client.Get("https://" + addr + "/")
+		if err != nil {
+			t.Fatalf("Get(): unexpected error: %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].SerialNumber
+	}
+	get()
+
+	for i := 0; i < 3; i++ {
+		newSerial := files.rotate(t)
+		deadline := time.Now().Add(5 * time.Second)
+		for dialSerial(t, addr).Cmp(newSerial) != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("rotation %d: certificate with serial [%v] not served", i, newSerial)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		// The connection is not dropped, and keeps its certificate.
+		if got := get(); got.Cmp(serial) != 0 {
+			t.Errorf("rotation %d: keep-alive connection: got serial [%v], want [%v]", i, got, serial)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Package channelrouter implements a svalbardsrv.SecondaryChannel that
+// dispatches the messages to other channels, depending on the owner id type
+// of the recipient.  This enables a server to use several channels at once.
+package channelrouter
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+// Errors returned upon failures when configuring a Router.
+var (
+	ErrInvalidIDType     = errors.New("invalid owner id type")
+	ErrAlreadyRegistered = errors.New("owner id type already registered")
+	ErrNotRegistered     = errors.New("owner id type not registered")
+	ErrMissingChannel    = errors.New("missing channel")
+)
+
+// NormalizeIDType returns the normalized form of the given owner id type,
+// which is used for dispatching: leading and trailing whitespace is removed,
+// and all letters are mapped to upper case.
+func NormalizeIDType(idType string) string {
+	return strings.ToUpper(strings.TrimSpace(idType))
+}
+
+// NormalizeOwnerID returns the normalized form of the owner id 'ownerID' of
+// the normalized owner id type 'idType', under which the recipient is known
+// to the channels: leading and trailing whitespace is removed, e-mail
+// addresses are mapped to lower case, and phone numbers lose the separators
+// " -./()", with a leading "00" replaced by "+".
+func NormalizeOwnerID(idType, ownerID string) string {
+	ownerID = strings.TrimSpace(ownerID)
+	switch idType {
+	case "EMAIL":
+		return strings.ToLower(ownerID)
+	case "SMS", "PHONE":
+		ownerID = strings.Map(func(r rune) rune {
+			if strings.ContainsRune(" -./()", r) {
+				return -1
+			}
+			return r
+		}, ownerID)
+		if strings.HasPrefix(ownerID, "00") {
+			ownerID = "+" + ownerID[2:]
+		}
+	}
+	return ownerID
+}
+
+// New returns a new Router without any registered channels.
+// The returned Router implements svalbardsrv.SecondaryChannel interface.
+func New() *Router {
+	return &Router{
+		channels: make(map[string]svalbardsrv.SecondaryChannel),
+		aliases:  make(map[string]string),
+	}
+}
+
+// Router is a svalbardsrv.SecondaryChannel implementation that dispatches
+// the messages to the channels registered for the (normalized) owner id type
+// of the recipient.  The following rules are applied, in order:
+//   - if a channel is registered for the owner id type, it is used,
+//   - if the owner id type is an alias of a registered type, the channel
+//     registered for that type is used,
+//   - if a fallback type is set, the channel registered for that type is used,
+//   - otherwise the message is rejected with ErrUnsupportedOwnerIDType.
+//
+// The recipient passed to the selected channel carries the owner id type
+// the channel is registered for, and the owner id normalized with
+// NormalizeOwnerID.
+type Router struct {
+	mutex    sync.RWMutex
+	channels map[string]svalbardsrv.SecondaryChannel
+	aliases  map[string]string
+	fallback string
+}
+
+// Register registers 'channel' for sending messages to the recipients
+// of the owner id type 'idType'.
+func (r *Router) Register(idType string, channel svalbardsrv.SecondaryChannel) error {
+	idType = NormalizeIDType(idType)
+	if idType == "" {
+		return ErrInvalidIDType
+	}
+	if channel == nil {
+		return ErrMissingChannel
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.channels[idType]; ok {
+		return ErrAlreadyRegistered
+	}
+	if _, ok := r.aliases[idType]; ok {
+		return ErrAlreadyRegistered
+	}
+	r.channels[idType] = channel
+	return nil
+}
+
+// RegisterAlias makes 'alias' an alternative name of the registered owner
+// id type 'idType', e.g. "E-MAIL" for "EMAIL".
+func (r *Router) RegisterAlias(alias, idType string) error {
+	alias, idType = NormalizeIDType(alias), NormalizeIDType(idType)
+	if alias == "" {
+		return ErrInvalidIDType
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.channels[idType]; !ok {
+		return ErrNotRegistered
+	}
+	if _, ok := r.channels[alias]; ok {
+		return ErrAlreadyRegistered
+	}
+	if _, ok := r.aliases[alias]; ok {
+		return ErrAlreadyRegistered
+	}
+	r.aliases[alias] = idType
+	return nil
+}
+
+// SetFallback makes the channel registered for 'idType' handle the messages
+// for recipients of owner id types that are not registered.
+// An empty 'idType' removes the fallback.
+func (r *Router) SetFallback(idType string) error {
+	idType = NormalizeIDType(idType)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.channels[idType]; !ok && idType != "" {
+		return ErrNotRegistered
+	}
+	r.fallback = idType
+	return nil
+}
+
+// Send sends 'data' to the specified recipient, using the channel selected
+// for the owner id type of the recipient.
+func (r *Router) Send(recipient svalbardsrv.RecipientID, data svalbardsrv.TokenMsgData) error {
+	idType, channel := r.route(recipient.IDType)
+	if channel == nil {
+		return svalbardsrv.ErrUnsupportedOwnerIDType
+	}
+	return channel.Send(svalbardsrv.RecipientID{IDType: idType, ID: NormalizeOwnerID(idType, recipient.ID)}, data)
+}
+
+// Recipient returns 'recipient' in the form passed to the channels: with the
+// owner id type the channel selected for it is registered for, and with the
+// normalized owner id.  The owner id type of recipients without a channel is
+// only normalized.  All the variants of a recipient thus map to the same
+// RecipientID, e.g. for keeping limits per recipient.
+func (r *Router) Recipient(recipient svalbardsrv.RecipientID) svalbardsrv.RecipientID {
+	idType, channel := r.route(recipient.IDType)
+	if channel == nil {
+		idType = NormalizeIDType(recipient.IDType)
+	}
+	return svalbardsrv.RecipientID{IDType: idType, ID: NormalizeOwnerID(idType, recipient.ID)}
+}
+
+// route returns the owner id type and the channel that should be used
+// for recipients of the given 'idType', or a nil channel if there is none.
+func (r *Router) route(idType string) (string, svalbardsrv.SecondaryChannel) {
+	idType = NormalizeIDType(idType)
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if channel, ok := r.channels[idType]; ok {
+		return idType, channel
+	}
+	if target, ok := r.aliases[idType]; ok {
+		return target, r.channels[target]
+	}
+	if r.fallback != "" {
+		return r.fallback, r.channels[r.fallback]
+	}
+	return "", nil
+}
+
+// SupportsOwnerIDType returns true if the router has a channel for
+// the recipients of the owner id type 'idType'.
+func (r *Router) SupportsOwnerIDType(idType string) bool {
+	_, channel := r.route(idType)
+	return channel != nil
+}
+
+// SupportedOwnerIDTypes returns the sorted list of the registered owner
+// id types, excluding the aliases.
+func (r *Router) SupportedOwnerIDTypes() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	idTypes := make([]string, 0, len(r.channels))
+	for idType := range r.channels {
+		idTypes = append(idTypes, idType)
+	}
+	sort.Strings(idTypes)
+	return idTypes
+}
+
+// CheckHealth runs the self-tests of all registered channels that implement
+// svalbardsrv.HealthChecker, in the order of their owner id types, and
+// returns the first error, labeled with the owner id type.
+func (r *Router) CheckHealth() error {
+	for _, idType := range r.SupportedOwnerIDTypes() {
+		if err := r.CheckChannelHealth(idType); err != nil {
+			return fmt.Errorf("channel for %s: %v", idType, err)
+		}
+	}
+	return nil
+}
+
+// CheckChannelHealth runs the self-test of the channel registered for the
+// owner id type 'idType' (or an alias), if it implements
+// svalbardsrv.HealthChecker.  It returns ErrNotRegistered for unknown types.
+func (r *Router) CheckChannelHealth(idType string) error {
+	r.mutex.RLock()
+	channel, ok := r.channels[NormalizeIDType(idType)]
+	if !ok {
+		if target, isAlias := r.aliases[NormalizeIDType(idType)]; isAlias {
+			channel, ok = r.channels[target]
+		}
+	}
+	r.mutex.RUnlock()
+	if !ok {
+		return ErrNotRegistered
+	}
+	if checker, ok := channel.(svalbardsrv.HealthChecker); ok {
+		return checker.CheckHealth()
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package channelrouter
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+// recordingChannel is a SecondaryChannel that records the recipients
+// of the messages sent to it.
+type recordingChannel struct {
+	recipients []svalbardsrv.RecipientID
+}
+
+func (c *recordingChannel) Send(recipient svalbardsrv.RecipientID, data svalbardsrv.TokenMsgData) error {
+	c.recipients = append(c.recipients, recipient)
+	return nil
+}
+
+func TestRouterDispatchesByNormalizedIDType(t *testing.T) {
+	sms, email, file := &recordingChannel{}, &recordingChannel{}, &recordingChannel{}
+	r := New()
+	for idType, channel := range map[string]*recordingChannel{"SMS": sms, "email": email, " File ": file} {
+		if err := r.Register(idType, channel); err != nil {
+			t.Fatalf("Register(%q) failed: %v", idType, err)
+		}
+	}
+	if err := r.RegisterAlias("e-mail", "EMAIL"); err != nil {
+		t.Fatalf("RegisterAlias() failed: %v", err)
+	}
+	var tests = []struct {
+		idType  string
+		channel *recordingChannel
+		want    string // owner id type passed to the channel
+	}{
+		{"SMS", sms, "SMS"},
+		{"sms", sms, "SMS"},
+		{" Sms\t", sms, "SMS"},
+		{"email", email, "EMAIL"},
+		{"E-Mail", email, "EMAIL"},
+		{"FILE", file, "FILE"},
+		{"file ", file, "FILE"},
+	}
+	for _, tt := range tests {
+		recipient := svalbardsrv.RecipientID{IDType: tt.idType, ID: "alice"}
+		if err := r.Send(recipient, svalbardsrv.TokenMsgData{ReqID: "req42", Token: "asdfie"}); err != nil {
+			t.Errorf("Send(%v) unexpected error: %v", recipient, err)
+			continue
+		}
+		got := tt.channel.recipients[len(tt.channel.recipients)-1]
+		want := svalbardsrv.RecipientID{IDType: tt.want, ID: "alice"}
+		if got != want {
+			t.Errorf("Send(%v) passed recipient [%v], want [%v]", recipient, got, want)
+		}
+	}
+	if got, want := len(sms.recipients)+len(email.recipients)+len(file.recipients), len(tests); got != want {
+		t.Errorf("Unexpected number of dispatched messages: got %d, want %d", got, want)
+	}
+}
+
+func TestRouterFallback(t *testing.T) {
+	sms, file := &recordingChannel{}, &recordingChannel{}
+	r := New()
+	r.Register("SMS", sms)
+	r.Register("FILE", file)
+	data := svalbardsrv.TokenMsgData{ReqID: "req42", Token: "asdfie"}
+	for _, idType := range []string{"pager", "", "chat"} {
+		err := r.Send(svalbardsrv.RecipientID{IDType: idType, ID: "bob"}, data)
+		if err != svalbardsrv.ErrUnsupportedOwnerIDType {
+			t.Errorf("Send() with owner id type %q and no fallback: got error [%v], want [%v]",
+				idType, err, svalbardsrv.ErrUnsupportedOwnerIDType)
+		}
+	}
+	if r.SupportsOwnerIDType("pager") || !r.SupportsOwnerIDType("sms") {
+		t.Errorf("SupportsOwnerIDType() without fallback: got %v for PAGER and %v for SMS, want false and true",
+			r.SupportsOwnerIDType("pager"), r.SupportsOwnerIDType("sms"))
+	}
+	if err := r.SetFallback("pager"); err != ErrNotRegistered {
+		t.Errorf("SetFallback() of an unregistered type: got error [%v], want [%v]", err, ErrNotRegistered)
+	}
+	if err := r.SetFallback("file"); err != nil {
+		t.Fatalf("SetFallback() failed: %v", err)
+	}
+	if !r.SupportsOwnerIDType("pager") {
+		t.Errorf("SupportsOwnerIDType() with fallback: got false for PAGER, want true")
+	}
+	if err := r.Send(svalbardsrv.RecipientID{IDType: "pager", ID: "bob"}, data); err != nil {
+		t.Errorf("Send() with fallback unexpected error: %v", err)
+	}
+	want := []svalbardsrv.RecipientID{{IDType: "FILE", ID: "bob"}}
+	if !reflect.DeepEqual(file.recipients, want) {
+		t.Errorf("Fallback channel got recipients %v, want %v", file.recipients, want)
+	}
+	if len(sms.recipients) != 0 {
+		t.Errorf("Unexpected recipients of a non-fallback channel: %v", sms.recipients)
+	}
+	// Removing the fallback makes unregistered types unsupported again.
+	if err := r.SetFallback(""); err != nil {
+		t.Fatalf("SetFallback(\"\") failed: %v", err)
+	}
+	if err := r.Send(svalbardsrv.RecipientID{IDType: "pager", ID: "bob"}, data); err != svalbardsrv.ErrUnsupportedOwnerIDType {
+		t.Errorf("Send() after removing fallback: got error [%v], want [%v]", err, svalbardsrv.ErrUnsupportedOwnerIDType)
+	}
+}
+
+func TestRouterNormalizesOwnerIDs(t *testing.T) {
+	sms, email := &recordingChannel{}, &recordingChannel{}
+	r := New()
+	r.Register("SMS", sms)
+	r.Register("EMAIL", email)
+	r.RegisterAlias("E-MAIL", "EMAIL")
+	var tests = []struct {
+		recipient svalbardsrv.RecipientID
+		want      svalbardsrv.RecipientID
+	}{
+		{svalbardsrv.RecipientID{IDType: "sms", ID: " +41 (79) 123-45.67 "}, svalbardsrv.RecipientID{IDType: "SMS", ID: "+41791234567"}},
+		{svalbardsrv.RecipientID{IDType: "SMS", ID: "0041 79 123 45 67"}, svalbardsrv.RecipientID{IDType: "SMS", ID: "+41791234567"}},
+		{svalbardsrv.RecipientID{IDType: "e-mail", ID: "Alice@Example.COM "}, svalbardsrv.RecipientID{IDType: "EMAIL", ID: "alice@example.com"}},
+		{svalbardsrv.RecipientID{IDType: "Pager", ID: " Bob-1 "}, svalbardsrv.RecipientID{IDType: "PAGER", ID: "Bob-1"}},
+	}
+	for _, tt := range tests {
+		if got := r.Recipient(tt.recipient); got != tt.want {
+			t.Errorf("Recipient(%v): got [%v], want [%v]", tt.recipient, got, tt.want)
+		}
+	}
+	data := svalbardsrv.TokenMsgData{ReqID: "req42", Token: "asdfie"}
+	for _, tt := range tests[:3] {
+		if err := r.Send(tt.recipient, data); err != nil {
+			t.Fatalf("Send(%v) unexpected error: %v", tt.recipient, err)
+		}
+	}
+	want := []svalbardsrv.RecipientID{tests[0].want, tests[1].want}
+	if !reflect.DeepEqual(sms.recipients, want) {
+		t.Errorf("SMS channel got recipients %v, want %v", sms.recipients, want)
+	}
+	if want := []svalbardsrv.RecipientID{tests[2].want}; !reflect.DeepEqual(email.recipients, want) {
+		t.Errorf("EMAIL channel got recipients %v, want %v", email.recipients, want)
+	}
+}
+
+func TestRouterRegistrationErrors(t *testing.T) {
+	r := New()
+	channel := &recordingChannel{}
+	var tests = []struct {
+		op     string
+		idType string
+		target string // used only for RegisterAlias
+		err    error
+	}{
+		{"Register", "SMS", "", nil},
+		{"Register", "sms", "", ErrAlreadyRegistered},
+		{"Register", " ", "", ErrInvalidIDType},
+		{"RegisterAlias", "text", "SMS", nil},
+		{"RegisterAlias", "TEXT", "SMS", ErrAlreadyRegistered},
+		{"RegisterAlias", "sms", "SMS", ErrAlreadyRegistered},
+		{"RegisterAlias", "mail", "EMAIL", ErrNotRegistered},
+		{"RegisterAlias", "", "SMS", ErrInvalidIDType},
+		{"Register", "Text", "", ErrAlreadyRegistered},
+	}
+	for _, tt := range tests {
+		var err error
+		switch tt.op {
+		case "Register":
+			err = r.Register(tt.idType, channel)
+		case "RegisterAlias":
+			err = r.RegisterAlias(tt.idType, tt.target)
+		default:
+			panic("Unknown operation: " + tt.op)
+		}
+		if err != tt.err {
+			t.Errorf("%s(%q, %q): got error [%v], want [%v]", tt.op, tt.idType, tt.target, err, tt.err)
+		}
+	}
+	if err := r.Register("EMAIL", nil); err != ErrMissingChannel {
+		t.Errorf("Register() of nil channel: got error [%v], want [%v]", err, ErrMissingChannel)
+	}
+}
+
+func TestRouterListsSupportedOwnerIDTypes(t *testing.T) {
+	r := New()
+	if got := r.SupportedOwnerIDTypes(); len(got) != 0 {
+		t.Errorf("SupportedOwnerIDTypes() of an empty router: got %v, want none", got)
+	}
+	r.Register("sms", &recordingChannel{})
+	r.Register("FILE", &recordingChannel{})
+	r.Register("Email", &recordingChannel{})
+	r.RegisterAlias("e-mail", "email")
+	want := []string{"EMAIL", "FILE", "SMS"}
+	if got := r.SupportedOwnerIDTypes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("SupportedOwnerIDTypes(): got %v, want %v", got, want)
+	}
+}
+
+// checkedChannel is a SecondaryChannel with a self-test that fails with 'err'.
+type checkedChannel struct {
+	recordingChannel
+	err error
+}
+
+func (c *checkedChannel) CheckHealth() error {
+	return c.err
+}
+
+func TestRouterChecksHealthOfChannels(t *testing.T) {
+	sms, email := &checkedChannel{}, &checkedChannel{}
+	r := New()
+	r.Register("SMS", sms)
+	r.Register("EMAIL", email)
+	r.Register("FILE", &recordingChannel{})
+	r.RegisterAlias("e-mail", "EMAIL")
+	errBroken := errors.New("broken")
+	var tests = []struct {
+		smsErr, emailErr error
+		idType           string
+		wantChannel      error // of CheckChannelHealth(idType)
+		wantAll          string
+	}{
+		{nil, nil, "SMS", nil, ""},
+		{nil, errBroken, "e-mail", errBroken, "channel for EMAIL: broken"},
+		{errBroken, errBroken, "FILE", nil, "channel for EMAIL: broken"},
+		{errBroken, nil, "SMS", errBroken, "channel for SMS: broken"},
+		{nil, nil, "PIGEON", ErrNotRegistered, ""},
+	}
+	for _, tt := range tests {
+		sms.err, email.err = tt.smsErr, tt.emailErr
+		if err := r.CheckChannelHealth(tt.idType); err != tt.wantChannel {
+			t.Errorf("CheckChannelHealth(%q): got [%v], want [%v]", tt.idType, err, tt.wantChannel)
+		}
+		err := r.CheckHealth()
+		if (err == nil && tt.wantAll != "") || (err != nil && err.Error() != tt.wantAll) {
+			t.Errorf("CheckHealth() with SMS error [%v] and EMAIL error [%v]: got [%v], want [%v]",
+				tt.smsErr, tt.emailErr, err, tt.wantAll)
+		}
+	}
+}
@@ -18,40 +18,152 @@
 package filechannel
 
 import (
+	"bufio"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/google/svalbard/server/go/msgtemplate"
 	"github.com/google/svalbard/server/go/svalbardsrv"
 )
 
+// Default values of the parameters of a Channel.
+const (
+	DefaultMaxFileSize     = 1 << 20
+	DefaultMaxRotatedFiles = 3
+)
+
+// MaxOwnerIDLength is the maximal length (in bytes) of the owner ids
+// supported by Channel, which keeps the filenames within common limits.
+const MaxOwnerIDLength = 100
+
+// Errors returned upon failures.
+var (
+	ErrInvalidOwnerID  = errors.New("invalid owner id for file channel")
+	ErrNotRegularFile  = errors.New("channel file is not a regular file")
+	ErrInvalidFileLine = errors.New("invalid line in channel file")
+)
+
+// Config contains the parameters of a Channel.
+type Config struct {
+	// MaxFileSize is the size (in bytes) beyond which a channel file is
+	// rotated.  If zero, DefaultMaxFileSize is used.
+	MaxFileSize int64
+	// MaxRotatedFiles is the number of rotated files kept per recipient.
+	// If zero, DefaultMaxRotatedFiles is used.
+	MaxRotatedFiles int
+	// Templates are used for rendering human-readable messages.  If nil,
+	// the messages contain only the line generated by
+	// svalbardsrv.GetMsgWithToken.
+	Templates *msgtemplate.Set
+}
+
+// Message is a message read from a channel file.
+type Message struct {
+	Time time.Time
+	Text string
+}
+
 // NewChannel returns a new Channel object, which is an implementation of
 // svalbardsrv.SecondaryChannel interface that communicates using files in the specified 'rootDir'.
 // It is intended for testing only.
 // TODO: add testonly=1 to the BUILD-rule once other implementations are available.
 func NewChannel(rootDir string) *Channel {
+	return NewChannelWithConfig(rootDir, Config{})
+}
+
+// NewChannelWithConfig returns a new Channel object like NewChannel,
+// configured according to 'config'.
+func NewChannelWithConfig(rootDir string, config Config) *Channel {
+	if config.MaxFileSize <= 0 {
+		config.MaxFileSize = DefaultMaxFileSize
+	}
+	if config.MaxRotatedFiles <= 0 {
+		config.MaxRotatedFiles = DefaultMaxRotatedFiles
+	}
 	return &Channel{
-		rootDir,
+		rootDir: rootDir,
+		config:  config,
+		now:     time.Now,
 	}
 }
 
 // Channel is a svalbardsrv.SecondaryChannel implementation based on files.
 // A secondary channel to a user identified by 'userID' is just a file named
-// userID + "secondary_channel.txt" in the root directory of the channel,
-// and each message sent via the channel is written to the file on a separate line.
+// hex(userID) + "_secondary_channel.txt" in the root directory of the channel,
+// and each message sent via the channel is written to the file on a separate
+// line, as "<time in ns since epoch> <message quoted as Go string>".
+// The message is rendered from the configured templates (see package
+// msgtemplate), and svalbardsrv.ParseMsgWithToken extracts the token from it.
+// A file that would grow beyond Config.MaxFileSize is rotated, i.e. renamed
+// with suffix ".1" (with older rotated files renamed to ".2", ".3", ...).
 // It is intended for testing only.
 type Channel struct {
 	rootDir string
+	config  Config
+	now     func() time.Time
+
+	mutex sync.Mutex
+}
+
+// Filename returns the name of the file with the messages to 'ownerID'.
+// The name is encoded, so that the file is always located directly in the
+// root directory of the channel.
+func (sc *Channel) Filename(ownerID string) (string, error) {
+	if ownerID == "" || len(ownerID) > MaxOwnerIDLength {
+		return "", ErrInvalidOwnerID
+	}
+	filename := filepath.Join(sc.rootDir, hex.EncodeToString([]byte(ownerID))+"_secondary_channel.txt")
+	// Hex-encoding alone guarantees this, but make sure the file stays confined.
+	if filepath.Dir(filename) != filepath.Clean(sc.rootDir) {
+		return "", ErrInvalidOwnerID
+	}
+	return filename, nil
 }
 
-func getFile(dir, ownerID string) (*os.File, error) {
-	filename := filepath.Join(dir, ownerID+"_secondary_channel.txt")
-	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// checkRegularFile returns nil if 'filename' does not exist or is a regular file.
+// In particular, it rejects symlinks that could redirect the writes.
+func checkRegularFile(filename string) error {
+	info, err := os.Lstat(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return ErrNotRegularFile
 	}
-	return file, nil
+	return nil
+}
+
+// SupportedOwnerIDTypes returns the owner id types supported by Channel.
+func (sc *Channel) SupportedOwnerIDTypes() []string {
+	return []string{"FILE"}
+}
+
+// CheckHealth returns nil if the root directory of the channel exists (or can
+// be created) and is writable, which it checks by creating and removing
+// a temporary file.
+func (sc *Channel) CheckHealth() error {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if err := os.MkdirAll(sc.rootDir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(sc.rootDir, ".health-check-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
 }
 
 // Send sends 'token' with the label 'reqID' to recipient identified by 'ownerID'
@@ -61,11 +173,28 @@ func (sc *Channel) Send(recipientID svalbardsrv.RecipientID, data svalbardsrv.To
 	if strings.ToUpper(recipientID.IDType) != "FILE" {
 		return svalbardsrv.ErrUnsupportedOwnerIDType
 	}
-	msg, err := svalbardsrv.GetMsgWithToken(data)
+	msg, err := sc.message(recipientID, data)
 	if err != nil {
 		return err
 	}
-	f, err := getFile(sc.rootDir, recipientID.ID)
+	filename, err := sc.Filename(recipientID.ID)
+	if err != nil {
+		return err
+	}
+	line := fmt.Sprintf("%d %s\n", sc.now().UnixNano(), strconv.Quote(msg))
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if err := os.MkdirAll(sc.rootDir, 0700); err != nil {
+		return err
+	}
+	if err := checkRegularFile(filename); err != nil {
+		return err
+	}
+	if err := sc.rotateIfNeeded(filename, int64(len(line))); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
 		return err
 	}
@@ -74,6 +203,107 @@ func (sc *Channel) Send(recipientID svalbardsrv.RecipientID, data svalbardsrv.To
 			err = cErr
 		}
 	}()
-	_, err = fmt.Fprintf(f, "%s\n", msg)
+	_, err = f.WriteString(line)
 	return err
 }
+
+// message returns the message with token to be sent to 'recipientID'.
+func (sc *Channel) message(recipientID svalbardsrv.RecipientID, data svalbardsrv.TokenMsgData) (string, error) {
+	if sc.config.Templates == nil {
+		return svalbardsrv.GetMsgWithToken(data)
+	}
+	return sc.config.Templates.Render(recipientID, data)
+}
+
+// rotateIfNeeded rotates 'filename' if appending 'size' bytes to it would make
+// it larger than the configured maximum.  The oldest rotated file is removed.
+func (sc *Channel) rotateIfNeeded(filename string, size int64) error {
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 || info.Size()+size <= sc.config.MaxFileSize {
+		return nil
+	}
+	for i := sc.config.MaxRotatedFiles; i > 0; i-- {
+		older := rotatedFilename(filename, i)
+		newer := rotatedFilename(filename, i-1)
+		if i == sc.config.MaxRotatedFiles {
+			if err := os.Remove(older); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(newer, older); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotatedFilename returns the name of the i-th rotated file of 'filename',
+// or 'filename' itself for i == 0.
+func rotatedFilename(filename string, i int) string {
+	if i == 0 {
+		return filename
+	}
+	return filename + "." + strconv.Itoa(i)
+}
+
+// ReadMessages returns the messages sent to 'ownerID' at or after 'since',
+// in the order they were sent, including the messages in the rotated files.
+func (sc *Channel) ReadMessages(ownerID string, since time.Time) ([]Message, error) {
+	filename, err := sc.Filename(ownerID)
+	if err != nil {
+		return nil, err
+	}
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	var msgs []Message
+	for i := sc.config.MaxRotatedFiles; i >= 0; i-- {
+		fileMsgs, err := readFile(rotatedFilename(filename, i), since)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, fileMsgs...)
+	}
+	return msgs, nil
+}
+
+// readFile returns the messages in 'filename' sent at or after 'since'.
+// A missing file contains no messages.
+func readFile(filename string, since time.Time) ([]Message, error) {
+	if err := checkRegularFile(filename); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var msgs []Message
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), " ", 2)
+		if len(parts) != 2 {
+			return nil, ErrInvalidFileLine
+		}
+		nanos, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, ErrInvalidFileLine
+		}
+		text, err := strconv.Unquote(parts[1])
+		if err != nil {
+			return nil, ErrInvalidFileLine
+		}
+		if t := time.Unix(0, nanos); !t.Before(since) {
+			msgs = append(msgs, Message{Time: t, Text: text})
+		}
+	}
+	return msgs, scanner.Err()
+}
@@ -17,12 +17,17 @@
 package filechannel
 
 import (
-	"bytes"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/svalbard/server/go/msgtemplate"
 	"github.com/google/svalbard/server/go/svalbardsrv"
 )
 
@@ -34,6 +39,37 @@ func getFileContent(filename string, t *testing.T) []byte {
 	return content
 }
 
+func TestSendRendersTemplates(t *testing.T) {
+	rootDir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "svalbard_file_channel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates := msgtemplate.New()
+	sc := NewChannelWithConfig(rootDir, Config{Templates: templates})
+	alice := svalbardsrv.RecipientID{"FILE", "alice"}
+	for _, locale := range []string{"", "de-CH"} {
+		data := svalbardsrv.TokenMsgData{ReqID: "req42", Token: "asdfie", Op: svalbardsrv.OpRetrieveShare, Locale: locale}
+		if err := sc.Send(alice, data); err != nil {
+			t.Fatalf("Send(%v, %v) unexpected error: %v", alice, data, err)
+		}
+		want, err := templates.Render(alice, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs, err := sc.ReadMessages(alice.ID, time.Time{})
+		if err != nil || len(msgs) == 0 {
+			t.Fatalf("ReadMessages(%q): got [%v, %v], want messages", alice.ID, msgs, err)
+		}
+		// The rendered message has a human-readable text before the token line.
+		if got := msgs[len(msgs)-1].Text; got != want || !strings.Contains(got, "\nSVBD:req42:asdfie") {
+			t.Errorf("ReadMessages(%q) in locale [%v]: got [%v], want [%v]", alice.ID, locale, got, want)
+		}
+		if parsed, err := svalbardsrv.ParseMsgWithToken(msgs[len(msgs)-1].Text); err != nil || parsed.Token != "asdfie" {
+			t.Errorf("ParseMsgWithToken() of the message in locale [%v]: got %v (error: %v), want token asdfie", locale, parsed, err)
+		}
+	}
+}
+
 func TestSendMessageWritesToPerRecipientFilesInclDuplicates(t *testing.T) {
 	rootDir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "svalbard_file_channel")
 	if err != nil {
@@ -47,39 +83,50 @@ func TestSendMessageWritesToPerRecipientFilesInclDuplicates(t *testing.T) {
 		// A few valid requests to be sent to various recipients.
 		// Each distinct recipientID.ID results in a separate file.
 		// Each repetition of a message should also appear in the corresponding file.
-		{svalbardsrv.RecipientID{"file", "alice"}, svalbardsrv.TokenMsgData{"req42", "asdfie"}},
-		{svalbardsrv.RecipientID{"FILE", "Bob"}, svalbardsrv.TokenMsgData{"26g3", "AEUHE"}},
-		{svalbardsrv.RecipientID{"FIle", "Bob"}, svalbardsrv.TokenMsgData{"636328", "yqggyod"}},
-		{svalbardsrv.RecipientID{"File", "Mary"}, svalbardsrv.TokenMsgData{"3682a", "Uye83gh"}},
-		{svalbardsrv.RecipientID{"FilE", "Mary"}, svalbardsrv.TokenMsgData{"362843a", "ABueyge63"}},
-		{svalbardsrv.RecipientID{"fILe", "alice"}, svalbardsrv.TokenMsgData{"req42", "asdfie"}},
-		{svalbardsrv.RecipientID{"fiLE", "alice"}, svalbardsrv.TokenMsgData{"req42", "asdfie"}},
+		{svalbardsrv.RecipientID{"file", "alice"}, svalbardsrv.TokenMsgData{ReqID: "req42", Token: "asdfie"}},
+		{svalbardsrv.RecipientID{"FILE", "Bob"}, svalbardsrv.TokenMsgData{ReqID: "26g3", Token: "AEUHE"}},
+		{svalbardsrv.RecipientID{"FIle", "Bob"}, svalbardsrv.TokenMsgData{ReqID: "636328", Token: "yqggyod"}},
+		{svalbardsrv.RecipientID{"File", "Mary"}, svalbardsrv.TokenMsgData{ReqID: "3682a", Token: "Uye83gh"}},
+		{svalbardsrv.RecipientID{"FilE", "Mary"}, svalbardsrv.TokenMsgData{ReqID: "362843a", Token: "ABueyge63"}},
+		{svalbardsrv.RecipientID{"fILe", "alice"}, svalbardsrv.TokenMsgData{ReqID: "req42", Token: "asdfie"}},
+		{svalbardsrv.RecipientID{"fiLE", "alice"}, svalbardsrv.TokenMsgData{ReqID: "req42", Token: "asdfie"}},
 	}
 	// Every entry corresponds to a file that should be created for each distinct ownerID.
-	expectedContent := make(map[string][]byte)
+	expectedMsgs := make(map[string][]string)
 	for _, tt := range tests {
 		err := sc.Send(tt.recipient, tt.data)
 		if err != nil {
 			t.Errorf("Unexpected error %v", err)
 			continue
 		}
-		// Update expectedContent.
-		expected := expectedContent[tt.recipient.ID]
+		// Update expectedMsgs.
 		msg, err := svalbardsrv.GetMsgWithToken(tt.data)
 		if err != nil {
 			t.Errorf("Unexpected error %v", err)
 			continue
 		}
-		expectedContent[tt.recipient.ID] = append(expected, []byte(msg+"\n")...)
-		// Compare with actual content.
-		filename := filepath.Join(rootDir, tt.recipient.ID+"_secondary_channel.txt")
-		actualContent := getFileContent(filename, t)
-		expected = expectedContent[tt.recipient.ID]
-		if !bytes.Equal(actualContent, expected) {
-			t.Errorf("Unexpected content of %v: got [%v], want [%v]",
-				filename, string(actualContent), string(expected))
+		expectedMsgs[tt.recipient.ID] = append(expectedMsgs[tt.recipient.ID], msg)
+		// Compare with actual messages.
+		msgs, err := sc.ReadMessages(tt.recipient.ID, time.Time{})
+		if err != nil {
+			t.Errorf("ReadMessages(%q) unexpected error: %v", tt.recipient.ID, err)
+			continue
+		}
+		var actual []string
+		for _, m := range msgs {
+			actual = append(actual, m.Text)
+		}
+		if !reflect.DeepEqual(actual, expectedMsgs[tt.recipient.ID]) {
+			t.Errorf("ReadMessages(%q): got %v, want %v", tt.recipient.ID, actual, expectedMsgs[tt.recipient.ID])
 		}
 	}
+	// Each line of a file contains the time and the quoted message.
+	filename := filepath.Join(rootDir, hex.EncodeToString([]byte("Bob"))+"_secondary_channel.txt")
+	lines := strings.Split(strings.TrimSuffix(string(getFileContent(filename, t)), "\n"), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], ` "SVBD:26g3:AEUHE"`) ||
+		!strings.HasSuffix(lines[1], ` "SVBD:636328:yqggyod"`) {
+		t.Errorf("Unexpected content of %v: got %v", filename, lines)
+	}
 }
 
 func TestSendMessageDoesNotCrashForUnsupportedOwnerIdTypes(t *testing.T) {
@@ -92,9 +139,9 @@ func TestSendMessageDoesNotCrashForUnsupportedOwnerIdTypes(t *testing.T) {
 		recipient svalbardsrv.RecipientID
 		data      svalbardsrv.TokenMsgData
 	}{
-		{svalbardsrv.RecipientID{"SMS", "alice"}, svalbardsrv.TokenMsgData{"req42", "hehggeo"}},
-		{svalbardsrv.RecipientID{"email", "Mary"}, svalbardsrv.TokenMsgData{"76263", "662563"}},
-		{svalbardsrv.RecipientID{"foo", "Bob"}, svalbardsrv.TokenMsgData{"63tg3", "63hgg3"}},
+		{svalbardsrv.RecipientID{"SMS", "alice"}, svalbardsrv.TokenMsgData{ReqID: "req42", Token: "hehggeo"}},
+		{svalbardsrv.RecipientID{"email", "Mary"}, svalbardsrv.TokenMsgData{ReqID: "76263", Token: "662563"}},
+		{svalbardsrv.RecipientID{"foo", "Bob"}, svalbardsrv.TokenMsgData{ReqID: "63tg3", Token: "63hgg3"}},
 	}
 	// Every entry corresponds to a file that should be created for each distinct ownerID.
 	for _, tt := range tests {
@@ -106,3 +153,153 @@ func TestSendMessageDoesNotCrashForUnsupportedOwnerIdTypes(t *testing.T) {
 		}
 	}
 }
+
+func TestSendConfinesFilesToRootDir(t *testing.T) {
+	parentDir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "svalbard_file_channel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootDir := filepath.Join(parentDir, "channel")
+	sc := NewChannel(rootDir)
+	data := svalbardsrv.TokenMsgData{ReqID: "req42", Token: "asdfie"}
+	for _, ownerID := range []string{"../escaped", "../../etc/x", "/tmp/x", "a/b", "..", ".", "x\x00y"} {
+		if err := sc.Send(svalbardsrv.RecipientID{IDType: "FILE", ID: ownerID}, data); err != nil {
+			t.Errorf("Send() to %q unexpected error: %v", ownerID, err)
+			continue
+		}
+		msgs, err := sc.ReadMessages(ownerID, time.Time{})
+		if err != nil || len(msgs) != 1 || msgs[0].Text != "SVBD:req42:asdfie" {
+			t.Errorf("ReadMessages(%q): got %v (error: %v), want a single message", ownerID, msgs, err)
+		}
+	}
+	// All files are regular files directly in rootDir, readable only by the owner.
+	if files, _ := ioutil.ReadDir(parentDir); len(files) != 1 || files[0].Name() != "channel" {
+		t.Errorf("Unexpected files outside of root dir: %v", files)
+	}
+	files, err := ioutil.ReadDir(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 7 {
+		t.Errorf("Unexpected number of files in root dir: got %d, want 7", len(files))
+	}
+	for _, f := range files {
+		if !f.Mode().IsRegular() || f.Mode().Perm() != 0600 {
+			t.Errorf("Unexpected mode of %v: %v", f.Name(), f.Mode())
+		}
+	}
+	if info, err := os.Stat(rootDir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("Unexpected mode of root dir: %v (error: %v)", info.Mode(), err)
+	}
+
+	for _, ownerID := range []string{"", strings.Repeat("a", MaxOwnerIDLength+1)} {
+		if err := sc.Send(svalbardsrv.RecipientID{IDType: "FILE", ID: ownerID}, data); err != ErrInvalidOwnerID {
+			t.Errorf("Send() to %q: got error [%v], want [%v]", ownerID, err, ErrInvalidOwnerID)
+		}
+	}
+	// Symlinks are not followed.
+	filename, _ := sc.Filename("mallory")
+	if err := os.Symlink(filepath.Join(parentDir, "target"), filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.Send(svalbardsrv.RecipientID{IDType: "FILE", ID: "mallory"}, data); err != ErrNotRegularFile {
+		t.Errorf("Send() to a symlink: got error [%v], want [%v]", err, ErrNotRegularFile)
+	}
+	if _, err := os.Lstat(filepath.Join(parentDir, "target")); !os.IsNotExist(err) {
+		t.Errorf("Send() created the target of a symlink")
+	}
+}
+
+func TestSendRotatesFiles(t *testing.T) {
+	rootDir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "svalbard_file_channel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each line takes 39 bytes, so every file holds 2 messages.
+	sc := NewChannelWithConfig(rootDir, Config{MaxFileSize: 78, MaxRotatedFiles: 2})
+	start := time.Unix(1500000000, 0)
+	for i := 0; i < 9; i++ {
+		sendTime := start.Add(time.Duration(i) * time.Second)
+		sc.now = func() time.Time { return sendTime }
+		data := svalbardsrv.TokenMsgData{ReqID: fmt.Sprintf("req%d", i), Token: "asdfie"}
+		if err := sc.Send(svalbardsrv.RecipientID{IDType: "FILE", ID: "alice"}, data); err != nil {
+			t.Fatalf("Send(%v) unexpected error: %v", data, err)
+		}
+	}
+	filename, _ := sc.Filename("alice")
+	var tests = []struct {
+		filename string
+		size     int64
+	}{
+		{filename, 39},
+		{filename + ".1", 78},
+		{filename + ".2", 78},
+		{filename + ".3", -1},
+	}
+	for _, tt := range tests {
+		info, err := os.Stat(tt.filename)
+		if tt.size == -1 {
+			if !os.IsNotExist(err) {
+				t.Errorf("Unexpected file %v", tt.filename)
+			}
+			continue
+		}
+		if err != nil || info.Size() != tt.size {
+			t.Errorf("Size of %v: got %v (error: %v), want %v", tt.filename, info.Size(), err, tt.size)
+		}
+	}
+
+	// Messages in the rotated files are read too, the oldest ones are gone.
+	var since = []struct {
+		since  time.Time
+		reqIDs []string
+	}{
+		{time.Time{}, []string{"req4", "req5", "req6", "req7", "req8"}},
+		{start.Add(6 * time.Second), []string{"req6", "req7", "req8"}},
+		{start.Add(6*time.Second + 1), []string{"req7", "req8"}},
+		{start.Add(time.Minute), nil},
+	}
+	for _, tt := range since {
+		msgs, err := sc.ReadMessages("alice", tt.since)
+		if err != nil {
+			t.Errorf("ReadMessages(since %v) unexpected error: %v", tt.since, err)
+			continue
+		}
+		var reqIDs []string
+		for _, m := range msgs {
+			data, err := svalbardsrv.ParseMsgWithToken(m.Text)
+			if err != nil {
+				t.Errorf("ParseMsgWithToken(%q) unexpected error: %v", m.Text, err)
+			}
+			reqIDs = append(reqIDs, data.ReqID)
+		}
+		if !reflect.DeepEqual(reqIDs, tt.reqIDs) {
+			t.Errorf("ReadMessages(since %v): got %v, want %v", tt.since, reqIDs, tt.reqIDs)
+		}
+	}
+	if msgs, err := sc.ReadMessages("bob", time.Time{}); err != nil || len(msgs) != 0 {
+		t.Errorf("ReadMessages() of unknown owner: got %v (error: %v), want none", msgs, err)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	rootDir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "svalbard_file_channel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := NewChannel(filepath.Join(rootDir, "messages"))
+	if err := sc.CheckHealth(); err != nil {
+		t.Errorf("CheckHealth(): got [%v], want [nil]", err)
+	}
+	if files, err := ioutil.ReadDir(filepath.Join(rootDir, "messages")); err != nil || len(files) != 0 {
+		t.Errorf("Files after CheckHealth(): got %v (error: %v), want none", files, err)
+	}
+	// A root dir that cannot be created makes the channel unhealthy.
+	if err := ioutil.WriteFile(filepath.Join(rootDir, "file"), []byte("not a dir"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sc = NewChannel(filepath.Join(rootDir, "file", "messages"))
+	if err := sc.CheckHealth(); err == nil {
+		t.Errorf("CheckHealth() with invalid root dir: got [nil], want error")
+	}
+}
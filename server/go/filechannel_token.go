@@ -0,0 +1,52 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Binary filechannel_token prints the most recent token sent via filechannel
+// to an owner for a request, so that shell tests can use the tokens without
+// parsing the channel files.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/svalbard/server/go/filechannel"
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+func main() {
+	rootDir := flag.String("filechannel_root_dir", "", "root directory of the file-based secondary channel")
+	ownerID := flag.String("owner_id", "", "owner id to which the token was sent")
+	reqID := flag.String("request_id", "", "id of the request for the token")
+	flag.Parse()
+	if *rootDir == "" || *ownerID == "" || *reqID == "" {
+		log.Fatal("Please provide -filechannel_root_dir, -owner_id and -request_id")
+	}
+
+	msgs, err := filechannel.NewChannel(*rootDir).ReadMessages(*ownerID, time.Time{})
+	if err != nil {
+		log.Fatalf("Could not read messages of [%s]: %v", *ownerID, err)
+	}
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if data, err := svalbardsrv.ParseMsgWithToken(msgs[i].Text); err == nil && data.ReqID == *reqID {
+			fmt.Println(data.Token)
+			return
+		}
+	}
+	log.Fatalf("No token found for request [%s] of owner [%s]", *reqID, *ownerID)
+}
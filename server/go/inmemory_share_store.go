@@ -20,7 +20,9 @@
 package inmemorysharestore
 
 import (
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/google/svalbard/server/go/svalbardsrv"
 )
@@ -30,7 +32,10 @@ import (
 // The returned InMemory implements svalbardsrv.ShareStore-interface.
 func New() *InMemory {
 	return &InMemory{
-		store: make(map[string]string),
+		store:       make(map[string]string),
+		tombstones:  make(map[string]tombstone),
+		owners:      make(map[string]map[string]bool),
+		shareOwners: make(map[string]string),
 	}
 }
 
@@ -38,10 +43,36 @@ func New() *InMemory {
 type InMemory struct {
 	storeMutex sync.RWMutex
 	store      map[string]string
+	tombstones map[string]tombstone
+	// owners indexes the ids of the shares by the keys of their owners,
+	// shareOwners the keys of the owners by the ids of the shares.
+	owners            map[string]map[string]bool
+	shareOwners       map[string]string
+	maxSharesPerOwner int
+}
+
+// tombstone is a soft-deleted share.
+type tombstone struct {
+	value   string
+	purgeAt time.Time
+}
+
+// SetMaxSharesPerOwner sets the maximal number of shares that StoreForOwner
+// indexes under a single owner to 'n' (unlimited if 0).
+func (ss *InMemory) SetMaxSharesPerOwner(n int) {
+	ss.storeMutex.Lock()
+	defer ss.storeMutex.Unlock()
+	ss.maxSharesPerOwner = n
 }
 
 // Store stores the given 'shareValue' under the specified 'shareID'.
 func (ss *InMemory) Store(shareID, shareValue string) error {
+	return ss.StoreForOwner(shareID, shareValue, "")
+}
+
+// StoreForOwner stores the given 'shareValue' under the specified 'shareID',
+// and indexes it under 'ownerKey', unless it is empty.
+func (ss *InMemory) StoreForOwner(shareID, shareValue, ownerKey string) error {
 	if shareID == "" {
 		return svalbardsrv.ErrInvalidShareID
 	}
@@ -50,13 +81,100 @@ func (ss *InMemory) Store(shareID, shareValue string) error {
 	}
 	ss.storeMutex.Lock()
 	defer ss.storeMutex.Unlock()
+	return ss.add(shareID, shareValue, ownerKey)
+}
+
+// Replace replaces the value of the share identified by 'shareID' with
+// 'shareValue', or stores it like Store if there is no such share.
+func (ss *InMemory) Replace(shareID, shareValue string) error {
+	if shareID == "" {
+		return svalbardsrv.ErrInvalidShareID
+	}
+	if shareValue == "" {
+		return svalbardsrv.ErrInvalidShareValue
+	}
+	ss.storeMutex.Lock()
+	defer ss.storeMutex.Unlock()
+	if _, shareExists := ss.store[shareID]; !shareExists {
+		return ss.add(shareID, shareValue, "")
+	}
+	ss.store[shareID] = shareValue
+	return nil
+}
+
+// add stores 'shareValue' under 'shareID', indexed under 'ownerKey' unless
+// it is empty.  The caller must hold the mutex.
+func (ss *InMemory) add(shareID, shareValue, ownerKey string) error {
 	if _, shareExists := ss.store[shareID]; shareExists {
 		return svalbardsrv.ErrShareAlreadyExists
 	}
+	// A new share replaces the tombstone of a deleted one.
+	_, deleted := ss.tombstones[shareID]
+	if ownerKey != "" {
+		n := len(ss.owners[ownerKey])
+		if deleted && ss.shareOwners[shareID] == ownerKey {
+			n--
+		}
+		if ss.maxSharesPerOwner > 0 && n >= ss.maxSharesPerOwner {
+			return svalbardsrv.ErrQuotaExceeded
+		}
+	}
+	if deleted {
+		delete(ss.tombstones, shareID)
+		ss.unindex(shareID)
+	}
+	if ownerKey != "" {
+		if ss.owners[ownerKey] == nil {
+			ss.owners[ownerKey] = make(map[string]bool)
+		}
+		ss.owners[ownerKey][shareID] = true
+		ss.shareOwners[shareID] = ownerKey
+	}
 	ss.store[shareID] = shareValue
 	return nil
 }
 
+// CheckCapacity returns ErrQuotaExceeded if the owner with 'ownerKey' has
+// the maximal number of shares besides the one identified by 'shareID'.
+func (ss *InMemory) CheckCapacity(shareID, ownerKey string) error {
+	ss.storeMutex.RLock()
+	defer ss.storeMutex.RUnlock()
+	n := len(ss.owners[ownerKey])
+	if ss.shareOwners[shareID] == ownerKey && ownerKey != "" {
+		n--
+	}
+	if ss.maxSharesPerOwner > 0 && n >= ss.maxSharesPerOwner {
+		return svalbardsrv.ErrQuotaExceeded
+	}
+	return nil
+}
+
+// OwnerShareIDs returns the ids of the shares indexed under 'ownerKey', sorted.
+func (ss *InMemory) OwnerShareIDs(ownerKey string) ([]string, error) {
+	ss.storeMutex.RLock()
+	defer ss.storeMutex.RUnlock()
+	var ids []string
+	for id := range ss.owners[ownerKey] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// unindex removes the share identified by 'shareID' from the index of its
+// owner, if any.
+func (ss *InMemory) unindex(shareID string) {
+	ownerKey, indexed := ss.shareOwners[shareID]
+	if !indexed {
+		return
+	}
+	delete(ss.owners[ownerKey], shareID)
+	if len(ss.owners[ownerKey]) == 0 {
+		delete(ss.owners, ownerKey)
+	}
+	delete(ss.shareOwners, shareID)
+}
+
 // Retrieve returns the value of the share identified by 'shareID',
 // if it is present in the store.  If no share is present, or if the
 // retrieval fails for some reason, it returns nil and an error message.
@@ -73,6 +191,18 @@ func (ss *InMemory) Retrieve(shareID string) (string, error) {
 	return shareValue, nil
 }
 
+// Contains returns true if the share identified by 'shareID' is present
+// in the store, without retrieving its value.
+func (ss *InMemory) Contains(shareID string) (bool, error) {
+	if shareID == "" {
+		return false, svalbardsrv.ErrInvalidShareID
+	}
+	ss.storeMutex.RLock()
+	defer ss.storeMutex.RUnlock()
+	_, shareExists := ss.store[shareID]
+	return shareExists, nil
+}
+
 // Delete removes from the store the share identified by 'shareID',
 // if it is present in the store.  If no share is present, or if the
 // deletion fails for some reason, it returns an error message.
@@ -87,5 +217,89 @@ func (ss *InMemory) Delete(shareID string) error {
 		return svalbardsrv.ErrShareNotFound
 	}
 	delete(ss.store, shareID)
+	ss.unindex(shareID)
+	return nil
+}
+
+// Count returns the number of shares in the store.
+func (ss *InMemory) Count() (int, error) {
+	ss.storeMutex.RLock()
+	defer ss.storeMutex.RUnlock()
+	return len(ss.store), nil
+}
+
+// ShareIDs returns the ids of all shares in the store, sorted.
+func (ss *InMemory) ShareIDs() ([]string, error) {
+	ss.storeMutex.RLock()
+	defer ss.storeMutex.RUnlock()
+	ids := make([]string, 0, len(ss.store))
+	for id := range ss.store {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// SoftDelete removes from the store the share identified by 'shareID',
+// but keeps it as a tombstone until 'purgeAt'.
+func (ss *InMemory) SoftDelete(shareID string, purgeAt time.Time) error {
+	if shareID == "" {
+		return svalbardsrv.ErrInvalidShareID
+	}
+	ss.storeMutex.Lock()
+	defer ss.storeMutex.Unlock()
+	shareValue, shareExists := ss.store[shareID]
+	if !shareExists {
+		return svalbardsrv.ErrShareNotFound
+	}
+	ss.tombstones[shareID] = tombstone{shareValue, purgeAt}
+	delete(ss.store, shareID)
 	return nil
 }
+
+// Undelete restores the share identified by 'shareID' from its tombstone,
+// if the tombstone is not due for purging at 'now'.
+func (ss *InMemory) Undelete(shareID string, now time.Time) error {
+	if shareID == "" {
+		return svalbardsrv.ErrInvalidShareID
+	}
+	ss.storeMutex.Lock()
+	defer ss.storeMutex.Unlock()
+	t, deleted := ss.tombstones[shareID]
+	if !deleted || !t.purgeAt.After(now) {
+		return svalbardsrv.ErrShareNotFound
+	}
+	ss.store[shareID] = t.value
+	delete(ss.tombstones, shareID)
+	return nil
+}
+
+// PurgeTime returns the purge time of the tombstone of the share identified
+// by 'shareID'.
+func (ss *InMemory) PurgeTime(shareID string) (time.Time, error) {
+	if shareID == "" {
+		return time.Time{}, svalbardsrv.ErrInvalidShareID
+	}
+	ss.storeMutex.RLock()
+	defer ss.storeMutex.RUnlock()
+	t, deleted := ss.tombstones[shareID]
+	if !deleted {
+		return time.Time{}, svalbardsrv.ErrShareNotFound
+	}
+	return t.purgeAt, nil
+}
+
+// Purge removes the tombstones that are due for purging at 'now'.
+func (ss *InMemory) Purge(now time.Time) (int, error) {
+	ss.storeMutex.Lock()
+	defer ss.storeMutex.Unlock()
+	n := 0
+	for id, t := range ss.tombstones {
+		if !t.purgeAt.After(now) {
+			delete(ss.tombstones, id)
+			ss.unindex(id)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Package logging configures structured logging (with log/slog) for
+// a Svalbard server, with a redaction layer that keeps secrets out of the logs:
+// values of attributes that may contain tokens, share values or solutions of
+// challenges are never emitted, and owner ids are replaced by their hashes.
+// Redaction is based on the keys of the attributes (at any nesting level),
+// so the code that logs must use the keys defined below.
+package logging
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// Keys of attributes that are redacted.
+const (
+	KeyToken             = "token"
+	KeyShareValue        = "share_value"
+	KeyChallengeSolution = "challenge_solution"
+	KeyOwnerID           = "owner_id"
+)
+
+// Redacted is the value emitted instead of the value of a secret attribute.
+const Redacted = "[REDACTED]"
+
+// secretKeys are the keys of the attributes whose values are never emitted.
+var secretKeys = map[string]bool{
+	KeyToken:             true,
+	KeyShareValue:        true,
+	KeyChallengeSolution: true,
+}
+
+// Errors returned upon failures.
+var (
+	ErrInvalidLevel  = errors.New("invalid log level")
+	ErrInvalidFormat = errors.New("invalid log format")
+)
+
+// Config contains the parameters of the logging.
+type Config struct {
+	// Level is the minimum level of the emitted records; use a *slog.LevelVar
+	// to change it at runtime.  If nil, slog.LevelInfo is used.
+	Level slog.Leveler
+	// Format is "text" (default) or "json".
+	Format string
+	// OwnerIDKey (optional) is the key for hashing the owner ids with
+	// HMAC-SHA256.  Without a key, a random key of the process is used, so
+	// that the hashes can be correlated only within the logs of the process,
+	// and nobody can check whether a given owner id was logged.
+	OwnerIDKey []byte
+}
+
+// processKey returns the random key for hashing the owner ids of all the
+// handlers without Config.OwnerIDKey, which is generated once per process.
+var processKey = sync.OnceValues(func() ([]byte, error) {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+})
+
+// ParseLevel parses a log level, e.g. "debug", "info", "warn", "error",
+// or "info+2".
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(s))); err != nil {
+		return 0, ErrInvalidLevel
+	}
+	return level, nil
+}
+
+// NewHandler returns a slog.Handler that writes redacted records to 'w'.
+func NewHandler(w io.Writer, config Config) (slog.Handler, error) {
+	ownerIDKey := config.OwnerIDKey
+	if len(ownerIDKey) == 0 {
+		var err error
+		if ownerIDKey, err = processKey(); err != nil {
+			return nil, err
+		}
+	}
+	opts := &slog.HandlerOptions{
+		Level: config.Level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			return redact(a, ownerIDKey)
+		},
+	}
+	switch config.Format {
+	case "", "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, ErrInvalidFormat
+}
+
+// New returns a slog.Logger that writes redacted records to 'w'.
+func New(w io.Writer, config Config) (*slog.Logger, error) {
+	h, err := NewHandler(w, config)
+	if err != nil {
+		return nil, err
+	}
+	return slog.New(h), nil
+}
+
+// redact returns the attribute to be emitted instead of 'a'.
+func redact(a slog.Attr, ownerIDKey []byte) slog.Attr {
+	key := strings.ToLower(a.Key)
+	switch {
+	case secretKeys[key]:
+		return slog.String(a.Key, Redacted)
+	case key == KeyOwnerID:
+		return slog.String(a.Key, HashOwnerID(a.Value.Resolve().String(), ownerIDKey))
+	}
+	return a
+}
+
+// HashOwnerID returns the hash of 'ownerID' emitted in the logs, under
+// 'key' (if any).  Operators can compute it with the key of Config.OwnerIDKey
+// to find the records of a particular owner.
+func HashOwnerID(ownerID string, key []byte) string {
+	var sum []byte
+	if len(key) == 0 {
+		h := sha256.Sum256([]byte(ownerID))
+		sum = h[:]
+	} else {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(ownerID))
+		sum = mac.Sum(nil)
+	}
+	return "h:" + hex.EncodeToString(sum[:8])
+}
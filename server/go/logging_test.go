@@ -0,0 +1,177 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	var tests = []struct {
+		s     string
+		level slog.Level
+		err   error
+	}{
+		{"debug", slog.LevelDebug, nil},
+		{"INFO", slog.LevelInfo, nil},
+		{" warn ", slog.LevelWarn, nil},
+		{"error", slog.LevelError, nil},
+		{"info+2", slog.LevelInfo + 2, nil},
+		{"", 0, ErrInvalidLevel},
+		{"verbose", 0, ErrInvalidLevel},
+	}
+	for _, tt := range tests {
+		level, err := ParseLevel(tt.s)
+		if err != tt.err || level != tt.level {
+			t.Errorf("ParseLevel(%q): got %v (error: %v), want %v (error: %v)", tt.s, level, err, tt.level, tt.err)
+		}
+	}
+}
+
+func TestNewHandlerValidatesFormat(t *testing.T) {
+	for _, format := range []string{"", "text", "json"} {
+		if _, err := NewHandler(&bytes.Buffer{}, Config{Format: format}); err != nil {
+			t.Errorf("NewHandler() with format %q: got [%v], want [<nil>]", format, err)
+		}
+	}
+	if _, err := NewHandler(&bytes.Buffer{}, Config{Format: "xml"}); err != ErrInvalidFormat {
+		t.Errorf("NewHandler() with format xml: got [%v], want [%v]", err, ErrInvalidFormat)
+	}
+}
+
+// recipient mimics svalbardsrv.RecipientID, which logs as a group.
+type recipient struct {
+	idType, id string
+}
+
+func (r recipient) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("owner_id_type", r.idType), slog.String("owner_id", r.id))
+}
+
+func TestRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Config{Format: "json", OwnerIDKey: []byte("key")})
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	logger.Info("test",
+		"token", "secretToken",
+		"share_value", "secretShare",
+		"Challenge_Solution", "secretSolution",
+		"owner_id", "+41791234567",
+		"recipient", recipient{"SMS", "+41791234567"},
+		slog.Group("nested", slog.String("token", "secretToken"), slog.String("request_id", "req1")),
+		"share_id", "abcd")
+	out := buf.String()
+	for _, secret := range []string{"secretToken", "secretShare", "secretSolution", "+41791234567"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("Log output contains %q: %s", secret, out)
+		}
+	}
+	var record struct {
+		Token         string `json:"token"`
+		OwnerID       string `json:"owner_id"`
+		SolutionValue string `json:"Challenge_Solution"`
+		Recipient     struct {
+			OwnerIDType string `json:"owner_id_type"`
+			OwnerID     string `json:"owner_id"`
+		} `json:"recipient"`
+		Nested struct {
+			Token     string `json:"token"`
+			RequestID string `json:"request_id"`
+		} `json:"nested"`
+		ShareID string `json:"share_id"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Invalid log output %s: %v", out, err)
+	}
+	hash := HashOwnerID("+41791234567", []byte("key"))
+	if record.Token != Redacted || record.SolutionValue != Redacted || record.Nested.Token != Redacted {
+		t.Errorf("Secrets in log output: got %s, want them %s", out, Redacted)
+	}
+	if record.OwnerID != hash || record.Recipient.OwnerID != hash {
+		t.Errorf("Owner ids in log output: got %s, want %s", out, hash)
+	}
+	if record.Recipient.OwnerIDType != "SMS" || record.Nested.RequestID != "req1" || record.ShareID != "abcd" {
+		t.Errorf("Other attributes in log output: got %s, want them unchanged", out)
+	}
+}
+
+func TestHashOwnerID(t *testing.T) {
+	h := HashOwnerID("tom@example.com", nil)
+	if !strings.HasPrefix(h, "h:") || len(h) != 18 {
+		t.Errorf("HashOwnerID(): got %q, want h:<16 hex digits>", h)
+	}
+	if HashOwnerID("tom@example.com", nil) != h {
+		t.Errorf("HashOwnerID() is not deterministic")
+	}
+	if HashOwnerID("jerry@example.com", nil) == h {
+		t.Errorf("HashOwnerID() of different ids: got the same hash %q", h)
+	}
+	if HashOwnerID("tom@example.com", []byte("key")) == h {
+		t.Errorf("HashOwnerID() with key: got the unkeyed hash %q", h)
+	}
+}
+
+func TestRandomOwnerIDKey(t *testing.T) {
+	// Without a key, the owner ids are hashed under a random key of the
+	// process, the same for all handlers.
+	var hashes []string
+	for i := 0; i < 2; i++ {
+		var buf bytes.Buffer
+		logger, err := New(&buf, Config{Format: "json"})
+		if err != nil {
+			t.Fatalf("New() failed: %v", err)
+		}
+		logger.Info("test", "owner_id", "+41791234567")
+		var record struct {
+			OwnerID string `json:"owner_id"`
+		}
+		if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+			t.Fatalf("Invalid log output %s: %v", buf.String(), err)
+		}
+		hashes = append(hashes, record.OwnerID)
+	}
+	if unkeyed := HashOwnerID("+41791234567", nil); hashes[0] == unkeyed || !strings.HasPrefix(hashes[0], "h:") {
+		t.Errorf("Owner id without key: got %q, want a hash other than the unkeyed %q", hashes[0], unkeyed)
+	}
+	if hashes[0] != hashes[1] {
+		t.Errorf("Owner ids of two handlers without key: got %q and %q, want the same hash", hashes[0], hashes[1])
+	}
+}
+
+func TestLevel(t *testing.T) {
+	var buf bytes.Buffer
+	level := &slog.LevelVar{}
+	level.Set(slog.LevelWarn)
+	logger, err := New(&buf, Config{Level: level})
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	logger.Info("hidden")
+	logger.Warn("shown")
+	level.Set(slog.LevelDebug)
+	logger.Debug("debug shown")
+	out := buf.String()
+	if strings.Contains(out, "hidden") || !strings.Contains(out, "msg=shown") || !strings.Contains(out, "debug shown") {
+		t.Errorf("Log output with levels: got %s, want only messages at the current level", out)
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Package metrics implements a small registry of metrics that are exposed
+// in the text format of Prometheus (version 0.0.4), so that a Svalbard server
+// can be monitored without any external dependencies.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the default upper bounds of the buckets of histograms,
+// in seconds, suitable for latencies of requests.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// labelSeparator separates the label values in the keys of the series.
+const labelSeparator = "\xff"
+
+// metric is a family of series with the same name.
+type metric interface {
+	// write writes the series of the metric in the text format.
+	write(w io.Writer, name string, labelNames []string) error
+}
+
+type family struct {
+	name       string
+	help       string
+	kind       string // "counter", "gauge" or "histogram"
+	labelNames []string
+	metric     metric
+}
+
+// Registry is a set of metrics.
+type Registry struct {
+	mutex    sync.Mutex
+	families map[string]*family
+}
+
+// NewRegistry returns a new, empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// register registers the metric created by 'newMetric' under 'name',
+// unless a metric of the same name and kind is registered already, and
+// returns the registered metric.  It panics if a metric of the same name
+// but another kind or other labels is registered.
+func (r *Registry) register(name, help, kind string, labelNames []string, newMetric func() metric) metric {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if f, ok := r.families[name]; ok {
+		if f.kind != kind || strings.Join(f.labelNames, ",") != strings.Join(labelNames, ",") {
+			panic("metrics: conflicting registrations of " + name)
+		}
+		return f.metric
+	}
+	f := &family{name, help, kind, labelNames, newMetric()}
+	r.families[name] = f
+	return f.metric
+}
+
+// Counter returns the counter 'name' with the given labels, registering it
+// if necessary.
+func (r *Registry) Counter(name, help string, labelNames ...string) *CounterVec {
+	return r.register(name, help, "counter", labelNames, func() metric {
+		return &CounterVec{labelCount: len(labelNames), values: make(map[string]float64)}
+	}).(*CounterVec)
+}
+
+// Histogram returns the histogram 'name' with the given buckets (upper
+// bounds, in increasing order) and labels, registering it if necessary.
+func (r *Registry) Histogram(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return r.register(name, help, "histogram", labelNames, func() metric {
+		return &HistogramVec{labelCount: len(labelNames), buckets: buckets, series: make(map[string]*histogram)}
+	}).(*HistogramVec)
+}
+
+// GaugeFunc registers the gauge 'name', whose value is obtained by calling
+// 'f' whenever the metrics are written.  If 'f' fails, the gauge is omitted.
+func (r *Registry) GaugeFunc(name, help string, f func() (float64, error)) {
+	r.register(name, help, "gauge", nil, func() metric {
+		return gaugeFunc(f)
+	})
+}
+
+// WriteText writes all metrics to 'w' in the text format, sorted by name.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mutex.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+	for _, f := range families {
+		var buf bytes.Buffer
+		if err := f.metric.write(&buf, f.name, f.labelNames); err != nil {
+			continue
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+		if _, err := buf.WriteTo(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeHTTP serves the metrics in the text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "expected GET request", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteText(w)
+}
+
+// CounterVec is a counter with labels.
+type CounterVec struct {
+	labelCount int
+	mutex      sync.Mutex
+	values     map[string]float64
+}
+
+// Inc increments the counter with the given label values by 1.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increments the counter with the given label values by 'v' (which must
+// not be negative).
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	if c == nil {
+		return
+	}
+	if len(labelValues) != c.labelCount || v < 0 {
+		panic("metrics: invalid use of counter")
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[strings.Join(labelValues, labelSeparator)] += v
+}
+
+// Value returns the value of the counter with the given label values.
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.values[strings.Join(labelValues, labelSeparator)]
+}
+
+func (c *CounterVec) write(w io.Writer, name string, labelNames []string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labelNames, key, "", ""), formatValue(c.values[key]))
+	}
+	return nil
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative; the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec is a histogram with labels.
+type HistogramVec struct {
+	labelCount int
+	buckets    []float64
+	mutex      sync.Mutex
+	series     map[string]*histogram
+}
+
+// Observe adds observation 'v' to the histogram with the given label values.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	if h == nil {
+		return
+	}
+	if len(labelValues) != h.labelCount {
+		panic("metrics: invalid use of histogram")
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	key := strings.Join(labelValues, labelSeparator)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	s.counts[i]++
+	s.sum += v
+	s.count++
+}
+
+// ObserveDuration adds the duration since 'start' in seconds to the histogram
+// with the given label values.
+func (h *HistogramVec) ObserveDuration(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// Count returns the number of observations in the histogram with the given
+// label values.
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if s, ok := h.series[strings.Join(labelValues, labelSeparator)]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(w io.Writer, name string, labelNames []string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(labelNames, key, "le", formatValue(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(labelNames, key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(labelNames, key, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(labelNames, key, "", ""), s.count)
+	}
+	return nil
+}
+
+type gaugeFunc func() (float64, error)
+
+func (g gaugeFunc) write(w io.Writer, name string, labelNames []string) error {
+	v, err := g()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s %s\n", name, formatValue(v))
+	return err
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels returns the labels of the series with key 'key' in the form
+// {name="value",...}, with the extra label 'extraName' (if not empty).
+func formatLabels(labelNames []string, key, extraName, extraValue string) string {
+	var parts []string
+	if len(labelNames) > 0 {
+		for i, value := range strings.Split(key, labelSeparator) {
+			parts = append(parts, labelNames[i]+`="`+escapeLabelValue(value)+`"`)
+		}
+	}
+	if extraName != "" {
+		parts = append(parts, extraName+`="`+extraValue+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+// statusRecorder records the status of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// InstrumentHandler returns a handler that calls 'h' and counts the requests,
+// and measures their latencies, per 'handler' and status of the response,
+// in the metrics http_requests_total and http_request_duration_seconds
+// of 'r'.
+func InstrumentHandler(r *Registry, handler string, h http.HandlerFunc) http.HandlerFunc {
+	requests := r.Counter("http_requests_total", "Number of HTTP requests.", "handler", "status")
+	durations := r.Histogram("http_request_duration_seconds", "Latencies of HTTP requests.",
+		DefaultBuckets, "handler", "status")
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h(rec, req)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		status := strconv.Itoa(rec.status)
+		requests.Inc(handler, status)
+		durations.ObserveDuration(start, handler, status)
+	}
+}
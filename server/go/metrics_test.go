@@ -0,0 +1,177 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func writeText(t *testing.T, r *Registry) string {
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatalf("WriteText(): got [%v], want [nil]", err)
+	}
+	return buf.String()
+}
+
+func TestCounters(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("requests_total", "Number of requests.", "handler", "status")
+	c.Inc("store", "200")
+	c.Inc("store", "200")
+	c.Add(3, "retrieve", "403")
+	if got := r.Counter("requests_total", "Number of requests.", "handler", "status"); got != c {
+		t.Errorf("Counter(%q) again: got another counter, want the registered one", "requests_total")
+	}
+	want := `# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{handler="retrieve",status="403"} 3
+requests_total{handler="store",status="200"} 2
+`
+	if got := writeText(t, r); got != want {
+		t.Errorf("WriteText(): got [%v], want [%v]", got, want)
+	}
+	if got := c.Value("store", "200"); got != 2 {
+		t.Errorf("Value(%q, %q): got [%v], want [%v]", "store", "200", got, 2)
+	}
+}
+
+func TestHistograms(t *testing.T) {
+	r := NewRegistry()
+	h := r.Histogram("latency_seconds", "Latencies.", []float64{0.1, 1}, "op")
+	for _, v := range []float64{0.05, 0.1, 0.5, 2} {
+		h.Observe(v, "store")
+	}
+	want := `# HELP latency_seconds Latencies.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{op="store",le="0.1"} 2
+latency_seconds_bucket{op="store",le="1"} 3
+latency_seconds_bucket{op="store",le="+Inf"} 4
+latency_seconds_sum{op="store"} 2.65
+latency_seconds_count{op="store"} 4
+`
+	if got := writeText(t, r); got != want {
+		t.Errorf("WriteText(): got [%v], want [%v]", got, want)
+	}
+	if got := h.Count("store"); got != 4 {
+		t.Errorf("Count(%q): got [%v], want [%v]", "store", got, 4)
+	}
+}
+
+func TestGaugeFuncs(t *testing.T) {
+	r := NewRegistry()
+	var err error
+	r.GaugeFunc("shares", "Number of shares.", func() (float64, error) { return 42, err })
+	want := "# HELP shares Number of shares.\n# TYPE shares gauge\nshares 42\n"
+	if got := writeText(t, r); got != want {
+		t.Errorf("WriteText(): got [%v], want [%v]", got, want)
+	}
+	// A failing gauge is omitted.
+	err = errors.New("failed")
+	if got := writeText(t, r); got != "" {
+		t.Errorf("WriteText() with failing gauge: got [%v], want []", got)
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("errors_total", "Errors,\nby \\ message.", "message").Inc("a \"quoted\"\nmessage \\")
+	want := `# HELP errors_total Errors,\nby \\ message.
+# TYPE errors_total counter
+errors_total{message="a \"quoted\"\nmessage \\"} 1
+`
+	if got := writeText(t, r); got != want {
+		t.Errorf("WriteText(): got [%v], want [%v]", got, want)
+	}
+}
+
+func TestConflictingRegistrations(t *testing.T) {
+	tests := []struct {
+		desc     string
+		register func(r *Registry)
+	}{
+		{"other kind", func(r *Registry) { r.Histogram("m", "", DefaultBuckets, "a") }},
+		{"other labels", func(r *Registry) { r.Counter("m", "", "b") }},
+	}
+	for _, tt := range tests {
+		r := NewRegistry()
+		r.Counter("m", "", "a")
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("registration with %s: got no panic, want panic", tt.desc)
+				}
+			}()
+			tt.register(r)
+		}()
+	}
+}
+
+func TestInstrumentHandler(t *testing.T) {
+	r := NewRegistry()
+	h := InstrumentHandler(r, "test", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/fail" {
+			http.Error(w, "failed", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	for _, path := range []string{"/ok", "/ok", "/fail"} {
+		h(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	tests := []struct {
+		status string
+		count  float64
+	}{
+		{"200", 2},
+		{"403", 1},
+	}
+	requests := r.Counter("http_requests_total", "Number of HTTP requests.", "handler", "status")
+	durations := r.Histogram("http_request_duration_seconds", "Latencies of HTTP requests.",
+		DefaultBuckets, "handler", "status")
+	for _, tt := range tests {
+		if got := requests.Value("test", tt.status); got != tt.count {
+			t.Errorf("http_requests_total{status=%q}: got [%v], want [%v]", tt.status, got, tt.count)
+		}
+		if got := durations.Count("test", tt.status); float64(got) != tt.count {
+			t.Errorf("http_request_duration_seconds_count{status=%q}: got [%v], want [%v]", tt.status, got, tt.count)
+		}
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("c", "A counter.").Inc()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type: got [%v], want [text/plain; version=0.0.4...]", got)
+	}
+	if got, want := w.Body.String(), "# HELP c A counter.\n# TYPE c counter\nc 1\n"; got != want {
+		t.Errorf("body: got [%v], want [%v]", got, want)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/metrics", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST /metrics: got [%v], want [%v]", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Package msgtemplate renders human-readable, localized messages with tokens
+// to be sent via secondary channels.  Every rendered message embeds the line
+// generated by svalbardsrv.GetMsgWithToken, so that the clients can still
+// extract the token using svalbardsrv.ParseMsgWithToken.
+package msgtemplate
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+// DefaultLocale is the locale used for messages in unsupported locales.
+const DefaultLocale = "en"
+
+// DefaultTemplate is the name of the template used for owner id types
+// that have no template of their own.
+const DefaultTemplate = "default"
+
+// Errors returned upon failures when loading catalogs.
+var (
+	ErrInvalidLocale    = errors.New("invalid locale")
+	ErrMissingDefault   = errors.New("catalog has no default template")
+	ErrMissingOperation = errors.New("catalog has no name for an operation")
+	ErrMissingTokenLine = errors.New("template does not embed the token line")
+	ErrMissingLocale    = errors.New("no catalog for the default locale")
+)
+
+// Catalog contains the templates and the names of the operations
+// for a single locale.  Templates are keyed by owner id type (in upper case),
+// or by DefaultTemplate.  Operations are keyed by "storage", "retrieval",
+// "deletion" and (optionally, see Add) "renewal" and "undeletion".
+type Catalog struct {
+	Operations map[string]string `json:"operations"`
+	Templates  map[string]string `json:"templates"`
+}
+
+// MsgData is the data available to the templates.
+type MsgData struct {
+	ReqID     string
+	Token     string
+	Operation string                  // localized name of the operation
+	Recipient svalbardsrv.RecipientID // the recipient of the message
+	TokenLine string                  // the line with token, as generated by svalbardsrv.GetMsgWithToken
+}
+
+// operationKeys are the keys of the operations in the catalogs.
+var operationKeys = map[svalbardsrv.Operation]string{
+	svalbardsrv.OpStoreShare:    "storage",
+	svalbardsrv.OpRetrieveShare: "retrieval",
+	svalbardsrv.OpDeleteShare:   "deletion",
+	svalbardsrv.OpRenewShare:    "renewal",
+	svalbardsrv.OpUndeleteShare: "undeletion",
+}
+
+// optionalOperations are the keys of operations that catalogs may omit, as
+// they were added after the catalog format; the builtin names are used
+// instead.
+var optionalOperations = map[string]bool{"renewal": true, "undeletion": true}
+
+// BuiltinCatalogs are the catalogs available in every Set returned by New.
+var BuiltinCatalogs = map[string]Catalog{
+	"en": {
+		Operations: map[string]string{
+			"storage":    "storage",
+			"retrieval":  "retrieval",
+			"deletion":   "deletion",
+			"renewal":    "renewal",
+			"undeletion": "undeletion",
+		},
+		Templates: map[string]string{
+			DefaultTemplate: "Your Svalbard {{.Operation}} code for request {{.ReqID}} is {{.Token}}.\n" +
+				"If you did not request it, please ignore this message.\n" +
+				"{{.TokenLine}}",
+			"SMS": "Svalbard {{.Operation}} code: {{.Token}}\n{{.TokenLine}}",
+		},
+	},
+	"de": {
+		Operations: map[string]string{
+			"storage":    "Speicherung",
+			"retrieval":  "Abfrage",
+			"deletion":   "Löschung",
+			"renewal":    "Verlängerung",
+			"undeletion": "Wiederherstellung",
+		},
+		Templates: map[string]string{
+			DefaultTemplate: "Ihr Svalbard-Code für die {{.Operation}} (Anfrage {{.ReqID}}) lautet {{.Token}}.\n" +
+				"Falls Sie ihn nicht angefordert haben, ignorieren Sie bitte diese Nachricht.\n" +
+				"{{.TokenLine}}",
+		},
+	},
+	"fr": {
+		Operations: map[string]string{
+			"storage":    "le stockage",
+			"retrieval":  "la récupération",
+			"deletion":   "la suppression",
+			"renewal":    "le renouvellement",
+			"undeletion": "la restauration",
+		},
+		Templates: map[string]string{
+			DefaultTemplate: "Votre code Svalbard pour {{.Operation}} (demande {{.ReqID}}) est {{.Token}}.\n" +
+				"Si vous ne l'avez pas demandé, veuillez ignorer ce message.\n" +
+				"{{.TokenLine}}",
+		},
+	},
+}
+
+// localeCatalog is a Catalog with parsed templates.
+type localeCatalog struct {
+	operations map[string]string
+	templates  map[string]*template.Template
+}
+
+// Set is a set of catalogs, one per locale.  It is safe for concurrent use,
+// so that the catalogs can be reloaded while messages are being rendered.
+type Set struct {
+	mutex    sync.RWMutex
+	catalogs map[string]*localeCatalog
+}
+
+// New returns a new Set with the BuiltinCatalogs.
+func New() *Set {
+	s := &Set{catalogs: make(map[string]*localeCatalog)}
+	for locale, catalog := range BuiltinCatalogs {
+		if err := s.Add(locale, catalog); err != nil {
+			panic("invalid builtin catalog for " + locale + ": " + err.Error())
+		}
+	}
+	return s
+}
+
+// NormalizeLocale returns the normalized form of the given locale,
+// e.g. "de-ch" for "de_CH", or an empty string for an invalid locale.
+// Valid locales consist of ASCII letters, digits and separators only.
+func NormalizeLocale(locale string) string {
+	locale = strings.Replace(strings.ToLower(strings.TrimSpace(locale)), "_", "-", -1)
+	if len(locale) > 35 {
+		return ""
+	}
+	for _, c := range locale {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return ""
+		}
+	}
+	return locale
+}
+
+// Add adds 'catalog' for the given locale, replacing any existing catalog
+// for that locale.  The catalog must name all operations (except optional
+// ones, whose names default to those of the builtin catalog for the locale
+// or its language, or else for DefaultLocale), and contain a DefaultTemplate,
+// and each template must embed {{.TokenLine}}.
+func (s *Set) Add(locale string, catalog Catalog) error {
+	locale = NormalizeLocale(locale)
+	if locale == "" {
+		return ErrInvalidLocale
+	}
+	if _, ok := catalog.Templates[DefaultTemplate]; !ok {
+		return ErrMissingDefault
+	}
+	lc := &localeCatalog{
+		operations: make(map[string]string),
+		templates:  make(map[string]*template.Template),
+	}
+	for _, key := range operationKeys {
+		name, ok := catalog.Operations[key]
+		if (!ok || name == "") && optionalOperations[key] {
+			name, ok = builtinOperation(locale, key), true
+		}
+		if !ok || name == "" {
+			return ErrMissingOperation
+		}
+		lc.operations[key] = name
+	}
+	for name, text := range catalog.Templates {
+		if name != DefaultTemplate {
+			name = strings.ToUpper(strings.TrimSpace(name))
+		}
+		tmpl, err := template.New(locale + "/" + name).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return err
+		}
+		// Verify that the template embeds the token line.
+		sample := MsgData{"sampleReqID", "sampleToken", "sample", svalbardsrv.RecipientID{IDType: name, ID: "sample"},
+			"SVBD:sampleReqID:sampleToken"}
+		msg, err := execute(tmpl, sample)
+		if err != nil {
+			return err
+		}
+		if !containsLine(msg, sample.TokenLine) {
+			return ErrMissingTokenLine
+		}
+		lc.templates[name] = tmpl
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.catalogs == nil {
+		s.catalogs = make(map[string]*localeCatalog)
+	}
+	s.catalogs[locale] = lc
+	return nil
+}
+
+// builtinOperation returns the name of the operation 'key' in the builtin
+// catalog for 'locale', or for its language, or else for DefaultLocale.
+func builtinOperation(locale, key string) string {
+	candidates := []string{locale}
+	if i := strings.Index(locale, "-"); i > 0 {
+		candidates = append(candidates, locale[:i])
+	}
+	for _, candidate := range append(candidates, DefaultLocale) {
+		if name := BuiltinCatalogs[candidate].Operations[key]; name != "" {
+			return name
+		}
+	}
+	return key
+}
+
+// LoadDir adds the catalogs stored in directory 'dir' as JSON-encoded
+// Catalogs in files named <locale>.json, e.g. "de-CH.json".
+func (s *Set) LoadDir(dir string) error {
+	filenames, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, filename := range filenames {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		var catalog Catalog
+		if err := json.Unmarshal(content, &catalog); err != nil {
+			return errors.New(filepath.Base(filename) + ": " + err.Error())
+		}
+		locale := strings.TrimSuffix(filepath.Base(filename), ".json")
+		if err := s.Add(locale, catalog); err != nil {
+			return errors.New(filepath.Base(filename) + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// ReloadDir replaces the catalogs in the set with the BuiltinCatalogs and
+// the catalogs stored in directory 'dir' (see LoadDir), if not empty,
+// so that catalogs removed from 'dir' are dropped.  If any of the catalogs
+// is invalid, the set is left unchanged.
+func (s *Set) ReloadDir(dir string) error {
+	fresh := New()
+	if dir != "" {
+		if err := fresh.LoadDir(dir); err != nil {
+			return err
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.catalogs = fresh.catalogs
+	return nil
+}
+
+// Locales returns the sorted list of the locales of the catalogs in the set.
+func (s *Set) Locales() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	locales := make([]string, 0, len(s.catalogs))
+	for locale := range s.catalogs {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// catalog returns the catalog for 'locale'.  If there is none, it falls back
+// to the catalog of the language of the locale (e.g. "de" for "de-ch"),
+// and then to the catalog of DefaultLocale.
+func (s *Set) catalog(locale string) *localeCatalog {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	locale = NormalizeLocale(locale)
+	if lc, ok := s.catalogs[locale]; ok {
+		return lc
+	}
+	if i := strings.Index(locale, "-"); i > 0 {
+		if lc, ok := s.catalogs[locale[:i]]; ok {
+			return lc
+		}
+	}
+	return s.catalogs[DefaultLocale]
+}
+
+// Render returns the message with the token in 'data' for 'recipient',
+// in the locale data.Locale.  The template for the owner id type of the
+// recipient is used, if the catalog has one, and DefaultTemplate otherwise.
+// It returns svalbardsrv.ErrInvalidParametersForMsgWithToken if 'data'
+// cannot be embedded in a message.
+func (s *Set) Render(recipient svalbardsrv.RecipientID, data svalbardsrv.TokenMsgData) (string, error) {
+	tokenLine, err := svalbardsrv.GetMsgWithToken(data)
+	if err != nil {
+		return "", err
+	}
+	lc := s.catalog(data.Locale)
+	if lc == nil {
+		return "", ErrMissingLocale
+	}
+	tmpl, ok := lc.templates[strings.ToUpper(strings.TrimSpace(recipient.IDType))]
+	if !ok {
+		tmpl = lc.templates[DefaultTemplate]
+	}
+	return execute(tmpl, MsgData{
+		ReqID:     data.ReqID,
+		Token:     data.Token,
+		Operation: lc.operations[operationKeys[data.Op]],
+		Recipient: recipient,
+		TokenLine: tokenLine,
+	})
+}
+
+func execute(tmpl *template.Template, data MsgData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// containsLine returns true if 'line' is one of the lines of 'msg'.
+func containsLine(msg, line string) bool {
+	for _, l := range strings.Split(msg, "\n") {
+		if strings.TrimSpace(l) == line {
+			return true
+		}
+	}
+	return false
+}
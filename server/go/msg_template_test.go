@@ -0,0 +1,237 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package msgtemplate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+var testOperations = map[string]string{"storage": "S", "retrieval": "R", "deletion": "D"}
+
+func TestRenderSelectsLocaleAndTemplate(t *testing.T) {
+	s := New()
+	if err := s.Add("de-CH", Catalog{
+		Operations: map[string]string{"storage": "Speicherung", "retrieval": "Abfrage", "deletion": "Löschung"},
+		Templates:  map[string]string{DefaultTemplate: "Grüezi! Code: {{.Token}}\n{{.TokenLine}}"},
+	}); err != nil {
+		t.Fatalf("Add() failed: %v", err)
+	}
+	sms := svalbardsrv.RecipientID{IDType: "sms", ID: "alice"}
+	email := svalbardsrv.RecipientID{IDType: "EMAIL", ID: "alice@example.com"}
+	var tests = []struct {
+		recipient svalbardsrv.RecipientID
+		op        svalbardsrv.Operation
+		locale    string
+		want      string
+	}{
+		{sms, svalbardsrv.OpStoreShare, "", "Svalbard storage code: asdfie\nSVBD:req42:asdfie"},
+		{sms, svalbardsrv.OpDeleteShare, "EN", "Svalbard deletion code: asdfie\nSVBD:req42:asdfie"},
+		{email, svalbardsrv.OpRetrieveShare, "en_GB",
+			"Your Svalbard retrieval code for request req42 is asdfie.\n" +
+				"If you did not request it, please ignore this message.\nSVBD:req42:asdfie"},
+		// Unsupported locales fall back to DefaultLocale.
+		{sms, svalbardsrv.OpStoreShare, "xx", "Svalbard storage code: asdfie\nSVBD:req42:asdfie"},
+		{sms, svalbardsrv.OpStoreShare, "<script>", "Svalbard storage code: asdfie\nSVBD:req42:asdfie"},
+		// The language of the locale is used if there is no catalog for the locale.
+		{email, svalbardsrv.OpDeleteShare, "fr-CA",
+			"Votre code Svalbard pour la suppression (demande req42) est asdfie.\n" +
+				"Si vous ne l'avez pas demandé, veuillez ignorer ce message.\nSVBD:req42:asdfie"},
+		// A locale without a template for the owner id type uses its default template.
+		{sms, svalbardsrv.OpStoreShare, "de_ch", "Grüezi! Code: asdfie\nSVBD:req42:asdfie"},
+		{sms, svalbardsrv.OpStoreShare, "de-AT",
+			"Ihr Svalbard-Code für die Speicherung (Anfrage req42) lautet asdfie.\n" +
+				"Falls Sie ihn nicht angefordert haben, ignorieren Sie bitte diese Nachricht.\nSVBD:req42:asdfie"},
+		{sms, svalbardsrv.OpRenewShare, "de-AT",
+			"Ihr Svalbard-Code für die Verlängerung (Anfrage req42) lautet asdfie.\n" +
+				"Falls Sie ihn nicht angefordert haben, ignorieren Sie bitte diese Nachricht.\nSVBD:req42:asdfie"},
+		{email, svalbardsrv.OpUndeleteShare, "fr",
+			"Votre code Svalbard pour la restauration (demande req42) est asdfie.\n" +
+				"Si vous ne l'avez pas demandé, veuillez ignorer ce message.\nSVBD:req42:asdfie"},
+	}
+	for _, tt := range tests {
+		data := svalbardsrv.TokenMsgData{ReqID: "req42", Token: "asdfie", Op: tt.op, Locale: tt.locale}
+		msg, err := s.Render(tt.recipient, data)
+		if err != nil {
+			t.Errorf("Render(%v, %v) unexpected error: %v", tt.recipient, data, err)
+			continue
+		}
+		if msg != tt.want {
+			t.Errorf("Render(%v, %v): got [%v], want [%v]", tt.recipient, data, msg, tt.want)
+		}
+		parsed, err := svalbardsrv.ParseMsgWithToken(msg)
+		if err != nil || parsed.ReqID != data.ReqID || parsed.Token != data.Token {
+			t.Errorf("ParseMsgWithToken(%q): got %v (error: %v), want %v", msg, parsed, err, data)
+		}
+	}
+}
+
+func TestRenderRejectsInvalidData(t *testing.T) {
+	s := New()
+	recipient := svalbardsrv.RecipientID{IDType: "SMS", ID: "alice"}
+	for _, data := range []svalbardsrv.TokenMsgData{
+		{ReqID: "req:42", Token: "asdfie"},
+		{ReqID: "req42", Token: ""},
+		{},
+	} {
+		if _, err := s.Render(recipient, data); err != svalbardsrv.ErrInvalidParametersForMsgWithToken {
+			t.Errorf("Render(%v, %v): got error [%v], want [%v]",
+				recipient, data, err, svalbardsrv.ErrInvalidParametersForMsgWithToken)
+		}
+	}
+	if _, err := (&Set{}).Render(recipient, svalbardsrv.TokenMsgData{ReqID: "req42", Token: "asdfie"}); err != ErrMissingLocale {
+		t.Errorf("Render() with an empty set: got error [%v], want [%v]", err, ErrMissingLocale)
+	}
+}
+
+func TestAddValidatesCatalogs(t *testing.T) {
+	var tests = []struct {
+		desc    string
+		locale  string
+		catalog Catalog
+		err     error
+	}{
+		{"valid catalog", "pl", Catalog{testOperations,
+			map[string]string{DefaultTemplate: "Kod: {{.Token}}\n{{.TokenLine}}"}}, nil},
+		{"invalid locale", "p l", Catalog{testOperations,
+			map[string]string{DefaultTemplate: "{{.TokenLine}}"}}, ErrInvalidLocale},
+		{"empty locale", "", Catalog{testOperations,
+			map[string]string{DefaultTemplate: "{{.TokenLine}}"}}, ErrInvalidLocale},
+		{"missing default", "pl", Catalog{testOperations,
+			map[string]string{"SMS": "{{.TokenLine}}"}}, ErrMissingDefault},
+		{"missing operation", "pl", Catalog{map[string]string{"storage": "S", "retrieval": "R"},
+			map[string]string{DefaultTemplate: "{{.TokenLine}}"}}, ErrMissingOperation},
+		{"missing token line", "pl", Catalog{testOperations,
+			map[string]string{DefaultTemplate: "Kod: {{.Token}}"}}, ErrMissingTokenLine},
+		{"token line not on a separate line", "pl", Catalog{testOperations,
+			map[string]string{DefaultTemplate: "Kod: {{.TokenLine}}"}}, ErrMissingTokenLine},
+		{"missing token line in a specific template", "pl", Catalog{testOperations,
+			map[string]string{DefaultTemplate: "{{.TokenLine}}", "SMS": "{{.Token}}"}}, ErrMissingTokenLine},
+	}
+	for _, tt := range tests {
+		if err := New().Add(tt.locale, tt.catalog); err != tt.err {
+			t.Errorf("Add() of %s: got error [%v], want [%v]", tt.desc, err, tt.err)
+		}
+	}
+	for _, text := range []string{"{{.TokenLine", "{{.NoSuchField}}\n{{.TokenLine}}"} {
+		catalog := Catalog{testOperations, map[string]string{DefaultTemplate: text}}
+		if err := New().Add("pl", catalog); err == nil {
+			t.Errorf("Add() of invalid template %q: got no error", text)
+		}
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "msg_templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	catalog := `{"operations": {"storage": "zapisania", "retrieval": "odczytania", "deletion": "usunięcia"},
+	             "templates": {"default": "Kod do {{.Operation}}: {{.Token}}\n{{.TokenLine}}"}}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "pl.json"), []byte(catalog), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := New()
+	if err := s.LoadDir(dir); err != nil {
+		t.Fatalf("LoadDir() failed: %v", err)
+	}
+	if got, want := s.Locales(), []string{"de", "en", "fr", "pl"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Locales(): got %v, want %v", got, want)
+	}
+	data := svalbardsrv.TokenMsgData{ReqID: "req42", Token: "asdfie", Op: svalbardsrv.OpDeleteShare, Locale: "pl-PL"}
+	msg, err := s.Render(svalbardsrv.RecipientID{IDType: "SMS", ID: "alice"}, data)
+	if want := "Kod do usunięcia: asdfie\nSVBD:req42:asdfie"; err != nil || msg != want {
+		t.Errorf("Render(%v): got [%v] (error: %v), want [%v]", data, msg, err, want)
+	}
+	// The catalog does not name the renewal, so the builtin name is used.
+	data.Op = svalbardsrv.OpRenewShare
+	msg, err = s.Render(svalbardsrv.RecipientID{IDType: "SMS", ID: "alice"}, data)
+	if want := "Kod do renewal: asdfie\nSVBD:req42:asdfie"; err != nil || msg != want {
+		t.Errorf("Render(%v): got [%v] (error: %v), want [%v]", data, msg, err, want)
+	}
+
+	// Invalid catalogs are rejected.
+	if err := ioutil.WriteFile(filepath.Join(dir, "de.json"), []byte(`{"templates": {}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := New().LoadDir(dir); err == nil {
+		t.Errorf("LoadDir() with an invalid catalog: got no error")
+	}
+}
+
+func TestReloadDir(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "msg_templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeCatalog := func(locale, code string) {
+		catalog := `{"operations": {"storage": "s", "retrieval": "r", "deletion": "d"},
+		             "templates": {"default": "` + code + `: {{.Token}}\n{{.TokenLine}}"}}`
+		if err := ioutil.WriteFile(filepath.Join(dir, locale+".json"), []byte(catalog), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	render := func(s *Set, locale string) string {
+		data := svalbardsrv.TokenMsgData{ReqID: "req42", Token: "asdfie", Op: svalbardsrv.OpStoreShare, Locale: locale}
+		msg, err := s.Render(svalbardsrv.RecipientID{IDType: "SMS", ID: "alice"}, data)
+		if err != nil {
+			t.Fatalf("Render(%v): unexpected error: %v", data, err)
+		}
+		return strings.SplitN(msg, ":", 2)[0]
+	}
+	writeCatalog("pl", "Kod")
+	writeCatalog("it", "Codice")
+	s := New()
+	if err := s.LoadDir(dir); err != nil {
+		t.Fatalf("LoadDir() failed: %v", err)
+	}
+
+	// Changed catalogs are replaced, and removed ones are dropped.
+	writeCatalog("pl", "Kod dostępu")
+	if err := os.Remove(filepath.Join(dir, "it.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReloadDir(dir); err != nil {
+		t.Fatalf("ReloadDir() failed: %v", err)
+	}
+	if got, want := s.Locales(), []string{"de", "en", "fr", "pl"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Locales() after ReloadDir(): got %v, want %v", got, want)
+	}
+	if got, want := render(s, "pl"), "Kod dostępu"; got != want {
+		t.Errorf("Render() in pl after ReloadDir(): got [%v], want [%v]", got, want)
+	}
+
+	// An invalid catalog leaves the set unchanged.
+	if err := ioutil.WriteFile(filepath.Join(dir, "de.json"), []byte(`{"templates": {}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeCatalog("pl", "Kod nowy")
+	if err := s.ReloadDir(dir); err == nil {
+		t.Errorf("ReloadDir() with an invalid catalog: got no error")
+	}
+	if got, want := render(s, "pl"), "Kod dostępu"; got != want {
+		t.Errorf("Render() in pl after failed ReloadDir(): got [%v], want [%v]", got, want)
+	}
+}
@@ -0,0 +1,647 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Package outboxchannel implements a svalbardsrv.SecondaryChannel that
+// decouples the delivery of messages from the requests that trigger them:
+// messages are persisted in a Bolt DB ("outbox") and delivered via another
+// channel by background workers, with retries and exponential backoff.
+// Messages that cannot be delivered end up in a dead-letter bucket, as do
+// the messages whose tokens expire before they are delivered.  Dead letters
+// and delivery statuses keep neither the tokens nor the recipients in the
+// clear (only HMACs of the recipients under a secret key), and are purged
+// after a retention period.
+package outboxchannel
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt/bolt"
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+// Names of the Bolt buckets used by an Outbox.
+var (
+	pendingBucket    = []byte("OutboxPending")
+	deadLetterBucket = []byte("OutboxDeadLetters")
+	statusBucket     = []byte("OutboxStatus")
+	allOutboxBuckets = [][]byte{pendingBucket, deadLetterBucket, statusBucket}
+)
+
+// statusPurgePeriod is the interval in which expired delivery statuses
+// and dead letters are removed.
+const statusPurgePeriod = time.Minute
+
+// Default values of the parameters of an Outbox.
+const (
+	DefaultWorkers             = 4
+	DefaultMaxAttempts         = 5
+	DefaultInitialBackoff      = time.Second
+	DefaultMaxBackoff          = time.Minute
+	DefaultPollInterval        = time.Second
+	DefaultStatusRetention     = 24 * time.Hour
+	DefaultDeadLetterRetention = 7 * 24 * time.Hour
+)
+
+// Errors returned upon failures.
+var (
+	ErrMissingChannel = errors.New("missing channel")
+	ErrMissingKey     = errors.New("missing recipient key")
+	ErrOutboxClosed   = errors.New("outbox closed")
+)
+
+// errMessageGone indicates that a message is not pending any more.
+var errMessageGone = errors.New("message not pending any more")
+
+// Config contains the parameters of an Outbox.  Zero values are replaced
+// by the corresponding defaults, except for Key.
+type Config struct {
+	// Key is the secret under which the recipients are hashed (with
+	// HMAC-SHA256) in the delivery statuses and the dead letters.  The same
+	// key must be used across restarts.
+	Key []byte
+	// Workers is the number of goroutines that deliver the messages.
+	Workers int
+	// MaxAttempts is the number of delivery attempts after which a message
+	// is moved to the dead-letter bucket.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry, it is doubled
+	// after each subsequent failure, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// PollInterval is the interval in which the outbox is scanned for
+	// messages due for delivery.
+	PollInterval time.Duration
+	// StatusRetention is the period for which the delivery status
+	// of a message is available.
+	StatusRetention time.Duration
+	// DeadLetterRetention is the period for which dead letters are kept.
+	DeadLetterRetention time.Duration
+	// TokenValidity is the validity period of the tokens in the messages.
+	// Messages that are not delivered within it are dead-lettered instead of
+	// delivering expired tokens.  If it is zero, the tokens never expire.
+	TokenValidity time.Duration
+}
+
+func (c Config) withDefaults() Config {
+	if c.Workers <= 0 {
+		c.Workers = DefaultWorkers
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = DefaultMaxAttempts
+	}
+	if c.InitialBackoff <= 0 {
+		c.InitialBackoff = DefaultInitialBackoff
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = DefaultMaxBackoff
+	}
+	if c.PollInterval <= 0 {
+		c.PollInterval = DefaultPollInterval
+	}
+	if c.StatusRetention <= 0 {
+		c.StatusRetention = DefaultStatusRetention
+	}
+	if c.DeadLetterRetention <= 0 {
+		c.DeadLetterRetention = DefaultDeadLetterRetention
+	}
+	return c
+}
+
+// message is a persisted message waiting for delivery.
+type message struct {
+	Recipient   svalbardsrv.RecipientID  `json:"recipient"`
+	Data        svalbardsrv.TokenMsgData `json:"data"`
+	Attempts    int                      `json:"attempts"`
+	Enqueued    time.Time                `json:"enqueued"`
+	NextAttempt time.Time                `json:"next_attempt"`
+	// Expires is when the token expires, zero if it never does.
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// expired returns true if the token of the message has expired at 'now'.
+func (m message) expired(now time.Time) bool {
+	return !m.Expires.IsZero() && !now.Before(m.Expires)
+}
+
+// DeadLetter describes a message that could not be delivered.
+// Neither the token nor the id of the recipient of the message is retained.
+type DeadLetter struct {
+	// IDType is the owner id type of the recipient, and RecipientKey a keyed
+	// hash of the recipient (see Outbox.RecipientKey).
+	IDType       string    `json:"id_type"`
+	RecipientKey string    `json:"recipient_key"`
+	ReqID        string    `json:"req_id"`
+	Attempts     int       `json:"attempts"`
+	Enqueued     time.Time `json:"enqueued"`
+	Failed       time.Time `json:"failed"`
+	// Expired is true if the token expired before the message was delivered.
+	Expired bool `json:"expired,omitempty"`
+}
+
+// statusRecord is the delivery status of a message.
+type statusRecord struct {
+	Status   string    `json:"status"`
+	Attempts int       `json:"attempts"`
+	Updated  time.Time `json:"updated"`
+}
+
+// ownerIDTypeChecker is implemented by channels that can tell upfront whether
+// they support a given owner id type (e.g. by channelrouter.Router).
+type ownerIDTypeChecker interface {
+	SupportsOwnerIDType(idType string) bool
+}
+
+// Outbox is a svalbardsrv.SecondaryChannel implementation that persists
+// the messages and delivers them asynchronously via another channel.
+type Outbox struct {
+	db      *bolt.DB
+	channel svalbardsrv.SecondaryChannel
+	config  Config
+	now     func() time.Time
+
+	work    chan uint64
+	wakeup  chan struct{}
+	done    chan struct{}
+	workers sync.WaitGroup
+
+	// IDs of the messages currently being delivered.
+	inFlightMutex sync.Mutex
+	inFlight      map[uint64]bool
+
+	closeOnce sync.Once
+}
+
+// Open returns an Outbox that persists the messages in a Bolt database kept
+// in the specified file, and delivers them via 'channel'.  The messages
+// persisted by a previous instance and not delivered yet are delivered too.
+// The returned Outbox implements svalbardsrv.SecondaryChannel-interface.
+func Open(filename string, channel svalbardsrv.SecondaryChannel, config Config) (*Outbox, error) {
+	if channel == nil {
+		return nil, ErrMissingChannel
+	}
+	if len(config.Key) == 0 {
+		return nil, ErrMissingKey
+	}
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range allOutboxBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return fmt.Errorf("Could not initialize Bolt DB: %s", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	o := &Outbox{
+		db:       db,
+		channel:  channel,
+		config:   config.withDefaults(),
+		now:      time.Now,
+		work:     make(chan uint64),
+		wakeup:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		inFlight: make(map[uint64]bool),
+	}
+	o.workers.Add(o.config.Workers + 1)
+	go o.dispatch()
+	for i := 0; i < o.config.Workers; i++ {
+		go o.deliver()
+	}
+	return o, nil
+}
+
+// Send persists 'data' for delivery to the specified recipient, and returns
+// without waiting for the delivery.  It fails synchronously only if
+// the message is invalid, the recipient is known to be unsupported,
+// or the message could not be persisted.
+func (o *Outbox) Send(recipient svalbardsrv.RecipientID, data svalbardsrv.TokenMsgData) error {
+	if _, err := svalbardsrv.GetMsgWithToken(data); err != nil {
+		return err
+	}
+	if checker, ok := o.channel.(ownerIDTypeChecker); ok && !checker.SupportsOwnerIDType(recipient.IDType) {
+		return svalbardsrv.ErrUnsupportedOwnerIDType
+	}
+	select {
+	case <-o.done:
+		return ErrOutboxClosed
+	default:
+	}
+	now := o.now()
+	m := message{
+		Recipient:   recipient,
+		Data:        data,
+		Enqueued:    now,
+		NextAttempt: now,
+	}
+	if o.config.TokenValidity > 0 {
+		m.Expires = now.Add(o.config.TokenValidity)
+	}
+	msg, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	status, err := json.Marshal(statusRecord{Status: svalbardsrv.DeliveryPending, Updated: now})
+	if err != nil {
+		return err
+	}
+	err = o.db.Update(func(tx *bolt.Tx) error {
+		pending := tx.Bucket(pendingBucket)
+		seq, err := pending.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := pending.Put(idToKey(seq), msg); err != nil {
+			return err
+		}
+		return tx.Bucket(statusBucket).Put(o.statusKey(recipient, data.ReqID), status)
+	})
+	if err != nil {
+		return err
+	}
+	select {
+	case o.wakeup <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SupportedOwnerIDTypes returns the owner id types supported by the
+// underlying channel, if it can enumerate them.
+func (o *Outbox) SupportedOwnerIDTypes() []string {
+	if lister, ok := o.channel.(svalbardsrv.OwnerIDTypeLister); ok {
+		return lister.SupportedOwnerIDTypes()
+	}
+	return nil
+}
+
+// Recipient returns 'recipient' normalized by the underlying channel, if it
+// is a svalbardsrv.RecipientNormalizer, and unchanged otherwise.
+func (o *Outbox) Recipient(recipient svalbardsrv.RecipientID) svalbardsrv.RecipientID {
+	if normalizer, ok := o.channel.(svalbardsrv.RecipientNormalizer); ok {
+		return normalizer.Recipient(recipient)
+	}
+	return recipient
+}
+
+// DeliveryStatus returns the delivery status of the most recent message
+// with the request id 'reqID' sent to 'recipient'.
+func (o *Outbox) DeliveryStatus(recipient svalbardsrv.RecipientID, reqID string) (string, error) {
+	var status statusRecord
+	err := o.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(statusBucket).Get(o.statusKey(recipient, reqID))
+		if v == nil {
+			return svalbardsrv.ErrDeliveryStatusNotFound
+		}
+		return json.Unmarshal(v, &status)
+	})
+	if err != nil {
+		return "", err
+	}
+	return status.Status, nil
+}
+
+// DeadLetters returns the messages that could not be delivered, and have not
+// been purged yet.
+func (o *Outbox) DeadLetters() ([]DeadLetter, error) {
+	var letters []DeadLetter
+	err := o.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadLetterBucket).ForEach(func(k, v []byte) error {
+			var letter DeadLetter
+			if err := json.Unmarshal(v, &letter); err != nil {
+				return err
+			}
+			letters = append(letters, letter)
+			return nil
+		})
+	})
+	return letters, err
+}
+
+// CheckHealth returns nil if the underlying Bolt DB is open and writable,
+// and the channel used for the delivery (if it implements
+// svalbardsrv.HealthChecker) is healthy.
+func (o *Outbox) CheckHealth() error {
+	if err := o.db.Update(func(tx *bolt.Tx) error { return nil }); err != nil {
+		return err
+	}
+	if checker, ok := o.channel.(svalbardsrv.HealthChecker); ok {
+		return checker.CheckHealth()
+	}
+	return nil
+}
+
+// Close stops the delivery of the messages, waiting for the ongoing
+// deliveries, and closes the underlying Bolt DB.  The messages that have
+// not been delivered yet remain in the outbox.
+func (o *Outbox) Close() error {
+	o.closeOnce.Do(func() {
+		close(o.done)
+	})
+	o.workers.Wait()
+	return o.db.Close()
+}
+
+// dispatch periodically scans the outbox for messages due for delivery,
+// and hands them over to the workers.
+func (o *Outbox) dispatch() {
+	defer o.workers.Done()
+	defer close(o.work)
+	ticker := time.NewTicker(o.config.PollInterval)
+	defer ticker.Stop()
+	var lastPurge time.Time
+	for {
+		if err := o.dispatchDue(); err != nil {
+			if err == ErrOutboxClosed {
+				return
+			}
+			slog.Error("outbox: scanning of pending messages failed", "error", err)
+		}
+		if now := o.now(); now.Sub(lastPurge) >= statusPurgePeriod {
+			if err := o.purgeStatuses(now.Add(-o.config.StatusRetention)); err != nil {
+				slog.Error("outbox: purging of delivery statuses failed", "error", err)
+			}
+			if err := o.purgeDeadLetters(now.Add(-o.config.DeadLetterRetention)); err != nil {
+				slog.Error("outbox: purging of dead letters failed", "error", err)
+			}
+			lastPurge = now
+		}
+		select {
+		case <-o.done:
+			return
+		case <-ticker.C:
+		case <-o.wakeup:
+		}
+	}
+}
+
+// dispatchDue hands over to the workers all messages that are due for
+// delivery or whose tokens have expired, and are not being delivered
+// already.
+func (o *Outbox) dispatchDue() error {
+	var due []uint64
+	now := o.now()
+	err := o.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(pendingBucket).ForEach(func(k, v []byte) error {
+			var msg message
+			if err := json.Unmarshal(v, &msg); err != nil {
+				return err
+			}
+			if !msg.NextAttempt.After(now) || msg.expired(now) {
+				due = append(due, keyToID(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range due {
+		if !o.markInFlight(id) {
+			continue
+		}
+		select {
+		case o.work <- id:
+		case <-o.done:
+			return ErrOutboxClosed
+		}
+	}
+	return nil
+}
+
+func (o *Outbox) markInFlight(id uint64) bool {
+	o.inFlightMutex.Lock()
+	defer o.inFlightMutex.Unlock()
+	if o.inFlight[id] {
+		return false
+	}
+	o.inFlight[id] = true
+	return true
+}
+
+func (o *Outbox) clearInFlight(id uint64) {
+	o.inFlightMutex.Lock()
+	defer o.inFlightMutex.Unlock()
+	delete(o.inFlight, id)
+}
+
+// deliver delivers the messages handed over by dispatch, until the outbox
+// is closed.
+func (o *Outbox) deliver() {
+	defer o.workers.Done()
+	for id := range o.work {
+		if err := o.deliverMessage(id); err != nil {
+			slog.Error("outbox: updating of message failed", "message_id", id, "error", err)
+		}
+		o.clearInFlight(id)
+	}
+}
+
+// deliverMessage makes a single delivery attempt of the message 'id',
+// and updates the outbox according to the outcome.  A message whose token
+// has expired, or would expire before the next attempt, is dead-lettered.
+func (o *Outbox) deliverMessage(id uint64) error {
+	var msg message
+	err := o.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(pendingBucket).Get(idToKey(id))
+		if v == nil {
+			return errMessageGone
+		}
+		return json.Unmarshal(v, &msg)
+	})
+	if err == errMessageGone {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var sendErr error
+	expired := msg.expired(o.now())
+	if !expired {
+		sendErr = o.channel.Send(msg.Recipient, msg.Data)
+		msg.Attempts++
+	}
+	now := o.now()
+	if sendErr != nil && msg.expired(now.Add(o.backoff(msg.Attempts))) {
+		expired = true
+	}
+	return o.db.Update(func(tx *bolt.Tx) error {
+		pending := tx.Bucket(pendingBucket)
+		status := statusRecord{Attempts: msg.Attempts, Updated: now}
+		switch {
+		case !expired && sendErr == nil:
+			status.Status = svalbardsrv.DeliveryDelivered
+			if err := pending.Delete(idToKey(id)); err != nil {
+				return err
+			}
+		case expired || isPermanent(sendErr) || msg.Attempts >= o.config.MaxAttempts:
+			status.Status = svalbardsrv.DeliveryFailed
+			letter, err := json.Marshal(DeadLetter{
+				IDType:       normalizeIDType(msg.Recipient.IDType),
+				RecipientKey: o.RecipientKey(msg.Recipient),
+				ReqID:        msg.Data.ReqID,
+				Attempts:     msg.Attempts,
+				Enqueued:     msg.Enqueued,
+				Failed:       now,
+				Expired:      expired,
+			})
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(deadLetterBucket).Put(idToKey(id), letter); err != nil {
+				return err
+			}
+			if err := pending.Delete(idToKey(id)); err != nil {
+				return err
+			}
+		default:
+			status.Status = svalbardsrv.DeliveryPending
+			msg.NextAttempt = now.Add(o.backoff(msg.Attempts))
+			v, err := json.Marshal(msg)
+			if err != nil {
+				return err
+			}
+			if err := pending.Put(idToKey(id), v); err != nil {
+				return err
+			}
+		}
+		v, err := json.Marshal(status)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(statusBucket).Put(o.statusKey(msg.Recipient, msg.Data.ReqID), v)
+	})
+}
+
+// backoff returns the delay before the next attempt, after 'attempts'
+// failed ones.
+func (o *Outbox) backoff(attempts int) time.Duration {
+	delay := o.config.InitialBackoff
+	for i := 1; i < attempts && delay < o.config.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > o.config.MaxBackoff {
+		delay = o.config.MaxBackoff
+	}
+	return delay
+}
+
+// purgeStatuses removes the delivery statuses last updated before 'before'.
+func (o *Outbox) purgeStatuses(before time.Time) error {
+	return o.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(statusBucket)
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var status statusRecord
+			if err := json.Unmarshal(v, &status); err != nil || status.Updated.Before(before) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// purgeDeadLetters removes the dead letters that failed before 'before'.
+func (o *Outbox) purgeDeadLetters(before time.Time) error {
+	return o.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(deadLetterBucket)
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var letter DeadLetter
+			if err := json.Unmarshal(v, &letter); err != nil || letter.Failed.Before(before) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// isPermanent returns true if a delivery that failed with 'err' should not
+// be retried.
+func isPermanent(err error) bool {
+	return err == svalbardsrv.ErrUnsupportedOwnerIDType ||
+		err == svalbardsrv.ErrInvalidParametersForMsgWithToken
+}
+
+// statusKey returns the key of the delivery status of the message with
+// the request id 'reqID' sent to 'recipient'.  The key does not reveal
+// the recipient to anyone without the key of the outbox.
+func (o *Outbox) statusKey(recipient svalbardsrv.RecipientID, reqID string) []byte {
+	idType := normalizeIDType(recipient.IDType)
+	return []byte(o.hash("[" + idType + "][" + recipient.ID + "][" + reqID + "]"))
+}
+
+// RecipientKey returns the keyed hash of 'recipient' kept in dead letters,
+// so that operators can find the dead letters of a given recipient.
+func (o *Outbox) RecipientKey(recipient svalbardsrv.RecipientID) string {
+	idType := normalizeIDType(recipient.IDType)
+	return o.hash("recipient:[" + idType + "][" + recipient.ID + "]")
+}
+
+// hash returns the hex-encoded HMAC-SHA256 of 's' under the key of the outbox.
+func (o *Outbox) hash(s string) string {
+	mac := hmac.New(sha256.New, o.config.Key)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// normalizeIDType returns 'idType' as the channels compare it.
+func normalizeIDType(idType string) string {
+	return strings.ToUpper(strings.TrimSpace(idType))
+}
+
+func idToKey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+func keyToID(k []byte) uint64 {
+	return binary.BigEndian.Uint64(k)
+}
@@ -0,0 +1,386 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package outboxchannel
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt/bolt"
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+func getDBFilePath(filename string) string {
+	d, err := ioutil.TempDir("/tmp", "test-outbox-")
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create temp dir: %v", err))
+	}
+	return filepath.Join(d, filename)
+}
+
+var errTransient = errors.New("gateway temporarily unavailable")
+
+// failingChannel is a SecondaryChannel that fails the first 'failures'
+// deliveries of each message with 'err', and records the delivered messages.
+type failingChannel struct {
+	failures int
+	err      error
+
+	mutex     sync.Mutex
+	attempts  map[string]int
+	delivered []svalbardsrv.TokenMsgData
+}
+
+func newFailingChannel(failures int, err error) *failingChannel {
+	return &failingChannel{failures: failures, err: err, attempts: make(map[string]int)}
+}
+
+func (c *failingChannel) Send(recipient svalbardsrv.RecipientID, data svalbardsrv.TokenMsgData) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.attempts[data.ReqID]++
+	if c.attempts[data.ReqID] <= c.failures {
+		return c.err
+	}
+	c.delivered = append(c.delivered, data)
+	return nil
+}
+
+func (c *failingChannel) attemptsFor(reqID string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.attempts[reqID]
+}
+
+func (c *failingChannel) deliveredCount() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.delivered)
+}
+
+var testConfig = Config{
+	Key:            []byte("some recipient key"),
+	Workers:        2,
+	MaxAttempts:    3,
+	InitialBackoff: 10 * time.Millisecond,
+	MaxBackoff:     40 * time.Millisecond,
+	PollInterval:   5 * time.Millisecond,
+}
+
+// waitForStatus waits until the delivery status of the message 'reqID'
+// sent to 'recipient' becomes 'want'.
+func waitForStatus(o *Outbox, recipient svalbardsrv.RecipientID, reqID, want string, t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, err := o.DeliveryStatus(recipient, reqID)
+		if err == nil && status == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("DeliveryStatus(%v, %q): got [%v] (error: %v), want [%v]", recipient, reqID, status, err, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestOutboxDeliversMessagesWithRetries(t *testing.T) {
+	channel := newFailingChannel(2, errTransient)
+	o, err := Open(getDBFilePath("retries_test.db"), channel, testConfig)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer o.Close()
+	alice := svalbardsrv.RecipientID{"SMS", "alice"}
+	reqIDs := []string{"req1", "req2", "req3", "req4"}
+	for _, reqID := range reqIDs {
+		if err := o.Send(alice, svalbardsrv.TokenMsgData{ReqID: reqID, Token: "token" + reqID}); err != nil {
+			t.Fatalf("Send(%q) failed: %v", reqID, err)
+		}
+	}
+	for _, reqID := range reqIDs {
+		// The status is reported also for an owner id type in another case.
+		waitForStatus(o, svalbardsrv.RecipientID{"sms", "alice"}, reqID, svalbardsrv.DeliveryDelivered, t)
+	}
+	if got := channel.deliveredCount(); got != len(reqIDs) {
+		t.Errorf("Unexpected number of delivered messages: got %d, want %d", got, len(reqIDs))
+	}
+	if letters, err := o.DeadLetters(); err != nil || len(letters) != 0 {
+		t.Errorf("DeadLetters(): got %v (error: %v), want none", letters, err)
+	}
+}
+
+func TestOutboxMovesUndeliverableMessagesToDeadLetters(t *testing.T) {
+	var tests = []struct {
+		desc     string
+		err      error
+		attempts int
+	}{
+		{"transient failures", errTransient, testConfig.MaxAttempts},
+		{"permanent failure", svalbardsrv.ErrUnsupportedOwnerIDType, 1},
+	}
+	for _, tt := range tests {
+		channel := newFailingChannel(100, tt.err)
+		o, err := Open(getDBFilePath("dead_letter_test.db"), channel, testConfig)
+		if err != nil {
+			t.Fatalf("Open() failed: %v", err)
+		}
+		bob := svalbardsrv.RecipientID{"SMS", "bob"}
+		if err := o.Send(bob, svalbardsrv.TokenMsgData{ReqID: "req42", Token: "someToken"}); err != nil {
+			t.Fatalf("Send() with %s failed: %v", tt.desc, err)
+		}
+		waitForStatus(o, bob, "req42", svalbardsrv.DeliveryFailed, t)
+		letters, err := o.DeadLetters()
+		if err != nil {
+			t.Fatalf("DeadLetters() with %s failed: %v", tt.desc, err)
+		}
+		if len(letters) != 1 || letters[0].ReqID != "req42" || letters[0].RecipientKey != o.RecipientKey(bob) ||
+			letters[0].IDType != "SMS" || letters[0].Attempts != tt.attempts || letters[0].Expired {
+			t.Errorf("DeadLetters() with %s: got %+v, want a single letter for req42 after %d attempts",
+				tt.desc, letters, tt.attempts)
+		}
+		if got := channel.attemptsFor("req42"); got != tt.attempts {
+			t.Errorf("Delivery attempts with %s: got %d, want %d", tt.desc, got, tt.attempts)
+		}
+		o.Close()
+	}
+}
+
+func TestOutboxDeadLettersExpiredTokens(t *testing.T) {
+	config := testConfig
+	config.MaxAttempts = 1000
+	config.TokenValidity = 100 * time.Millisecond
+	channel := newFailingChannel(1000, errTransient)
+	o, err := Open(getDBFilePath("expiry_test.db"), channel, config)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer o.Close()
+	bob := svalbardsrv.RecipientID{"SMS", "bob"}
+	if err := o.Send(bob, svalbardsrv.TokenMsgData{ReqID: "req42", Token: "someToken"}); err != nil {
+		t.Fatalf("Send() failed: %v", err)
+	}
+	waitForStatus(o, bob, "req42", svalbardsrv.DeliveryFailed, t)
+	letters, err := o.DeadLetters()
+	if err != nil {
+		t.Fatalf("DeadLetters() failed: %v", err)
+	}
+	if len(letters) != 1 || letters[0].ReqID != "req42" || !letters[0].Expired {
+		t.Errorf("DeadLetters(): got %+v, want a single expired letter for req42", letters)
+	}
+	// The token is not retained once it has expired.
+	err = o.db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket(pendingBucket).Stats().KeyN; n != 0 {
+			return fmt.Errorf("%d pending messages", n)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Pending messages after expiry: got [%v], want none", err)
+	}
+	attempts := channel.attemptsFor("req42")
+	if attempts == 0 || attempts >= 10 {
+		t.Errorf("Delivery attempts within the validity of the token: got %d, want between 1 and 10", attempts)
+	}
+
+	// A message whose token expires before the first attempt is not
+	// delivered at all.
+	config.TokenValidity = time.Nanosecond
+	o2, err := Open(getDBFilePath("expiry_test.db"), channel, config)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer o2.Close()
+	if err := o2.Send(bob, svalbardsrv.TokenMsgData{ReqID: "req43", Token: "someToken"}); err != nil {
+		t.Fatalf("Send() failed: %v", err)
+	}
+	waitForStatus(o2, bob, "req43", svalbardsrv.DeliveryFailed, t)
+	if got := channel.attemptsFor("req43"); got != 0 {
+		t.Errorf("Delivery attempts of expired token: got %d, want 0", got)
+	}
+}
+
+func TestOutboxPurgesDeadLetters(t *testing.T) {
+	channel := newFailingChannel(100, svalbardsrv.ErrUnsupportedOwnerIDType)
+	o, err := Open(getDBFilePath("purge_test.db"), channel, testConfig)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer o.Close()
+	bob := svalbardsrv.RecipientID{"SMS", "bob"}
+	if err := o.Send(bob, svalbardsrv.TokenMsgData{ReqID: "req42", Token: "someToken"}); err != nil {
+		t.Fatalf("Send() failed: %v", err)
+	}
+	waitForStatus(o, bob, "req42", svalbardsrv.DeliveryFailed, t)
+	if err := o.purgeDeadLetters(time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("purgeDeadLetters() failed: %v", err)
+	}
+	if letters, err := o.DeadLetters(); err != nil || len(letters) != 1 {
+		t.Errorf("DeadLetters() after purging older letters: got %v (error: %v), want one", letters, err)
+	}
+	if err := o.purgeDeadLetters(time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("purgeDeadLetters() failed: %v", err)
+	}
+	if letters, err := o.DeadLetters(); err != nil || len(letters) != 0 {
+		t.Errorf("DeadLetters() after purging: got %v (error: %v), want none", letters, err)
+	}
+}
+
+func TestOutboxKeepsPendingMessagesAcrossReopening(t *testing.T) {
+	dbFilePath := getDBFilePath("reopen_test.db")
+	config := testConfig
+	config.MaxAttempts = 1000
+	broken := newFailingChannel(1000, errTransient)
+	o, err := Open(dbFilePath, broken, config)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	alice := svalbardsrv.RecipientID{"SMS", "alice"}
+	for _, reqID := range []string{"req1", "req2"} {
+		if err := o.Send(alice, svalbardsrv.TokenMsgData{ReqID: reqID, Token: "someToken"}); err != nil {
+			t.Fatalf("Send(%q) failed: %v", reqID, err)
+		}
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if err := o.Send(alice, svalbardsrv.TokenMsgData{ReqID: "req3", Token: "someToken"}); err != ErrOutboxClosed {
+		t.Errorf("Send() after Close(): got error [%v], want [%v]", err, ErrOutboxClosed)
+	}
+
+	working := newFailingChannel(0, nil)
+	o, err = Open(dbFilePath, working, config)
+	if err != nil {
+		t.Fatalf("Re-opening failed: %v", err)
+	}
+	defer o.Close()
+	waitForStatus(o, alice, "req1", svalbardsrv.DeliveryDelivered, t)
+	waitForStatus(o, alice, "req2", svalbardsrv.DeliveryDelivered, t)
+	if got := working.deliveredCount(); got != 2 {
+		t.Errorf("Unexpected number of delivered messages: got %d, want 2", got)
+	}
+}
+
+// unsupportingChannel is a SecondaryChannel that supports only SMS.
+type unsupportingChannel struct {
+	*failingChannel
+}
+
+func (c *unsupportingChannel) SupportsOwnerIDType(idType string) bool {
+	return idType == "SMS"
+}
+
+func TestOutboxRejectsInvalidMessagesSynchronously(t *testing.T) {
+	o, err := Open(getDBFilePath("invalid_test.db"), &unsupportingChannel{newFailingChannel(0, nil)}, testConfig)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer o.Close()
+	var tests = []struct {
+		recipient svalbardsrv.RecipientID
+		data      svalbardsrv.TokenMsgData
+		err       error
+	}{
+		{svalbardsrv.RecipientID{"SMS", "alice"}, svalbardsrv.TokenMsgData{ReqID: "req:1", Token: "token"},
+			svalbardsrv.ErrInvalidParametersForMsgWithToken},
+		{svalbardsrv.RecipientID{"SMS", "alice"}, svalbardsrv.TokenMsgData{ReqID: "req1", Token: ""},
+			svalbardsrv.ErrInvalidParametersForMsgWithToken},
+		{svalbardsrv.RecipientID{"PAGER", "alice"}, svalbardsrv.TokenMsgData{ReqID: "req1", Token: "token"},
+			svalbardsrv.ErrUnsupportedOwnerIDType},
+	}
+	for _, tt := range tests {
+		if err := o.Send(tt.recipient, tt.data); err != tt.err {
+			t.Errorf("Send(%v, %v): got error [%v], want [%v]", tt.recipient, tt.data, err, tt.err)
+		}
+		if _, err := o.DeliveryStatus(tt.recipient, tt.data.ReqID); err != svalbardsrv.ErrDeliveryStatusNotFound {
+			t.Errorf("DeliveryStatus(%v, %q): got error [%v], want [%v]",
+				tt.recipient, tt.data.ReqID, err, svalbardsrv.ErrDeliveryStatusNotFound)
+		}
+	}
+}
+
+func TestRecipientKeysAreKeyed(t *testing.T) {
+	if _, err := Open(getDBFilePath("keyless_test.db"), newFailingChannel(0, nil), Config{}); err != ErrMissingKey {
+		t.Errorf("Open() without key: got error [%v], want [%v]", err, ErrMissingKey)
+	}
+	bob := svalbardsrv.RecipientID{"SMS", "bob"}
+	o1 := &Outbox{config: Config{Key: []byte("some key")}}
+	o2 := &Outbox{config: Config{Key: []byte("another key")}}
+	if o1.RecipientKey(bob) != o1.RecipientKey(svalbardsrv.RecipientID{" sms", "bob"}) {
+		t.Errorf("RecipientKey() of variants of the owner id type: got different keys, want the same")
+	}
+	if o1.RecipientKey(bob) == o2.RecipientKey(bob) {
+		t.Errorf("RecipientKey() under different keys: got the same key [%v], want different ones", o1.RecipientKey(bob))
+	}
+	if string(o1.statusKey(bob, "req42")) == string(o2.statusKey(bob, "req42")) {
+		t.Errorf("statusKey() under different keys: got the same key, want different ones")
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	o := &Outbox{config: Config{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}}
+	var tests = []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := o.backoff(tt.attempts); got != tt.delay {
+			t.Errorf("backoff(%d): got %v, want %v", tt.attempts, got, tt.delay)
+		}
+	}
+}
+
+// checkedChannel is a SecondaryChannel with a self-test that fails with 'err'.
+type checkedChannel struct {
+	*failingChannel
+	err error
+}
+
+func (c *checkedChannel) CheckHealth() error {
+	return c.err
+}
+
+func TestOutboxChecksHealth(t *testing.T) {
+	channel := &checkedChannel{failingChannel: newFailingChannel(0, nil)}
+	o, err := Open(getDBFilePath("health_test.db"), channel, testConfig)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	if err := o.CheckHealth(); err != nil {
+		t.Errorf("CheckHealth(): got [%v], want [nil]", err)
+	}
+	channel.err = errTransient
+	if err := o.CheckHealth(); err != errTransient {
+		t.Errorf("CheckHealth() with unhealthy channel: got [%v], want [%v]", err, errTransient)
+	}
+	channel.err = nil
+	o.Close()
+	if err := o.CheckHealth(); err == nil {
+		t.Errorf("CheckHealth() after Close(): got [nil], want error")
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Package pow implements hashcash-style proof-of-work challenges, which
+// the Svalbard server can require from anonymous clients before sending them
+// tokens.  A challenge is issued and signed by a Guard, and the client solves
+// it with Solve, by finding a solution such that SHA-256 of
+// challenge + "." + solution starts with (at least) the number of zero bits
+// given by the difficulty of the challenge.
+package pow
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+// Default values of the parameters of a Guard.
+const (
+	DefaultDifficulty    = 16
+	DefaultMaxDifficulty = 24
+	DefaultTTL           = 2 * time.Minute
+	DefaultWindow        = time.Minute
+)
+
+// MaxDifficulty is the highest difficulty Solve accepts.
+const MaxDifficulty = 32
+
+// challengeVersion is the prefix of the challenges, identifying their format.
+const challengeVersion = "v1"
+
+// Errors returned upon failures.
+var (
+	ErrMissingKey         = errors.New("missing challenge signing key")
+	ErrInvalidDifficulty  = errors.New("invalid challenge difficulty")
+	ErrInvalidChallenge   = errors.New("invalid challenge")
+	ErrExpiredChallenge   = errors.New("expired challenge")
+	ErrInvalidSolution    = errors.New("invalid challenge solution")
+	ErrReplayedSolution   = errors.New("challenge already solved")
+	ErrTooDifficult       = errors.New("challenge too difficult")
+	ErrNegativeThresholds = errors.New("thresholds must not be negative")
+)
+
+// Config contains the parameters of a Guard.
+type Config struct {
+	// Key is the secret used to sign the challenges with HMAC-SHA256.
+	Key []byte
+	// Difficulty is the difficulty (number of leading zero bits) of the
+	// challenges when the server is not under load.  If zero,
+	// DefaultDifficulty is used.
+	Difficulty int
+	// MaxDifficulty bounds the difficulty when the server is under load.
+	// If zero, DefaultMaxDifficulty is used.
+	MaxDifficulty int
+	// TTL is the validity period of the challenges.  If zero, DefaultTTL is used.
+	TTL time.Duration
+	// Window is the period over which the requests are counted.
+	// If zero, DefaultWindow is used.
+	Window time.Duration
+	// LoadThreshold is the number of token requests per window beyond which
+	// the server is under load: all requests must carry a solved challenge,
+	// and the difficulty grows by one bit whenever the number of requests
+	// doubles.  If zero, solved challenges are always required.
+	LoadThreshold int
+	// RecipientThreshold is the number of token requests per window for
+	// a single recipient beyond which the requests for that recipient must
+	// carry a solved challenge.  If zero, it is not checked.
+	RecipientThreshold int
+}
+
+// Guard issues and verifies challenges, and decides when they are required.
+// It implements svalbardsrv.ChallengeGuard interface.
+type Guard struct {
+	config    Config
+	now       func() time.Time
+	normalize func(svalbardsrv.RecipientID) svalbardsrv.RecipientID
+
+	mutex           sync.Mutex
+	windowStart     time.Time
+	requests        int            // in the current window
+	prevRequests    int            // in the previous window
+	recipients      map[string]int // requests per recipient in the current window
+	prevRecipients  map[string]int
+	solved          map[string]time.Time // solved challenges, until they expire
+	lastSolvedPrune time.Time
+}
+
+// NewGuard returns a new Guard configured according to 'config'.
+func NewGuard(config Config) (*Guard, error) {
+	if len(config.Key) == 0 {
+		return nil, ErrMissingKey
+	}
+	if config.Difficulty == 0 {
+		config.Difficulty = DefaultDifficulty
+	}
+	if config.MaxDifficulty == 0 {
+		config.MaxDifficulty = DefaultMaxDifficulty
+	}
+	if config.Difficulty < 0 || config.MaxDifficulty < config.Difficulty || config.MaxDifficulty > MaxDifficulty {
+		return nil, ErrInvalidDifficulty
+	}
+	if config.LoadThreshold < 0 || config.RecipientThreshold < 0 {
+		return nil, ErrNegativeThresholds
+	}
+	if config.TTL == 0 {
+		config.TTL = DefaultTTL
+	}
+	if config.Window == 0 {
+		config.Window = DefaultWindow
+	}
+	config.Key = append([]byte(nil), config.Key...)
+	return &Guard{
+		config:     config,
+		now:        time.Now,
+		normalize:  normalizeRecipient,
+		recipients: make(map[string]int),
+		solved:     make(map[string]time.Time),
+	}, nil
+}
+
+// SetRecipientNormalizer makes the guard map the recipients with 'normalize'
+// before counting the requests per recipient, e.g. with
+// channelrouter.Router.Recipient, so that all the variants of the owner id
+// of a recipient share a count.  By default, only the surrounding whitespace
+// is removed and the owner id type is mapped to upper case.
+func (g *Guard) SetRecipientNormalizer(normalize func(svalbardsrv.RecipientID) svalbardsrv.RecipientID) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.normalize = normalize
+}
+
+// normalizeRecipient is the default normalization of the recipients.
+func normalizeRecipient(recipient svalbardsrv.RecipientID) svalbardsrv.RecipientID {
+	return svalbardsrv.RecipientID{
+		IDType: strings.ToUpper(strings.TrimSpace(recipient.IDType)),
+		ID:     strings.TrimSpace(recipient.ID),
+	}
+}
+
+// advanceWindow starts a new counting window, if the current one is over.
+// The caller must hold the mutex.
+func (g *Guard) advanceWindow(now time.Time) {
+	if g.windowStart.IsZero() {
+		g.windowStart = now
+	}
+	elapsed := now.Sub(g.windowStart)
+	if elapsed < g.config.Window {
+		return
+	}
+	if elapsed < 2*g.config.Window {
+		g.prevRequests, g.prevRecipients = g.requests, g.recipients
+	} else {
+		g.prevRequests, g.prevRecipients = 0, nil
+	}
+	g.requests, g.recipients = 0, make(map[string]int)
+	g.windowStart = g.windowStart.Add(elapsed - elapsed%g.config.Window)
+}
+
+// load returns the number of requests in the last window, estimated from
+// the counts of the current and of the previous window.
+// The caller must hold the mutex.
+func (g *Guard) load(now time.Time, current, previous int) float64 {
+	fraction := float64(now.Sub(g.windowStart)) / float64(g.config.Window)
+	return float64(current) + float64(previous)*(1-fraction)
+}
+
+// Required records a request for a token for 'recipient', and returns true
+// if the request must carry a solved challenge.
+func (g *Guard) Required(recipient svalbardsrv.RecipientID) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	recipient = g.normalize(recipient)
+	key := recipient.IDType + "\x00" + recipient.ID
+	now := g.now()
+	g.advanceWindow(now)
+	g.requests++
+	g.recipients[key]++
+	if g.config.LoadThreshold == 0 ||
+		g.load(now, g.requests, g.prevRequests) > float64(g.config.LoadThreshold) {
+		return true
+	}
+	return g.config.RecipientThreshold > 0 &&
+		g.load(now, g.recipients[key], g.prevRecipients[key]) > float64(g.config.RecipientThreshold)
+}
+
+// Difficulty returns the difficulty of the challenges issued now.
+func (g *Guard) Difficulty() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := g.now()
+	g.advanceWindow(now)
+	return g.difficulty(g.load(now, g.requests, g.prevRequests))
+}
+
+// difficulty returns the difficulty of the challenges under the given load.
+func (g *Guard) difficulty(load float64) int {
+	d := g.config.Difficulty
+	if threshold := float64(g.config.LoadThreshold); threshold > 0 && load > threshold {
+		d += int(math.Log2(load / threshold))
+	}
+	if d > g.config.MaxDifficulty {
+		d = g.config.MaxDifficulty
+	}
+	return d
+}
+
+// NewChallenge returns a new signed challenge of the current difficulty,
+// and the time when it expires.
+func (g *Guard) NewChallenge() (string, time.Time, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", time.Time{}, err
+	}
+	expires := g.now().Add(g.config.TTL)
+	payload := strings.Join([]string{challengeVersion, strconv.Itoa(g.Difficulty()),
+		strconv.FormatInt(expires.Unix(), 10), hex.EncodeToString(nonce)}, ".")
+	return payload + "." + g.sign(payload), expires, nil
+}
+
+func (g *Guard) sign(payload string) string {
+	mac := hmac.New(sha256.New, g.config.Key)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify returns nil if 'challenge' was issued by the guard, has not expired,
+// and 'solution' solves it.  Each challenge can be used only once.
+func (g *Guard) Verify(challenge, solution string) error {
+	i := strings.LastIndex(challenge, ".")
+	if i < 0 {
+		return ErrInvalidChallenge
+	}
+	if !hmac.Equal([]byte(challenge[i+1:]), []byte(g.sign(challenge[:i]))) {
+		return ErrInvalidChallenge
+	}
+	difficulty, expires, err := parseChallenge(challenge)
+	if err != nil {
+		return err
+	}
+	now := g.now()
+	if !now.Before(expires) {
+		return ErrExpiredChallenge
+	}
+	if !IsSolution(challenge, solution, difficulty) {
+		return ErrInvalidSolution
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if _, ok := g.solved[challenge]; ok {
+		return ErrReplayedSolution
+	}
+	g.solved[challenge] = expires
+	if now.Sub(g.lastSolvedPrune) >= g.config.TTL {
+		g.lastSolvedPrune = now
+		for c, exp := range g.solved {
+			if !now.Before(exp) {
+				delete(g.solved, c)
+			}
+		}
+	}
+	return nil
+}
+
+// parseChallenge returns the difficulty and the expiration time of 'challenge'.
+func parseChallenge(challenge string) (int, time.Time, error) {
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 5 || parts[0] != challengeVersion {
+		return 0, time.Time{}, ErrInvalidChallenge
+	}
+	difficulty, err := strconv.Atoi(parts[1])
+	if err != nil || difficulty < 0 {
+		return 0, time.Time{}, ErrInvalidChallenge
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return 0, time.Time{}, ErrInvalidChallenge
+	}
+	return difficulty, time.Unix(expires, 0), nil
+}
+
+// IsSolution returns true if SHA-256 of challenge + "." + solution starts
+// with at least 'difficulty' zero bits.
+func IsSolution(challenge, solution string, difficulty int) bool {
+	h := sha256.Sum256([]byte(challenge + "." + solution))
+	return leadingZeroBits(h[:]) >= difficulty
+}
+
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, x := range b {
+		if x != 0 {
+			return n + bits.LeadingZeros8(x)
+		}
+		n += 8
+	}
+	return n
+}
+
+// Solve returns a solution of 'challenge', as issued by Guard.NewChallenge.
+// It takes 2^difficulty hash computations on average.
+func Solve(challenge string) (string, error) {
+	difficulty, _, err := parseChallenge(challenge)
+	if err != nil {
+		return "", err
+	}
+	if difficulty > MaxDifficulty {
+		return "", ErrTooDifficult
+	}
+	prefix := []byte(challenge + ".")
+	buf := make([]byte, 0, len(prefix)+20)
+	for counter := uint64(0); ; counter++ {
+		buf = strconv.AppendUint(append(buf[:0], prefix...), counter, 10)
+		h := sha256.Sum256(buf)
+		if leadingZeroBits(h[:]) >= difficulty {
+			return string(buf[len(prefix):]), nil
+		}
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package pow
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+// fakeClock is a manually advanced clock.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestGuard(config Config, t testing.TB) (*Guard, *fakeClock) {
+	g, err := NewGuard(config)
+	if err != nil {
+		t.Fatalf("NewGuard(%+v) failed: %v", config, err)
+	}
+	clock := &fakeClock{time.Unix(1500000000, 0)}
+	g.now = clock.Now
+	return g, clock
+}
+
+// nonSolution returns a string that does not solve 'challenge'.
+func nonSolution(challenge string, difficulty int) string {
+	for i := 0; ; i++ {
+		s := "x" + strconv.Itoa(i)
+		if !IsSolution(challenge, s, difficulty) {
+			return s
+		}
+	}
+}
+
+func TestNewGuardValidatesConfig(t *testing.T) {
+	var tests = []struct {
+		config Config
+		err    error
+	}{
+		{Config{Key: []byte("key")}, nil},
+		{Config{Key: []byte("key"), Difficulty: 20, MaxDifficulty: 30, LoadThreshold: 10, RecipientThreshold: 2}, nil},
+		{Config{}, ErrMissingKey},
+		{Config{Key: []byte("key"), Difficulty: -1}, ErrInvalidDifficulty},
+		{Config{Key: []byte("key"), Difficulty: 20, MaxDifficulty: 10}, ErrInvalidDifficulty},
+		{Config{Key: []byte("key"), MaxDifficulty: MaxDifficulty + 1}, ErrInvalidDifficulty},
+		{Config{Key: []byte("key"), LoadThreshold: -1}, ErrNegativeThresholds},
+		{Config{Key: []byte("key"), RecipientThreshold: -1}, ErrNegativeThresholds},
+	}
+	for _, tt := range tests {
+		if _, err := NewGuard(tt.config); err != tt.err {
+			t.Errorf("NewGuard(%+v): got [%v], want [%v]", tt.config, err, tt.err)
+		}
+	}
+}
+
+func TestSolveAndVerify(t *testing.T) {
+	g, clock := newTestGuard(Config{Key: []byte("key"), Difficulty: 8, TTL: time.Minute}, t)
+	challenge, expires, err := g.NewChallenge()
+	if err != nil {
+		t.Fatalf("NewChallenge() failed: %v", err)
+	}
+	if want := clock.now.Add(time.Minute); !expires.Equal(want) {
+		t.Errorf("NewChallenge(): got expiration time %v, want %v", expires, want)
+	}
+	solution, err := Solve(challenge)
+	if err != nil {
+		t.Fatalf("Solve(%q) failed: %v", challenge, err)
+	}
+	if !IsSolution(challenge, solution, 8) {
+		t.Errorf("Solve(%q): got %q, which is not a solution", challenge, solution)
+	}
+	if err := g.Verify(challenge, nonSolution(challenge, 8)); err != ErrInvalidSolution {
+		t.Errorf("Verify() of invalid solution: got [%v], want [%v]", err, ErrInvalidSolution)
+	}
+	if err := g.Verify(challenge, solution); err != nil {
+		t.Errorf("Verify(%q, %q): got [%v], want [<nil>]", challenge, solution, err)
+	}
+	if err := g.Verify(challenge, solution); err != ErrReplayedSolution {
+		t.Errorf("Verify(%q, %q) again: got [%v], want [%v]", challenge, solution, err, ErrReplayedSolution)
+	}
+
+	// A challenge expires after the TTL.
+	challenge, _, err = g.NewChallenge()
+	if err != nil {
+		t.Fatalf("NewChallenge() failed: %v", err)
+	}
+	if solution, err = Solve(challenge); err != nil {
+		t.Fatalf("Solve(%q) failed: %v", challenge, err)
+	}
+	clock.now = clock.now.Add(time.Minute)
+	if err := g.Verify(challenge, solution); err != ErrExpiredChallenge {
+		t.Errorf("Verify() of expired challenge: got [%v], want [%v]", err, ErrExpiredChallenge)
+	}
+}
+
+func TestVerifyRejectsForgedChallenges(t *testing.T) {
+	g, _ := newTestGuard(Config{Key: []byte("key"), Difficulty: 8}, t)
+	other, _ := newTestGuard(Config{Key: []byte("other key"), Difficulty: 8}, t)
+	challenge, _, err := g.NewChallenge()
+	if err != nil {
+		t.Fatalf("NewChallenge() failed: %v", err)
+	}
+	otherChallenge, _, err := other.NewChallenge()
+	if err != nil {
+		t.Fatalf("NewChallenge() failed: %v", err)
+	}
+	// An easier variant of the challenge, with the original signature.
+	easier := strings.Replace(challenge, "v1.8.", "v1.0.", 1)
+	var tests = []struct {
+		challenge string
+		err       error
+	}{
+		{otherChallenge, ErrInvalidChallenge},
+		{easier, ErrInvalidChallenge},
+		{"", ErrInvalidChallenge},
+		{"no signature", ErrInvalidChallenge},
+		{"v1.8.1500000060.abcd.", ErrInvalidChallenge},
+	}
+	for _, tt := range tests {
+		solution, _ := Solve(tt.challenge)
+		if err := g.Verify(tt.challenge, solution); err != tt.err {
+			t.Errorf("Verify(%q): got [%v], want [%v]", tt.challenge, err, tt.err)
+		}
+	}
+}
+
+func TestSolveRejectsInvalidChallenges(t *testing.T) {
+	var tests = []struct {
+		challenge string
+		err       error
+	}{
+		{"", ErrInvalidChallenge},
+		{"v1.8.1500000060.abcd", ErrInvalidChallenge},
+		{"v2.8.1500000060.abcd.sig", ErrInvalidChallenge},
+		{"v1.x.1500000060.abcd.sig", ErrInvalidChallenge},
+		{"v1.-1.1500000060.abcd.sig", ErrInvalidChallenge},
+		{"v1.8.soon.abcd.sig", ErrInvalidChallenge},
+		{"v1.33.1500000060.abcd.sig", ErrTooDifficult},
+	}
+	for _, tt := range tests {
+		if _, err := Solve(tt.challenge); err != tt.err {
+			t.Errorf("Solve(%q): got [%v], want [%v]", tt.challenge, err, tt.err)
+		}
+	}
+}
+
+func TestRequired(t *testing.T) {
+	g, clock := newTestGuard(Config{Key: []byte("key"), LoadThreshold: 4, RecipientThreshold: 2, Window: time.Minute}, t)
+	alice := svalbardsrv.RecipientID{IDType: "SMS", ID: "alice"}
+	aliceEmail := svalbardsrv.RecipientID{IDType: "email", ID: "alice"}
+	bob := svalbardsrv.RecipientID{IDType: "SMS", ID: "bob"}
+	carol := svalbardsrv.RecipientID{IDType: "SMS", ID: "carol"}
+	var tests = []struct {
+		advance   time.Duration
+		recipient svalbardsrv.RecipientID
+		required  bool
+	}{
+		{0, alice, false},
+		{0, alice, false},
+		{0, alice, true}, // alice is being hammered
+		{0, aliceEmail, false},
+		{0, bob, true}, // the server is under load
+		// After two windows, the counts are reset.
+		{2 * time.Minute, alice, false},
+		{0, alice, false},
+		{0, bob, false},
+		{0, carol, false},
+		// Half of the requests of the previous window still count.
+		{90 * time.Second, alice, false},
+		{0, alice, true},
+		{0, bob, true},
+	}
+	for i, tt := range tests {
+		clock.now = clock.now.Add(tt.advance)
+		if required := g.Required(tt.recipient); required != tt.required {
+			t.Errorf("Required(%v) #%d: got %v, want %v", tt.recipient, i, required, tt.required)
+		}
+	}
+}
+
+func TestRequiredNormalizesRecipients(t *testing.T) {
+	g, _ := newTestGuard(Config{Key: []byte("key"), LoadThreshold: 100, RecipientThreshold: 2, Window: time.Minute}, t)
+	// By default, only the owner id types and the surrounding whitespace are normalized.
+	for i, recipient := range []svalbardsrv.RecipientID{{"SMS", "alice"}, {"sms ", "alice"}, {"Sms", " alice"}} {
+		if required, want := g.Required(recipient), i >= 2; required != want {
+			t.Errorf("Required(%v) #%d: got %v, want %v", recipient, i, required, want)
+		}
+	}
+	g.SetRecipientNormalizer(func(recipient svalbardsrv.RecipientID) svalbardsrv.RecipientID {
+		return svalbardsrv.RecipientID{IDType: "SMS", ID: strings.Replace(recipient.ID, " ", "", -1)}
+	})
+	for i, recipient := range []svalbardsrv.RecipientID{{"SMS", "+41 79 1"}, {"TEXT", "+41791"}, {"sms", "+4179 1"}} {
+		if required, want := g.Required(recipient), i >= 2; required != want {
+			t.Errorf("Required(%v) with custom normalizer #%d: got %v, want %v", recipient, i, required, want)
+		}
+	}
+}
+
+func TestRequiredAlwaysWithoutLoadThreshold(t *testing.T) {
+	g, _ := newTestGuard(Config{Key: []byte("key")}, t)
+	recipient := svalbardsrv.RecipientID{IDType: "SMS", ID: "alice"}
+	if !g.Required(recipient) {
+		t.Errorf("Required(%v): got false, want true", recipient)
+	}
+}
+
+func TestAdaptiveDifficulty(t *testing.T) {
+	g, _ := newTestGuard(Config{Key: []byte("key"), Difficulty: 10, MaxDifficulty: 13, LoadThreshold: 4}, t)
+	recipient := svalbardsrv.RecipientID{IDType: "SMS", ID: "alice"}
+	var tests = []struct {
+		requests   int
+		difficulty int
+	}{
+		{0, 10},
+		{4, 10},
+		{7, 10},
+		{8, 11},
+		{16, 12},
+		{32, 13},
+		{1000, 13},
+	}
+	requests := 0
+	for _, tt := range tests {
+		for ; requests < tt.requests; requests++ {
+			g.Required(recipient)
+		}
+		if d := g.Difficulty(); d != tt.difficulty {
+			t.Errorf("Difficulty() after %d requests: got %d, want %d", tt.requests, d, tt.difficulty)
+		}
+		challenge, _, err := g.NewChallenge()
+		if err != nil {
+			t.Fatalf("NewChallenge() failed: %v", err)
+		}
+		if prefix := fmt.Sprintf("v1.%d.", tt.difficulty); !strings.HasPrefix(challenge, prefix) {
+			t.Errorf("NewChallenge() after %d requests: got %q, want prefix %q", tt.requests, challenge, prefix)
+		}
+	}
+}
+
+func BenchmarkSolve(b *testing.B) {
+	for _, difficulty := range []int{8, 12, 16} {
+		b.Run(fmt.Sprintf("difficulty=%d", difficulty), func(b *testing.B) {
+			g, _ := newTestGuard(Config{Key: []byte("key"), Difficulty: difficulty}, b)
+			challenges := make([]string, b.N)
+			for i := range challenges {
+				var err error
+				if challenges[i], _, err = g.NewChallenge(); err != nil {
+					b.Fatalf("NewChallenge() failed: %v", err)
+				}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := Solve(challenges[i]); err != nil {
+					b.Fatalf("Solve(%q) failed: %v", challenges[i], err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkVerify(b *testing.B) {
+	g, _ := newTestGuard(Config{Key: []byte("key"), Difficulty: 8}, b)
+	challenges := make([]string, b.N)
+	solutions := make([]string, b.N)
+	for i := range challenges {
+		var err error
+		if challenges[i], _, err = g.NewChallenge(); err != nil {
+			b.Fatalf("NewChallenge() failed: %v", err)
+		}
+		if solutions[i], err = Solve(challenges[i]); err != nil {
+			b.Fatalf("Solve(%q) failed: %v", challenges[i], err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := g.Verify(challenges[i], solutions[i]); err != nil {
+			b.Fatalf("Verify(%q, %q) failed: %v", challenges[i], solutions[i], err)
+		}
+	}
+}
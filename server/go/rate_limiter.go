@@ -0,0 +1,357 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Package ratelimit implements a svalbardsrv.RateLimiter based on token
+// buckets kept per recipient, per client subnet, and globally.
+package ratelimit
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+// Default values of the parameters of a Limiter.
+const (
+	DefaultIPv4PrefixLength = 32
+	DefaultIPv6PrefixLength = 64
+)
+
+// Errors returned upon failures.
+var (
+	ErrInvalidPolicy       = errors.New("invalid rate limit policy")
+	ErrInvalidPrefixLength = errors.New("invalid subnet prefix length")
+	ErrMissingKey          = errors.New("missing bucket key")
+)
+
+// Policy defines a token bucket: it holds up to Burst tokens, and is refilled
+// with Rate tokens per second.  Every request takes one token from the bucket.
+// A zero Policy disables the limit.
+type Policy struct {
+	Rate  float64
+	Burst float64
+}
+
+// Enabled returns true if the policy limits the requests.
+func (p Policy) Enabled() bool {
+	return p.Burst > 0
+}
+
+// ParsePolicy parses a policy of the form "<n>/<duration>", e.g. "5/1h",
+// which allows bursts of n requests, and n requests per duration on average.
+// An empty string or "0" yields the zero (disabled) Policy.
+func ParsePolicy(s string) (Policy, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return Policy{}, nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return Policy{}, ErrInvalidPolicy
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n < 0 {
+		return Policy{}, ErrInvalidPolicy
+	}
+	d, err := time.ParseDuration(parts[1])
+	if err != nil || d <= 0 {
+		return Policy{}, ErrInvalidPolicy
+	}
+	if n == 0 {
+		return Policy{}, nil
+	}
+	return Policy{Rate: float64(n) / d.Seconds(), Burst: float64(n)}, nil
+}
+
+// Config contains the parameters of a Limiter.
+type Config struct {
+	// PerRecipient limits the tokens sent to a single recipient.
+	PerRecipient Policy
+	// PerSubnet limits the tokens requested from a single client subnet.
+	PerSubnet Policy
+	// Global limits all tokens.
+	Global Policy
+	// IPv4PrefixLength and IPv6PrefixLength define the subnets of the clients.
+	// If zero, DefaultIPv4PrefixLength and DefaultIPv6PrefixLength are used.
+	IPv4PrefixLength int
+	IPv6PrefixLength int
+}
+
+// BucketState is the state of a single token bucket.
+type BucketState struct {
+	Tokens  float64
+	Updated time.Time
+}
+
+// Store persists the states of the buckets of a Limiter, so that the limits
+// survive restarts of the server.  The keys of the buckets are HMACs of the
+// recipients and the clients under the key of the Limiter, so they do not
+// reveal the recipients or the clients to anyone without that key.
+type Store interface {
+	// Load returns all the stored bucket states.
+	Load() (map[string]BucketState, error)
+	// Save replaces the stored bucket states with 'states'.
+	Save(states map[string]BucketState) error
+}
+
+// Limiter is a svalbardsrv.RateLimiter implementation that keeps the buckets
+// in memory.  Full buckets are equivalent to missing ones, and are dropped
+// from time to time, so the number of kept buckets is bounded by the number
+// of requests allowed by the global limit within the time needed to refill
+// the buckets.
+type Limiter struct {
+	config     Config
+	key        []byte
+	store      Store
+	now        func() time.Time
+	normalize  func(svalbardsrv.RecipientID) svalbardsrv.RecipientID
+	refillTime time.Duration // the longest time needed to refill a bucket
+
+	mutex     sync.Mutex
+	buckets   map[string]*BucketState
+	lastPrune time.Time
+}
+
+// New returns a new Limiter that applies the limits in 'config', and derives
+// the keys of the buckets with the secret 'key'.  If 'store' is not nil, the
+// buckets are loaded from it, and are saved to it by Flush and Close; the
+// same 'key' must then be used across restarts, and ErrMissingKey is returned
+// if it is empty.  Otherwise an empty 'key' is replaced by a random one.
+func New(config Config, key []byte, store Store) (*Limiter, error) {
+	config, refillTime, err := checkConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		if store != nil {
+			return nil, ErrMissingKey
+		}
+		key = make([]byte, sha256.Size)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	l := &Limiter{
+		config:     config,
+		key:        key,
+		store:      store,
+		now:        time.Now,
+		normalize:  normalizeRecipient,
+		refillTime: refillTime,
+		buckets:    make(map[string]*BucketState),
+	}
+	if store != nil {
+		states, err := store.Load()
+		if err != nil {
+			return nil, err
+		}
+		for key, state := range states {
+			state := state
+			l.buckets[key] = &state
+		}
+	}
+	return l, nil
+}
+
+// SetConfig replaces the limits applied by the limiter with those in
+// 'config', e.g. upon a reload of the configuration of the server.
+// The states of the buckets are kept, but never exceed the new bursts.
+func (l *Limiter) SetConfig(config Config) error {
+	config, refillTime, err := checkConfig(config)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.config = config
+	l.refillTime = refillTime
+	return nil
+}
+
+// SetRecipientNormalizer makes the limiter map the recipients with
+// 'normalize' before keeping limits per recipient, e.g. with
+// channelrouter.Router.Recipient, so that all the variants of the owner id
+// of a recipient share a bucket.  By default, only the surrounding whitespace
+// is removed and the owner id type is mapped to upper case.
+func (l *Limiter) SetRecipientNormalizer(normalize func(svalbardsrv.RecipientID) svalbardsrv.RecipientID) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.normalize = normalize
+}
+
+// normalizeRecipient is the default normalization of the recipients.
+func normalizeRecipient(recipient svalbardsrv.RecipientID) svalbardsrv.RecipientID {
+	return svalbardsrv.RecipientID{
+		IDType: strings.ToUpper(strings.TrimSpace(recipient.IDType)),
+		ID:     strings.TrimSpace(recipient.ID),
+	}
+}
+
+// checkConfig validates 'config', and returns it with the defaults filled in,
+// together with the longest time needed to refill a bucket.
+func checkConfig(config Config) (Config, time.Duration, error) {
+	for _, p := range []Policy{config.PerRecipient, config.PerSubnet, config.Global} {
+		if p.Rate < 0 || p.Burst < 0 || (p.Enabled() && p.Rate == 0) {
+			return config, 0, ErrInvalidPolicy
+		}
+	}
+	if config.IPv4PrefixLength == 0 {
+		config.IPv4PrefixLength = DefaultIPv4PrefixLength
+	}
+	if config.IPv6PrefixLength == 0 {
+		config.IPv6PrefixLength = DefaultIPv6PrefixLength
+	}
+	if config.IPv4PrefixLength < 0 || config.IPv4PrefixLength > 32 ||
+		config.IPv6PrefixLength < 0 || config.IPv6PrefixLength > 128 {
+		return config, 0, ErrInvalidPrefixLength
+	}
+	var refillTime time.Duration
+	for _, p := range []Policy{config.PerRecipient, config.PerSubnet, config.Global} {
+		if p.Enabled() {
+			if d := time.Duration(math.Ceil(p.Burst / p.Rate * float64(time.Second))); d > refillTime {
+				refillTime = d
+			}
+		}
+	}
+	return config, refillTime, nil
+}
+
+// limitedBucket is a bucket to be checked for a request.
+type limitedBucket struct {
+	key    string
+	policy Policy
+}
+
+// Allow returns true if a token may be sent to 'recipient' upon a request
+// from 'clientIP', and takes a token from each of the corresponding buckets.
+// Otherwise it returns false and the time after which all the buckets will
+// hold a token; no tokens are taken then.
+func (l *Limiter) Allow(recipient svalbardsrv.RecipientID, clientIP net.IP) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var limited []limitedBucket
+	if l.config.PerRecipient.Enabled() {
+		recipient = l.normalize(recipient)
+		key := "recipient\x00" + recipient.IDType + "\x00" + recipient.ID
+		limited = append(limited, limitedBucket{l.bucketKey(key), l.config.PerRecipient})
+	}
+	if l.config.PerSubnet.Enabled() {
+		limited = append(limited, limitedBucket{l.bucketKey("subnet\x00" + l.subnet(clientIP)), l.config.PerSubnet})
+	}
+	if l.config.Global.Enabled() {
+		limited = append(limited, limitedBucket{l.bucketKey("global"), l.config.Global})
+	}
+	now := l.now()
+	l.pruneIfNeeded(now)
+	var wait time.Duration
+	states := make([]*BucketState, len(limited))
+	for i, lb := range limited {
+		state, ok := l.buckets[lb.key]
+		if !ok {
+			state = &BucketState{Tokens: lb.policy.Burst, Updated: now}
+		}
+		refill(state, lb.policy, now)
+		states[i] = state
+		if state.Tokens < 1 {
+			missing := time.Duration(math.Ceil((1 - state.Tokens) / lb.policy.Rate * float64(time.Second)))
+			if missing > wait {
+				wait = missing
+			}
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for i, lb := range limited {
+		states[i].Tokens--
+		l.buckets[lb.key] = states[i]
+	}
+	return true, 0
+}
+
+// refill adds the tokens accumulated since the last update of 'state',
+// up to the burst of 'policy'.
+func refill(state *BucketState, policy Policy, now time.Time) {
+	if elapsed := now.Sub(state.Updated).Seconds(); elapsed > 0 {
+		state.Tokens += elapsed * policy.Rate
+	}
+	state.Tokens = math.Min(policy.Burst, state.Tokens)
+	state.Updated = now
+}
+
+// bucketKey returns the key of the bucket for 'id', an HMAC of 'id' under
+// the key of the limiter, which does not reveal 'id'.
+func (l *Limiter) bucketKey(id string) string {
+	mac := hmac.New(sha256.New, l.key)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// subnet returns the subnet of 'ip', as configured.  The caller must hold
+// the mutex.
+func (l *Limiter) subnet(ip net.IP) string {
+	if ip == nil {
+		return "unknown"
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(l.config.IPv4PrefixLength, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(l.config.IPv6PrefixLength, 128)).String()
+}
+
+// pruneIfNeeded drops the buckets that are full at 'now', at most once
+// per the longest time needed to refill a bucket.
+func (l *Limiter) pruneIfNeeded(now time.Time) {
+	if now.Sub(l.lastPrune) < l.refillTime {
+		return
+	}
+	l.lastPrune = now
+	for key, state := range l.buckets {
+		if now.Sub(state.Updated) >= l.refillTime {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Flush saves the states of the buckets to the store of the limiter, if any.
+func (l *Limiter) Flush() error {
+	if l.store == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	states := make(map[string]BucketState, len(l.buckets))
+	for key, state := range l.buckets {
+		states[key] = *state
+	}
+	l.mutex.Unlock()
+	return l.store.Save(states)
+}
+
+// Close saves the states of the buckets to the store of the limiter, if any.
+// It does not close the store.
+func (l *Limiter) Close() error {
+	return l.Flush()
+}
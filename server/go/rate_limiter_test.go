@@ -0,0 +1,291 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package ratelimit
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+// fakeClock is a manually advanced clock.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+var testKey = []byte("rate limit test key")
+
+func newTestLimiter(config Config, store Store, t *testing.T) (*Limiter, *fakeClock) {
+	l, err := New(config, testKey, store)
+	if err != nil {
+		t.Fatalf("New(%+v) failed: %v", config, err)
+	}
+	clock := &fakeClock{time.Unix(1500000000, 0)}
+	l.now = clock.Now
+	return l, clock
+}
+
+func TestParsePolicy(t *testing.T) {
+	var tests = []struct {
+		s      string
+		policy Policy
+		err    error
+	}{
+		{"", Policy{}, nil},
+		{"0", Policy{}, nil},
+		{"0/1h", Policy{}, nil},
+		{"5/1h", Policy{5.0 / 3600, 5}, nil},
+		{" 10/1s ", Policy{10, 10}, nil},
+		{"3/500ms", Policy{6, 3}, nil},
+		{"5", Policy{}, ErrInvalidPolicy},
+		{"-1/1h", Policy{}, ErrInvalidPolicy},
+		{"5/0s", Policy{}, ErrInvalidPolicy},
+		{"5/-1h", Policy{}, ErrInvalidPolicy},
+		{"five/1h", Policy{}, ErrInvalidPolicy},
+		{"5/hour", Policy{}, ErrInvalidPolicy},
+	}
+	for _, tt := range tests {
+		policy, err := ParsePolicy(tt.s)
+		if err != tt.err || policy != tt.policy {
+			t.Errorf("ParsePolicy(%q): got %+v (error: %v), want %+v (error: %v)", tt.s, policy, err, tt.policy, tt.err)
+		}
+	}
+}
+
+func TestNewValidatesConfig(t *testing.T) {
+	var tests = []struct {
+		config Config
+		err    error
+	}{
+		{Config{}, nil},
+		{Config{PerRecipient: Policy{1, 5}, IPv4PrefixLength: 24, IPv6PrefixLength: 48}, nil},
+		{Config{PerRecipient: Policy{0, 5}}, ErrInvalidPolicy},
+		{Config{PerSubnet: Policy{-1, 5}}, ErrInvalidPolicy},
+		{Config{Global: Policy{1, -5}}, ErrInvalidPolicy},
+		{Config{IPv4PrefixLength: 33}, ErrInvalidPrefixLength},
+		{Config{IPv6PrefixLength: -1}, ErrInvalidPrefixLength},
+	}
+	for _, tt := range tests {
+		if _, err := New(tt.config, nil, nil); err != tt.err {
+			t.Errorf("New(%+v): got error [%v], want [%v]", tt.config, err, tt.err)
+		}
+	}
+	if _, err := New(Config{}, nil, &memoryStore{}); err != ErrMissingKey {
+		t.Errorf("New() with a store and no key: got error [%v], want [%v]", err, ErrMissingKey)
+	}
+}
+
+func TestRecipientsAreNormalized(t *testing.T) {
+	l, _ := newTestLimiter(Config{PerRecipient: Policy{1.0 / 60, 1}}, nil, t)
+	if ok, _ := l.Allow(svalbardsrv.RecipientID{IDType: "SMS", ID: "alice"}, nil); !ok {
+		t.Fatalf("Allow() of the first request: got false, want true")
+	}
+	if ok, _ := l.Allow(svalbardsrv.RecipientID{IDType: " sms", ID: "alice "}, nil); ok {
+		t.Errorf("Allow() for a variant of the recipient: got true, want false")
+	}
+	l.SetRecipientNormalizer(func(recipient svalbardsrv.RecipientID) svalbardsrv.RecipientID {
+		return svalbardsrv.RecipientID{IDType: "SMS", ID: strings.ToLower(recipient.ID)}
+	})
+	if ok, _ := l.Allow(svalbardsrv.RecipientID{IDType: "TEXT", ID: "ALICE"}, nil); ok {
+		t.Errorf("Allow() for a recipient normalized by the custom normalizer: got true, want false")
+	}
+	if ok, _ := l.Allow(svalbardsrv.RecipientID{IDType: "SMS", ID: "bob"}, nil); !ok {
+		t.Errorf("Allow() for another recipient: got false, want true")
+	}
+}
+
+func TestAllowAppliesAllLimits(t *testing.T) {
+	// 2 tokens per recipient and per subnet per minute, 4 globally per 2 minutes.
+	l, clock := newTestLimiter(Config{
+		PerRecipient:     Policy{2.0 / 60, 2},
+		PerSubnet:        Policy{2.0 / 60, 2},
+		Global:           Policy{4.0 / 120, 4},
+		IPv4PrefixLength: 24,
+	}, nil, t)
+	alice := svalbardsrv.RecipientID{IDType: "SMS", ID: "alice"}
+	bob := svalbardsrv.RecipientID{IDType: "SMS", ID: "bob"}
+	carol := svalbardsrv.RecipientID{IDType: "EMAIL", ID: "carol"}
+	ip1, ip2 := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.77")
+	ip3, ip4 := net.ParseIP("198.51.100.1"), net.ParseIP("203.0.113.1")
+	var tests = []struct {
+		advance   time.Duration
+		recipient svalbardsrv.RecipientID
+		ip        net.IP
+		ok        bool
+		wait      time.Duration
+	}{
+		{0, alice, ip1, true, 0},
+		{0, alice, ip3, true, 0},
+		// Per-recipient limit, the owner id type is normalized.
+		{0, svalbardsrv.RecipientID{IDType: " sms", ID: "alice"}, ip1, false, 30 * time.Second},
+		{0, bob, ip2, true, 0},
+		// Per-subnet limit: ip1 and ip2 are in the same /24 subnet.
+		{0, carol, ip2, false, 30 * time.Second},
+		{0, carol, ip3, true, 0},
+		// Global limit.
+		{0, bob, ip4, false, 30 * time.Second},
+		{10 * time.Second, bob, ip4, false, 20 * time.Second},
+		{21 * time.Second, bob, ip4, true, 0},
+		// Alice's bucket has been refilled in the meantime, the global one not yet.
+		{0, alice, nil, false, 29 * time.Second},
+		{30 * time.Second, alice, nil, true, 0},
+	}
+	for i, tt := range tests {
+		clock.now = clock.now.Add(tt.advance)
+		ok, wait := l.Allow(tt.recipient, tt.ip)
+		if ok != tt.ok || wait.Round(time.Millisecond) != tt.wait {
+			t.Errorf("test case #%d: Allow(%v, %v): got (%v, %v), want (%v, %v)",
+				i, tt.recipient, tt.ip, ok, wait, tt.ok, tt.wait)
+		}
+	}
+}
+
+func TestAllowWithoutLimits(t *testing.T) {
+	l, _ := newTestLimiter(Config{}, nil, t)
+	for i := 0; i < 1000; i++ {
+		if ok, _ := l.Allow(svalbardsrv.RecipientID{IDType: "SMS", ID: "alice"}, nil); !ok {
+			t.Fatalf("Allow() without limits: request #%d rejected", i)
+		}
+	}
+}
+
+func TestIPv6Subnets(t *testing.T) {
+	l, _ := newTestLimiter(Config{PerSubnet: Policy{1.0 / 60, 1}}, nil, t)
+	alice := svalbardsrv.RecipientID{IDType: "SMS", ID: "alice"}
+	var tests = []struct {
+		ip string
+		ok bool
+	}{
+		{"2001:db8:1:2::1", true},
+		{"2001:db8:1:2:ffff::1", false}, // same /64
+		{"2001:db8:1:3::1", true},
+		{"::ffff:192.0.2.1", true}, // IPv4-mapped addresses are IPv4
+		{"192.0.2.1", false},
+	}
+	for _, tt := range tests {
+		if ok, _ := l.Allow(alice, net.ParseIP(tt.ip)); ok != tt.ok {
+			t.Errorf("Allow() from %v: got %v, want %v", tt.ip, ok, tt.ok)
+		}
+	}
+}
+
+func TestFullBucketsArePruned(t *testing.T) {
+	l, clock := newTestLimiter(Config{PerRecipient: Policy{1, 10}, Global: Policy{100, 100}}, nil, t)
+	for i := 0; i < 50; i++ {
+		l.Allow(svalbardsrv.RecipientID{IDType: "SMS", ID: string(rune('a' + i))}, nil)
+	}
+	if n := len(l.buckets); n != 51 {
+		t.Fatalf("Unexpected number of buckets: got %d, want 51", n)
+	}
+	// After the longest refill time (10s), all unused buckets are full.
+	clock.now = clock.now.Add(10 * time.Second)
+	l.Allow(svalbardsrv.RecipientID{IDType: "SMS", ID: "alice"}, nil)
+	if n := len(l.buckets); n != 2 {
+		t.Errorf("Unexpected number of buckets after pruning: got %d, want 2", n)
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	l, clock := newTestLimiter(Config{PerRecipient: Policy{1.0 / 60, 3}}, nil, t)
+	alice := svalbardsrv.RecipientID{IDType: "SMS", ID: "alice"}
+	bob := svalbardsrv.RecipientID{IDType: "SMS", ID: "bob"}
+	carol := svalbardsrv.RecipientID{IDType: "SMS", ID: "carol"}
+	l.Allow(alice, nil)
+	if err := l.SetConfig(Config{PerRecipient: Policy{-1, 1}}); err != ErrInvalidPolicy {
+		t.Errorf("SetConfig() with invalid policy: got [%v], want [%v]", err, ErrInvalidPolicy)
+	}
+	// Lower the burst: alice has 2 tokens left, but may take only 1.
+	if err := l.SetConfig(Config{PerRecipient: Policy{1.0 / 60, 1}, Global: Policy{1.0 / 60, 2}}); err != nil {
+		t.Fatalf("SetConfig(): unexpected error: %v", err)
+	}
+	var tests = []struct {
+		advance   time.Duration
+		recipient svalbardsrv.RecipientID
+		ok        bool
+	}{
+		{0, alice, true},
+		{0, alice, false},
+		// The new global limit applies too.
+		{0, bob, true},
+		{0, carol, false},
+		{60 * time.Second, carol, true},
+	}
+	for i, tt := range tests {
+		clock.now = clock.now.Add(tt.advance)
+		if ok, _ := l.Allow(tt.recipient, nil); ok != tt.ok {
+			t.Errorf("test case #%d: Allow(%v) after SetConfig(): got %v, want %v", i, tt.recipient, ok, tt.ok)
+		}
+	}
+	// Disabling all limits.
+	if err := l.SetConfig(Config{}); err != nil {
+		t.Fatalf("SetConfig(): unexpected error: %v", err)
+	}
+	if ok, _ := l.Allow(alice, nil); !ok {
+		t.Errorf("Allow() after disabling the limits: got false, want true")
+	}
+}
+
+// memoryStore is a Store that keeps the states in memory.
+type memoryStore struct {
+	states map[string]BucketState
+}
+
+func (s *memoryStore) Load() (map[string]BucketState, error) {
+	return s.states, nil
+}
+
+func (s *memoryStore) Save(states map[string]BucketState) error {
+	s.states = states
+	return nil
+}
+
+func TestLimitsArePersisted(t *testing.T) {
+	config := Config{PerRecipient: Policy{1.0 / 60, 1}}
+	store := &memoryStore{}
+	alice := svalbardsrv.RecipientID{IDType: "SMS", ID: "alice"}
+	l, _ := newTestLimiter(config, store, t)
+	if ok, _ := l.Allow(alice, nil); !ok {
+		t.Fatalf("Allow() of the first request: got false, want true")
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	for key := range store.states {
+		if key == "alice" || len(key) != 32 {
+			t.Errorf("Stored key %q may reveal the recipient", key)
+		}
+	}
+	l, _ = newTestLimiter(config, store, t)
+	if ok, wait := l.Allow(alice, nil); ok || wait.Round(time.Millisecond) != time.Minute {
+		t.Errorf("Allow() after reloading: got (%v, %v), want (false, %v)", ok, wait, time.Minute)
+	}
+	// Under another key, the stored buckets belong to no recipient.
+	other, err := New(config, []byte("another key"), store)
+	if err != nil {
+		t.Fatalf("New() with another key failed: %v", err)
+	}
+	if ok, _ := other.Allow(alice, nil); !ok {
+		t.Errorf("Allow() after reloading with another key: got false, want true")
+	}
+}
@@ -0,0 +1,621 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Package replicatedsharestore implements a store for shares of a Svalbard
+// HTTP server, that replicates the shares over several underlying stores
+// (e.g. Bolt DBs on different disks).
+//
+// Every operation reads the share from all replicas, and requires a read
+// quorum of responses; writes require a write quorum of acknowledgements.
+// With overlapping quorums (read + write quorum > number of replicas), every
+// read sees the latest successful write.  The replicas store each share in
+// an envelope with a version (the time of the write in nanoseconds), and
+// keep deleted shares as tombstones, so that a replica that missed a write
+// or a deletion is recognized as stale: the latest version wins, and the
+// stale replicas are repaired on read.  An anti-entropy scanner repairs all
+// shares in the background, and purges tombstones once every replica has
+// them and they are older than the retention period.
+//
+// The values stored in the replicas are envelopes, so a replica cannot be
+// used on its own as the store of a server.
+package replicatedsharestore
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+// Defaults of Config.
+const (
+	DefaultAntiEntropyInterval = 10 * time.Minute
+	DefaultTombstoneRetention  = 7 * 24 * time.Hour
+)
+
+// Errors returned upon failures.
+var (
+	ErrNoReplicas    = errors.New("no replicas")
+	ErrInvalidQuorum = errors.New("invalid quorum, want quorums between 1 and the number of replicas, and read quorum + write quorum > number of replicas")
+	ErrNotListable   = errors.New("none of the replicas can list its shares")
+)
+
+// QuorumError is returned if fewer replicas than required responded to
+// an operation.
+type QuorumError struct {
+	Op        string
+	Responses int
+	Quorum    int
+	// Errs are the errors of the replicas that failed.
+	Errs []error
+}
+
+func (e *QuorumError) Error() string {
+	msg := fmt.Sprintf("%s: quorum not reached, %d replicas responded, %d required", e.Op, e.Responses, e.Quorum)
+	if len(e.Errs) > 0 {
+		msg += fmt.Sprintf(" (%v)", e.Errs[0])
+	}
+	return msg
+}
+
+// ShareIDLister is implemented by ShareStores that can list the ids of
+// their shares, which the anti-entropy scanner requires.
+type ShareIDLister interface {
+	// ShareIDs returns the ids of all shares in the store.
+	ShareIDs() ([]string, error)
+}
+
+// Config contains the parameters of a Replicated store.  Zero values are
+// replaced by the corresponding defaults.
+type Config struct {
+	// WriteQuorum and ReadQuorum are the numbers of replicas that must
+	// acknowledge a write, and respond to a read.  They default to a
+	// majority of the replicas.
+	WriteQuorum int
+	ReadQuorum  int
+	// AntiEntropyInterval is the interval of the background scans; a
+	// negative interval disables them.
+	AntiEntropyInterval time.Duration
+	// TombstoneRetention is the period for which deleted shares are kept
+	// as tombstones, which must exceed the time for which a replica may be
+	// unavailable.
+	TombstoneRetention time.Duration
+}
+
+func (c Config) withDefaults(replicas int) Config {
+	if c.WriteQuorum == 0 {
+		c.WriteQuorum = replicas/2 + 1
+	}
+	if c.ReadQuorum == 0 {
+		c.ReadQuorum = replicas/2 + 1
+	}
+	if c.AntiEntropyInterval == 0 {
+		c.AntiEntropyInterval = DefaultAntiEntropyInterval
+	}
+	if c.TombstoneRetention <= 0 {
+		c.TombstoneRetention = DefaultTombstoneRetention
+	}
+	return c
+}
+
+// record is the state of a share in a replica.
+type record struct {
+	version uint64
+	deleted bool
+	value   string
+}
+
+const envelopePrefix = "rss1:"
+
+// encode returns the envelope of 'r', of the form
+// rss1:<version>:<"live" or "deleted">:<value>.
+func (r record) encode() string {
+	state := "live"
+	if r.deleted {
+		state = "deleted"
+	}
+	return envelopePrefix + strconv.FormatUint(r.version, 10) + ":" + state + ":" + r.value
+}
+
+func decode(envelope string) (record, error) {
+	parts := strings.SplitN(strings.TrimPrefix(envelope, envelopePrefix), ":", 3)
+	if !strings.HasPrefix(envelope, envelopePrefix) || len(parts) != 3 {
+		return record{}, errors.New("invalid envelope")
+	}
+	version, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return record{}, errors.New("invalid version in envelope")
+	}
+	switch {
+	case parts[1] == "live" && parts[2] != "":
+		return record{version: version, value: parts[2]}, nil
+	case parts[1] == "deleted" && parts[2] == "":
+		return record{version: version, deleted: true}, nil
+	}
+	return record{}, errors.New("invalid state in envelope")
+}
+
+// newer returns true if 'r' supersedes 'other'.  Ties of versions are
+// broken deterministically, in favour of deletions.
+func (r record) newer(other record) bool {
+	switch {
+	case r.version != other.version:
+		return r.version > other.version
+	case r.deleted != other.deleted:
+		return r.deleted
+	}
+	return r.value > other.value
+}
+
+// replicaState is the response of a replica to a read.
+type replicaState struct {
+	rec   record
+	found bool
+	// stored is set if the replica holds a value, even if undecodable.
+	stored bool
+	// err is set if the replica failed; undecodable envelopes count as
+	// absent records, to be repaired.
+	err error
+}
+
+// Replicated is a ShareStore implementation that replicates the shares
+// over several underlying ShareStores.
+type Replicated struct {
+	replicas []svalbardsrv.ShareStore
+	config   Config
+	now      func() time.Time
+
+	// locks serialize the operations on each share.
+	locks [64]sync.Mutex
+
+	done      chan struct{}
+	workers   sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// New returns a Replicated store over the given replicas, and starts the
+// anti-entropy scanner unless it is disabled.  The replicas remain owned by
+// the caller, and must not be written to otherwise.
+// The returned Replicated implements svalbardsrv.ShareStore-interface.
+func New(replicas []svalbardsrv.ShareStore, config Config) (*Replicated, error) {
+	if len(replicas) == 0 {
+		return nil, ErrNoReplicas
+	}
+	config = config.withDefaults(len(replicas))
+	n := len(replicas)
+	if config.WriteQuorum < 1 || config.WriteQuorum > n || config.ReadQuorum < 1 || config.ReadQuorum > n ||
+		config.WriteQuorum+config.ReadQuorum <= n {
+		return nil, ErrInvalidQuorum
+	}
+	rs := &Replicated{
+		replicas: replicas,
+		config:   config,
+		now:      time.Now,
+		done:     make(chan struct{}),
+	}
+	if config.AntiEntropyInterval > 0 {
+		rs.workers.Add(1)
+		go rs.scan()
+	}
+	return rs, nil
+}
+
+// lock locks the operations on 'shareID', and returns the function that
+// unlocks them.
+func (rs *Replicated) lock(shareID string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(shareID))
+	m := &rs.locks[h.Sum32()%uint32(len(rs.locks))]
+	m.Lock()
+	return m.Unlock
+}
+
+// readAll reads the share from all replicas in parallel.
+func (rs *Replicated) readAll(shareID string) []replicaState {
+	states := make([]replicaState, len(rs.replicas))
+	var wg sync.WaitGroup
+	for i, replica := range rs.replicas {
+		wg.Add(1)
+		go func(i int, replica svalbardsrv.ShareStore) {
+			defer wg.Done()
+			envelope, err := replica.Retrieve(shareID)
+			switch {
+			case err == svalbardsrv.ErrShareNotFound:
+			case err != nil:
+				states[i].err = err
+			default:
+				states[i].stored = true
+				if rec, err := decode(envelope); err != nil {
+					slog.Warn("replicated share store: invalid record", "replica", i, "share_id", shareID, "error", err)
+				} else {
+					states[i].rec, states[i].found = rec, true
+				}
+			}
+		}(i, replica)
+	}
+	wg.Wait()
+	return states
+}
+
+// readQuorum reads the share from all replicas, and fails unless a read
+// quorum responded.
+func (rs *Replicated) readQuorum(op, shareID string) ([]replicaState, error) {
+	states := rs.readAll(shareID)
+	var errs []error
+	for _, s := range states {
+		if s.err != nil {
+			errs = append(errs, s.err)
+		}
+	}
+	if responses := len(states) - len(errs); responses < rs.config.ReadQuorum {
+		return nil, &QuorumError{op, responses, rs.config.ReadQuorum, errs}
+	}
+	return states, nil
+}
+
+// reconcile returns the latest record among the responses, if any.
+func reconcile(states []replicaState) (record, bool) {
+	var latest record
+	found := false
+	for _, s := range states {
+		if s.err == nil && s.found && (!found || s.rec.newer(latest)) {
+			latest, found = s.rec, true
+		}
+	}
+	return latest, found
+}
+
+// write writes 'rec' to replica i, replacing any record it has unless
+// 'absent' is true.
+func (rs *Replicated) write(i int, shareID string, rec record, absent bool) error {
+	replica := rs.replicas[i]
+	if !absent {
+		if err := replica.Delete(shareID); err != nil && err != svalbardsrv.ErrShareNotFound {
+			return err
+		}
+	}
+	return replica.Store(shareID, rec.encode())
+}
+
+// writeQuorum writes 'rec' to all replicas in parallel, and fails unless
+// a write quorum acknowledged it.
+func (rs *Replicated) writeQuorum(op, shareID string, rec record, states []replicaState) error {
+	errs := make([]error, len(rs.replicas))
+	var wg sync.WaitGroup
+	for i := range rs.replicas {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = rs.write(i, shareID, rec, states[i].err == nil && !states[i].stored)
+		}(i)
+	}
+	wg.Wait()
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if acks := len(errs) - len(failed); acks < rs.config.WriteQuorum {
+		return &QuorumError{op, acks, rs.config.WriteQuorum, failed}
+	}
+	return nil
+}
+
+// repair writes the latest record to the replicas that responded with
+// another one, and returns the number of repaired replicas.
+func (rs *Replicated) repair(shareID string, states []replicaState, latest record) int {
+	repaired := 0
+	for i, s := range states {
+		if s.err != nil || (s.found && s.rec == latest) {
+			continue
+		}
+		if err := rs.write(i, shareID, latest, !s.stored); err != nil {
+			slog.Warn("replicated share store: repair failed", "replica", i, "share_id", shareID, "error", err)
+			continue
+		}
+		repaired++
+	}
+	return repaired
+}
+
+// nextVersion returns the version of a write that supersedes 'latest'.
+func (rs *Replicated) nextVersion(latest record) uint64 {
+	version := uint64(rs.now().UnixNano())
+	if version <= latest.version {
+		version = latest.version + 1
+	}
+	return version
+}
+
+// Store stores the given 'shareValue' under the specified 'shareID'.
+func (rs *Replicated) Store(shareID, shareValue string) error {
+	if shareID == "" {
+		return svalbardsrv.ErrInvalidShareID
+	}
+	if shareValue == "" {
+		return svalbardsrv.ErrInvalidShareValue
+	}
+	defer rs.lock(shareID)()
+	states, err := rs.readQuorum("Store", shareID)
+	if err != nil {
+		return err
+	}
+	latest, found := reconcile(states)
+	if found && !latest.deleted {
+		rs.repair(shareID, states, latest)
+		return svalbardsrv.ErrShareAlreadyExists
+	}
+	return rs.writeQuorum("Store", shareID, record{version: rs.nextVersion(latest), value: shareValue}, states)
+}
+
+// Retrieve returns the value of the share identified by 'shareID',
+// if it is present in the store.  If no share is present, or if the
+// retrieval fails for some reason, it returns nil and an error message.
+// Stale replicas are repaired.
+func (rs *Replicated) Retrieve(shareID string) (string, error) {
+	if shareID == "" {
+		return "", svalbardsrv.ErrInvalidShareID
+	}
+	defer rs.lock(shareID)()
+	states, err := rs.readQuorum("Retrieve", shareID)
+	if err != nil {
+		return "", err
+	}
+	latest, found := reconcile(states)
+	if !found {
+		return "", svalbardsrv.ErrShareNotFound
+	}
+	rs.repair(shareID, states, latest)
+	if latest.deleted {
+		return "", svalbardsrv.ErrShareNotFound
+	}
+	return latest.value, nil
+}
+
+// Contains returns true if the share identified by 'shareID' is present
+// in the store.
+func (rs *Replicated) Contains(shareID string) (bool, error) {
+	_, err := rs.Retrieve(shareID)
+	switch err {
+	case nil:
+		return true, nil
+	case svalbardsrv.ErrShareNotFound:
+		return false, nil
+	}
+	return false, err
+}
+
+// Delete removes from the store the share identified by 'shareID',
+// if it is present in the store.  If no share is present, or if the
+// deletion fails for some reason, it returns an error message.
+func (rs *Replicated) Delete(shareID string) error {
+	if shareID == "" {
+		return svalbardsrv.ErrInvalidShareID
+	}
+	defer rs.lock(shareID)()
+	states, err := rs.readQuorum("Delete", shareID)
+	if err != nil {
+		return err
+	}
+	latest, found := reconcile(states)
+	if !found || latest.deleted {
+		if found {
+			rs.repair(shareID, states, latest)
+		}
+		return svalbardsrv.ErrShareNotFound
+	}
+	return rs.writeQuorum("Delete", shareID, record{version: rs.nextVersion(latest), deleted: true}, states)
+}
+
+// shareIDs returns the union of the share ids of the replicas that can list
+// them, and the number of replicas that failed to list them.
+func (rs *Replicated) shareIDs() ([]string, int, error) {
+	ids := make(map[string]bool)
+	listers, failed := 0, 0
+	for i, replica := range rs.replicas {
+		lister, ok := replica.(ShareIDLister)
+		if !ok {
+			continue
+		}
+		listers++
+		list, err := lister.ShareIDs()
+		if err != nil {
+			slog.Warn("replicated share store: listing of shares failed", "replica", i, "error", err)
+			failed++
+			continue
+		}
+		for _, id := range list {
+			ids[id] = true
+		}
+	}
+	if listers == 0 {
+		return nil, 0, ErrNotListable
+	}
+	sorted := make([]string, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Strings(sorted)
+	return sorted, failed, nil
+}
+
+// ShareIDs returns the sorted ids of the shares in the store.  It reads
+// every share from the replicas, and fails if any of them lacks a read
+// quorum.
+func (rs *Replicated) ShareIDs() ([]string, error) {
+	ids, _, err := rs.shareIDs()
+	if err != nil {
+		return nil, err
+	}
+	var present []string
+	for _, id := range ids {
+		states, err := rs.readQuorum("ShareIDs", id)
+		if err != nil {
+			return nil, err
+		}
+		if latest, found := reconcile(states); found && !latest.deleted {
+			present = append(present, id)
+		}
+	}
+	return present, nil
+}
+
+// Count returns the number of shares in the store.  It reads every share
+// from the replicas, and fails if any of them lacks a read quorum.
+func (rs *Replicated) Count() (int, error) {
+	ids, err := rs.ShareIDs()
+	return len(ids), err
+}
+
+// Report summarizes an anti-entropy scan.
+type Report struct {
+	// Scanned is the number of shares (including tombstones) scanned.
+	Scanned int
+	// Repaired is the number of replicas of shares that were repaired.
+	Repaired int
+	// Purged is the number of tombstones removed from all replicas.
+	Purged int
+	// Failed is the number of shares, and of replicas failing to list
+	// their shares, that could not be scanned.
+	Failed int
+}
+
+// AntiEntropy scans all shares listed by any replica, and repairs the
+// stale replicas.  Tombstones held by every replica and older than the
+// retention period are purged.
+func (rs *Replicated) AntiEntropy() (Report, error) {
+	var report Report
+	ids, failed, err := rs.shareIDs()
+	if err != nil {
+		return report, err
+	}
+	report.Failed = failed
+	for _, id := range ids {
+		report.Scanned++
+		repaired, purged, err := rs.antiEntropy(id)
+		if err != nil {
+			report.Failed++
+		}
+		report.Repaired += repaired
+		if purged {
+			report.Purged++
+		}
+	}
+	return report, nil
+}
+
+func (rs *Replicated) antiEntropy(shareID string) (int, bool, error) {
+	defer rs.lock(shareID)()
+	states, err := rs.readQuorum("AntiEntropy", shareID)
+	if err != nil {
+		return 0, false, err
+	}
+	latest, found := reconcile(states)
+	if !found {
+		return 0, false, nil
+	}
+	repaired := rs.repair(shareID, states, latest)
+	if !latest.deleted || rs.now().Sub(time.Unix(0, int64(latest.version))) < rs.config.TombstoneRetention {
+		return repaired, false, nil
+	}
+	// A tombstone can be purged only if no replica may still hold an older
+	// live record, i.e. if all replicas responded with it.  Replicas that
+	// were repaired just now are purged in the next scan.
+	if repaired > 0 {
+		return repaired, false, nil
+	}
+	for _, s := range states {
+		if s.err != nil || !s.found || s.rec != latest {
+			return repaired, false, nil
+		}
+	}
+	for i, replica := range rs.replicas {
+		if err := replica.Delete(shareID); err != nil && err != svalbardsrv.ErrShareNotFound {
+			slog.Warn("replicated share store: purging of tombstone failed", "replica", i, "share_id", shareID, "error", err)
+			return repaired, false, err
+		}
+	}
+	return repaired, true, nil
+}
+
+// scan runs the anti-entropy scans periodically.
+func (rs *Replicated) scan() {
+	defer rs.workers.Done()
+	ticker := time.NewTicker(rs.config.AntiEntropyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rs.done:
+			return
+		case <-ticker.C:
+		}
+		report, err := rs.AntiEntropy()
+		switch {
+		case err != nil:
+			slog.Error("replicated share store: anti-entropy scan failed", "error", err)
+		case report.Repaired > 0 || report.Purged > 0 || report.Failed > 0:
+			slog.Info("replicated share store: anti-entropy scan", "scanned", report.Scanned,
+				"repaired", report.Repaired, "purged", report.Purged, "failed", report.Failed)
+		}
+	}
+}
+
+// CheckHealth returns nil if enough replicas are healthy for both quorums.
+// Replicas that do not implement svalbardsrv.HealthChecker count as healthy.
+func (rs *Replicated) CheckHealth() error {
+	required := rs.config.ReadQuorum
+	if rs.config.WriteQuorum > required {
+		required = rs.config.WriteQuorum
+	}
+	healthy := 0
+	var firstErr error
+	for _, replica := range rs.replicas {
+		checker, ok := replica.(svalbardsrv.HealthChecker)
+		if !ok {
+			healthy++
+			continue
+		}
+		if err := checker.CheckHealth(); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		healthy++
+	}
+	if healthy < required {
+		return fmt.Errorf("%d of %d replicas healthy, %d required: %v", healthy, len(rs.replicas), required, firstErr)
+	}
+	return nil
+}
+
+// Close stops the anti-entropy scanner, waiting for an ongoing scan.
+// It does not close the replicas.
+func (rs *Replicated) Close() error {
+	rs.closeOnce.Do(func() {
+		close(rs.done)
+	})
+	rs.workers.Wait()
+	return nil
+}
@@ -0,0 +1,425 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package replicatedsharestore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/svalbard/server/go/boltsharestore"
+	"github.com/google/svalbard/server/go/inmemorysharestore"
+	"github.com/google/svalbard/server/go/sharestoretest"
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+var errInjected = errors.New("injected failure")
+
+// faultyStore is a replica that fails all operations while it is down.
+type faultyStore struct {
+	inner svalbardsrv.ShareStore
+	mutex sync.Mutex
+	down  bool
+}
+
+func (f *faultyStore) setDown(down bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.down = down
+}
+
+func (f *faultyStore) failure() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.down {
+		return errInjected
+	}
+	return nil
+}
+
+func (f *faultyStore) Store(shareID, shareValue string) error {
+	if err := f.failure(); err != nil {
+		return err
+	}
+	return f.inner.Store(shareID, shareValue)
+}
+
+func (f *faultyStore) Retrieve(shareID string) (string, error) {
+	if err := f.failure(); err != nil {
+		return "", err
+	}
+	return f.inner.Retrieve(shareID)
+}
+
+func (f *faultyStore) Delete(shareID string) error {
+	if err := f.failure(); err != nil {
+		return err
+	}
+	return f.inner.Delete(shareID)
+}
+
+func (f *faultyStore) ShareIDs() ([]string, error) {
+	if err := f.failure(); err != nil {
+		return nil, err
+	}
+	return f.inner.(ShareIDLister).ShareIDs()
+}
+
+func (f *faultyStore) CheckHealth() error {
+	return f.failure()
+}
+
+// newReplicas returns two replicas in Bolt DBs and one in memory.
+func newReplicas(t *testing.T) []*faultyStore {
+	dir, err := ioutil.TempDir("", "test-replicated-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replicas []*faultyStore
+	for i := 0; i < 2; i++ {
+		s, err := boltsharestore.OpenOrCreate(filepath.Join(dir, fmt.Sprintf("replica%d.db", i)))
+		if err != nil {
+			t.Fatalf("OpenOrCreate(): %v", err)
+		}
+		replicas = append(replicas, &faultyStore{inner: s})
+	}
+	return append(replicas, &faultyStore{inner: inmemorysharestore.New()})
+}
+
+func newStore(t *testing.T, replicas []*faultyStore, config Config) *Replicated {
+	stores := make([]svalbardsrv.ShareStore, len(replicas))
+	for i, r := range replicas {
+		stores[i] = r
+	}
+	if config.AntiEntropyInterval == 0 {
+		config.AntiEntropyInterval = -1
+	}
+	rs, err := New(stores, config)
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+	return rs
+}
+
+// rawRecords returns the records of 'shareID' in the replicas, or nil for
+// replicas without a record.
+func rawRecords(t *testing.T, replicas []*faultyStore, shareID string) []*record {
+	records := make([]*record, len(replicas))
+	for i, r := range replicas {
+		envelope, err := r.inner.Retrieve(shareID)
+		if err == svalbardsrv.ErrShareNotFound {
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Retrieve() from replica %d: %v", i, err)
+		}
+		rec, err := decode(envelope)
+		if err != nil {
+			t.Fatalf("decode(%q) from replica %d: %v", envelope, i, err)
+		}
+		records[i] = &rec
+	}
+	return records
+}
+
+func TestNew(t *testing.T) {
+	stores := []svalbardsrv.ShareStore{inmemorysharestore.New(), inmemorysharestore.New(), inmemorysharestore.New()}
+	tests := []struct {
+		replicas []svalbardsrv.ShareStore
+		config   Config
+		err      error
+	}{
+		{stores, Config{}, nil},
+		{stores[:1], Config{}, nil},
+		{stores, Config{WriteQuorum: 3, ReadQuorum: 1}, nil},
+		{stores, Config{WriteQuorum: 1, ReadQuorum: 3}, nil},
+		{nil, Config{}, ErrNoReplicas},
+		{stores, Config{WriteQuorum: 1, ReadQuorum: 2}, ErrInvalidQuorum},
+		{stores, Config{WriteQuorum: 4, ReadQuorum: 1}, ErrInvalidQuorum},
+		{stores, Config{WriteQuorum: -1}, ErrInvalidQuorum},
+	}
+	for i, tt := range tests {
+		tt.config.AntiEntropyInterval = -1
+		if _, err := New(tt.replicas, tt.config); err != tt.err {
+			t.Errorf("test case #%d: New(%d replicas, %+v): got [%v], want [%v]", i, len(tt.replicas), tt.config, err, tt.err)
+		}
+	}
+}
+
+func TestReplicatedShareStore(t *testing.T) {
+	sharestoretest.Run(t, sharestoretest.Factory{
+		New: func(t *testing.T) svalbardsrv.ShareStore {
+			return newStore(t, newReplicas(t), Config{})
+		},
+	})
+}
+
+func TestOperations(t *testing.T) {
+	rs := newStore(t, newReplicas(t), Config{})
+	tests := []struct {
+		op      string // Operation on a ShareStore object
+		shareID string
+		value   string
+		err     error
+	}{
+		{"Store", "", "some value", svalbardsrv.ErrInvalidShareID},
+		{"Retrieve", "", "", svalbardsrv.ErrInvalidShareID},
+		{"Delete", "", "", svalbardsrv.ErrInvalidShareID},
+		{"Store", "share1", "", svalbardsrv.ErrInvalidShareValue},
+		{"Retrieve", "share1", "", svalbardsrv.ErrShareNotFound},
+		{"Delete", "share1", "", svalbardsrv.ErrShareNotFound},
+		{"Store", "share1", "some value: 1", nil},
+		{"Retrieve", "share1", "some value: 1", nil},
+		{"Store", "share1", "other value", svalbardsrv.ErrShareAlreadyExists},
+		{"Store", "share2", "some value 2", nil},
+		{"Delete", "share1", "", nil},
+		{"Retrieve", "share1", "", svalbardsrv.ErrShareNotFound},
+		{"Delete", "share1", "", svalbardsrv.ErrShareNotFound},
+		// A deleted share can be stored again.
+		{"Store", "share1", "new value", nil},
+		{"Retrieve", "share1", "new value", nil},
+		{"Retrieve", "share2", "some value 2", nil},
+		{"Store", "share3", "some value 3", nil},
+		{"Delete", "share3", "", nil},
+	}
+	for i, tt := range tests {
+		var err error
+		var value string
+		switch tt.op {
+		case "Store":
+			err = rs.Store(tt.shareID, tt.value)
+		case "Retrieve":
+			value, err = rs.Retrieve(tt.shareID)
+		case "Delete":
+			err = rs.Delete(tt.shareID)
+		default:
+			panic("Unknown operation: " + tt.op)
+		}
+		if err != tt.err || value != tt.value && tt.op == "Retrieve" {
+			t.Errorf("test case #%d: %s(%q): got [%q, %v], want [%q, %v]", i, tt.op, tt.shareID, value, err, tt.value, tt.err)
+		}
+	}
+	if n, err := rs.Count(); n != 2 || err != nil {
+		t.Errorf("Count(): got [%v, %v], want [2, nil]", n, err)
+	}
+	// Deleted shares are not listed, although the replicas keep tombstones.
+	if ids, err := rs.ShareIDs(); !reflect.DeepEqual(ids, []string{"share1", "share2"}) || err != nil {
+		t.Errorf("ShareIDs(): got [%v, %v], want [[share1 share2], nil]", ids, err)
+	}
+	for id, want := range map[string]bool{"share1": true, "share3": false} {
+		if got, err := rs.Contains(id); got != want || err != nil {
+			t.Errorf("Contains(%q): got [%v, %v], want [%v, nil]", id, got, err, want)
+		}
+	}
+}
+
+func TestQuorums(t *testing.T) {
+	replicas := newReplicas(t)
+	rs := newStore(t, replicas, Config{})
+
+	// With one replica down, all operations reach the quorums.
+	replicas[0].setDown(true)
+	if err := rs.Store("share1", "some value 1"); err != nil {
+		t.Errorf("Store() with one replica down: got [%v], want [nil]", err)
+	}
+	if err := rs.Store("share2", "some value 2"); err != nil {
+		t.Errorf("Store() with one replica down: got [%v], want [nil]", err)
+	}
+	if value, err := rs.Retrieve("share1"); value != "some value 1" || err != nil {
+		t.Errorf("Retrieve() with one replica down: got [%q, %v], want [%q, nil]", value, err, "some value 1")
+	}
+	if err := rs.Delete("share2"); err != nil {
+		t.Errorf("Delete() with one replica down: got [%v], want [nil]", err)
+	}
+	if err := rs.CheckHealth(); err != nil {
+		t.Errorf("CheckHealth() with one replica down: got [%v], want [nil]", err)
+	}
+
+	// With two replicas down, no operation reaches its quorum.
+	replicas[1].setDown(true)
+	for _, op := range []struct {
+		name string
+		run  func() error
+	}{
+		{"Store", func() error { return rs.Store("share3", "some value 3") }},
+		{"Retrieve", func() error { _, err := rs.Retrieve("share1"); return err }},
+		{"Delete", func() error { return rs.Delete("share1") }},
+	} {
+		err := op.run()
+		if qe, ok := err.(*QuorumError); !ok || qe.Op != op.name || qe.Responses != 1 || qe.Quorum != 2 || len(qe.Errs) != 2 {
+			t.Errorf("%s() with two replicas down: got [%#v], want QuorumError", op.name, err)
+		}
+	}
+	if err := rs.CheckHealth(); err == nil {
+		t.Errorf("CheckHealth() with two replicas down: got [nil], want error")
+	}
+
+	// A write that reaches some replicas only fails.
+	replicas[1].setDown(false)
+	rs2 := newStore(t, replicas, Config{WriteQuorum: 3, ReadQuorum: 1})
+	if err := rs2.Store("share4", "some value 4"); err == nil {
+		t.Errorf("Store() with write quorum 3 and one replica down: got [nil], want QuorumError")
+	}
+	replicas[0].setDown(false)
+
+	// The replica that was down is repaired on read.
+	if value, err := rs.Retrieve("share1"); value != "some value 1" || err != nil {
+		t.Errorf("Retrieve() after recovery: got [%q, %v], want [%q, nil]", value, err, "some value 1")
+	}
+	if recs := rawRecords(t, replicas, "share1"); recs[0] == nil || *recs[0] != *recs[1] || *recs[0] != *recs[2] {
+		t.Errorf("replicas of share1 after Retrieve(): got %v, want equal records", recs)
+	}
+}
+
+func TestReadRepair(t *testing.T) {
+	replicas := newReplicas(t)
+	rs := newStore(t, replicas, Config{})
+	put := func(i int, shareID string, rec record) {
+		replicas[i].inner.Delete(shareID)
+		if err := replicas[i].inner.Store(shareID, rec.encode()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Divergent replicas: the latest version wins, ties favour deletions.
+	put(0, "share1", record{version: 1, value: "old value"})
+	put(1, "share1", record{version: 3, value: "new value"})
+	put(2, "share1", record{version: 2, deleted: true})
+	put(0, "share2", record{version: 5, value: "some value"})
+	put(1, "share2", record{version: 5, deleted: true})
+	replicas[2].inner.Store("share3", "not an envelope")
+	put(1, "share3", record{version: 1, value: "some value"})
+
+	tests := []struct {
+		shareID string
+		value   string
+		err     error
+		want    record
+	}{
+		{"share1", "new value", nil, record{version: 3, value: "new value"}},
+		{"share2", "", svalbardsrv.ErrShareNotFound, record{version: 5, deleted: true}},
+		{"share3", "some value", nil, record{version: 1, value: "some value"}},
+	}
+	for _, tt := range tests {
+		if value, err := rs.Retrieve(tt.shareID); value != tt.value || err != tt.err {
+			t.Errorf("Retrieve(%q): got [%q, %v], want [%q, %v]", tt.shareID, value, err, tt.value, tt.err)
+		}
+		for i, rec := range rawRecords(t, replicas, tt.shareID) {
+			if rec == nil || *rec != tt.want {
+				t.Errorf("replica %d of %q after Retrieve(): got %v, want %v", i, tt.shareID, rec, tt.want)
+			}
+		}
+	}
+}
+
+func TestDeletedShareIsNotResurrected(t *testing.T) {
+	replicas := newReplicas(t)
+	rs := newStore(t, replicas, Config{})
+	rs.Store("share1", "some value")
+	replicas[2].setDown(true)
+	if err := rs.Delete("share1"); err != nil {
+		t.Fatalf("Delete(): %v", err)
+	}
+	replicas[2].setDown(false)
+	// Replica 2 still holds the share, but the tombstones supersede it.
+	replicas[0].setDown(true)
+	if _, err := rs.Retrieve("share1"); err != svalbardsrv.ErrShareNotFound {
+		t.Errorf("Retrieve() of deleted share: got [%v], want [%v]", err, svalbardsrv.ErrShareNotFound)
+	}
+	if recs := rawRecords(t, replicas, "share1"); !recs[2].deleted {
+		t.Errorf("replica 2 after Retrieve(): got %v, want tombstone", recs[2])
+	}
+}
+
+func TestAntiEntropy(t *testing.T) {
+	replicas := newReplicas(t)
+	rs := newStore(t, replicas, Config{TombstoneRetention: time.Hour})
+	now := time.Unix(1500000000, 0)
+	rs.now = func() time.Time { return now }
+
+	replicas[1].setDown(true)
+	for i := 0; i < 10; i++ {
+		rs.Store(fmt.Sprintf("share%d", i), fmt.Sprintf("some value %d", i))
+	}
+	rs.Delete("share0")
+	replicas[1].setDown(false)
+	report, err := rs.AntiEntropy()
+	if want := (Report{Scanned: 10, Repaired: 10}); report != want || err != nil {
+		t.Errorf("AntiEntropy(): got [%+v, %v], want [%+v, nil]", report, err, want)
+	}
+	if ids, _ := replicas[1].ShareIDs(); len(ids) != 10 {
+		t.Errorf("ShareIDs() of repaired replica: got %v, want 10 shares", ids)
+	}
+
+	// Tombstones are purged after the retention period, only if every
+	// replica holds them.
+	rs.Delete("share1")
+	now = now.Add(2 * time.Hour)
+	replicas[2].setDown(true)
+	report, err = rs.AntiEntropy()
+	if want := (Report{Scanned: 10, Failed: 1}); report != want || err != nil {
+		t.Errorf("AntiEntropy() with a replica down: got [%+v, %v], want [%+v, nil]", report, err, want)
+	}
+	replicas[2].setDown(false)
+	report, err = rs.AntiEntropy()
+	if want := (Report{Scanned: 10, Purged: 2}); report != want || err != nil {
+		t.Errorf("AntiEntropy(): got [%+v, %v], want [%+v, nil]", report, err, want)
+	}
+	for i, r := range replicas {
+		if ids, _ := r.ShareIDs(); len(ids) != 8 {
+			t.Errorf("ShareIDs() of replica %d after purge: got %v, want 8 shares", i, ids)
+		}
+	}
+	if n, err := rs.Count(); n != 8 || err != nil {
+		t.Errorf("Count(): got [%v, %v], want [8, nil]", n, err)
+	}
+
+	notListable := []svalbardsrv.ShareStore{struct{ svalbardsrv.ShareStore }{inmemorysharestore.New()}}
+	rs, err = New(notListable, Config{AntiEntropyInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rs.AntiEntropy(); err != ErrNotListable {
+		t.Errorf("AntiEntropy() without listable replicas: got [%v], want [%v]", err, ErrNotListable)
+	}
+}
+
+func TestBackgroundAntiEntropy(t *testing.T) {
+	replicas := newReplicas(t)
+	rs := newStore(t, replicas, Config{AntiEntropyInterval: 10 * time.Millisecond})
+	defer rs.Close()
+	replicas[0].setDown(true)
+	rs.Store("share1", "some value")
+	replicas[0].setDown(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for rawRecords(t, replicas, "share1")[0] == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("replica 0 was not repaired in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := rs.Close(); err != nil {
+		t.Errorf("Close(): got [%v], want [nil]", err)
+	}
+	if recs := rawRecords(t, replicas, "share1"); !reflect.DeepEqual(recs[0], recs[1]) {
+		t.Errorf("replicas after background repair: got %v, want equal records", recs)
+	}
+}
@@ -18,73 +18,1001 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/google/svalbard/server/go/adminapi"
+	"github.com/google/svalbard/server/go/auditlog"
+	"github.com/google/svalbard/server/go/boltratelimitstore"
 	"github.com/google/svalbard/server/go/boltsharestore"
+	"github.com/google/svalbard/server/go/certreloader"
+	"github.com/google/svalbard/server/go/channelrouter"
 	"github.com/google/svalbard/server/go/filechannel"
+	"github.com/google/svalbard/server/go/logging"
+	"github.com/google/svalbard/server/go/metrics"
+	"github.com/google/svalbard/server/go/msgtemplate"
+	"github.com/google/svalbard/server/go/outboxchannel"
+	"github.com/google/svalbard/server/go/pow"
+	"github.com/google/svalbard/server/go/ratelimit"
+	"github.com/google/svalbard/server/go/serverconfig"
+	"github.com/google/svalbard/server/go/shareexpiry"
+	"github.com/google/svalbard/server/go/snapshot"
+	"github.com/google/svalbard/server/go/sqlitesharestore"
 	"github.com/google/svalbard/server/go/svalbardsrv"
 	"github.com/google/svalbard/server/go/tokenstore"
+	"github.com/google/svalbard/server/go/translog"
+	"github.com/google/svalbard/server/go/util"
+	"github.com/google/svalbard/server/go/webhookchannel"
 )
 
+// parseKeyValueList parses a comma-separated list of "key=value" pairs.
+func parseKeyValueList(list string) (map[string]string, error) {
+	result := make(map[string]string)
+	if list == "" {
+		return result, nil
+	}
+	for _, pair := range strings.Split(list, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid key=value pair [%s]", pair)
+		}
+		result[kv[0]] = kv[1]
+	}
+	return result, nil
+}
+
 func main() {
 	filechannelRootDir := flag.String("filechannel_root_dir", "", "root dir for file-based secondary channel")
+	filechannelMaxFileSize := flag.Int64("filechannel_max_file_size", filechannel.DefaultMaxFileSize, "size in bytes beyond which files of file-based secondary channel are rotated")
+	webhookURLs := flag.String("webhook_urls", "", "comma-separated list of owner_id_type=URL pairs for webhook secondary channels")
+	webhookKeyFile := flag.String("webhook_key_file", "", "file (or env:<variable>) with the key for signing the payloads sent to webhooks")
+	webhookMaxRetries := flag.Int("webhook_max_retries", 2, "number of retries of failed webhook deliveries")
+	ownerIDTypeAliases := flag.String("owner_id_type_aliases", "", "comma-separated list of alias=owner_id_type pairs")
+	fallbackOwnerIDType := flag.String("fallback_owner_id_type", "", "owner_id_type whose channel handles unsupported owner id types")
+	msgTemplatesDir := flag.String("msg_templates_dir", "", "dir with <locale>.json catalogs of message templates, in addition to the builtin ones")
+	outboxFile := flag.String("outbox_file", "", "Bolt DB file for the outbox; if set, tokens are delivered asynchronously")
+	outboxKeyFile := flag.String("outbox_key_file", "", "file (or env:<variable>) with the key for hashing the recipients in the outbox; required with -outbox_file")
+	outboxMaxAttempts := flag.Int("outbox_max_attempts", outboxchannel.DefaultMaxAttempts, "number of delivery attempts before a message is dead-lettered")
+	recipientRateLimit := flag.String("recipient_rate_limit", "10/1h", "limit of tokens sent to a recipient, as <n>/<duration>; 0 disables the limit")
+	subnetRateLimit := flag.String("subnet_rate_limit", "60/1h", "limit of tokens requested from a client subnet, as <n>/<duration>; 0 disables the limit")
+	globalRateLimit := flag.String("global_rate_limit", "1000/1h", "limit of all tokens, as <n>/<duration>; 0 disables the limit")
+	deliveryStatusRateLimit := flag.String("delivery_status_rate_limit", "60/1h", "limit of delivery status requests per recipient and per client subnet, as <n>/<duration>; 0 disables the limit")
+	rateLimitFile := flag.String("rate_limit_file", "", "Bolt DB file for persisting the rate limits across restarts")
+	rateLimitKeyFile := flag.String("rate_limit_key_file", "", "file (or env:<variable>) with the key for deriving the keys of the rate limit buckets; required with -rate_limit_file")
+	powKeyFile := flag.String("pow_key_file", "", "file (or env:<variable>) with the key for signing proof-of-work challenges; if set, challenges are required under load")
+	powDifficulty := flag.Int("pow_difficulty", pow.DefaultDifficulty, "difficulty (in bits) of proof-of-work challenges when not under load")
+	powMaxDifficulty := flag.Int("pow_max_difficulty", pow.DefaultMaxDifficulty, "maximal difficulty (in bits) of proof-of-work challenges under load")
+	powLoadThreshold := flag.Int("pow_load_threshold", 100, "number of token requests per minute beyond which challenges are required; 0 requires them always")
+	powRecipientThreshold := flag.Int("pow_recipient_threshold", 3, "number of token requests per minute for a recipient beyond which challenges are required; 0 disables the check")
+	auditLogFile := flag.String("audit_log_file", "", "file for the tamper-evident audit log of token requests and share operations")
+	auditLogKeyFile := flag.String("audit_log_key_file", "", "file (or env:<variable>) with the key for the hashes in the audit log")
+	auditLogHeadInterval := flag.Duration("audit_log_head_interval", time.Hour, "interval of logging the head of the audit log, if it has changed; 0 logs it only at startup and shutdown")
+	translogFile := flag.String("translog_file", "", "file for the public transparency log of share operations")
+	translogKeyFile := flag.String("translog_key_file", "", "file (or env:<variable>) with the PEM-encoded ECDSA P-256 key for signing the tree heads of the transparency log")
 	boltShareStoreFile := flag.String("bolt_share_store_file", "", "Bolt DB file for storing shares")
+	sqliteShareStoreFile := flag.String("sqlite_share_store_file", "", "SQLite DB file for storing shares, instead of -bolt_share_store_file")
+	shareExpiryDefault := flag.Duration("share_expiry_default", 0, "period after which shares stored without expires_in expire unless renewed; 0 keeps them forever, or for -share_expiry_max if set")
+	shareExpiryMax := flag.Duration("share_expiry_max", 0, "maximal period after which shares expire unless renewed; 0 allows any period, and shares that never expire")
+	shareExpiryReminder := flag.Duration("share_expiry_reminder", shareexpiry.DefaultReminderLeadTime, "time before the expiry of a share when its owner is sent a renewal token; negative disables the reminders")
+	shareExpiryKeyFile := flag.String("share_expiry_key_file", "", "file (or env:<variable>) with the key for encrypting the owners of expiring shares in the share store; without it, owners are not kept and not reminded")
+	shareExpiryReapInterval := flag.Duration("share_expiry_reap_interval", shareexpiry.DefaultReapInterval, "interval of deleting expired shares and sending reminders")
+	deletionGracePeriod := flag.Duration("deletion_grace_period", 0, "period during which deleted shares can be undeleted by their owners, e.g. 168h; 0 deletes shares immediately")
+	shareStoreMaxSize := flag.Int64("share_store_max_size", 0, "maximal size in bytes of the data in the share store, beyond which no more shares are stored; 0 disables the limit")
+	maxSharesPerOwner := flag.Int("max_shares_per_owner", 100, "maximal number of shares stored per owner, including deleted shares until they are purged; 0 disables the limit")
+	ownerIndexKeyFile := flag.String("owner_index_key_file", "", "file (or env:<variable>) with the key for the index of the shares by their owners; without it, shares are not indexed, and -max_shares_per_owner is not enforced")
+	maxShareSize := flag.Int("max_share_size", svalbardsrv.DefaultMaxShareSize, "maximal size in bytes of share values; 0 disables the limit")
+	maxRequestSize := flag.Int64("max_request_size", svalbardsrv.DefaultMaxRequestSize, "maximal size in bytes of the bodies of requests; 0 disables the limit")
+	deletionPurgeInterval := flag.Duration("deletion_purge_interval", time.Hour, "interval of purging deleted shares whose grace period is over")
 	serverPort := flag.String("port", "8080", "port on which server should listen to incoming requests")
+	adminAddr := flag.String("admin_addr", "", "address (e.g. localhost:9090) of the admin listener serving /metrics, /healthz, /readyz and /version; empty disables it")
+	adminAPIAddr := flag.String("admin_api_addr", "", "address (e.g. :9443) of the admin API listener, which requires client certificates; empty disables it")
+	adminAPICertFile := flag.String("admin_api_tls_cert_file", "", "file with the certificate of the admin API listener")
+	adminAPIKeyFile := flag.String("admin_api_tls_key_file", "", "file with the private key of the admin API listener")
+	adminAPIClientCAFile := flag.String("admin_api_client_ca_file", "", "file with the PEM-encoded certificates of the CAs that issue the client certificates of the operators")
+	adminAPIRoles := flag.String("admin_api_roles", "", "comma-separated list of <attribute>:<value>=<role> pairs mapping subjects of client certificates to roles, e.g. OU:sre=operator,CN:dashboard=viewer")
+	adminAPISnapshots := flag.Bool("admin_api_snapshots", false, "serve snapshots of the share store to operators at /snapshot of the admin API")
+	adminAPISnapshotPublicKeyFile := flag.String("admin_api_snapshot_public_key_file", "", "file with the PEM-encoded RSA public key of the operators to encrypt snapshots to; empty serves unencrypted snapshots")
+	maxTokens := flag.Int("max_tokens", tokenstore.DefaultMaxTokens, "maximal number of valid tokens; beyond 90% the server is not ready")
 	tokenValidityPeriod := flag.Duration("token_validity", 5*time.Second, "validity period for short-lived tokens")
 	keyFileTLS := flag.String("tls_key_file", "", "file with private key to be used for TLS")
 	certFileTLS := flag.String("tls_cert_file", "", "file with certificate for the key to be used for TLS")
+	logLevel := flag.String("log_level", "info", "minimum level of logged messages: debug, info, warn or error")
+	logFormat := flag.String("log_format", "text", "format of logged messages: text or json")
+	logHashKeyFile := flag.String("log_hash_key_file", "", "file (or env:<variable>) with the key for hashing owner ids in the logs; if empty, a random key is used, which changes upon every restart")
+	readTimeout := flag.Duration("read_timeout", 10*time.Second, "maximal duration of reading a request")
+	writeTimeout := flag.Duration("write_timeout", time.Minute, "maximal duration from the end of reading a request to the end of the response")
+	idleTimeout := flag.Duration("idle_timeout", 2*time.Minute, "maximal duration of idle keep-alive connections")
+	shutdownTimeout := flag.Duration("shutdown_timeout", 30*time.Second, "maximal duration of draining the requests in flight upon SIGTERM or SIGINT")
+	configFile := flag.String("config", "", "JSON file with the configuration of the server; flags given on the command line override it")
+	checkConfig := flag.Bool("check_config", false, "validate the configuration (the -config file and the flags) and exit")
 	flag.Parse()
-	if *filechannelRootDir == "" {
-		log.Fatal("Please provide -filechannel_root_dir")
+
+	commandLine := commandLineFlags()
+	if *configFile != "" {
+		if err := applyConfigFile(*configFile, commandLine); err != nil {
+			log.Fatalf("Could not load configuration: %v", err)
+		}
 	}
-	if *boltShareStoreFile == "" {
-		log.Fatal("Please provide -bolt_share_store_file")
+	if err := checkFlags(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
 	}
-	useTLS := false
-	if *keyFileTLS != "" || *certFileTLS != "" {
-		useTLS = true
-		if *keyFileTLS == "" {
-			log.Fatalf("Missing -tls_key_file")
-		}
-		if *certFileTLS == "" {
-			log.Fatalf("Missing -tls_cert_file")
-		}
+	if *checkConfig {
+		fmt.Println("Configuration OK")
+		os.Exit(0)
+	}
+	logger, logLevelVar, err := newLogger(*logLevel, *logFormat, *logHashKeyFile)
+	if err != nil {
+		log.Fatalf("Could not setup logging: %v", err)
 	}
+	slog.SetDefault(logger)
+	if *logHashKeyFile == "" {
+		slog.Warn("hashes of owner ids in the logs change upon every restart without -log_hash_key_file")
+	}
+	useTLS := *keyFileTLS != ""
 
 	tokenLength := 5
 	tokenStore, err := tokenstore.NewStore(tokenLength, *tokenValidityPeriod)
 	if err != nil {
 		log.Fatalf("Could not setup TokenStore: %v", err)
 	}
-	shareStore, err := boltsharestore.OpenOrCreate(*boltShareStoreFile)
-	if err != nil {
-		log.Fatalf("Could not setup BoltShareStore: %v", err)
-	}
-	srv := svalbardsrv.NewServer(tokenStore, shareStore,
-		filechannel.NewChannel(*filechannelRootDir))
-	http.HandleFunc("/get_storage_token", srv.GetStorageTokenHandler)
-	http.HandleFunc("/get_storage_token/", srv.GetStorageTokenHandler)
-	http.HandleFunc("/store_share", srv.StoreShareHandler)
-	http.HandleFunc("/store_share/", srv.StoreShareHandler)
-	http.HandleFunc("/get_retrieval_token", srv.GetRetrievalTokenHandler)
-	http.HandleFunc("/get_retrieval_token/", srv.GetRetrievalTokenHandler)
-	http.HandleFunc("/retrieve_share", srv.RetrieveShareHandler)
-	http.HandleFunc("/retrieve_share/", srv.RetrieveShareHandler)
-	http.HandleFunc("/get_deletion_token", srv.GetDeletionTokenHandler)
-	http.HandleFunc("/get_deletion_token/", srv.GetDeletionTokenHandler)
-	http.HandleFunc("/delete_share", srv.DeleteShareHandler)
-	http.HandleFunc("/delete_share/", srv.DeleteShareHandler)
-	log.Printf("Starting Svalbard server at port %v, using directory %v for secondary channel...\n",
-		*serverPort, *filechannelRootDir)
+	tokenStore.SetMaxTokens(*maxTokens)
+	shareStore, err := openShareStore(*boltShareStoreFile, *sqliteShareStoreFile)
+	if err != nil {
+		log.Fatalf("Could not setup share store: %v", err)
+	}
+	shareStore.SetMaxSharesPerOwner(*maxSharesPerOwner)
+	shareStore.SetMaxSize(*shareStoreMaxSize)
+	// The resources are closed upon shutdown in the reverse order of opening,
+	// so that nothing is closed before the resources that use it.
+	resources := []resource{{"share store", shareStore.Close}}
+	expiringShareStore, err := shareexpiry.New(shareStore, shareexpiry.Policy{
+		DefaultPeriod:    *shareExpiryDefault,
+		MaxPeriod:        *shareExpiryMax,
+		ReminderLeadTime: *shareExpiryReminder,
+		ReapInterval:     *shareExpiryReapInterval,
+	})
+	if err != nil {
+		log.Fatalf("Could not setup share expiry: %v", err)
+	}
+	if *shareExpiryKeyFile != "" {
+		key, err := util.ReadSecret(*shareExpiryKeyFile)
+		if err != nil {
+			log.Fatalf("Could not read -share_expiry_key_file: %v", err)
+		}
+		if err := expiringShareStore.SetRecipientKey(key); err != nil {
+			log.Fatalf("Could not setup share expiry: %v", err)
+		}
+	} else if (*shareExpiryDefault > 0 || *shareExpiryMax > 0) && *shareExpiryReminder >= 0 {
+		slog.Warn("owners of expiring shares are not reminded without -share_expiry_key_file")
+	}
+	if *deletionGracePeriod > 0 {
+		resources = append(resources, resource{"purger of deleted shares", startPurger(expiringShareStore, *deletionPurgeInterval)})
+	}
+	templates := msgtemplate.New()
+	if *msgTemplatesDir != "" {
+		if err := templates.LoadDir(*msgTemplatesDir); err != nil {
+			log.Fatalf("Could not load message templates: %v", err)
+		}
+	}
+	router, err := newChannelRouter(*filechannelRootDir, *filechannelMaxFileSize, *webhookURLs, *webhookKeyFile, *webhookMaxRetries,
+		*ownerIDTypeAliases, *fallbackOwnerIDType, templates)
+	if err != nil {
+		log.Fatalf("Could not setup secondary channels: %v", err)
+	}
+	var secondaryChannel svalbardsrv.SecondaryChannel = router
+	if *outboxFile != "" {
+		key, err := util.ReadSecret(*outboxKeyFile)
+		if err != nil {
+			log.Fatalf("Could not read -outbox_key_file: %v", err)
+		}
+		outbox, err := outboxchannel.Open(*outboxFile, router,
+			outboxchannel.Config{Key: key, MaxAttempts: *outboxMaxAttempts, TokenValidity: *tokenValidityPeriod})
+		if err != nil {
+			log.Fatalf("Could not setup outbox: %v", err)
+		}
+		secondaryChannel = outbox
+		resources = append(resources, resource{"outbox", outbox.Close})
+	}
+	rateLimiter, closeRateLimiter, err := newRateLimiter(*recipientRateLimit, *subnetRateLimit, *globalRateLimit, *rateLimitFile, *rateLimitKeyFile)
+	if err != nil {
+		log.Fatalf("Could not setup rate limiter: %v", err)
+	}
+	if closeRateLimiter != nil {
+		resources = append(resources, resource{"rate limit store", closeRateLimiter})
+	}
+	rateLimiter.SetRecipientNormalizer(router.Recipient)
+	// Polling the delivery statuses must not use up the tokens of the
+	// recipients, so it is limited separately, and only in memory.
+	statusPolicy, err := ratelimit.ParsePolicy(*deliveryStatusRateLimit)
+	if err != nil {
+		log.Fatalf("Invalid -delivery_status_rate_limit: %v", err)
+	}
+	statusLimiter, err := ratelimit.New(ratelimit.Config{PerRecipient: statusPolicy, PerSubnet: statusPolicy}, nil, nil)
+	if err != nil {
+		log.Fatalf("Could not setup rate limiter: %v", err)
+	}
+	statusLimiter.SetRecipientNormalizer(router.Recipient)
+	registry := metrics.NewRegistry()
+	mux := http.NewServeMux()
+	opts := []svalbardsrv.Option{svalbardsrv.WithRateLimiter(rateLimiter), svalbardsrv.WithDeliveryStatusRateLimiter(statusLimiter),
+		svalbardsrv.WithMetrics(registry),
+		svalbardsrv.WithSoftDelete(*deletionGracePeriod), svalbardsrv.WithMaxRequestSize(*maxRequestSize),
+		svalbardsrv.WithMaxShareSize(*maxShareSize)}
+	if *ownerIndexKeyFile != "" {
+		key, err := util.ReadSecret(*ownerIndexKeyFile)
+		if err != nil {
+			log.Fatalf("Could not read -owner_index_key_file: %v", err)
+		}
+		opts = append(opts, svalbardsrv.WithOwnerIndexKey(key))
+	} else if *maxSharesPerOwner > 0 {
+		slog.Warn("shares per owner are not limited without -owner_index_key_file")
+	}
+	if *powKeyFile != "" {
+		guard, err := newChallengeGuard(*powKeyFile, *powDifficulty, *powMaxDifficulty, *powLoadThreshold, *powRecipientThreshold)
+		if err != nil {
+			log.Fatalf("Could not setup proof-of-work challenges: %v", err)
+		}
+		guard.SetRecipientNormalizer(router.Recipient)
+		opts = append(opts, svalbardsrv.WithChallengeGuard(guard))
+	}
+	if *auditLogFile != "" {
+		auditLog, err := newAuditLog(*auditLogFile, *auditLogKeyFile, *auditLogHeadInterval)
+		if err != nil {
+			log.Fatalf("Could not setup audit log: %v", err)
+		}
+		slog.Info("appending to audit log", "file", *auditLogFile, "head", auditLog.Head().String())
+		opts = append(opts, svalbardsrv.WithAuditor(auditLog))
+		resources = append(resources, resource{"audit log", auditLog.Close})
+	}
+	if *translogFile != "" {
+		translogKey, err := util.ReadSecret(*translogKeyFile)
+		if err != nil {
+			log.Fatalf("Could not read -translog_key_file: %v", err)
+		}
+		key, err := translog.ParsePrivateKey(translogKey)
+		if err != nil {
+			log.Fatalf("Could not parse -translog_key_file: %v", err)
+		}
+		transparencyLog, err := translog.Open(*translogFile, key)
+		if err != nil {
+			log.Fatalf("Could not setup transparency log: %v", err)
+		}
+		opts = append(opts, svalbardsrv.WithAuditor(transparencyLog))
+		resources = append(resources, resource{"transparency log", transparencyLog.Close})
+		mux.HandleFunc("/translog/sth", metrics.InstrumentHandler(registry, "translog_sth", transparencyLog.SignedTreeHeadHandler))
+		mux.HandleFunc("/translog/get-entries", metrics.InstrumentHandler(registry, "translog_get_entries", transparencyLog.GetEntriesHandler))
+		mux.HandleFunc("/translog/entries", metrics.InstrumentHandler(registry, "translog_entries", transparencyLog.EntriesHandler))
+		mux.HandleFunc("/translog/inclusion_proof", metrics.InstrumentHandler(registry, "translog_inclusion_proof", transparencyLog.InclusionProofHandler))
+		mux.HandleFunc("/translog/consistency_proof", metrics.InstrumentHandler(registry, "translog_consistency_proof", transparencyLog.ConsistencyProofHandler))
+	}
+	srv := svalbardsrv.NewServer(tokenStore, expiringShareStore, secondaryChannel, opts...)
+	// The reaper sends reminders via the secondary channel, so it is stopped
+	// before the channel is closed.
+	expiringShareStore.StartReaper(srv.SendRenewalReminder)
+	resources = append(resources, resource{"share expiry reaper", expiringShareStore.Close})
+	for _, route := range []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"get_storage_token", srv.GetStorageTokenHandler},
+		{"store_share", srv.StoreShareHandler},
+		{"get_retrieval_token", srv.GetRetrievalTokenHandler},
+		{"retrieve_share", srv.RetrieveShareHandler},
+		{"get_deletion_token", srv.GetDeletionTokenHandler},
+		{"delete_share", srv.DeleteShareHandler},
+		{"get_renewal_token", srv.GetRenewalTokenHandler},
+		{"renew_share", srv.RenewShareHandler},
+		{"get_undeletion_token", srv.GetUndeletionTokenHandler},
+		{"undelete_share", srv.UndeleteShareHandler},
+		{"owner_id_types", srv.SupportedOwnerIDTypesHandler},
+		{"delivery_status", srv.DeliveryStatusHandler},
+		{"challenge", srv.ChallengeHandler},
+		{"healthz", srv.HealthzHandler},
+	} {
+		handler := metrics.InstrumentHandler(registry, route.name, route.handler)
+		mux.HandleFunc("/"+route.name, handler)
+		mux.HandleFunc("/"+route.name+"/", handler)
+	}
+	var certs []*certreloader.Reloader
+	var publicCert *certreloader.Reloader
+	if useTLS {
+		publicCert, err = certreloader.New(*certFileTLS, *keyFileTLS)
+		if err != nil {
+			log.Fatalf("Could not load TLS certificate: %v", err)
+		}
+		publicCert.Watch(certreloader.DefaultPollInterval)
+		certs = append(certs, publicCert)
+		resources = append(resources, resource{"certificate reloader", publicCert.Close})
+	}
+	timeouts := serverTimeouts{read: *readTimeout, write: *writeTimeout, idle: *idleTimeout}
+	servers := []*http.Server{newHTTPServer(":"+*serverPort, mux, timeouts)}
+	if *adminAddr != "" {
+		// The admin listener uses its own mux, so that the metrics, the
+		// readiness checks (which write to the share store) and the build
+		// details are never exposed on the public port.
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/metrics", registry)
+		adminMux.HandleFunc("/healthz", srv.HealthzHandler)
+		adminMux.HandleFunc("/readyz", srv.ReadyzHandler)
+		adminMux.HandleFunc("/version", srv.VersionHandler)
+		adminServer := newHTTPServer(*adminAddr, adminMux, timeouts)
+		servers = append(servers, adminServer)
+		slog.Info("starting admin listener", "address", *adminAddr)
+		go func() {
+			if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	} else {
+		slog.Warn("/readyz and /version are not served without -admin_addr")
+	}
+
+	if *adminAPIAddr != "" {
+		config := adminapi.Config{
+			ShareStore: expiringShareStore,
+			TokenStore: tokenStore,
+			Channels:   router,
+		}
+		if *adminAPISnapshots {
+			// checkFlags() ensures that snapshots are enabled only for Bolt.
+			snapshots, err := newSnapshotWriter(shareStore.(*boltsharestore.Bolt), *adminAPISnapshotPublicKeyFile)
+			if err != nil {
+				log.Fatalf("Could not setup snapshots: %v", err)
+			}
+			config.Snapshots = snapshots
+		}
+		adminAPIServer, adminAPICert, err := newAdminAPIServer(*adminAPIAddr, *adminAPICertFile, *adminAPIKeyFile,
+			*adminAPIClientCAFile, *adminAPIRoles, timeouts, config)
+		if err != nil {
+			log.Fatalf("Could not setup admin API: %v", err)
+		}
+		certs = append(certs, adminAPICert)
+		resources = append(resources, resource{"admin API certificate reloader", adminAPICert.Close})
+		servers = append(servers, adminAPIServer)
+		slog.Info("starting admin API listener", "address", *adminAPIAddr)
+		go func() {
+			if err := adminAPIServer.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// Reload the certificates and the configuration upon SIGHUP.
+	reloader := &configReloader{
+		configFile:  *configFile,
+		commandLine: commandLine,
+		certs:       certs,
+		rateLimiter: rateLimiter,
+		templates:   templates,
+		logLevel:    logLevelVar,
+	}
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			if err := reloader.reload(); err != nil {
+				slog.Error("could not reload configuration", "error", err)
+			}
+		}
+	}()
+
+	// Shut down gracefully upon SIGTERM or SIGINT.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	exitCode := make(chan int)
+	go func() {
+		sig := <-signals
+		slog.Info("shutting down", "signal", sig.String(), "timeout", *shutdownTimeout)
+		exitCode <- shutdown(servers, resources, *shutdownTimeout)
+	}()
+
+	slog.Info("starting Svalbard server", "port", *serverPort, "owner_id_types", router.SupportedOwnerIDTypes())
 	if useTLS {
-		log.Printf("Starting in TLS-mode, using key from %v and certificate from %v ...\n",
-			*keyFileTLS, *certFileTLS)
-		log.Fatal(http.ListenAndServeTLS(":"+(*serverPort), *certFileTLS, *keyFileTLS, nil))
+		slog.Info("starting in TLS mode", "key_file", *keyFileTLS, "cert_file", *certFileTLS)
+		servers[0].TLSConfig = publicCert.TLSConfig()
+		err = servers[0].ListenAndServeTLS("", "")
 	} else {
-		log.Printf("WARNING: starting in non-encrypted mode, all traffic can be intercepted ...\n")
-		log.Fatal(http.ListenAndServe(":"+(*serverPort), nil))
+		slog.Warn("starting in non-encrypted mode, all traffic can be intercepted")
+		err = servers[0].ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	os.Exit(<-exitCode)
+}
+
+// serverTimeouts are the timeouts of the HTTP servers.
+type serverTimeouts struct {
+	read, write, idle time.Duration
+}
+
+// newHTTPServer returns an http.Server that serves 'handler' at 'addr'
+// with the given timeouts.
+func newHTTPServer(addr string, handler http.Handler, timeouts serverTimeouts) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       timeouts.read,
+		ReadHeaderTimeout: timeouts.read,
+		WriteTimeout:      timeouts.write,
+		IdleTimeout:       timeouts.idle,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+}
+
+// resource is opened by the server, and must be closed upon shutdown.
+type resource struct {
+	name  string
+	close func() error
+}
+
+// shutdown stops 'servers' from accepting new requests, waits at most
+// 'timeout' for the requests in flight to complete, and then closes
+// 'resources' in the reverse order.  It returns the exit code of the server:
+// 0 if everything was drained and closed cleanly, 1 otherwise.
+func shutdown(servers []*http.Server, resources []resource, timeout time.Duration) int {
+	exitCode := 0
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("could not drain requests in flight", "address", server.Addr, "error", err)
+			server.Close()
+			exitCode = 1
+		}
+	}
+	for i := len(resources) - 1; i >= 0; i-- {
+		if err := resources[i].close(); err != nil {
+			slog.Error("could not close "+resources[i].name, "error", err)
+			exitCode = 1
+		}
+	}
+	slog.Info("shut down", "exit_code", exitCode)
+	return exitCode
+}
+
+// commandLineFlags returns the set of the names of the flags given on the
+// command line.  It must be called before any flag is set otherwise.
+func commandLineFlags() map[string]bool {
+	names := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		names[f.Name] = true
+	})
+	return names
+}
+
+// applyConfigFile sets the flags that are not given on the command line
+// ('commandLine') to the values in the configuration file 'filename'.
+func applyConfigFile(filename string, commandLine map[string]bool) error {
+	config, err := serverconfig.Load(filename)
+	if err != nil {
+		return err
+	}
+	for name, value := range config.Flags() {
+		if commandLine[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value [%s] for -%s: %v", value, name, err)
+		}
+	}
+	return nil
+}
+
+// reloadableFlags are the flags whose values are applied upon SIGHUP;
+// changes of the other flags require a restart.
+var reloadableFlags = map[string]bool{
+	"recipient_rate_limit": true,
+	"subnet_rate_limit":    true,
+	"global_rate_limit":    true,
+	"msg_templates_dir":    true,
+	"log_level":            true,
+}
+
+// configReloader reloads the TLS certificates, and applies the values of
+// the reloadableFlags from the configuration file, without dropping any
+// connections.
+type configReloader struct {
+	configFile  string
+	commandLine map[string]bool // flags given on the command line
+	certs       []*certreloader.Reloader
+	rateLimiter *ratelimit.Limiter
+	templates   *msgtemplate.Set
+	logLevel    *slog.LevelVar
+}
+
+// reload reloads the certificates and the configuration.  Either all or
+// none of the reloadable settings are applied.
+func (r *configReloader) reload() error {
+	var problems []string
+	for _, certs := range r.certs {
+		if err := certs.Reload(); err != nil {
+			problems = append(problems, fmt.Sprintf("could not reload TLS certificate: %v", err))
+		} else if leaf, err := certs.Leaf(); err == nil {
+			slog.Info("reloaded TLS certificate", "subject", leaf.Subject.String(), "not_after", leaf.NotAfter)
+		}
+	}
+	if err := r.reloadSettings(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// reloadSettings applies the reloadable settings.
+func (r *configReloader) reloadSettings() error {
+	values, err := r.settings()
+	if err != nil {
+		return err
+	}
+	for name, value := range values {
+		if !reloadableFlags[name] && value != flag.Lookup(name).Value.String() {
+			slog.Warn("changed setting requires a restart", "flag", name)
+		}
+	}
+	limits, err := rateLimitConfig(values["recipient_rate_limit"], values["subnet_rate_limit"], values["global_rate_limit"])
+	if err != nil {
+		return err
+	}
+	level, err := logging.ParseLevel(values["log_level"])
+	if err != nil {
+		return fmt.Errorf("invalid -log_level: %v", err)
+	}
+	if err := r.templates.ReloadDir(values["msg_templates_dir"]); err != nil {
+		return fmt.Errorf("could not reload message templates: %v", err)
+	}
+	if err := r.rateLimiter.SetConfig(limits); err != nil {
+		return err
+	}
+	r.logLevel.Set(level)
+	for name := range reloadableFlags {
+		flag.Set(name, values[name])
+	}
+	slog.Info("reloaded configuration", "recipient_rate_limit", values["recipient_rate_limit"],
+		"subnet_rate_limit", values["subnet_rate_limit"], "global_rate_limit", values["global_rate_limit"],
+		"msg_templates_dir", values["msg_templates_dir"], "log_level", level.String())
+	return nil
+}
+
+// settings returns the values of all flags as they would be upon a restart:
+// given on the command line, set by the configuration file, or default.
+func (r *configReloader) settings() (map[string]string, error) {
+	var fileValues map[string]string
+	if r.configFile != "" {
+		config, err := serverconfig.Load(r.configFile)
+		if err != nil {
+			return nil, err
+		}
+		fileValues = config.Flags()
+	}
+	values := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		if r.commandLine[f.Name] {
+			values[f.Name] = f.Value.String()
+		} else if value, ok := fileValues[f.Name]; ok {
+			values[f.Name] = value
+		} else {
+			values[f.Name] = f.DefValue
+		}
+	})
+	return values, nil
+}
+
+// checkFlags checks the values of the flags (possibly set by a configuration
+// file) without opening any files except for the secrets, and returns an
+// error that lists all problems.
+func checkFlags() error {
+	value := func(name string) string {
+		return flag.Lookup(name).Value.String()
+	}
+	var problems []string
+	if value("filechannel_root_dir") == "" && value("webhook_urls") == "" {
+		problems = append(problems, "please provide -filechannel_root_dir and/or -webhook_urls")
+	}
+	switch {
+	case value("bolt_share_store_file") == "" && value("sqlite_share_store_file") == "":
+		problems = append(problems, "please provide -bolt_share_store_file or -sqlite_share_store_file")
+	case value("bolt_share_store_file") != "" && value("sqlite_share_store_file") != "":
+		problems = append(problems, "-bolt_share_store_file and -sqlite_share_store_file are mutually exclusive")
+	}
+	if d, err := time.ParseDuration(value("share_expiry_default")); err != nil || d < 0 {
+		problems = append(problems, "-share_expiry_default must not be negative")
+	} else if max, err := time.ParseDuration(value("share_expiry_max")); err != nil || max < 0 {
+		problems = append(problems, "-share_expiry_max must not be negative")
+	} else if max > 0 && d > max {
+		problems = append(problems, "-share_expiry_default must not exceed -share_expiry_max")
+	}
+	if d, err := time.ParseDuration(value("deletion_grace_period")); err != nil || d < 0 {
+		problems = append(problems, "-deletion_grace_period must not be negative")
+	}
+	if d, err := time.ParseDuration(value("deletion_purge_interval")); err != nil || d <= 0 {
+		problems = append(problems, "-deletion_purge_interval must be positive")
+	}
+	if d, err := time.ParseDuration(value("audit_log_head_interval")); err != nil || d < 0 {
+		problems = append(problems, "-audit_log_head_interval must not be negative")
+	}
+	for _, name := range []string{"share_store_max_size", "max_shares_per_owner", "max_share_size", "max_request_size"} {
+		if n, err := strconv.ParseInt(value(name), 10, 64); err != nil || n < 0 {
+			problems = append(problems, "-"+name+" must not be negative")
+		}
+	}
+	if shareSize, _ := strconv.ParseInt(value("max_share_size"), 10, 64); shareSize > 0 {
+		if requestSize, _ := strconv.ParseInt(value("max_request_size"), 10, 64); requestSize > 0 && shareSize > requestSize {
+			problems = append(problems, "-max_share_size must not exceed -max_request_size")
+		}
+	}
+	if (value("tls_key_file") == "") != (value("tls_cert_file") == "") {
+		problems = append(problems, "-tls_key_file and -tls_cert_file must be given together")
+	} else if value("tls_key_file") != "" {
+		if _, err := tls.LoadX509KeyPair(value("tls_cert_file"), value("tls_key_file")); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid TLS key pair: %v", err))
+		}
+	}
+	if value("admin_api_addr") != "" {
+		if value("admin_api_tls_cert_file") == "" || value("admin_api_tls_key_file") == "" {
+			problems = append(problems, "please provide -admin_api_tls_cert_file and -admin_api_tls_key_file")
+		} else if _, err := tls.LoadX509KeyPair(value("admin_api_tls_cert_file"), value("admin_api_tls_key_file")); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid admin API TLS key pair: %v", err))
+		}
+		if value("admin_api_client_ca_file") == "" {
+			problems = append(problems, "please provide -admin_api_client_ca_file")
+		} else if _, err := adminapi.LoadCertPool(value("admin_api_client_ca_file")); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid -admin_api_client_ca_file: %v", err))
+		}
+		if roles, err := adminapi.ParseRoleMap(value("admin_api_roles")); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid -admin_api_roles: %v", err))
+		} else if len(roles) == 0 {
+			problems = append(problems, "please provide -admin_api_roles")
+		}
+		if value("admin_api_snapshots") == "true" && value("bolt_share_store_file") == "" {
+			problems = append(problems, "-admin_api_snapshots requires -bolt_share_store_file")
+		}
+		if keyFile := value("admin_api_snapshot_public_key_file"); keyFile != "" {
+			if value("admin_api_snapshots") != "true" {
+				problems = append(problems, "-admin_api_snapshot_public_key_file requires -admin_api_snapshots")
+			} else if _, err := newSnapshotWriter(nil, keyFile); err != nil {
+				problems = append(problems, fmt.Sprintf("invalid -admin_api_snapshot_public_key_file: %v", err))
+			}
+		}
+	}
+	if value("translog_file") != "" && value("translog_key_file") == "" {
+		problems = append(problems, "please provide -translog_key_file")
+	}
+	if value("rate_limit_file") != "" && value("rate_limit_key_file") == "" {
+		problems = append(problems, "please provide -rate_limit_key_file")
+	}
+	if value("outbox_file") != "" && value("outbox_key_file") == "" {
+		problems = append(problems, "please provide -outbox_key_file")
+	}
+	if value("webhook_urls") != "" && value("webhook_key_file") == "" {
+		problems = append(problems, "please provide -webhook_key_file")
+	}
+	for _, name := range []string{"recipient_rate_limit", "subnet_rate_limit", "global_rate_limit", "delivery_status_rate_limit"} {
+		if _, err := ratelimit.ParsePolicy(value(name)); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid -%s: %v", name, err))
+		}
+	}
+	if _, err := logging.ParseLevel(value("log_level")); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid -log_level: %v", err))
+	}
+	if format := value("log_format"); format != "text" && format != "json" {
+		problems = append(problems, fmt.Sprintf("invalid -log_format: %v", logging.ErrInvalidFormat))
+	}
+	for _, name := range []string{"webhook_key_file", "pow_key_file", "audit_log_key_file", "translog_key_file", "log_hash_key_file", "rate_limit_key_file",
+		"share_expiry_key_file", "outbox_key_file", "owner_index_key_file"} {
+		if source := value(name); source != "" {
+			if _, err := util.ReadSecret(source); err != nil {
+				problems = append(problems, fmt.Sprintf("invalid -%s: %v", name, err))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// newChannelRouter returns a channelrouter.Router with the secondary channels
+// enabled by the given flag values.
+func newChannelRouter(filechannelRootDir string, filechannelMaxFileSize int64, webhookURLs, webhookKeyFile string, webhookMaxRetries int,
+	ownerIDTypeAliases, fallbackOwnerIDType string, templates *msgtemplate.Set) (*channelrouter.Router, error) {
+	router := channelrouter.New()
+	if filechannelRootDir != "" {
+		fileChannel := filechannel.NewChannelWithConfig(filechannelRootDir,
+			filechannel.Config{MaxFileSize: filechannelMaxFileSize, Templates: templates})
+		if err := router.Register("FILE", fileChannel); err != nil {
+			return nil, err
+		}
+	}
+	urls, err := parseKeyValueList(webhookURLs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -webhook_urls: %v", err)
+	}
+	if len(urls) > 0 {
+		if webhookKeyFile == "" {
+			return nil, fmt.Errorf("missing -webhook_key_file")
+		}
+		key, err := util.ReadSecret(webhookKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		webhook, err := webhookchannel.NewChannel(webhookchannel.Config{
+			URLs:       urls,
+			Key:        []byte(strings.TrimSpace(string(key))),
+			MaxRetries: webhookMaxRetries,
+			Templates:  templates,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, idType := range webhook.SupportedOwnerIDTypes() {
+			if err := router.Register(idType, webhook); err != nil {
+				return nil, fmt.Errorf("could not register webhook for [%s]: %v", idType, err)
+			}
+		}
+	}
+	aliases, err := parseKeyValueList(ownerIDTypeAliases)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -owner_id_type_aliases: %v", err)
+	}
+	for alias, idType := range aliases {
+		if err := router.RegisterAlias(alias, idType); err != nil {
+			return nil, fmt.Errorf("could not register alias [%s] of [%s]: %v", alias, idType, err)
+		}
+	}
+	if err := router.SetFallback(fallbackOwnerIDType); err != nil {
+		return nil, fmt.Errorf("could not set fallback owner id type [%s]: %v", fallbackOwnerIDType, err)
+	}
+	return router, nil
+}
+
+// rateLimitFlushInterval is the interval of saving the rate limits, if they
+// are persisted.
+const rateLimitFlushInterval = time.Minute
+
+// newAdminAPIServer returns an http.Server for the admin API at 'addr', which
+// requires client certificates issued by the CAs in 'clientCAFile', and
+// authorizes the clients according to 'roles'.  It also returns the reloader
+// of the certificate of the server.
+func newAdminAPIServer(addr, certFile, keyFile, clientCAFile, roles string, timeouts serverTimeouts,
+	config adminapi.Config) (*http.Server, *certreloader.Reloader, error) {
+	var err error
+	if config.Roles, err = adminapi.ParseRoleMap(roles); err != nil {
+		return nil, nil, err
+	}
+	api, err := adminapi.New(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientCAs, err := adminapi.LoadCertPool(clientCAFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	certs, err := certreloader.New(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	certs.Watch(certreloader.DefaultPollInterval)
+	server := newHTTPServer(addr, api, timeouts)
+	server.TLSConfig = adminapi.TLSConfig(certs.GetCertificate, clientCAs)
+	return server, certs, nil
+}
+
+// closableShareStore is a share store that supports the admin API and
+// limits the shares that can be stored.
+type closableShareStore interface {
+	svalbardsrv.ShareStore
+	adminapi.ShareStore
+	SetMaxSharesPerOwner(n int)
+	SetMaxSize(bytes int64)
+	Close() error
+}
+
+// openShareStore opens the share store in 'boltFile' or in 'sqliteFile',
+// whichever is set.
+func openShareStore(boltFile, sqliteFile string) (closableShareStore, error) {
+	if sqliteFile != "" {
+		s, err := sqlitesharestore.OpenOrCreate(sqliteFile)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	s, err := boltsharestore.OpenOrCreate(boltFile)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newSnapshotWriter returns a writer of snapshots of 'shareStore', which
+// are encrypted to the key in 'publicKeyFile' unless it is empty.
+func newSnapshotWriter(shareStore *boltsharestore.Bolt, publicKeyFile string) (*snapshot.Writer, error) {
+	w := &snapshot.Writer{Store: shareStore}
+	if publicKeyFile != "" {
+		pemBytes, err := ioutil.ReadFile(publicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if w.PublicKey, err = snapshot.ParsePublicKey(pemBytes); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// rateLimitConfig returns the ratelimit.Config with the limits given by
+// the flag values.
+func rateLimitConfig(recipientRateLimit, subnetRateLimit, globalRateLimit string) (ratelimit.Config, error) {
+	var config ratelimit.Config
+	var err error
+	if config.PerRecipient, err = ratelimit.ParsePolicy(recipientRateLimit); err != nil {
+		return config, fmt.Errorf("invalid -recipient_rate_limit: %v", err)
+	}
+	if config.PerSubnet, err = ratelimit.ParsePolicy(subnetRateLimit); err != nil {
+		return config, fmt.Errorf("invalid -subnet_rate_limit: %v", err)
+	}
+	if config.Global, err = ratelimit.ParsePolicy(globalRateLimit); err != nil {
+		return config, fmt.Errorf("invalid -global_rate_limit: %v", err)
+	}
+	return config, nil
+}
+
+// newRateLimiter returns a ratelimit.Limiter with the limits given by the flag
+// values.  If 'rateLimitFile' is set, the limits are persisted in that file,
+// with the bucket keys derived with the key in 'rateLimitKeyFile', and it
+// also returns a function that saves the limits and closes the file.
+func newRateLimiter(recipientRateLimit, subnetRateLimit, globalRateLimit, rateLimitFile, rateLimitKeyFile string) (*ratelimit.Limiter, func() error, error) {
+	config, err := rateLimitConfig(recipientRateLimit, subnetRateLimit, globalRateLimit)
+	if err != nil {
+		return nil, nil, err
+	}
+	var key []byte
+	if rateLimitKeyFile != "" {
+		if key, err = util.ReadSecret(rateLimitKeyFile); err != nil {
+			return nil, nil, fmt.Errorf("could not read -rate_limit_key_file: %v", err)
+		}
+	}
+	if rateLimitFile == "" {
+		limiter, err := ratelimit.New(config, key, nil)
+		return limiter, nil, err
+	}
+	store, err := boltratelimitstore.OpenOrCreate(rateLimitFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	limiter, err := ratelimit.New(config, key, store)
+	if err != nil {
+		store.Close()
+		return nil, nil, err
+	}
+	ticker := time.NewTicker(rateLimitFlushInterval)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				if err := limiter.Flush(); err != nil {
+					slog.Error("could not save rate limits", "error", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	closeLimiter := func() error {
+		ticker.Stop()
+		close(stop)
+		<-stopped
+		err := limiter.Flush()
+		if cErr := store.Close(); err == nil {
+			err = cErr
+		}
+		return err
+	}
+	return limiter, closeLimiter, nil
+}
+
+// startPurger starts purging the deleted shares of 'shareStore' whose grace
+// period is over, every 'interval'.  It returns a function that stops it.
+func startPurger(shareStore svalbardsrv.RecoverableShareStore, interval time.Duration) func() error {
+	ticker := time.NewTicker(interval)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				if n, err := shareStore.Purge(time.Now()); err != nil {
+					slog.Error("could not purge deleted shares", "error", err)
+				} else if n > 0 {
+					slog.Info("purged deleted shares", "shares", n)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() error {
+		ticker.Stop()
+		close(stop)
+		<-stopped
+		return nil
+	}
+}
+
+// newChallengeGuard returns a pow.Guard configured by the given flag values,
+// which signs the challenges with the key stored in 'keyFile'.
+func newChallengeGuard(keyFile string, difficulty, maxDifficulty, loadThreshold, recipientThreshold int) (*pow.Guard, error) {
+	key, err := util.ReadSecret(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return pow.NewGuard(pow.Config{
+		Key:                key,
+		Difficulty:         difficulty,
+		MaxDifficulty:      maxDifficulty,
+		LoadThreshold:      loadThreshold,
+		RecipientThreshold: recipientThreshold,
+	})
+}
+
+// newAuditLog opens the audit log in 'filename', whose hashes are keyed
+// with the key stored in 'keyFile' (if set).  The head of the log is logged
+// every 'headInterval' (if positive) and when the log is closed, so that it
+// can be exported.
+func newAuditLog(filename, keyFile string, headInterval time.Duration) (*auditlog.Log, error) {
+	config := auditlog.Config{
+		ExportHead: func(head auditlog.Head) {
+			slog.Info("audit log head", "file", filename, "head", head.String())
+		},
+		ExportInterval: headInterval,
+	}
+	if keyFile != "" {
+		key, err := util.ReadSecret(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Key = key
+	}
+	return auditlog.Open(filename, config)
+}
+
+// newLogger returns a logger that writes redacted messages of at least
+// 'level' in 'format' to stderr, and the variable that holds the level.
+// If 'hashKeyFile' is set, owner ids are hashed with the key stored in
+// that file.
+func newLogger(level, format, hashKeyFile string) (*slog.Logger, *slog.LevelVar, error) {
+	levelVar := new(slog.LevelVar)
+	config := logging.Config{Level: levelVar, Format: format}
+	parsedLevel, err := logging.ParseLevel(level)
+	if err != nil {
+		return nil, nil, err
+	}
+	levelVar.Set(parsedLevel)
+	if hashKeyFile != "" {
+		if config.OwnerIDKey, err = util.ReadSecret(hashKeyFile); err != nil {
+			return nil, nil, err
+		}
 	}
+	logger, err := logging.New(os.Stderr, config)
+	return logger, levelVar, err
 }
@@ -0,0 +1,725 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Package serverconfig implements the versioned JSON configuration file of
+// the Svalbard server.  The configuration is mapped to the flags of the
+// server, so that flags given on the command line can override the file.
+//
+// An example of a configuration file:
+//
+//	{
+//	  "version": 1,
+//	  "listeners": {
+//	    "public": {"port": "8443", "tls": {"cert_file": "cert.pem", "key_file": "key.pem"}},
+//	    "admin": {"address": "localhost:9090"},
+//	    "admin_api": {
+//	      "address": ":9443",
+//	      "tls": {"cert_file": "admin_cert.pem", "key_file": "admin_key.pem"},
+//	      "client_ca_file": "operators_ca.pem",
+//	      "roles": {"OU:sre": "operator", "CN:dashboard": "viewer"},
+//	      "snapshots": {"public_key_file": "snapshot_pub.pem"}
+//	    }
+//	  },
+//	  "share_store": {
+//	    "backend": "bolt", "path": "/var/lib/svalbard/shares.db",
+//	    "expiry": {"default": "8760h", "max": "87600h", "reminder": "720h"},
+//	    "deletion": {"grace_period": "720h"}
+//	  },
+//	  "tokens": {"validity": "5m"},
+//	  "limits": {"max_share_size": 16384, "max_shares_per_owner": 20},
+//	  "channels": {
+//	    "webhooks": {"urls": {"SMS": "https://sms.example.com/hook"}, "key": {"env": "WEBHOOK_KEY"}}
+//	  },
+//	  "rate_limits": {"recipient": "10/1h"},
+//	  "logging": {"level": "info", "format": "json"}
+//	}
+package serverconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/svalbard/server/go/adminapi"
+	"github.com/google/svalbard/server/go/logging"
+	"github.com/google/svalbard/server/go/ratelimit"
+)
+
+// CurrentVersion is the version of the configuration format.
+const CurrentVersion = 1
+
+// Share store backends.
+var shareStoreBackends = []string{"bolt", "sqlite"}
+
+// Errors returned upon failures.
+var (
+	ErrMissingVersion     = errors.New("missing version")
+	ErrUnsupportedVersion = errors.New("unsupported version")
+)
+
+// Config is the configuration of a server.  Fields that are not set
+// (zero values or nil) leave the defaults of the server unchanged.
+type Config struct {
+	Version         int                   `json:"version"`
+	Listeners       ListenersConfig       `json:"listeners"`
+	Timeouts        TimeoutsConfig        `json:"timeouts"`
+	ShareStore      ShareStoreConfig      `json:"share_store"`
+	Tokens          TokensConfig          `json:"tokens"`
+	Limits          LimitsConfig          `json:"limits"`
+	Channels        ChannelsConfig        `json:"channels"`
+	RateLimits      RateLimitsConfig      `json:"rate_limits"`
+	ProofOfWork     ProofOfWorkConfig     `json:"proof_of_work"`
+	AuditLog        AuditLogConfig        `json:"audit_log"`
+	TransparencyLog TransparencyLogConfig `json:"transparency_log"`
+	Logging         LoggingConfig         `json:"logging"`
+}
+
+// ListenersConfig configures the listeners of the server.
+type ListenersConfig struct {
+	Public   PublicListenerConfig    `json:"public"`
+	Admin    AdminListenerConfig     `json:"admin"`
+	AdminAPI *AdminAPIListenerConfig `json:"admin_api"`
+}
+
+// PublicListenerConfig configures the listener for the clients.
+type PublicListenerConfig struct {
+	Port string     `json:"port"`
+	TLS  *TLSConfig `json:"tls"`
+}
+
+// TLSConfig configures TLS of a listener.
+type TLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// AdminListenerConfig configures the admin listener.
+type AdminListenerConfig struct {
+	Address string `json:"address"`
+}
+
+// AdminAPIListenerConfig configures the listener of the admin API, which
+// requires client certificates issued by the CA in ClientCAFile.
+type AdminAPIListenerConfig struct {
+	Address      string     `json:"address"`
+	TLS          *TLSConfig `json:"tls"`
+	ClientCAFile string     `json:"client_ca_file"`
+	// Roles maps attributes of the subjects of client certificates, e.g.
+	// "OU:sre" or "CN:dashboard", to roles ("viewer" or "operator").
+	Roles map[string]string `json:"roles"`
+	// Snapshots (optional) enables snapshots of the share store.
+	Snapshots *SnapshotsConfig `json:"snapshots"`
+}
+
+// SnapshotsConfig configures the snapshots of the share store served by
+// the admin API.
+type SnapshotsConfig struct {
+	// PublicKeyFile (optional) is the RSA public key of the operators to
+	// encrypt the snapshots to.
+	PublicKeyFile string `json:"public_key_file"`
+}
+
+// TimeoutsConfig configures the timeouts of the listeners.
+type TimeoutsConfig struct {
+	Read     Duration `json:"read"`
+	Write    Duration `json:"write"`
+	Idle     Duration `json:"idle"`
+	Shutdown Duration `json:"shutdown"`
+}
+
+// ShareStoreConfig configures the share store.
+type ShareStoreConfig struct {
+	// Backend is the kind of the store, "bolt" (the default) or "sqlite".
+	Backend  string          `json:"backend"`
+	Path     string          `json:"path"`
+	Expiry   *ExpiryConfig   `json:"expiry"`
+	Deletion *DeletionConfig `json:"deletion"`
+	// OwnerIndexKey keys the index of the shares by their owners, which
+	// enforces limits.max_shares_per_owner only if it is set.
+	OwnerIndexKey *Secret `json:"owner_index_key"`
+}
+
+// ExpiryConfig configures the expiry of the shares.
+type ExpiryConfig struct {
+	// Default and Max are the default and the maximal periods after which
+	// shares expire unless renewed.
+	Default Duration `json:"default"`
+	Max     Duration `json:"max"`
+	// Reminder is the time before the expiry when the owners are reminded,
+	// negative to disable the reminders.
+	Reminder     Duration `json:"reminder"`
+	ReapInterval Duration `json:"reap_interval"`
+	// Key encrypts the owners of the shares, which are reminded only if
+	// it is set.
+	Key *Secret `json:"key"`
+}
+
+// DeletionConfig configures how long deleted shares can be undeleted.
+type DeletionConfig struct {
+	// GracePeriod is how long deleted shares are kept for undeletion,
+	// zero to delete them immediately.
+	GracePeriod   *Duration `json:"grace_period"`
+	PurgeInterval Duration  `json:"purge_interval"`
+}
+
+// TokensConfig configures the tokens.
+type TokensConfig struct {
+	Validity  Duration `json:"validity"`
+	MaxTokens int      `json:"max_tokens"`
+}
+
+// LimitsConfig configures the limits of the requests and of the stored
+// shares.  A limit of zero disables the limit.
+type LimitsConfig struct {
+	// MaxRequestSize and MaxShareSize are the maximal sizes in bytes of the
+	// bodies of requests and of share values, respectively.
+	MaxRequestSize    *int `json:"max_request_size"`
+	MaxShareSize      *int `json:"max_share_size"`
+	MaxSharesPerOwner *int `json:"max_shares_per_owner"`
+	// MaxStoreSize is the maximal size in bytes of the data in the share
+	// store.
+	MaxStoreSize int64 `json:"max_store_size"`
+}
+
+// ChannelsConfig configures the secondary channels.
+type ChannelsConfig struct {
+	File     *FileChannelConfig     `json:"file"`
+	Webhooks *WebhookChannelsConfig `json:"webhooks"`
+	// Aliases maps aliases to owner id types.
+	Aliases      map[string]string `json:"aliases"`
+	Fallback     string            `json:"fallback"`
+	TemplatesDir string            `json:"templates_dir"`
+	Outbox       *OutboxConfig     `json:"outbox"`
+}
+
+// FileChannelConfig configures the file-based channel.
+type FileChannelConfig struct {
+	RootDir     string `json:"root_dir"`
+	MaxFileSize int64  `json:"max_file_size"`
+}
+
+// WebhookChannelsConfig configures the webhook channels.
+type WebhookChannelsConfig struct {
+	// URLs maps owner id types to the URLs of their webhooks.
+	URLs       map[string]string `json:"urls"`
+	Key        *Secret           `json:"key"`
+	MaxRetries *int              `json:"max_retries"`
+}
+
+// OutboxConfig configures the asynchronous delivery of the messages.
+type OutboxConfig struct {
+	Path        string  `json:"path"`
+	Key         *Secret `json:"key"`
+	MaxAttempts int     `json:"max_attempts"`
+}
+
+// RateLimitsConfig configures the rate limits, each given as <n>/<duration>,
+// or "0" to disable it.
+type RateLimitsConfig struct {
+	Recipient      string  `json:"recipient"`
+	Subnet         string  `json:"subnet"`
+	Global         string  `json:"global"`
+	DeliveryStatus string  `json:"delivery_status"`
+	Path           string  `json:"path"`
+	Key            *Secret `json:"key"`
+}
+
+// ProofOfWorkConfig configures the proof-of-work challenges.
+type ProofOfWorkConfig struct {
+	Key                *Secret `json:"key"`
+	Difficulty         int     `json:"difficulty"`
+	MaxDifficulty      int     `json:"max_difficulty"`
+	LoadThreshold      *int    `json:"load_threshold"`
+	RecipientThreshold *int    `json:"recipient_threshold"`
+}
+
+// AuditLogConfig configures the audit log.
+type AuditLogConfig struct {
+	Path         string   `json:"path"`
+	Key          *Secret  `json:"key"`
+	HeadInterval Duration `json:"head_interval"`
+}
+
+// TransparencyLogConfig configures the transparency log.
+type TransparencyLogConfig struct {
+	Path string  `json:"path"`
+	Key  *Secret `json:"key"`
+}
+
+// LoggingConfig configures the logging.
+type LoggingConfig struct {
+	Level   string  `json:"level"`
+	Format  string  `json:"format"`
+	HashKey *Secret `json:"hash_key"`
+}
+
+// Secret is a credential read from a file or from an environment variable.
+// Exactly one of the fields must be set.
+type Secret struct {
+	File string `json:"file"`
+	Env  string `json:"env"`
+}
+
+// Source returns the source of the secret in the form accepted by the key
+// file flags of the server: the name of the file, or "env:" followed by
+// the name of the environment variable.
+func (s *Secret) Source() string {
+	if s.Env != "" {
+		return "env:" + s.Env
+	}
+	return s.File
+}
+
+// Duration is a time.Duration given as a string like "1m30s".
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration given as a string.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("invalid duration %s, want a string like \"1m30s\"", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q, want a string like \"1m30s\"", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON formats a duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ValidationError lists the problems found in a configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// Load reads, parses and validates the configuration in 'filename'.
+func Load(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return config, nil
+}
+
+// Parse parses and validates the configuration in 'data'.  Unknown fields
+// are rejected, so that misspelled settings are not ignored silently.
+func Parse(data []byte) (*Config, error) {
+	// Check the version first, as other versions may have other fields.
+	var versioned struct {
+		Version *int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &versioned); err != nil {
+		return nil, describeJSONError(data, err)
+	}
+	if versioned.Version == nil {
+		return nil, ErrMissingVersion
+	}
+	if *versioned.Version != CurrentVersion {
+		return nil, fmt.Errorf("%v %d, want %d", ErrUnsupportedVersion, *versioned.Version, CurrentVersion)
+	}
+	var config Config
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, describeJSONError(data, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// describeJSONError returns 'err' of parsing 'data', with the line and
+// column of the error if known.
+func describeJSONError(data []byte, err error) error {
+	var offset int64 = -1
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+		err = fmt.Errorf("invalid value for %s: got %s, want %v", e.Field, e.Value, e.Type)
+	}
+	if offset < 0 {
+		return err
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	line := 1 + bytes.Count(data[:offset], []byte("\n"))
+	column := int(offset) - bytes.LastIndex(data[:offset], []byte("\n"))
+	return fmt.Errorf("line %d, column %d: %v", line, column-1, err)
+}
+
+// Validate checks the configuration for invalid or inconsistent settings,
+// and returns a *ValidationError that lists all problems.
+func (c *Config) Validate() error {
+	var problems []string
+	problem := func(field, format string, args ...interface{}) {
+		problems = append(problems, field+": "+fmt.Sprintf(format, args...))
+	}
+	if c.Version != CurrentVersion {
+		problem("version", "got %d, want %d", c.Version, CurrentVersion)
+	}
+	if port := c.Listeners.Public.Port; port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			problem("listeners.public.port", "invalid port %q", port)
+		}
+	}
+	if tls := c.Listeners.Public.TLS; tls != nil && (tls.CertFile == "" || tls.KeyFile == "") {
+		problem("listeners.public.tls", "both cert_file and key_file are required")
+	}
+	if api := c.Listeners.AdminAPI; api != nil {
+		if api.Address == "" {
+			problem("listeners.admin_api.address", "missing")
+		}
+		if api.TLS == nil || api.TLS.CertFile == "" || api.TLS.KeyFile == "" {
+			problem("listeners.admin_api.tls", "both cert_file and key_file are required")
+		}
+		if api.ClientCAFile == "" {
+			problem("listeners.admin_api.client_ca_file", "missing")
+		}
+		if len(api.Roles) == 0 {
+			problem("listeners.admin_api.roles", "missing")
+		} else if _, err := adminapi.ParseRoleMap(keyValueList(api.Roles)); err != nil {
+			problem("listeners.admin_api.roles", "%v", err)
+		}
+	}
+	for field, d := range map[string]Duration{
+		"timeouts.read": c.Timeouts.Read, "timeouts.write": c.Timeouts.Write,
+		"timeouts.idle": c.Timeouts.Idle, "timeouts.shutdown": c.Timeouts.Shutdown,
+		"tokens.validity": c.Tokens.Validity,
+	} {
+		if d < 0 {
+			problem(field, "must not be negative")
+		}
+	}
+	if c.ShareStore.Backend != "" && !contains(shareStoreBackends, c.ShareStore.Backend) {
+		problem("share_store.backend", "unknown backend %q, want one of %s",
+			c.ShareStore.Backend, strings.Join(shareStoreBackends, ", "))
+	}
+	if expiry := c.ShareStore.Expiry; expiry != nil {
+		for field, d := range map[string]Duration{
+			"share_store.expiry.default": expiry.Default, "share_store.expiry.max": expiry.Max,
+			"share_store.expiry.reap_interval": expiry.ReapInterval,
+		} {
+			if d < 0 {
+				problem(field, "must not be negative")
+			}
+		}
+		if expiry.Max > 0 && expiry.Default > expiry.Max {
+			problem("share_store.expiry", "default %v exceeds max %v", time.Duration(expiry.Default), time.Duration(expiry.Max))
+		}
+		validateSecret("share_store.expiry.key", expiry.Key, problem)
+	}
+	validateSecret("share_store.owner_index_key", c.ShareStore.OwnerIndexKey, problem)
+	if deletion := c.ShareStore.Deletion; deletion != nil {
+		if deletion.GracePeriod != nil && *deletion.GracePeriod < 0 {
+			problem("share_store.deletion.grace_period", "must not be negative")
+		}
+		if deletion.PurgeInterval < 0 {
+			problem("share_store.deletion.purge_interval", "must not be negative")
+		}
+	}
+	if c.Tokens.MaxTokens < 0 {
+		problem("tokens.max_tokens", "must not be negative")
+	}
+	limits := c.Limits
+	for field, n := range map[string]*int{
+		"limits.max_request_size": limits.MaxRequestSize, "limits.max_share_size": limits.MaxShareSize,
+		"limits.max_shares_per_owner": limits.MaxSharesPerOwner,
+	} {
+		if n != nil && *n < 0 {
+			problem(field, "must not be negative")
+		}
+	}
+	if limits.MaxStoreSize < 0 {
+		problem("limits.max_store_size", "must not be negative")
+	}
+	if limits.MaxRequestSize != nil && *limits.MaxRequestSize > 0 && limits.MaxShareSize != nil && *limits.MaxShareSize > *limits.MaxRequestSize {
+		problem("limits", "max_share_size %d exceeds max_request_size %d", *limits.MaxShareSize, *limits.MaxRequestSize)
+	}
+	if file := c.Channels.File; file != nil {
+		if file.RootDir == "" {
+			problem("channels.file.root_dir", "missing")
+		}
+		if file.MaxFileSize < 0 {
+			problem("channels.file.max_file_size", "must not be negative")
+		}
+	}
+	if hooks := c.Channels.Webhooks; hooks != nil {
+		if len(hooks.URLs) == 0 {
+			problem("channels.webhooks.urls", "missing")
+		}
+		for _, idType := range sortedKeys(hooks.URLs) {
+			if idType == "" || hooks.URLs[idType] == "" || strings.ContainsAny(idType+hooks.URLs[idType], ",=") {
+				problem("channels.webhooks.urls", "invalid entry %q: %q", idType, hooks.URLs[idType])
+			}
+		}
+		if hooks.Key == nil {
+			problem("channels.webhooks.key", "missing")
+		}
+		validateSecret("channels.webhooks.key", hooks.Key, problem)
+		if hooks.MaxRetries != nil && *hooks.MaxRetries < 0 {
+			problem("channels.webhooks.max_retries", "must not be negative")
+		}
+	}
+	for _, alias := range sortedKeys(c.Channels.Aliases) {
+		if alias == "" || c.Channels.Aliases[alias] == "" || strings.ContainsAny(alias+c.Channels.Aliases[alias], ",=") {
+			problem("channels.aliases", "invalid alias %q of %q", alias, c.Channels.Aliases[alias])
+		}
+	}
+	if outbox := c.Channels.Outbox; outbox != nil {
+		if outbox.Path == "" {
+			problem("channels.outbox.path", "missing")
+		}
+		if outbox.Key == nil {
+			problem("channels.outbox.key", "missing")
+		}
+		validateSecret("channels.outbox.key", outbox.Key, problem)
+		if outbox.MaxAttempts < 0 {
+			problem("channels.outbox.max_attempts", "must not be negative")
+		}
+	}
+	for field, policy := range map[string]string{
+		"rate_limits.recipient": c.RateLimits.Recipient, "rate_limits.subnet": c.RateLimits.Subnet,
+		"rate_limits.global": c.RateLimits.Global, "rate_limits.delivery_status": c.RateLimits.DeliveryStatus,
+	} {
+		if policy == "" {
+			continue
+		}
+		if _, err := ratelimit.ParsePolicy(policy); err != nil {
+			problem(field, "%v, want <n>/<duration> or 0", err)
+		}
+	}
+	if c.RateLimits.Path != "" && c.RateLimits.Key == nil {
+		problem("rate_limits.key", "missing")
+	}
+	validateSecret("rate_limits.key", c.RateLimits.Key, problem)
+	pow := c.ProofOfWork
+	validateSecret("proof_of_work.key", pow.Key, problem)
+	if pow.Difficulty < 0 || pow.MaxDifficulty < 0 {
+		problem("proof_of_work", "difficulties must not be negative")
+	}
+	if pow.Difficulty > 0 && pow.MaxDifficulty > 0 && pow.Difficulty > pow.MaxDifficulty {
+		problem("proof_of_work", "difficulty %d exceeds max_difficulty %d", pow.Difficulty, pow.MaxDifficulty)
+	}
+	if (pow.LoadThreshold != nil && *pow.LoadThreshold < 0) || (pow.RecipientThreshold != nil && *pow.RecipientThreshold < 0) {
+		problem("proof_of_work", "thresholds must not be negative")
+	}
+	if c.AuditLog.Key != nil && c.AuditLog.Path == "" {
+		problem("audit_log.path", "missing")
+	}
+	validateSecret("audit_log.key", c.AuditLog.Key, problem)
+	if c.AuditLog.HeadInterval < 0 {
+		problem("audit_log.head_interval", "must not be negative")
+	}
+	if c.TransparencyLog.Path != "" && c.TransparencyLog.Key == nil {
+		problem("transparency_log.key", "missing")
+	}
+	validateSecret("transparency_log.key", c.TransparencyLog.Key, problem)
+	if c.Logging.Level != "" {
+		if _, err := logging.ParseLevel(c.Logging.Level); err != nil {
+			problem("logging.level", "%v %q, want debug, info, warn or error", err, c.Logging.Level)
+		}
+	}
+	if c.Logging.Format != "" && c.Logging.Format != "text" && c.Logging.Format != "json" {
+		problem("logging.format", "%v %q, want text or json", logging.ErrInvalidFormat, c.Logging.Format)
+	}
+	validateSecret("logging.hash_key", c.Logging.HashKey, problem)
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return &ValidationError{problems}
+	}
+	return nil
+}
+
+// validateSecret checks that exactly one source of 'secret' (if any) is set.
+func validateSecret(field string, secret *Secret, problem func(field, format string, args ...interface{})) {
+	if secret == nil {
+		return
+	}
+	if (secret.File == "") == (secret.Env == "") {
+		problem(field, "exactly one of file and env is required")
+	}
+}
+
+// Flags returns the values of the flags of the server that correspond to
+// the settings of the configuration, keyed by the names of the flags.
+// Settings that are not set are omitted.
+func (c *Config) Flags() map[string]string {
+	flags := make(map[string]string)
+	set := func(name, value string) {
+		if value != "" {
+			flags[name] = value
+		}
+	}
+	setInt := func(name string, value int64) {
+		if value != 0 {
+			flags[name] = strconv.FormatInt(value, 10)
+		}
+	}
+	setIntPtr := func(name string, value *int) {
+		if value != nil {
+			flags[name] = strconv.Itoa(*value)
+		}
+	}
+	setDuration := func(name string, value Duration) {
+		if value != 0 {
+			flags[name] = time.Duration(value).String()
+		}
+	}
+	setDurationPtr := func(name string, value *Duration) {
+		if value != nil {
+			flags[name] = time.Duration(*value).String()
+		}
+	}
+	setSecret := func(name string, secret *Secret) {
+		if secret != nil {
+			flags[name] = secret.Source()
+		}
+	}
+	set("port", c.Listeners.Public.Port)
+	if tls := c.Listeners.Public.TLS; tls != nil {
+		set("tls_cert_file", tls.CertFile)
+		set("tls_key_file", tls.KeyFile)
+	}
+	set("admin_addr", c.Listeners.Admin.Address)
+	if api := c.Listeners.AdminAPI; api != nil {
+		set("admin_api_addr", api.Address)
+		if api.TLS != nil {
+			set("admin_api_tls_cert_file", api.TLS.CertFile)
+			set("admin_api_tls_key_file", api.TLS.KeyFile)
+		}
+		set("admin_api_client_ca_file", api.ClientCAFile)
+		set("admin_api_roles", keyValueList(api.Roles))
+		if api.Snapshots != nil {
+			set("admin_api_snapshots", "true")
+			set("admin_api_snapshot_public_key_file", api.Snapshots.PublicKeyFile)
+		}
+	}
+	setDuration("read_timeout", c.Timeouts.Read)
+	setDuration("write_timeout", c.Timeouts.Write)
+	setDuration("idle_timeout", c.Timeouts.Idle)
+	setDuration("shutdown_timeout", c.Timeouts.Shutdown)
+	if c.ShareStore.Backend == "sqlite" {
+		set("sqlite_share_store_file", c.ShareStore.Path)
+	} else {
+		set("bolt_share_store_file", c.ShareStore.Path)
+	}
+	if expiry := c.ShareStore.Expiry; expiry != nil {
+		setDuration("share_expiry_default", expiry.Default)
+		setDuration("share_expiry_max", expiry.Max)
+		setDuration("share_expiry_reminder", expiry.Reminder)
+		setDuration("share_expiry_reap_interval", expiry.ReapInterval)
+		setSecret("share_expiry_key_file", expiry.Key)
+	}
+	setSecret("owner_index_key_file", c.ShareStore.OwnerIndexKey)
+	if deletion := c.ShareStore.Deletion; deletion != nil {
+		setDurationPtr("deletion_grace_period", deletion.GracePeriod)
+		setDuration("deletion_purge_interval", deletion.PurgeInterval)
+	}
+	setDuration("token_validity", c.Tokens.Validity)
+	setInt("max_tokens", int64(c.Tokens.MaxTokens))
+	setIntPtr("max_request_size", c.Limits.MaxRequestSize)
+	setIntPtr("max_share_size", c.Limits.MaxShareSize)
+	setIntPtr("max_shares_per_owner", c.Limits.MaxSharesPerOwner)
+	setInt("share_store_max_size", c.Limits.MaxStoreSize)
+	if file := c.Channels.File; file != nil {
+		set("filechannel_root_dir", file.RootDir)
+		setInt("filechannel_max_file_size", file.MaxFileSize)
+	}
+	if hooks := c.Channels.Webhooks; hooks != nil {
+		set("webhook_urls", keyValueList(hooks.URLs))
+		setSecret("webhook_key_file", hooks.Key)
+		setIntPtr("webhook_max_retries", hooks.MaxRetries)
+	}
+	set("owner_id_type_aliases", keyValueList(c.Channels.Aliases))
+	set("fallback_owner_id_type", c.Channels.Fallback)
+	set("msg_templates_dir", c.Channels.TemplatesDir)
+	if outbox := c.Channels.Outbox; outbox != nil {
+		set("outbox_file", outbox.Path)
+		setSecret("outbox_key_file", outbox.Key)
+		setInt("outbox_max_attempts", int64(outbox.MaxAttempts))
+	}
+	set("recipient_rate_limit", c.RateLimits.Recipient)
+	set("subnet_rate_limit", c.RateLimits.Subnet)
+	set("global_rate_limit", c.RateLimits.Global)
+	set("delivery_status_rate_limit", c.RateLimits.DeliveryStatus)
+	set("rate_limit_file", c.RateLimits.Path)
+	setSecret("rate_limit_key_file", c.RateLimits.Key)
+	setSecret("pow_key_file", c.ProofOfWork.Key)
+	setInt("pow_difficulty", int64(c.ProofOfWork.Difficulty))
+	setInt("pow_max_difficulty", int64(c.ProofOfWork.MaxDifficulty))
+	setIntPtr("pow_load_threshold", c.ProofOfWork.LoadThreshold)
+	setIntPtr("pow_recipient_threshold", c.ProofOfWork.RecipientThreshold)
+	set("audit_log_file", c.AuditLog.Path)
+	setSecret("audit_log_key_file", c.AuditLog.Key)
+	setDuration("audit_log_head_interval", c.AuditLog.HeadInterval)
+	set("translog_file", c.TransparencyLog.Path)
+	setSecret("translog_key_file", c.TransparencyLog.Key)
+	set("log_level", c.Logging.Level)
+	set("log_format", c.Logging.Format)
+	setSecret("log_hash_key_file", c.Logging.HashKey)
+	return flags
+}
+
+// keyValueList returns 'm' as a comma-separated list of "key=value" pairs,
+// sorted by the keys.
+func keyValueList(m map[string]string) string {
+	var pairs []string
+	for _, key := range sortedKeys(m) {
+		pairs = append(pairs, key+"="+m[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// runCheckConfig runs the server with -check_config and 'args' in a child
+// process, and returns its exit code and output.
+func runCheckConfig(t *testing.T, args ...string) (int, string) {
+	var output bytes.Buffer
+	cmd := exec.Command(os.Args[0], append([]string{"-check_config"}, args...)...)
+	cmd.Env = append(os.Environ(), childEnv+"=1", "SVALBARD_TEST_WEBHOOK_KEY=secret")
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.Sys().(syscall.WaitStatus).ExitStatus(), output.String()
+	}
+	if err != nil {
+		t.Fatalf("Could not run server: %v", err)
+	}
+	return 0, output.String()
+}
+
+func TestCheckConfig(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	writeConfig := func(name, config string) string {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	valid := writeConfig("valid.json", `{
+  "version": 1,
+  "share_store": {"path": "`+filepath.Join(dir, "shares.db")+`"},
+  "channels": {
+    "webhooks": {"urls": {"SMS": "https://sms.example.com/hook"}, "key": {"env": "SVALBARD_TEST_WEBHOOK_KEY"}}
+  },
+  "logging": {"level": "debug"}
+}`)
+	noKey := writeConfig("no_key.json", `{
+  "version": 1,
+  "share_store": {"path": "shares.db"},
+  "channels": {"webhooks": {"urls": {"SMS": "https://sms.example.com/hook"}}}
+}`)
+	unsetEnv := writeConfig("unset_env.json", `{
+  "version": 1,
+  "share_store": {"path": "shares.db"},
+  "channels": {"file": {"root_dir": "messages"}},
+  "logging": {"hash_key": {"env": "SVALBARD_TEST_UNSET_VARIABLE"}}
+}`)
+	var tests = []struct {
+		args     []string
+		wantCode int
+		want     string // substring of the output
+	}{
+		{[]string{"-config=" + valid}, 0, "Configuration OK"},
+		// Flags override the configuration file.
+		{[]string{"-config=" + valid, "-log_level=verbose"}, 1, "invalid -log_level"},
+		{[]string{"-config=" + valid, "-global_rate_limit=often"}, 1, "invalid -global_rate_limit"},
+		{[]string{"-config=" + noKey}, 1, "channels.webhooks.key: missing"},
+		{[]string{"-config=" + unsetEnv}, 1, "environment variable SVALBARD_TEST_UNSET_VARIABLE is not set"},
+		{[]string{"-config=" + filepath.Join(dir, "missing.json")}, 1, "Could not load configuration"},
+		// Without a configuration file, the flags alone are checked.
+		{[]string{"-filechannel_root_dir=" + dir}, 1, "please provide -bolt_share_store_file"},
+		{[]string{"-filechannel_root_dir=" + dir, "-bolt_share_store_file=" + filepath.Join(dir, "shares.db")}, 0, "Configuration OK"},
+		{[]string{"-filechannel_root_dir=" + dir, "-sqlite_share_store_file=" + filepath.Join(dir, "shares.sqlite")}, 0, "Configuration OK"},
+		{[]string{"-filechannel_root_dir=" + dir, "-bolt_share_store_file=" + filepath.Join(dir, "shares.db"),
+			"-sqlite_share_store_file=" + filepath.Join(dir, "shares.sqlite")}, 1, "mutually exclusive"},
+		{[]string{"-filechannel_root_dir=" + dir, "-sqlite_share_store_file=" + filepath.Join(dir, "shares.sqlite"),
+			"-admin_api_addr=:9443", "-admin_api_snapshots"}, 1, "-admin_api_snapshots requires -bolt_share_store_file"},
+		{[]string{"-filechannel_root_dir=" + dir, "-bolt_share_store_file=" + filepath.Join(dir, "shares.db"),
+			"-share_expiry_default=48h", "-share_expiry_max=24h"}, 1, "-share_expiry_default must not exceed -share_expiry_max"},
+		{[]string{"-filechannel_root_dir=" + dir, "-bolt_share_store_file=" + filepath.Join(dir, "shares.db"),
+			"-deletion_grace_period=-1h", "-deletion_purge_interval=0"}, 1,
+			"-deletion_grace_period must not be negative; -deletion_purge_interval must be positive"},
+		{[]string{"-filechannel_root_dir=" + dir, "-bolt_share_store_file=" + filepath.Join(dir, "shares.db"),
+			"-admin_api_addr=:9443", "-admin_api_roles=CN:alice=root"}, 1,
+			"please provide -admin_api_tls_cert_file and -admin_api_tls_key_file; please provide -admin_api_client_ca_file; invalid -admin_api_roles"},
+	}
+	for _, tt := range tests {
+		code, output := runCheckConfig(t, tt.args...)
+		if code != tt.wantCode || !strings.Contains(output, tt.want) {
+			t.Errorf("server -check_config %v: got exit code %d and output [%s], want %d and output containing [%s]",
+				tt.args, code, output, tt.wantCode, tt.want)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package serverconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const fullConfig = `{
+  "version": 1,
+  "listeners": {
+    "public": {"port": "8443", "tls": {"cert_file": "cert.pem", "key_file": "key.pem"}},
+    "admin": {"address": "localhost:9090"},
+    "admin_api": {
+      "address": ":9443",
+      "tls": {"cert_file": "admin_cert.pem", "key_file": "admin_key.pem"},
+      "client_ca_file": "operators_ca.pem",
+      "roles": {"OU:sre": "operator", "CN:dashboard": "viewer"},
+      "snapshots": {"public_key_file": "snapshot_pub.pem"}
+    }
+  },
+  "timeouts": {"read": "5s", "write": "30s", "idle": "1m0s", "shutdown": "10s"},
+  "share_store": {
+    "backend": "bolt", "path": "/var/lib/svalbard/shares.db",
+    "expiry": {"default": "8760h", "max": "87600h", "reminder": "720h", "reap_interval": "30m",
+      "key": {"file": "expiry.key"}},
+    "deletion": {"grace_period": "0s", "purge_interval": "10m"},
+    "owner_index_key": {"env": "OWNER_INDEX_KEY"}
+  },
+  "tokens": {"validity": "5m0s", "max_tokens": 1000},
+  "limits": {"max_request_size": 65536, "max_share_size": 0, "max_shares_per_owner": 20, "max_store_size": 1073741824},
+  "channels": {
+    "file": {"root_dir": "/var/lib/svalbard/messages", "max_file_size": 4096},
+    "webhooks": {
+      "urls": {"SMS": "https://sms.example.com/hook", "EMAIL": "https://mail.example.com/hook"},
+      "key": {"env": "WEBHOOK_KEY"},
+      "max_retries": 0
+    },
+    "aliases": {"E-MAIL": "EMAIL"},
+    "fallback": "EMAIL",
+    "templates_dir": "/etc/svalbard/templates",
+    "outbox": {"path": "/var/lib/svalbard/outbox.db", "key": {"file": "outbox.key"}, "max_attempts": 3}
+  },
+  "rate_limits": {"recipient": "5/1h", "subnet": "0", "global": "100/1m", "delivery_status": "10/1m",
+    "path": "/var/lib/svalbard/limits.db", "key": {"file": "limits.key"}},
+  "proof_of_work": {"key": {"file": "pow.key"}, "difficulty": 12, "max_difficulty": 20, "load_threshold": 0},
+  "audit_log": {"path": "/var/log/svalbard/audit.log", "key": {"file": "audit.key"}, "head_interval": "15m"},
+  "transparency_log": {"path": "/var/lib/svalbard/translog", "key": {"file": "translog.pem"}},
+  "logging": {"level": "debug", "format": "json", "hash_key": {"env": "LOG_HASH_KEY"}}
+}`
+
+func TestFlags(t *testing.T) {
+	config, err := Parse([]byte(fullConfig))
+	if err != nil {
+		t.Fatalf("Parse(): unexpected error: %v", err)
+	}
+	want := map[string]string{
+		"port":                               "8443",
+		"tls_cert_file":                      "cert.pem",
+		"tls_key_file":                       "key.pem",
+		"admin_addr":                         "localhost:9090",
+		"admin_api_addr":                     ":9443",
+		"admin_api_tls_cert_file":            "admin_cert.pem",
+		"admin_api_tls_key_file":             "admin_key.pem",
+		"admin_api_client_ca_file":           "operators_ca.pem",
+		"admin_api_roles":                    "CN:dashboard=viewer,OU:sre=operator",
+		"admin_api_snapshots":                "true",
+		"admin_api_snapshot_public_key_file": "snapshot_pub.pem",
+		"read_timeout":                       "5s",
+		"write_timeout":                      "30s",
+		"idle_timeout":                       "1m0s",
+		"shutdown_timeout":                   "10s",
+		"bolt_share_store_file":              "/var/lib/svalbard/shares.db",
+		"share_expiry_default":               "8760h0m0s",
+		"share_expiry_max":                   "87600h0m0s",
+		"share_expiry_reminder":              "720h0m0s",
+		"share_expiry_reap_interval":         "30m0s",
+		"share_expiry_key_file":              "expiry.key",
+		"owner_index_key_file":               "env:OWNER_INDEX_KEY",
+		"deletion_grace_period":              "0s",
+		"deletion_purge_interval":            "10m0s",
+		"token_validity":                     "5m0s",
+		"max_tokens":                         "1000",
+		"max_request_size":                   "65536",
+		"max_share_size":                     "0",
+		"max_shares_per_owner":               "20",
+		"share_store_max_size":               "1073741824",
+		"filechannel_root_dir":               "/var/lib/svalbard/messages",
+		"filechannel_max_file_size":          "4096",
+		"webhook_urls":                       "EMAIL=https://mail.example.com/hook,SMS=https://sms.example.com/hook",
+		"webhook_key_file":                   "env:WEBHOOK_KEY",
+		"webhook_max_retries":                "0",
+		"owner_id_type_aliases":              "E-MAIL=EMAIL",
+		"fallback_owner_id_type":             "EMAIL",
+		"msg_templates_dir":                  "/etc/svalbard/templates",
+		"outbox_file":                        "/var/lib/svalbard/outbox.db",
+		"outbox_key_file":                    "outbox.key",
+		"outbox_max_attempts":                "3",
+		"recipient_rate_limit":               "5/1h",
+		"subnet_rate_limit":                  "0",
+		"global_rate_limit":                  "100/1m",
+		"delivery_status_rate_limit":         "10/1m",
+		"rate_limit_file":                    "/var/lib/svalbard/limits.db",
+		"rate_limit_key_file":                "limits.key",
+		"pow_key_file":                       "pow.key",
+		"pow_difficulty":                     "12",
+		"pow_max_difficulty":                 "20",
+		"pow_load_threshold":                 "0",
+		"audit_log_file":                     "/var/log/svalbard/audit.log",
+		"audit_log_key_file":                 "audit.key",
+		"audit_log_head_interval":            "15m0s",
+		"translog_file":                      "/var/lib/svalbard/translog",
+		"translog_key_file":                  "translog.pem",
+		"log_level":                          "debug",
+		"log_format":                         "json",
+		"log_hash_key_file":                  "env:LOG_HASH_KEY",
+	}
+	if got := config.Flags(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Flags(): got [%v], want [%v]", got, want)
+	}
+	// A minimal configuration sets only the given flags.
+	config, err = Parse([]byte(`{"version": 1, "share_store": {"path": "shares.db"}}`))
+	if err != nil {
+		t.Fatalf("Parse(): unexpected error: %v", err)
+	}
+	want = map[string]string{"bolt_share_store_file": "shares.db"}
+	if got := config.Flags(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Flags() of minimal config: got [%v], want [%v]", got, want)
+	}
+	config, err = Parse([]byte(`{"version": 1, "share_store": {"backend": "sqlite", "path": "shares.sqlite"}}`))
+	if err != nil {
+		t.Fatalf("Parse(): unexpected error: %v", err)
+	}
+	want = map[string]string{"sqlite_share_store_file": "shares.sqlite"}
+	if got := config.Flags(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Flags() of SQLite config: got [%v], want [%v]", got, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	var tests = []struct {
+		config string
+		want   []string // substrings of the error
+	}{
+		{`{}`, []string{"missing version"}},
+		{`{"version": 2}`, []string{"unsupported version 2, want 1"}},
+		{`{"version": "1"}`, []string{"line 1, column 15", "invalid value for version"}},
+		{"{\n  \"version\": 1,\n  \"share_store\": {\"path\": \"a\",}\n}", []string{"line 3, column 31", "invalid character"}},
+		{`{"version": 1, "share_stor": {}}`, []string{`unknown field "share_stor"`}},
+		{`{"version": 1, "timeouts": {"read": "10 s"}}`, []string{`invalid duration "10 s"`}},
+		{`{"version": 1, "timeouts": {"read": 10}}`, []string{`invalid duration 10`}},
+		{`{"version": 1, "timeouts": {"read": "-1s"}}`, []string{"timeouts.read: must not be negative"}},
+		{`{"version": 1, "listeners": {"public": {"port": "http"}}}`, []string{`listeners.public.port: invalid port "http"`}},
+		{`{"version": 1, "listeners": {"public": {"tls": {"cert_file": "c"}}}}`,
+			[]string{"listeners.public.tls: both cert_file and key_file are required"}},
+		{`{"version": 1, "listeners": {"admin_api": {}}}`,
+			[]string{"listeners.admin_api.address: missing", "listeners.admin_api.client_ca_file: missing",
+				"listeners.admin_api.roles: missing", "listeners.admin_api.tls: both cert_file and key_file are required"}},
+		{`{"version": 1, "listeners": {"admin_api": {"roles": {"CN:alice": "root", "L:Zurich": "viewer"}}}}`,
+			[]string{"listeners.admin_api.roles: invalid"}},
+		{`{"version": 1, "share_store": {"backend": "mysql"}}`,
+			[]string{`share_store.backend: unknown backend "mysql", want one of bolt, sqlite`}},
+		{`{"version": 1, "share_store": {"expiry": {"default": "48h", "max": "24h", "reap_interval": "-1h"}}}`,
+			[]string{"share_store.expiry: default 48h0m0s exceeds max 24h0m0s",
+				"share_store.expiry.reap_interval: must not be negative"}},
+		{`{"version": 1, "share_store": {"deletion": {"grace_period": "-1h", "purge_interval": "-1h"}}}`,
+			[]string{"share_store.deletion.grace_period: must not be negative",
+				"share_store.deletion.purge_interval: must not be negative"}},
+		{`{"version": 1, "limits": {"max_shares_per_owner": -1, "max_store_size": -1}}`,
+			[]string{"limits.max_shares_per_owner: must not be negative", "limits.max_store_size: must not be negative"}},
+		{`{"version": 1, "limits": {"max_request_size": 1024, "max_share_size": 4096}}`,
+			[]string{"limits: max_share_size 4096 exceeds max_request_size 1024"}},
+		{`{"version": 1, "channels": {"webhooks": {"urls": {"SMS": "https://a"}}}}`,
+			[]string{"channels.webhooks.key: missing"}},
+		{`{"version": 1, "channels": {"webhooks": {"urls": {"SMS": "https://a"}, "key": {"file": "k", "env": "K"}}}}`,
+			[]string{"channels.webhooks.key: exactly one of file and env is required"}},
+		{`{"version": 1, "channels": {"file": {}, "outbox": {"max_attempts": -1}}}`,
+			[]string{"channels.file.root_dir: missing", "channels.outbox.max_attempts: must not be negative",
+				"channels.outbox.path: missing"}},
+		{`{"version": 1, "rate_limits": {"recipient": "ten per hour"}}`,
+			[]string{"rate_limits.recipient: ", "want <n>/<duration> or 0"}},
+		{`{"version": 1, "rate_limits": {"path": "/var/lib/svalbard/limits.db"}}`,
+			[]string{"rate_limits.key: missing"}},
+		{`{"version": 1, "proof_of_work": {"difficulty": 24, "max_difficulty": 16}}`,
+			[]string{"proof_of_work: difficulty 24 exceeds max_difficulty 16"}},
+		{`{"version": 1, "audit_log": {"head_interval": "-1m"}}`, []string{"audit_log.head_interval: must not be negative"}},
+		{`{"version": 1, "transparency_log": {"path": "t"}}`, []string{"transparency_log.key: missing"}},
+		{`{"version": 1, "logging": {"level": "verbose", "format": "xml"}}`,
+			[]string{`logging.format: invalid log format "xml", want text or json`,
+				`logging.level: invalid log level "verbose", want debug, info, warn or error`}},
+	}
+	for _, tt := range tests {
+		_, err := Parse([]byte(tt.config))
+		if err == nil {
+			t.Errorf("Parse(%s): got no error, want [%s]", tt.config, strings.Join(tt.want, "..."))
+			continue
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("Parse(%s): got [%v], want error containing [%s]", tt.config, err, want)
+			}
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "svalbard_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(filename, []byte(fullConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(filename); err != nil {
+		t.Errorf("Load(%q): got [%v], want [nil]", filename, err)
+	}
+	if err := ioutil.WriteFile(filename, []byte(`{"version": 1, "tokens": {"max_tokens": -1}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(filename); err == nil || !strings.Contains(err.Error(), filename+": invalid configuration") {
+		t.Errorf("Load(%q) of invalid config: got [%v], want error naming the file", filename, err)
+	}
+	if _, err := Load(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("Load() of missing file: got no error, want error")
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/svalbard/server/go/testingtools"
+)
+
+// writeCertificate writes a new self-signed certificate to the given files,
+// and returns its serial.
+func writeCertificate(t *testing.T, certFile, keyFile string) *big.Int {
+	cert, err := testingtools.NewTestCertificate(pkix.Name{CommonName: "localhost"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.WriteFiles(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	return cert.Cert.SerialNumber
+}
+
+// dialChild opens a TLS connection to 'c', without verifying its certificate.
+func dialChild(t *testing.T, c *child) *tls.Conn {
+	conn, err := tls.Dial("tcp", strings.TrimPrefix(c.baseURL, "https://"), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Dial(): unexpected error: %v", err)
+	}
+	return conn
+}
+
+// serial returns the serial of the certificate of 'conn'.
+func serial(conn *tls.Conn) *big.Int {
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber
+}
+
+// getFileToken requests a storage token for a recipient of the file channel
+// over the keep-alive connection 'conn', and returns the status of the response.
+func getFileToken(t *testing.T, conn *tls.Conn, reader *bufio.Reader) int {
+	form := url.Values{
+		"request_id":    {"req1"},
+		"owner_id_type": {"FILE"},
+		"owner_id":      {"alice"},
+		"secret_name":   {"some secret"},
+	}
+	req, err := http.NewRequest("POST", "https://localhost/get_storage_token", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("Write(): unexpected error: %v", err)
+	}
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatalf("ReadResponse(): unexpected error: %v", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// waitForOutput waits until the output of 'c' contains 'want'.
+func waitForOutput(t *testing.T, c *child, want string) {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if strings.Contains(c.output.String(), want) {
+			return
+		}
+	}
+	t.Fatalf("Output does not contain [%s]:\n%s", want, c.output.String())
+}
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	oldSerial := writeCertificate(t, certFile, keyFile)
+	configFile := filepath.Join(dir, "config.json")
+	writeConfig := func(globalRateLimit, logLevel string) {
+		config := `{
+  "version": 1,
+  "share_store": {"path": "` + filepath.Join(dir, "shares.db") + `"},
+  "channels": {"file": {"root_dir": "` + dir + `"}},
+  "rate_limits": {"global": "` + globalRateLimit + `"},
+  "logging": {"level": "` + logLevel + `"}
+}`
+		if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("1/1h", "info")
+	c := startChild(t, "-config="+configFile, "-tls_cert_file="+certFile, "-tls_key_file="+keyFile)
+	defer c.cmd.Process.Kill()
+	c.client.Transport.(*http.Transport).CloseIdleConnections()
+
+	// A keep-alive connection established before the reload.
+	conn := dialChild(t, c)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	if got := serial(conn); got.Cmp(oldSerial) != 0 {
+		t.Fatalf("certificate before reload: got serial [%v], want [%v]", got, oldSerial)
+	}
+	if status := getFileToken(t, conn, reader); status != http.StatusOK {
+		t.Fatalf("first token request: got status [%v], want [%v]", status, http.StatusOK)
+	}
+	if status := getFileToken(t, conn, reader); status != http.StatusTooManyRequests {
+		t.Fatalf("second token request: got status [%v], want [%v]", status, http.StatusTooManyRequests)
+	}
+
+	if output := c.output.String(); strings.Contains(output, "level=DEBUG") {
+		t.Errorf("debug messages logged before reload:\n%s", output)
+	}
+
+	newSerial := writeCertificate(t, certFile, keyFile)
+	writeConfig("0", "debug")
+	if err := c.cmd.Process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("Signal(SIGHUP) failed: %v", err)
+	}
+	waitForOutput(t, c, "reloaded configuration")
+	newConn := dialChild(t, c)
+	if got := serial(newConn); got.Cmp(newSerial) != 0 {
+		t.Errorf("certificate of new connection after reload: got serial [%v], want [%v]", got, newSerial)
+	}
+	newConn.Close()
+	// The rate limit is lifted, and the old connection still works.
+	if status := getFileToken(t, conn, reader); status != http.StatusOK {
+		t.Errorf("token request after reload: got status [%v], want [%v]", status, http.StatusOK)
+	}
+	// Debug messages are logged now.
+	waitForOutput(t, c, "level=DEBUG msg=\"parsed POST data\"")
+
+	// An invalid configuration is rejected as a whole.
+	writeConfig("1/1h", "verbose")
+	if err := c.cmd.Process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("Signal(SIGHUP) failed: %v", err)
+	}
+	waitForOutput(t, c, "could not reload configuration")
+	for i := 0; i < 3; i++ {
+		if status := getFileToken(t, conn, reader); status != http.StatusOK {
+			t.Errorf("token request #%d after rejected reload: got status [%v], want [%v]", i, status, http.StatusOK)
+		}
+	}
+
+	conn.Close()
+	if err := c.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("Signal(SIGTERM) failed: %v", err)
+	}
+	if got := c.wait(t); got != 0 {
+		t.Errorf("exit code: got [%v], want [0], output:\n%s", got, c.output.String())
+	}
+}
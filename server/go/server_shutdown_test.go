@@ -0,0 +1,266 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	bolt "github.com/etcd-io/bbolt/bolt"
+)
+
+// childEnv is set in the environment of the child processes, which run
+// the server instead of the tests.
+const childEnv = "SVALBARD_SERVER_TEST_CHILD"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(childEnv) == "1" {
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func newTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "svalbard_server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return fmt.Sprint(l.Addr().(*net.TCPAddr).Port)
+}
+
+// syncBuffer is a bytes.Buffer that may be read while being written.
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+// child is a server running in a child process.
+type child struct {
+	cmd     *exec.Cmd
+	output  syncBuffer
+	baseURL string
+	client  *http.Client
+}
+
+// startChild starts the server with 'args' in a child process, and waits
+// until it is alive.  If 'args' contain -tls_cert_file, the child is
+// accessed via HTTPS, without verifying its certificate.
+func startChild(t *testing.T, args ...string) *child {
+	port := freePort(t)
+	c := &child{baseURL: "http://127.0.0.1:" + port, client: &http.Client{Transport: &http.Transport{}}}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-tls_cert_file=") {
+			c.baseURL = "https://127.0.0.1:" + port
+			c.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		}
+	}
+	c.cmd = exec.Command(os.Args[0], append([]string{"-port=" + port}, args...)...)
+	c.cmd.Env = append(os.Environ(), childEnv+"=1")
+	c.cmd.Stdout = &c.output
+	c.cmd.Stderr = &c.output
+	if err := c.cmd.Start(); err != nil {
+		t.Fatalf("Could not start server: %v", err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if resp, err := c.client.Get(c.baseURL + "/healthz"); err == nil {
+			resp.Body.Close()
+			return c
+		}
+	}
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	t.Fatalf("Server did not start, output:\n%s", c.output.String())
+	return nil
+}
+
+// wait waits for the child to exit, and returns its exit code.
+func (c *child) wait(t *testing.T) int {
+	done := make(chan error, 1)
+	go func() { done <- c.cmd.Wait() }()
+	select {
+	case err := <-done:
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+		}
+		if err != nil {
+			t.Fatalf("Wait() failed: %v", err)
+		}
+		return 0
+	case <-time.After(10 * time.Second):
+		c.cmd.Process.Kill()
+		t.Fatalf("Server did not exit, output:\n%s", c.output.String())
+		return -1
+	}
+}
+
+// waitUntilStopped waits until the child does not accept new connections.
+func (c *child) waitUntilStopped(t *testing.T) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		resp, err := c.client.Get(c.baseURL + "/healthz")
+		if err != nil {
+			return
+		}
+		resp.Body.Close()
+	}
+	t.Fatalf("Server still accepts connections, output:\n%s", c.output.String())
+}
+
+// checkDBClosed checks that the Bolt DB 'filename' is not locked any more.
+func checkDBClosed(filename string, t *testing.T) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 500 * time.Millisecond})
+	if err != nil {
+		t.Errorf("Bolt DB %s not closed by the server: %v", filename, err)
+		return
+	}
+	db.Close()
+}
+
+// blockingWebhook is a webhook that blocks every delivery until it is released.
+type blockingWebhook struct {
+	*httptest.Server
+	received chan struct{}
+	release  chan struct{}
+}
+
+func newBlockingWebhook() *blockingWebhook {
+	w := &blockingWebhook{received: make(chan struct{}, 10), release: make(chan struct{})}
+	w.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w.received <- struct{}{}
+		<-w.release
+	}))
+	return w
+}
+
+// requestToken requests a storage token for a recipient of the webhook
+// in the background, and returns a channel with the status of the response,
+// or 0 if the request failed.
+func requestToken(c *child) <-chan int {
+	status := make(chan int, 1)
+	go func() {
+		resp, err := c.client.PostForm(c.baseURL+"/get_storage_token", url.Values{
+			"request_id":    {"req1"},
+			"owner_id_type": {"HOOK"},
+			"owner_id":      {"alice"},
+			"secret_name":   {"some secret"},
+		})
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	return status
+}
+
+func TestShutdownDrainsRequestsInFlight(t *testing.T) {
+	for _, sig := range []os.Signal{syscall.SIGTERM, os.Interrupt} {
+		dir := newTempDir(t)
+		keyFile := filepath.Join(dir, "webhook.key")
+		if err := ioutil.WriteFile(keyFile, []byte("some webhook key"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		webhook := newBlockingWebhook()
+		shareStoreFile := filepath.Join(dir, "shares.db")
+		rateLimitFile := filepath.Join(dir, "rate_limits.db")
+		c := startChild(t, "-bolt_share_store_file="+shareStoreFile, "-rate_limit_file="+rateLimitFile,
+			"-rate_limit_key_file="+keyFile, "-webhook_urls=HOOK="+webhook.URL, "-webhook_key_file="+keyFile, "-webhook_max_retries=0",
+			"-audit_log_file="+filepath.Join(dir, "audit.log"))
+		status := requestToken(c)
+		<-webhook.received
+		if err := c.cmd.Process.Signal(sig); err != nil {
+			t.Fatalf("Signal(%v) failed: %v", sig, err)
+		}
+		c.waitUntilStopped(t)
+		close(webhook.release)
+		if got := <-status; got != http.StatusOK {
+			t.Errorf("%v: status of request in flight: got [%v], want [%v]", sig, got, http.StatusOK)
+		}
+		if got := c.wait(t); got != 0 {
+			t.Errorf("%v: exit code: got [%v], want [0], output:\n%s", sig, got, c.output.String())
+		}
+		checkDBClosed(shareStoreFile, t)
+		checkDBClosed(rateLimitFile, t)
+		webhook.Close()
+	}
+}
+
+func TestShutdownGivesUpAfterTimeout(t *testing.T) {
+	dir := newTempDir(t)
+	keyFile := filepath.Join(dir, "webhook.key")
+	if err := ioutil.WriteFile(keyFile, []byte("some webhook key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	webhook := newBlockingWebhook()
+	defer webhook.Close()
+	defer close(webhook.release)
+	shareStoreFile := filepath.Join(dir, "shares.db")
+	c := startChild(t, "-bolt_share_store_file="+shareStoreFile, "-shutdown_timeout=200ms",
+		"-webhook_urls=HOOK="+webhook.URL, "-webhook_key_file="+keyFile, "-webhook_max_retries=0")
+	status := requestToken(c)
+	<-webhook.received
+	start := time.Now()
+	if err := c.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("Signal(SIGTERM) failed: %v", err)
+	}
+	if got := c.wait(t); got != 1 {
+		t.Errorf("exit code: got [%v], want [1], output:\n%s", got, c.output.String())
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("duration of shutdown: got [%v], want about 200ms", elapsed)
+	}
+	if got := <-status; got != 0 {
+		t.Errorf("status of request in flight: got [%v], want failed request", got)
+	}
+	checkDBClosed(shareStoreFile, t)
+}
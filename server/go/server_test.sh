@@ -18,6 +18,7 @@
 
 ROOT_DIR="$TEST_SRCDIR/svalbard"
 SERVER_BIN="$ROOT_DIR/server/go/linux_amd64_stripped/server"
+TOKEN_BIN="$ROOT_DIR/server/go/linux_amd64_stripped/filechannel_token"
 PORTPICKER_CLI="$ROOT_DIR/external/org_python_pypi_portpicker/portpicker_cli"
 SERVER_PORT=$($PORTPICKER_CLI $$)
 HTTP_RESPONSE_BODY="$TEST_TMPDIR/http_response_body.txt"
@@ -31,8 +32,7 @@ TLS_CERT_FILE="$ROOT_DIR/server/testdata/test_server_certificate.crt"
 get_token() {
   local owner_id="$1"
   local request_id="$2"
-  local channel_file="$FILECHANNEL_DIR/${owner_id}_secondary_channel.txt"
-  local token=$(grep "SVBD:$request_id" $channel_file | cut -d: -f3)
+  local token=$($TOKEN_BIN -filechannel_root_dir="$FILECHANNEL_DIR" -owner_id="$owner_id" -request_id="$request_id")
   echo $token
 }
 
@@ -0,0 +1,275 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Package sharedump implements the encrypted format in which svalbardctl
+// exports the shares of a share store.
+//
+// A dump starts with a header of the magic "SVBDDUMP", a version byte and a
+// random salt, followed by frames of a 4-byte big-endian length and an
+// AES-256-GCM ciphertext.  Each frame holds one JSON-encoded Record; the last
+// frame holds the number of records and is marked as final in its nonce, so
+// that a truncated, reordered or spliced dump fails to decrypt.  The key of
+// the dump is derived from a key file of the operator and the salt, and the
+// header is authenticated with every frame.
+package sharedump
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Version is the version of the dump format written by this package.
+// Version 2 added the purge times of the soft-deleted shares and the owner
+// keys; readers accept all versions up to Version.
+const Version = 2
+
+const (
+	magic        = "SVBDDUMP"
+	saltSize     = 16
+	headerSize   = len(magic) + 1 + saltSize
+	maxFrameSize = 1 << 24
+	// MinKeySize is the minimal length of the key material.
+	MinKeySize = 16
+)
+
+var (
+	// ErrKeyTooShort is returned if the key material is shorter than
+	// MinKeySize.
+	ErrKeyTooShort = fmt.Errorf("key must have at least %d bytes", MinKeySize)
+	// ErrNotADump is returned if the input does not start with a dump header.
+	ErrNotADump = errors.New("not a share dump")
+	// ErrUnknownVersion is returned for dumps newer than Version, or with an
+	// invalid version.
+	ErrUnknownVersion = errors.New("unknown dump version")
+	// ErrDecryption is returned if a frame does not decrypt, because of a
+	// wrong key or because the dump was modified.
+	ErrDecryption = errors.New("could not decrypt dump: wrong key or modified dump")
+	// ErrTruncated is returned if the dump ends before its final frame.
+	ErrTruncated = errors.New("dump is truncated")
+)
+
+// Record is a share as stored in a dump.
+type Record struct {
+	ShareID string
+	Value   string
+	// Created is the time at which the share was stored, in Unix seconds,
+	// or 0 if unknown.
+	Created int64
+	// PurgeAt is the purge time of a soft-deleted share, in Unix seconds, or
+	// 0 if the share is not deleted.
+	PurgeAt int64
+	// OwnerKey is the key under which the share is indexed by its owner, or
+	// empty if the share is not indexed.
+	OwnerKey string
+}
+
+// jsonRecord is the encoding of a Record in a frame.  The ID and the value
+// are encoded as base64 rather than as JSON strings, which would replace
+// invalid UTF-8.
+type jsonRecord struct {
+	ShareID  []byte `json:"share_id"`
+	Value    []byte `json:"value"`
+	Created  int64  `json:"created,omitempty"`
+	PurgeAt  int64  `json:"purge_at,omitempty"`
+	OwnerKey []byte `json:"owner_key,omitempty"`
+}
+
+type trailer struct {
+	Records int `json:"records"`
+}
+
+type frameCipher struct {
+	aead    cipher.AEAD
+	header  []byte
+	counter uint64
+}
+
+func newFrameCipher(key, header []byte) (*frameCipher, error) {
+	if len(key) < MinKeySize {
+		return nil, ErrKeyTooShort
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("svalbard share dump"))
+	mac.Write(header)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &frameCipher{aead: aead, header: header}, nil
+}
+
+// nonce returns the nonce of the next frame, and advances the counter.
+func (c *frameCipher) nonce(final bool) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, c.counter)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	c.counter++
+	return nonce
+}
+
+// Writer writes an encrypted dump.  Close must be called to write the final
+// frame; a dump without it is rejected as truncated.
+type Writer struct {
+	w       io.Writer
+	cipher  *frameCipher
+	records int
+}
+
+// NewWriter writes the header of a dump encrypted under 'key' to 'w'.
+func NewWriter(w io.Writer, key []byte) (*Writer, error) {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	header[len(magic)] = Version
+	if _, err := io.ReadFull(rand.Reader, header[len(magic)+1:]); err != nil {
+		return nil, err
+	}
+	c, err := newFrameCipher(key, header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, cipher: c}, nil
+}
+
+func (dw *Writer) writeFrame(v interface{}, final bool) error {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	sealed := dw.cipher.aead.Seal(make([]byte, 4), dw.cipher.nonce(final), plaintext, dw.cipher.header)
+	binary.BigEndian.PutUint32(sealed, uint32(len(sealed)-4))
+	_, err = dw.w.Write(sealed)
+	return err
+}
+
+// Write writes a record to the dump.
+func (dw *Writer) Write(r Record) error {
+	if err := dw.writeFrame(jsonRecord{[]byte(r.ShareID), []byte(r.Value), r.Created, r.PurgeAt, []byte(r.OwnerKey)}, false); err != nil {
+		return err
+	}
+	dw.records++
+	return nil
+}
+
+// Close writes the final frame.  It does not close the underlying writer.
+func (dw *Writer) Close() error {
+	return dw.writeFrame(trailer{dw.records}, true)
+}
+
+// Reader reads an encrypted dump.
+type Reader struct {
+	r       io.Reader
+	cipher  *frameCipher
+	records int
+	done    bool
+}
+
+// NewReader reads the header of a dump from 'r', which must have been
+// encrypted under 'key'.
+func NewReader(r io.Reader, key []byte) (*Reader, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNotADump
+		}
+		return nil, err
+	}
+	if string(header[:len(magic)]) != magic {
+		return nil, ErrNotADump
+	}
+	if v := header[len(magic)]; v == 0 || v > Version {
+		return nil, ErrUnknownVersion
+	}
+	c, err := newFrameCipher(key, header)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{r: r, cipher: c}, nil
+}
+
+// Next returns the next record of the dump.  After the last record it
+// returns io.EOF, once the final frame has been verified.
+func (dr *Reader) Next() (*Record, error) {
+	if dr.done {
+		return nil, io.EOF
+	}
+	var length [4]byte
+	if _, err := io.ReadFull(dr.r, length[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrTruncated
+		}
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > maxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds the maximum of %d bytes", n, maxFrameSize)
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(dr.r, sealed); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrTruncated
+		}
+		return nil, err
+	}
+	// A frame is either a record or the final frame; try the former first.
+	counter := dr.cipher.counter
+	plaintext, err := dr.cipher.aead.Open(nil, dr.cipher.nonce(false), sealed, dr.cipher.header)
+	if err == nil {
+		var r jsonRecord
+		if err := json.Unmarshal(plaintext, &r); err != nil {
+			return nil, fmt.Errorf("invalid record #%d: %v", dr.records, err)
+		}
+		dr.records++
+		return &Record{string(r.ShareID), string(r.Value), r.Created, r.PurgeAt, string(r.OwnerKey)}, nil
+	}
+	dr.cipher.counter = counter
+	plaintext, err = dr.cipher.aead.Open(nil, dr.cipher.nonce(true), sealed, dr.cipher.header)
+	if err != nil {
+		return nil, ErrDecryption
+	}
+	var t trailer
+	if err := json.Unmarshal(plaintext, &t); err != nil {
+		return nil, fmt.Errorf("invalid final frame: %v", err)
+	}
+	if t.Records != dr.records {
+		return nil, fmt.Errorf("dump has %d records, final frame says %d", dr.records, t.Records)
+	}
+	switch _, err := io.ReadFull(dr.r, length[:1]); err {
+	case io.EOF:
+	case nil:
+		return nil, errors.New("unexpected data after the final frame")
+	default:
+		return nil, err
+	}
+	dr.done = true
+	return nil, io.EOF
+}
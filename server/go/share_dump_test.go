@@ -0,0 +1,188 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package sharedump
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func writeDump(t *testing.T, key []byte, records []Record) []byte {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, key)
+	if err != nil {
+		t.Fatalf("NewWriter(): %v", err)
+	}
+	for _, r := range records {
+		if err := w.Write(r); err != nil {
+			t.Fatalf("Write(): %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close(): %v", err)
+	}
+	return buf.Bytes()
+}
+
+func readDump(data, key []byte) ([]Record, error) {
+	r, err := NewReader(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, *rec)
+	}
+}
+
+// frames splits a dump into its header and frames.
+func frames(data []byte) ([]byte, [][]byte) {
+	header, data := data[:headerSize], data[headerSize:]
+	var fs [][]byte
+	for len(data) > 0 {
+		n := 4 + int(binary.BigEndian.Uint32(data))
+		fs = append(fs, data[:n])
+		data = data[n:]
+	}
+	return header, fs
+}
+
+func join(header []byte, frames ...[]byte) []byte {
+	return bytes.Join(append([][]byte{header}, frames...), nil)
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := [][]Record{
+		nil,
+		{{ShareID: "share1", Value: "some value 1", Created: 1500000000}},
+		{
+			{ShareID: "share1", Value: "some value 1", Created: 1500000000},
+			{ShareID: "share2", Value: "some value 2"},
+			{ShareID: "share3", Value: "\x00\xff", Created: 1},
+		},
+		{
+			{ShareID: "share1", Value: "some value 1", Created: 1500000000, OwnerKey: "owner1"},
+			{ShareID: "share2", Value: "some value 2", Created: 1500000000, PurgeAt: 1600000000},
+			{ShareID: "share3", Value: "some value 3", PurgeAt: 1600000000, OwnerKey: "\x00\xff"},
+		},
+	}
+	for _, records := range tests {
+		got, err := readDump(writeDump(t, testKey, records), testKey)
+		if err != nil || !reflect.DeepEqual(got, records) {
+			t.Errorf("readDump(writeDump(%v)): got [%v, %v], want [%v, nil]", records, got, err, records)
+		}
+	}
+	// Every dump has a fresh salt.
+	if a, b := writeDump(t, testKey, nil), writeDump(t, testKey, nil); bytes.Equal(a, b) {
+		t.Errorf("writeDump() twice: got equal dumps, want different salts")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	records := []Record{{ShareID: "share1", Value: "some value 1", Created: 1}, {ShareID: "share2", Value: "some value 2", Created: 2}}
+	dump := writeDump(t, testKey, records)
+	header, fs := frames(dump)
+	if len(fs) != 3 {
+		t.Fatalf("frames(): got %d frames, want 3", len(fs))
+	}
+	flipped := append([]byte(nil), dump...)
+	flipped[len(header)+10] ^= 1
+	badHeader := append([]byte(nil), dump...)
+	badHeader[len(magic)+1] ^= 1
+	newer := append([]byte(nil), dump...)
+	newer[len(magic)] = Version + 1
+	zero := append([]byte(nil), dump...)
+	zero[len(magic)] = 0
+	otherDump := writeDump(t, testKey, records)
+	_, otherFrames := frames(otherDump)
+	wrongKey := append([]byte(nil), testKey...)
+	wrongKey[0] ^= 1
+
+	tests := []struct {
+		desc string
+		data []byte
+		key  []byte
+		err  error
+	}{
+		{"short key", dump, testKey[:MinKeySize-1], ErrKeyTooShort},
+		{"wrong key", dump, wrongKey, ErrDecryption},
+		{"empty input", nil, testKey, ErrNotADump},
+		{"wrong magic", append([]byte("NOTADUMP"), dump[len(magic):]...), testKey, ErrNotADump},
+		{"newer version", newer, testKey, ErrUnknownVersion},
+		{"version 0", zero, testKey, ErrUnknownVersion},
+		{"modified header", badHeader, testKey, ErrDecryption},
+		{"modified frame", flipped, testKey, ErrDecryption},
+		{"missing final frame", join(header, fs[0], fs[1]), testKey, ErrTruncated},
+		{"truncated frame", dump[:len(dump)-1], testKey, ErrTruncated},
+		{"reordered frames", join(header, fs[1], fs[0], fs[2]), testKey, ErrDecryption},
+		{"dropped frame", join(header, fs[0], fs[2]), testKey, ErrDecryption},
+		{"spliced frame", join(header, fs[0], otherFrames[1], fs[2]), testKey, ErrDecryption},
+	}
+	for _, tt := range tests {
+		if _, err := readDump(tt.data, tt.key); err != tt.err {
+			t.Errorf("readDump(%s): got [%v], want [%v]", tt.desc, err, tt.err)
+		}
+	}
+	if _, err := readDump(append(dump, 0), testKey); err == nil {
+		t.Errorf("readDump(trailing data): got [nil], want error")
+	}
+	if _, err := NewWriter(&bytes.Buffer{}, testKey[:1]); err != ErrKeyTooShort {
+		t.Errorf("NewWriter(short key): got [%v], want [%v]", err, ErrKeyTooShort)
+	}
+}
+
+func TestReadVersion1(t *testing.T) {
+	// Dumps of version 1 have no purge times and owner keys.
+	var buf bytes.Buffer
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	header[len(magic)] = 1
+	c, err := newFrameCipher(testKey, header)
+	if err != nil {
+		t.Fatalf("newFrameCipher(): got [%v], want [nil]", err)
+	}
+	buf.Write(header)
+	w := &Writer{w: &buf, cipher: c}
+	frame := struct {
+		ShareID []byte `json:"share_id"`
+		Value   []byte `json:"value"`
+		Created int64  `json:"created,omitempty"`
+	}{[]byte("share1"), []byte("some value 1"), 1500000000}
+	if err := w.writeFrame(frame, false); err != nil {
+		t.Fatalf("writeFrame(): got [%v], want [nil]", err)
+	}
+	w.records++
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close(): got [%v], want [nil]", err)
+	}
+	want := []Record{{ShareID: "share1", Value: "some value 1", Created: 1500000000}}
+	if got, err := readDump(buf.Bytes(), testKey); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("readDump(version 1): got [%v, %v], want [%v, nil]", got, err, want)
+	}
+}
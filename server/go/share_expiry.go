@@ -0,0 +1,682 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Package shareexpiry implements a store for shares of a Svalbard HTTP server
+// that lets shares expire unless their owners renew them, on top of another
+// share store.
+//
+// The expiry of a share, its renewal period and its owner are kept in
+// a metadata record stored in the underlying store next to the share, under
+// the id of the share prefixed with "expiry:".  The owner is kept only if
+// a recipient key is set, and then encrypted under that key, so that the
+// store does not reveal the owners of the shares.  Shares without a metadata
+// record (e.g. those stored before expiry was enabled) never expire.
+// The writes are ordered such that a crash never loses a share: a share is
+// stored before its metadata, and its metadata is deleted before the share,
+// so that a crash can only leave a share that does not expire.
+//
+// A reaper periodically deletes the expired shares, and reminds the owners
+// of shares that are about to expire, e.g. by sending them renewal tokens.
+package shareexpiry
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+// Defaults of Policy.
+const (
+	DefaultReminderLeadTime = 30 * 24 * time.Hour
+	DefaultReapInterval     = time.Hour
+)
+
+// MetadataPrefix is the prefix of the ids of the metadata records; share ids
+// of the server are hex-encoded, so they never start with it.
+const MetadataPrefix = "expiry:"
+
+// Errors returned upon failures.
+var (
+	ErrInvalidPolicy = errors.New("invalid policy, want periods not negative, and the default period not exceeding the maximal one")
+	ErrNotListable   = errors.New("the underlying store cannot list its shares")
+	ErrInvalidOwner  = errors.New("invalid encrypted owner")
+)
+
+// ShareIDLister is implemented by ShareStores that can list the ids of
+// their shares, which the reaper requires.
+type ShareIDLister interface {
+	// ShareIDs returns the ids of all shares in the store.
+	ShareIDs() ([]string, error)
+}
+
+// Policy contains the parameters of the expiry.  Zero values of the
+// reminder lead time and of the reap interval are replaced by the defaults.
+type Policy struct {
+	// DefaultPeriod is the period of shares stored without an explicit one.
+	// If zero, such shares never expire, unless MaxPeriod is set, which is
+	// then the default.
+	DefaultPeriod time.Duration
+	// MaxPeriod is the maximal period, zero if unbounded.
+	MaxPeriod time.Duration
+	// ReminderLeadTime is the time before the expiry of a share when its
+	// owner is reminded; a negative lead time disables the reminders.
+	ReminderLeadTime time.Duration
+	// ReapInterval is the interval of the reaper; a negative interval
+	// disables it.
+	ReapInterval time.Duration
+}
+
+func (p Policy) withDefaults() Policy {
+	if p.DefaultPeriod == 0 {
+		p.DefaultPeriod = p.MaxPeriod
+	}
+	if p.ReminderLeadTime == 0 {
+		p.ReminderLeadTime = DefaultReminderLeadTime
+	}
+	if p.ReapInterval == 0 {
+		p.ReapInterval = DefaultReapInterval
+	}
+	return p
+}
+
+// Reminder reminds 'owner' that the share identified by 'shareID' expires
+// at 'expires', e.g. svalbardsrv.Server.SendRenewalReminder.
+type Reminder func(shareID string, owner svalbardsrv.RecipientID, expires time.Time) error
+
+// metadata is the content of a metadata record.
+type metadata struct {
+	// Owner is the owner to remind, encrypted under the recipient key
+	// (see encryptOwner), or empty.
+	Owner string `json:"owner,omitempty"`
+	// Period is the renewal period in seconds, Expires the Unix time of
+	// the expiry.
+	Period   int64 `json:"period"`
+	Expires  int64 `json:"expires"`
+	Reminded bool  `json:"reminded,omitempty"`
+}
+
+func (m metadata) expires() time.Time {
+	return time.Unix(m.Expires, 0)
+}
+
+// Expiring is a ShareStore implementation that lets the shares stored in
+// an underlying ShareStore expire.
+type Expiring struct {
+	store  svalbardsrv.ShareStore
+	policy Policy
+	now    func() time.Time
+	owners cipher.AEAD // encrypts the owners, nil if they are not kept
+
+	// locks serialize the operations on each share.
+	locks [64]sync.Mutex
+
+	done      chan struct{}
+	workers   sync.WaitGroup
+	startOnce sync.Once
+	closeOnce sync.Once
+}
+
+// New returns an Expiring store over 'store', which must implement
+// ShareIDLister.  The underlying store remains owned by the caller, and must
+// not be written to otherwise.
+// The returned Expiring implements svalbardsrv.ShareStore-interface and
+// svalbardsrv.ExpiringShareStore-interface.  It also implements
+// svalbardsrv.RecoverableShareStore-interface, whose methods fail with
+// svalbardsrv.ErrSoftDeleteNotAvailable unless 'store' implements it too.
+func New(store svalbardsrv.ShareStore, policy Policy) (*Expiring, error) {
+	if _, ok := store.(ShareIDLister); !ok {
+		return nil, ErrNotListable
+	}
+	if policy.DefaultPeriod < 0 || policy.MaxPeriod < 0 ||
+		policy.MaxPeriod > 0 && policy.DefaultPeriod > policy.MaxPeriod {
+		return nil, ErrInvalidPolicy
+	}
+	return &Expiring{
+		store:  store,
+		policy: policy.withDefaults(),
+		now:    time.Now,
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// SetRecipientKey makes the store keep the owners of the shares for the
+// reminders, encrypted with AES-256-GCM under a key derived from 'secret'.
+// Without a recipient key, the owners are not kept, and not reminded.
+// It must be called before the store is used.
+func (e *Expiring) SetRecipientKey(secret []byte) error {
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	e.owners = aead
+	return nil
+}
+
+// encryptOwner returns 'owner' of the share identified by 'shareID',
+// encrypted under the recipient key and base64-encoded, or an empty string
+// if the owner is not given or not kept.  The share id is authenticated
+// with the owner, so that an owner cannot be moved to another share.
+func (e *Expiring) encryptOwner(shareID string, owner svalbardsrv.RecipientID) (string, error) {
+	if e.owners == nil || owner.IDType == "" {
+		return "", nil
+	}
+	plaintext, err := json.Marshal([]string{owner.IDType, owner.ID})
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, e.owners.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(e.owners.Seal(nonce, nonce, plaintext, []byte(shareID))), nil
+}
+
+// decryptOwner returns the owner of the share identified by 'shareID' from
+// its encrypted form 'encrypted'.
+func (e *Expiring) decryptOwner(shareID, encrypted string) (svalbardsrv.RecipientID, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(sealed) < e.owners.NonceSize() {
+		return svalbardsrv.RecipientID{}, ErrInvalidOwner
+	}
+	n := e.owners.NonceSize()
+	plaintext, err := e.owners.Open(nil, sealed[:n], sealed[n:], []byte(shareID))
+	if err != nil {
+		return svalbardsrv.RecipientID{}, ErrInvalidOwner
+	}
+	var fields []string
+	if err := json.Unmarshal(plaintext, &fields); err != nil || len(fields) != 2 {
+		return svalbardsrv.RecipientID{}, ErrInvalidOwner
+	}
+	return svalbardsrv.RecipientID{IDType: fields[0], ID: fields[1]}, nil
+}
+
+// StartReaper starts the reaper, which reaps the store periodically (see
+// Reap) and reminds the owners with 'remind', if not nil.  It does nothing
+// if the reaper is disabled or already started.
+func (e *Expiring) StartReaper(remind Reminder) {
+	if e.policy.ReapInterval < 0 {
+		return
+	}
+	e.startOnce.Do(func() {
+		e.workers.Add(1)
+		go e.reap(remind)
+	})
+}
+
+// lock locks the operations on 'shareID', and returns the function that
+// unlocks them.
+func (e *Expiring) lock(shareID string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(shareID))
+	m := &e.locks[h.Sum32()%uint32(len(e.locks))]
+	m.Lock()
+	return m.Unlock
+}
+
+// readMetadata returns the metadata of the share identified by 'shareID',
+// and false if it has none.
+func (e *Expiring) readMetadata(shareID string) (metadata, bool, error) {
+	var m metadata
+	value, err := e.store.Retrieve(MetadataPrefix + shareID)
+	if err == svalbardsrv.ErrShareNotFound {
+		return m, false, nil
+	}
+	if err != nil {
+		return m, false, err
+	}
+	if err := json.Unmarshal([]byte(value), &m); err != nil {
+		return m, false, err
+	}
+	return m, true, nil
+}
+
+// writeMetadata replaces the metadata of the share identified by 'shareID'.
+// If the underlying store is a svalbardsrv.ReplacingShareStore, the record is
+// replaced atomically, so it is never lost, even if the store is full.
+// Otherwise the old record is deleted before the new one is stored, and
+// restored if storing the new one fails.
+func (e *Expiring) writeMetadata(shareID string, m metadata) error {
+	value, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if replacing, ok := e.store.(svalbardsrv.ReplacingShareStore); ok {
+		return replacing.Replace(MetadataPrefix+shareID, string(value))
+	}
+	old, err := e.store.Retrieve(MetadataPrefix + shareID)
+	if err != nil && err != svalbardsrv.ErrShareNotFound {
+		return err
+	}
+	if err := e.deleteMetadata(shareID); err != nil {
+		return err
+	}
+	err = e.store.Store(MetadataPrefix+shareID, string(value))
+	if err != nil && old != "" {
+		if rErr := e.store.Store(MetadataPrefix+shareID, old); rErr != nil {
+			slog.Error("share expiry: restoring of metadata failed", "share_id", shareID, "error", rErr)
+		}
+	}
+	return err
+}
+
+// deleteMetadata deletes the metadata of the share identified by 'shareID',
+// if any.
+func (e *Expiring) deleteMetadata(shareID string) error {
+	if err := e.store.Delete(MetadataPrefix + shareID); err != nil && err != svalbardsrv.ErrShareNotFound {
+		return err
+	}
+	return nil
+}
+
+// Store stores 'shareValue' under 'shareID' with the default period of the
+// policy, without an owner to remind.
+func (e *Expiring) Store(shareID, shareValue string) error {
+	return e.StoreWithExpiry(shareID, shareValue, svalbardsrv.RecipientID{}, "", 0)
+}
+
+// StoreWithExpiry stores 'shareValue' under 'shareID', to expire after
+// 'period' (or the default period of the policy, if zero) unless renewed.
+// The share is indexed under 'ownerKey', if given.
+func (e *Expiring) StoreWithExpiry(shareID, shareValue string, owner svalbardsrv.RecipientID, ownerKey string, period time.Duration) error {
+	if strings.HasPrefix(shareID, MetadataPrefix) {
+		return svalbardsrv.ErrInvalidShareID
+	}
+	if period < 0 || e.policy.MaxPeriod > 0 && period > e.policy.MaxPeriod {
+		return svalbardsrv.ErrInvalidExpiry
+	}
+	if period == 0 {
+		period = e.policy.DefaultPeriod
+	}
+	// Periods are kept in seconds.
+	if period > 0 && period < time.Second {
+		period = time.Second
+	}
+	defer e.lock(shareID)()
+	if err := e.storeShare(shareID, shareValue, ownerKey); err != nil {
+		return err
+	}
+	// Metadata left over from an earlier share with the same id must not
+	// apply to this one, so it is replaced or deleted.
+	var err error
+	if period > 0 {
+		var encryptedOwner string
+		if encryptedOwner, err = e.encryptOwner(shareID, owner); err == nil {
+			err = e.writeMetadata(shareID, metadata{
+				Owner:   encryptedOwner,
+				Period:  int64(period / time.Second),
+				Expires: e.now().Add(period).Unix(),
+			})
+		}
+	} else {
+		err = e.deleteMetadata(shareID)
+	}
+	if err != nil {
+		// Without its metadata the share would never expire.
+		if dErr := e.store.Delete(shareID); dErr != nil {
+			slog.Error("share expiry: deletion of share without metadata failed", "share_id", shareID, "error", dErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// storeShare stores 'shareValue' under 'shareID' in the underlying store,
+// indexed under 'ownerKey' if the store implements
+// svalbardsrv.OwnerIndexedShareStore and 'ownerKey' is given.
+func (e *Expiring) storeShare(shareID, shareValue, ownerKey string) error {
+	indexed, ok := e.store.(svalbardsrv.OwnerIndexedShareStore)
+	if !ok || ownerKey == "" {
+		return e.store.Store(shareID, shareValue)
+	}
+	return indexed.StoreForOwner(shareID, shareValue, ownerKey)
+}
+
+// CheckCapacity checks the capacity of the underlying store, if it
+// implements svalbardsrv.CapacityChecker.
+func (e *Expiring) CheckCapacity(shareID, ownerKey string) error {
+	if checker, ok := e.store.(svalbardsrv.CapacityChecker); ok {
+		return checker.CheckCapacity(shareID, ownerKey)
+	}
+	return nil
+}
+
+// Retrieve returns the value of the share identified by 'shareID'.  Shares
+// remain available until they are reaped.
+func (e *Expiring) Retrieve(shareID string) (string, error) {
+	if strings.HasPrefix(shareID, MetadataPrefix) {
+		return "", svalbardsrv.ErrInvalidShareID
+	}
+	return e.store.Retrieve(shareID)
+}
+
+// Contains returns true if the share identified by 'shareID' is present.
+func (e *Expiring) Contains(shareID string) (bool, error) {
+	if strings.HasPrefix(shareID, MetadataPrefix) {
+		return false, svalbardsrv.ErrInvalidShareID
+	}
+	if container, ok := e.store.(interface {
+		Contains(shareID string) (bool, error)
+	}); ok {
+		return container.Contains(shareID)
+	}
+	_, err := e.store.Retrieve(shareID)
+	if err == svalbardsrv.ErrShareNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Delete deletes the share identified by 'shareID', and its metadata.
+func (e *Expiring) Delete(shareID string) error {
+	if strings.HasPrefix(shareID, MetadataPrefix) {
+		return svalbardsrv.ErrInvalidShareID
+	}
+	defer e.lock(shareID)()
+	if err := e.deleteMetadata(shareID); err != nil {
+		return err
+	}
+	return e.store.Delete(shareID)
+}
+
+// recoverable returns the underlying store as a RecoverableShareStore, or
+// ErrSoftDeleteNotAvailable.
+func (e *Expiring) recoverable() (svalbardsrv.RecoverableShareStore, error) {
+	r, ok := e.store.(svalbardsrv.RecoverableShareStore)
+	if !ok {
+		return nil, svalbardsrv.ErrSoftDeleteNotAvailable
+	}
+	return r, nil
+}
+
+// SoftDelete deletes the share identified by 'shareID', but keeps it as a
+// tombstone in the underlying store until 'purgeAt'.  The metadata of the
+// share is kept with the tombstone, and deleted by the reaper once the
+// tombstone is purged.
+func (e *Expiring) SoftDelete(shareID string, purgeAt time.Time) error {
+	if strings.HasPrefix(shareID, MetadataPrefix) {
+		return svalbardsrv.ErrInvalidShareID
+	}
+	r, err := e.recoverable()
+	if err != nil {
+		return err
+	}
+	defer e.lock(shareID)()
+	return r.SoftDelete(shareID, purgeAt)
+}
+
+// Undelete restores the share identified by 'shareID' from its tombstone.
+// If the share expired while it was deleted, its expiry is postponed as by
+// Renew, so that it is not reaped right away.
+func (e *Expiring) Undelete(shareID string, now time.Time) error {
+	if strings.HasPrefix(shareID, MetadataPrefix) {
+		return svalbardsrv.ErrInvalidShareID
+	}
+	r, err := e.recoverable()
+	if err != nil {
+		return err
+	}
+	defer e.lock(shareID)()
+	if err := r.Undelete(shareID, now); err != nil {
+		return err
+	}
+	m, found, err := e.readMetadata(shareID)
+	if err != nil || !found || e.now().Before(m.expires()) {
+		return err
+	}
+	m.Expires = e.now().Add(time.Duration(m.Period) * time.Second).Unix()
+	m.Reminded = false
+	return e.writeMetadata(shareID, m)
+}
+
+// PurgeTime returns the purge time of the tombstone of the share identified
+// by 'shareID'.
+func (e *Expiring) PurgeTime(shareID string) (time.Time, error) {
+	if strings.HasPrefix(shareID, MetadataPrefix) {
+		return time.Time{}, svalbardsrv.ErrInvalidShareID
+	}
+	r, err := e.recoverable()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return r.PurgeTime(shareID)
+}
+
+// Purge removes the tombstones that are due for purging at 'now' from the
+// underlying store.
+func (e *Expiring) Purge(now time.Time) (int, error) {
+	r, err := e.recoverable()
+	if err != nil {
+		return 0, err
+	}
+	return r.Purge(now)
+}
+
+// Renew postpones the expiry of the share identified by 'shareID' to its
+// period from now, and returns the new expiry, or the zero time if the share
+// does not expire.  Expired shares cannot be renewed.
+func (e *Expiring) Renew(shareID string) (time.Time, error) {
+	if strings.HasPrefix(shareID, MetadataPrefix) {
+		return time.Time{}, svalbardsrv.ErrInvalidShareID
+	}
+	defer e.lock(shareID)()
+	if _, err := e.store.Retrieve(shareID); err != nil {
+		return time.Time{}, err
+	}
+	m, found, err := e.readMetadata(shareID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !found {
+		return time.Time{}, nil
+	}
+	now := e.now()
+	if !now.Before(m.expires()) {
+		return time.Time{}, svalbardsrv.ErrShareNotFound
+	}
+	m.Expires = now.Add(time.Duration(m.Period) * time.Second).Unix()
+	m.Reminded = false
+	if err := e.writeMetadata(shareID, m); err != nil {
+		return time.Time{}, err
+	}
+	return m.expires(), nil
+}
+
+// Expiry returns the expiry of the share identified by 'shareID', or the
+// zero time if the share does not expire.
+func (e *Expiring) Expiry(shareID string) (time.Time, error) {
+	if strings.HasPrefix(shareID, MetadataPrefix) {
+		return time.Time{}, svalbardsrv.ErrInvalidShareID
+	}
+	if _, err := e.store.Retrieve(shareID); err != nil {
+		return time.Time{}, err
+	}
+	m, found, err := e.readMetadata(shareID)
+	if err != nil || !found {
+		return time.Time{}, err
+	}
+	return m.expires(), nil
+}
+
+// listIDs returns the sorted ids of the shares, and of the shares that have
+// metadata records, in the underlying store.
+func (e *Expiring) listIDs() ([]string, []string, error) {
+	ids, err := e.store.(ShareIDLister).ShareIDs()
+	if err != nil {
+		return nil, nil, err
+	}
+	var shares, withMetadata []string
+	for _, id := range ids {
+		if strings.HasPrefix(id, MetadataPrefix) {
+			withMetadata = append(withMetadata, strings.TrimPrefix(id, MetadataPrefix))
+		} else {
+			shares = append(shares, id)
+		}
+	}
+	sort.Strings(shares)
+	sort.Strings(withMetadata)
+	return shares, withMetadata, nil
+}
+
+// ShareIDs returns the sorted ids of the shares in the store.
+func (e *Expiring) ShareIDs() ([]string, error) {
+	shares, _, err := e.listIDs()
+	return shares, err
+}
+
+// Count returns the number of shares in the store.
+func (e *Expiring) Count() (int, error) {
+	shares, _, err := e.listIDs()
+	return len(shares), err
+}
+
+// Report summarizes a run of the reaper.
+type Report struct {
+	// Expired is the number of expired shares that were deleted.
+	Expired int
+	// Reminded is the number of owners that were reminded.
+	Reminded int
+	// Orphans is the number of metadata records without shares that
+	// were deleted.
+	Orphans int
+	// Failed is the number of shares that could not be reaped, or whose
+	// owners could not be reminded.
+	Failed int
+}
+
+// Reap deletes the expired shares, and reminds the owners of the shares
+// that expire within the lead time of the policy with 'remind' (if not
+// nil).  Each owner is reminded once per period, and failed reminders are
+// retried in the next run.
+func (e *Expiring) Reap(remind Reminder) (Report, error) {
+	var report Report
+	_, ids, err := e.listIDs()
+	if err != nil {
+		return report, err
+	}
+	for _, id := range ids {
+		if err := e.reapShare(id, remind, &report); err != nil {
+			slog.Warn("share expiry: reaping of share failed", "share_id", id, "error", err)
+			report.Failed++
+		}
+	}
+	return report, nil
+}
+
+func (e *Expiring) reapShare(shareID string, remind Reminder, report *Report) error {
+	defer e.lock(shareID)()
+	m, found, err := e.readMetadata(shareID)
+	if err != nil || !found {
+		return err
+	}
+	_, err = e.store.Retrieve(shareID)
+	if err == svalbardsrv.ErrShareNotFound {
+		// The metadata of a soft-deleted share is kept for its undeletion.
+		if r, ok := e.store.(svalbardsrv.RecoverableShareStore); ok {
+			if _, err := r.PurgeTime(shareID); err != svalbardsrv.ErrShareNotFound {
+				return err
+			}
+		}
+		report.Orphans++
+		return e.deleteMetadata(shareID)
+	}
+	if err != nil {
+		return err
+	}
+	now := e.now()
+	if !now.Before(m.expires()) {
+		if err := e.deleteMetadata(shareID); err != nil {
+			return err
+		}
+		if err := e.store.Delete(shareID); err != nil && err != svalbardsrv.ErrShareNotFound {
+			return err
+		}
+		slog.Info("share expiry: deleted expired share", "share_id", shareID, "expires", m.expires())
+		report.Expired++
+		return nil
+	}
+	if remind == nil || m.Reminded || m.Owner == "" || e.owners == nil || e.policy.ReminderLeadTime < 0 ||
+		now.Before(m.expires().Add(-e.policy.ReminderLeadTime)) {
+		return nil
+	}
+	owner, err := e.decryptOwner(shareID, m.Owner)
+	if err != nil {
+		return err
+	}
+	if err := remind(shareID, owner, m.expires()); err != nil {
+		return err
+	}
+	report.Reminded++
+	m.Reminded = true
+	return e.writeMetadata(shareID, m)
+}
+
+// reap runs the reaper periodically.
+func (e *Expiring) reap(remind Reminder) {
+	defer e.workers.Done()
+	ticker := time.NewTicker(e.policy.ReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+		}
+		report, err := e.Reap(remind)
+		switch {
+		case err != nil:
+			slog.Error("share expiry: reaping failed", "error", err)
+		case report.Expired > 0 || report.Reminded > 0 || report.Orphans > 0 || report.Failed > 0:
+			slog.Info("share expiry: reaped", "expired", report.Expired, "reminded", report.Reminded,
+				"orphans", report.Orphans, "failed", report.Failed)
+		}
+	}
+}
+
+// CheckHealth checks the health of the underlying store, if it implements
+// svalbardsrv.HealthChecker.
+func (e *Expiring) CheckHealth() error {
+	if checker, ok := e.store.(svalbardsrv.HealthChecker); ok {
+		return checker.CheckHealth()
+	}
+	return nil
+}
+
+// Close stops the reaper, waiting for an ongoing run.  It does not close
+// the underlying store.
+func (e *Expiring) Close() error {
+	e.closeOnce.Do(func() {
+		close(e.done)
+	})
+	e.workers.Wait()
+	return nil
+}
@@ -0,0 +1,560 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package shareexpiry
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/svalbard/server/go/inmemorysharestore"
+	"github.com/google/svalbard/server/go/sharestoretest"
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+var errInjected = errors.New("injected failure")
+
+// clock is a fake clock for the tests.
+type clock struct {
+	mutex sync.Mutex
+	t     time.Time
+}
+
+func (c *clock) now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// reminders records the reminders sent, and fails them while 'fail' is set.
+type reminders struct {
+	mutex sync.Mutex
+	sent  []string
+	fail  bool
+}
+
+func (r *reminders) remind(shareID string, owner svalbardsrv.RecipientID, expires time.Time) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.fail {
+		return errInjected
+	}
+	r.sent = append(r.sent, shareID+" to "+owner.IDType+":"+owner.ID+" by "+expires.UTC().Format(time.RFC3339))
+	return nil
+}
+
+func (r *reminders) take() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	sent := r.sent
+	r.sent = nil
+	return sent
+}
+
+// failingStore is an underlying store that fails to store or replace
+// metadata records while 'fail' is set.
+type failingStore struct {
+	*inmemorysharestore.InMemory
+	fail bool
+}
+
+func (f *failingStore) Store(shareID, shareValue string) error {
+	if f.fail && strings.HasPrefix(shareID, MetadataPrefix) {
+		return errInjected
+	}
+	return f.InMemory.Store(shareID, shareValue)
+}
+
+func (f *failingStore) Replace(shareID, shareValue string) error {
+	if f.fail && strings.HasPrefix(shareID, MetadataPrefix) {
+		return errInjected
+	}
+	return f.InMemory.Replace(shareID, shareValue)
+}
+
+// fullStore is an underlying store that rejects the next 'rejects' new
+// shares with ErrStoreFull, but replaces existing ones, like the stores with
+// a maximal size.
+type fullStore struct {
+	*inmemorysharestore.InMemory
+	rejects int
+}
+
+func (f *fullStore) Store(shareID, shareValue string) error {
+	if f.rejects > 0 {
+		f.rejects--
+		return svalbardsrv.ErrStoreFull
+	}
+	return f.InMemory.Store(shareID, shareValue)
+}
+
+var (
+	start = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	alice = svalbardsrv.RecipientID{IDType: "EMAIL", ID: "alice@example.com"}
+	day   = 24 * time.Hour
+)
+
+// newStore returns an Expiring store in memory with 'policy', with the
+// reaper disabled, and its fake clock.
+func newStore(t *testing.T, policy Policy) (*Expiring, *inmemorysharestore.InMemory, *clock) {
+	inner := inmemorysharestore.New()
+	if policy.ReapInterval == 0 {
+		policy.ReapInterval = -1
+	}
+	e, err := New(inner, policy)
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+	if err := e.SetRecipientKey([]byte("recipient key")); err != nil {
+		t.Fatalf("SetRecipientKey(): %v", err)
+	}
+	c := &clock{t: start}
+	e.now = c.now
+	return e, inner, c
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		policy Policy
+		err    error
+	}{
+		{Policy{}, nil},
+		{Policy{DefaultPeriod: day, MaxPeriod: 10 * day}, nil},
+		{Policy{DefaultPeriod: day}, nil},
+		{Policy{DefaultPeriod: -day}, ErrInvalidPolicy},
+		{Policy{MaxPeriod: -day}, ErrInvalidPolicy},
+		{Policy{DefaultPeriod: 10 * day, MaxPeriod: day}, ErrInvalidPolicy},
+	}
+	for _, tt := range tests {
+		if _, err := New(inmemorysharestore.New(), tt.policy); err != tt.err {
+			t.Errorf("New(%+v): got [%v], want [%v]", tt.policy, err, tt.err)
+		}
+	}
+	type unlistable struct{ svalbardsrv.ShareStore }
+	if _, err := New(unlistable{inmemorysharestore.New()}, Policy{}); err != ErrNotListable {
+		t.Errorf("New() of unlistable store: got [%v], want [%v]", err, ErrNotListable)
+	}
+}
+
+func TestExpiringShareStore(t *testing.T) {
+	sharestoretest.Run(t, sharestoretest.Factory{
+		New: func(t *testing.T) svalbardsrv.ShareStore {
+			e, _, _ := newStore(t, Policy{DefaultPeriod: day})
+			return e
+		},
+	})
+}
+
+func TestStoreWithExpiry(t *testing.T) {
+	e, inner, _ := newStore(t, Policy{DefaultPeriod: 30 * day, MaxPeriod: 3650 * day})
+	tests := []struct {
+		shareID string
+		period  time.Duration
+		err     error
+		expires time.Time
+	}{
+		{"share1", 0, nil, start.Add(30 * day)},
+		{"share2", 3650 * day, nil, start.Add(3650 * day)},
+		{"share3", time.Millisecond, nil, start.Add(time.Second)},
+		{"share4", 3651 * day, svalbardsrv.ErrInvalidExpiry, time.Time{}},
+		{"share5", -time.Second, svalbardsrv.ErrInvalidExpiry, time.Time{}},
+		{"share1", day, svalbardsrv.ErrShareAlreadyExists, time.Time{}},
+		{"expiry:share1", day, svalbardsrv.ErrInvalidShareID, time.Time{}},
+	}
+	for _, tt := range tests {
+		if err := e.StoreWithExpiry(tt.shareID, "value", alice, "", tt.period); err != tt.err {
+			t.Errorf("StoreWithExpiry(%q, %v): got [%v], want [%v]", tt.shareID, tt.period, err, tt.err)
+			continue
+		}
+		if tt.err != nil {
+			continue
+		}
+		if expires, err := e.Expiry(tt.shareID); !expires.Equal(tt.expires) || err != nil {
+			t.Errorf("Expiry(%q): got [%v, %v], want [%v, nil]", tt.shareID, expires, err, tt.expires)
+		}
+	}
+	// The metadata records are kept out of sight.
+	want := []string{"share1", "share2", "share3"}
+	if ids, err := e.ShareIDs(); !reflect.DeepEqual(ids, want) || err != nil {
+		t.Errorf("ShareIDs(): got [%v, %v], want [%v, nil]", ids, err, want)
+	}
+	if n, err := e.Count(); n != 3 || err != nil {
+		t.Errorf("Count(): got [%v, %v], want [3, nil]", n, err)
+	}
+	if ids, _ := inner.ShareIDs(); len(ids) != 6 {
+		t.Errorf("ShareIDs() of underlying store: got %v, want 3 shares and 3 metadata records", ids)
+	}
+
+	// Deletion removes the metadata as well.
+	if err := e.Delete("share1"); err != nil {
+		t.Errorf("Delete(%q): got [%v], want [nil]", "share1", err)
+	}
+	if _, err := inner.Retrieve(MetadataPrefix + "share1"); err != svalbardsrv.ErrShareNotFound {
+		t.Errorf("Retrieve() of metadata of deleted share: got [%v], want [%v]", err, svalbardsrv.ErrShareNotFound)
+	}
+
+	// Shares are indexed under the given owner key only.
+	if err := e.StoreWithExpiry("share6", "value", alice, "alice-key", day); err != nil {
+		t.Fatalf("StoreWithExpiry(): %v", err)
+	}
+	if ids, err := inner.OwnerShareIDs("alice-key"); !reflect.DeepEqual(ids, []string{"share6"}) || err != nil {
+		t.Errorf("OwnerShareIDs(): got [%v, %v], want [%v, nil]", ids, err, []string{"share6"})
+	}
+}
+
+func TestNeverExpiringShares(t *testing.T) {
+	e, inner, c := newStore(t, Policy{})
+	if err := e.Store("share1", "value1"); err != nil {
+		t.Fatalf("Store(): %v", err)
+	}
+	// A share stored before the expiry was enabled.
+	if err := inner.Store("share2", "value2"); err != nil {
+		t.Fatalf("Store(): %v", err)
+	}
+	if err := e.StoreWithExpiry("share3", "value3", alice, "", day); err != nil {
+		t.Fatalf("StoreWithExpiry(): %v", err)
+	}
+	c.advance(100 * 365 * day)
+	if report, err := e.Reap(nil); report != (Report{Expired: 1}) || err != nil {
+		t.Errorf("Reap(): got [%+v, %v], want [{Expired:1}, nil]", report, err)
+	}
+	want := []string{"share1", "share2"}
+	if ids, err := e.ShareIDs(); !reflect.DeepEqual(ids, want) || err != nil {
+		t.Errorf("ShareIDs(): got [%v, %v], want [%v, nil]", ids, err, want)
+	}
+	for _, id := range want {
+		if expires, err := e.Renew(id); !expires.IsZero() || err != nil {
+			t.Errorf("Renew(%q): got [%v, %v], want [zero time, nil]", id, expires, err)
+		}
+	}
+}
+
+func TestReap(t *testing.T) {
+	e, inner, c := newStore(t, Policy{ReminderLeadTime: 7 * day})
+	r := &reminders{}
+	for _, share := range []struct {
+		id     string
+		period time.Duration
+		owner  svalbardsrv.RecipientID
+	}{
+		{"share1", 10 * day, alice},
+		{"share2", 20 * day, alice},
+		{"share3", 10 * day, svalbardsrv.RecipientID{}},
+	} {
+		if err := e.StoreWithExpiry(share.id, "value", share.owner, "", share.period); err != nil {
+			t.Fatalf("StoreWithExpiry(%q): %v", share.id, err)
+		}
+	}
+	steps := []struct {
+		advance   time.Duration
+		fail      bool
+		report    Report
+		reminders []string
+		ids       []string
+	}{
+		{day, false, Report{}, nil, []string{"share1", "share2", "share3"}},
+		// Reminders are sent within the lead time, but only to known owners.
+		{2 * day, false, Report{Reminded: 1}, []string{"share1 to EMAIL:alice@example.com by 2026-01-11T00:00:00Z"},
+			[]string{"share1", "share2", "share3"}},
+		// Each owner is reminded once.
+		{day, false, Report{}, nil, []string{"share1", "share2", "share3"}},
+		// Expired shares are deleted.
+		{6 * day, false, Report{Expired: 2}, nil, []string{"share2"}},
+		// Failed reminders are retried.
+		{4 * day, true, Report{Failed: 1}, nil, []string{"share2"}},
+		{time.Hour, false, Report{Reminded: 1}, []string{"share2 to EMAIL:alice@example.com by 2026-01-21T00:00:00Z"},
+			[]string{"share2"}},
+		{7 * day, false, Report{Expired: 1}, nil, nil},
+	}
+	for i, step := range steps {
+		c.advance(step.advance)
+		r.fail = step.fail
+		report, err := e.Reap(r.remind)
+		if report != step.report || err != nil {
+			t.Errorf("Reap() in step %d: got [%+v, %v], want [%+v, nil]", i, report, err, step.report)
+		}
+		if sent := r.take(); !reflect.DeepEqual(sent, step.reminders) {
+			t.Errorf("reminders in step %d: got %q, want %q", i, sent, step.reminders)
+		}
+		if ids, _ := e.ShareIDs(); !reflect.DeepEqual(ids, step.ids) {
+			t.Errorf("ShareIDs() in step %d: got %v, want %v", i, ids, step.ids)
+		}
+	}
+	if ids, _ := inner.ShareIDs(); len(ids) != 0 {
+		t.Errorf("ShareIDs() of underlying store: got %v, want none", ids)
+	}
+}
+
+func TestOwnersAreEncrypted(t *testing.T) {
+	e, inner, c := newStore(t, Policy{ReminderLeadTime: 7 * day})
+	for _, id := range []string{"share1", "share2"} {
+		if err := e.StoreWithExpiry(id, "value", alice, "", 10*day); err != nil {
+			t.Fatalf("StoreWithExpiry(%q): %v", id, err)
+		}
+	}
+	value, err := inner.Retrieve(MetadataPrefix + "share1")
+	if err != nil {
+		t.Fatalf("Retrieve() of metadata: %v", err)
+	}
+	if strings.Contains(value, alice.ID) || strings.Contains(value, alice.IDType) {
+		t.Errorf("metadata: got %s, want no plaintext owner", value)
+	}
+	// An owner moved to another share is rejected.
+	inner.Delete(MetadataPrefix + "share2")
+	inner.Store(MetadataPrefix+"share2", value)
+	c.advance(5 * day)
+	r := &reminders{}
+	if report, err := e.Reap(r.remind); report != (Report{Reminded: 1, Failed: 1}) || err != nil {
+		t.Errorf("Reap() with a moved owner: got [%+v, %v], want [%+v, nil]", report, err, Report{Reminded: 1, Failed: 1})
+	}
+	if sent := r.take(); !reflect.DeepEqual(sent, []string{"share1 to EMAIL:alice@example.com by 2026-01-11T00:00:00Z"}) {
+		t.Errorf("reminders: got %q, want only share1", sent)
+	}
+
+	// Without a recipient key, owners are neither kept nor reminded.
+	e, err = New(inner, Policy{ReminderLeadTime: 7 * day, ReapInterval: -1})
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+	e.now = c.now
+	if err := e.StoreWithExpiry("share3", "value", alice, "", 2*day); err != nil {
+		t.Fatalf("StoreWithExpiry(): %v", err)
+	}
+	if value, _ := inner.Retrieve(MetadataPrefix + "share3"); strings.Contains(value, "owner") {
+		t.Errorf("metadata without recipient key: got %s, want no owner", value)
+	}
+	if report, err := e.Reap(r.remind); report != (Report{}) || err != nil {
+		t.Errorf("Reap() without recipient key: got [%+v, %v], want [%+v, nil]", report, err, Report{})
+	}
+}
+
+func TestRenew(t *testing.T) {
+	e, _, c := newStore(t, Policy{ReminderLeadTime: 7 * day})
+	r := &reminders{}
+	if err := e.StoreWithExpiry("share1", "value", alice, "", 10*day); err != nil {
+		t.Fatalf("StoreWithExpiry(): %v", err)
+	}
+	c.advance(5 * day)
+	if _, err := e.Reap(r.remind); err != nil || len(r.take()) != 1 {
+		t.Fatalf("Reap(): got error %v, want a reminder", err)
+	}
+	// Renewal postpones the expiry by the period, and enables the reminder
+	// for the next period.
+	if expires, err := e.Renew("share1"); !expires.Equal(start.Add(15*day)) || err != nil {
+		t.Errorf("Renew(): got [%v, %v], want [%v, nil]", expires, err, start.Add(15*day))
+	}
+	c.advance(5 * day)
+	if report, err := e.Reap(r.remind); report != (Report{Reminded: 1}) || err != nil {
+		t.Errorf("Reap() after renewal: got [%+v, %v], want [{Reminded:1}, nil]", report, err)
+	}
+	r.take()
+
+	// Expired shares cannot be renewed, even before they are reaped.
+	c.advance(5 * day)
+	if _, err := e.Renew("share1"); err != svalbardsrv.ErrShareNotFound {
+		t.Errorf("Renew() of expired share: got [%v], want [%v]", err, svalbardsrv.ErrShareNotFound)
+	}
+	if _, err := e.Renew("share2"); err != svalbardsrv.ErrShareNotFound {
+		t.Errorf("Renew() of missing share: got [%v], want [%v]", err, svalbardsrv.ErrShareNotFound)
+	}
+}
+
+func TestOrphanedMetadata(t *testing.T) {
+	e, inner, c := newStore(t, Policy{})
+	// Metadata of a share that is gone, e.g. after a crash.
+	if err := e.StoreWithExpiry("share1", "value", alice, "", day); err != nil {
+		t.Fatalf("StoreWithExpiry(): %v", err)
+	}
+	if err := inner.Delete("share1"); err != nil {
+		t.Fatalf("Delete(): %v", err)
+	}
+	// A share stored later with the same id does not inherit the metadata.
+	if err := e.StoreWithExpiry("share2", "value", alice, "", day); err != nil {
+		t.Fatalf("StoreWithExpiry(): %v", err)
+	}
+	if err := inner.Delete("share2"); err != nil {
+		t.Fatalf("Delete(): %v", err)
+	}
+	if err := e.Store("share2", "value"); err != nil {
+		t.Fatalf("Store(): %v", err)
+	}
+	c.advance(2 * day)
+	if report, err := e.Reap(nil); report != (Report{Orphans: 1}) || err != nil {
+		t.Errorf("Reap(): got [%+v, %v], want [{Orphans:1}, nil]", report, err)
+	}
+	want := []string{"share2"}
+	if ids, err := inner.ShareIDs(); !reflect.DeepEqual(ids, want) || err != nil {
+		t.Errorf("ShareIDs() of underlying store: got [%v, %v], want [%v, nil]", ids, err, want)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	e, _, c := newStore(t, Policy{})
+	if err := e.StoreWithExpiry("share1", "value", alice, "", day); err != nil {
+		t.Fatalf("StoreWithExpiry(): %v", err)
+	}
+	if err := e.SoftDelete("share1", start.Add(7*day)); err != nil {
+		t.Fatalf("SoftDelete(): %v", err)
+	}
+	// The metadata of the tombstone is kept, even after the share expired.
+	c.advance(2 * day)
+	if report, err := e.Reap(nil); report != (Report{}) || err != nil {
+		t.Errorf("Reap() with tombstone: got [%+v, %v], want [{}, nil]", report, err)
+	}
+	if err := e.Undelete("share1", c.now()); err != nil {
+		t.Fatalf("Undelete(): %v", err)
+	}
+	// The expired share is not reaped right after its undeletion.
+	want := c.now().Add(day)
+	if got, err := e.Expiry("share1"); !got.Equal(want) || err != nil {
+		t.Errorf("Expiry() after Undelete(): got [%v, %v], want [%v, nil]", got, err, want)
+	}
+	if report, err := e.Reap(nil); report != (Report{}) || err != nil {
+		t.Errorf("Reap() after Undelete(): got [%+v, %v], want [{}, nil]", report, err)
+	}
+
+	// The metadata of a purged tombstone is an orphan.
+	if err := e.SoftDelete("share1", c.now().Add(day)); err != nil {
+		t.Fatalf("SoftDelete(): %v", err)
+	}
+	if n, err := e.Purge(c.now().Add(day)); n != 1 || err != nil {
+		t.Errorf("Purge(): got [%v, %v], want [1, nil]", n, err)
+	}
+	if report, err := e.Reap(nil); report != (Report{Orphans: 1}) || err != nil {
+		t.Errorf("Reap() after Purge(): got [%+v, %v], want [{Orphans:1}, nil]", report, err)
+	}
+	if err := e.SoftDelete(MetadataPrefix+"share1", start); err != svalbardsrv.ErrInvalidShareID {
+		t.Errorf("SoftDelete() of metadata: got [%v], want [%v]", err, svalbardsrv.ErrInvalidShareID)
+	}
+}
+
+func TestSoftDeleteNotAvailable(t *testing.T) {
+	inner := inmemorysharestore.New()
+	e, err := New(struct {
+		svalbardsrv.ShareStore
+		ShareIDLister
+	}{inner, inner}, Policy{ReapInterval: -1})
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+	if err := e.SoftDelete("share1", start); err != svalbardsrv.ErrSoftDeleteNotAvailable {
+		t.Errorf("SoftDelete(): got [%v], want [%v]", err, svalbardsrv.ErrSoftDeleteNotAvailable)
+	}
+	if _, err := e.PurgeTime("share1"); err != svalbardsrv.ErrSoftDeleteNotAvailable {
+		t.Errorf("PurgeTime(): got [%v], want [%v]", err, svalbardsrv.ErrSoftDeleteNotAvailable)
+	}
+}
+
+func TestFailedMetadataWrite(t *testing.T) {
+	inner := &failingStore{InMemory: inmemorysharestore.New(), fail: true}
+	e, err := New(inner, Policy{ReapInterval: -1})
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+	// A share that could not get its metadata is not stored at all.
+	if err := e.StoreWithExpiry("share1", "value", alice, "", day); err != errInjected {
+		t.Errorf("StoreWithExpiry(): got [%v], want [%v]", err, errInjected)
+	}
+	if ids, _ := inner.ShareIDs(); len(ids) != 0 {
+		t.Errorf("ShareIDs() of underlying store: got %v, want none", ids)
+	}
+	inner.fail = false
+	if err := e.StoreWithExpiry("share1", "value", alice, "", day); err != nil {
+		t.Errorf("StoreWithExpiry() after failure: got [%v], want [nil]", err)
+	}
+}
+
+func TestMetadataWriteIntoFullStore(t *testing.T) {
+	inner := &fullStore{InMemory: inmemorysharestore.New()}
+	var tests = []struct {
+		desc  string
+		store svalbardsrv.ShareStore
+	}{
+		{"replacing store", inner},
+		// Without Replace, the old record is restored.
+		{"other store", struct {
+			svalbardsrv.ShareStore
+			ShareIDLister
+		}{inner, inner}},
+	}
+	for _, tt := range tests {
+		e, err := New(tt.store, Policy{ReapInterval: -1})
+		if err != nil {
+			t.Fatalf("New(): %v", err)
+		}
+		c := &clock{t: start}
+		e.now = c.now
+		if err := e.StoreWithExpiry("share1", "value", alice, "", day); err != nil {
+			t.Fatalf("StoreWithExpiry(): %v", err)
+		}
+		c.advance(time.Hour)
+		inner.rejects = 1
+		want, wantErr := start.Add(time.Hour+day), error(nil)
+		if _, replacing := tt.store.(svalbardsrv.ReplacingShareStore); !replacing {
+			want, wantErr = start.Add(day), svalbardsrv.ErrStoreFull
+		}
+		if _, err := e.Renew("share1"); err != wantErr {
+			t.Errorf("Renew() in full %s: got [%v], want [%v]", tt.desc, err, wantErr)
+		}
+		// The share keeps its metadata in any case.
+		if expires, err := e.Expiry("share1"); !expires.Equal(want) || err != nil {
+			t.Errorf("Expiry() after Renew() in full %s: got [%v, %v], want [%v, nil]", tt.desc, expires, err, want)
+		}
+		inner.rejects = 0
+		if err := e.Delete("share1"); err != nil {
+			t.Fatalf("Delete(): %v", err)
+		}
+	}
+}
+
+func TestBackgroundReaper(t *testing.T) {
+	e, _, c := newStore(t, Policy{ReapInterval: time.Millisecond})
+	r := &reminders{}
+	e.StartReaper(r.remind)
+	defer e.Close()
+	if err := e.StoreWithExpiry("share1", "value", alice, "", 100*day); err != nil {
+		t.Fatalf("StoreWithExpiry(): %v", err)
+	}
+	waitFor := func(desc string, done func() bool) {
+		deadline := time.Now().Add(10 * time.Second)
+		for !done() {
+			if time.Now().After(deadline) {
+				t.Fatalf("reaper did not %s in time", desc)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	c.advance(80 * day)
+	waitFor("remind the owner", func() bool { return len(r.take()) > 0 })
+	c.advance(30 * day)
+	waitFor("delete the expired share", func() bool {
+		n, err := e.Count()
+		return err == nil && n == 0
+	})
+	if err := e.Close(); err != nil {
+		t.Errorf("Close(): got [%v], want [nil]", err)
+	}
+}
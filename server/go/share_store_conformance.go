@@ -0,0 +1,766 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Package sharestoretest offers a test suite that checks the behaviour
+// common to all ShareStore implementations, so that every implementation
+// gives the same guarantees to the server.
+package sharestoretest
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+// canonicalErrors are the errors that ShareStores return for invalid
+// operations.
+var canonicalErrors = []error{
+	svalbardsrv.ErrInvalidShareID,
+	svalbardsrv.ErrInvalidShareValue,
+	svalbardsrv.ErrShareAlreadyExists,
+	svalbardsrv.ErrShareNotFound,
+	svalbardsrv.ErrQuotaExceeded,
+	svalbardsrv.ErrStoreFull,
+}
+
+// Factory creates the ShareStores under test.
+type Factory struct {
+	// New returns an empty ShareStore.
+	New func(t *testing.T) svalbardsrv.ShareStore
+	// Reopen (optional) closes 's', and returns a ShareStore that reads the
+	// same persistent storage.  If it is nil, the tests of persistence are
+	// skipped.
+	Reopen func(t *testing.T, s svalbardsrv.ShareStore) svalbardsrv.ShareStore
+}
+
+// shareContainer is implemented by ShareStores that can check for the
+// presence of shares without retrieving them.
+type shareContainer interface {
+	Contains(shareID string) (bool, error)
+}
+
+// shareIDLister is implemented by ShareStores that can list their shares.
+type shareIDLister interface {
+	ShareIDs() ([]string, error)
+}
+
+// quotaSetter is implemented by ShareStores that limit the number of shares
+// indexed under an owner.
+type quotaSetter interface {
+	SetMaxSharesPerOwner(n int)
+}
+
+// Run runs the test suite on the ShareStores created by 'factory', which
+// creates a new store for each test.  The tests of optional methods, e.g.
+// Count() or Contains(), are skipped for ShareStores that do not implement
+// them, as are the tests of soft deletion, of owner quotas and of replacement
+// for ShareStores that do not implement svalbardsrv.RecoverableShareStore,
+// svalbardsrv.OwnerIndexedShareStore or svalbardsrv.ReplacingShareStore,
+// respectively.  The stores that
+// implement io.Closer are closed after each test.
+func Run(t *testing.T, factory Factory) {
+	for _, test := range []struct {
+		name string
+		run  func(t *testing.T, f Factory, s svalbardsrv.ShareStore) svalbardsrv.ShareStore
+	}{
+		{"StoresAndRetrievesShares", testStoresAndRetrievesShares},
+		{"StoresAndDeletesShares", testStoresAndDeletesShares},
+		{"OperationErrors", testOperationErrors},
+		{"Count", testCount},
+		{"Contains", testContains},
+		{"ShareIDs", testShareIDs},
+		{"LargeValues", testLargeValues},
+		{"UnicodeIDs", testUnicodeIDs},
+		{"ConcurrentOperations", testConcurrentOperations},
+		{"ConcurrentStores", testConcurrentStores},
+		{"Persistence", testPersistence},
+		{"SoftDelete", testSoftDelete},
+		{"OwnerQuota", testOwnerQuota},
+		{"Replace", testReplace},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			s := test.run(t, factory, factory.New(t))
+			if c, ok := s.(io.Closer); ok {
+				if err := c.Close(); err != nil {
+					t.Errorf("Close(): %v", err)
+				}
+			}
+		})
+	}
+}
+
+// operation is an operation on a ShareStore, and its expected outcome.
+type operation struct {
+	op      string // Operation on a ShareStore object
+	shareID string
+	value   string
+	err     error
+}
+
+func runOperations(t *testing.T, s svalbardsrv.ShareStore, tests []operation) {
+	for i, tt := range tests {
+		var err error
+		var value string
+		switch tt.op {
+		case "Store":
+			err = s.Store(tt.shareID, tt.value)
+		case "Delete":
+			err = s.Delete(tt.shareID)
+		case "Retrieve":
+			value, err = s.Retrieve(tt.shareID)
+		default:
+			panic("Unknown operation: " + tt.op)
+		}
+		if err != tt.err {
+			t.Errorf("Unexpected err of test #%d, %s(%q): got [%q], want[%q]",
+				i, tt.op, tt.shareID, err, tt.err)
+		}
+		if tt.op == "Retrieve" && err == nil && value != tt.value {
+			t.Errorf("Unexpected value of test #%d, Retrieve(%q): got [%q], want[%q]",
+				i, tt.shareID, value, tt.value)
+		}
+	}
+}
+
+func testStoresAndRetrievesShares(t *testing.T, f Factory, s svalbardsrv.ShareStore) svalbardsrv.ShareStore {
+	runOperations(t, s, []operation{
+		// Add share42 and verify it exitsts.
+		{"Store", "share42", "some value", nil},
+		{"Retrieve", "share42", "some value", nil},
+		// Add share23 and verify it exitsts.
+		{"Store", "share23", "some other value", nil},
+		{"Retrieve", "share23", "some other value", nil},
+		// Add a bunch of new shares.
+		{"Store", "share1", "some value 1", nil},
+		{"Store", "share2", "some value 2", nil},
+		{"Store", "share3", "some value 3", nil},
+		{"Store", "share4", "some value 4", nil},
+		{"Store", "share5", "some value 5", nil},
+		{"Store", "share6", "some value 6", nil},
+		{"Store", "share7", "some value 7", nil},
+		{"Store", "share8", "some value 8", nil},
+		{"Store", "share9", "some value 9", nil},
+		// Check all stored shares exist.
+		{"Retrieve", "share42", "some value", nil},
+		{"Retrieve", "share23", "some other value", nil},
+		{"Retrieve", "share1", "some value 1", nil},
+		{"Retrieve", "share2", "some value 2", nil},
+		{"Retrieve", "share3", "some value 3", nil},
+		{"Retrieve", "share4", "some value 4", nil},
+		{"Retrieve", "share5", "some value 5", nil},
+		{"Retrieve", "share6", "some value 6", nil},
+		{"Retrieve", "share7", "some value 7", nil},
+		{"Retrieve", "share8", "some value 8", nil},
+		{"Retrieve", "share9", "some value 9", nil},
+		// Shares cannot be overwritten.
+		{"Store", "share42", "some new value", svalbardsrv.ErrShareAlreadyExists},
+		{"Retrieve", "share42", "some value", nil},
+	})
+	return s
+}
+
+func testStoresAndDeletesShares(t *testing.T, f Factory, s svalbardsrv.ShareStore) svalbardsrv.ShareStore {
+	runOperations(t, s, []operation{
+		// Add a bunch of shares.
+		{"Store", "share1", "some value 1", nil},
+		{"Store", "share2", "some value 2", nil},
+		{"Store", "share3", "some value 3", nil},
+		{"Store", "share4", "some value 4", nil},
+		{"Store", "share5", "some value 5", nil},
+		{"Store", "share6", "some value 6", nil},
+		{"Store", "share7", "some value 7", nil},
+		{"Store", "share8", "some value 8", nil},
+		{"Store", "share9", "some value 9", nil},
+		// Delete some of the shares, check that they are deleted.
+		{"Delete", "share1", "", nil},
+		{"Delete", "share3", "", nil},
+		{"Delete", "share5", "", nil},
+		{"Delete", "share7", "", nil},
+		{"Delete", "share9", "", nil},
+		{"Retrieve", "share1", "", svalbardsrv.ErrShareNotFound},
+		{"Retrieve", "share3", "", svalbardsrv.ErrShareNotFound},
+		{"Retrieve", "share5", "", svalbardsrv.ErrShareNotFound},
+		{"Retrieve", "share7", "", svalbardsrv.ErrShareNotFound},
+		{"Retrieve", "share9", "", svalbardsrv.ErrShareNotFound},
+		// Non-deleted shares still exist.
+		{"Retrieve", "share2", "some value 2", nil},
+		{"Retrieve", "share4", "some value 4", nil},
+		{"Retrieve", "share6", "some value 6", nil},
+		{"Retrieve", "share8", "some value 8", nil},
+		// Deleted shares can be stored again.
+		{"Store", "share1", "some new value 1", nil},
+		{"Retrieve", "share1", "some new value 1", nil},
+	})
+	return s
+}
+
+func testOperationErrors(t *testing.T, f Factory, s svalbardsrv.ShareStore) svalbardsrv.ShareStore {
+	runOperations(t, s, []operation{
+		// Invalid requests.
+		{"Store", "", "some value", svalbardsrv.ErrInvalidShareID},
+		{"Retrieve", "", "some value", svalbardsrv.ErrInvalidShareID},
+		{"Delete", "", "some value", svalbardsrv.ErrInvalidShareID},
+		{"Store", "someShareID", "", svalbardsrv.ErrInvalidShareValue},
+		// share42 does not exist yet.
+		{"Retrieve", "share42", "some other value", svalbardsrv.ErrShareNotFound},
+		// Add share42 and verify it exitsts.
+		{"Store", "share42", "some other value", nil},
+		{"Retrieve", "share42", "some other value", nil},
+		// Delete share42.
+		{"Delete", "share42", "", nil},
+		{"Retrieve", "share42", "some other value", svalbardsrv.ErrShareNotFound},
+		// Try deleting non-existing shares.
+		{"Delete", "share42", "", svalbardsrv.ErrShareNotFound},
+		{"Delete", "someOtherShare", "", svalbardsrv.ErrShareNotFound},
+	})
+	return s
+}
+
+func testCount(t *testing.T, f Factory, s svalbardsrv.ShareStore) svalbardsrv.ShareStore {
+	counter, ok := s.(svalbardsrv.ShareCounter)
+	if !ok {
+		t.Skip("ShareStore does not implement ShareCounter")
+	}
+	tests := []struct {
+		op      string // Operation on a ShareStore object
+		shareID string
+		count   int // expected count after the operation
+	}{
+		{"Store", "share1", 1},
+		{"Store", "share2", 2},
+		{"Store", "share2", 2},
+		{"Delete", "share1", 1},
+		{"Delete", "share1", 1},
+		{"Delete", "share2", 0},
+	}
+	for _, tt := range tests {
+		switch tt.op {
+		case "Store":
+			s.Store(tt.shareID, "some value")
+		case "Delete":
+			s.Delete(tt.shareID)
+		default:
+			panic("Unknown operation: " + tt.op)
+		}
+		if count, err := counter.Count(); err != nil || count != tt.count {
+			t.Errorf("Count() after %s(%q): got [%v, %v], want [%v, nil]", tt.op, tt.shareID, count, err, tt.count)
+		}
+	}
+	return s
+}
+
+func testContains(t *testing.T, f Factory, s svalbardsrv.ShareStore) svalbardsrv.ShareStore {
+	c, ok := s.(shareContainer)
+	if !ok {
+		t.Skip("ShareStore does not implement Contains()")
+	}
+	s.Store("share1", "some value")
+	tests := []struct {
+		shareID string
+		want    bool
+		err     error
+	}{
+		{"share1", true, nil},
+		{"share2", false, nil},
+		{"", false, svalbardsrv.ErrInvalidShareID},
+	}
+	for _, tt := range tests {
+		if got, err := c.Contains(tt.shareID); got != tt.want || err != tt.err {
+			t.Errorf("Contains(%q): got [%v, %v], want [%v, %v]", tt.shareID, got, err, tt.want, tt.err)
+		}
+	}
+	return s
+}
+
+func testShareIDs(t *testing.T, f Factory, s svalbardsrv.ShareStore) svalbardsrv.ShareStore {
+	lister, ok := s.(shareIDLister)
+	if !ok {
+		t.Skip("ShareStore does not implement ShareIDs()")
+	}
+	if ids, err := lister.ShareIDs(); len(ids) != 0 || err != nil {
+		t.Errorf("ShareIDs() of empty store: got [%v, %v], want [[], nil]", ids, err)
+	}
+	for _, id := range []string{"share2", "share1", "share3", "Share4"} {
+		s.Store(id, "some value")
+	}
+	s.Delete("share3")
+	want := []string{"Share4", "share1", "share2"}
+	if ids, err := lister.ShareIDs(); !reflect.DeepEqual(ids, want) || err != nil {
+		t.Errorf("ShareIDs(): got [%v, %v], want [%v, nil]", ids, err, want)
+	}
+	return s
+}
+
+// largeValue returns a value of 'n' bytes that contains every byte value,
+// and is not valid UTF-8.
+func largeValue(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return string(b)
+}
+
+func testLargeValues(t *testing.T, f Factory, s svalbardsrv.ShareStore) svalbardsrv.ShareStore {
+	values := map[string]string{
+		"share1": largeValue(1 << 20),
+		"share2": largeValue(256),
+		"share3": "\x00",
+		"share4": strings.Repeat("some value ", 10000),
+	}
+	for id, value := range values {
+		if err := s.Store(id, value); err != nil {
+			t.Errorf("Store(%q) of %d bytes: got [%v], want [nil]", id, len(value), err)
+		}
+	}
+	for id, want := range values {
+		if got, err := s.Retrieve(id); got != want || err != nil {
+			t.Errorf("Retrieve(%q): got %d bytes and [%v], want the stored %d bytes and [nil]", id, len(got), err, len(want))
+		}
+	}
+	return s
+}
+
+// unicodeIDs are share IDs that differ only in their encoding, case or
+// normalization, and have to be kept apart.
+var unicodeIDs = []string{
+	"share-\u00e9",  // e with acute accent, precomposed
+	"share-e\u0301", // e with combining acute accent
+	"share-\u00c9",  // capital E with acute accent
+	"\u5206\u4eab",  // Chinese
+	"\U0001f511",    // key emoji
+	"share id with spaces",
+	"share/with/slashes",
+}
+
+func testUnicodeIDs(t *testing.T, f Factory, s svalbardsrv.ShareStore) svalbardsrv.ShareStore {
+	for i, id := range unicodeIDs {
+		if err := s.Store(id, fmt.Sprintf("some value %d", i)); err != nil {
+			t.Errorf("Store(%q): got [%v], want [nil]", id, err)
+		}
+	}
+	for i, id := range unicodeIDs {
+		want := fmt.Sprintf("some value %d", i)
+		if got, err := s.Retrieve(id); got != want || err != nil {
+			t.Errorf("Retrieve(%q): got [%q, %v], want [%q, nil]", id, got, err, want)
+		}
+	}
+	if err := s.Delete(unicodeIDs[0]); err != nil {
+		t.Errorf("Delete(%q): got [%v], want [nil]", unicodeIDs[0], err)
+	}
+	if _, err := s.Retrieve(unicodeIDs[1]); err != nil {
+		t.Errorf("Retrieve(%q) after Delete(%q): got [%v], want [nil]", unicodeIDs[1], unicodeIDs[0], err)
+	}
+	return s
+}
+
+// checkCanonical reports errors that are not canonical.
+func checkCanonical(t *testing.T, op, shareID string, err error) {
+	if err == nil {
+		return
+	}
+	for _, canonical := range canonicalErrors {
+		if err == canonical {
+			return
+		}
+	}
+	t.Errorf("%s(%q): got non-canonical error [%v]", op, shareID, err)
+}
+
+func testConcurrentOperations(t *testing.T, f Factory, s svalbardsrv.ShareStore) svalbardsrv.ShareStore {
+	const workers, shares = 8, 20
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < shares; i++ {
+				id, value := fmt.Sprintf("share-%d-%d", w, i), fmt.Sprintf("some value %d %d", w, i)
+				if err := s.Store(id, value); err != nil {
+					t.Errorf("Store(%q): got [%v], want [nil]", id, err)
+				}
+				if got, err := s.Retrieve(id); got != value || err != nil {
+					t.Errorf("Retrieve(%q): got [%q, %v], want [%q, nil]", id, got, err, value)
+				}
+				if i%2 == 0 {
+					if err := s.Delete(id); err != nil {
+						t.Errorf("Delete(%q): got [%v], want [nil]", id, err)
+					}
+				}
+				// Operations on the shares of the other workers may fail,
+				// but only with canonical errors.
+				other := fmt.Sprintf("share-%d-%d", (w+1)%workers, i)
+				_, err := s.Retrieve(other)
+				checkCanonical(t, "Retrieve", other, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+	if counter, ok := s.(svalbardsrv.ShareCounter); ok {
+		if n, err := counter.Count(); n != workers*shares/2 || err != nil {
+			t.Errorf("Count() after concurrent operations: got [%v, %v], want [%v, nil]", n, err, workers*shares/2)
+		}
+	}
+	return s
+}
+
+func testConcurrentStores(t *testing.T, f Factory, s svalbardsrv.ShareStore) svalbardsrv.ShareStore {
+	const n = 10
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.Store("share1", fmt.Sprintf("some value %d", i))
+		}(i)
+	}
+	wg.Wait()
+	stored := -1
+	for i, err := range errs {
+		switch err {
+		case nil:
+			if stored >= 0 {
+				t.Errorf("concurrent Store() of the same share: both #%d and #%d succeeded", stored, i)
+			}
+			stored = i
+		case svalbardsrv.ErrShareAlreadyExists:
+		default:
+			t.Errorf("concurrent Store() #%d: got [%v], want [nil] or [%v]", i, err, svalbardsrv.ErrShareAlreadyExists)
+		}
+	}
+	if stored < 0 {
+		t.Fatalf("concurrent Store() of the same share: none succeeded")
+	}
+	want := fmt.Sprintf("some value %d", stored)
+	if got, err := s.Retrieve("share1"); got != want || err != nil {
+		t.Errorf("Retrieve() after concurrent Store(): got [%q, %v], want [%q, nil]", got, err, want)
+	}
+	return s
+}
+
+func testPersistence(t *testing.T, f Factory, s svalbardsrv.ShareStore) svalbardsrv.ShareStore {
+	if f.Reopen == nil {
+		t.Skip("ShareStore is not persistent")
+	}
+	shares := map[string]string{"share1": "some value 1", "share2": largeValue(1 << 16)}
+	for i, id := range unicodeIDs {
+		shares[id] = fmt.Sprintf("some value %d", i)
+	}
+	var ids []string
+	for id, value := range shares {
+		if err := s.Store(id, value); err != nil {
+			t.Errorf("Store(%q): got [%v], want [nil]", id, err)
+		}
+		ids = append(ids, id)
+	}
+	s.Store("deleted share", "some value")
+	s.Delete("deleted share")
+	sort.Strings(ids)
+
+	s = f.Reopen(t, s)
+	for id, want := range shares {
+		if got, err := s.Retrieve(id); got != want || err != nil {
+			t.Errorf("Retrieve(%q) after reopening: got %d bytes and [%v], want %d bytes and [nil]", id, len(got), err, len(want))
+		}
+	}
+	if _, err := s.Retrieve("deleted share"); err != svalbardsrv.ErrShareNotFound {
+		t.Errorf("Retrieve() of deleted share after reopening: got [%v], want [%v]", err, svalbardsrv.ErrShareNotFound)
+	}
+	if err := s.Store("share1", "other value"); err != svalbardsrv.ErrShareAlreadyExists {
+		t.Errorf("Store() of existing share after reopening: got [%v], want [%v]", err, svalbardsrv.ErrShareAlreadyExists)
+	}
+	if lister, ok := s.(shareIDLister); ok {
+		if got, err := lister.ShareIDs(); !reflect.DeepEqual(got, ids) || err != nil {
+			t.Errorf("ShareIDs() after reopening: got [%q, %v], want [%q, nil]", got, err, ids)
+		}
+	}
+	return s
+}
+
+func testSoftDelete(t *testing.T, f Factory, s svalbardsrv.ShareStore) svalbardsrv.ShareStore {
+	if _, ok := s.(svalbardsrv.RecoverableShareStore); !ok {
+		t.Skip("ShareStore does not implement RecoverableShareStore")
+	}
+	now := time.Unix(1500000000, 0)
+	purgeAt := now.Add(time.Hour)
+	s.Store("share1", "some value 1")
+	s.Store("share2", "some value 2")
+	s.Store("share3", "some value 3")
+	tests := []struct {
+		op      string // Operation on a RecoverableShareStore object
+		shareID string
+		at      time.Time // 'purgeAt' of SoftDelete, 'now' of Undelete and Purge
+		err     error
+		n       int // expected result of Purge
+	}{
+		{"SoftDelete", "", purgeAt, svalbardsrv.ErrInvalidShareID, 0},
+		{"SoftDelete", "share4", purgeAt, svalbardsrv.ErrShareNotFound, 0},
+		{"SoftDelete", "share1", purgeAt, nil, 0},
+		{"SoftDelete", "share1", purgeAt, svalbardsrv.ErrShareNotFound, 0},
+		{"Retrieve", "share1", time.Time{}, svalbardsrv.ErrShareNotFound, 0},
+		{"Undelete", "", now, svalbardsrv.ErrInvalidShareID, 0},
+		{"Undelete", "share2", now, svalbardsrv.ErrShareNotFound, 0},
+		{"Undelete", "share1", purgeAt, svalbardsrv.ErrShareNotFound, 0},
+		{"Undelete", "share1", now, nil, 0},
+		{"Retrieve", "share1", time.Time{}, nil, 0},
+		{"Undelete", "share1", now, svalbardsrv.ErrShareNotFound, 0},
+		{"SoftDelete", "share1", purgeAt, nil, 0},
+		{"SoftDelete", "share2", purgeAt.Add(time.Hour), nil, 0},
+		{"Purge", "", now, nil, 0},
+		{"Purge", "", purgeAt, nil, 1},
+		{"Undelete", "share1", now, svalbardsrv.ErrShareNotFound, 0},
+		// Purged shares can be stored again.
+		{"Store", "share1", time.Time{}, nil, 0},
+		{"Undelete", "share2", purgeAt, nil, 0},
+		{"Retrieve", "share2", time.Time{}, nil, 0},
+		// A new share replaces the tombstone of a deleted one.
+		{"SoftDelete", "share2", purgeAt, nil, 0},
+		{"Store", "share2", time.Time{}, nil, 0},
+		{"Undelete", "share2", now, svalbardsrv.ErrShareNotFound, 0},
+		{"Retrieve", "share2", time.Time{}, nil, 0},
+	}
+	r := s.(svalbardsrv.RecoverableShareStore)
+	for i, tt := range tests {
+		var err error
+		n := 0
+		switch tt.op {
+		case "SoftDelete":
+			err = r.SoftDelete(tt.shareID, tt.at)
+		case "Undelete":
+			err = r.Undelete(tt.shareID, tt.at)
+		case "Purge":
+			n, err = r.Purge(tt.at)
+		case "Store":
+			err = s.Store(tt.shareID, "some new value")
+		case "Retrieve":
+			_, err = s.Retrieve(tt.shareID)
+		default:
+			panic("Unknown operation: " + tt.op)
+		}
+		if err != tt.err || n != tt.n {
+			t.Errorf("test #%d, %s(%q, %v): got [%v, %v], want [%v, %v]", i, tt.op, tt.shareID, tt.at.Unix(), n, err, tt.n, tt.err)
+		}
+	}
+	if got, err := s.Retrieve("share2"); got != "some new value" || err != nil {
+		t.Errorf("Retrieve() of share replacing a tombstone: got [%q, %v], want [%q, nil]", got, err, "some new value")
+	}
+
+	// Tombstones are neither counted nor listed.
+	r.SoftDelete("share3", purgeAt)
+	if counter, ok := s.(svalbardsrv.ShareCounter); ok {
+		if n, err := counter.Count(); n != 2 || err != nil {
+			t.Errorf("Count() with a tombstone: got [%v, %v], want [2, nil]", n, err)
+		}
+	}
+	if c, ok := s.(shareContainer); ok {
+		if got, err := c.Contains("share3"); got || err != nil {
+			t.Errorf("Contains() of a tombstone: got [%v, %v], want [false, nil]", got, err)
+		}
+	}
+	if lister, ok := s.(shareIDLister); ok {
+		want := []string{"share1", "share2"}
+		if got, err := lister.ShareIDs(); !reflect.DeepEqual(got, want) || err != nil {
+			t.Errorf("ShareIDs() with a tombstone: got [%q, %v], want [%q, nil]", got, err, want)
+		}
+	}
+	if got, err := r.PurgeTime("share3"); !got.Equal(purgeAt) || err != nil {
+		t.Errorf("PurgeTime(%q): got [%v, %v], want [%v, nil]", "share3", got, err, purgeAt)
+	}
+	if _, err := r.PurgeTime("share1"); err != svalbardsrv.ErrShareNotFound {
+		t.Errorf("PurgeTime() of a share without tombstone: got [%v], want [%v]", err, svalbardsrv.ErrShareNotFound)
+	}
+
+	if f.Reopen == nil {
+		return s
+	}
+	s = f.Reopen(t, s)
+	r = s.(svalbardsrv.RecoverableShareStore)
+	if got, err := r.PurgeTime("share3"); !got.Equal(purgeAt) || err != nil {
+		t.Errorf("PurgeTime() after reopening: got [%v, %v], want [%v, nil]", got, err, purgeAt)
+	}
+	if err := r.Undelete("share3", now); err != nil {
+		t.Errorf("Undelete() after reopening: got [%v], want [nil]", err)
+	}
+	if got, err := s.Retrieve("share3"); got != "some value 3" || err != nil {
+		t.Errorf("Retrieve() of undeleted share after reopening: got [%q, %v], want [%q, nil]", got, err, "some value 3")
+	}
+	return s
+}
+
+func testOwnerQuota(t *testing.T, f Factory, s svalbardsrv.ShareStore) svalbardsrv.ShareStore {
+	o, ok := s.(svalbardsrv.OwnerIndexedShareStore)
+	if !ok {
+		t.Skip("ShareStore does not implement OwnerIndexedShareStore")
+	}
+	q, ok := s.(quotaSetter)
+	if !ok {
+		t.Skip("ShareStore does not implement SetMaxSharesPerOwner()")
+	}
+	q.SetMaxSharesPerOwner(2)
+	tests := []struct {
+		shareID  string
+		ownerKey string
+		err      error
+	}{
+		{"", "owner1", svalbardsrv.ErrInvalidShareID},
+		{"share1", "owner1", nil},
+		{"share1", "owner2", svalbardsrv.ErrShareAlreadyExists},
+		{"share2", "owner1", nil},
+		{"share3", "owner2", nil},
+		// Shares without an owner are not indexed.
+		{"share4", "", nil},
+		{"share5", "owner1", svalbardsrv.ErrQuotaExceeded},
+	}
+	for _, tt := range tests {
+		if err := o.StoreForOwner(tt.shareID, "some value", tt.ownerKey); err != tt.err {
+			t.Errorf("StoreForOwner(%q, %q): got [%v], want [%v]", tt.shareID, tt.ownerKey, err, tt.err)
+		}
+	}
+	// A share over the quota is not stored.
+	if _, err := s.Retrieve("share5"); err != svalbardsrv.ErrShareNotFound {
+		t.Errorf("Retrieve() of share over quota: got [%v], want [%v]", err, svalbardsrv.ErrShareNotFound)
+	}
+	checkOwnerShareIDs := func(desc, ownerKey string, want []string) {
+		if got, err := o.OwnerShareIDs(ownerKey); !reflect.DeepEqual(got, want) || err != nil {
+			t.Errorf("OwnerShareIDs(%q) %s: got [%q, %v], want [%q, nil]", ownerKey, desc, got, err, want)
+		}
+	}
+	checkOwnerShareIDs("", "owner1", []string{"share1", "share2"})
+	checkOwnerShareIDs("", "owner2", []string{"share3"})
+	checkOwnerShareIDs("", "owner3", nil)
+
+	// The capacity can be checked before storing, and a share does not count
+	// against its own replacement.
+	if c, ok := s.(svalbardsrv.CapacityChecker); ok {
+		capacityTests := []struct {
+			shareID  string
+			ownerKey string
+			err      error
+		}{
+			{"share5", "owner1", svalbardsrv.ErrQuotaExceeded},
+			{"share1", "owner1", nil},
+			{"share5", "owner2", nil},
+			{"share5", "owner3", nil},
+		}
+		for _, tt := range capacityTests {
+			if err := c.CheckCapacity(tt.shareID, tt.ownerKey); err != tt.err {
+				t.Errorf("CheckCapacity(%q, %q): got [%v], want [%v]", tt.shareID, tt.ownerKey, err, tt.err)
+			}
+		}
+	}
+
+	// Deletion frees the quota.
+	if err := s.Delete("share1"); err != nil {
+		t.Fatalf("Delete(%q): %v", "share1", err)
+	}
+	checkOwnerShareIDs("after Delete()", "owner1", []string{"share2"})
+	if err := o.StoreForOwner("share5", "some value", "owner1"); err != nil {
+		t.Errorf("StoreForOwner() after Delete(): got [%v], want [nil]", err)
+	}
+
+	// Soft-deleted shares count until they are purged.
+	if r, ok := s.(svalbardsrv.RecoverableShareStore); ok {
+		now := time.Unix(1500000000, 0)
+		if err := r.SoftDelete("share2", now); err != nil {
+			t.Fatalf("SoftDelete(%q): %v", "share2", err)
+		}
+		checkOwnerShareIDs("after SoftDelete()", "owner1", []string{"share2", "share5"})
+		// A new share replaces the tombstone, and its index entry.
+		if err := o.StoreForOwner("share2", "new value", "owner2"); err != nil {
+			t.Errorf("StoreForOwner() of a soft-deleted share: got [%v], want [nil]", err)
+		}
+		checkOwnerShareIDs("after replacing a tombstone", "owner1", []string{"share5"})
+		checkOwnerShareIDs("after replacing a tombstone", "owner2", []string{"share2", "share3"})
+		if err := s.Delete("share2"); err != nil {
+			t.Fatalf("Delete(%q): %v", "share2", err)
+		}
+		if err := r.SoftDelete("share5", now); err != nil {
+			t.Fatalf("SoftDelete(%q): %v", "share5", err)
+		}
+		if _, err := r.Purge(now); err != nil {
+			t.Fatalf("Purge(): %v", err)
+		}
+		checkOwnerShareIDs("after Purge()", "owner1", nil)
+	}
+
+	if f.Reopen == nil {
+		return s
+	}
+	s = f.Reopen(t, s)
+	o = s.(svalbardsrv.OwnerIndexedShareStore)
+	checkOwnerShareIDs("after reopening", "owner2", []string{"share3"})
+	return s
+}
+
+func testReplace(t *testing.T, f Factory, s svalbardsrv.ShareStore) svalbardsrv.ShareStore {
+	r, ok := s.(svalbardsrv.ReplacingShareStore)
+	if !ok {
+		t.Skip("ShareStore does not implement ReplacingShareStore")
+	}
+	tests := []struct {
+		shareID string
+		value   string
+		err     error
+	}{
+		{"", "some value", svalbardsrv.ErrInvalidShareID},
+		{"share1", "", svalbardsrv.ErrInvalidShareValue},
+		// A missing share is stored.
+		{"share1", "some value 1", nil},
+		{"share1", "other value 1", nil},
+	}
+	for _, tt := range tests {
+		if err := r.Replace(tt.shareID, tt.value); err != tt.err {
+			t.Errorf("Replace(%q, %q): got [%v], want [%v]", tt.shareID, tt.value, err, tt.err)
+		}
+	}
+	if got, err := s.Retrieve("share1"); got != "other value 1" || err != nil {
+		t.Errorf("Retrieve() of replaced share: got [%q, %v], want [%q, nil]", got, err, "other value 1")
+	}
+	if err := s.Store("share1", "some value"); err != svalbardsrv.ErrShareAlreadyExists {
+		t.Errorf("Store() of replaced share: got [%v], want [%v]", err, svalbardsrv.ErrShareAlreadyExists)
+	}
+
+	// A replaced share stays in the index of its owner.
+	if o, ok := s.(svalbardsrv.OwnerIndexedShareStore); ok {
+		if err := o.StoreForOwner("share2", "some value 2", "owner1"); err != nil {
+			t.Fatalf("StoreForOwner(%q): %v", "share2", err)
+		}
+		if err := r.Replace("share2", "other value 2"); err != nil {
+			t.Errorf("Replace() of indexed share: got [%v], want [nil]", err)
+		}
+		if got, err := o.OwnerShareIDs("owner1"); !reflect.DeepEqual(got, []string{"share2"}) || err != nil {
+			t.Errorf("OwnerShareIDs() after Replace(): got [%q, %v], want [%q, nil]", got, err, []string{"share2"})
+		}
+	}
+
+	if f.Reopen == nil {
+		return s
+	}
+	s = f.Reopen(t, s)
+	if got, err := s.Retrieve("share1"); got != "other value 1" || err != nil {
+		t.Errorf("Retrieve() of replaced share after reopening: got [%q, %v], want [%q, nil]", got, err, "other value 1")
+	}
+	return s
+}
@@ -18,6 +18,7 @@
 package shareid
 
 import (
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
@@ -28,6 +29,7 @@ var (
 	ErrMissingOwnerType  = errors.New("missing owner_id_type")
 	ErrMissingOwnerID    = errors.New("missing owner_id")
 	ErrMissingSecretName = errors.New("missing secret_name")
+	ErrMissingKey        = errors.New("missing key")
 )
 
 // GetShareID generates a unique, determinisic ID for the given parameters,
@@ -48,3 +50,27 @@ func GetShareID(ownerIDType, ownerID, secretName string) (string, error) {
 	hashValue := sha256.Sum256([]byte(stringToHash))
 	return hex.EncodeToString(hashValue[:]), nil
 }
+
+// GetOwnerKey generates a unique, deterministic key of the owner with the
+// given parameters, all of which must be non-empty, under which share stores
+// can index the shares of the owner without keeping the owner id itself.
+// The owner key is an HMAC under the secret 'key', so that the owner ids
+// cannot be recovered from the index by hashing all candidates (e.g. all
+// phone numbers) without the secret.  The owner id should be normalized
+// (see svalbardsrv.RecipientNormalizer), so that all variants of it get
+// the same owner key.
+// Like GetShareID, it returns only errors without sensitive information.
+func GetOwnerKey(key []byte, ownerIDType, ownerID string) (string, error) {
+	if len(key) == 0 {
+		return "", ErrMissingKey
+	}
+	if ownerIDType == "" {
+		return "", ErrMissingOwnerType
+	}
+	if ownerID == "" {
+		return "", ErrMissingOwnerID
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("owner:[" + ownerIDType + "][" + ownerID + "]"))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
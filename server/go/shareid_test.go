@@ -59,3 +59,34 @@ func TestGetShareIDErrors(t *testing.T) {
 		}
 	}
 }
+
+func TestGetOwnerKey(t *testing.T) {
+	secret := []byte("secret")
+	key, err := GetOwnerKey(secret, "a", "b")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if other, _ := GetOwnerKey(secret, "a", "c"); other == key {
+		t.Errorf("Expected distinct keys of distinct owners, got %v twice", key)
+	}
+	if again, _ := GetOwnerKey(secret, "a", "b"); again != key {
+		t.Errorf("Expected the same key of the same owner, got %v and %v", key, again)
+	}
+	// Without the secret, the key cannot be computed from the owner id.
+	if other, _ := GetOwnerKey([]byte("other secret"), "a", "b"); other == key {
+		t.Errorf("Expected distinct keys under distinct secrets, got %v twice", key)
+	}
+	// The key of an owner differs from the ids of the shares of the owner.
+	if id, _ := GetShareID("a", "b", "c"); id == key {
+		t.Errorf("Expected the key of the owner to differ from the share id %v", id)
+	}
+	if _, err := GetOwnerKey(nil, "a", "b"); err != ErrMissingKey {
+		t.Errorf("Expected error [%v] but got [%v]", ErrMissingKey, err)
+	}
+	if _, err := GetOwnerKey(secret, "", "b"); err != ErrMissingOwnerType {
+		t.Errorf("Expected error [%v] but got [%v]", ErrMissingOwnerType, err)
+	}
+	if _, err := GetOwnerKey(secret, "a", ""); err != ErrMissingOwnerID {
+		t.Errorf("Expected error [%v] but got [%v]", ErrMissingOwnerID, err)
+	}
+}
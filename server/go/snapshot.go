@@ -0,0 +1,525 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Package snapshot implements hot backups of the Bolt share store of a
+// Svalbard server, and their restore.
+//
+// A snapshot is a tar archive with two files: shares.db, a consistent copy
+// of the DB written from a single read transaction while the server keeps
+// serving, followed by MANIFEST.json, which records the size, the SHA-256
+// checksum and the number of shares of the copy.  The archive can be
+// encrypted to an RSA public key of the operators: a fresh AES-256 key is
+// wrapped with RSA-OAEP, and the archive is encrypted with AES-256-GCM in
+// chunks, so that a modified, reordered or truncated snapshot is rejected.
+package snapshot
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/google/svalbard/server/go/boltsharestore"
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+// Names of the files in a snapshot.
+const (
+	DBFileName       = "shares.db"
+	ManifestFileName = "MANIFEST.json"
+)
+
+// ManifestVersion is the version of the manifests written by this package.
+const ManifestVersion = 1
+
+const (
+	magic     = "SVBDSNAP"
+	version   = 1
+	chunkSize = 64 << 10
+	// minKeyBits is the minimal size of the RSA keys of the operators.
+	minKeyBits = 2048
+)
+
+var oaepLabel = []byte("svalbard snapshot")
+
+// Errors returned upon failures.
+var (
+	ErrInvalidKey       = errors.New("invalid key, want a PEM-encoded RSA key of at least 2048 bits")
+	ErrEncrypted        = errors.New("snapshot is encrypted, a private key is required")
+	ErrUnknownVersion   = errors.New("unknown snapshot version")
+	ErrDecryption       = errors.New("could not decrypt snapshot: wrong key or modified snapshot")
+	ErrTruncated        = errors.New("snapshot is truncated")
+	ErrInvalidSnapshot  = errors.New("invalid snapshot, want shares.db followed by MANIFEST.json")
+	ErrChecksumMismatch = errors.New("checksum of shares.db does not match the manifest")
+)
+
+// Manifest describes the DB file of a snapshot.
+type Manifest struct {
+	Version       int       `json:"version"`
+	Created       time.Time `json:"created"`
+	ServerVersion string    `json:"server_version"`
+	SchemaVersion int       `json:"schema_version"`
+	TxID          int       `json:"tx_id"`
+	Shares        int       `json:"shares"`
+	Size          int64     `json:"size"`
+	SHA256        string    `json:"sha256"`
+}
+
+// ParsePublicKey parses a PEM-encoded RSA public key.
+func ParsePublicKey(pemBytes []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, ErrInvalidKey
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	publicKey, ok := key.(*rsa.PublicKey)
+	if !ok || publicKey.N.BitLen() < minKeyBits {
+		return nil, ErrInvalidKey
+	}
+	return publicKey, nil
+}
+
+// ParsePrivateKey parses a PEM-encoded RSA private key, in PKCS #1 or
+// PKCS #8 form.
+func ParsePrivateKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, ErrInvalidKey
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, ErrInvalidKey
+	}
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	privateKey, ok := key.(*rsa.PrivateKey)
+	if !ok || privateKey.N.BitLen() < minKeyBits {
+		return nil, ErrInvalidKey
+	}
+	return privateKey, nil
+}
+
+// Writer writes snapshots of a share store.
+type Writer struct {
+	// Store is the share store to back up.
+	Store *boltsharestore.Bolt
+	// PublicKey (optional) is the key of the operators to encrypt the
+	// snapshots to.
+	PublicKey *rsa.PublicKey
+
+	now func() time.Time
+}
+
+// WriteSnapshot writes a snapshot of the share store to w, and returns its
+// manifest.  The share store can be used concurrently.
+func (sw *Writer) WriteSnapshot(w io.Writer) (*Manifest, error) {
+	now := time.Now
+	if sw.now != nil {
+		now = sw.now
+	}
+	out := w
+	var enc *encryptWriter
+	if sw.PublicKey != nil {
+		var err error
+		if enc, err = newEncryptWriter(w, sw.PublicKey); err != nil {
+			return nil, err
+		}
+		out = enc
+	}
+	archive := tar.NewWriter(out)
+	var manifest *Manifest
+	err := sw.Store.Snapshot(func(s *boltsharestore.Snapshot) error {
+		created := now().UTC().Truncate(time.Second)
+		err := archive.WriteHeader(&tar.Header{
+			Name:    DBFileName,
+			Mode:    0600,
+			Size:    s.Size,
+			ModTime: created,
+		})
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		if _, err := s.WriteTo(io.MultiWriter(archive, h)); err != nil {
+			return err
+		}
+		manifest = &Manifest{
+			Version:       ManifestVersion,
+			Created:       created,
+			ServerVersion: svalbardsrv.Version,
+			SchemaVersion: boltsharestore.SchemaVersion,
+			TxID:          s.TxID,
+			Shares:        s.Shares,
+			Size:          s.Size,
+			SHA256:        hex.EncodeToString(h.Sum(nil)),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, '\n')
+	err = archive.WriteHeader(&tar.Header{
+		Name:    ManifestFileName,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: manifest.Created,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := archive.Write(data); err != nil {
+		return nil, err
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	if enc != nil {
+		if err := enc.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+// Restore restores the snapshot read from r into a new share store file
+// 'filename', which must not exist.  Encrypted snapshots require the
+// private key of the operators.  The DB is written to a temporary file
+// next to 'filename' first; it is moved in place only after its checksum
+// matches the manifest, and every record passes boltsharestore's Verify.
+func Restore(r io.Reader, privateKey *rsa.PrivateKey, filename string) (*Manifest, error) {
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		if err == nil {
+			err = fmt.Errorf("%s exists already", filename)
+		}
+		return nil, err
+	}
+	in := bufio.NewReader(r)
+	if prefix, err := in.Peek(len(magic)); err == nil && string(prefix) == magic {
+		if privateKey == nil {
+			return nil, ErrEncrypted
+		}
+		dec, err := newDecryptReader(in, privateKey)
+		if err != nil {
+			return nil, err
+		}
+		in = bufio.NewReader(dec)
+	}
+
+	tmpFilename := filename + ".restore"
+	file, err := os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFilename)
+	manifest, sum, err := extract(in, file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hex.EncodeToString(sum) != manifest.SHA256 {
+		return nil, ErrChecksumMismatch
+	}
+	if err := check(tmpFilename, manifest); err != nil {
+		return nil, err
+	}
+	// Link fails rather than replacing a file created in the meantime.
+	if err := os.Link(tmpFilename, filename); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// extract copies the DB file of the archive read from r to w, and returns
+// the manifest of the archive and the checksum of the DB file.
+func extract(r io.Reader, w io.Writer) (*Manifest, []byte, error) {
+	archive := tar.NewReader(r)
+	next := func(name string) (*tar.Header, error) {
+		header, err := archive.Next()
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			return nil, ErrTruncated
+		case err != nil:
+			return nil, err
+		case header.Name != name || header.Typeflag != tar.TypeReg:
+			return nil, ErrInvalidSnapshot
+		}
+		return header, nil
+	}
+	header, err := next(DBFileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), archive)
+	if err == nil && n != header.Size {
+		err = ErrTruncated
+	}
+	if err == io.ErrUnexpectedEOF {
+		err = ErrTruncated
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := next(ManifestFileName); err != nil {
+		return nil, nil, err
+	}
+	var manifest Manifest
+	if err := json.NewDecoder(archive).Decode(&manifest); err != nil {
+		return nil, nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if manifest.Version != ManifestVersion {
+		return nil, nil, ErrUnknownVersion
+	}
+	if manifest.Size != header.Size {
+		return nil, nil, ErrChecksumMismatch
+	}
+	if _, err := archive.Next(); err != io.EOF {
+		return nil, nil, ErrInvalidSnapshot
+	}
+	// Reading to the end verifies the final chunk of an encrypted snapshot.
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return nil, nil, err
+	}
+	return &manifest, h.Sum(nil), nil
+}
+
+// check opens the restored DB, and verifies that every record is intact and
+// that it holds the shares listed in the manifest.
+func check(filename string, manifest *Manifest) error {
+	store, err := boltsharestore.Open(filename, nil)
+	if err != nil {
+		return fmt.Errorf("could not open restored share store: %v", err)
+	}
+	defer store.Close()
+	n, problems, err := store.Verify()
+	switch {
+	case err != nil:
+		return err
+	case len(problems) > 0:
+		return fmt.Errorf("restored share store is corrupt: %v", problems[0])
+	case n != manifest.Shares:
+		return fmt.Errorf("restored share store has %d shares, manifest says %d", n, manifest.Shares)
+	}
+	return nil
+}
+
+// Encrypted snapshots start with a header of the magic, a version byte, and
+// the AES key wrapped with RSA-OAEP (with a 2-byte big-endian length).  The
+// chunks that follow have a 4-byte big-endian length, and are encrypted with
+// AES-256-GCM under a nonce of the 8-byte chunk counter and a final flag in
+// the last byte; the header is authenticated with every chunk.
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(aead cipher.AEAD, counter uint64, final bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, counter)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	counter uint64
+	buf     []byte
+}
+
+func newEncryptWriter(w io.Writer, publicKey *rsa.PublicKey) (*encryptWriter, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, key, oaepLabel)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte(magic), version, 0, 0)
+	binary.BigEndian.PutUint16(header[len(magic)+1:], uint16(len(wrapped)))
+	header = append(header, wrapped...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, header: header, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (ew *encryptWriter) writeChunk(final bool) error {
+	sealed := ew.aead.Seal(make([]byte, 4), chunkNonce(ew.aead, ew.counter, final), ew.buf, ew.header)
+	binary.BigEndian.PutUint32(sealed, uint32(len(sealed)-4))
+	ew.counter++
+	ew.buf = ew.buf[:0]
+	_, err := ew.w.Write(sealed)
+	return err
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if len(ew.buf) == chunkSize {
+			if err := ew.writeChunk(false); err != nil {
+				return n, err
+			}
+		}
+		m := copy(ew.buf[len(ew.buf):chunkSize], p)
+		ew.buf = ew.buf[:len(ew.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+// Close writes the final chunk.  It does not close the underlying writer.
+func (ew *encryptWriter) Close() error {
+	return ew.writeChunk(true)
+}
+
+type decryptReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	header  []byte
+	counter uint64
+	buf     []byte
+	done    bool
+}
+
+func newDecryptReader(r io.Reader, privateKey *rsa.PrivateKey) (*decryptReader, error) {
+	header := make([]byte, len(magic)+3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrTruncated
+	}
+	if header[len(magic)] != version {
+		return nil, ErrUnknownVersion
+	}
+	wrapped := make([]byte, binary.BigEndian.Uint16(header[len(magic)+1:]))
+	if _, err := io.ReadFull(r, wrapped); err != nil {
+		return nil, ErrTruncated
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, wrapped, oaepLabel)
+	if err != nil {
+		return nil, ErrDecryption
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: r, aead: aead, header: append(header, wrapped...)}, nil
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.buf) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		if err := dr.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.buf)
+	dr.buf = dr.buf[n:]
+	return n, nil
+}
+
+func (dr *decryptReader) readChunk() error {
+	var length [4]byte
+	if _, err := io.ReadFull(dr.r, length[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		return err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > chunkSize+uint32(dr.aead.Overhead()) {
+		return ErrDecryption
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(dr.r, sealed); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		return err
+	}
+	for _, final := range []bool{false, true} {
+		if plaintext, err := dr.aead.Open(nil, chunkNonce(dr.aead, dr.counter, final), sealed, dr.header); err == nil {
+			dr.counter++
+			dr.buf, dr.done = plaintext, final
+			if final {
+				return dr.checkEnd()
+			}
+			return nil
+		}
+	}
+	return ErrDecryption
+}
+
+// checkEnd verifies that nothing follows the final chunk.
+func (dr *decryptReader) checkEnd() error {
+	var b [1]byte
+	switch _, err := io.ReadFull(dr.r, b[:]); err {
+	case io.EOF:
+		return nil
+	case nil:
+		return errors.New("unexpected data after the final chunk")
+	default:
+		return err
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package snapshot
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/svalbard/server/go/boltsharestore"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+)
+
+func privateKey(t *testing.T) *rsa.PrivateKey {
+	testKeyOnce.Do(func() {
+		var err error
+		if testKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return testKey
+}
+
+func tempDir(t *testing.T) string {
+	d, err := ioutil.TempDir("", "test-snapshot-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// newStore returns a share store with 'n' shares.
+func newStore(t *testing.T, n int) *boltsharestore.Bolt {
+	s, err := boltsharestore.OpenOrCreate(filepath.Join(tempDir(t), "shares.db"))
+	if err != nil {
+		t.Fatalf("OpenOrCreate(): %v", err)
+	}
+	for i := 0; i < n; i++ {
+		if err := s.Store(fmt.Sprintf("share%04d", i), fmt.Sprintf("some value %d", i)); err != nil {
+			t.Fatalf("Store(): %v", err)
+		}
+	}
+	return s
+}
+
+func records(t *testing.T, s *boltsharestore.Bolt) map[string]boltsharestore.Record {
+	m := make(map[string]boltsharestore.Record)
+	err := s.ForEach(func(r boltsharestore.Record) error {
+		m[r.ShareID] = r
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ForEach(): %v", err)
+	}
+	return m
+}
+
+func TestWriteAndRestore(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		store := newStore(t, 500)
+		w := &Writer{Store: store}
+		if encrypted {
+			w.PublicKey = &privateKey(t).PublicKey
+		}
+		// The store keeps serving writes while the snapshot is written.
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				store.Store(fmt.Sprintf("concurrent%04d", i), "some other value")
+			}
+		}()
+		var buf bytes.Buffer
+		manifest, err := w.WriteSnapshot(&buf)
+		close(done)
+		wg.Wait()
+		if err != nil {
+			t.Fatalf("WriteSnapshot(encrypted=%v): got [%v], want [nil]", encrypted, err)
+		}
+		if manifest.Shares < 500 || manifest.SchemaVersion != boltsharestore.SchemaVersion || manifest.Version != ManifestVersion {
+			t.Errorf("WriteSnapshot(encrypted=%v): got manifest %+v, want at least 500 shares", encrypted, manifest)
+		}
+		if plain := bytes.Contains(buf.Bytes(), []byte("some value 42")); plain == encrypted {
+			t.Errorf("WriteSnapshot(encrypted=%v): got plaintext values in snapshot: %v", encrypted, plain)
+		}
+
+		filename := filepath.Join(tempDir(t), "restored.db")
+		var key *rsa.PrivateKey
+		if encrypted {
+			key = privateKey(t)
+		}
+		restored, err := Restore(bytes.NewReader(buf.Bytes()), key, filename)
+		if err != nil {
+			t.Fatalf("Restore(encrypted=%v): got [%v], want [nil]", encrypted, err)
+		}
+		if !reflect.DeepEqual(restored, manifest) {
+			t.Errorf("Restore(encrypted=%v): got manifest %+v, want %+v", encrypted, restored, manifest)
+		}
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != manifest.SHA256 {
+			t.Errorf("Restore(encrypted=%v): restored file does not match the checksum of the manifest", encrypted)
+		}
+
+		// The restored store holds the shares of the snapshot, unchanged.
+		s, err := boltsharestore.Open(filename, nil)
+		if err != nil {
+			t.Fatalf("Open(restored): %v", err)
+		}
+		got, want := records(t, s), records(t, store)
+		if len(got) != manifest.Shares {
+			t.Errorf("restored store (encrypted=%v): got %d shares, want %d", encrypted, len(got), manifest.Shares)
+		}
+		for id, r := range got {
+			if !reflect.DeepEqual(r, want[id]) {
+				t.Errorf("restored share %q: got %+v, want %+v", id, r, want[id])
+			}
+		}
+		for i := 0; i < 500; i++ {
+			if id := fmt.Sprintf("share%04d", i); !reflect.DeepEqual(got[id], want[id]) {
+				t.Errorf("restored share %q: got %+v, want %+v", id, got[id], want[id])
+			}
+		}
+		s.Close()
+		store.Close()
+		if _, err := os.Stat(filename + ".restore"); !os.IsNotExist(err) {
+			t.Errorf("Restore(encrypted=%v): temporary file was not removed: %v", encrypted, err)
+		}
+	}
+}
+
+func TestRestoreErrors(t *testing.T) {
+	store := newStore(t, 100)
+	defer store.Close()
+	var plain, encrypted bytes.Buffer
+	if _, err := (&Writer{Store: store}).WriteSnapshot(&plain); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&Writer{Store: store, PublicKey: &privateKey(t).PublicKey}).WriteSnapshot(&encrypted); err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modify := func(data []byte, i int) []byte {
+		data = append([]byte(nil), data...)
+		data[i] ^= 1
+		return data
+	}
+	// A tar archive starts with a header block of 512 bytes.
+	dbOffset := 512
+	// Changes the number of shares in the manifest from 100 to 101.
+	manifestOffset := bytes.Index(plain.Bytes(), []byte(`"shares": 100`)) + len(`"shares": 10`)
+	existing := filepath.Join(tempDir(t), "existing.db")
+	ioutil.WriteFile(existing, nil, 0600)
+
+	tests := []struct {
+		desc     string
+		data     []byte
+		key      *rsa.PrivateKey
+		filename string
+		err      string
+	}{
+		{"encrypted without key", encrypted.Bytes(), nil, "", ErrEncrypted.Error()},
+		{"wrong key", encrypted.Bytes(), otherKey, "", ErrDecryption.Error()},
+		{"modified encrypted", modify(encrypted.Bytes(), encrypted.Len()/2), privateKey(t), "", ErrDecryption.Error()},
+		{"truncated encrypted", encrypted.Bytes()[:encrypted.Len()-100], privateKey(t), "", ErrTruncated.Error()},
+		{"truncated plain", plain.Bytes()[:plain.Len()/2], nil, "", ErrTruncated.Error()},
+		{"modified DB", modify(plain.Bytes(), dbOffset+100), nil, "", ErrChecksumMismatch.Error()},
+		{"modified manifest", modify(plain.Bytes(), manifestOffset), nil, "", "manifest says"},
+		{"not a snapshot", []byte("hello"), nil, "", ErrTruncated.Error()},
+		{"existing file", plain.Bytes(), nil, existing, "exists already"},
+	}
+	for _, tt := range tests {
+		filename := tt.filename
+		if filename == "" {
+			filename = filepath.Join(tempDir(t), "restored.db")
+		}
+		_, err := Restore(bytes.NewReader(tt.data), tt.key, filename)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Restore(%s): got [%v], want [%v]", tt.desc, err, tt.err)
+		}
+		if tt.filename != "" {
+			continue
+		}
+		for _, f := range []string{filename, filename + ".restore"} {
+			if _, err := os.Stat(f); !os.IsNotExist(err) {
+				t.Errorf("Restore(%s): got file %s, want none", tt.desc, f)
+			}
+		}
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	key := privateKey(t)
+	smallKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(typ string, der []byte) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	}
+	pkix := func(k interface{}) []byte {
+		der, err := x509.MarshalPKIXPublicKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encode("PUBLIC KEY", der)
+	}
+	pkcs8 := func(k interface{}) []byte {
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encode("PRIVATE KEY", der)
+	}
+
+	publicTests := []struct {
+		desc string
+		pem  []byte
+		err  error
+	}{
+		{"RSA 2048", pkix(&key.PublicKey), nil},
+		{"RSA 1024", pkix(&smallKey.PublicKey), ErrInvalidKey},
+		{"ECDSA", pkix(&ecKey.PublicKey), ErrInvalidKey},
+		{"private key", pkcs8(key), ErrInvalidKey},
+		{"no PEM", []byte("no PEM"), ErrInvalidKey},
+	}
+	for _, tt := range publicTests {
+		if _, err := ParsePublicKey(tt.pem); err != tt.err {
+			t.Errorf("ParsePublicKey(%s): got [%v], want [%v]", tt.desc, err, tt.err)
+		}
+	}
+	privateTests := []struct {
+		desc string
+		pem  []byte
+		err  error
+	}{
+		{"PKCS #1", encode("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)), nil},
+		{"PKCS #8", pkcs8(key), nil},
+		{"RSA 1024", pkcs8(smallKey), ErrInvalidKey},
+		{"ECDSA", pkcs8(ecKey), ErrInvalidKey},
+		{"public key", pkix(&key.PublicKey), ErrInvalidKey},
+		{"no PEM", []byte("no PEM"), ErrInvalidKey},
+	}
+	for _, tt := range privateTests {
+		if _, err := ParsePrivateKey(tt.pem); err != tt.err {
+			t.Errorf("ParsePrivateKey(%s): got [%v], want [%v]", tt.desc, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,527 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Package sqlitesharestore implements a store for shares of a Svalbard HTTP
+// server, that uses an SQLite DB for persisting the data.
+//
+// Unlike Bolt, SQLite lets other processes (e.g. the sqlite3 shell) read the
+// DB while the server is running.  The DB is used in WAL mode, so that such
+// readers do not block the server, and vice versa.  The schema is versioned
+// with the user_version pragma, and upgraded when the DB is opened.
+package sqlitesharestore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/google/svalbard/server/go/svalbardsrv"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SchemaVersion is the version of the schema of the DBs written by this
+// package.  Version 2 added the tombstones of soft-deleted shares, version 3
+// the index of the shares by owner.
+const SchemaVersion = 3
+
+// busyTimeout is how long an operation waits for locks held by other
+// connections, e.g. of a long-running ad hoc query.
+const busyTimeout = 5 * time.Second
+
+// migrations[i] upgrades the schema from version i to version i+1.
+var migrations = []string{
+	`CREATE TABLE shares (
+		share_id TEXT NOT NULL PRIMARY KEY,
+		value BLOB NOT NULL,
+		created INTEGER NOT NULL
+	) WITHOUT ROWID`,
+	`CREATE TABLE tombstones (
+		share_id TEXT NOT NULL PRIMARY KEY,
+		value BLOB NOT NULL,
+		created INTEGER NOT NULL,
+		purge_at INTEGER NOT NULL
+	) WITHOUT ROWID`,
+	`CREATE TABLE owners (
+		share_id TEXT NOT NULL PRIMARY KEY,
+		owner_key TEXT NOT NULL
+	) WITHOUT ROWID;
+	CREATE INDEX owners_by_owner_key ON owners (owner_key)`,
+}
+
+// Errors returned upon failures.
+var (
+	ErrUnknownSchema = errors.New("share store has an unknown schema version, probably written by a newer server")
+)
+
+// Record is a share together with its metadata.
+type Record struct {
+	ShareID string
+	Value   string
+	Created time.Time
+}
+
+// OpenOrCreate returns a new SQLite-instance that stores the shares in the
+// DB in the specified file, creating the file if it does not exist, and
+// upgrading the schema if it is older than SchemaVersion.
+// The returned SQLite implements svalbardsrv.ShareStore-interface.
+func OpenOrCreate(filename string) (*SQLite, error) {
+	// The pragmas are set on every connection of the pool.
+	params := url.Values{}
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", busyTimeout/time.Millisecond))
+	params.Add("_pragma", "synchronous(FULL)")
+	params.Set("_txlock", "immediate")
+	db, err := sql.Open("sqlite", "file:"+filename+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLite{db: db, now: time.Now}, nil
+}
+
+// migrate upgrades the schema of 'db' to SchemaVersion, one version per
+// transaction.
+func migrate(db *sql.DB) error {
+	for {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		var version int
+		if err := tx.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if version == SchemaVersion {
+			return tx.Rollback()
+		}
+		if version > SchemaVersion {
+			tx.Rollback()
+			return ErrUnknownSchema
+		}
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("could not migrate schema to version %d: %v", version+1, err)
+		}
+		// Pragmas do not accept parameters.
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+}
+
+// isUniqueViolation returns true if 'err' reports a duplicate key.
+func isUniqueViolation(err error) bool {
+	var e *sqlite.Error
+	if !errors.As(err, &e) {
+		return false
+	}
+	return e.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY || e.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+// SQLite is a ShareStore implementation that uses an SQLite DB to store
+// the shares.
+type SQLite struct {
+	db                *sql.DB
+	now               func() time.Time
+	maxSharesPerOwner int
+	maxSize           int64
+}
+
+// SetMaxSharesPerOwner sets the maximal number of shares that StoreForOwner
+// indexes under a single owner to 'n' (unlimited if 0).  It must be called
+// before the store is used.
+func (ss *SQLite) SetMaxSharesPerOwner(n int) {
+	ss.maxSharesPerOwner = n
+}
+
+// SetMaxSize sets the maximal size of the data in the DB to 'bytes'
+// (unlimited if 0).  Shares that would exceed it are not stored, while
+// deletions remain possible.  The size excludes the free pages of the DB
+// and the WAL, so the files themselves can be larger.  It must be called
+// before the store is used.
+func (ss *SQLite) SetMaxSize(bytes int64) {
+	ss.maxSize = bytes
+}
+
+// Store stores the given 'shareValue' under the specified 'shareID'.
+func (ss *SQLite) Store(shareID, shareValue string) error {
+	return ss.StoreForOwner(shareID, shareValue, "")
+}
+
+// StoreForOwner stores the given 'shareValue' under the specified 'shareID',
+// and indexes it under 'ownerKey', unless it is empty.
+func (ss *SQLite) StoreForOwner(shareID, shareValue, ownerKey string) error {
+	if shareID == "" {
+		return svalbardsrv.ErrInvalidShareID
+	}
+	if shareValue == "" {
+		return svalbardsrv.ErrInvalidShareValue
+	}
+	return ss.inTx(func(tx *sql.Tx) error {
+		return ss.add(tx, shareID, shareValue, ownerKey)
+	})
+}
+
+// Replace replaces the value of the share identified by 'shareID' with
+// 'shareValue', keeping its creation time, or stores it like Store if there
+// is no such share.  The maximal size of the DB is checked only for new
+// shares.
+func (ss *SQLite) Replace(shareID, shareValue string) error {
+	if shareID == "" {
+		return svalbardsrv.ErrInvalidShareID
+	}
+	if shareValue == "" {
+		return svalbardsrv.ErrInvalidShareValue
+	}
+	return ss.inTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec("UPDATE shares SET value = ? WHERE share_id = ?", []byte(shareValue), shareID)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil || n > 0 {
+			return err
+		}
+		return ss.add(tx, shareID, shareValue, "")
+	})
+}
+
+// add stores 'shareValue' under 'shareID' within 'tx', indexed under
+// 'ownerKey' unless it is empty.
+func (ss *SQLite) add(tx *sql.Tx, shareID, shareValue, ownerKey string) error {
+	var deleted bool
+	err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM tombstones WHERE share_id = ?)", shareID).Scan(&deleted)
+	if err != nil {
+		return err
+	}
+	// A new share replaces the tombstone of a deleted one.
+	if deleted {
+		if _, err := tx.Exec("DELETE FROM owners WHERE share_id = ?", shareID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM tombstones WHERE share_id = ?", shareID); err != nil {
+			return err
+		}
+	}
+	if ss.maxSize > 0 {
+		used, err := usedSize(tx)
+		if err != nil {
+			return err
+		}
+		if used+int64(len(shareValue)) > ss.maxSize {
+			return svalbardsrv.ErrStoreFull
+		}
+	}
+	_, err = tx.Exec("INSERT INTO shares (share_id, value, created) VALUES (?, ?, ?)",
+		shareID, []byte(shareValue), ss.now().Unix())
+	if isUniqueViolation(err) {
+		return svalbardsrv.ErrShareAlreadyExists
+	}
+	if err != nil || ownerKey == "" {
+		return err
+	}
+	if ss.maxSharesPerOwner > 0 {
+		var n int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM owners WHERE owner_key = ?", ownerKey).Scan(&n); err != nil {
+			return err
+		}
+		if n >= ss.maxSharesPerOwner {
+			return svalbardsrv.ErrQuotaExceeded
+		}
+	}
+	_, err = tx.Exec("INSERT INTO owners (share_id, owner_key) VALUES (?, ?)", shareID, ownerKey)
+	return err
+}
+
+// usedSize returns the size of the data in the DB, i.e. the size of the DB
+// without the free pages.
+func usedSize(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}) (int64, error) {
+	var used int64
+	err := q.QueryRow(`SELECT (page_count - freelist_count) * page_size
+		FROM pragma_page_count(), pragma_freelist_count(), pragma_page_size()`).Scan(&used)
+	return used, err
+}
+
+// CheckCapacity returns ErrQuotaExceeded if the owner with 'ownerKey' has
+// the maximal number of shares besides the one identified by 'shareID', and
+// ErrStoreFull if the data in the DB has the maximal size.
+func (ss *SQLite) CheckCapacity(shareID, ownerKey string) error {
+	if ss.maxSize > 0 {
+		used, err := usedSize(ss.db)
+		if err != nil {
+			return err
+		}
+		if used >= ss.maxSize {
+			return svalbardsrv.ErrStoreFull
+		}
+	}
+	if ss.maxSharesPerOwner == 0 {
+		return nil
+	}
+	var n int
+	err := ss.db.QueryRow("SELECT COUNT(*) FROM owners WHERE owner_key = ? AND share_id != ?", ownerKey, shareID).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n >= ss.maxSharesPerOwner {
+		return svalbardsrv.ErrQuotaExceeded
+	}
+	return nil
+}
+
+// OwnerShareIDs returns the ids of the shares indexed under 'ownerKey', sorted.
+func (ss *SQLite) OwnerShareIDs(ownerKey string) ([]string, error) {
+	var ids []string
+	err := ss.query(func(rows *sql.Rows) error {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+		return nil
+	}, "SELECT share_id FROM owners WHERE owner_key = ? ORDER BY share_id", ownerKey)
+	return ids, err
+}
+
+// Retrieve returns the value of the share identified by 'shareID',
+// if it is present in the store.  If no share is present, or if the
+// retrieval fails for some reason, it returns nil and an error message.
+func (ss *SQLite) Retrieve(shareID string) (string, error) {
+	if shareID == "" {
+		return "", svalbardsrv.ErrInvalidShareID
+	}
+	var value []byte
+	err := ss.db.QueryRow("SELECT value FROM shares WHERE share_id = ?", shareID).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", svalbardsrv.ErrShareNotFound
+	}
+	return string(value), err
+}
+
+// Contains returns true if the share identified by 'shareID' is present
+// in the store, without retrieving its value.
+func (ss *SQLite) Contains(shareID string) (bool, error) {
+	if shareID == "" {
+		return false, svalbardsrv.ErrInvalidShareID
+	}
+	var shareExists bool
+	err := ss.db.QueryRow("SELECT EXISTS (SELECT 1 FROM shares WHERE share_id = ?)", shareID).Scan(&shareExists)
+	return shareExists, err
+}
+
+// Delete removes from the store the share identified by 'shareID',
+// if it is present in the store.  If no share is present, or if the
+// deletion fails for some reason, it returns an error message.
+func (ss *SQLite) Delete(shareID string) error {
+	if shareID == "" {
+		return svalbardsrv.ErrInvalidShareID
+	}
+	return ss.inTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec("DELETE FROM shares WHERE share_id = ?", shareID)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			if err == nil {
+				err = svalbardsrv.ErrShareNotFound
+			}
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM owners WHERE share_id = ?", shareID)
+		return err
+	})
+}
+
+// SoftDelete removes from the store the share identified by 'shareID',
+// but keeps it as a tombstone until 'purgeAt'.
+func (ss *SQLite) SoftDelete(shareID string, purgeAt time.Time) error {
+	if shareID == "" {
+		return svalbardsrv.ErrInvalidShareID
+	}
+	return ss.inTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec(`INSERT INTO tombstones (share_id, value, created, purge_at)
+			SELECT share_id, value, created, ? FROM shares WHERE share_id = ?`, purgeAt.Unix(), shareID)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			if err == nil {
+				err = svalbardsrv.ErrShareNotFound
+			}
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM shares WHERE share_id = ?", shareID)
+		return err
+	})
+}
+
+// Undelete restores the share identified by 'shareID' from its tombstone,
+// if the tombstone is not due for purging at 'now'.
+func (ss *SQLite) Undelete(shareID string, now time.Time) error {
+	if shareID == "" {
+		return svalbardsrv.ErrInvalidShareID
+	}
+	return ss.inTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec(`INSERT INTO shares (share_id, value, created)
+			SELECT share_id, value, created FROM tombstones WHERE share_id = ? AND purge_at > ?`, shareID, now.Unix())
+		if isUniqueViolation(err) {
+			return svalbardsrv.ErrShareAlreadyExists
+		}
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			if err == nil {
+				err = svalbardsrv.ErrShareNotFound
+			}
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM tombstones WHERE share_id = ?", shareID)
+		return err
+	})
+}
+
+// PurgeTime returns the purge time of the tombstone of the share identified
+// by 'shareID'.
+func (ss *SQLite) PurgeTime(shareID string) (time.Time, error) {
+	if shareID == "" {
+		return time.Time{}, svalbardsrv.ErrInvalidShareID
+	}
+	var purgeAt int64
+	err := ss.db.QueryRow("SELECT purge_at FROM tombstones WHERE share_id = ?", shareID).Scan(&purgeAt)
+	if err == sql.ErrNoRows {
+		return time.Time{}, svalbardsrv.ErrShareNotFound
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(purgeAt, 0), nil
+}
+
+// Purge removes the tombstones that are due for purging at 'now'.
+func (ss *SQLite) Purge(now time.Time) (int, error) {
+	var n int64
+	err := ss.inTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM owners WHERE share_id IN
+			(SELECT share_id FROM tombstones WHERE purge_at <= ?)`, now.Unix())
+		if err != nil {
+			return err
+		}
+		result, err := tx.Exec("DELETE FROM tombstones WHERE purge_at <= ?", now.Unix())
+		if err != nil {
+			return err
+		}
+		n, err = result.RowsAffected()
+		return err
+	})
+	return int(n), err
+}
+
+// inTx runs 'fn' in a transaction, which is committed if 'fn' succeeds, and
+// rolled back otherwise.
+func (ss *SQLite) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Count returns the number of shares in the store.
+func (ss *SQLite) Count() (int, error) {
+	var n int
+	err := ss.db.QueryRow("SELECT COUNT(*) FROM shares").Scan(&n)
+	return n, err
+}
+
+// ShareIDs returns the ids of all shares in the store, sorted.
+func (ss *SQLite) ShareIDs() ([]string, error) {
+	var ids []string
+	err := ss.query(func(rows *sql.Rows) error {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+		return nil
+	}, "SELECT share_id FROM shares ORDER BY share_id")
+	return ids, err
+}
+
+// ForEach calls 'fn' with every record in the store, sorted by share ID,
+// and stops at the first error.
+func (ss *SQLite) ForEach(fn func(Record) error) error {
+	return ss.query(func(rows *sql.Rows) error {
+		var r Record
+		var value []byte
+		var created int64
+		if err := rows.Scan(&r.ShareID, &value, &created); err != nil {
+			return err
+		}
+		r.Value, r.Created = string(value), time.Unix(created, 0)
+		return fn(r)
+	}, "SELECT share_id, value, created FROM shares ORDER BY share_id")
+}
+
+// query runs 'query' and calls 'fn' for each row of the result.
+func (ss *SQLite) query(fn func(*sql.Rows) error, query string, args ...interface{}) error {
+	rows, err := ss.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// CheckHealth returns nil if the underlying SQLite DB is open and has the
+// expected schema.
+func (ss *SQLite) CheckHealth() error {
+	var version int
+	if err := ss.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version != SchemaVersion {
+		return fmt.Errorf("unexpected schema version %d", version)
+	}
+	return nil
+}
+
+// Close closes the underlying SQLite DB, releasing the corresponding
+// resources.  After Close() the ShareStore cannot be accessed any more.
+func (ss *SQLite) Close() error {
+	return ss.db.Close()
+}
@@ -0,0 +1,219 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package sqlitesharestore
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/svalbard/server/go/sharestoretest"
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+func getDBFilePath(t *testing.T, filename string) string {
+	d, err := ioutil.TempDir("", "test-sqlite-")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	return filepath.Join(d, filename)
+}
+
+func openStore(t *testing.T, filename string) *SQLite {
+	s, err := OpenOrCreate(filename)
+	if err != nil {
+		t.Fatalf("OpenOrCreate(%q): %v", filename, err)
+	}
+	return s
+}
+
+func TestSQLiteShareStore(t *testing.T) {
+	filenames := make(map[svalbardsrv.ShareStore]string)
+	sharestoretest.Run(t, sharestoretest.Factory{
+		New: func(t *testing.T) svalbardsrv.ShareStore {
+			filename := getDBFilePath(t, "conformance_test.db")
+			s := openStore(t, filename)
+			filenames[s] = filename
+			return s
+		},
+		Reopen: func(t *testing.T, s svalbardsrv.ShareStore) svalbardsrv.ShareStore {
+			if err := s.(*SQLite).Close(); err != nil {
+				t.Fatalf("Close(): %v", err)
+			}
+			return openStore(t, filenames[s])
+		},
+	})
+}
+
+func TestSQLiteWAL(t *testing.T) {
+	s := openStore(t, getDBFilePath(t, "wal_test.db"))
+	defer s.Close()
+	var mode string
+	if err := s.db.QueryRow("PRAGMA journal_mode").Scan(&mode); mode != "wal" || err != nil {
+		t.Errorf("journal_mode: got [%q, %v], want [%q, nil]", mode, err, "wal")
+	}
+}
+
+func TestSQLiteSchemaVersion(t *testing.T) {
+	filename := getDBFilePath(t, "schema_test.db")
+	s := openStore(t, filename)
+	if err := s.CheckHealth(); err != nil {
+		t.Errorf("CheckHealth(): got [%v], want [nil]", err)
+	}
+	s.Close()
+	if err := s.CheckHealth(); err == nil {
+		t.Errorf("CheckHealth() after Close(): got [nil], want error")
+	}
+
+	// A DB written by a newer server is not opened.
+	db, err := sql.Open("sqlite", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", SchemaVersion+1)); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if _, err := OpenOrCreate(filename); err != ErrUnknownSchema {
+		t.Errorf("OpenOrCreate() of newer schema: got [%v], want [%v]", err, ErrUnknownSchema)
+	}
+}
+
+func TestSQLiteMigration(t *testing.T) {
+	// A DB of schema version 1, without tombstones.
+	filename := getDBFilePath(t, "migration_test.db")
+	db, err := sql.Open("sqlite", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		migrations[0],
+		"INSERT INTO shares (share_id, value, created) VALUES ('share1', 'some value', 1500000000)",
+		"PRAGMA user_version = 1",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	db.Close()
+
+	s := openStore(t, filename)
+	defer s.Close()
+	if err := s.CheckHealth(); err != nil {
+		t.Errorf("CheckHealth() after migration: got [%v], want [nil]", err)
+	}
+	if got, err := s.Retrieve("share1"); got != "some value" || err != nil {
+		t.Errorf("Retrieve() after migration: got [%q, %v], want [%q, nil]", got, err, "some value")
+	}
+	if err := s.SoftDelete("share1", time.Unix(1600000000, 0)); err != nil {
+		t.Errorf("SoftDelete() after migration: got [%v], want [nil]", err)
+	}
+	// Shares stored before the migration are not indexed by owner.
+	if err := s.StoreForOwner("share2", "some value", "owner1"); err != nil {
+		t.Errorf("StoreForOwner() after migration: got [%v], want [nil]", err)
+	}
+	if got, err := s.OwnerShareIDs("owner1"); !reflect.DeepEqual(got, []string{"share2"}) || err != nil {
+		t.Errorf("OwnerShareIDs() after migration: got [%q, %v], want [%q, nil]", got, err, []string{"share2"})
+	}
+}
+
+func TestSQLiteConcurrentProcesses(t *testing.T) {
+	filename := getDBFilePath(t, "processes_test.db")
+	server := openStore(t, filename)
+	defer server.Close()
+	// Another connection to the DB, e.g. of an ad hoc query, does not
+	// lock out the server.
+	other := openStore(t, filename)
+	defer other.Close()
+	rows, err := other.db.Query("SELECT share_id FROM shares")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	if err := server.Store("share1", "some value"); err != nil {
+		t.Errorf("Store() during a query of another connection: got [%v], want [nil]", err)
+	}
+	if got, err := other.Retrieve("share1"); got != "some value" || err != nil {
+		t.Errorf("Retrieve() from another connection: got [%q, %v], want [%q, nil]", got, err, "some value")
+	}
+	if err := other.Store("share1", "other value"); err != svalbardsrv.ErrShareAlreadyExists {
+		t.Errorf("Store() of existing share from another connection: got [%v], want [%v]", err, svalbardsrv.ErrShareAlreadyExists)
+	}
+}
+
+func TestSQLiteForEach(t *testing.T) {
+	s := openStore(t, getDBFilePath(t, "foreach_test.db"))
+	defer s.Close()
+	created := time.Unix(1500000000, 0)
+	s.now = func() time.Time { return created }
+	for _, id := range []string{"share2", "share1", "share3"} {
+		s.Store(id, "value of "+id)
+	}
+	s.Delete("share3")
+	want := []Record{
+		{"share1", "value of share1", created},
+		{"share2", "value of share2", created},
+	}
+	var got []Record
+	err := s.ForEach(func(r Record) error {
+		got = append(got, r)
+		return nil
+	})
+	if !reflect.DeepEqual(got, want) || err != nil {
+		t.Errorf("ForEach(): got [%v, %v], want [%v, nil]", got, err, want)
+	}
+}
+
+func TestSQLiteMaxSize(t *testing.T) {
+	s := openStore(t, getDBFilePath(t, "max_size_test.db"))
+	defer s.Close()
+	s.SetMaxSize(64 << 10)
+	value := strings.Repeat("x", 1024)
+	n := 0
+	for ; n < 100; n++ {
+		if err := s.Store(fmt.Sprintf("share%d", n), value); err != nil {
+			if err != svalbardsrv.ErrStoreFull {
+				t.Fatalf("Store() of share #%d: got [%v], want [%v]", n, err, svalbardsrv.ErrStoreFull)
+			}
+			break
+		}
+	}
+	if n == 0 || n == 100 {
+		t.Fatalf("Store() of 1kB shares into 64kB: got %d shares stored, want more than 0 and less than 100", n)
+	}
+	// Shares can still be replaced.
+	if err := s.Replace("share0", strings.Repeat("y", 1024)); err != nil {
+		t.Errorf("Replace() in full store: got [%v], want [nil]", err)
+	}
+	if err := s.Replace(fmt.Sprintf("share%d", n), value); err != svalbardsrv.ErrStoreFull {
+		t.Errorf("Replace() of new share in full store: got [%v], want [%v]", err, svalbardsrv.ErrStoreFull)
+	}
+	// Deletions free space for new shares.
+	for i := 0; i < n; i++ {
+		if err := s.Delete(fmt.Sprintf("share%d", i)); err != nil {
+			t.Fatalf("Delete(): %v", err)
+		}
+	}
+	if err := s.Store("share", value); err != nil {
+		t.Errorf("Store() after Delete(): got [%v], want [nil]", err)
+	}
+}
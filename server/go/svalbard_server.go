@@ -18,31 +18,58 @@
 package svalbardsrv
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/google/svalbard/server/go/metrics"
 	"github.com/google/svalbard/server/go/shareid"
 )
 
 // Canonical errors returned upon failures.
 var (
 	ErrExpectedPostRequest              = errors.New("expected POST request")
+	ErrExpectedGetRequest               = errors.New("expected GET request")
 	ErrMissingToken                     = errors.New("missing token")
 	ErrMissingShareValue                = errors.New("missing share_value")
 	ErrMissingRequestID                 = errors.New("missing request_id")
+	ErrInvalidRequestID                 = errors.New("invalid request_id")
 	ErrShareAlreadyExists               = errors.New("share already exists")
 	ErrShareNotFound                    = errors.New("share not found")
 	ErrTokenNotFound                    = errors.New("token not found")
 	ErrTokenExpired                     = errors.New("token expired")
 	ErrTokenNotValid                    = errors.New("token not valid")
+	ErrTokenDeliveryFailed              = errors.New("token delivery failed")
 	ErrUnsupportedOwnerIDType           = errors.New("unsupported owner id type")
+	ErrOwnerIDTypesNotAvailable         = errors.New("owner id types not available")
+	ErrDeliveryStatusNotAvailable       = errors.New("delivery status not available")
+	ErrDeliveryStatusNotFound           = errors.New("delivery status not found")
+	ErrRateLimited                      = errors.New("rate limited")
+	ErrChallengeRequired                = errors.New("challenge required")
+	ErrInvalidChallengeSolution         = errors.New("invalid challenge solution")
+	ErrChallengesNotAvailable           = errors.New("challenges not available")
 	ErrInvalidParametersForMsgWithToken = errors.New("invalid parameters for message with token")
 	ErrInvalidMsgWithToken              = errors.New("invalid message with token")
 	ErrInvalidShareID                   = errors.New("invalid share id")
 	ErrInvalidShareValue                = errors.New("invalid share value")
+	ErrInvalidExpiry                    = errors.New("invalid expiry")
+	ErrExpiryNotAvailable               = errors.New("share expiry not available")
+	ErrSoftDeleteNotAvailable           = errors.New("soft delete not available")
+	ErrRequestTooLarge                  = errors.New("request too large")
+	ErrShareTooLarge                    = errors.New("share value too large")
+	ErrQuotaExceeded                    = errors.New("quota of shares exceeded")
+	ErrStoreFull                        = errors.New("share store full")
+	ErrAuditFailed                      = errors.New("recording of operation failed")
 )
 
 // ShareStore enables storage and retrieval of shares identified by IDs.
@@ -61,6 +88,85 @@ type ShareStore interface {
 	Delete(shareID string) error
 }
 
+// ShareCounter is implemented by ShareStores that can count their shares.
+type ShareCounter interface {
+	// Count returns the number of shares in the store.
+	Count() (int, error)
+}
+
+// ReplacingShareStore is implemented by ShareStores that can replace the
+// value of a share atomically.
+type ReplacingShareStore interface {
+	// Replace replaces the value of the share identified by 'shareID' with
+	// 'shareValue', or stores it like Store if there is no such share.  If it
+	// fails, the share keeps its former value.  The maximal size of the
+	// store (if any) is checked only for new shares, so that records of
+	// a fixed size can be updated in a full store.
+	Replace(shareID, shareValue string) error
+}
+
+// ExpiringShareStore is implemented by ShareStores that let shares expire
+// unless their owners renew them in time.
+type ExpiringShareStore interface {
+	// StoreWithExpiry stores 'shareValue' under 'shareID' like Store, such
+	// that the share expires after 'period' unless it is renewed; a zero
+	// period selects the default of the store.  The store may remind 'owner'
+	// of the expiry, and index the share under 'ownerKey' as StoreForOwner of
+	// OwnerIndexedShareStore does.  It returns ErrInvalidExpiry if 'period'
+	// is negative or exceeds the maximum of the store.
+	StoreWithExpiry(shareID, shareValue string, owner RecipientID, ownerKey string, period time.Duration) error
+	// Renew postpones the expiry of the share identified by 'shareID' to its
+	// period from now, and returns the new expiry, or the zero time if the
+	// share does not expire.  It returns ErrShareNotFound for expired shares.
+	Renew(shareID string) (time.Time, error)
+}
+
+// RecoverableShareStore is implemented by ShareStores that can keep deleted
+// shares as tombstones for a grace period, within which they can be restored.
+type RecoverableShareStore interface {
+	// SoftDelete removes the share identified by 'shareID' like Delete, but
+	// keeps it as a tombstone until 'purgeAt'.  Storing a share under the
+	// same id replaces the tombstone.
+	SoftDelete(shareID string, purgeAt time.Time) error
+	// Undelete restores the share identified by 'shareID' from its
+	// tombstone, if the purge time of the tombstone is after 'now'.
+	// Otherwise it returns ErrShareNotFound.
+	Undelete(shareID string, now time.Time) error
+	// PurgeTime returns the purge time of the tombstone of the share
+	// identified by 'shareID', or ErrShareNotFound if there is none.
+	PurgeTime(shareID string) (time.Time, error)
+	// Purge removes for good the tombstones whose purge time is not after
+	// 'now', and returns their number.
+	Purge(now time.Time) (int, error)
+}
+
+// OwnerIndexedShareStore is implemented by ShareStores that index the shares
+// by their owners, which lets them enforce a maximal number of shares per
+// owner.  The shares of an owner remain in the index while they are deleted
+// but recoverable (see RecoverableShareStore).  Shares stored with Store are
+// not indexed, and cannot be indexed later, as their ids do not reveal their
+// owners.
+type OwnerIndexedShareStore interface {
+	// StoreForOwner stores 'shareValue' under 'shareID' like Store, and
+	// indexes the share under 'ownerKey' (see WithOwnerIndexKey).  It
+	// returns ErrQuotaExceeded if the owner has the maximal number of shares
+	// of the store already.
+	StoreForOwner(shareID, shareValue, ownerKey string) error
+	// OwnerShareIDs returns the ids of the shares indexed under 'ownerKey',
+	// sorted.
+	OwnerShareIDs(ownerKey string) ([]string, error)
+}
+
+// CapacityChecker is implemented by ShareStores with limits, which can tell
+// before a share is stored whether it would exceed them.
+type CapacityChecker interface {
+	// CheckCapacity returns ErrQuotaExceeded if the owner with 'ownerKey'
+	// has the maximal number of shares besides the one identified by
+	// 'shareID', ErrStoreFull if the store holds its maximal size of data,
+	// and nil otherwise.
+	CheckCapacity(shareID, ownerKey string) error
+}
+
 // TokenStore generates short-lived "access" tokens for various operations,
 // and checks their validity.
 // Every TokenStore implementation should in case of failures return
@@ -73,13 +179,18 @@ type TokenStore interface {
 	// for the operation 'op' on the share identified by 'shareID'.
 	// Otherwise it returns an error indicating why the token is not valid.
 	IsTokenValidNow(token, shareID string, op Operation) error
+	// RevokeToken invalidates the given token, so that it cannot be used
+	// for any operation.  It returns ErrTokenNotFound for unknown tokens.
+	RevokeToken(token string) error
 }
 
 // TokenMsgData contains information needed to generate a message with a token
 // to be sent using a secondary communication channel.
 type TokenMsgData struct {
-	ReqID string
-	Token string
+	ReqID  string
+	Token  string
+	Op     Operation // the operation the token is issued for
+	Locale string    // the preferred locale of the recipient, may be empty
 }
 
 // RecipientID identifies an recipient and a communication channel.
@@ -88,6 +199,13 @@ type RecipientID struct {
 	ID     string
 }
 
+// LogValue returns the recipient as a group of attributes whose keys are
+// those of the request parameters, so that the owner id gets redacted
+// in the logs (see package logging).
+func (r RecipientID) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("owner_id_type", r.IDType), slog.String("owner_id", r.ID))
+}
+
 // SecondaryChannel enables a secondary, one-way communication from server to client.
 // It is used for sending short-lived tokens that authorize various operations.
 // Every SecondaryChannel implementation must ensure that the errors returned
@@ -98,6 +216,106 @@ type SecondaryChannel interface {
 	Send(recipient RecipientID, tokenMsgData TokenMsgData) error
 }
 
+// OwnerIDTypeLister is implemented by SecondaryChannels that can enumerate
+// the owner id types they support.
+type OwnerIDTypeLister interface {
+	// SupportedOwnerIDTypes returns the list of supported owner id types.
+	SupportedOwnerIDTypes() []string
+}
+
+// RecipientNormalizer is implemented by SecondaryChannels that normalize
+// the recipients before sending messages to them.
+type RecipientNormalizer interface {
+	// Recipient returns 'recipient' in the normalized form the messages are
+	// sent to, e.g. with aliases of owner id types resolved.
+	Recipient(recipient RecipientID) RecipientID
+}
+
+// Delivery statuses of messages sent via secondary channels
+// that deliver the messages asynchronously.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// DeliveryStatusReporter is implemented by SecondaryChannels that deliver
+// the messages asynchronously, and can report the status of the delivery.
+type DeliveryStatusReporter interface {
+	// DeliveryStatus returns the delivery status (one of DeliveryPending,
+	// DeliveryDelivered, DeliveryFailed) of the message with the request id
+	// 'reqID' sent to 'recipient', or ErrDeliveryStatusNotFound.
+	DeliveryStatus(recipient RecipientID, reqID string) (string, error)
+}
+
+// HealthChecker is implemented by ShareStores, TokenStores and
+// SecondaryChannels (and other dependencies of the server) that can check
+// whether they are able to serve requests.  A SecondaryChannel implements it
+// to offer a self-test, which must not send any messages.
+type HealthChecker interface {
+	// CheckHealth returns nil if the dependency is healthy, otherwise
+	// an error that describes the problem.
+	CheckHealth() error
+}
+
+// Version is the version of the server, reported by VersionHandler.
+// It can be set at build time with
+// -ldflags "-X github.com/google/svalbard/server/go/svalbardsrv.Version=...".
+var Version = "dev"
+
+// maxRequestIDLength is the maximal length of request ids.
+const maxRequestIDLength = 64
+
+// serverRequestIDPrefixes are the prefixes of the ids of the messages that
+// the server sends on its own, e.g. renewal reminders.  Clients cannot use
+// them, so that their requests cannot pass for such messages.
+var serverRequestIDPrefixes = []string{"deleted-", "reminder-"}
+
+// isValidRequestID returns true if 'reqID' consists of at most
+// maxRequestIDLength ASCII letters, digits, '_' and '-', and does not start
+// with any of serverRequestIDPrefixes.  The request ids are embedded in the
+// messages to the owners, so that arbitrary text in them could be used for
+// phishing.
+func isValidRequestID(reqID string) bool {
+	if len(reqID) > maxRequestIDLength {
+		return false
+	}
+	for _, prefix := range serverRequestIDPrefixes {
+		if strings.HasPrefix(reqID, prefix) {
+			return false
+		}
+	}
+	for _, c := range reqID {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// newServerRequestID returns a random id with 'prefix' (one of
+// serverRequestIDPrefixes) for a message that the server sends on its own.
+// The ids are random, so that nobody can guess them, e.g. to query the
+// delivery statuses of the messages.
+func newServerRequestID(prefix string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(b), nil
+}
+
+// maxExpiresIn bounds the period after which a share expires, as requested
+// by the clients, so that it does not overflow a time.Duration.
+const maxExpiresIn = 100 * 365 * 24 * time.Hour
+
+// Default limits of the size of requests and of share values, see
+// WithMaxRequestSize and WithMaxShareSize.
+const (
+	DefaultMaxRequestSize = 256 << 10
+	DefaultMaxShareSize   = 64 << 10
+)
+
 // GetMsgWithToken generates a message for the given 'data'.
 func GetMsgWithToken(data TokenMsgData) (string, error) {
 	if len(data.ReqID) < 1 || strings.Index(data.ReqID, ":") != -1 ||
@@ -109,17 +327,95 @@ func GetMsgWithToken(data TokenMsgData) (string, error) {
 
 // ParseMsgWithToken expects a message with token as generated by GetMsgWithToken,
 // and parses it to provide the corresponding reqID and token separately.
+// The message may also be a longer text (e.g. a localized message), in which
+// case the first of its lines that is a valid message with token is parsed.
 func ParseMsgWithToken(msg string) (TokenMsgData, error) {
-	if len(msg) < 5 || strings.ToUpper(msg[:5]) != "SVBD:" {
-		return TokenMsgData{"", ""}, ErrInvalidMsgWithToken
+	for _, line := range strings.Split(msg, "\n") {
+		if data, err := parseLineWithToken(strings.TrimSpace(line)); err == nil {
+			return data, nil
+		}
 	}
-	parts := strings.Split(msg[5:], ":")
+	return TokenMsgData{}, ErrInvalidMsgWithToken
+}
+
+func parseLineWithToken(line string) (TokenMsgData, error) {
+	if len(line) < 5 || strings.ToUpper(line[:5]) != "SVBD:" {
+		return TokenMsgData{}, ErrInvalidMsgWithToken
+	}
+	parts := strings.Split(line[5:], ":")
 	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
-		return TokenMsgData{"", ""}, ErrInvalidMsgWithToken
+		return TokenMsgData{}, ErrInvalidMsgWithToken
 	}
 	return TokenMsgData{ReqID: parts[0], Token: parts[1]}, nil
 }
 
+// RateLimiter limits the rate at which tokens are issued and sent,
+// e.g. to limit the costs of the secondary channels, and to prevent using
+// the server for flooding the recipients with messages.
+type RateLimiter interface {
+	// Allow returns true if a token may be sent to 'recipient' upon
+	// a request from a client with IP address 'clientIP' (which may be nil
+	// if unknown).  Otherwise it returns false and the duration after which
+	// the request may be retried.
+	Allow(recipient RecipientID, clientIP net.IP) (bool, time.Duration)
+}
+
+// ChallengeGuard requires proof-of-work from the clients that request tokens,
+// e.g. when the server is under load, or when tokens are requested
+// for a single recipient too often.
+type ChallengeGuard interface {
+	// Required records a request for a token for 'recipient', and returns
+	// true if the request must carry a solution of a challenge.
+	Required(recipient RecipientID) bool
+	// NewChallenge returns a new challenge, and the time when it expires.
+	NewChallenge() (string, time.Time, error)
+	// Verify returns nil if 'solution' is a valid solution of 'challenge',
+	// which was issued by NewChallenge, has not expired, and has not been
+	// used before.
+	Verify(challenge, solution string) error
+}
+
+// AuditEvent describes a request for a token or an operation on a share,
+// as recorded in an audit log.
+type AuditEvent struct {
+	Time      time.Time
+	Operation string // one of the Audit* operations below
+	ShareID   string // empty if the request did not identify a share
+	ReqID     string // empty if the request had no request_id
+	ClientIP  net.IP // nil if unknown
+	Status    int    // HTTP status of the response
+}
+
+// Operations recorded in AuditEvents.
+const (
+	AuditGetStorageToken    = "get_storage_token"
+	AuditStoreShare         = "store_share"
+	AuditGetRetrievalToken  = "get_retrieval_token"
+	AuditRetrieveShare      = "retrieve_share"
+	AuditGetDeletionToken   = "get_deletion_token"
+	AuditDeleteShare        = "delete_share"
+	AuditGetRenewalToken    = "get_renewal_token"
+	AuditRenewShare         = "renew_share"
+	AuditGetUndeletionToken = "get_undeletion_token"
+	AuditUndeleteShare      = "undelete_share"
+)
+
+// Auditor records AuditEvents, e.g. in a tamper-evident audit log.
+type Auditor interface {
+	Audit(event AuditEvent) error
+}
+
+// CommittingAuditor is implemented by Auditors that must record a successful
+// request before its response is sent, e.g. a transparency log, which
+// promises that no retrieval of a share goes unrecorded.  The server passes
+// the event of a successful request to Commit before it sends the response,
+// and fails the request with ErrAuditFailed instead if Commit fails.  Events
+// passed to Commit are not passed to Audit again.
+type CommittingAuditor interface {
+	Auditor
+	Commit(event AuditEvent) error
+}
+
 // Operation identifies operations guarded by the tokens.
 type Operation int
 
@@ -128,6 +424,8 @@ const (
 	OpStoreShare Operation = iota
 	OpRetrieveShare
 	OpDeleteShare
+	OpRenewShare
+	OpUndeleteShare
 )
 
 // Server is a Svalbard server that stores shares and offers them for retrieval.
@@ -135,17 +433,170 @@ type Server struct {
 	shareStore       ShareStore
 	tokenStore       TokenStore
 	secondaryChannel SecondaryChannel
+	rateLimiter      RateLimiter
+	statusLimiter    RateLimiter
+	challengeGuard   ChallengeGuard
+	auditors         []Auditor
+	logger           *slog.Logger
+	metrics          *serverMetrics
+	healthCheckers   []namedHealthChecker
+	deletionGrace    time.Duration
+	maxRequestSize   int64
+	maxShareSize     int
+	ownerIndexKey    []byte
+}
+
+// namedHealthChecker is a HealthChecker of a dependency of a Server.
+type namedHealthChecker struct {
+	name    string
+	checker HealthChecker
+}
+
+// Option configures an optional feature of a Server.
+type Option func(*Server)
+
+// WithRateLimiter makes the server consult 'rateLimiter' before issuing
+// any token.
+func WithRateLimiter(rateLimiter RateLimiter) Option {
+	return func(s *Server) {
+		s.rateLimiter = rateLimiter
+	}
+}
+
+// WithDeliveryStatusRateLimiter makes the server consult 'rateLimiter' before
+// answering any request for a delivery status, so that clients cannot poll
+// the statuses without bounds.  It should be separate from the limiter of the
+// tokens, so that polling does not use up the tokens of the recipients.
+func WithDeliveryStatusRateLimiter(rateLimiter RateLimiter) Option {
+	return func(s *Server) {
+		s.statusLimiter = rateLimiter
+	}
+}
+
+// WithChallengeGuard makes the server require solutions of challenges
+// issued by 'challengeGuard' in token requests, whenever the guard says so.
+func WithChallengeGuard(challengeGuard ChallengeGuard) Option {
+	return func(s *Server) {
+		s.challengeGuard = challengeGuard
+	}
+}
+
+// WithAuditor makes the server record every request for a token and every
+// operation on a share with 'auditor'.  It can be given several times,
+// to record the requests with several auditors.
+func WithAuditor(auditor Auditor) Option {
+	return func(s *Server) {
+		s.auditors = append(s.auditors, auditor)
+	}
+}
+
+// WithLogger makes the server log with 'logger' instead of slog.Default().
+// The logger should redact the owner ids, see package logging; the server
+// itself never logs any tokens or share values.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// WithMetrics makes the server record metrics of the issued and verified
+// tokens, of the secondary channel and of the share store in 'registry'.
+// If the share store implements ShareCounter, the number of stored shares
+// is exported as well.
+func WithMetrics(registry *metrics.Registry) Option {
+	return func(s *Server) {
+		s.metrics = newServerMetrics(registry)
+	}
+}
+
+// WithSoftDelete makes the server keep deleted shares as tombstones for
+// 'gracePeriod', within which their owners can undelete them, and notify
+// the owners of deletions with undeletion tokens.  The share store must
+// implement RecoverableShareStore, and the tombstones must be purged
+// (see RecoverableShareStore.Purge) by the caller.
+func WithSoftDelete(gracePeriod time.Duration) Option {
+	return func(s *Server) {
+		s.deletionGrace = gracePeriod
+	}
+}
+
+// WithMaxRequestSize makes the server reject requests whose bodies are
+// longer than 'n' bytes (instead of DefaultMaxRequestSize) with
+// ErrRequestTooLarge.  If 'n' is 0, the size of requests is not limited.
+func WithMaxRequestSize(n int64) Option {
+	return func(s *Server) {
+		s.maxRequestSize = n
+	}
+}
+
+// WithMaxShareSize makes the server reject share values that are longer
+// than 'n' bytes (instead of DefaultMaxShareSize) with ErrShareTooLarge.
+// If 'n' is 0, the size of share values is not limited.
+func WithMaxShareSize(n int) Option {
+	return func(s *Server) {
+		s.maxShareSize = n
+	}
+}
+
+// WithOwnerIndexKey makes the server index the shares by their owners (if the
+// share store supports it, see OwnerIndexedShareStore) under owner keys that
+// are HMACs of the normalized owner ids under 'key' (see shareid.GetOwnerKey).
+// The key must be kept secret, and must not change, as the shares indexed
+// under the owner keys of a former key no longer count for their owners.
+// Without this option, shares are not indexed.
+func WithOwnerIndexKey(key []byte) Option {
+	return func(s *Server) {
+		s.ownerIndexKey = key
+	}
+}
+
+// WithHealthChecker makes the server check the dependency 'name' with
+// 'checker' whenever it is asked whether it is ready, in addition to the
+// stores and the secondary channel.  It can be given several times.
+func WithHealthChecker(name string, checker HealthChecker) Option {
+	return func(s *Server) {
+		s.healthCheckers = append(s.healthCheckers, namedHealthChecker{name, checker})
+	}
 }
 
 // NewServer returns a new, initialized Svalbard server that uses the specified
 // stores and offers all necessary handlers.
 func NewServer(tokenStore TokenStore, shareStore ShareStore,
-	secondaryChannel SecondaryChannel) *Server {
-	return &Server{
+	secondaryChannel SecondaryChannel, opts ...Option) *Server {
+	s := &Server{
 		tokenStore:       tokenStore,
 		shareStore:       shareStore,
 		secondaryChannel: secondaryChannel,
+		logger:           slog.Default(),
+		maxRequestSize:   DefaultMaxRequestSize,
+		maxShareSize:     DefaultMaxShareSize,
+	}
+	var checkers []namedHealthChecker
+	for _, dep := range []struct {
+		name string
+		dep  interface{}
+	}{
+		{"share_store", shareStore},
+		{"token_store", tokenStore},
+		{"secondary_channel", secondaryChannel},
+	} {
+		if checker, ok := dep.dep.(HealthChecker); ok {
+			checkers = append(checkers, namedHealthChecker{dep.name, checker})
+		}
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.healthCheckers = append(checkers, s.healthCheckers...)
+	if s.metrics != nil {
+		if counter, ok := shareStore.(ShareCounter); ok {
+			s.metrics.registry.GaugeFunc("svalbard_shares", "Number of stored shares.", func() (float64, error) {
+				n, err := counter.Count()
+				return float64(n), err
+			})
+		}
+	}
+	return s
 }
 
 // GetStorageTokenHandler handles requests for a token that can be used to store a share.
@@ -154,86 +605,128 @@ func NewServer(tokenStore TokenStore, shareStore ShareStore,
 //  - owner_id_type: type of id, e.g. "SMS", "email", ...
 //  - owner_id:  actual id, e.g. a phone number, e-mail address
 //  - secret_name: the name of the secret that the desired share belongs to
+//  - locale: (optional) the preferred locale of the message with the token, e.g. "de-CH"
+//  - challenge, challenge_solution: (optional) a challenge obtained from
+//    ChallengeHandler and its solution, required if the server demands it
 func (s *Server) GetStorageTokenHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("-------------- GET_STORAGE_TOKEN")
-	log.Println(r)
+	s.logRequest(r, "get_storage_token")
+	s.handleTokenRequest(w, r, OpStoreShare)
+}
+
+// StoreShareHandler handles requests that want to store a share.
+// Request r must be a POST request with the following form data:
+//  - token: the retrieval token that the client obtained via a secondary channel
+//  - owner_id_type: type of id, e.g. "SMS", "email", ...
+//  - owner_id:  actual id, e.g. a phone number, e-mail address
+//  - secret_name: the name of the secret that the share_value belongs to
+//  - share_value: the actual value of the share, of at most the maximal
+//    share size (see WithMaxShareSize)
+//  - expires_in: (optional) the number of seconds after which the share
+//    expires unless it is renewed, if the share store supports expiry;
+//    the share store may impose a default and a maximum
+func (s *Server) StoreShareHandler(w http.ResponseWriter, r *http.Request) {
+	s.logRequest(r, "store_share")
+	w, audit := s.startAudit(w, r, AuditStoreShare)
+	defer audit.finish()
 	if r.Method != "POST" {
 		http.Error(w, ErrExpectedPostRequest.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Parse the request.
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("Parsing of POST data failed: %v\n", err)
+	if err := s.parseForm(w, r); err != nil {
+		return
+	}
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, ErrMissingToken.Error(), http.StatusBadRequest)
 		return
 	}
+	shareValue := r.FormValue("share_value")
+	if shareValue == "" {
+		http.Error(w, ErrMissingShareValue.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.maxShareSize > 0 && len(shareValue) > s.maxShareSize {
+		http.Error(w, ErrShareTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var period time.Duration
+	if expiresIn := r.FormValue("expires_in"); expiresIn != "" {
+		seconds, err := strconv.ParseInt(expiresIn, 10, 64)
+		if err != nil || seconds <= 0 || seconds > int64(maxExpiresIn/time.Second) {
+			http.Error(w, ErrInvalidExpiry.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := s.shareStore.(ExpiringShareStore); !ok {
+			http.Error(w, ErrExpiryNotAvailable.Error(), http.StatusNotImplemented)
+			return
+		}
+		period = time.Duration(seconds) * time.Second
+	}
+
 	ownerIDType := r.FormValue("owner_id_type")
 	ownerID := r.FormValue("owner_id")
 	secretName := r.FormValue("secret_name")
-	reqID := r.FormValue("request_id")
-	log.Printf("Parsing of POST data succeeded: ownerIDType=[%v], ownerID=[%v], secretName=[%v], reqID=[%v]\n",
-		ownerIDType, ownerID, secretName, reqID)
+	s.logger.Debug("parsed POST data", "recipient", RecipientID{ownerIDType, ownerID})
 
-	// Verify the parsed parameters.
-	if reqID == "" {
-		http.Error(w, ErrMissingRequestID.Error(), http.StatusBadRequest)
-		return
-	}
 	shareID, err := shareid.GetShareID(ownerIDType, ownerID, secretName)
 	if err != nil {
 		http.Error(w, errToPublicMessage(err), http.StatusBadRequest)
 		return
 	}
-	// Check that the share does not exist yet.
-	if _, err = s.shareStore.Retrieve(shareID); err == nil {
-		http.Error(w, "Req. "+reqID+": share already exists.", http.StatusForbidden)
-		return
-	}
-
-	// Generate a new storage token.
-	token, err := s.tokenStore.GetNewToken(shareID, OpStoreShare)
+	audit.setShareID(shareID)
+	err = s.verifyToken(token, shareID, OpStoreShare)
 	if err != nil {
-		log.Printf("--- req. %s: generation of storage token for share of [%s] failed: %v\n",
-			reqID, secretName, err)
-		http.Error(w, "Req. "+reqID+": could not generate storage token, try later again.",
-			http.StatusInternalServerError)
+		http.Error(w, "could not store the share: "+errToPublicMessage(err), http.StatusForbidden)
 		return
 	}
-
-	// Send the token via the secondary channel.
-	err = s.secondaryChannel.Send(RecipientID{ownerIDType, ownerID},
-		TokenMsgData{reqID, token})
+	err = s.storeShare(shareID, shareValue, RecipientID{ownerIDType, ownerID}, period)
 	if err != nil {
-		http.Error(w, "Req. "+reqID+": error occurred while sending storage token: "+err.Error(),
-			http.StatusInternalServerError)
+		if err == ErrShareAlreadyExists || err == ErrQuotaExceeded {
+			http.Error(w, errToPublicMessage(err), http.StatusForbidden)
+		} else if err == ErrInvalidExpiry {
+			http.Error(w, errToPublicMessage(err), http.StatusBadRequest)
+		} else if err == ErrStoreFull {
+			http.Error(w, errToPublicMessage(err), http.StatusInsufficientStorage)
+		} else {
+			http.Error(w, errToPublicMessage(err), http.StatusInternalServerError)
+		}
+		return
 	}
+	s.logger.Info("stored share", "share_id", shareID, "recipient", RecipientID{ownerIDType, ownerID})
+	fmt.Fprintf(w, "Stored a share of secret [%s] for owner [%s:%s]", secretName, ownerIDType, ownerID)
+}
 
-	// Log the operation, and prepare the response.
-	log.Printf("--- req. %s: generated storage token [%s] for share of [%s] sent to [%s:%s]\n",
-		reqID, token, secretName, ownerIDType, ownerID)
-	fmt.Fprintf(w, "Req. %s: storage token for share of [%s] sent to [%s:%s]",
-		reqID, secretName, ownerIDType, ownerID)
+// GetRetrievalTokenHandler handles requests for a token that can be used to retrieve a share.
+// Request r must be a POST request with the following form data:
+//  - request_id: an id of that particular request
+//  - owner_id_type: type of id, e.g. "SMS", "email", ...
+//  - owner_id:  actual id, e.g. a phone number, e-mail address
+//  - secret_name: the name of the secret that the desired share belongs to
+//  - locale: (optional) the preferred locale of the message with the token, e.g. "de-CH"
+//  - challenge, challenge_solution: (optional) a challenge obtained from
+//    ChallengeHandler and its solution, required if the server demands it
+func (s *Server) GetRetrievalTokenHandler(w http.ResponseWriter, r *http.Request) {
+	s.logRequest(r, "get_retrieval_token")
+	s.handleTokenRequest(w, r, OpRetrieveShare)
 }
 
-// StoreShareHandler handles requests that want to store a share.
+// RetrieveShareHandler handles requests that want to retrieve a share.
 // Request r must be a POST request with the following form data:
 //  - token: the retrieval token that the client obtained via a secondary channel
 //  - owner_id_type: type of id, e.g. "SMS", "email", ...
 //  - owner_id:  actual id, e.g. a phone number, e-mail address
-//  - secret_name: the name of the secret that the share_value belongs to
-//  - share_value: the actual value of the share
-func (s *Server) StoreShareHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("-------------- STORE_SHARE")
-	log.Println(r)
+//  - secret_name: the name of the secret that the desired share belongs to
+func (s *Server) RetrieveShareHandler(w http.ResponseWriter, r *http.Request) {
+	s.logRequest(r, "retrieve_share")
+	w, audit := s.startAudit(w, r, AuditRetrieveShare)
+	defer audit.finish()
 	if r.Method != "POST" {
 		http.Error(w, ErrExpectedPostRequest.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("Parsing of POST data failed: %v\n", err)
+	if err := s.parseForm(w, r); err != nil {
 		return
 	}
 	token := r.FormValue("token")
@@ -241,118 +734,141 @@ func (s *Server) StoreShareHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, ErrMissingToken.Error(), http.StatusBadRequest)
 		return
 	}
-	shareValue := r.FormValue("share_value")
-	if shareValue == "" {
-		http.Error(w, ErrMissingShareValue.Error(), http.StatusBadRequest)
-		return
-	}
 
 	ownerIDType := r.FormValue("owner_id_type")
 	ownerID := r.FormValue("owner_id")
 	secretName := r.FormValue("secret_name")
-	log.Printf("Parsing of POST data succeeded: ownerID=[%v], ownerIDType=[%v], secretName=[%v], token=[%v]\n",
-		ownerIDType, ownerID, secretName, token)
+	s.logger.Debug("parsed POST data", "recipient", RecipientID{ownerIDType, ownerID})
 
 	shareID, err := shareid.GetShareID(ownerIDType, ownerID, secretName)
 	if err != nil {
 		http.Error(w, errToPublicMessage(err), http.StatusBadRequest)
 		return
 	}
-	err = s.tokenStore.IsTokenValidNow(token, shareID, OpStoreShare)
-	if err != nil {
-		http.Error(w, "could not store the share: "+errToPublicMessage(err), http.StatusForbidden)
+	audit.setShareID(shareID)
+	if err := s.verifyToken(token, shareID, OpRetrieveShare); err != nil {
+		http.Error(w, "could not retrieve the share: "+errToPublicMessage(err), http.StatusForbidden)
 		return
 	}
-	err = s.shareStore.Store(shareID, shareValue)
+	shareValue, err := s.retrieveShare(shareID)
 	if err != nil {
-		if err == ErrShareAlreadyExists {
-			http.Error(w, errToPublicMessage(err), http.StatusForbidden)
-		} else {
-			http.Error(w, errToPublicMessage(err), http.StatusInternalServerError)
-		}
+		http.Error(w, "could not retrieve the share: "+errToPublicMessage(err), http.StatusInternalServerError)
 		return
 	}
-	log.Printf("--- stored a share of secret [%s] for owner [%s:%s]\n", secretName, ownerIDType, ownerID)
-	fmt.Fprintf(w, "Stored a share of secret [%s] for owner [%s:%s]", secretName, ownerIDType, ownerID)
+	fmt.Fprint(w, shareValue)
 }
 
-// GetRetrievalTokenHandler handles requests for a token that can be used to retrieve a share.
+// GetDeletionTokenHandler handles requests for a token that can be used to delete a share.
 // Request r must be a POST request with the following form data:
 //  - request_id: an id of that particular request
 //  - owner_id_type: type of id, e.g. "SMS", "email", ...
 //  - owner_id:  actual id, e.g. a phone number, e-mail address
 //  - secret_name: the name of the secret that the desired share belongs to
-func (s *Server) GetRetrievalTokenHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("-------------- GET_RETRIEVAL_TOKEN")
-	log.Println(r)
+//  - locale: (optional) the preferred locale of the message with the token, e.g. "de-CH"
+//  - challenge, challenge_solution: (optional) a challenge obtained from
+//    ChallengeHandler and its solution, required if the server demands it
+func (s *Server) GetDeletionTokenHandler(w http.ResponseWriter, r *http.Request) {
+	s.logRequest(r, "get_deletion_token")
+	s.handleTokenRequest(w, r, OpDeleteShare)
+}
+
+// DeleteShareHandler handles requests that want to delete a share.  If the
+// server keeps deleted shares (see WithSoftDelete), the owner is sent an
+// undeletion token, and can undelete the share within the grace period.
+// Request r must be a POST request with the following form data:
+//  - token: the deletion token that the client obtained via a secondary channel
+//  - owner_id_type: type of id, e.g. "SMS", "email", ...
+//  - owner_id:  actual id, e.g. a phone number, e-mail address
+//  - secret_name: the name of the secret that the desired share belongs to
+func (s *Server) DeleteShareHandler(w http.ResponseWriter, r *http.Request) {
+	s.logRequest(r, "delete_share")
+	w, audit := s.startAudit(w, r, AuditDeleteShare)
+	defer audit.finish()
 	if r.Method != "POST" {
 		http.Error(w, ErrExpectedPostRequest.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("Parsing of POST data failed: %v\n", err)
+	if err := s.parseForm(w, r); err != nil {
+		return
+	}
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, ErrMissingToken.Error(), http.StatusBadRequest)
 		return
 	}
+
 	ownerIDType := r.FormValue("owner_id_type")
 	ownerID := r.FormValue("owner_id")
 	secretName := r.FormValue("secret_name")
-	reqID := r.FormValue("request_id")
-	log.Printf("Parsing of POST data succeeded: ownerID=[%v], ownerIDType=[%v], secretName=[%v], reqID=[%v]\n",
-		ownerIDType, ownerID, secretName, reqID)
+	s.logger.Debug("parsed POST data", "recipient", RecipientID{ownerIDType, ownerID})
 
-	if reqID == "" {
-		http.Error(w, ErrMissingRequestID.Error(), http.StatusBadRequest)
-		return
-	}
 	shareID, err := shareid.GetShareID(ownerIDType, ownerID, secretName)
 	if err != nil {
 		http.Error(w, errToPublicMessage(err), http.StatusBadRequest)
 		return
 	}
-	_, err = s.shareStore.Retrieve(shareID)
-	if err != nil {
-		http.Error(w, "Req. "+reqID+": share not found.", http.StatusNotFound)
+	audit.setShareID(shareID)
+	if err := s.verifyToken(token, shareID, OpDeleteShare); err != nil {
+		http.Error(w, "could not delete the share: "+errToPublicMessage(err), http.StatusForbidden)
 		return
 	}
-	token, err := s.tokenStore.GetNewToken(shareID, OpRetrieveShare)
+	purgeAt, err := s.deleteShare(shareID)
 	if err != nil {
-		log.Printf("--- req. %s: generation of retrieval token for share of [%s] failed: %v\n",
-			reqID, secretName, err)
-		http.Error(w, "Req. "+reqID+": could not generate retrieval token, try later again.",
-			http.StatusInternalServerError)
+		status := http.StatusInternalServerError
+		if err == ErrSoftDeleteNotAvailable {
+			status = http.StatusNotImplemented
+		}
+		http.Error(w, "could not delete the share: "+errToPublicMessage(err), status)
 		return
 	}
-	err = s.secondaryChannel.Send(RecipientID{ownerIDType, ownerID},
-		TokenMsgData{reqID, token})
-	if err != nil {
-		http.Error(w, "Req. "+reqID+": error occurred while sending retrieval token: "+err.Error(),
-			http.StatusInternalServerError)
+	owner := RecipientID{ownerIDType, ownerID}
+	if purgeAt.IsZero() {
+		s.logger.Info("deleted share", "share_id", shareID, "recipient", owner)
+		fmt.Fprintf(w, "Deleted a share of secret [%s] of owner [%s:%s]", secretName, ownerIDType, ownerID)
+		return
 	}
-	log.Printf("--- req. %s: generated retrieval token [%s] for share of [%s] sent to [%s:%s]\n",
-		reqID, token, secretName, ownerIDType, ownerID)
-	fmt.Fprintf(w, "Req. %s: retrieval token for share of [%s] sent to [%s:%s]",
-		reqID, secretName, ownerIDType, ownerID)
+	s.logger.Info("soft-deleted share", "share_id", shareID, "recipient", owner, "purge_at", purgeAt)
+	// The deletion stands even if the owner cannot be notified.
+	if reqID, err := s.sendOperationToken(shareID, owner, OpUndeleteShare, "deleted-"); err != nil {
+		s.logger.Warn("notification of deletion failed", "request_id", reqID, "share_id", shareID, "error", err)
+	}
+	fmt.Fprintf(w, "Deleted a share of secret [%s] of owner [%s:%s], which can be undeleted until %s",
+		secretName, ownerIDType, ownerID, purgeAt.UTC().Format(time.RFC3339))
 }
 
-// RetrieveShareHandler handles requests that want to retrieve a share.
+// GetRenewalTokenHandler handles requests for a token that can be used to renew
+// a share, i.e. to postpone its expiry.
 // Request r must be a POST request with the following form data:
-//  - token: the retrieval token that the client obtained via a secondary channel
+//  - request_id: an id of that particular request
 //  - owner_id_type: type of id, e.g. "SMS", "email", ...
 //  - owner_id:  actual id, e.g. a phone number, e-mail address
 //  - secret_name: the name of the secret that the desired share belongs to
-func (s *Server) RetrieveShareHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("-------------- RETRIEVE_SHARE")
-	log.Println(r)
+//  - locale: (optional) the preferred locale of the message with the token, e.g. "de-CH"
+//  - challenge, challenge_solution: (optional) a challenge obtained from
+//    ChallengeHandler and its solution, required if the server demands it
+func (s *Server) GetRenewalTokenHandler(w http.ResponseWriter, r *http.Request) {
+	s.logRequest(r, "get_renewal_token")
+	s.handleTokenRequest(w, r, OpRenewShare)
+}
+
+// RenewShareHandler handles requests that want to renew a share, which
+// postpones its expiry by the period given when the share was stored.
+// Request r must be a POST request with the following form data:
+//  - token: the renewal token that the client obtained via a secondary channel
+//  - owner_id_type: type of id, e.g. "SMS", "email", ...
+//  - owner_id:  actual id, e.g. a phone number, e-mail address
+//  - secret_name: the name of the secret that the desired share belongs to
+func (s *Server) RenewShareHandler(w http.ResponseWriter, r *http.Request) {
+	s.logRequest(r, "renew_share")
+	w, audit := s.startAudit(w, r, AuditRenewShare)
+	defer audit.finish()
 	if r.Method != "POST" {
 		http.Error(w, ErrExpectedPostRequest.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("Parsing of POST data failed: %v\n", err)
+	if err := s.parseForm(w, r); err != nil {
 		return
 	}
 	token := r.FormValue("token")
@@ -364,125 +880,917 @@ func (s *Server) RetrieveShareHandler(w http.ResponseWriter, r *http.Request) {
 	ownerIDType := r.FormValue("owner_id_type")
 	ownerID := r.FormValue("owner_id")
 	secretName := r.FormValue("secret_name")
-	log.Printf("Parsing of POST data succeeded: ownerID=[%v], ownerIDType=[%v], secretName=[%v], token=[%v]\n",
-		ownerIDType, ownerID, secretName, token)
+	s.logger.Debug("parsed POST data", "recipient", RecipientID{ownerIDType, ownerID})
 
 	shareID, err := shareid.GetShareID(ownerIDType, ownerID, secretName)
 	if err != nil {
 		http.Error(w, errToPublicMessage(err), http.StatusBadRequest)
 		return
 	}
-	if err := s.tokenStore.IsTokenValidNow(token, shareID, OpRetrieveShare); err != nil {
-		http.Error(w, "could not retrieve the share: "+errToPublicMessage(err), http.StatusForbidden)
+	audit.setShareID(shareID)
+	if err := s.verifyToken(token, shareID, OpRenewShare); err != nil {
+		http.Error(w, "could not renew the share: "+errToPublicMessage(err), http.StatusForbidden)
 		return
 	}
-	shareValue, err := s.shareStore.Retrieve(shareID)
-	if err != nil {
-		http.Error(w, "could not retrieve the share: "+errToPublicMessage(err), http.StatusInternalServerError)
+	expires, err := s.renewShare(shareID)
+	switch {
+	case err == ErrShareNotFound:
+		http.Error(w, "could not renew the share: "+errToPublicMessage(err), http.StatusNotFound)
+		return
+	case err == ErrExpiryNotAvailable:
+		http.Error(w, "could not renew the share: "+errToPublicMessage(err), http.StatusNotImplemented)
+		return
+	case err != nil:
+		http.Error(w, "could not renew the share: "+errToPublicMessage(err), http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprint(w, shareValue)
+	s.logger.Info("renewed share", "share_id", shareID, "recipient", RecipientID{ownerIDType, ownerID}, "expires", expires)
+	if expires.IsZero() {
+		fmt.Fprintf(w, "The share of secret [%s] of owner [%s:%s] does not expire", secretName, ownerIDType, ownerID)
+		return
+	}
+	fmt.Fprintf(w, "Renewed a share of secret [%s] of owner [%s:%s] until %s",
+		secretName, ownerIDType, ownerID, expires.UTC().Format(time.RFC3339))
 }
 
-// GetDeletionTokenHandler handles requests for a token that can be used to delete a share.
+// GetUndeletionTokenHandler handles requests for a token that can be used to
+// undelete a share within the grace period after its deletion.
 // Request r must be a POST request with the following form data:
 //  - request_id: an id of that particular request
 //  - owner_id_type: type of id, e.g. "SMS", "email", ...
 //  - owner_id:  actual id, e.g. a phone number, e-mail address
 //  - secret_name: the name of the secret that the desired share belongs to
-func (s *Server) GetDeletionTokenHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("-------------- GET_DELETION_TOKEN")
-	log.Println(r)
+//  - locale: (optional) the preferred locale of the message with the token, e.g. "de-CH"
+//  - challenge, challenge_solution: (optional) a challenge obtained from
+//    ChallengeHandler and its solution, required if the server demands it
+func (s *Server) GetUndeletionTokenHandler(w http.ResponseWriter, r *http.Request) {
+	s.logRequest(r, "get_undeletion_token")
+	s.handleTokenRequest(w, r, OpUndeleteShare)
+}
+
+// UndeleteShareHandler handles requests that want to undelete a share, which
+// restores a deleted share within the grace period after its deletion.
+// Request r must be a POST request with the following form data:
+//  - token: the undeletion token that the client obtained via a secondary channel
+//  - owner_id_type: type of id, e.g. "SMS", "email", ...
+//  - owner_id:  actual id, e.g. a phone number, e-mail address
+//  - secret_name: the name of the secret that the desired share belongs to
+func (s *Server) UndeleteShareHandler(w http.ResponseWriter, r *http.Request) {
+	s.logRequest(r, "undelete_share")
+	w, audit := s.startAudit(w, r, AuditUndeleteShare)
+	defer audit.finish()
 	if r.Method != "POST" {
 		http.Error(w, ErrExpectedPostRequest.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("Parsing of POST data failed: %v\n", err)
+	if err := s.parseForm(w, r); err != nil {
+		return
+	}
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, ErrMissingToken.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ownerIDType := r.FormValue("owner_id_type")
+	ownerID := r.FormValue("owner_id")
+	secretName := r.FormValue("secret_name")
+	s.logger.Debug("parsed POST data", "recipient", RecipientID{ownerIDType, ownerID})
+
+	shareID, err := shareid.GetShareID(ownerIDType, ownerID, secretName)
+	if err != nil {
+		http.Error(w, errToPublicMessage(err), http.StatusBadRequest)
+		return
+	}
+	audit.setShareID(shareID)
+	if err := s.verifyToken(token, shareID, OpUndeleteShare); err != nil {
+		http.Error(w, "could not undelete the share: "+errToPublicMessage(err), http.StatusForbidden)
+		return
+	}
+	switch err := s.undeleteShare(shareID); {
+	case err == ErrShareNotFound:
+		http.Error(w, "could not undelete the share: "+errToPublicMessage(err), http.StatusNotFound)
+		return
+	case err == ErrSoftDeleteNotAvailable:
+		http.Error(w, "could not undelete the share: "+errToPublicMessage(err), http.StatusNotImplemented)
+		return
+	case err != nil:
+		http.Error(w, "could not undelete the share: "+errToPublicMessage(err), http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info("undeleted share", "share_id", shareID, "recipient", RecipientID{ownerIDType, ownerID})
+	fmt.Fprintf(w, "Undeleted a share of secret [%s] of owner [%s:%s]", secretName, ownerIDType, ownerID)
+}
+
+// tokenNames are the names of the tokens for the operations, used in messages.
+var tokenNames = map[Operation]string{
+	OpStoreShare:    "storage",
+	OpRetrieveShare: "retrieval",
+	OpDeleteShare:   "deletion",
+	OpRenewShare:    "renewal",
+	OpUndeleteShare: "undeletion",
+}
+
+// tokenAuditOps are the audited operations of requests for tokens.
+var tokenAuditOps = map[Operation]string{
+	OpStoreShare:    AuditGetStorageToken,
+	OpRetrieveShare: AuditGetRetrievalToken,
+	OpDeleteShare:   AuditGetDeletionToken,
+	OpRenewShare:    AuditGetRenewalToken,
+	OpUndeleteShare: AuditGetUndeletionToken,
+}
+
+// handleTokenRequest handles a request for a token for the operation 'op',
+// as described at GetStorageTokenHandler, GetRetrievalTokenHandler,
+// GetDeletionTokenHandler, GetRenewalTokenHandler and
+// GetUndeletionTokenHandler.  A storage token is issued only for a share that
+// neither exists nor is deleted, an undeletion token only for a share that
+// can still be undeleted, other tokens only for existing shares.
+func (s *Server) handleTokenRequest(w http.ResponseWriter, r *http.Request, op Operation) {
+	w, audit := s.startAudit(w, r, tokenAuditOps[op])
+	defer audit.finish()
+	// outcome is the canonical error of a failed request, or nil.
+	var outcome error
+	defer func() { s.metrics.tokenIssued(op, outcome) }()
+	if r.Method != "POST" {
+		outcome = ErrExpectedPostRequest
+		http.Error(w, ErrExpectedPostRequest.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Parse the request.
+	if outcome = s.parseForm(w, r); outcome != nil {
 		return
 	}
 	ownerIDType := r.FormValue("owner_id_type")
 	ownerID := r.FormValue("owner_id")
 	secretName := r.FormValue("secret_name")
 	reqID := r.FormValue("request_id")
-	log.Printf("Parsing of POST data succeeded: ownerID=[%v], ownerIDType=[%v], secretName=[%v], reqID=[%v]\n",
-		ownerIDType, ownerID, secretName, reqID)
+	locale := r.FormValue("locale")
+	s.logger.Debug("parsed POST data", "request_id", reqID, "recipient", RecipientID{ownerIDType, ownerID},
+		"locale", locale)
 
+	// Verify the parsed parameters.
 	if reqID == "" {
+		outcome = ErrMissingRequestID
 		http.Error(w, ErrMissingRequestID.Error(), http.StatusBadRequest)
 		return
 	}
+	if !isValidRequestID(reqID) {
+		outcome = ErrInvalidRequestID
+		http.Error(w, ErrInvalidRequestID.Error(), http.StatusBadRequest)
+		return
+	}
 	shareID, err := shareid.GetShareID(ownerIDType, ownerID, secretName)
 	if err != nil {
+		outcome = err
 		http.Error(w, errToPublicMessage(err), http.StatusBadRequest)
 		return
 	}
-	if _, err := s.shareStore.Retrieve(shareID); err != nil {
+	audit.setShareID(shareID)
+	if outcome = s.checkChallenge(w, r, RecipientID{ownerIDType, ownerID}); outcome != nil {
+		s.logger.Info("token request without valid challenge solution", "request_id", reqID, "operation", tokenNames[op])
+		return
+	}
+	if outcome = checkRateLimit(w, r, s.rateLimiter, RecipientID{ownerIDType, ownerID}); outcome != nil {
+		s.logger.Info("rate limited token request", "request_id", reqID, "operation", tokenNames[op])
+		return
+	}
+	_, err = s.retrieveShare(shareID)
+	// A deleted share is treated like a missing one, so that the responses
+	// do not reveal deletions; a new share replaces its tombstone.
+	var purgeAt time.Time
+	var deleted bool
+	if op == OpUndeleteShare {
+		purgeAt, deleted = s.purgeTime(shareID)
+	}
+	switch {
+	case op == OpStoreShare && err == nil:
+		outcome = ErrShareAlreadyExists
+		http.Error(w, "Req. "+reqID+": share already exists.", http.StatusForbidden)
+		return
+	case op == OpUndeleteShare && (!deleted || !purgeAt.After(time.Now())),
+		op != OpStoreShare && op != OpUndeleteShare && err != nil:
+		outcome = ErrShareNotFound
 		http.Error(w, "Req. "+reqID+": share not found.", http.StatusNotFound)
 		return
 	}
-	token, err := s.tokenStore.GetNewToken(shareID, OpDeleteShare)
+	if op == OpStoreShare {
+		// No storage token is sent if the share could not be stored anyway.
+		if outcome = s.checkCapacity(shareID, RecipientID{ownerIDType, ownerID}); outcome != nil {
+			status := http.StatusInternalServerError
+			if outcome == ErrQuotaExceeded {
+				status = http.StatusForbidden
+			} else if outcome == ErrStoreFull {
+				status = http.StatusInsufficientStorage
+			}
+			http.Error(w, "Req. "+reqID+": "+errToPublicMessage(outcome), status)
+			return
+		}
+	}
+
+	// Generate a new token, and send it via the secondary channel.
+	tokenName := tokenNames[op]
+	token, err := s.tokenStore.GetNewToken(shareID, op)
 	if err != nil {
-		log.Printf("--- req. %s: generation of deletion token for share of [%s] failed: %v\n", reqID, secretName, err)
-		http.Error(w, "Req. "+reqID+": could not generate deletion token, try later again.", http.StatusInternalServerError)
+		outcome = err
+		s.logger.Error("generation of token failed", "request_id", reqID, "operation", tokenName,
+			"share_id", shareID, "error", err)
+		http.Error(w, "Req. "+reqID+": could not generate "+tokenName+" token, try later again.",
+			http.StatusInternalServerError)
 		return
 	}
-	if err := s.secondaryChannel.Send(RecipientID{ownerIDType, ownerID}, TokenMsgData{reqID, token}); err != nil {
-		http.Error(w, "Req. "+reqID+": error occurred while sending deletion token: "+err.Error(),
-			http.StatusInternalServerError)
+	if err := s.sendToken(RecipientID{ownerIDType, ownerID}, TokenMsgData{ReqID: reqID, Token: token, Op: op, Locale: locale}); err != nil {
+		// The token never reached the owner, so nobody should be able to use it.
+		if rErr := s.tokenStore.RevokeToken(token); rErr != nil {
+			s.logger.Error("revocation of undelivered token failed", "request_id", reqID, "operation", tokenName,
+				"error", rErr)
+		}
+		outcome = err
+		status := http.StatusInternalServerError
+		if err == ErrUnsupportedOwnerIDType {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, "Req. "+reqID+": could not send "+tokenName+" token: "+err.Error(), status)
+		return
+	}
+
+	// Log the operation, and prepare the response.
+	s.logger.Info("sent token", "request_id", reqID, "operation", tokenName, "share_id", shareID,
+		"recipient", RecipientID{ownerIDType, ownerID})
+	fmt.Fprintf(w, "Req. %s: %s token for share of [%s] sent to [%s:%s]",
+		reqID, tokenName, secretName, ownerIDType, ownerID)
+}
+
+// logRequest logs the arrival of request 'r' for 'handler'.  Only the method
+// and the path are logged, as the other parts of the request may contain
+// secrets.
+func (s *Server) logRequest(r *http.Request, handler string) {
+	s.logger.Debug("handling request", "handler", handler, "method", r.Method, "path", r.URL.Path)
+}
+
+// auditRecorder records the outcome of a request in an AuditEvent,
+// by intercepting the status of the response.
+type auditRecorder struct {
+	http.ResponseWriter
+	auditors     []Auditor
+	logger       *slog.Logger
+	r            *http.Request
+	event        AuditEvent
+	wroteHeader  bool
+	committed    bool // the event has been passed to the CommittingAuditors
+	commitFailed bool
+}
+
+// startAudit starts recording request 'r' for the audited operation 'op'.
+// It returns the ResponseWriter to be used for the response, and a recorder
+// whose finish method must be called when the response is complete.
+// If the server has no auditors, it returns 'w' and a nil recorder, whose
+// methods do nothing.
+func (s *Server) startAudit(w http.ResponseWriter, r *http.Request, op string) (http.ResponseWriter, *auditRecorder) {
+	if len(s.auditors) == 0 {
+		return w, nil
+	}
+	a := &auditRecorder{
+		ResponseWriter: w,
+		auditors:       s.auditors,
+		logger:         s.logger,
+		r:              r,
+		event:          AuditEvent{Operation: op, ClientIP: ClientIP(r), Status: http.StatusOK},
+	}
+	return a, a
+}
+
+func (a *auditRecorder) WriteHeader(status int) {
+	if !a.wroteHeader {
+		a.event.Status = status
+		a.wroteHeader = true
+		if status == http.StatusOK && !a.commit() {
+			return
+		}
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *auditRecorder) Write(b []byte) (int, error) {
+	if !a.wroteHeader {
+		a.WriteHeader(http.StatusOK)
+	}
+	if a.commitFailed {
+		return 0, ErrAuditFailed
+	}
+	return a.ResponseWriter.Write(b)
+}
+
+// commit passes the event of a successful request to the CommittingAuditors,
+// before the response is sent.  If any of them fails, it responds with
+// ErrAuditFailed instead of the response of the request, and returns false.
+func (a *auditRecorder) commit() bool {
+	a.committed = true
+	a.completeEvent()
+	for _, auditor := range a.auditors {
+		committer, ok := auditor.(CommittingAuditor)
+		if !ok {
+			continue
+		}
+		if err := committer.Commit(a.event); err != nil {
+			a.logger.Error("recording of request failed", "operation", a.event.Operation,
+				"auditor", fmt.Sprintf("%T", auditor), "error", err)
+			a.commitFailed = true
+			a.event.Status = http.StatusInternalServerError
+			http.Error(a.ResponseWriter, ErrAuditFailed.Error(), http.StatusInternalServerError)
+			return false
+		}
+	}
+	return true
+}
+
+// completeEvent sets the time and the request id of the recorded event.
+func (a *auditRecorder) completeEvent() {
+	a.event.Time = time.Now()
+	a.event.ReqID = a.r.Form.Get("request_id")
+}
+
+// setShareID records the id of the share that the request refers to.
+func (a *auditRecorder) setShareID(shareID string) {
+	if a != nil {
+		a.event.ShareID = shareID
+	}
+}
+
+// finish passes the recorded event to the auditors, except for the
+// CommittingAuditors that have been passed it already.
+func (a *auditRecorder) finish() {
+	if a == nil {
+		return
+	}
+	a.completeEvent()
+	for _, auditor := range a.auditors {
+		if _, ok := auditor.(CommittingAuditor); ok && a.committed {
+			continue
+		}
+		if err := auditor.Audit(a.event); err != nil {
+			a.logger.Error("recording of request failed", "operation", a.event.Operation,
+				"auditor", fmt.Sprintf("%T", auditor), "error", err)
+		}
+	}
+}
+
+// serverMetrics are the metrics recorded by a Server.  All methods of a nil
+// *serverMetrics do nothing.
+type serverMetrics struct {
+	registry          *metrics.Registry
+	tokensIssued      *metrics.CounterVec
+	tokenVerifies     *metrics.CounterVec
+	channelDurations  *metrics.HistogramVec
+	channelFailures   *metrics.CounterVec
+	shareStoreLatency *metrics.HistogramVec
+}
+
+func newServerMetrics(registry *metrics.Registry) *serverMetrics {
+	return &serverMetrics{
+		registry: registry,
+		tokensIssued: registry.Counter("svalbard_tokens_issued_total",
+			"Number of token requests, by operation and outcome.", "operation", "outcome"),
+		tokenVerifies: registry.Counter("svalbard_token_verifications_total",
+			"Number of token verifications, by operation and outcome.", "operation", "outcome"),
+		channelDurations: registry.Histogram("svalbard_channel_send_duration_seconds",
+			"Latencies of sending tokens via the secondary channel.", metrics.DefaultBuckets, "owner_id_type"),
+		channelFailures: registry.Counter("svalbard_channel_send_failures_total",
+			"Number of failures of sending tokens via the secondary channel.", "owner_id_type"),
+		shareStoreLatency: registry.Histogram("svalbard_share_store_duration_seconds",
+			"Latencies of the operations of the share store.", metrics.DefaultBuckets, "operation"),
+	}
+}
+
+// outcomeLabel returns the label of the outcome 'err' of an operation:
+// "ok" for nil, or the public message of the error, of which there are
+// only a few.
+func outcomeLabel(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	return errToPublicMessage(err)
+}
+
+// tokenIssued records the outcome of a request for a token for 'op'.
+func (m *serverMetrics) tokenIssued(op Operation, err error) {
+	if m != nil {
+		m.tokensIssued.Inc(tokenNames[op], outcomeLabel(err))
+	}
+}
+
+// tokenVerified records the outcome of a verification of a token for 'op'.
+func (m *serverMetrics) tokenVerified(op Operation, err error) {
+	if m != nil {
+		m.tokenVerifies.Inc(tokenNames[op], outcomeLabel(err))
+	}
+}
+
+// channelSent records the outcome of sending a token, started at 'start',
+// to an owner id of type 'idType' via the secondary channel.
+func (m *serverMetrics) channelSent(idType string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.channelDurations.ObserveDuration(start, idType)
+	if err != nil {
+		m.channelFailures.Inc(idType)
+	}
+}
+
+// shareStoreOp records the latency of the operation 'op' of the share store,
+// started at 'start'.
+func (m *serverMetrics) shareStoreOp(op string, start time.Time) {
+	if m != nil {
+		m.shareStoreLatency.ObserveDuration(start, op)
+	}
+}
+
+// ownerIDTypeLabel returns the label of the owner id type 'idType' in
+// metrics.  The type is normalized (by the secondary channel, if it is
+// a RecipientNormalizer), so that aliases and variants in case or whitespace
+// share the label of the type they resolve to.  To keep the number of labels
+// bounded, types that are not supported by the secondary channel are labeled
+// "unsupported", and all types are labeled "unknown" if the channel cannot
+// list the supported ones.
+func (s *Server) ownerIDTypeLabel(idType string) string {
+	if s.metrics == nil {
+		return ""
+	}
+	lister, ok := s.secondaryChannel.(OwnerIDTypeLister)
+	if !ok {
+		return "unknown"
+	}
+	if normalizer, ok := s.secondaryChannel.(RecipientNormalizer); ok {
+		idType = normalizer.Recipient(RecipientID{IDType: idType}).IDType
+	} else {
+		idType = strings.ToUpper(strings.TrimSpace(idType))
+	}
+	for _, t := range lister.SupportedOwnerIDTypes() {
+		if t == idType {
+			return idType
+		}
+	}
+	return "unsupported"
+}
+
+// verifyToken checks whether 'token' is currently valid for the operation
+// 'op' on the share identified by 'shareID', and records the outcome.
+func (s *Server) verifyToken(token, shareID string, op Operation) error {
+	err := s.tokenStore.IsTokenValidNow(token, shareID, op)
+	s.metrics.tokenVerified(op, err)
+	return err
+}
+
+// storeShare, retrieveShare, deleteShare, renewShare, undeleteShare and
+// purgeTime call the share store, and record the latencies of the calls.
+// Shares are stored with an expiry, and indexed by their owners, whenever
+// the share store supports it.
+
+func (s *Server) storeShare(shareID, shareValue string, owner RecipientID, period time.Duration) error {
+	defer s.metrics.shareStoreOp("store", time.Now())
+	ownerKey, err := s.ownerKey(owner)
+	if err != nil {
+		return err
+	}
+	if expiring, ok := s.shareStore.(ExpiringShareStore); ok {
+		return expiring.StoreWithExpiry(shareID, shareValue, owner, ownerKey, period)
+	}
+	if indexed, ok := s.shareStore.(OwnerIndexedShareStore); ok && ownerKey != "" {
+		return indexed.StoreForOwner(shareID, shareValue, ownerKey)
+	}
+	return s.shareStore.Store(shareID, shareValue)
+}
+
+// ownerKey returns the key under which the shares of 'owner' are indexed,
+// or "" if the server does not index shares (see WithOwnerIndexKey).  The
+// owner id is normalized first (by the secondary channel, if it is
+// a RecipientNormalizer), so that all variants of it share the index.
+func (s *Server) ownerKey(owner RecipientID) (string, error) {
+	if s.ownerIndexKey == nil {
+		return "", nil
+	}
+	if normalizer, ok := s.secondaryChannel.(RecipientNormalizer); ok {
+		owner = normalizer.Recipient(owner)
 	}
-	log.Printf("--- req. %s: generated a deletion token [%s] for share of [%s] sent to [%s:%s]\n", reqID, token, secretName, ownerIDType, ownerID)
-	fmt.Fprintf(w, "Req. %s: deletion token for share of [%s] sent to [%s:%s]", reqID, secretName, ownerIDType, ownerID)
+	return shareid.GetOwnerKey(s.ownerIndexKey, owner.IDType, owner.ID)
 }
 
-// DeleteShareHandler handles requests that want to delete a share.
+// checkCapacity returns an error if the share store could not store a share
+// with 'shareID' for 'owner', as far as it can tell in advance (see
+// CapacityChecker).
+func (s *Server) checkCapacity(shareID string, owner RecipientID) error {
+	checker, ok := s.shareStore.(CapacityChecker)
+	if !ok {
+		return nil
+	}
+	ownerKey, err := s.ownerKey(owner)
+	if err != nil {
+		return err
+	}
+	return checker.CheckCapacity(shareID, ownerKey)
+}
+
+// parseForm parses the form data of 'r', whose body must not be longer than
+// the maximal size of requests.  If parsing fails, it replies to the request
+// with an error and returns it.
+func (s *Server) parseForm(w http.ResponseWriter, r *http.Request) error {
+	if s.maxRequestSize > 0 && r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxRequestSize)
+	}
+	err := r.ParseForm()
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, ErrRequestTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		s.logger.Warn("request too large", "limit", tooLarge.Limit)
+		return ErrRequestTooLarge
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.logger.Warn("parsing of POST data failed", "error", err)
+	}
+	return err
+}
+
+func (s *Server) retrieveShare(shareID string) (string, error) {
+	defer s.metrics.shareStoreOp("retrieve", time.Now())
+	return s.shareStore.Retrieve(shareID)
+}
+
+// deleteShare returns the time at which the deleted share will be purged,
+// or the zero time if it was deleted for good.
+func (s *Server) deleteShare(shareID string) (time.Time, error) {
+	defer s.metrics.shareStoreOp("delete", time.Now())
+	if s.deletionGrace <= 0 {
+		return time.Time{}, s.shareStore.Delete(shareID)
+	}
+	recoverable, ok := s.shareStore.(RecoverableShareStore)
+	if !ok {
+		return time.Time{}, ErrSoftDeleteNotAvailable
+	}
+	// Stores keep the purge times in seconds.
+	purgeAt := time.Now().Add(s.deletionGrace).Truncate(time.Second)
+	return purgeAt, recoverable.SoftDelete(shareID, purgeAt)
+}
+
+func (s *Server) renewShare(shareID string) (time.Time, error) {
+	defer s.metrics.shareStoreOp("renew", time.Now())
+	expiring, ok := s.shareStore.(ExpiringShareStore)
+	if !ok {
+		return time.Time{}, ErrExpiryNotAvailable
+	}
+	return expiring.Renew(shareID)
+}
+
+func (s *Server) undeleteShare(shareID string) error {
+	defer s.metrics.shareStoreOp("undelete", time.Now())
+	recoverable, ok := s.shareStore.(RecoverableShareStore)
+	if !ok {
+		return ErrSoftDeleteNotAvailable
+	}
+	return recoverable.Undelete(shareID, time.Now())
+}
+
+// purgeTime returns the purge time of the tombstone of the share identified
+// by 'shareID', and false if the share is not deleted (or the share store
+// does not support soft deletion).
+func (s *Server) purgeTime(shareID string) (time.Time, bool) {
+	recoverable, ok := s.shareStore.(RecoverableShareStore)
+	if !ok {
+		return time.Time{}, false
+	}
+	defer s.metrics.shareStoreOp("purge_time", time.Now())
+	purgeAt, err := recoverable.PurgeTime(shareID)
+	if err != nil && err != ErrShareNotFound && err != ErrSoftDeleteNotAvailable {
+		s.logger.Error("lookup of tombstone failed", "share_id", shareID, "error", err)
+	}
+	return purgeAt, err == nil
+}
+
+// checkChallenge returns nil if the challenge guard of the server (if any)
+// does not require a solved challenge for request 'r' for a token for
+// 'recipient', or if 'r' carries a valid solution.  Otherwise it responds
+// with ErrChallengeRequired or ErrInvalidChallengeSolution, and returns
+// that error.
+func (s *Server) checkChallenge(w http.ResponseWriter, r *http.Request, recipient RecipientID) error {
+	if s.challengeGuard == nil || !s.challengeGuard.Required(recipient) {
+		return nil
+	}
+	challenge := r.FormValue("challenge")
+	solution := r.FormValue("challenge_solution")
+	if challenge == "" || solution == "" {
+		http.Error(w, ErrChallengeRequired.Error(), http.StatusPreconditionRequired)
+		return ErrChallengeRequired
+	}
+	if err := s.challengeGuard.Verify(challenge, solution); err != nil {
+		s.logger.Debug("verification of challenge solution failed", "error", err)
+		http.Error(w, ErrInvalidChallengeSolution.Error(), http.StatusForbidden)
+		return ErrInvalidChallengeSolution
+	}
+	return nil
+}
+
+// checkRateLimit returns nil if 'rateLimiter' (if any) allows a request 'r'
+// concerning 'recipient', e.g. for sending a token.  Otherwise it responds
+// with ErrRateLimited and a Retry-After header, and returns that error.
+func checkRateLimit(w http.ResponseWriter, r *http.Request, rateLimiter RateLimiter, recipient RecipientID) error {
+	if rateLimiter == nil {
+		return nil
+	}
+	ok, retryAfter := rateLimiter.Allow(recipient, ClientIP(r))
+	if ok {
+		return nil
+	}
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	http.Error(w, ErrRateLimited.Error(), http.StatusTooManyRequests)
+	return ErrRateLimited
+}
+
+// ClientIP returns the IP address of the client that sent request 'r',
+// or nil if it is not known.
+func ClientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// sendToken sends 'data' to 'recipient' via the secondary channel.
+// It returns only canonical errors: any error of the channel that is not
+// known to be free of sensitive information is replaced by
+// ErrTokenDeliveryFailed.
+func (s *Server) sendToken(recipient RecipientID, data TokenMsgData) error {
+	start := time.Now()
+	err := s.secondaryChannel.Send(recipient, data)
+	s.metrics.channelSent(s.ownerIDTypeLabel(recipient.IDType), start, err)
+	if err == nil {
+		return nil
+	}
+	if _, ok := knownErrors[err]; ok {
+		return err
+	}
+	s.logger.Error("sending of token failed", "request_id", data.ReqID, "recipient", recipient, "error", err)
+	return ErrTokenDeliveryFailed
+}
+
+// SendRenewalReminder reminds 'owner' that the share identified by 'shareID'
+// expires at 'expires', by sending a renewal token via the secondary channel.
+// Should the token expire before the owner uses it, the owner can request
+// a new one with GetRenewalTokenHandler.  It is meant to be called by an
+// ExpiringShareStore, and returns only canonical errors.
+func (s *Server) SendRenewalReminder(shareID string, owner RecipientID, expires time.Time) error {
+	reqID, err := s.sendOperationToken(shareID, owner, OpRenewShare, "reminder-")
+	if err != nil {
+		return err
+	}
+	s.logger.Info("sent renewal reminder", "request_id", reqID, "share_id", shareID, "recipient", owner, "expires", expires)
+	return nil
+}
+
+// sendOperationToken sends 'owner' a token for the operation 'op' on the
+// share identified by 'shareID', that nobody requested, e.g. a renewal token
+// as a reminder.  The message is identified by a random id with 'prefix' in
+// place of the id of a request, which it returns even if the sending fails.
+// It returns only canonical errors.
+func (s *Server) sendOperationToken(shareID string, owner RecipientID, op Operation, prefix string) (string, error) {
+	reqID, err := newServerRequestID(prefix)
+	if err != nil {
+		s.logger.Error("generation of request id failed", "operation", tokenNames[op], "share_id", shareID, "error", err)
+		return "", ErrTokenDeliveryFailed
+	}
+	token, err := s.tokenStore.GetNewToken(shareID, op)
+	s.metrics.tokenIssued(op, err)
+	if err != nil {
+		s.logger.Error("generation of token failed", "operation", tokenNames[op], "share_id", shareID, "error", err)
+		return reqID, err
+	}
+	if err := s.sendToken(owner, TokenMsgData{ReqID: reqID, Token: token, Op: op}); err != nil {
+		if rErr := s.tokenStore.RevokeToken(token); rErr != nil {
+			s.logger.Error("revocation of undelivered token failed", "request_id", reqID,
+				"operation", tokenNames[op], "error", rErr)
+		}
+		return reqID, err
+	}
+	return reqID, nil
+}
+
+// ChallengeHandler handles requests for a new proof-of-work challenge,
+// whose solution must be included in token requests whenever the server
+// requires it (which it indicates by responding with ErrChallengeRequired).
+// Request r must be a GET request, the response is a JSON object of the form
+// {"challenge": "...", "expires": <Unix time>}.
+func (s *Server) ChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	s.logRequest(r, "challenge")
+	if r.Method != "GET" {
+		http.Error(w, ErrExpectedGetRequest.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.challengeGuard == nil {
+		http.Error(w, ErrChallengesNotAvailable.Error(), http.StatusNotImplemented)
+		return
+	}
+	challenge, expires, err := s.challengeGuard.NewChallenge()
+	if err != nil {
+		s.logger.Error("generation of challenge failed", "error", err)
+		http.Error(w, errToPublicMessage(err), http.StatusInternalServerError)
+		return
+	}
+	resp, err := json.Marshal(struct {
+		Challenge string `json:"challenge"`
+		Expires   int64  `json:"expires"`
+	}{challenge, expires.Unix()})
+	if err != nil {
+		http.Error(w, errToPublicMessage(err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(resp)
+}
+
+// SupportedOwnerIDTypesHandler handles requests for the list of owner id types
+// supported by the secondary channel of the server, so that the clients can
+// offer valid choices to the users.
+// Request r must be a GET request, the response is a JSON object
+// of the form {"owner_id_types": ["EMAIL", "SMS", ...]}.
+func (s *Server) SupportedOwnerIDTypesHandler(w http.ResponseWriter, r *http.Request) {
+	s.logRequest(r, "owner_id_types")
+	if r.Method != "GET" {
+		http.Error(w, ErrExpectedGetRequest.Error(), http.StatusBadRequest)
+		return
+	}
+	lister, ok := s.secondaryChannel.(OwnerIDTypeLister)
+	if !ok {
+		http.Error(w, ErrOwnerIDTypesNotAvailable.Error(), http.StatusNotImplemented)
+		return
+	}
+	idTypes := lister.SupportedOwnerIDTypes()
+	if idTypes == nil {
+		idTypes = []string{}
+	}
+	resp, err := json.Marshal(struct {
+		OwnerIDTypes []string `json:"owner_id_types"`
+	}{idTypes})
+	if err != nil {
+		http.Error(w, errToPublicMessage(err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+// DeliveryStatusHandler handles requests for the delivery status of a token
+// requested earlier, if the secondary channel of the server delivers the tokens
+// asynchronously.
 // Request r must be a POST request with the following form data:
-//  - token: the deletion token that the client obtained via a secondary channel
+//  - request_id: the id of the request for the token
 //  - owner_id_type: type of id, e.g. "SMS", "email", ...
 //  - owner_id:  actual id, e.g. a phone number, e-mail address
-//  - secret_name: the name of the secret that the desired share belongs to
-func (s *Server) DeleteShareHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("-------------- DELETE_SHARE")
-	log.Println(r)
+// The response is a JSON object of the form
+// {"request_id": "...", "status": "pending"|"delivered"|"failed"}.
+// The requests are limited by the rate limiter set with
+// WithDeliveryStatusRateLimiter, if any.
+func (s *Server) DeliveryStatusHandler(w http.ResponseWriter, r *http.Request) {
+	s.logRequest(r, "delivery_status")
 	if r.Method != "POST" {
 		http.Error(w, ErrExpectedPostRequest.Error(), http.StatusBadRequest)
 		return
 	}
-
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("Parsing of POST data failed: %v\n", err)
+	if err := s.parseForm(w, r); err != nil {
 		return
 	}
-	token := r.FormValue("token")
-	if token == "" {
-		http.Error(w, ErrMissingToken.Error(), http.StatusBadRequest)
+	ownerIDType := r.FormValue("owner_id_type")
+	ownerID := r.FormValue("owner_id")
+	reqID := r.FormValue("request_id")
+	switch {
+	case reqID == "":
+		http.Error(w, ErrMissingRequestID.Error(), http.StatusBadRequest)
+		return
+	case ownerIDType == "":
+		http.Error(w, shareid.ErrMissingOwnerType.Error(), http.StatusBadRequest)
+		return
+	case ownerID == "":
+		http.Error(w, shareid.ErrMissingOwnerID.Error(), http.StatusBadRequest)
+		return
+	}
+	reporter, ok := s.secondaryChannel.(DeliveryStatusReporter)
+	if !ok {
+		http.Error(w, ErrDeliveryStatusNotAvailable.Error(), http.StatusNotImplemented)
+		return
+	}
+	recipient := RecipientID{ownerIDType, ownerID}
+	if err := checkRateLimit(w, r, s.statusLimiter, recipient); err != nil {
+		s.logger.Info("rate limited delivery status request", "request_id", reqID)
+		return
+	}
+	status, err := reporter.DeliveryStatus(recipient, reqID)
+	if err == ErrDeliveryStatusNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		s.logger.Error("could not get delivery status", "request_id", reqID, "error", err)
+		http.Error(w, errToPublicMessage(err), http.StatusInternalServerError)
+		return
+	}
+	resp, err := json.Marshal(struct {
+		RequestID string `json:"request_id"`
+		Status    string `json:"status"`
+	}{reqID, status})
+	if err != nil {
+		http.Error(w, errToPublicMessage(err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
 
-	ownerIDType := r.FormValue("owner_id_type")
-	ownerID := r.FormValue("owner_id")
-	secretName := r.FormValue("secret_name")
-	log.Printf("Parsing of POST data succeeded: ownerID=[%v], ownerIDType=[%v], secretName=[%v], token=[%v]\n",
-		ownerIDType, ownerID, secretName, token)
+// HealthzHandler handles requests that check whether the server is alive.
+// It responds with HTTP status 200 and "ok" as long as the server is able
+// to handle requests at all.
+func (s *Server) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprint(w, "ok")
+}
 
-	shareID, err := shareid.GetShareID(ownerIDType, ownerID, secretName)
+// ReadyzHandler handles requests that check whether the server is ready to
+// serve requests, by checking all its dependencies that implement
+// HealthChecker.  The response is a JSON object of the form
+// {"status": "ok"|"unavailable", "checks": {"share_store": "ok"|"failed", ...}},
+// with HTTP status 200 if all checks pass, and 503 otherwise.  The errors of
+// failed checks are only logged, as they may contain internal details.
+func (s *Server) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	status := "ok"
+	checks := make(map[string]string)
+	for _, hc := range s.healthCheckers {
+		if err := hc.checker.CheckHealth(); err != nil {
+			s.logger.Warn("health check failed", "dependency", hc.name, "error", err)
+			checks[hc.name] = "failed"
+			status = "unavailable"
+			continue
+		}
+		checks[hc.name] = "ok"
+	}
+	resp, err := json.Marshal(struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}{status, checks})
 	if err != nil {
-		http.Error(w, errToPublicMessage(err), http.StatusBadRequest)
+		http.Error(w, errToPublicMessage(err), http.StatusInternalServerError)
 		return
 	}
-	if err := s.tokenStore.IsTokenValidNow(token, shareID, OpDeleteShare); err != nil {
-		http.Error(w, "could not delete the share: "+errToPublicMessage(err), http.StatusForbidden)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(resp)
+}
+
+// VersionHandler handles requests for the version of the server.
+// The response is a JSON object of the form
+// {"version": "...", "go_version": "...", "vcs_revision": "...", "vcs_time": "...", "vcs_modified": true|false},
+// where the fields about the version control system are present only if
+// the binary was built with this information.
+func (s *Server) VersionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, ErrExpectedGetRequest.Error(), http.StatusBadRequest)
 		return
 	}
-	if err := s.shareStore.Delete(shareID); err != nil {
-		http.Error(w, "could not delete the share: "+errToPublicMessage(err), http.StatusInternalServerError)
+	info := struct {
+		Version     string `json:"version"`
+		GoVersion   string `json:"go_version"`
+		VCSRevision string `json:"vcs_revision,omitempty"`
+		VCSTime     string `json:"vcs_time,omitempty"`
+		VCSModified *bool  `json:"vcs_modified,omitempty"`
+	}{Version: Version, GoVersion: runtime.Version()}
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range buildInfo.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info.VCSRevision = setting.Value
+			case "vcs.time":
+				info.VCSTime = setting.Value
+			case "vcs.modified":
+				modified := setting.Value == "true"
+				info.VCSModified = &modified
+			}
+		}
+	}
+	resp, err := json.Marshal(info)
+	if err != nil {
+		http.Error(w, errToPublicMessage(err), http.StatusInternalServerError)
 		return
 	}
-	log.Printf("--- deleted a share of secret [%s] of owner [%s:%s]\n", secretName, ownerIDType, ownerID)
-	fmt.Fprintf(w, "Deleted a share of secret [%s] of owner [%s:%s]", secretName, ownerIDType, ownerID)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
 }
 
 // Known errors that are known not to contain any sensitive information.
@@ -493,14 +1801,31 @@ var knownErrors = map[error]bool{
 	ErrMissingToken:                     true,
 	ErrMissingShareValue:                true,
 	ErrMissingRequestID:                 true,
+	ErrInvalidRequestID:                 true,
 	ErrShareAlreadyExists:               true,
 	ErrShareNotFound:                    true,
 	ErrTokenNotFound:                    true,
 	ErrTokenExpired:                     true,
 	ErrTokenNotValid:                    true,
+	ErrTokenDeliveryFailed:              true,
 	ErrUnsupportedOwnerIDType:           true,
+	ErrOwnerIDTypesNotAvailable:         true,
+	ErrDeliveryStatusNotAvailable:       true,
+	ErrDeliveryStatusNotFound:           true,
+	ErrRateLimited:                      true,
+	ErrChallengeRequired:                true,
+	ErrInvalidChallengeSolution:         true,
+	ErrChallengesNotAvailable:           true,
 	ErrInvalidParametersForMsgWithToken: true,
 	ErrInvalidMsgWithToken:              true,
+	ErrInvalidExpiry:                    true,
+	ErrExpiryNotAvailable:               true,
+	ErrSoftDeleteNotAvailable:           true,
+	ErrRequestTooLarge:                  true,
+	ErrShareTooLarge:                    true,
+	ErrQuotaExceeded:                    true,
+	ErrStoreFull:                        true,
+	ErrAuditFailed:                      true,
 }
 
 // errToPublicMessage returns a message that describes the given error but is guaranteed
@@ -18,19 +18,31 @@ package svalbardsrv_test
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
-	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/google/svalbard/server/go/channelrouter"
 	"github.com/google/svalbard/server/go/filechannel"
 	"github.com/google/svalbard/server/go/inmemorysharestore"
+	"github.com/google/svalbard/server/go/logging"
+	"github.com/google/svalbard/server/go/metrics"
+	"github.com/google/svalbard/server/go/pow"
+	"github.com/google/svalbard/server/go/ratelimit"
+	"github.com/google/svalbard/server/go/shareexpiry"
 	"github.com/google/svalbard/server/go/shareid"
 	"github.com/google/svalbard/server/go/svalbardsrv"
 	"github.com/google/svalbard/server/go/testingtools"
@@ -97,6 +109,30 @@ func newDeleteShareRequest(token string, user userID, secretName string) *http.R
 	return req
 }
 
+func newRenewShareRequest(token string, user userID, secretName string) *http.Request {
+	reqData := make(url.Values)
+	reqData.Set("token", token)
+	reqData.Set("owner_id_type", user.IDType)
+	reqData.Set("owner_id", user.ID)
+	reqData.Set("secret_name", secretName)
+	body := bufio.NewReader(strings.NewReader(reqData.Encode()))
+	req := httptest.NewRequest("POST", testTarget+"/renew_share", body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func newUndeleteShareRequest(token string, user userID, secretName string) *http.Request {
+	reqData := make(url.Values)
+	reqData.Set("token", token)
+	reqData.Set("owner_id_type", user.IDType)
+	reqData.Set("owner_id", user.ID)
+	reqData.Set("secret_name", secretName)
+	body := bufio.NewReader(strings.NewReader(reqData.Encode()))
+	req := httptest.NewRequest("POST", testTarget+"/undelete_share", body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
 func newGetTokenRequest(reqID string, user userID, secretName, handlerURL string) *http.Request {
 	data := make(url.Values)
 	data.Set("request_id", reqID)
@@ -143,19 +179,34 @@ func getTestServer(rootDir string, t *testing.T) *svalbardsrv.Server {
 }
 
 func fetchToken(rootDir, ownerID, reqID string, t *testing.T) string {
-	filename := filepath.Join(rootDir, ownerID+"_secondary_channel.txt")
-	content, err := ioutil.ReadFile(filename)
+	msgs, err := filechannel.NewChannel(rootDir).ReadMessages(ownerID, time.Time{})
 	if err != nil {
-		t.Fatal("Could not read file " + filename + ": " + err.Error())
+		t.Fatalf("Could not read messages of [%v]: %v", ownerID, err)
 	}
-	s := string(content)
-	prefix := "SVBD:" + reqID + ":"
-	i := strings.LastIndex(s, prefix)
-	if i == -1 {
-		t.Errorf("No token found for request with ID [%v] of owner [%v].", reqID, ownerID)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if data, err := svalbardsrv.ParseMsgWithToken(msgs[i].Text); err == nil && data.ReqID == reqID {
+			return data.Token
+		}
 	}
-	ts := s[i+len(prefix):] // ts starts at the first char of the token
-	return ts[:strings.Index(ts, "\n")]
+	t.Errorf("No token found for request with ID [%v] of owner [%v].", reqID, ownerID)
+	return ""
+}
+
+// fetchServerToken returns the request id and the token of the latest
+// message to 'ownerID' with a request id starting with 'prefix', as sent
+// by the server on its own.
+func fetchServerToken(rootDir, ownerID, prefix string, t *testing.T) (string, string) {
+	msgs, err := filechannel.NewChannel(rootDir).ReadMessages(ownerID, time.Time{})
+	if err != nil {
+		t.Fatalf("Could not read messages of [%v]: %v", ownerID, err)
+	}
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if data, err := svalbardsrv.ParseMsgWithToken(msgs[i].Text); err == nil && strings.HasPrefix(data.ReqID, prefix) {
+			return data.ReqID, data.Token
+		}
+	}
+	t.Errorf("No token found for request with ID [%v...] of owner [%v].", prefix, ownerID)
+	return "", ""
 }
 
 func TestGetMsgWithToken(t *testing.T) {
@@ -164,18 +215,18 @@ func TestGetMsgWithToken(t *testing.T) {
 		msg  string
 		err  error
 	}{
-		{svalbardsrv.TokenMsgData{"reqID1", "someToken"}, "SVBD:reqID1:someToken", nil},
-		{svalbardsrv.TokenMsgData{"673hgg", "ghGGHAHye"}, "SVBD:673hgg:ghGGHAHye", nil},
-		{svalbardsrv.TokenMsgData{"a", "b"}, "SVBD:a:b", nil},
-		{svalbardsrv.TokenMsgData{"7e76g3hgeb3ke", "HEUG83gg37g63gdegw"}, "SVBD:7e76g3hgeb3ke:HEUG83gg37g63gdegw", nil},
-		{svalbardsrv.TokenMsgData{"67:g", "ghHAHye"}, "", svalbardsrv.ErrInvalidParametersForMsgWithToken},
-		{svalbardsrv.TokenMsgData{"67ag", "ab:e"}, "", svalbardsrv.ErrInvalidParametersForMsgWithToken},
-		{svalbardsrv.TokenMsgData{"6::ag", "ab:e"}, "", svalbardsrv.ErrInvalidParametersForMsgWithToken},
-		{svalbardsrv.TokenMsgData{":", ":"}, "", svalbardsrv.ErrInvalidParametersForMsgWithToken},
-		{svalbardsrv.TokenMsgData{":", ""}, "", svalbardsrv.ErrInvalidParametersForMsgWithToken},
-		{svalbardsrv.TokenMsgData{"A", ""}, "", svalbardsrv.ErrInvalidParametersForMsgWithToken},
-		{svalbardsrv.TokenMsgData{"", "B"}, "", svalbardsrv.ErrInvalidParametersForMsgWithToken},
-		{svalbardsrv.TokenMsgData{"", ""}, "", svalbardsrv.ErrInvalidParametersForMsgWithToken},
+		{svalbardsrv.TokenMsgData{ReqID: "reqID1", Token: "someToken"}, "SVBD:reqID1:someToken", nil},
+		{svalbardsrv.TokenMsgData{ReqID: "673hgg", Token: "ghGGHAHye"}, "SVBD:673hgg:ghGGHAHye", nil},
+		{svalbardsrv.TokenMsgData{ReqID: "a", Token: "b"}, "SVBD:a:b", nil},
+		{svalbardsrv.TokenMsgData{ReqID: "7e76g3hgeb3ke", Token: "HEUG83gg37g63gdegw"}, "SVBD:7e76g3hgeb3ke:HEUG83gg37g63gdegw", nil},
+		{svalbardsrv.TokenMsgData{ReqID: "67:g", Token: "ghHAHye"}, "", svalbardsrv.ErrInvalidParametersForMsgWithToken},
+		{svalbardsrv.TokenMsgData{ReqID: "67ag", Token: "ab:e"}, "", svalbardsrv.ErrInvalidParametersForMsgWithToken},
+		{svalbardsrv.TokenMsgData{ReqID: "6::ag", Token: "ab:e"}, "", svalbardsrv.ErrInvalidParametersForMsgWithToken},
+		{svalbardsrv.TokenMsgData{ReqID: ":", Token: ":"}, "", svalbardsrv.ErrInvalidParametersForMsgWithToken},
+		{svalbardsrv.TokenMsgData{ReqID: ":", Token: ""}, "", svalbardsrv.ErrInvalidParametersForMsgWithToken},
+		{svalbardsrv.TokenMsgData{ReqID: "A", Token: ""}, "", svalbardsrv.ErrInvalidParametersForMsgWithToken},
+		{svalbardsrv.TokenMsgData{ReqID: "", Token: "B"}, "", svalbardsrv.ErrInvalidParametersForMsgWithToken},
+		{svalbardsrv.TokenMsgData{}, "", svalbardsrv.ErrInvalidParametersForMsgWithToken},
 	}
 	for _, tt := range tests {
 		msg, err := svalbardsrv.GetMsgWithToken(tt.data)
@@ -195,20 +246,26 @@ func TestParseMsgWithToken(t *testing.T) {
 		data svalbardsrv.TokenMsgData
 		err  error
 	}{
-		{"SVBD:reqID2:someOtherToken", svalbardsrv.TokenMsgData{"reqID2", "someOtherToken"}, nil},
-		{"SVBD:63gh:hEGHE83", svalbardsrv.TokenMsgData{"63gh", "hEGHE83"}, nil},
-		{"SVBD:8g3ggb3:hwebt3BGb83", svalbardsrv.TokenMsgData{"8g3ggb3", "hwebt3BGb83"}, nil},
-		{"SVBD:7:A", svalbardsrv.TokenMsgData{"7", "A"}, nil},
-		{"SV:", svalbardsrv.TokenMsgData{"", ""}, svalbardsrv.ErrInvalidMsgWithToken},
-		{"::", svalbardsrv.TokenMsgData{"", ""}, svalbardsrv.ErrInvalidMsgWithToken},
-		{"", svalbardsrv.TokenMsgData{"", ""}, svalbardsrv.ErrInvalidMsgWithToken},
-		{"SVBD::", svalbardsrv.TokenMsgData{"", ""}, svalbardsrv.ErrInvalidMsgWithToken},
-		{"SVBD:A:", svalbardsrv.TokenMsgData{"", ""}, svalbardsrv.ErrInvalidMsgWithToken},
-		{"SVBD::B", svalbardsrv.TokenMsgData{"", ""}, svalbardsrv.ErrInvalidMsgWithToken},
-		{"SVBD:::", svalbardsrv.TokenMsgData{"", ""}, svalbardsrv.ErrInvalidMsgWithToken},
-		{"SVB:reqID2:someOtherToken", svalbardsrv.TokenMsgData{"", ""}, svalbardsrv.ErrInvalidMsgWithToken},
-		{"SVBD:reqID3:some:OtherToken", svalbardsrv.TokenMsgData{"", ""}, svalbardsrv.ErrInvalidMsgWithToken},
-		{"SVBD:reqID5:AsdF:", svalbardsrv.TokenMsgData{"", ""}, svalbardsrv.ErrInvalidMsgWithToken},
+		{"SVBD:reqID2:someOtherToken", svalbardsrv.TokenMsgData{ReqID: "reqID2", Token: "someOtherToken"}, nil},
+		{"SVBD:63gh:hEGHE83", svalbardsrv.TokenMsgData{ReqID: "63gh", Token: "hEGHE83"}, nil},
+		{"SVBD:8g3ggb3:hwebt3BGb83", svalbardsrv.TokenMsgData{ReqID: "8g3ggb3", Token: "hwebt3BGb83"}, nil},
+		{"SVBD:7:A", svalbardsrv.TokenMsgData{ReqID: "7", Token: "A"}, nil},
+		{"SV:", svalbardsrv.TokenMsgData{}, svalbardsrv.ErrInvalidMsgWithToken},
+		{"::", svalbardsrv.TokenMsgData{}, svalbardsrv.ErrInvalidMsgWithToken},
+		{"", svalbardsrv.TokenMsgData{}, svalbardsrv.ErrInvalidMsgWithToken},
+		{"SVBD::", svalbardsrv.TokenMsgData{}, svalbardsrv.ErrInvalidMsgWithToken},
+		{"SVBD:A:", svalbardsrv.TokenMsgData{}, svalbardsrv.ErrInvalidMsgWithToken},
+		{"SVBD::B", svalbardsrv.TokenMsgData{}, svalbardsrv.ErrInvalidMsgWithToken},
+		{"SVBD:::", svalbardsrv.TokenMsgData{}, svalbardsrv.ErrInvalidMsgWithToken},
+		{"SVB:reqID2:someOtherToken", svalbardsrv.TokenMsgData{}, svalbardsrv.ErrInvalidMsgWithToken},
+		{"SVBD:reqID3:some:OtherToken", svalbardsrv.TokenMsgData{}, svalbardsrv.ErrInvalidMsgWithToken},
+		{"SVBD:reqID5:AsdF:", svalbardsrv.TokenMsgData{}, svalbardsrv.ErrInvalidMsgWithToken},
+		// Longer messages that embed a line with token.
+		{"Your code is 63hgG.\nSVBD:req1:63hgG", svalbardsrv.TokenMsgData{ReqID: "req1", Token: "63hgG"}, nil},
+		{"Hello,\r\n  svbd:req1:63hgG  \r\nBye", svalbardsrv.TokenMsgData{ReqID: "req1", Token: "63hgG"}, nil},
+		{"SVBD:req1:a:b\nSVBD:req2:GG3\nSVBD:req3:HHe", svalbardsrv.TokenMsgData{ReqID: "req2", Token: "GG3"}, nil},
+		{"Your code is SVBD:req1:63hgG", svalbardsrv.TokenMsgData{}, svalbardsrv.ErrInvalidMsgWithToken},
+		{"Your code is 63hgG.\nSVBD:req1:\n", svalbardsrv.TokenMsgData{}, svalbardsrv.ErrInvalidMsgWithToken},
 	}
 	for _, tt := range tests {
 		data, err := svalbardsrv.ParseMsgWithToken(tt.msg)
@@ -315,6 +372,13 @@ func TestBadRequestsForStorageToken(t *testing.T) {
 	}{
 		// An invalid request: no request_id.
 		{"", ownerIDType, ownerID, secretName, addBodySuffix(svalbardsrv.ErrMissingRequestID)},
+		// Invalid requests: request_ids with text to be embedded in the message.
+		{"1.\nCall +41 79 123 45 67 now", ownerIDType, ownerID, secretName, addBodySuffix(svalbardsrv.ErrInvalidRequestID)},
+		{"req 1", ownerIDType, ownerID, secretName, addBodySuffix(svalbardsrv.ErrInvalidRequestID)},
+		{strings.Repeat("r", 65), ownerIDType, ownerID, secretName, addBodySuffix(svalbardsrv.ErrInvalidRequestID)},
+		// Invalid requests: request_ids of the messages the server sends on its own.
+		{"reminder-1700000000", ownerIDType, ownerID, secretName, addBodySuffix(svalbardsrv.ErrInvalidRequestID)},
+		{"deleted-1", ownerIDType, ownerID, secretName, addBodySuffix(svalbardsrv.ErrInvalidRequestID)},
 		// An invalid request: no owner_id_type.
 		{reqID, "", ownerID, secretName, addBodySuffix(shareid.ErrMissingOwnerType)},
 		// An invalid request: no owner_id.
@@ -995,6 +1059,430 @@ func TestBadRequestsToDeleteShare(t *testing.T) {
 	}
 }
 
+func TestShareExpiryAndRenewal(t *testing.T) {
+	rootDir := newTempDir()
+	tokenStore, err := tokenstore.NewStore(5, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Could not setup TokenStore: %v", err)
+	}
+	shareStore, err := shareexpiry.New(inmemorysharestore.New(),
+		shareexpiry.Policy{DefaultPeriod: 24 * time.Hour, MaxPeriod: 240 * time.Hour, ReapInterval: -1})
+	if err != nil {
+		t.Fatalf("Could not setup share store: %v", err)
+	}
+	s := svalbardsrv.NewServer(tokenStore, shareStore, filechannel.NewChannel(rootDir))
+	user := userID{"FILE", "Tom"}
+	secretName := "Gmail key"
+	shareID, err := shareid.GetShareID(user.IDType, user.ID, secretName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getToken := func(handler http.HandlerFunc, path, reqID string) string {
+		w := testingtools.NewFakeResponseWriter()
+		handler(w, newGetTokenRequest(reqID, user, secretName, path))
+		if w.Status != http.StatusOK {
+			t.Fatalf("%s: got status [%v] and body [%v], want [%v]", path, w.Status, w.Body, http.StatusOK)
+		}
+		return fetchToken(rootDir, user.ID, reqID, t)
+	}
+
+	// The period requested at storage time is bounded by the policy.
+	token := getToken(s.GetStorageTokenHandler, "/get_storage_token", "req1")
+	for _, tt := range []struct {
+		expiresIn string
+		status    int
+		body      string
+	}{
+		{"soon", http.StatusBadRequest, addBodySuffix(svalbardsrv.ErrInvalidExpiry)},
+		{"-3600", http.StatusBadRequest, addBodySuffix(svalbardsrv.ErrInvalidExpiry)},
+		{"99999999999999", http.StatusBadRequest, addBodySuffix(svalbardsrv.ErrInvalidExpiry)},
+		{"864001", http.StatusBadRequest, addBodySuffix(svalbardsrv.ErrInvalidExpiry)},
+		{"86400", http.StatusOK, shareStoredResponse(shareData{secretName, "some share"}, user)},
+	} {
+		w := testingtools.NewFakeResponseWriter()
+		req := newStoreShareRequest(token, user, shareData{secretName, "some share"})
+		req.ParseForm()
+		req.Form.Set("expires_in", tt.expiresIn)
+		s.StoreShareHandler(w, req)
+		if w.Status != tt.status || w.Body != tt.body {
+			t.Errorf("StoreShareHandler() with expires_in=%s: got [%v, %v], want [%v, %v]",
+				tt.expiresIn, w.Status, w.Body, tt.status, tt.body)
+		}
+	}
+	expires, err := shareStore.Expiry(shareID)
+	if want := time.Now().Add(24 * time.Hour); err != nil || expires.Before(want.Add(-time.Minute)) || expires.After(want) {
+		t.Errorf("Expiry(): got [%v, %v], want about [%v, nil]", expires, err, want)
+	}
+
+	// A share is renewed with a renewal token, which must not be usable
+	// for other operations, nor other tokens for the renewal.
+	token = getToken(s.GetRenewalTokenHandler, "/get_renewal_token", "req2")
+	w := testingtools.NewFakeResponseWriter()
+	s.RetrieveShareHandler(w, newRetrieveShareRequest(token, user, secretName))
+	if w.Status != http.StatusForbidden {
+		t.Errorf("RetrieveShareHandler() with renewal token: got status [%v], want [%v]", w.Status, http.StatusForbidden)
+	}
+	retrievalToken := getToken(s.GetRetrievalTokenHandler, "/get_retrieval_token", "req3")
+	w = testingtools.NewFakeResponseWriter()
+	s.RenewShareHandler(w, newRenewShareRequest(retrievalToken, user, secretName))
+	if w.Status != http.StatusForbidden {
+		t.Errorf("RenewShareHandler() with retrieval token: got status [%v], want [%v]", w.Status, http.StatusForbidden)
+	}
+	w = testingtools.NewFakeResponseWriter()
+	s.RenewShareHandler(w, newRenewShareRequest(token, user, secretName))
+	wantPrefix := "Renewed a share of secret [" + secretName + "] of owner [FILE:Tom] until "
+	if w.Status != http.StatusOK || !strings.HasPrefix(w.Body, wantPrefix) {
+		t.Errorf("RenewShareHandler(): got [%v, %v], want [%v, %v...]", w.Status, w.Body, http.StatusOK, wantPrefix)
+	}
+
+	// Reminders carry renewal tokens.
+	expires = time.Unix(1700000000, 0)
+	if err := s.SendRenewalReminder(shareID, svalbardsrv.RecipientID{IDType: user.IDType, ID: user.ID}, expires); err != nil {
+		t.Fatalf("SendRenewalReminder(): %v", err)
+	}
+	reqID, token := fetchServerToken(rootDir, user.ID, "reminder-", t)
+	// The ids of the reminders are random, so they cannot be guessed.
+	if err := s.SendRenewalReminder(shareID, svalbardsrv.RecipientID{IDType: user.IDType, ID: user.ID}, expires); err != nil {
+		t.Fatalf("SendRenewalReminder(): %v", err)
+	}
+	if reqID2, _ := fetchServerToken(rootDir, user.ID, "reminder-", t); len(reqID) != len("reminder-")+16 || reqID2 == reqID {
+		t.Errorf("request ids of reminders: got [%v, %v], want two different random ids", reqID, reqID2)
+	}
+	w = testingtools.NewFakeResponseWriter()
+	s.RenewShareHandler(w, newRenewShareRequest(token, user, secretName))
+	if w.Status != http.StatusOK {
+		t.Errorf("RenewShareHandler() with token of reminder: got [%v, %v], want [%v]", w.Status, w.Body, http.StatusOK)
+	}
+
+	// Renewal tokens are issued only for existing shares.
+	w = testingtools.NewFakeResponseWriter()
+	s.GetRenewalTokenHandler(w, newGetTokenRequest("req4", user, "Bitcoin key", "/get_renewal_token"))
+	if w.Status != http.StatusNotFound || w.Body != shareNotFoundResponse("req4") {
+		t.Errorf("GetRenewalTokenHandler() for missing share: got [%v, %v], want [%v, %v]",
+			w.Status, w.Body, http.StatusNotFound, shareNotFoundResponse("req4"))
+	}
+}
+
+func TestShareExpiryNotAvailable(t *testing.T) {
+	rootDir := newTempDir()
+	s := getTestServer(rootDir, t)
+	user := userID{"FILE", "Tom"}
+	w := testingtools.NewFakeResponseWriter()
+	s.GetStorageTokenHandler(w, newGetTokenRequest("req1", user, "Gmail key", "/get_storage_token"))
+	req := newStoreShareRequest(fetchToken(rootDir, user.ID, "req1", t), user, shareData{"Gmail key", "some share"})
+	req.ParseForm()
+	req.Form.Set("expires_in", "3600")
+	w = testingtools.NewFakeResponseWriter()
+	s.StoreShareHandler(w, req)
+	if want := addBodySuffix(svalbardsrv.ErrExpiryNotAvailable); w.Status != http.StatusNotImplemented || w.Body != want {
+		t.Errorf("StoreShareHandler() with expires_in: got [%v, %v], want [%v, %v]", w.Status, w.Body, http.StatusNotImplemented, want)
+	}
+	// Without expires_in, the share is stored.
+	req.Form.Del("expires_in")
+	w = testingtools.NewFakeResponseWriter()
+	s.StoreShareHandler(w, req)
+	if w.Status != http.StatusOK {
+		t.Fatalf("StoreShareHandler(): got [%v, %v], want [%v]", w.Status, w.Body, http.StatusOK)
+	}
+	w = testingtools.NewFakeResponseWriter()
+	s.GetRenewalTokenHandler(w, newGetTokenRequest("req2", user, "Gmail key", "/get_renewal_token"))
+	w = testingtools.NewFakeResponseWriter()
+	s.RenewShareHandler(w, newRenewShareRequest(fetchToken(rootDir, user.ID, "req2", t), user, "Gmail key"))
+	if want := "could not renew the share: " + addBodySuffix(svalbardsrv.ErrExpiryNotAvailable); w.Status != http.StatusNotImplemented || w.Body != want {
+		t.Errorf("RenewShareHandler(): got [%v, %v], want [%v, %v]", w.Status, w.Body, http.StatusNotImplemented, want)
+	}
+}
+
+func TestSoftDeleteAndUndelete(t *testing.T) {
+	rootDir := newTempDir()
+	tokenStore, err := tokenstore.NewStore(5, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Could not setup TokenStore: %v", err)
+	}
+	shareStore := inmemorysharestore.New()
+	s := svalbardsrv.NewServer(tokenStore, shareStore, filechannel.NewChannel(rootDir),
+		svalbardsrv.WithSoftDelete(7*24*time.Hour))
+	user := userID{"FILE", "Tom"}
+	data := shareData{"Gmail key", "some share"}
+	shareID, err := shareid.GetShareID(user.IDType, user.ID, data.secretName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestToken := func(handler http.HandlerFunc, path, reqID string) *testingtools.FakeResponseWriter {
+		w := testingtools.NewFakeResponseWriter()
+		handler(w, newGetTokenRequest(reqID, user, data.secretName, path))
+		return w
+	}
+	requestToken(s.GetStorageTokenHandler, "/get_storage_token", "req1")
+	w := testingtools.NewFakeResponseWriter()
+	s.StoreShareHandler(w, newStoreShareRequest(fetchToken(rootDir, user.ID, "req1", t), user, data))
+	if w.Status != http.StatusOK {
+		t.Fatalf("StoreShareHandler(): got [%v, %v], want [%v]", w.Status, w.Body, http.StatusOK)
+	}
+
+	// A deleted share is kept, and its owner is sent an undeletion token.
+	requestToken(s.GetDeletionTokenHandler, "/get_deletion_token", "req2")
+	w = testingtools.NewFakeResponseWriter()
+	s.DeleteShareHandler(w, newDeleteShareRequest(fetchToken(rootDir, user.ID, "req2", t), user, data.secretName))
+	wantPrefix := shareDeletedResponse(data.secretName, user) + ", which can be undeleted until "
+	if w.Status != http.StatusOK || !strings.HasPrefix(w.Body, wantPrefix) {
+		t.Fatalf("DeleteShareHandler(): got [%v, %v], want [%v, %v...]", w.Status, w.Body, http.StatusOK, wantPrefix)
+	}
+	purgeAt, err := time.Parse(time.RFC3339, strings.TrimPrefix(w.Body, wantPrefix))
+	if want := time.Now().Add(7 * 24 * time.Hour); err != nil || purgeAt.Before(want.Add(-time.Minute)) || purgeAt.After(want) {
+		t.Errorf("purge time of deleted share: got [%v, %v], want about [%v, nil]", purgeAt, err, want)
+	}
+	_, notification := fetchServerToken(rootDir, user.ID, "deleted-", t)
+
+	// The share cannot be retrieved, and the responses do not reveal that
+	// it is deleted.
+	for _, tt := range []struct {
+		handler http.HandlerFunc
+		path    string
+		reqID   string
+		status  int
+		body    string
+	}{
+		{s.GetRetrievalTokenHandler, "/get_retrieval_token", "req3", http.StatusNotFound, shareNotFoundResponse("req3")},
+		{s.GetStorageTokenHandler, "/get_storage_token", "req4", http.StatusOK,
+			tokenSentResponse("req4", user, data.secretName, "storage")},
+	} {
+		if w := requestToken(tt.handler, tt.path, tt.reqID); w.Status != tt.status || w.Body != tt.body {
+			t.Errorf("%s with deleted share: got [%v, %v], want [%v, %v]", tt.path, w.Status, w.Body, tt.status, tt.body)
+		}
+	}
+
+	// The token of the notification undeletes the share, other tokens do not.
+	w = requestToken(s.GetUndeletionTokenHandler, "/get_undeletion_token", "req5")
+	if want := tokenSentResponse("req5", user, data.secretName, "undeletion"); w.Status != http.StatusOK || w.Body != want {
+		t.Errorf("GetUndeletionTokenHandler(): got [%v, %v], want [%v, %v]", w.Status, w.Body, http.StatusOK, want)
+	}
+	w = testingtools.NewFakeResponseWriter()
+	s.RetrieveShareHandler(w, newRetrieveShareRequest(fetchToken(rootDir, user.ID, "req5", t), user, data.secretName))
+	if w.Status != http.StatusForbidden {
+		t.Errorf("RetrieveShareHandler() with undeletion token: got [%v, %v], want [%v]", w.Status, w.Body, http.StatusForbidden)
+	}
+	w = testingtools.NewFakeResponseWriter()
+	s.UndeleteShareHandler(w, newUndeleteShareRequest("wrong", user, data.secretName))
+	if w.Status != http.StatusForbidden {
+		t.Errorf("UndeleteShareHandler() with invalid token: got [%v, %v], want [%v]", w.Status, w.Body, http.StatusForbidden)
+	}
+	w = testingtools.NewFakeResponseWriter()
+	s.UndeleteShareHandler(w, newUndeleteShareRequest(notification, user, data.secretName))
+	want := "Undeleted a share of secret [" + data.secretName + "] of owner [FILE:Tom]"
+	if w.Status != http.StatusOK || w.Body != want {
+		t.Errorf("UndeleteShareHandler(): got [%v, %v], want [%v, %v]", w.Status, w.Body, http.StatusOK, want)
+	}
+	if got, err := shareStore.Retrieve(shareID); got != data.shareValue || err != nil {
+		t.Errorf("Retrieve() of undeleted share: got [%q, %v], want [%q, nil]", got, err, data.shareValue)
+	}
+	if w := requestToken(s.GetUndeletionTokenHandler, "/get_undeletion_token", "req6"); w.Status != http.StatusNotFound {
+		t.Errorf("GetUndeletionTokenHandler() for existing share: got [%v, %v], want [%v]", w.Status, w.Body, http.StatusNotFound)
+	}
+
+	// Once the deleted share is purged, it can be stored again.
+	requestToken(s.GetDeletionTokenHandler, "/get_deletion_token", "req7")
+	w = testingtools.NewFakeResponseWriter()
+	s.DeleteShareHandler(w, newDeleteShareRequest(fetchToken(rootDir, user.ID, "req7", t), user, data.secretName))
+	if n, err := shareStore.Purge(time.Now().Add(8 * 24 * time.Hour)); n != 1 || err != nil {
+		t.Errorf("Purge(): got [%v, %v], want [1, nil]", n, err)
+	}
+	if w := requestToken(s.GetUndeletionTokenHandler, "/get_undeletion_token", "req8"); w.Status != http.StatusNotFound {
+		t.Errorf("GetUndeletionTokenHandler() for purged share: got [%v, %v], want [%v]", w.Status, w.Body, http.StatusNotFound)
+	}
+	if w := requestToken(s.GetStorageTokenHandler, "/get_storage_token", "req9"); w.Status != http.StatusOK {
+		t.Errorf("GetStorageTokenHandler() for purged share: got [%v, %v], want [%v]", w.Status, w.Body, http.StatusOK)
+	}
+
+	// A new share replaces the tombstone of a deleted one.
+	w = testingtools.NewFakeResponseWriter()
+	s.StoreShareHandler(w, newStoreShareRequest(fetchToken(rootDir, user.ID, "req9", t), user, data))
+	requestToken(s.GetDeletionTokenHandler, "/get_deletion_token", "req10")
+	w = testingtools.NewFakeResponseWriter()
+	s.DeleteShareHandler(w, newDeleteShareRequest(fetchToken(rootDir, user.ID, "req10", t), user, data.secretName))
+	requestToken(s.GetStorageTokenHandler, "/get_storage_token", "req11")
+	w = testingtools.NewFakeResponseWriter()
+	newData := shareData{data.secretName, "new share"}
+	s.StoreShareHandler(w, newStoreShareRequest(fetchToken(rootDir, user.ID, "req11", t), user, newData))
+	if w.Status != http.StatusOK {
+		t.Errorf("StoreShareHandler() of deleted share: got [%v, %v], want [%v]", w.Status, w.Body, http.StatusOK)
+	}
+	if got, err := shareStore.Retrieve(shareID); got != newData.shareValue || err != nil {
+		t.Errorf("Retrieve() of share replacing a tombstone: got [%q, %v], want [%q, nil]", got, err, newData.shareValue)
+	}
+	if _, err := shareStore.PurgeTime(shareID); err != svalbardsrv.ErrShareNotFound {
+		t.Errorf("PurgeTime() of replaced tombstone: got [%v], want [%v]", err, svalbardsrv.ErrShareNotFound)
+	}
+}
+
+func TestSoftDeleteNotAvailable(t *testing.T) {
+	rootDir := newTempDir()
+	tokenStore, err := tokenstore.NewStore(5, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Could not setup TokenStore: %v", err)
+	}
+	// A store that cannot keep deleted shares.
+	shareStore := struct{ svalbardsrv.ShareStore }{inmemorysharestore.New()}
+	s := svalbardsrv.NewServer(tokenStore, shareStore, filechannel.NewChannel(rootDir),
+		svalbardsrv.WithSoftDelete(time.Hour))
+	user := userID{"FILE", "Tom"}
+	data := shareData{"Gmail key", "some share"}
+	shareID, err := shareid.GetShareID(user.IDType, user.ID, data.secretName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shareStore.Store(shareID, data.shareValue); err != nil {
+		t.Fatal(err)
+	}
+	w := testingtools.NewFakeResponseWriter()
+	s.GetDeletionTokenHandler(w, newGetTokenRequest("req1", user, data.secretName, "/get_deletion_token"))
+	w = testingtools.NewFakeResponseWriter()
+	s.DeleteShareHandler(w, newDeleteShareRequest(fetchToken(rootDir, user.ID, "req1", t), user, data.secretName))
+	if want := "could not delete the share: " + addBodySuffix(svalbardsrv.ErrSoftDeleteNotAvailable); w.Status != http.StatusNotImplemented || w.Body != want {
+		t.Errorf("DeleteShareHandler(): got [%v, %v], want [%v, %v]", w.Status, w.Body, http.StatusNotImplemented, want)
+	}
+	// The share is not deleted for good instead.
+	if _, err := shareStore.Retrieve(shareID); err != nil {
+		t.Errorf("Retrieve() after failed deletion: got [%v], want [nil]", err)
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	rootDir := newTempDir()
+	tokenStore, err := tokenstore.NewStore(5, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Could not setup TokenStore: %v", err)
+	}
+	s := svalbardsrv.NewServer(tokenStore, inmemorysharestore.New(), filechannel.NewChannel(rootDir),
+		svalbardsrv.WithMaxRequestSize(512), svalbardsrv.WithMaxShareSize(16))
+	user := userID{"FILE", "Tom"}
+
+	// Requests with long bodies are rejected before they are parsed.
+	w := testingtools.NewFakeResponseWriter()
+	s.GetStorageTokenHandler(w, newGetTokenRequest("req1", user, strings.Repeat("x", 512), "/get_storage_token"))
+	if want := addBodySuffix(svalbardsrv.ErrRequestTooLarge); w.Status != http.StatusRequestEntityTooLarge || w.Body != want {
+		t.Errorf("GetStorageTokenHandler() of long request: got [%v, %v], want [%v, %v]", w.Status, w.Body, http.StatusRequestEntityTooLarge, want)
+	}
+	w = testingtools.NewFakeResponseWriter()
+	s.StoreShareHandler(w, newStoreShareRequest("token", user, shareData{"Gmail key", strings.Repeat("x", 512)}))
+	if want := addBodySuffix(svalbardsrv.ErrRequestTooLarge); w.Status != http.StatusRequestEntityTooLarge || w.Body != want {
+		t.Errorf("StoreShareHandler() of long request: got [%v, %v], want [%v, %v]", w.Status, w.Body, http.StatusRequestEntityTooLarge, want)
+	}
+
+	// Long share values are rejected without using up the token.
+	data := shareData{"Gmail key", "some share"}
+	w = testingtools.NewFakeResponseWriter()
+	s.GetStorageTokenHandler(w, newGetTokenRequest("req2", user, data.secretName, "/get_storage_token"))
+	token := fetchToken(rootDir, user.ID, "req2", t)
+	w = testingtools.NewFakeResponseWriter()
+	s.StoreShareHandler(w, newStoreShareRequest(token, user, shareData{data.secretName, strings.Repeat("x", 17)}))
+	if want := addBodySuffix(svalbardsrv.ErrShareTooLarge); w.Status != http.StatusRequestEntityTooLarge || w.Body != want {
+		t.Errorf("StoreShareHandler() of long share: got [%v, %v], want [%v, %v]", w.Status, w.Body, http.StatusRequestEntityTooLarge, want)
+	}
+	w = testingtools.NewFakeResponseWriter()
+	s.StoreShareHandler(w, newStoreShareRequest(token, user, data))
+	if want := shareStoredResponse(data, user); w.Status != http.StatusOK || w.Body != want {
+		t.Errorf("StoreShareHandler(): got [%v, %v], want [%v, %v]", w.Status, w.Body, http.StatusOK, want)
+	}
+}
+
+// fullShareStore is a ShareStore without space for more shares.
+type fullShareStore struct {
+	svalbardsrv.ShareStore
+}
+
+func (fullShareStore) Store(shareID, shareValue string) error {
+	return svalbardsrv.ErrStoreFull
+}
+
+// normalizingChannel is a SecondaryChannel with case-insensitive recipient ids.
+type normalizingChannel struct {
+	svalbardsrv.SecondaryChannel
+}
+
+func (normalizingChannel) Recipient(recipient svalbardsrv.RecipientID) svalbardsrv.RecipientID {
+	recipient.ID = strings.ToLower(recipient.ID)
+	return recipient
+}
+
+func TestShareQuotas(t *testing.T) {
+	rootDir := newTempDir()
+	tokenStore, err := tokenstore.NewStore(5, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Could not setup TokenStore: %v", err)
+	}
+	shareStore := inmemorysharestore.New()
+	shareStore.SetMaxSharesPerOwner(1)
+	ownerIndexKey := []byte("owner index key")
+	s := svalbardsrv.NewServer(tokenStore, shareStore, normalizingChannel{filechannel.NewChannel(rootDir)},
+		svalbardsrv.WithOwnerIndexKey(ownerIndexKey))
+	storeShare := func(s *svalbardsrv.Server, reqID string, user userID, data shareData) *testingtools.FakeResponseWriter {
+		w := testingtools.NewFakeResponseWriter()
+		s.GetStorageTokenHandler(w, newGetTokenRequest(reqID, user, data.secretName, "/get_storage_token"))
+		w = testingtools.NewFakeResponseWriter()
+		s.StoreShareHandler(w, newStoreShareRequest(fetchToken(rootDir, user.ID, reqID, t), user, data))
+		return w
+	}
+
+	tom, ann := userID{"FILE", "Tom"}, userID{"FILE", "Ann"}
+	data := shareData{"Gmail key", "some share"}
+	if w := storeShare(s, "req1", tom, data); w.Status != http.StatusOK {
+		t.Errorf("StoreShareHandler(): got [%v, %v], want [%v, ...]", w.Status, w.Body, http.StatusOK)
+	}
+	// The quota applies per owner.
+	if w := storeShare(s, "req2", ann, data); w.Status != http.StatusOK {
+		t.Errorf("StoreShareHandler() of another owner: got [%v, %v], want [%v, ...]", w.Status, w.Body, http.StatusOK)
+	}
+	// No storage token is sent over the quota.
+	w := testingtools.NewFakeResponseWriter()
+	s.GetStorageTokenHandler(w, newGetTokenRequest("req3", tom, "Yahoo key", "/get_storage_token"))
+	if want := "Req. req3: " + addBodySuffix(svalbardsrv.ErrQuotaExceeded); w.Status != http.StatusForbidden || w.Body != want {
+		t.Errorf("GetStorageTokenHandler() over quota: got [%v, %v], want [%v, %v]", w.Status, w.Body, http.StatusForbidden, want)
+	}
+	msgs, err := filechannel.NewChannel(rootDir).ReadMessages(tom.ID, time.Time{})
+	if err != nil {
+		t.Fatalf("Could not read messages of [%v]: %v", tom.ID, err)
+	}
+	for _, msg := range msgs {
+		if data, err := svalbardsrv.ParseMsgWithToken(msg.Text); err == nil && data.ReqID == "req3" {
+			t.Errorf("GetStorageTokenHandler() over quota: got token [%v], want none", data.Token)
+		}
+	}
+	// The quota applies to all variants of the owner id.
+	w = testingtools.NewFakeResponseWriter()
+	s.GetStorageTokenHandler(w, newGetTokenRequest("req5", userID{"FILE", "TOM"}, "Yahoo key", "/get_storage_token"))
+	if w.Status != http.StatusForbidden {
+		t.Errorf("GetStorageTokenHandler() of variant over quota: got [%v, %v], want [%v, ...]", w.Status, w.Body, http.StatusForbidden)
+	}
+	ownerKey, err := shareid.GetOwnerKey(ownerIndexKey, tom.IDType, "tom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shareID, err := shareid.GetShareID(tom.IDType, tom.ID, data.secretName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := shareStore.OwnerShareIDs(ownerKey); !reflect.DeepEqual(got, []string{shareID}) || err != nil {
+		t.Errorf("OwnerShareIDs(): got [%q, %v], want [%q, nil]", got, err, []string{shareID})
+	}
+
+	// Without an owner index key, shares are not indexed.
+	unindexed := inmemorysharestore.New()
+	unindexed.SetMaxSharesPerOwner(1)
+	s = svalbardsrv.NewServer(tokenStore, unindexed, filechannel.NewChannel(rootDir))
+	for i, secretName := range []string{"Gmail key", "Yahoo key"} {
+		if w := storeShare(s, fmt.Sprintf("req%d", 6+i), tom, shareData{secretName, "some share"}); w.Status != http.StatusOK {
+			t.Errorf("StoreShareHandler() without owner index: got [%v, %v], want [%v, ...]", w.Status, w.Body, http.StatusOK)
+		}
+	}
+
+	s = svalbardsrv.NewServer(tokenStore, fullShareStore{inmemorysharestore.New()}, filechannel.NewChannel(rootDir))
+	w = storeShare(s, "req4", tom, data)
+	if want := addBodySuffix(svalbardsrv.ErrStoreFull); w.Status != http.StatusInsufficientStorage || w.Body != want {
+		t.Errorf("StoreShareHandler() into full store: got [%v, %v], want [%v, %v]", w.Status, w.Body, http.StatusInsufficientStorage, want)
+	}
+}
+
 func TestNonPostRequests(t *testing.T) {
 	rootDir := newTempDir()
 	s := getTestServer(rootDir, t)
@@ -1013,6 +1501,10 @@ func TestNonPostRequests(t *testing.T) {
 		{"/retrieve_share", s.RetrieveShareHandler, "RetrieveShareHandler"},
 		{"/get_deletion_token", s.GetDeletionTokenHandler, "GetDeletionTokenHandler"},
 		{"/delete_share", s.DeleteShareHandler, "DeleteShareHandler"},
+		{"/get_renewal_token", s.GetRenewalTokenHandler, "GetRenewalTokenHandler"},
+		{"/renew_share", s.RenewShareHandler, "RenewShareHandler"},
+		{"/get_undeletion_token", s.GetUndeletionTokenHandler, "GetUndeletionTokenHandler"},
+		{"/undelete_share", s.UndeleteShareHandler, "UndeleteShareHandler"},
 	}
 	for _, tt := range tests {
 		req := httptest.NewRequest("GET", testTarget+tt.path, reqBody)
@@ -1026,3 +1518,824 @@ func TestNonPostRequests(t *testing.T) {
 		}
 	}
 }
+
+// sendOnlyChannel is a SecondaryChannel that does not enumerate
+// the owner id types it supports.
+type sendOnlyChannel struct{}
+
+func (c sendOnlyChannel) Send(recipient svalbardsrv.RecipientID, data svalbardsrv.TokenMsgData) error {
+	return nil
+}
+
+func TestSupportedOwnerIDTypes(t *testing.T) {
+	tokenStore, err := tokenstore.NewStore(5, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Could not setup TokenStore: %v", err)
+	}
+	router := channelrouter.New()
+	router.Register("FILE", filechannel.NewChannel(newTempDir()))
+	router.Register("sms", sendOnlyChannel{})
+	router.RegisterAlias("text", "SMS")
+	var tests = []struct {
+		channel  svalbardsrv.SecondaryChannel
+		method   string
+		status   int
+		respBody string
+	}{
+		{filechannel.NewChannel(newTempDir()), "GET", http.StatusOK, `{"owner_id_types":["FILE"]}`},
+		{router, "GET", http.StatusOK, `{"owner_id_types":["FILE","SMS"]}`},
+		{channelrouter.New(), "GET", http.StatusOK, `{"owner_id_types":[]}`},
+		{sendOnlyChannel{}, "GET", http.StatusNotImplemented, addBodySuffix(svalbardsrv.ErrOwnerIDTypesNotAvailable)},
+		{router, "POST", http.StatusBadRequest, addBodySuffix(svalbardsrv.ErrExpectedGetRequest)},
+	}
+	for _, tt := range tests {
+		s := svalbardsrv.NewServer(tokenStore, inmemorysharestore.New(), tt.channel)
+		w := testingtools.NewFakeResponseWriter()
+		req := httptest.NewRequest(tt.method, testTarget+"/owner_id_types", nil)
+		s.SupportedOwnerIDTypesHandler(w, req)
+		if w.Status != tt.status {
+			t.Errorf("SupportedOwnerIDTypesHandler() with %T status: got [%v], want [%v]", tt.channel, w.Status, tt.status)
+		}
+		if w.Body != tt.respBody {
+			t.Errorf("SupportedOwnerIDTypesHandler() with %T body: got [%v], want [%v]", tt.channel, w.Body, tt.respBody)
+		}
+	}
+}
+
+// statusReportingChannel is a SecondaryChannel that reports fixed delivery
+// statuses of the messages, keyed by request id.
+type statusReportingChannel struct {
+	sendOnlyChannel
+	statuses map[string]string
+}
+
+func (c statusReportingChannel) DeliveryStatus(recipient svalbardsrv.RecipientID, reqID string) (string, error) {
+	status, ok := c.statuses[reqID]
+	if !ok || recipient.ID != "Tom" {
+		return "", svalbardsrv.ErrDeliveryStatusNotFound
+	}
+	return status, nil
+}
+
+func newDeliveryStatusRequest(reqID string, user userID) *http.Request {
+	data := make(url.Values)
+	data.Set("request_id", reqID)
+	data.Set("owner_id_type", user.IDType)
+	data.Set("owner_id", user.ID)
+	body := bufio.NewReader(strings.NewReader(data.Encode()))
+	req := httptest.NewRequest("POST", testTarget+"/delivery_status", body)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func TestDeliveryStatus(t *testing.T) {
+	tokenStore, err := tokenstore.NewStore(5, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Could not setup TokenStore: %v", err)
+	}
+	reporter := statusReportingChannel{statuses: map[string]string{
+		"req1": svalbardsrv.DeliveryPending,
+		"req2": svalbardsrv.DeliveryDelivered,
+		"req3": svalbardsrv.DeliveryFailed,
+	}}
+	tom, jerry := userID{"SMS", "Tom"}, userID{"SMS", "Jerry"}
+	var tests = []struct {
+		channel  svalbardsrv.SecondaryChannel
+		reqID    string
+		user     userID
+		status   int
+		respBody string
+	}{
+		{reporter, "req1", tom, http.StatusOK, `{"request_id":"req1","status":"pending"}`},
+		{reporter, "req2", tom, http.StatusOK, `{"request_id":"req2","status":"delivered"}`},
+		{reporter, "req3", tom, http.StatusOK, `{"request_id":"req3","status":"failed"}`},
+		{reporter, "req4", tom, http.StatusNotFound, addBodySuffix(svalbardsrv.ErrDeliveryStatusNotFound)},
+		{reporter, "req1", jerry, http.StatusNotFound, addBodySuffix(svalbardsrv.ErrDeliveryStatusNotFound)},
+		{reporter, "", tom, http.StatusBadRequest, addBodySuffix(svalbardsrv.ErrMissingRequestID)},
+		{reporter, "req1", userID{"", "Tom"}, http.StatusBadRequest, addBodySuffix(shareid.ErrMissingOwnerType)},
+		{reporter, "req1", userID{"SMS", ""}, http.StatusBadRequest, addBodySuffix(shareid.ErrMissingOwnerID)},
+		{sendOnlyChannel{}, "req1", tom, http.StatusNotImplemented,
+			addBodySuffix(svalbardsrv.ErrDeliveryStatusNotAvailable)},
+	}
+	for _, tt := range tests {
+		s := svalbardsrv.NewServer(tokenStore, inmemorysharestore.New(), tt.channel)
+		w := testingtools.NewFakeResponseWriter()
+		s.DeliveryStatusHandler(w, newDeliveryStatusRequest(tt.reqID, tt.user))
+		if w.Status != tt.status {
+			t.Errorf("DeliveryStatusHandler(%v) status: got [%v], want [%v]", tt, w.Status, tt.status)
+		}
+		if w.Body != tt.respBody {
+			t.Errorf("DeliveryStatusHandler(%v) body: got [%v], want [%v]", tt, w.Body, tt.respBody)
+		}
+	}
+}
+
+func TestRateLimitedDeliveryStatus(t *testing.T) {
+	tokenStore, err := tokenstore.NewStore(5, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Could not setup TokenStore: %v", err)
+	}
+	limiter, err := ratelimit.New(ratelimit.Config{PerRecipient: ratelimit.Policy{Rate: 1.0 / 60, Burst: 2}}, nil, nil)
+	if err != nil {
+		t.Fatalf("Could not setup rate limiter: %v", err)
+	}
+	reporter := statusReportingChannel{statuses: map[string]string{"req1": svalbardsrv.DeliveryPending}}
+	s := svalbardsrv.NewServer(tokenStore, inmemorysharestore.New(), reporter,
+		svalbardsrv.WithDeliveryStatusRateLimiter(limiter))
+	tom, jerry := userID{"SMS", "Tom"}, userID{"SMS", "Jerry"}
+	var tests = []struct {
+		reqID  string
+		user   userID
+		status int
+	}{
+		{"req1", tom, http.StatusOK},
+		{"req2", tom, http.StatusNotFound},
+		{"req1", tom, http.StatusTooManyRequests},
+		{"req1", jerry, http.StatusNotFound},
+		// Invalid requests are rejected before consulting the limiter.
+		{"", tom, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := testingtools.NewFakeResponseWriter()
+		s.DeliveryStatusHandler(w, newDeliveryStatusRequest(tt.reqID, tt.user))
+		if w.Status != tt.status {
+			t.Errorf("DeliveryStatusHandler(%v) status: got [%v, %v], want [%v]", tt, w.Status, w.Body, tt.status)
+		}
+	}
+}
+
+// failingChannel is a SecondaryChannel that records the data it is asked
+// to send, and then fails the delivery with 'err' (if not nil).
+type failingChannel struct {
+	err  error
+	sent []svalbardsrv.TokenMsgData
+}
+
+func (c *failingChannel) Send(recipient svalbardsrv.RecipientID, data svalbardsrv.TokenMsgData) error {
+	c.sent = append(c.sent, data)
+	return c.err
+}
+
+func TestTokenIsRevokedWhenSendingFails(t *testing.T) {
+	tokenStore, err := tokenstore.NewStore(5, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Could not setup TokenStore: %v", err)
+	}
+	shareStore := inmemorysharestore.New()
+	tom := userID{"SMS", "Tom"}
+	existingSecret, newSecret := "Gmail key", "Bank PIN"
+	existingShareID, _ := shareid.GetShareID(tom.IDType, tom.ID, existingSecret)
+	if err := shareStore.Store(existingShareID, "some share"); err != nil {
+		t.Fatalf("Could not store a share: %v", err)
+	}
+	// An error of the channel that must not be revealed to the clients.
+	leakyErr := fmt.Errorf("gateway sms.example.com rejected credentials for +41 79 123")
+	var tests = []struct {
+		channelErr error
+		handlerURL string
+		secretName string
+		op         svalbardsrv.Operation
+		status     int
+		respBody   string
+	}{
+		{leakyErr, "/get_storage_token", newSecret, svalbardsrv.OpStoreShare, http.StatusInternalServerError,
+			"Req. req1: could not send storage token: " + addBodySuffix(svalbardsrv.ErrTokenDeliveryFailed)},
+		{leakyErr, "/get_retrieval_token", existingSecret, svalbardsrv.OpRetrieveShare, http.StatusInternalServerError,
+			"Req. req1: could not send retrieval token: " + addBodySuffix(svalbardsrv.ErrTokenDeliveryFailed)},
+		{leakyErr, "/get_deletion_token", existingSecret, svalbardsrv.OpDeleteShare, http.StatusInternalServerError,
+			"Req. req1: could not send deletion token: " + addBodySuffix(svalbardsrv.ErrTokenDeliveryFailed)},
+		{svalbardsrv.ErrUnsupportedOwnerIDType, "/get_storage_token", newSecret, svalbardsrv.OpStoreShare,
+			http.StatusBadRequest,
+			"Req. req1: could not send storage token: " + addBodySuffix(svalbardsrv.ErrUnsupportedOwnerIDType)},
+	}
+	for _, tt := range tests {
+		channel := &failingChannel{err: tt.channelErr}
+		s := svalbardsrv.NewServer(tokenStore, shareStore, channel)
+		handlers := map[string]http.HandlerFunc{
+			"/get_storage_token":   s.GetStorageTokenHandler,
+			"/get_retrieval_token": s.GetRetrievalTokenHandler,
+			"/get_deletion_token":  s.GetDeletionTokenHandler,
+		}
+		w := testingtools.NewFakeResponseWriter()
+		handlers[tt.handlerURL](w, newGetTokenRequest("req1", tom, tt.secretName, tt.handlerURL))
+		if w.Status != tt.status {
+			t.Errorf("%s with error [%v] status: got [%v], want [%v]", tt.handlerURL, tt.channelErr, w.Status, tt.status)
+		}
+		if w.Body != tt.respBody {
+			t.Errorf("%s with error [%v] body: got [%v], want [%v]", tt.handlerURL, tt.channelErr, w.Body, tt.respBody)
+		}
+		if len(channel.sent) != 1 {
+			t.Fatalf("%s with error [%v]: got %d tokens sent, want 1", tt.handlerURL, tt.channelErr, len(channel.sent))
+		}
+		// The undelivered token must not be usable.
+		shareID, _ := shareid.GetShareID(tom.IDType, tom.ID, tt.secretName)
+		if err := tokenStore.IsTokenValidNow(channel.sent[0].Token, shareID, tt.op); err != svalbardsrv.ErrTokenNotFound {
+			t.Errorf("%s with error [%v]: undelivered token got [%v], want [%v]",
+				tt.handlerURL, tt.channelErr, err, svalbardsrv.ErrTokenNotFound)
+		}
+	}
+}
+
+func TestTokenRequestsPassOperationAndLocale(t *testing.T) {
+	tokenStore, err := tokenstore.NewStore(5, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Could not setup TokenStore: %v", err)
+	}
+	shareStore := inmemorysharestore.New()
+	tom := userID{"SMS", "Tom"}
+	shareID, _ := shareid.GetShareID(tom.IDType, tom.ID, "Gmail key")
+	if err := shareStore.Store(shareID, "some share"); err != nil {
+		t.Fatalf("Could not store a share: %v", err)
+	}
+	channel := &failingChannel{}
+	s := svalbardsrv.NewServer(tokenStore, shareStore, channel)
+	var tests = []struct {
+		handler    http.HandlerFunc
+		handlerURL string
+		secretName string
+		locale     string
+		op         svalbardsrv.Operation
+	}{
+		{s.GetStorageTokenHandler, "/get_storage_token", "Bank PIN", "de-CH", svalbardsrv.OpStoreShare},
+		{s.GetRetrievalTokenHandler, "/get_retrieval_token", "Gmail key", "", svalbardsrv.OpRetrieveShare},
+		{s.GetDeletionTokenHandler, "/get_deletion_token", "Gmail key", "fr", svalbardsrv.OpDeleteShare},
+	}
+	for i, tt := range tests {
+		data := url.Values{"request_id": {"req1"}, "owner_id_type": {tom.IDType}, "owner_id": {tom.ID},
+			"secret_name": {tt.secretName}, "locale": {tt.locale}}
+		req := httptest.NewRequest("POST", testTarget+tt.handlerURL, strings.NewReader(data.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := testingtools.NewFakeResponseWriter()
+		tt.handler(w, req)
+		if w.Status != http.StatusOK {
+			t.Errorf("%s status: got [%v], want [%v]", tt.handlerURL, w.Status, http.StatusOK)
+			continue
+		}
+		if got := channel.sent[i]; got.ReqID != "req1" || got.Op != tt.op || got.Locale != tt.locale {
+			t.Errorf("%s sent [%+v], want request id req1, operation %v and locale [%v]",
+				tt.handlerURL, got, tt.op, tt.locale)
+		}
+	}
+}
+
+func TestRateLimitedTokenRequests(t *testing.T) {
+	rootDir := newTempDir()
+	tokenStore, err := tokenstore.NewStore(5, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Could not setup TokenStore: %v", err)
+	}
+	limiter, err := ratelimit.New(ratelimit.Config{PerRecipient: ratelimit.Policy{Rate: 1.0 / 60, Burst: 2}}, nil, nil)
+	if err != nil {
+		t.Fatalf("Could not setup rate limiter: %v", err)
+	}
+	s := svalbardsrv.NewServer(tokenStore, inmemorysharestore.New(), filechannel.NewChannel(rootDir),
+		svalbardsrv.WithRateLimiter(limiter))
+	tom, jerry := userID{"FILE", "Tom"}, userID{"FILE", "Jerry"}
+	var tests = []struct {
+		reqID    string
+		user     userID
+		status   int
+		respBody string
+	}{
+		{"req1", tom, http.StatusOK, tokenSentResponse("req1", tom, "Gmail key", "storage")},
+		{"req2", tom, http.StatusOK, tokenSentResponse("req2", tom, "Gmail key", "storage")},
+		{"req3", tom, http.StatusTooManyRequests, addBodySuffix(svalbardsrv.ErrRateLimited)},
+		{"req4", jerry, http.StatusOK, tokenSentResponse("req4", jerry, "Gmail key", "storage")},
+		// Invalid requests are rejected before consulting the limiter.
+		{"", tom, http.StatusBadRequest, addBodySuffix(svalbardsrv.ErrMissingRequestID)},
+	}
+	for _, tt := range tests {
+		w := testingtools.NewFakeResponseWriter()
+		s.GetStorageTokenHandler(w, newGetTokenRequest(tt.reqID, tt.user, "Gmail key", "/get_storage_token"))
+		if w.Status != tt.status {
+			t.Errorf("GetStorageTokenHandler(%v) status: got [%v], want [%v]", tt, w.Status, tt.status)
+		}
+		if w.Body != tt.respBody {
+			t.Errorf("GetStorageTokenHandler(%v) body: got [%v], want [%v]", tt, w.Body, tt.respBody)
+		}
+		retryAfter := w.Header().Get("Retry-After")
+		if tt.status == http.StatusTooManyRequests && retryAfter != "60" {
+			t.Errorf("GetStorageTokenHandler(%v) Retry-After: got [%v], want [60]", tt, retryAfter)
+		}
+		if tt.status != http.StatusTooManyRequests && retryAfter != "" {
+			t.Errorf("GetStorageTokenHandler(%v) unexpected Retry-After: [%v]", tt, retryAfter)
+		}
+	}
+	// A rate limited request does not send any token.
+	msgs, err := filechannel.NewChannel(rootDir).ReadMessages("Tom", time.Time{})
+	if err != nil || len(msgs) != 2 {
+		t.Errorf("Messages sent to Tom: got %v (error: %v), want 2", msgs, err)
+	}
+}
+
+// getChallenge returns a new challenge obtained from the ChallengeHandler of 's'.
+func getChallenge(s *svalbardsrv.Server, t *testing.T) string {
+	w := testingtools.NewFakeResponseWriter()
+	s.ChallengeHandler(w, httptest.NewRequest("GET", testTarget+"/challenge", nil))
+	if w.Status != http.StatusOK {
+		t.Fatalf("ChallengeHandler() status: got [%v], want [%v]", w.Status, http.StatusOK)
+	}
+	var resp struct {
+		Challenge string `json:"challenge"`
+		Expires   int64  `json:"expires"`
+	}
+	if err := json.Unmarshal([]byte(w.Body), &resp); err != nil {
+		t.Fatalf("ChallengeHandler() body [%v] is not valid: %v", w.Body, err)
+	}
+	if resp.Expires <= time.Now().Unix() {
+		t.Errorf("ChallengeHandler() expiration time: got %v, want a future time", resp.Expires)
+	}
+	return resp.Challenge
+}
+
+func TestChallengeHandler(t *testing.T) {
+	guard, err := pow.NewGuard(pow.Config{Key: []byte("key"), Difficulty: 4})
+	if err != nil {
+		t.Fatalf("Could not setup challenge guard: %v", err)
+	}
+	rootDir := newTempDir()
+	tokenStore, err := tokenstore.NewStore(5, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Could not setup TokenStore: %v", err)
+	}
+	s := svalbardsrv.NewServer(tokenStore, inmemorysharestore.New(), filechannel.NewChannel(rootDir),
+		svalbardsrv.WithChallengeGuard(guard))
+	if challenge := getChallenge(s, t); !strings.HasPrefix(challenge, "v1.4.") {
+		t.Errorf("ChallengeHandler() challenge: got [%v], want prefix [v1.4.]", challenge)
+	}
+
+	var tests = []struct {
+		server   *svalbardsrv.Server
+		method   string
+		status   int
+		respBody string
+	}{
+		{s, "POST", http.StatusBadRequest, addBodySuffix(svalbardsrv.ErrExpectedGetRequest)},
+		{getTestServer(rootDir, t), "GET", http.StatusNotImplemented, addBodySuffix(svalbardsrv.ErrChallengesNotAvailable)},
+	}
+	for _, tt := range tests {
+		w := testingtools.NewFakeResponseWriter()
+		tt.server.ChallengeHandler(w, httptest.NewRequest(tt.method, testTarget+"/challenge", nil))
+		if w.Status != tt.status {
+			t.Errorf("ChallengeHandler() with %s status: got [%v], want [%v]", tt.method, w.Status, tt.status)
+		}
+		if w.Body != tt.respBody {
+			t.Errorf("ChallengeHandler() with %s body: got [%v], want [%v]", tt.method, w.Body, tt.respBody)
+		}
+	}
+}
+
+func TestTokenRequestsRequireChallenge(t *testing.T) {
+	guard, err := pow.NewGuard(pow.Config{Key: []byte("key"), Difficulty: 4, LoadThreshold: 100, RecipientThreshold: 1})
+	if err != nil {
+		t.Fatalf("Could not setup challenge guard: %v", err)
+	}
+	rootDir := newTempDir()
+	tokenStore, err := tokenstore.NewStore(5, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Could not setup TokenStore: %v", err)
+	}
+	s := svalbardsrv.NewServer(tokenStore, inmemorysharestore.New(), filechannel.NewChannel(rootDir),
+		svalbardsrv.WithChallengeGuard(guard))
+	challenge := getChallenge(s, t)
+	solution, err := pow.Solve(challenge)
+	if err != nil {
+		t.Fatalf("Solve(%q) failed: %v", challenge, err)
+	}
+	wrongSolution := "wrong"
+	for pow.IsSolution(challenge, wrongSolution, 4) {
+		wrongSolution += "!"
+	}
+	tom, jerry := userID{"FILE", "Tom"}, userID{"FILE", "Jerry"}
+	var tests = []struct {
+		reqID     string
+		user      userID
+		challenge string
+		solution  string
+		status    int
+		respBody  string
+	}{
+		{"req1", tom, "", "", http.StatusOK, tokenSentResponse("req1", tom, "Gmail key", "storage")},
+		// Tom is being hammered, so further requests need a solved challenge.
+		{"req2", tom, "", "", http.StatusPreconditionRequired, addBodySuffix(svalbardsrv.ErrChallengeRequired)},
+		{"req3", tom, challenge, "", http.StatusPreconditionRequired, addBodySuffix(svalbardsrv.ErrChallengeRequired)},
+		{"req4", tom, challenge, wrongSolution, http.StatusForbidden, addBodySuffix(svalbardsrv.ErrInvalidChallengeSolution)},
+		{"req5", tom, "v1.0.9999999999.abcd.forged", "1", http.StatusForbidden, addBodySuffix(svalbardsrv.ErrInvalidChallengeSolution)},
+		{"req6", tom, challenge, solution, http.StatusOK, tokenSentResponse("req6", tom, "Gmail key", "storage")},
+		// A challenge can be used only once.
+		{"req7", tom, challenge, solution, http.StatusForbidden, addBodySuffix(svalbardsrv.ErrInvalidChallengeSolution)},
+		{"req7", jerry, "", "", http.StatusOK, tokenSentResponse("req7", jerry, "Gmail key", "storage")},
+	}
+	for _, tt := range tests {
+		data := make(url.Values)
+		data.Set("request_id", tt.reqID)
+		data.Set("owner_id_type", tt.user.IDType)
+		data.Set("owner_id", tt.user.ID)
+		data.Set("secret_name", "Gmail key")
+		data.Set("challenge", tt.challenge)
+		data.Set("challenge_solution", tt.solution)
+		req := httptest.NewRequest("POST", testTarget+"/get_storage_token", strings.NewReader(data.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := testingtools.NewFakeResponseWriter()
+		s.GetStorageTokenHandler(w, req)
+		if w.Status != tt.status {
+			t.Errorf("GetStorageTokenHandler(%v) status: got [%v], want [%v]", tt, w.Status, tt.status)
+		}
+		if w.Body != tt.respBody {
+			t.Errorf("GetStorageTokenHandler(%v) body: got [%v], want [%v]", tt, w.Body, tt.respBody)
+		}
+	}
+	// Requests without a valid solution do not send any token.
+	msgs, err := filechannel.NewChannel(rootDir).ReadMessages("Tom", time.Time{})
+	if err != nil || len(msgs) != 2 {
+		t.Errorf("Messages sent to Tom: got %v (error: %v), want 2", msgs, err)
+	}
+}
+
+// recordingAuditor is an Auditor that records the events in memory.
+type recordingAuditor struct {
+	events []svalbardsrv.AuditEvent
+}
+
+func (a *recordingAuditor) Audit(event svalbardsrv.AuditEvent) error {
+	a.events = append(a.events, event)
+	return nil
+}
+
+// failingCommitter is a CommittingAuditor whose Commit fails for retrievals.
+type failingCommitter struct {
+	recordingAuditor
+	commits []svalbardsrv.AuditEvent
+}
+
+func (a *failingCommitter) Commit(event svalbardsrv.AuditEvent) error {
+	a.commits = append(a.commits, event)
+	if event.Operation == svalbardsrv.AuditRetrieveShare {
+		return errors.New("log unavailable")
+	}
+	return nil
+}
+
+func TestAllShareOperationsAreAudited(t *testing.T) {
+	rootDir := newTempDir()
+	tokenStore, err := tokenstore.NewStore(5, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Could not setup TokenStore: %v", err)
+	}
+	auditor := &recordingAuditor{}
+	s := svalbardsrv.NewServer(tokenStore, inmemorysharestore.New(), filechannel.NewChannel(rootDir),
+		svalbardsrv.WithAuditor(auditor))
+	tom := userID{"FILE", "Tom"}
+	data := shareData{"Gmail key", "some share"}
+	shareID, err := shareid.GetShareID(tom.IDType, tom.ID, data.secretName)
+	if err != nil {
+		t.Fatalf("GetShareID() failed: %v", err)
+	}
+	var tests = []struct {
+		handler   http.HandlerFunc
+		request   func() *http.Request
+		operation string
+		shareID   string
+		reqID     string
+		status    int
+	}{
+		{s.GetStorageTokenHandler,
+			func() *http.Request { return newGetTokenRequest("req1", tom, data.secretName, "/get_storage_token") },
+			svalbardsrv.AuditGetStorageToken, shareID, "req1", http.StatusOK},
+		{s.StoreShareHandler,
+			func() *http.Request { return newStoreShareRequest(fetchToken(rootDir, tom.ID, "req1", t), tom, data) },
+			svalbardsrv.AuditStoreShare, shareID, "", http.StatusOK},
+		{s.GetRetrievalTokenHandler,
+			func() *http.Request { return newGetTokenRequest("req2", tom, data.secretName, "/get_retrieval_token") },
+			svalbardsrv.AuditGetRetrievalToken, shareID, "req2", http.StatusOK},
+		{s.RetrieveShareHandler,
+			func() *http.Request { return newRetrieveShareRequest("wrongtoken", tom, data.secretName) },
+			svalbardsrv.AuditRetrieveShare, shareID, "", http.StatusForbidden},
+		{s.RetrieveShareHandler,
+			func() *http.Request {
+				return newRetrieveShareRequest(fetchToken(rootDir, tom.ID, "req2", t), tom, data.secretName)
+			},
+			svalbardsrv.AuditRetrieveShare, shareID, "", http.StatusOK},
+		{s.GetDeletionTokenHandler,
+			func() *http.Request { return newGetTokenRequest("req3", tom, data.secretName, "/get_deletion_token") },
+			svalbardsrv.AuditGetDeletionToken, shareID, "req3", http.StatusOK},
+		{s.DeleteShareHandler,
+			func() *http.Request {
+				return newDeleteShareRequest(fetchToken(rootDir, tom.ID, "req3", t), tom, data.secretName)
+			},
+			svalbardsrv.AuditDeleteShare, shareID, "", http.StatusOK},
+		{s.GetStorageTokenHandler,
+			func() *http.Request {
+				return newGetTokenRequest("req4", userID{"FILE", ""}, data.secretName, "/get_storage_token")
+			},
+			svalbardsrv.AuditGetStorageToken, "", "req4", http.StatusBadRequest},
+		{s.DeleteShareHandler,
+			func() *http.Request { return httptest.NewRequest("GET", testTarget+"/delete_share", nil) },
+			svalbardsrv.AuditDeleteShare, "", "", http.StatusBadRequest},
+	}
+	for i, tt := range tests {
+		before := time.Now()
+		w := testingtools.NewFakeResponseWriter()
+		tt.handler(w, tt.request())
+		if w.Status != tt.status {
+			t.Fatalf("%s request #%d status: got [%v], want [%v] (body: %v)", tt.operation, i, w.Status, tt.status, w.Body)
+		}
+		if len(auditor.events) != i+1 {
+			t.Fatalf("%s request #%d: got %d audit events, want %d", tt.operation, i, len(auditor.events), i+1)
+		}
+		event := auditor.events[i]
+		if event.Operation != tt.operation || event.ShareID != tt.shareID || event.ReqID != tt.reqID ||
+			event.Status != tt.status || !event.ClientIP.Equal(net.ParseIP("192.0.2.1")) || event.Time.Before(before) {
+			t.Errorf("%s request #%d: got audit event %+v, want operation %s, share id %s, request id %q, status %d",
+				tt.operation, i, event, tt.operation, tt.shareID, tt.reqID, tt.status)
+		}
+	}
+}
+
+func TestRetrievalFailsIfCommitFails(t *testing.T) {
+	rootDir := newTempDir()
+	tokenStore, err := tokenstore.NewStore(5, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Could not setup TokenStore: %v", err)
+	}
+	committer := &failingCommitter{}
+	s := svalbardsrv.NewServer(tokenStore, inmemorysharestore.New(), filechannel.NewChannel(rootDir),
+		svalbardsrv.WithAuditor(committer))
+	tom := userID{"FILE", "Tom"}
+	data := shareData{"Gmail key", "some share"}
+	w := testingtools.NewFakeResponseWriter()
+	s.GetStorageTokenHandler(w, newGetTokenRequest("req1", tom, data.secretName, "/get_storage_token"))
+	w = testingtools.NewFakeResponseWriter()
+	s.StoreShareHandler(w, newStoreShareRequest(fetchToken(rootDir, tom.ID, "req1", t), tom, data))
+	if w.Status != http.StatusOK {
+		t.Fatalf("StoreShareHandler(): got status [%v], want [%v] (body: %v)", w.Status, http.StatusOK, w.Body)
+	}
+
+	w = testingtools.NewFakeResponseWriter()
+	s.GetRetrievalTokenHandler(w, newGetTokenRequest("req2", tom, data.secretName, "/get_retrieval_token"))
+	w = testingtools.NewFakeResponseWriter()
+	s.RetrieveShareHandler(w, newRetrieveShareRequest(fetchToken(rootDir, tom.ID, "req2", t), tom, data.secretName))
+	if w.Status != http.StatusInternalServerError || strings.Contains(w.Body, data.shareValue) {
+		t.Errorf("RetrieveShareHandler(): got status [%v] and body [%v], want [%v] without the share",
+			w.Status, w.Body, http.StatusInternalServerError)
+	}
+	if len(committer.commits) != 4 || committer.commits[3].Operation != svalbardsrv.AuditRetrieveShare {
+		t.Errorf("Commit(): got events %+v, want 4 ending with a retrieval", committer.commits)
+	}
+	// Events that were passed to Commit are not passed to Audit again.
+	if len(committer.events) != 0 {
+		t.Errorf("Audit(): got events %+v, want none", committer.events)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	rootDir := newTempDir()
+	tokenStore, err := tokenstore.NewStore(5, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Could not setup TokenStore: %v", err)
+	}
+	registry := metrics.NewRegistry()
+	s := svalbardsrv.NewServer(tokenStore, inmemorysharestore.New(), filechannel.NewChannel(rootDir),
+		svalbardsrv.WithMetrics(registry))
+	tom := userID{"FILE", "Tom"}
+	data := shareData{"Gmail key", "some share"}
+	var requests = []struct {
+		handler http.HandlerFunc
+		request func() *http.Request
+		status  int
+	}{
+		{s.GetStorageTokenHandler,
+			func() *http.Request { return newGetTokenRequest("req1", tom, data.secretName, "/get_storage_token") },
+			http.StatusOK},
+		{s.StoreShareHandler,
+			func() *http.Request { return newStoreShareRequest(fetchToken(rootDir, tom.ID, "req1", t), tom, data) },
+			http.StatusOK},
+		{s.GetStorageTokenHandler,
+			func() *http.Request { return newGetTokenRequest("req2", tom, data.secretName, "/get_storage_token") },
+			http.StatusForbidden},
+		{s.RetrieveShareHandler,
+			func() *http.Request { return newRetrieveShareRequest("wrongtoken", tom, data.secretName) },
+			http.StatusForbidden},
+		{s.GetStorageTokenHandler,
+			func() *http.Request {
+				return newGetTokenRequest("req3", userID{"SMS", "123"}, data.secretName, "/get_storage_token")
+			},
+			http.StatusBadRequest},
+	}
+	for i, tt := range requests {
+		w := testingtools.NewFakeResponseWriter()
+		tt.handler(w, tt.request())
+		if w.Status != tt.status {
+			t.Fatalf("request #%d status: got [%v], want [%v] (body: %v)", i, w.Status, tt.status, w.Body)
+		}
+	}
+	var buf bytes.Buffer
+	if err := registry.WriteText(&buf); err != nil {
+		t.Fatalf("WriteText() failed: %v", err)
+	}
+	for _, want := range []string{
+		`svalbard_tokens_issued_total{operation="storage",outcome="ok"} 1`,
+		`svalbard_tokens_issued_total{operation="storage",outcome="share already exists"} 1`,
+		`svalbard_tokens_issued_total{operation="storage",outcome="unsupported owner id type"} 1`,
+		`svalbard_token_verifications_total{operation="storage",outcome="ok"} 1`,
+		`svalbard_token_verifications_total{operation="retrieval",outcome="token not valid"} 1`,
+		`svalbard_channel_send_duration_seconds_count{owner_id_type="FILE"} 1`,
+		`svalbard_channel_send_duration_seconds_count{owner_id_type="unsupported"} 1`,
+		`svalbard_channel_send_failures_total{owner_id_type="unsupported"} 1`,
+		`svalbard_share_store_duration_seconds_count{operation="store"} 1`,
+		`svalbard_share_store_duration_seconds_count{operation="retrieve"} 3`,
+		"svalbard_shares 1\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics: got [%v], want them to contain [%v]", buf.String(), want)
+		}
+	}
+	if strings.Contains(buf.String(), `svalbard_channel_send_failures_total{owner_id_type="FILE"}`) {
+		t.Errorf("metrics: got [%v], want no failures of FILE channel", buf.String())
+	}
+}
+
+func TestMetricsLabelNormalizedOwnerIDTypes(t *testing.T) {
+	rootDir := newTempDir()
+	tokenStore, err := tokenstore.NewStore(5, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Could not setup TokenStore: %v", err)
+	}
+	router := channelrouter.New()
+	router.Register("FILE", filechannel.NewChannel(rootDir))
+	router.RegisterAlias("DATEI", "FILE")
+	registry := metrics.NewRegistry()
+	s := svalbardsrv.NewServer(tokenStore, inmemorysharestore.New(), router, svalbardsrv.WithMetrics(registry))
+	for i, idType := range []string{"FILE", " file ", "Datei"} {
+		user := userID{idType, "Tom"}
+		w := testingtools.NewFakeResponseWriter()
+		s.GetStorageTokenHandler(w, newGetTokenRequest(fmt.Sprintf("req%d", i), user, "Gmail key", "/get_storage_token"))
+		if w.Status != http.StatusOK {
+			t.Fatalf("GetStorageTokenHandler() for %q: got status %v, want %v (body: %v)", idType, w.Status, http.StatusOK, w.Body)
+		}
+	}
+	var buf bytes.Buffer
+	if err := registry.WriteText(&buf); err != nil {
+		t.Fatalf("WriteText() failed: %v", err)
+	}
+	if want := `svalbard_channel_send_duration_seconds_count{owner_id_type="FILE"} 3`; !strings.Contains(buf.String(), want) {
+		t.Errorf("metrics: got [%v], want them to contain [%v]", buf.String(), want)
+	}
+}
+
+// checkedShareStore and checkedChannel are dependencies whose health checks
+// fail with 'err'.
+type checkedShareStore struct {
+	*inmemorysharestore.InMemory
+	err error
+}
+
+func (s *checkedShareStore) CheckHealth() error {
+	return s.err
+}
+
+type checkedChannel struct {
+	*filechannel.Channel
+	err error
+}
+
+func (c *checkedChannel) CheckHealth() error {
+	return c.err
+}
+
+type healthCheckFunc func() error
+
+func (f healthCheckFunc) CheckHealth() error {
+	return f()
+}
+
+func TestReadyzHandler(t *testing.T) {
+	tokenStore, err := tokenstore.NewStore(5, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Could not setup TokenStore: %v", err)
+	}
+	shareStore := &checkedShareStore{InMemory: inmemorysharestore.New()}
+	channel := &checkedChannel{Channel: filechannel.NewChannel(newTempDir())}
+	var extraErr error
+	s := svalbardsrv.NewServer(tokenStore, shareStore, channel,
+		svalbardsrv.WithHealthChecker("audit_log", healthCheckFunc(func() error { return extraErr })))
+	errBroken := errors.New("broken")
+	var tests = []struct {
+		shareStoreErr, channelErr, extraErr error
+		status                              int
+		body                                string
+	}{
+		{nil, nil, nil, http.StatusOK,
+			`{"status":"ok","checks":{"audit_log":"ok","secondary_channel":"ok","share_store":"ok","token_store":"ok"}}`},
+		{errBroken, nil, nil, http.StatusServiceUnavailable,
+			`{"status":"unavailable","checks":{"audit_log":"ok","secondary_channel":"ok","share_store":"failed","token_store":"ok"}}`},
+		{nil, errBroken, nil, http.StatusServiceUnavailable,
+			`{"status":"unavailable","checks":{"audit_log":"ok","secondary_channel":"failed","share_store":"ok","token_store":"ok"}}`},
+		{nil, nil, errBroken, http.StatusServiceUnavailable,
+			`{"status":"unavailable","checks":{"audit_log":"failed","secondary_channel":"ok","share_store":"ok","token_store":"ok"}}`},
+		{nil, nil, nil, http.StatusOK,
+			`{"status":"ok","checks":{"audit_log":"ok","secondary_channel":"ok","share_store":"ok","token_store":"ok"}}`},
+	}
+	for i, tt := range tests {
+		shareStore.err, channel.err, extraErr = tt.shareStoreErr, tt.channelErr, tt.extraErr
+		w := testingtools.NewFakeResponseWriter()
+		s.ReadyzHandler(w, httptest.NewRequest("GET", testTarget+"/readyz", nil))
+		if w.Status != tt.status || w.Body != tt.body {
+			t.Errorf("readyz #%d: got [%v, %v], want [%v, %v]", i, w.Status, w.Body, tt.status, tt.body)
+		}
+	}
+	// The token store is unhealthy when it is nearly full.
+	tokenStore.SetMaxTokens(1)
+	tokenStore.GetNewToken("some share", svalbardsrv.OpStoreShare)
+	w := testingtools.NewFakeResponseWriter()
+	s.ReadyzHandler(w, httptest.NewRequest("GET", testTarget+"/readyz", nil))
+	if want := `"token_store":"failed"`; w.Status != http.StatusServiceUnavailable || !strings.Contains(w.Body, want) {
+		t.Errorf("readyz with full token store: got [%v, %v], want [%v, ...%v...]",
+			w.Status, w.Body, http.StatusServiceUnavailable, want)
+	}
+	// Liveness does not depend on the dependencies.
+	w = testingtools.NewFakeResponseWriter()
+	s.HealthzHandler(w, httptest.NewRequest("GET", testTarget+"/healthz", nil))
+	if w.Status != http.StatusOK || w.Body != "ok" {
+		t.Errorf("healthz: got [%v, %v], want [%v, ok]", w.Status, w.Body, http.StatusOK)
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	s := getTestServer(newTempDir(), t)
+	w := testingtools.NewFakeResponseWriter()
+	s.VersionHandler(w, httptest.NewRequest("GET", testTarget+"/version", nil))
+	var info struct {
+		Version   string `json:"version"`
+		GoVersion string `json:"go_version"`
+	}
+	if err := json.Unmarshal([]byte(w.Body), &info); err != nil {
+		t.Fatalf("version: could not parse response [%v]: %v", w.Body, err)
+	}
+	if w.Status != http.StatusOK || info.Version != svalbardsrv.Version || info.GoVersion != runtime.Version() {
+		t.Errorf("version: got [%v, %+v], want [%v, {%v %v}]", w.Status, info, http.StatusOK,
+			svalbardsrv.Version, runtime.Version())
+	}
+	w = testingtools.NewFakeResponseWriter()
+	s.VersionHandler(w, httptest.NewRequest("POST", testTarget+"/version", nil))
+	if w.Status != http.StatusBadRequest {
+		t.Errorf("version with POST: got [%v], want [%v]", w.Status, http.StatusBadRequest)
+	}
+}
+
+func TestLogsContainNoSecrets(t *testing.T) {
+	tom := userID{"FILE", "tom@example.com"}
+	data := shareData{"Gmail key", "top secret share value"}
+	for _, redacting := range []bool{false, true} {
+		var buf bytes.Buffer
+		logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		if redacting {
+			var err error
+			if logger, err = logging.New(&buf, logging.Config{Level: slog.LevelDebug}); err != nil {
+				t.Fatalf("Could not setup logging: %v", err)
+			}
+		}
+		rootDir := newTempDir()
+		tokenStore, err := tokenstore.NewStore(5, 5*time.Second)
+		if err != nil {
+			t.Fatalf("Could not setup TokenStore: %v", err)
+		}
+		s := svalbardsrv.NewServer(tokenStore, inmemorysharestore.New(), filechannel.NewChannel(rootDir),
+			svalbardsrv.WithLogger(logger))
+
+		var tokens []string
+		run := func(handler http.HandlerFunc, req *http.Request, status int) {
+			w := testingtools.NewFakeResponseWriter()
+			handler(w, req)
+			if w.Status != status {
+				t.Fatalf("%s status: got [%v], want [%v] (body: %v)", req.URL.Path, w.Status, status, w.Body)
+			}
+		}
+		token := func(reqID string) string {
+			token := fetchToken(rootDir, tom.ID, reqID, t)
+			tokens = append(tokens, token)
+			return token
+		}
+		run(s.GetStorageTokenHandler, newGetTokenRequest("req1", tom, data.secretName, "/get_storage_token"), http.StatusOK)
+		run(s.StoreShareHandler, newStoreShareRequest(token("req1"), tom, data), http.StatusOK)
+		run(s.GetRetrievalTokenHandler, newGetTokenRequest("req2", tom, data.secretName, "/get_retrieval_token"), http.StatusOK)
+		run(s.RetrieveShareHandler, newRetrieveShareRequest("guessedToken", tom, data.secretName), http.StatusForbidden)
+		run(s.RetrieveShareHandler, newRetrieveShareRequest(token("req2"), tom, data.secretName), http.StatusOK)
+		run(s.GetDeletionTokenHandler, newGetTokenRequest("req3", tom, data.secretName, "/get_deletion_token"), http.StatusOK)
+		run(s.DeleteShareHandler, newDeleteShareRequest(token("req3"), tom, data.secretName), http.StatusOK)
+
+		out := buf.String()
+		if !strings.Contains(out, "req1") || !strings.Contains(out, "stored share") {
+			t.Errorf("Log output lacks the operations: %s", out)
+		}
+		secrets := append(tokens, "guessedToken", data.shareValue)
+		if redacting {
+			secrets = append(secrets, tom.ID)
+		}
+		for _, secret := range secrets {
+			if strings.Contains(out, secret) {
+				t.Errorf("Log output (redacting: %v) contains secret %q: %s", redacting, secret, out)
+			}
+		}
+	}
+}
@@ -0,0 +1,402 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Binary svalbardctl inspects and maintains the Bolt share store of a
+// Svalbard server.  Usage:
+//
+//	svalbardctl <command> [flags]
+//
+// Commands:
+//
+//	stats    print the number and sizes of the shares, and a histogram of their ages
+//	export   write an encrypted dump of all shares, including the soft-deleted ones, to -output
+//	import   store the shares of an encrypted dump in -input (all or nothing)
+//	verify   check that every record decodes and matches its checksum
+//	compact  rewrite the DB file without free pages
+//	migrate  upgrade the DB to the current schema version
+//	snapshot download a snapshot of the share store of a running server
+//	restore  restore a snapshot into a new share store file
+//
+// All commands but snapshot work on the DB file offline, and refuse to run
+// while the server (or another svalbardctl) holds the lock of the file.
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/svalbard/server/go/boltsharestore"
+	"github.com/google/svalbard/server/go/sharedump"
+	"github.com/google/svalbard/server/go/shareexpiry"
+	"github.com/google/svalbard/server/go/snapshot"
+)
+
+type command struct {
+	help string
+	run  func(args []string)
+}
+
+var commands = map[string]command{
+	"stats":    {"print the number and sizes of the shares, and a histogram of their ages", stats},
+	"export":   {"write an encrypted dump of all shares", export},
+	"import":   {"store the shares of an encrypted dump, all or nothing", importDump},
+	"verify":   {"check that every record decodes and matches its checksum", verify},
+	"compact":  {"rewrite the DB file without free pages", compact},
+	"migrate":  {"upgrade the DB to the current schema version", migrate},
+	"snapshot": {"download a snapshot of the share store of a running server", downloadSnapshot},
+	"restore":  {"restore a snapshot into a new share store file", restore},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].help)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -help' for the flags of a command.\n", os.Args[0])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	cmd.run(os.Args[1:])
+}
+
+// parseFlags parses the flags of a command, including the flags common to
+// all commands, and returns the share store file and the options to open it.
+func parseFlags(fs *flag.FlagSet, args []string) (string, *boltsharestore.Options) {
+	filename := fs.String("bolt_share_store_file", "", "Bolt DB file of the share store")
+	lockTimeout := fs.Duration("lock_timeout", time.Second, "how long to wait for the lock of the DB file")
+	fs.Parse(args[1:])
+	if *filename == "" {
+		log.Fatal("Please provide -bolt_share_store_file")
+	}
+	if fs.NArg() != 0 {
+		log.Fatalf("Unexpected arguments: %v", fs.Args())
+	}
+	return *filename, &boltsharestore.Options{LockTimeout: *lockTimeout}
+}
+
+func open(filename string, options *boltsharestore.Options) *boltsharestore.Bolt {
+	store, err := boltsharestore.Open(filename, options)
+	if err != nil {
+		log.Fatalf("Could not open share store: %v", err)
+	}
+	store.SetMetadataPrefix(shareexpiry.MetadataPrefix)
+	return store
+}
+
+func readKey(keyFile string) []byte {
+	if keyFile == "" {
+		log.Fatal("Please provide -key_file")
+	}
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		log.Fatalf("Could not read key: %v", err)
+	}
+	return key
+}
+
+func stats(args []string) {
+	fs := flag.NewFlagSet(args[0], flag.ExitOnError)
+	filename, options := parseFlags(fs, args)
+	options.ReadOnly = true
+	store := open(filename, options)
+	defer store.Close()
+	st, err := store.Stats()
+	if err != nil {
+		log.Fatalf("Could not compute statistics: %v", err)
+	}
+	fmt.Printf("Schema version:  %d\n", st.SchemaVersion)
+	fmt.Printf("DB size:         %d bytes\n", st.DBBytes)
+	fmt.Printf("Shares:          %d\n", st.Shares)
+	fmt.Printf("Deleted shares:  %d\n", st.DeletedShares)
+	fmt.Printf("Expiry records:  %d\n", st.MetadataRecords)
+	fmt.Printf("Value sizes:     %d bytes in total, %d bytes largest\n", st.ValueBytes, st.LargestValue)
+	if !st.Oldest.IsZero() {
+		fmt.Printf("Oldest share:    %s\n", st.Oldest.UTC().Format(time.RFC3339))
+	}
+	fmt.Printf("Ages:\n")
+	lower := "0d"
+	for i, upper := range boltsharestore.AgeBuckets {
+		fmt.Printf("  %5s - %-5s %d\n", lower, formatDays(upper), st.AgeHistogram[i])
+		lower = formatDays(upper)
+	}
+	fmt.Printf("  %5s +       %d\n", lower, st.AgeHistogram[len(boltsharestore.AgeBuckets)])
+	fmt.Printf("  unknown       %d\n", st.UnknownAge)
+	if st.Corrupt > 0 {
+		fmt.Printf("Corrupt records: %d (run 'svalbardctl verify' for details)\n", st.Corrupt)
+	}
+}
+
+func formatDays(d time.Duration) string {
+	return fmt.Sprintf("%dd", d/(24*time.Hour))
+}
+
+func export(args []string) {
+	fs := flag.NewFlagSet(args[0], flag.ExitOnError)
+	keyFile := fs.String("key_file", "", "file with the key to encrypt the dump under")
+	output := fs.String("output", "", "file to write the dump to; must not exist yet")
+	filename, options := parseFlags(fs, args)
+	key := readKey(*keyFile)
+	if *output == "" {
+		log.Fatal("Please provide -output")
+	}
+	options.ReadOnly = true
+	store := open(filename, options)
+	defer store.Close()
+
+	file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Fatalf("Could not create dump: %v", err)
+	}
+	w, err := sharedump.NewWriter(file, key)
+	if err == nil {
+		err = store.ForEach(func(r boltsharestore.Record) error {
+			rec := sharedump.Record{ShareID: r.ShareID, Value: r.Value, OwnerKey: r.OwnerKey}
+			if !r.Created.IsZero() {
+				rec.Created = r.Created.Unix()
+			}
+			if !r.PurgeAt.IsZero() {
+				rec.PurgeAt = r.PurgeAt.Unix()
+			}
+			return w.Write(rec)
+		})
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*output)
+		log.Fatalf("Could not export shares: %v", err)
+	}
+	st, _ := os.Stat(*output)
+	fmt.Printf("OK: exported shares to %s (%d bytes)\n", *output, st.Size())
+}
+
+func importDump(args []string) {
+	fs := flag.NewFlagSet(args[0], flag.ExitOnError)
+	keyFile := fs.String("key_file", "", "file with the key the dump is encrypted under")
+	input := fs.String("input", "", "file to read the dump from")
+	filename, options := parseFlags(fs, args)
+	key := readKey(*keyFile)
+	if *input == "" {
+		log.Fatal("Please provide -input")
+	}
+	file, err := os.Open(*input)
+	if err != nil {
+		log.Fatalf("Could not open dump: %v", err)
+	}
+	defer file.Close()
+	r, err := sharedump.NewReader(file, key)
+	if err != nil {
+		log.Fatalf("Could not read dump: %v", err)
+	}
+	// The whole dump is read and authenticated before anything is stored.
+	var records []boltsharestore.Record
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("Could not read dump: %v", err)
+		}
+		record := boltsharestore.Record{ShareID: rec.ShareID, Value: rec.Value, OwnerKey: rec.OwnerKey}
+		if rec.Created != 0 {
+			record.Created = time.Unix(rec.Created, 0)
+		}
+		if rec.PurgeAt != 0 {
+			record.PurgeAt = time.Unix(rec.PurgeAt, 0)
+		}
+		records = append(records, record)
+	}
+
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		store, err := boltsharestore.OpenOrCreate(filename)
+		if err != nil {
+			log.Fatalf("Could not create share store: %v", err)
+		}
+		store.Close()
+	}
+	store := open(filename, options)
+	defer store.Close()
+	if err := store.Import(records); err != nil {
+		log.Fatalf("Import failed, no shares were stored: %v", err)
+	}
+	fmt.Printf("OK: imported %d records\n", len(records))
+}
+
+func verify(args []string) {
+	fs := flag.NewFlagSet(args[0], flag.ExitOnError)
+	filename, options := parseFlags(fs, args)
+	options.ReadOnly = true
+	store := open(filename, options)
+	defer store.Close()
+	n, problems, err := store.Verify()
+	if err != nil {
+		log.Fatalf("Could not verify share store: %v", err)
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		store.Close()
+		log.Fatalf("Verification failed: %d problems in the records of %d shares", len(problems), n)
+	}
+	fmt.Printf("OK: %d shares\n", n)
+}
+
+func compact(args []string) {
+	fs := flag.NewFlagSet(args[0], flag.ExitOnError)
+	filename, options := parseFlags(fs, args)
+	before, after, err := boltsharestore.Compact(filename, options)
+	if err != nil {
+		log.Fatalf("Could not compact share store: %v", err)
+	}
+	fmt.Printf("OK: compacted from %d to %d bytes\n", before, after)
+}
+
+func migrate(args []string) {
+	fs := flag.NewFlagSet(args[0], flag.ExitOnError)
+	filename, options := parseFlags(fs, args)
+	from, err := boltsharestore.Migrate(filename, options)
+	if err != nil {
+		log.Fatalf("Could not migrate share store: %v", err)
+	}
+	if from == boltsharestore.SchemaVersion {
+		fmt.Printf("OK: already at schema version %d\n", from)
+		return
+	}
+	fmt.Printf("OK: migrated from schema version %d to %d\n", from, boltsharestore.SchemaVersion)
+}
+
+func downloadSnapshot(args []string) {
+	fs := flag.NewFlagSet(args[0], flag.ExitOnError)
+	apiURL := fs.String("admin_api_url", "", "URL of the admin API of the server, e.g. https://svalbard.example.com:9443")
+	certFile := fs.String("tls_cert_file", "", "file with the client certificate of the operator")
+	keyFile := fs.String("tls_key_file", "", "file with the private key of the client certificate")
+	caFile := fs.String("ca_file", "", "file with the PEM-encoded certificates of the CAs of the admin API; empty uses the system CAs")
+	output := fs.String("output", "", "file to write the snapshot to; must not exist yet")
+	fs.Parse(args[1:])
+	if *apiURL == "" || *certFile == "" || *keyFile == "" || *output == "" {
+		log.Fatal("Please provide -admin_api_url, -tls_cert_file, -tls_key_file and -output")
+	}
+	cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+	if err != nil {
+		log.Fatalf("Could not load client certificate: %v", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if *caFile != "" {
+		pemBytes, err := ioutil.ReadFile(*caFile)
+		if err != nil {
+			log.Fatalf("Could not read CA certificates: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pemBytes) {
+			log.Fatalf("No CA certificates found in %s", *caFile)
+		}
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	resp, err := client.Get(strings.TrimSuffix(*apiURL, "/") + "/snapshot")
+	if err != nil {
+		log.Fatalf("Could not request snapshot: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		log.Fatalf("Could not get snapshot: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Fatalf("Could not create snapshot file: %v", err)
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(file, h), resp.Body)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*output)
+		log.Fatalf("Could not download snapshot: %v", err)
+	}
+	fmt.Printf("OK: wrote snapshot to %s (%d bytes, sha256 %x)\n", *output, n, h.Sum(nil))
+}
+
+func restore(args []string) {
+	fs := flag.NewFlagSet(args[0], flag.ExitOnError)
+	input := fs.String("snapshot", "", "file with the snapshot to restore")
+	privateKeyFile := fs.String("private_key_file", "", "file with the PEM-encoded RSA private key, if the snapshot is encrypted")
+	filename := fs.String("bolt_share_store_file", "", "Bolt DB file to restore the share store to; must not exist yet")
+	fs.Parse(args[1:])
+	if *input == "" || *filename == "" {
+		log.Fatal("Please provide -snapshot and -bolt_share_store_file")
+	}
+	var privateKey *rsa.PrivateKey
+	if *privateKeyFile != "" {
+		pemBytes, err := ioutil.ReadFile(*privateKeyFile)
+		if err != nil {
+			log.Fatalf("Could not read private key: %v", err)
+		}
+		if privateKey, err = snapshot.ParsePrivateKey(pemBytes); err != nil {
+			log.Fatalf("Could not parse private key: %v", err)
+		}
+	}
+	file, err := os.Open(*input)
+	if err != nil {
+		log.Fatalf("Could not open snapshot: %v", err)
+	}
+	defer file.Close()
+	manifest, err := snapshot.Restore(file, privateKey, *filename)
+	if err != nil {
+		log.Fatalf("Could not restore snapshot: %v", err)
+	}
+	fmt.Printf("OK: restored %d shares from snapshot of %s (transaction %d, server version %s)\n",
+		manifest.Shares, manifest.Created.Format(time.RFC3339), manifest.TxID, manifest.ServerVersion)
+}
@@ -18,7 +18,18 @@
 package testingtools
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
+	"time"
 )
 
 // FakeResponseWriter implements http.ResponseWriter interface.
@@ -58,3 +69,74 @@ func (r *FakeResponseWriter) WriteHeader(status int) {
 	r.statusSet = true
 	r.Status = status
 }
+
+// TestCertificate is an X.509 certificate together with its private key.
+type TestCertificate struct {
+	Cert    *x509.Certificate
+	Key     *ecdsa.PrivateKey
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// NewTestCertificate returns a new certificate for 'subject', valid for
+// "localhost" and 127.0.0.1 for both servers and clients, and signed by
+// 'issuer'.  If 'issuer' is nil, the certificate is self-signed, and can
+// be used as the issuer of other certificates.
+func NewTestCertificate(subject pkix.Name, issuer *TestCertificate) (*TestCertificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	parent, parentKey := template, key
+	if issuer == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		parent, parentKey = issuer.Cert, issuer.Key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &TestCertificate{
+		Cert:    cert,
+		Key:     key,
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
+
+// TLSCertificate returns the certificate as a tls.Certificate.
+func (c *TestCertificate) TLSCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.Cert.Raw}, PrivateKey: c.Key, Leaf: c.Cert}
+}
+
+// WriteFiles writes the PEM-encoded certificate and key to the given files.
+func (c *TestCertificate) WriteFiles(certFile, keyFile string) error {
+	if err := ioutil.WriteFile(certFile, c.CertPEM, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyFile, c.KeyPEM, 0600)
+}
@@ -39,20 +39,38 @@ func NewStore(tokenLength int, tokenValidityDuration time.Duration) (*Store, err
 	return &Store{
 		tokenLength:           tokenLength,
 		tokenValidityDuration: tokenValidityDuration,
+		maxTokens:             DefaultMaxTokens,
 		store:                 make(map[string]tokenData),
+		now:                   time.Now,
 	}, nil
 }
 
+// SetMaxTokens sets the maximal number of valid tokens in the store to 'n'
+// (DefaultMaxTokens by default).  When the store is full, no new tokens are
+// issued until some tokens expire.
+func (ts *Store) SetMaxTokens(n int) {
+	ts.storeMutex.Lock()
+	defer ts.storeMutex.Unlock()
+	ts.maxTokens = n
+}
+
 // Bounds on parameters used when creating Store-instances.
 const (
 	MinTokenLength           = 5
 	MinTokenValidityDuration = 2 * time.Second
+	DefaultMaxTokens         = 100000
 )
 
+// HealthyFillRatio is the fraction of the capacity of a Store beyond which
+// the store reports itself as unhealthy.
+const HealthyFillRatio = 0.9
+
 // Errors returned upon failures when creating a Store.
 var (
 	ErrTokenValidityDurationTooShort = errors.New("tokenValidityDuration too short")
 	ErrTokenLengthTooSmall           = errors.New("tokenLength too small")
+	ErrStoreFull                     = errors.New("token store full")
+	ErrStoreNearlyFull               = errors.New("token store nearly full")
 )
 
 // A Store implementation that uses an in-memory map to store the tokens.
@@ -60,9 +78,11 @@ type Store struct {
 	// General properties of the store.
 	tokenLength           int
 	tokenValidityDuration time.Duration
+	maxTokens             int
 	// Internal data structure that holds the tokens and the corresponding data.
 	store      map[string]tokenData
 	storeMutex sync.RWMutex
+	now        func() time.Time
 }
 
 // Data associated with each token.
@@ -75,7 +95,7 @@ type tokenData struct {
 // GetNewToken returns a new access token valid for the operation 'op' on the share
 // identified by 'shareID'.
 func (ts *Store) GetNewToken(shareID string, op svalbardsrv.Operation) (string, error) {
-	validTill := time.Now().Add(ts.tokenValidityDuration)
+	validTill := ts.now().Add(ts.tokenValidityDuration)
 	tokenData := tokenData{validTill, shareID, op}
 	newToken, err := util.RandomString(ts.tokenLength)
 	if err != nil {
@@ -83,6 +103,12 @@ func (ts *Store) GetNewToken(shareID string, op svalbardsrv.Operation) (string,
 	}
 	ts.storeMutex.Lock()
 	defer ts.storeMutex.Unlock()
+	if len(ts.store) >= ts.maxTokens {
+		ts.pruneExpired()
+		if len(ts.store) >= ts.maxTokens {
+			return "", ErrStoreFull
+		}
+	}
 	ts.store[newToken] = tokenData
 	return newToken, nil
 }
@@ -99,7 +125,7 @@ func (ts *Store) IsTokenValidNow(token, shareID string, op svalbardsrv.Operation
 	if !ok {
 		return svalbardsrv.ErrTokenNotFound
 	}
-	if tokenData.validTill.Before(time.Now()) {
+	if tokenData.validTill.Before(ts.now()) {
 		return svalbardsrv.ErrTokenExpired
 	}
 	if (tokenData.shareID != shareID) || (tokenData.op != op) {
@@ -107,3 +133,61 @@ func (ts *Store) IsTokenValidNow(token, shareID string, op svalbardsrv.Operation
 	}
 	return nil
 }
+
+// RevokeToken invalidates the given token, so that it cannot be used
+// for any operation.
+func (ts *Store) RevokeToken(token string) error {
+	ts.storeMutex.Lock()
+	defer ts.storeMutex.Unlock()
+	if _, ok := ts.store[token]; !ok {
+		return svalbardsrv.ErrTokenNotFound
+	}
+	delete(ts.store, token)
+	return nil
+}
+
+// RevokeShareTokens invalidates all tokens for the share identified by
+// 'shareID', and returns the number of revoked tokens.
+func (ts *Store) RevokeShareTokens(shareID string) int {
+	ts.storeMutex.Lock()
+	defer ts.storeMutex.Unlock()
+	n := 0
+	for token, tokenData := range ts.store {
+		if tokenData.shareID == shareID {
+			delete(ts.store, token)
+			n++
+		}
+	}
+	return n
+}
+
+// Count returns the number of valid tokens in the store.
+func (ts *Store) Count() int {
+	ts.storeMutex.Lock()
+	defer ts.storeMutex.Unlock()
+	ts.pruneExpired()
+	return len(ts.store)
+}
+
+// CheckHealth returns ErrStoreNearlyFull if the valid tokens fill more than
+// HealthyFillRatio of the capacity of the store, and nil otherwise.
+func (ts *Store) CheckHealth() error {
+	ts.storeMutex.Lock()
+	defer ts.storeMutex.Unlock()
+	ts.pruneExpired()
+	if float64(len(ts.store)) > HealthyFillRatio*float64(ts.maxTokens) {
+		return ErrStoreNearlyFull
+	}
+	return nil
+}
+
+// pruneExpired removes the expired tokens from the store.
+// The caller must hold storeMutex.
+func (ts *Store) pruneExpired() {
+	now := ts.now()
+	for token, tokenData := range ts.store {
+		if tokenData.validTill.Before(now) {
+			delete(ts.store, token)
+		}
+	}
+}
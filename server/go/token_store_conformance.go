@@ -0,0 +1,227 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Package tokenstoretest offers a test suite that checks the behaviour
+// common to all TokenStore implementations.
+package tokenstoretest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+// canonicalErrors are the errors that TokenStores return for tokens that
+// are not valid.
+var canonicalErrors = []error{
+	svalbardsrv.ErrTokenNotFound,
+	svalbardsrv.ErrTokenExpired,
+	svalbardsrv.ErrTokenNotValid,
+}
+
+// Factory creates the TokenStores under test.
+type Factory struct {
+	// New returns an empty TokenStore that issues tokens valid for
+	// Validity, and takes the current time from 'now'.
+	New func(t *testing.T, now func() time.Time) svalbardsrv.TokenStore
+	// Validity is the validity period of the tokens, at least 2 seconds.
+	Validity time.Duration
+}
+
+// clock is a fake clock for the TokenStores under test.
+type clock struct {
+	mutex sync.Mutex
+	time  time.Time
+}
+
+func (c *clock) now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.time
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.time = c.time.Add(d)
+}
+
+// Run runs the test suite on the TokenStores created by 'factory', which
+// creates a new store for each test.
+func Run(t *testing.T, factory Factory) {
+	for _, test := range []struct {
+		name string
+		run  func(t *testing.T, f Factory, ts svalbardsrv.TokenStore, c *clock)
+	}{
+		{"TokensAreBound", testTokensAreBound},
+		{"Expiration", testExpiration},
+		{"RevokeToken", testRevokeToken},
+		{"UniqueTokens", testUniqueTokens},
+		{"UnicodeShareIDs", testUnicodeShareIDs},
+		{"ConcurrentOperations", testConcurrentOperations},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			c := &clock{time: time.Unix(1500000000, 0)}
+			test.run(t, factory, factory.New(t, c.now), c)
+		})
+	}
+}
+
+// newToken returns a new token, and fails the test upon errors.
+func newToken(t *testing.T, ts svalbardsrv.TokenStore, shareID string, op svalbardsrv.Operation) string {
+	token, err := ts.GetNewToken(shareID, op)
+	if err != nil {
+		t.Fatalf("GetNewToken(%q, %v): unexpected error: %v", shareID, op, err)
+	}
+	return token
+}
+
+// checkInvalid reports tokens that are valid, or invalid with an error that
+// is not canonical.
+func checkInvalid(t *testing.T, ts svalbardsrv.TokenStore, token, shareID string, op svalbardsrv.Operation) {
+	err := ts.IsTokenValidNow(token, shareID, op)
+	for _, canonical := range canonicalErrors {
+		if err == canonical {
+			return
+		}
+	}
+	t.Errorf("IsTokenValidNow(%q, %q, %v): got [%v], want a canonical error", token, shareID, op, err)
+}
+
+func testTokensAreBound(t *testing.T, f Factory, ts svalbardsrv.TokenStore, c *clock) {
+	shareIDs := []string{"some share ID", "other share ID"}
+	ops := []svalbardsrv.Operation{svalbardsrv.OpStoreShare, svalbardsrv.OpRetrieveShare, svalbardsrv.OpDeleteShare}
+	tokens := make(map[string]string)
+	for _, shareID := range shareIDs {
+		for _, op := range ops {
+			tokens[fmt.Sprint(shareID, op)] = newToken(t, ts, shareID, op)
+		}
+	}
+	// Each token is valid only for its share and operation.
+	for _, shareID := range shareIDs {
+		for _, op := range ops {
+			token := tokens[fmt.Sprint(shareID, op)]
+			for _, otherShareID := range shareIDs {
+				for _, otherOp := range ops {
+					if otherShareID == shareID && otherOp == op {
+						if err := ts.IsTokenValidNow(token, shareID, op); err != nil {
+							t.Errorf("IsTokenValidNow(%q, %q, %v): got [%v], want [nil]", token, shareID, op, err)
+						}
+						continue
+					}
+					checkInvalid(t, ts, token, otherShareID, otherOp)
+				}
+			}
+			// Modified tokens are not valid.
+			for _, modified := range []string{"", token + "x", token[:len(token)-1], token[1:] + token[:1]} {
+				if modified != token {
+					checkInvalid(t, ts, modified, shareID, op)
+				}
+			}
+		}
+	}
+}
+
+func testExpiration(t *testing.T, f Factory, ts svalbardsrv.TokenStore, c *clock) {
+	shareID, op := "some share ID", svalbardsrv.OpRetrieveShare
+	token := newToken(t, ts, shareID, op)
+	c.advance(f.Validity - time.Second)
+	if err := ts.IsTokenValidNow(token, shareID, op); err != nil {
+		t.Errorf("IsTokenValidNow() before expiration: got [%v], want [nil]", err)
+	}
+	later := newToken(t, ts, shareID, op)
+	c.advance(2 * time.Second)
+	if err := ts.IsTokenValidNow(token, shareID, op); err != svalbardsrv.ErrTokenExpired && err != svalbardsrv.ErrTokenNotFound {
+		t.Errorf("IsTokenValidNow() after expiration: got [%v], want [%v] or [%v]",
+			err, svalbardsrv.ErrTokenExpired, svalbardsrv.ErrTokenNotFound)
+	}
+	if err := ts.IsTokenValidNow(later, shareID, op); err != nil {
+		t.Errorf("IsTokenValidNow() of later token: got [%v], want [nil]", err)
+	}
+}
+
+func testRevokeToken(t *testing.T, f Factory, ts svalbardsrv.TokenStore, c *clock) {
+	shareID, op := "some share ID", svalbardsrv.OpStoreShare
+	token1 := newToken(t, ts, shareID, op)
+	token2 := newToken(t, ts, shareID, op)
+	if err := ts.RevokeToken(token1); err != nil {
+		t.Errorf("RevokeToken(%q): got [%v], want [nil]", token1, err)
+	}
+	if err := ts.IsTokenValidNow(token1, shareID, op); err != svalbardsrv.ErrTokenNotFound {
+		t.Errorf("IsTokenValidNow() of revoked token: got [%v], want [%v]", err, svalbardsrv.ErrTokenNotFound)
+	}
+	if err := ts.IsTokenValidNow(token2, shareID, op); err != nil {
+		t.Errorf("IsTokenValidNow() of other token: got [%v], want [nil]", err)
+	}
+	if err := ts.RevokeToken(token1); err != svalbardsrv.ErrTokenNotFound {
+		t.Errorf("RevokeToken(%q) again: got [%v], want [%v]", token1, err, svalbardsrv.ErrTokenNotFound)
+	}
+	if err := ts.RevokeToken("unknown token"); err != svalbardsrv.ErrTokenNotFound {
+		t.Errorf("RevokeToken() of unknown token: got [%v], want [%v]", err, svalbardsrv.ErrTokenNotFound)
+	}
+}
+
+func testUniqueTokens(t *testing.T, f Factory, ts svalbardsrv.TokenStore, c *clock) {
+	tokens := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		token := newToken(t, ts, "some share ID", svalbardsrv.OpRetrieveShare)
+		if tokens[token] {
+			t.Fatalf("GetNewToken() #%d: got token %q again", i, token)
+		}
+		tokens[token] = true
+	}
+}
+
+func testUnicodeShareIDs(t *testing.T, f Factory, ts svalbardsrv.TokenStore, c *clock) {
+	precomposed, decomposed := "share-\u00e9", "share-e\u0301"
+	token := newToken(t, ts, precomposed, svalbardsrv.OpDeleteShare)
+	if err := ts.IsTokenValidNow(token, precomposed, svalbardsrv.OpDeleteShare); err != nil {
+		t.Errorf("IsTokenValidNow(%q): got [%v], want [nil]", precomposed, err)
+	}
+	checkInvalid(t, ts, token, decomposed, svalbardsrv.OpDeleteShare)
+}
+
+func testConcurrentOperations(t *testing.T, f Factory, ts svalbardsrv.TokenStore, c *clock) {
+	const workers, tokens = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			shareID := fmt.Sprintf("share%d", w)
+			for i := 0; i < tokens; i++ {
+				token, err := ts.GetNewToken(shareID, svalbardsrv.OpRetrieveShare)
+				if err != nil {
+					t.Errorf("GetNewToken(%q): got [%v], want [nil]", shareID, err)
+					return
+				}
+				if err := ts.IsTokenValidNow(token, shareID, svalbardsrv.OpRetrieveShare); err != nil {
+					t.Errorf("IsTokenValidNow(%q, %q): got [%v], want [nil]", token, shareID, err)
+				}
+				if i%2 == 0 {
+					if err := ts.RevokeToken(token); err != nil {
+						t.Errorf("RevokeToken(%q): got [%v], want [nil]", token, err)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
@@ -21,9 +21,23 @@ import (
 	"time"
 
 	"github.com/google/svalbard/server/go/svalbardsrv"
+	"github.com/google/svalbard/server/go/tokenstoretest"
 )
 
-// TODO: Add TSAN tests.
+func TestTokenStore(t *testing.T) {
+	validity := 5 * time.Second
+	tokenstoretest.Run(t, tokenstoretest.Factory{
+		New: func(t *testing.T, now func() time.Time) svalbardsrv.TokenStore {
+			ts, err := NewStore(7, validity)
+			if err != nil {
+				t.Fatalf("NewStore: %v", err)
+			}
+			ts.now = now
+			return ts
+		},
+		Validity: validity,
+	})
+}
 
 func TestNewStore(t *testing.T) {
 	exampleDuration := 5 * time.Second
@@ -59,73 +73,77 @@ func TestNewStore(t *testing.T) {
 	}
 }
 
-func TestTokenCreationAndExpiration(t *testing.T) {
-	shareID1 := "some share ID"
-	shareID2 := "other share ID"
-	op1 := svalbardsrv.OpRetrieveShare
-	op2 := svalbardsrv.OpDeleteShare
-
-	for i := 5; i < 8; i++ {
-		ts, err := NewStore(i, 5*time.Second)
-		if ts == nil {
-			t.Fatalf("NewStore: %v", err)
-		}
-		token1, err := ts.GetNewToken(shareID1, op1)
-		if err != nil {
+func TestRevokeShareTokensAndCount(t *testing.T) {
+	ts, err := NewStore(7, 5*time.Second)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	for _, shareID := range []string{"share1", "share1", "share2"} {
+		if _, err := ts.GetNewToken(shareID, svalbardsrv.OpRetrieveShare); err != nil {
 			t.Fatal(err)
 		}
-		token2, err := ts.GetNewToken(shareID2, op2)
-		if err != nil {
-			t.Fatal(err)
+	}
+	if got := ts.Count(); got != 3 {
+		t.Errorf("Count(): got [%v], want [3]", got)
+	}
+	var tests = []struct {
+		shareID string
+		revoked int
+		count   int
+	}{
+		{"share1", 2, 1},
+		{"share1", 0, 1},
+		{"share3", 0, 1},
+		{"share2", 1, 0},
+	}
+	for _, tt := range tests {
+		if got := ts.RevokeShareTokens(tt.shareID); got != tt.revoked {
+			t.Errorf("RevokeShareTokens(%q): got [%v], want [%v]", tt.shareID, got, tt.revoked)
 		}
-		var invalidTokenParametersTests = []struct {
-			token   string
-			shareID string
-			op      svalbardsrv.Operation
-		}{
-			// Check variations on token1.
-			{token1, shareID2, op1},
-			{token1, shareID1, op2},
-			{token1 + "extra", shareID1, op1},
-			{token1[:len(token1)-1], shareID1, op1},
-			// Check variations on token2.
-			{token2, shareID1, op2},
-			{token2, shareID2, op1},
-			{token2 + "extra", shareID2, op2},
-			{token2[:len(token2)-1], shareID2, op2},
-		}
-		for i, tt := range invalidTokenParametersTests {
-			if err := ts.IsTokenValidNow(tt.token, tt.shareID, tt.op); err == nil {
-				t.Errorf("test case #%v: token %v should not be valid for %v, %v",
-					i, tt.token, tt.shareID, tt.op)
-			}
-
+		if got := ts.Count(); got != tt.count {
+			t.Errorf("Count() after RevokeShareTokens(%q): got [%v], want [%v]", tt.shareID, got, tt.count)
 		}
+	}
+}
 
-		var tokenExpirationTests = []struct {
-			token   string
-			shareID string
-			op      svalbardsrv.Operation
-		}{
-			{token1, shareID1, op1},
-			{token2, shareID2, op2},
+func TestCapacityAndHealth(t *testing.T) {
+	ts, err := NewStore(7, 5*time.Second)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	ts.SetMaxTokens(10)
+	shareID := "some share ID"
+	op := svalbardsrv.OpStoreShare
+	var tokens []string
+	for i := 1; i <= 10; i++ {
+		token, err := ts.GetNewToken(shareID, op)
+		if err != nil {
+			t.Fatalf("GetNewToken() #%d: unexpected error: %v", i, err)
 		}
-		// Check tokens before and after timeout.
-		for j := 0; j < 4; j++ {
-			time.Sleep(time.Second)
-			for _, tt := range tokenExpirationTests {
-				if err := ts.IsTokenValidNow(tt.token, tt.shareID, tt.op); err != nil {
-					t.Errorf("Token %v should be valid for %v, %v; unexpected error: %v",
-						tt.token, tt.shareID, tt.op, err)
-				}
-			}
+		tokens = append(tokens, token)
+		wantHealth := error(nil)
+		if i > 9 {
+			wantHealth = ErrStoreNearlyFull
 		}
-		time.Sleep(time.Second)
-		for _, tt := range tokenExpirationTests {
-			if err := ts.IsTokenValidNow(tt.token, tt.shareID, tt.op); err != svalbardsrv.ErrTokenExpired {
-				t.Errorf("Token %v for %v, %v should be now expired; unexpected error %v",
-					tt.token, tt.shareID, tt.op, err)
-			}
+		if err := ts.CheckHealth(); err != wantHealth {
+			t.Errorf("CheckHealth() with %d tokens: got [%v], want [%v]", i, err, wantHealth)
 		}
 	}
+	if _, err := ts.GetNewToken(shareID, op); err != ErrStoreFull {
+		t.Errorf("GetNewToken() in full store: got [%v], want [%v]", err, ErrStoreFull)
+	}
+	// Expired tokens make room for new ones.
+	ts.storeMutex.Lock()
+	for _, token := range tokens[:5] {
+		data := ts.store[token]
+		data.validTill = time.Now().Add(-time.Second)
+		ts.store[token] = data
+	}
+	ts.storeMutex.Unlock()
+	if err := ts.CheckHealth(); err != nil {
+		t.Errorf("CheckHealth() after expiration: got [%v], want [nil]", err)
+	}
+	if _, err := ts.GetNewToken(shareID, op); err != nil {
+		t.Errorf("GetNewToken() after expiration: got [%v], want [nil]", err)
+	}
 }
@@ -0,0 +1,674 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Package translog implements a public transparency log of the operations
+// on shares, as a Merkle tree following RFC 6962.  Each leaf of the tree is
+// an Entry, which records a successful operation on a share identified by its
+// share id (as derived by shareid.GetShareID).  The log publishes signed tree
+// heads, and inclusion and consistency proofs, so that the owners of shares
+// can monitor the operations on their shares, and verify that the log does
+// not hide any of them.
+package translog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+// Errors returned upon failures.
+var (
+	ErrInvalidKey            = errors.New("invalid key")
+	ErrInvalidEntry          = errors.New("invalid log entry")
+	ErrInvalidTreeSize       = errors.New("invalid tree size")
+	ErrInvalidLeafIndex      = errors.New("invalid leaf index")
+	ErrInvalidShareID        = errors.New("invalid share id")
+	ErrInvalidSignature      = errors.New("invalid tree head signature")
+	ErrInvalidProof          = errors.New("invalid proof")
+	ErrTreeHeadsInconsistent = errors.New("tree heads are inconsistent")
+)
+
+// Entry records a successful operation on a share.
+type Entry struct {
+	Time      int64  `json:"time"` // Unix time in seconds
+	ShareID   string `json:"share_id"`
+	Operation string `json:"operation"` // one of the svalbardsrv.Audit* operations
+}
+
+// SignedTreeHead is a tree head signed by the log.
+type SignedTreeHead struct {
+	TreeSize  uint64 `json:"tree_size"`
+	Timestamp int64  `json:"timestamp"` // Unix time in milliseconds
+	RootHash  []byte `json:"sha256_root_hash"`
+	Signature []byte `json:"tree_head_signature"` // ASN.1-encoded ECDSA P-256 signature
+}
+
+// signedData returns the data covered by the signature of the tree head.
+func (sth *SignedTreeHead) signedData() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("svalbard-tree-head-v1\x00")
+	binary.Write(&buf, binary.BigEndian, sth.TreeSize)
+	binary.Write(&buf, binary.BigEndian, sth.Timestamp)
+	buf.Write(sth.RootHash)
+	return buf.Bytes()
+}
+
+// ecdsaSignature is the ASN.1 structure of ECDSA signatures.
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// Verify returns nil if 'sth' is signed with 'publicKey'.
+func (sth *SignedTreeHead) Verify(publicKey *ecdsa.PublicKey) error {
+	var sig ecdsaSignature
+	if rest, err := asn1.Unmarshal(sth.Signature, &sig); err != nil || len(rest) != 0 {
+		return ErrInvalidSignature
+	}
+	if sig.R == nil || sig.S == nil || sig.R.Sign() <= 0 || sig.S.Sign() <= 0 {
+		return ErrInvalidSignature
+	}
+	digest := sha256.Sum256(sth.signedData())
+	if !ecdsa.Verify(publicKey, digest[:], sig.R, sig.S) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// LeafHash returns the hash of the leaf with the given data.
+func LeafHash(leafInput []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(leafInput)
+	return h.Sum(nil)
+}
+
+// TreeHash returns the Merkle tree hash of the tree with leaves of the given
+// hashes, as defined in RFC 6962, section 2.1.
+func TreeHash(leafHashes [][]byte) []byte {
+	switch n := uint64(len(leafHashes)); n {
+	case 0:
+		h := sha256.Sum256(nil)
+		return h[:]
+	case 1:
+		return leafHashes[0]
+	default:
+		k := splitPoint(n)
+		return nodeHash(TreeHash(leafHashes[:k]), TreeHash(leafHashes[k:]))
+	}
+}
+
+// nodeHash returns the hash of the inner node with the given children.
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// ParsePrivateKey parses a PEM-encoded ECDSA P-256 private key.
+func ParsePrivateKey(pemBytes []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "EC PRIVATE KEY" {
+		return nil, ErrInvalidKey
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil || key.Curve != elliptic.P256() {
+		return nil, ErrInvalidKey
+	}
+	return key, nil
+}
+
+// ParsePublicKey parses a PEM-encoded ECDSA P-256 public key.
+func ParsePublicKey(pemBytes []byte) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, ErrInvalidKey
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	publicKey, ok := key.(*ecdsa.PublicKey)
+	if !ok || publicKey.Curve != elliptic.P256() {
+		return nil, ErrInvalidKey
+	}
+	return publicKey, nil
+}
+
+// Log is a transparency log that keeps its entries in a file, one JSON-encoded
+// entry per line, and the Merkle tree in memory.  It implements
+// svalbardsrv.Auditor, appending an entry for each successful operation.
+type Log struct {
+	key *ecdsa.PrivateKey
+	now func() time.Time
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64 // the size of the complete entries in the file
+	// levels[0] are the hashes of the leaves, levels[k][i] is the hash of the
+	// complete subtree with the leaves from i*2^k to (i+1)*2^k-1.
+	levels  [][][]byte
+	inputs  [][]byte            // the leaf inputs
+	byShare map[string][]uint64 // indices of the leaves of each share
+	sth     *SignedTreeHead     // the latest signed tree head
+}
+
+// Open opens the log stored in 'filename', creating the file if necessary.
+// The tree heads are signed with 'key'.  A partial last entry, left by a write
+// that did not complete, is removed from the file: it was never added to the
+// tree, so no signed tree head covers it.
+func Open(filename string, key *ecdsa.PrivateKey) (*Log, error) {
+	if key == nil || key.Curve != elliptic.P256() {
+		return nil, ErrInvalidKey
+	}
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{key: key, now: time.Now, file: file, byShare: make(map[string][]uint64)}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err == io.EOF {
+			slog.Warn("removing partial last entry of transparency log", "file", filename, "size", len(line))
+			if err := file.Truncate(l.size); err != nil {
+				file.Close()
+				return nil, err
+			}
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			file.Close()
+			return nil, ErrInvalidEntry
+		}
+		l.addLeaf(entry.ShareID, line)
+		l.size += int64(len(line)) + 1
+	}
+	return l, nil
+}
+
+// Close closes the log.
+func (l *Log) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.file.Close()
+}
+
+// addLeaf adds a leaf with the given input to the tree.
+// The caller must hold the mutex (or own the log exclusively).
+func (l *Log) addLeaf(shareID string, leafInput []byte) {
+	index := uint64(len(l.inputs))
+	l.inputs = append(l.inputs, leafInput)
+	l.byShare[shareID] = append(l.byShare[shareID], index)
+	h := LeafHash(leafInput)
+	for level := 0; ; level++ {
+		if level == len(l.levels) {
+			l.levels = append(l.levels, nil)
+		}
+		l.levels[level] = append(l.levels[level], h)
+		n := len(l.levels[level])
+		if n%2 == 1 {
+			return
+		}
+		h = nodeHash(l.levels[level][n-2], l.levels[level][n-1])
+	}
+}
+
+// Append appends 'entry' to the log.
+func (l *Log) Append(entry Entry) error {
+	if _, err := hex.DecodeString(entry.ShareID); err != nil || len(entry.ShareID) != 2*sha256.Size {
+		return ErrInvalidShareID
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	// The entry must be on disk before a signed tree head can cover it.
+	// After a failure, the file is cut back to the complete entries.
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		l.file.Truncate(l.size)
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		l.file.Truncate(l.size)
+		return err
+	}
+	l.addLeaf(entry.ShareID, line)
+	l.size += int64(len(line)) + 1
+	return nil
+}
+
+// Commit appends an entry for 'event' like Audit.  As Log implements
+// svalbardsrv.CommittingAuditor, a server responds to a successful request
+// only after its entry has been appended, and fails the request otherwise.
+func (l *Log) Commit(event svalbardsrv.AuditEvent) error {
+	return l.Audit(event)
+}
+
+// Audit appends an entry for 'event' to the log, if it records a successful
+// operation on a share.
+func (l *Log) Audit(event svalbardsrv.AuditEvent) error {
+	if event.ShareID == "" || event.Status != http.StatusOK {
+		return nil
+	}
+	return l.Append(Entry{Time: event.Time.Unix(), ShareID: event.ShareID, Operation: event.Operation})
+}
+
+// Size returns the number of entries in the log.
+func (l *Log) Size() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return uint64(len(l.inputs))
+}
+
+// splitPoint returns the largest power of 2 smaller than n (for n > 1).
+func splitPoint(n uint64) uint64 {
+	k := uint64(1)
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// subtreeHash returns the Merkle tree hash of the leaves start to end-1.
+// The caller must hold the mutex.
+func (l *Log) subtreeHash(start, end uint64) []byte {
+	n := end - start
+	if n == 0 {
+		h := sha256.Sum256(nil)
+		return h[:]
+	}
+	// Complete, aligned subtrees are stored in the levels.
+	if n&(n-1) == 0 && start%n == 0 {
+		level := 0
+		for m := n; m > 1; m >>= 1 {
+			level++
+		}
+		return l.levels[level][start/n]
+	}
+	k := splitPoint(n)
+	return nodeHash(l.subtreeHash(start, start+k), l.subtreeHash(start+k, end))
+}
+
+// inclusionPath returns the audit path of leaf m in the tree of leaves
+// start to end-1, as defined in RFC 6962, section 2.1.1.
+// The caller must hold the mutex.
+func (l *Log) inclusionPath(m, start, end uint64) [][]byte {
+	n := end - start
+	if n <= 1 {
+		return nil
+	}
+	k := splitPoint(n)
+	if m < k {
+		return append(l.inclusionPath(m, start, start+k), l.subtreeHash(start+k, end))
+	}
+	return append(l.inclusionPath(m-k, start+k, end), l.subtreeHash(start, start+k))
+}
+
+// subproof returns the consistency proof of the first m leaves of the tree
+// of leaves start to end-1, as defined in RFC 6962, section 2.1.2.
+// The caller must hold the mutex.
+func (l *Log) subproof(m, start, end uint64, complete bool) [][]byte {
+	n := end - start
+	if m == n {
+		if complete {
+			return nil
+		}
+		return [][]byte{l.subtreeHash(start, end)}
+	}
+	k := splitPoint(n)
+	if m <= k {
+		return append(l.subproof(m, start, start+k, complete), l.subtreeHash(start+k, end))
+	}
+	return append(l.subproof(m-k, start+k, end, false), l.subtreeHash(start, start+k))
+}
+
+// SignedTreeHead returns a signed tree head of the current tree.
+func (l *Log) SignedTreeHead() (*SignedTreeHead, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	size := uint64(len(l.inputs))
+	if l.sth != nil && l.sth.TreeSize == size {
+		return l.sth, nil
+	}
+	sth := &SignedTreeHead{
+		TreeSize:  size,
+		Timestamp: l.now().UnixNano() / int64(time.Millisecond),
+		RootHash:  l.subtreeHash(0, size),
+	}
+	digest := sha256.Sum256(sth.signedData())
+	r, s, err := ecdsa.Sign(rand.Reader, l.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	if sth.Signature, err = asn1.Marshal(ecdsaSignature{r, s}); err != nil {
+		return nil, err
+	}
+	l.sth = sth
+	return sth, nil
+}
+
+// InclusionProof returns the audit path of leaf 'index' in the tree
+// of the first 'treeSize' leaves.
+func (l *Log) InclusionProof(index, treeSize uint64) ([][]byte, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if treeSize > uint64(len(l.inputs)) {
+		return nil, ErrInvalidTreeSize
+	}
+	if index >= treeSize {
+		return nil, ErrInvalidLeafIndex
+	}
+	return l.inclusionPath(index, 0, treeSize), nil
+}
+
+// ConsistencyProof returns the proof that the tree of the first 'first'
+// leaves is a prefix of the tree of the first 'second' leaves.
+func (l *Log) ConsistencyProof(first, second uint64) ([][]byte, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if first > second || second > uint64(len(l.inputs)) {
+		return nil, ErrInvalidTreeSize
+	}
+	if first == 0 {
+		return nil, nil
+	}
+	return l.subproof(first, 0, second, true), nil
+}
+
+// LeafEntry is a leaf of the log together with its index.
+type LeafEntry struct {
+	LeafIndex uint64 `json:"leaf_index"`
+	LeafInput []byte `json:"leaf_input"` // JSON-encoded Entry
+}
+
+// MaxEntriesPerRequest is the maximal number of leaves returned by Entries.
+const MaxEntriesPerRequest = 1000
+
+// Entries returns the leaves 'start' to 'end' (inclusive), or only the first
+// MaxEntriesPerRequest of them.
+func (l *Log) Entries(start, end uint64) ([]LeafEntry, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if start > end || end >= uint64(len(l.inputs)) {
+		return nil, ErrInvalidLeafIndex
+	}
+	if end-start >= MaxEntriesPerRequest {
+		end = start + MaxEntriesPerRequest - 1
+	}
+	var entries []LeafEntry
+	for i := start; i <= end; i++ {
+		entries = append(entries, LeafEntry{i, l.inputs[i]})
+	}
+	return entries, nil
+}
+
+// ShareEntries returns the leaves with the entries of share 'shareID'.
+func (l *Log) ShareEntries(shareID string) []LeafEntry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var entries []LeafEntry
+	for _, i := range l.byShare[shareID] {
+		entries = append(entries, LeafEntry{i, l.inputs[i]})
+	}
+	return entries
+}
+
+// SignedTreeHeadHandler handles GET requests for the latest signed tree head.
+// The response is a JSON-encoded SignedTreeHead.
+func (l *Log) SignedTreeHeadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, svalbardsrv.ErrExpectedGetRequest.Error(), http.StatusBadRequest)
+		return
+	}
+	sth, err := l.SignedTreeHead()
+	if err != nil {
+		slog.Error("signing of tree head failed", "error", err)
+		http.Error(w, "could not sign tree head", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, sth)
+}
+
+// GetEntriesHandler handles GET requests for the leaves with indices from
+// start to end (inclusive), like get-entries of RFC 6962: at most
+// MaxEntriesPerRequest leaves are returned, so clients may have to repeat the
+// request for the remaining leaves.  The response is a JSON object of the form
+// {"entries": [{"leaf_index": ..., "leaf_input": "<base64>"}, ...]}.
+func (l *Log) GetEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, svalbardsrv.ErrExpectedGetRequest.Error(), http.StatusBadRequest)
+		return
+	}
+	start, err1 := strconv.ParseUint(r.FormValue("start"), 10, 64)
+	end, err2 := strconv.ParseUint(r.FormValue("end"), 10, 64)
+	if err1 != nil || err2 != nil {
+		http.Error(w, ErrInvalidLeafIndex.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := l.Entries(start, end)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, struct {
+		Entries []LeafEntry `json:"entries"`
+	}{entries})
+}
+
+// EntriesHandler handles GET requests for the entries of a share, given
+// by the parameter share_id.  The response is a JSON object of the form
+// {"entries": [{"leaf_index": ..., "leaf_input": "<base64>"}, ...]}.
+// As a log could omit entries from the response, clients that monitor
+// a share should scan all leaves with GetEntriesHandler instead.
+func (l *Log) EntriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, svalbardsrv.ErrExpectedGetRequest.Error(), http.StatusBadRequest)
+		return
+	}
+	shareID := r.FormValue("share_id")
+	if _, err := hex.DecodeString(shareID); err != nil || len(shareID) != 2*sha256.Size {
+		http.Error(w, ErrInvalidShareID.Error(), http.StatusBadRequest)
+		return
+	}
+	entries := l.ShareEntries(shareID)
+	if entries == nil {
+		entries = []LeafEntry{}
+	}
+	writeJSON(w, struct {
+		Entries []LeafEntry `json:"entries"`
+	}{entries})
+}
+
+// InclusionProofHandler handles GET requests for the audit path of the leaf
+// with index leaf_index in the tree of size tree_size.  The response is
+// a JSON object of the form {"leaf_index": ..., "audit_path": ["<base64>", ...]}.
+func (l *Log) InclusionProofHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, svalbardsrv.ErrExpectedGetRequest.Error(), http.StatusBadRequest)
+		return
+	}
+	index, err1 := strconv.ParseUint(r.FormValue("leaf_index"), 10, 64)
+	treeSize, err2 := strconv.ParseUint(r.FormValue("tree_size"), 10, 64)
+	if err1 != nil || err2 != nil {
+		http.Error(w, ErrInvalidLeafIndex.Error(), http.StatusBadRequest)
+		return
+	}
+	path, err := l.InclusionProof(index, treeSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if path == nil {
+		path = [][]byte{}
+	}
+	writeJSON(w, struct {
+		LeafIndex uint64   `json:"leaf_index"`
+		AuditPath [][]byte `json:"audit_path"`
+	}{index, path})
+}
+
+// ConsistencyProofHandler handles GET requests for the consistency proof
+// between the trees of sizes first and second.  The response is a JSON object
+// of the form {"consistency": ["<base64>", ...]}.
+func (l *Log) ConsistencyProofHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, svalbardsrv.ErrExpectedGetRequest.Error(), http.StatusBadRequest)
+		return
+	}
+	first, err1 := strconv.ParseUint(r.FormValue("first"), 10, 64)
+	second, err2 := strconv.ParseUint(r.FormValue("second"), 10, 64)
+	if err1 != nil || err2 != nil {
+		http.Error(w, ErrInvalidTreeSize.Error(), http.StatusBadRequest)
+		return
+	}
+	proof, err := l.ConsistencyProof(first, second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if proof == nil {
+		proof = [][]byte{}
+	}
+	writeJSON(w, struct {
+		Consistency [][]byte `json:"consistency"`
+	}{proof})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	resp, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "unknown error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+// VerifyInclusion returns nil if 'proof' proves that the leaf with hash
+// 'leafHash' is the leaf 'index' of the tree of size 'treeSize' with root
+// hash 'rootHash', following RFC 9162, section 2.1.3.2.
+func VerifyInclusion(index, treeSize uint64, leafHash []byte, proof [][]byte, rootHash []byte) error {
+	if index >= treeSize {
+		return ErrInvalidProof
+	}
+	fn, sn := index, treeSize-1
+	r := leafHash
+	for _, p := range proof {
+		if sn == 0 {
+			return ErrInvalidProof
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(r, rootHash) {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// VerifyConsistency returns nil if 'proof' proves that the tree of size
+// 'first' with root hash 'firstRoot' is a prefix of the tree of size 'second'
+// with root hash 'secondRoot', following RFC 9162, section 2.1.4.2.
+func VerifyConsistency(first, second uint64, firstRoot, secondRoot []byte, proof [][]byte) error {
+	switch {
+	case first > second:
+		return ErrInvalidProof
+	case first == second:
+		if len(proof) != 0 || !bytes.Equal(firstRoot, secondRoot) {
+			return ErrInvalidProof
+		}
+		return nil
+	case first == 0:
+		if len(proof) != 0 {
+			return ErrInvalidProof
+		}
+		return nil
+	case len(proof) == 0:
+		return ErrInvalidProof
+	}
+	if first&(first-1) == 0 {
+		proof = append([][]byte{firstRoot}, proof...)
+	}
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return ErrInvalidProof
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = nodeHash(c, fr)
+			sr = nodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = nodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(fr, firstRoot) || !bytes.Equal(sr, secondRoot) {
+		return ErrInvalidProof
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Package translogclient implements a client of the transparency log of
+// a Svalbard server, which verifies everything the log returns.  Owners of
+// shares can use it to monitor the operations on their shares:
+//
+//	c := translogclient.New("https://svalbard.example.com", publicKey)
+//	sth, err := c.GetSignedTreeHead()
+//	...
+//	entries, err := c.GetShareEntries(shareID, sth)  // scans the whole log
+//	...
+//	// Later, check that the log only grew since sth.
+//	newSTH, err := c.GetSignedTreeHead()
+//	...
+//	err = c.VerifyConsistency(sth, newSTH)
+package translogclient
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/google/svalbard/server/go/translog"
+)
+
+// ErrUnexpectedResponse is returned when the log returns malformed data.
+var ErrUnexpectedResponse = errors.New("unexpected response from transparency log")
+
+// Client fetches data from a transparency log and verifies it.
+type Client struct {
+	baseURL    string
+	publicKey  *ecdsa.PublicKey
+	httpClient *http.Client
+}
+
+// New returns a new Client of the log of the server at 'baseURL', whose tree
+// heads are signed with the private key for 'publicKey'.
+func New(baseURL string, publicKey *ecdsa.PublicKey) *Client {
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		publicKey:  publicKey,
+		httpClient: http.DefaultClient,
+	}
+}
+
+// get fetches 'path' with the given query parameters, and decodes
+// the JSON response into 'v'.
+func (c *Client) get(path string, params url.Values, v interface{}) error {
+	u := c.baseURL + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	resp, err := c.httpClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return ErrUnexpectedResponse
+	}
+	return nil
+}
+
+// GetSignedTreeHead returns the latest signed tree head of the log,
+// after verifying its signature.
+func (c *Client) GetSignedTreeHead() (*translog.SignedTreeHead, error) {
+	var sth translog.SignedTreeHead
+	if err := c.get("/translog/sth", nil, &sth); err != nil {
+		return nil, err
+	}
+	if err := sth.Verify(c.publicKey); err != nil {
+		return nil, err
+	}
+	return &sth, nil
+}
+
+// GetShareEntries returns the entries of the share 'shareID' in the tree
+// with head 'sth' (obtained from GetSignedTreeHead).  It fetches all leaves of
+// that tree and verifies that they hash to its root, so that the log can
+// neither modify nor omit any entry of the share.  Entries appended after
+// 'sth' are ignored.
+func (c *Client) GetShareEntries(shareID string, sth *translog.SignedTreeHead) ([]translog.Entry, error) {
+	leafHashes := make([][]byte, 0, sth.TreeSize)
+	var entries []translog.Entry
+	for start := uint64(0); start < sth.TreeSize; {
+		var resp struct {
+			Entries []translog.LeafEntry `json:"entries"`
+		}
+		params := url.Values{
+			"start": {strconv.FormatUint(start, 10)},
+			"end":   {strconv.FormatUint(sth.TreeSize-1, 10)},
+		}
+		if err := c.get("/translog/get-entries", params, &resp); err != nil {
+			return nil, err
+		}
+		if len(resp.Entries) == 0 || uint64(len(resp.Entries)) > sth.TreeSize-start {
+			return nil, ErrUnexpectedResponse
+		}
+		for _, leaf := range resp.Entries {
+			var entry translog.Entry
+			if leaf.LeafIndex != start || json.Unmarshal(leaf.LeafInput, &entry) != nil {
+				return nil, ErrUnexpectedResponse
+			}
+			leafHashes = append(leafHashes, translog.LeafHash(leaf.LeafInput))
+			if entry.ShareID == shareID {
+				entries = append(entries, entry)
+			}
+			start++
+		}
+	}
+	if !bytes.Equal(translog.TreeHash(leafHashes), sth.RootHash) {
+		return nil, translog.ErrInvalidProof
+	}
+	return entries, nil
+}
+
+// VerifyConsistency verifies that the tree with head 'newSTH' extends
+// the tree with head 'oldSTH', i.e. that the log did not remove or modify
+// any of the entries in the old tree.  Both heads must have been obtained
+// from GetSignedTreeHead.
+func (c *Client) VerifyConsistency(oldSTH, newSTH *translog.SignedTreeHead) error {
+	if oldSTH.TreeSize > newSTH.TreeSize {
+		return translog.ErrTreeHeadsInconsistent
+	}
+	var proof struct {
+		Consistency [][]byte `json:"consistency"`
+	}
+	params := url.Values{
+		"first":  {strconv.FormatUint(oldSTH.TreeSize, 10)},
+		"second": {strconv.FormatUint(newSTH.TreeSize, 10)},
+	}
+	if err := c.get("/translog/consistency_proof", params, &proof); err != nil {
+		return err
+	}
+	if err := translog.VerifyConsistency(oldSTH.TreeSize, newSTH.TreeSize, oldSTH.RootHash, newSTH.RootHash,
+		proof.Consistency); err != nil {
+		return translog.ErrTreeHeadsInconsistent
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package translogclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/svalbard/server/go/svalbardsrv"
+	"github.com/google/svalbard/server/go/translog"
+)
+
+func newTempDir() string {
+	dir := os.Getenv("TEST_TMPDIR")
+	if dir == "" {
+		dir = "/tmp"
+	}
+	tempDir, err := ioutil.TempDir(dir, "translogclient_test_")
+	if err != nil {
+		panic("Failure creating temp dir: " + err.Error())
+	}
+	return tempDir
+}
+
+func testShareID(i int) string {
+	h := sha256.Sum256([]byte{byte(i)})
+	return hex.EncodeToString(h[:])
+}
+
+// newTestLog returns a new log with 'n' entries, signed with 'key',
+// and a test server that serves it.
+func newTestLog(key *ecdsa.PrivateKey, n int, t *testing.T) (*translog.Log, *httptest.Server) {
+	filename := filepath.Join(newTempDir(), "translog")
+	l, err := translog.Open(filename, key)
+	if err != nil {
+		t.Fatalf("Open(%q) failed: %v", filename, err)
+	}
+	appendEntries(l, 0, n, t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/translog/sth", l.SignedTreeHeadHandler)
+	mux.HandleFunc("/translog/get-entries", l.GetEntriesHandler)
+	mux.HandleFunc("/translog/entries", l.EntriesHandler)
+	mux.HandleFunc("/translog/inclusion_proof", l.InclusionProofHandler)
+	mux.HandleFunc("/translog/consistency_proof", l.ConsistencyProofHandler)
+	return l, httptest.NewServer(mux)
+}
+
+func appendEntries(l *translog.Log, from, to int, t *testing.T) {
+	for i := from; i < to; i++ {
+		op := svalbardsrv.AuditRetrieveShare
+		if i%3 == 0 {
+			op = svalbardsrv.AuditStoreShare
+		}
+		if err := l.Append(translog.Entry{Time: int64(i), ShareID: testShareID(i % 3), Operation: op}); err != nil {
+			t.Fatalf("Append() failed: %v", err)
+		}
+	}
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() failed: %v", err)
+	}
+	return key
+}
+
+func TestMonitorShare(t *testing.T) {
+	key := newTestKey(t)
+	l, server := newTestLog(key, 10, t)
+	defer server.Close()
+	c := New(server.URL+"/", &key.PublicKey)
+
+	sth, err := c.GetSignedTreeHead()
+	if err != nil || sth.TreeSize != 10 {
+		t.Fatalf("GetSignedTreeHead(): got %+v (error: %v), want tree size 10", sth, err)
+	}
+	entries, err := c.GetShareEntries(testShareID(1), sth)
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("GetShareEntries(): got %v (error: %v), want 3 entries", entries, err)
+	}
+	for i, entry := range entries {
+		want := translog.Entry{Time: int64(3*i + 1), ShareID: testShareID(1), Operation: svalbardsrv.AuditRetrieveShare}
+		if entry != want {
+			t.Errorf("GetShareEntries()[%d]: got %v, want %v", i, entry, want)
+		}
+	}
+
+	// Entries appended later are verified against the newer tree head only.
+	appendEntries(l, 10, 17, t)
+	if entries, err = c.GetShareEntries(testShareID(1), sth); err != nil || len(entries) != 3 {
+		t.Errorf("GetShareEntries() with old tree head: got %v (error: %v), want 3 entries", entries, err)
+	}
+	newSTH, err := c.GetSignedTreeHead()
+	if err != nil || newSTH.TreeSize != 17 {
+		t.Fatalf("GetSignedTreeHead(): got %+v (error: %v), want tree size 17", newSTH, err)
+	}
+	if entries, err = c.GetShareEntries(testShareID(1), newSTH); err != nil || len(entries) != 6 {
+		t.Errorf("GetShareEntries() with new tree head: got %v (error: %v), want 6 entries", entries, err)
+	}
+	if err := c.VerifyConsistency(sth, newSTH); err != nil {
+		t.Errorf("VerifyConsistency(): got [%v], want [<nil>]", err)
+	}
+	if err := c.VerifyConsistency(newSTH, sth); err != translog.ErrTreeHeadsInconsistent {
+		t.Errorf("VerifyConsistency() of shrunk tree: got [%v], want [%v]", err, translog.ErrTreeHeadsInconsistent)
+	}
+}
+
+func TestDetectsMisbehavingLog(t *testing.T) {
+	key := newTestKey(t)
+	_, server := newTestLog(key, 10, t)
+	defer server.Close()
+	c := New(server.URL, &key.PublicKey)
+	sth, err := c.GetSignedTreeHead()
+	if err != nil {
+		t.Fatalf("GetSignedTreeHead() failed: %v", err)
+	}
+
+	// A log signed with another key.
+	if _, err := New(server.URL, &newTestKey(t).PublicKey).GetSignedTreeHead(); err != translog.ErrInvalidSignature {
+		t.Errorf("GetSignedTreeHead() with other key: got [%v], want [%v]", err, translog.ErrInvalidSignature)
+	}
+
+	// A log that rewrote its history: same key, different entries.
+	forked, forkedServer := newTestLog(key, 5, t)
+	defer forkedServer.Close()
+	if err := forked.Append(translog.Entry{Time: 5, ShareID: testShareID(7), Operation: svalbardsrv.AuditDeleteShare}); err != nil {
+		t.Fatalf("Append() failed: %v", err)
+	}
+	appendEntries(forked, 6, 12, t)
+	forkedClient := New(forkedServer.URL, &key.PublicKey)
+	forkedSTH, err := forkedClient.GetSignedTreeHead()
+	if err != nil {
+		t.Fatalf("GetSignedTreeHead() of forked log failed: %v", err)
+	}
+	if err := forkedClient.VerifyConsistency(sth, forkedSTH); err != translog.ErrTreeHeadsInconsistent {
+		t.Errorf("VerifyConsistency() of forked log: got [%v], want [%v]", err, translog.ErrTreeHeadsInconsistent)
+	}
+	// Entries of the fork are not included in the original tree.
+	if _, err := forkedClient.GetShareEntries(testShareID(0), sth); err != translog.ErrInvalidProof {
+		t.Errorf("GetShareEntries() of forked log: got [%v], want [%v]", err, translog.ErrInvalidProof)
+	}
+
+	// A log that hides a retrieval by serving it as a storage.
+	tampering := newTamperingServer(server.URL, func(entries []translog.LeafEntry) []translog.LeafEntry {
+		entries[1].LeafInput, _ = json.Marshal(translog.Entry{
+			Time: 1, ShareID: testShareID(1), Operation: svalbardsrv.AuditStoreShare})
+		return entries
+	}, t)
+	defer tampering.Close()
+	if _, err := New(tampering.URL, &key.PublicKey).GetShareEntries(testShareID(1), sth); err != translog.ErrInvalidProof {
+		t.Errorf("GetShareEntries() of tampering log: got [%v], want [%v]", err, translog.ErrInvalidProof)
+	}
+
+	// A log that omits the entries of a share.
+	omitting := newTamperingServer(server.URL, func(entries []translog.LeafEntry) []translog.LeafEntry {
+		var kept []translog.LeafEntry
+		for _, leaf := range entries {
+			if leaf.LeafIndex%3 != 1 {
+				kept = append(kept, leaf)
+			}
+		}
+		return kept
+	}, t)
+	defer omitting.Close()
+	if _, err := New(omitting.URL, &key.PublicKey).GetShareEntries(testShareID(1), sth); err != ErrUnexpectedResponse {
+		t.Errorf("GetShareEntries() of omitting log: got [%v], want [%v]", err, ErrUnexpectedResponse)
+	}
+	// The same log, also renumbering the remaining entries.
+	renumbering := newTamperingServer(server.URL, func(entries []translog.LeafEntry) []translog.LeafEntry {
+		var kept []translog.LeafEntry
+		for _, leaf := range entries {
+			if leaf.LeafIndex%3 != 1 {
+				leaf.LeafIndex = uint64(len(kept))
+				kept = append(kept, leaf)
+			}
+		}
+		for len(kept) < len(entries) {
+			kept = append(kept, translog.LeafEntry{LeafIndex: uint64(len(kept)), LeafInput: kept[0].LeafInput})
+		}
+		return kept
+	}, t)
+	defer renumbering.Close()
+	if _, err := New(renumbering.URL, &key.PublicKey).GetShareEntries(testShareID(1), sth); err != translog.ErrInvalidProof {
+		t.Errorf("GetShareEntries() of renumbering log: got [%v], want [%v]", err, translog.ErrInvalidProof)
+	}
+}
+
+// newTamperingServer returns a test server that forwards requests to the log
+// at 'logURL', passing the leaves returned by get-entries through 'tamper'.
+func newTamperingServer(logURL string, tamper func([]translog.LeafEntry) []translog.LeafEntry, t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, err := http.Get(logURL + r.URL.String())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if r.URL.Path == "/translog/get-entries" {
+			var entries struct {
+				Entries []translog.LeafEntry `json:"entries"`
+			}
+			if err := json.Unmarshal(body, &entries); err != nil {
+				t.Errorf("Invalid entries %s: %v", body, err)
+			}
+			entries.Entries = tamper(entries.Entries)
+			body, _ = json.Marshal(entries)
+		}
+		w.WriteHeader(resp.StatusCode)
+		w.Write(body)
+	}))
+}
+
+func TestGetShareEntriesScansLargeLogs(t *testing.T) {
+	key := newTestKey(t)
+	_, server := newTestLog(key, translog.MaxEntriesPerRequest+10, t)
+	defer server.Close()
+	c := New(server.URL, &key.PublicKey)
+	sth, err := c.GetSignedTreeHead()
+	if err != nil {
+		t.Fatalf("GetSignedTreeHead() failed: %v", err)
+	}
+	entries, err := c.GetShareEntries(testShareID(2), sth)
+	if want := (translog.MaxEntriesPerRequest + 10) / 3; err != nil || len(entries) != want {
+		t.Errorf("GetShareEntries(): got %d entries (error: %v), want %d", len(entries), err, want)
+	}
+}
@@ -0,0 +1,422 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package translog
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+func newTempDir() string {
+	dir := os.Getenv("TEST_TMPDIR")
+	if dir == "" {
+		dir = "/tmp"
+	}
+	tempDir, err := ioutil.TempDir(dir, "translog_test_")
+	if err != nil {
+		panic("Failure creating temp dir: " + err.Error())
+	}
+	return tempDir
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() failed: %v", err)
+	}
+	return key
+}
+
+func newTestLog(t *testing.T) *Log {
+	filename := filepath.Join(newTempDir(), "translog")
+	l, err := Open(filename, newTestKey(t))
+	if err != nil {
+		t.Fatalf("Open(%q) failed: %v", filename, err)
+	}
+	return l
+}
+
+func testShareID(i int) string {
+	h := sha256.Sum256([]byte{byte(i)})
+	return hex.EncodeToString(h[:])
+}
+
+// The leaves of the test vectors of RFC 6962 implementations.
+var rfcLeaves = []string{
+	"", "00", "10", "2021", "3031", "40414243", "5051525354555657",
+	"606162636465666768696a6b6c6d6e6f",
+}
+
+// referenceHash computes the Merkle tree hash of 'leaves' directly from
+// the definition in RFC 6962.
+func referenceHash(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		h := sha256.Sum256(nil)
+		return h[:]
+	case 1:
+		return LeafHash(leaves[0])
+	}
+	k := splitPoint(uint64(len(leaves)))
+	return nodeHash(referenceHash(leaves[:k]), referenceHash(leaves[k:]))
+}
+
+func TestTreeHashes(t *testing.T) {
+	l := newTestLog(t)
+	var leaves [][]byte
+	for _, s := range rfcLeaves {
+		leaf, _ := hex.DecodeString(s)
+		leaves = append(leaves, leaf)
+		l.addLeaf("", leaf)
+	}
+	var tests = []struct {
+		size uint64
+		root string
+	}{
+		{0, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{1, "6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d"},
+		{8, "5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328"},
+	}
+	for _, tt := range tests {
+		if root := hex.EncodeToString(l.subtreeHash(0, tt.size)); root != tt.root {
+			t.Errorf("subtreeHash(0, %d): got %s, want %s", tt.size, root, tt.root)
+		}
+	}
+	for size := 0; size <= len(leaves); size++ {
+		want := referenceHash(leaves[:size])
+		if root := l.subtreeHash(0, uint64(size)); !bytes.Equal(root, want) {
+			t.Errorf("subtreeHash(0, %d): got %x, want %x", size, root, want)
+		}
+		if root := TreeHash(l.levels[0][:size]); !bytes.Equal(root, want) {
+			t.Errorf("TreeHash() of %d leaves: got %x, want %x", size, root, want)
+		}
+	}
+}
+
+func TestInclusionAndConsistencyProofs(t *testing.T) {
+	l := newTestLog(t)
+	const maxSize = 35
+	for i := 0; i < maxSize; i++ {
+		if err := l.Append(Entry{Time: int64(i), ShareID: testShareID(i % 5), Operation: svalbardsrv.AuditStoreShare}); err != nil {
+			t.Fatalf("Append() failed: %v", err)
+		}
+	}
+	roots := make([][]byte, maxSize+1)
+	for size := uint64(0); size <= maxSize; size++ {
+		roots[size] = l.subtreeHash(0, size)
+	}
+	for size := uint64(1); size <= maxSize; size++ {
+		for index := uint64(0); index < size; index++ {
+			proof, err := l.InclusionProof(index, size)
+			if err != nil {
+				t.Fatalf("InclusionProof(%d, %d) failed: %v", index, size, err)
+			}
+			leafHash := LeafHash(l.inputs[index])
+			if err := VerifyInclusion(index, size, leafHash, proof, roots[size]); err != nil {
+				t.Errorf("VerifyInclusion(%d, %d): got [%v], want [<nil>]", index, size, err)
+			}
+			// The proof is not valid for another leaf, index or root.
+			if err := VerifyInclusion(index, size, LeafHash([]byte("other")), proof, roots[size]); err != ErrInvalidProof {
+				t.Errorf("VerifyInclusion(%d, %d) of other leaf: got [%v], want [%v]", index, size, err, ErrInvalidProof)
+			}
+			if err := VerifyInclusion((index+1)%size, size, leafHash, proof, roots[size]); size > 1 && err != ErrInvalidProof {
+				t.Errorf("VerifyInclusion(%d, %d) with wrong index: got [%v], want [%v]", index+1, size, err, ErrInvalidProof)
+			}
+			if err := VerifyInclusion(index, size, leafHash, proof, roots[size-1]); err != ErrInvalidProof {
+				t.Errorf("VerifyInclusion(%d, %d) with wrong root: got [%v], want [%v]", index, size, err, ErrInvalidProof)
+			}
+		}
+	}
+	for second := uint64(0); second <= maxSize; second++ {
+		for first := uint64(0); first <= second; first++ {
+			proof, err := l.ConsistencyProof(first, second)
+			if err != nil {
+				t.Fatalf("ConsistencyProof(%d, %d) failed: %v", first, second, err)
+			}
+			if err := VerifyConsistency(first, second, roots[first], roots[second], proof); err != nil {
+				t.Errorf("VerifyConsistency(%d, %d): got [%v], want [<nil>]", first, second, err)
+			}
+			if first == 0 || first == second {
+				continue
+			}
+			// The proof is not valid for other roots.
+			if err := VerifyConsistency(first, second, roots[first-1], roots[second], proof); err != ErrInvalidProof {
+				t.Errorf("VerifyConsistency(%d, %d) with wrong first root: got [%v], want [%v]", first, second, err, ErrInvalidProof)
+			}
+			if err := VerifyConsistency(first, second, roots[first], roots[second-1], proof); err != ErrInvalidProof {
+				t.Errorf("VerifyConsistency(%d, %d) with wrong second root: got [%v], want [%v]", first, second, err, ErrInvalidProof)
+			}
+		}
+	}
+
+	var errTests = []struct {
+		index, size uint64
+		err         error
+	}{
+		{0, 0, ErrInvalidLeafIndex},
+		{5, 5, ErrInvalidLeafIndex},
+		{0, maxSize + 1, ErrInvalidTreeSize},
+	}
+	for _, tt := range errTests {
+		if _, err := l.InclusionProof(tt.index, tt.size); err != tt.err {
+			t.Errorf("InclusionProof(%d, %d): got [%v], want [%v]", tt.index, tt.size, err, tt.err)
+		}
+	}
+	if _, err := l.ConsistencyProof(5, 4); err != ErrInvalidTreeSize {
+		t.Errorf("ConsistencyProof(5, 4): got [%v], want [%v]", err, ErrInvalidTreeSize)
+	}
+	if _, err := l.ConsistencyProof(5, maxSize+1); err != ErrInvalidTreeSize {
+		t.Errorf("ConsistencyProof(5, %d): got [%v], want [%v]", maxSize+1, err, ErrInvalidTreeSize)
+	}
+}
+
+func TestSignedTreeHead(t *testing.T) {
+	l := newTestLog(t)
+	sth1, err := l.SignedTreeHead()
+	if err != nil {
+		t.Fatalf("SignedTreeHead() failed: %v", err)
+	}
+	if err := sth1.Verify(&l.key.PublicKey); err != nil || sth1.TreeSize != 0 {
+		t.Errorf("SignedTreeHead() of empty log: got %+v (verification error: %v), want tree size 0", sth1, err)
+	}
+	if err := l.Append(Entry{Time: 1, ShareID: testShareID(1), Operation: svalbardsrv.AuditStoreShare}); err != nil {
+		t.Fatalf("Append() failed: %v", err)
+	}
+	sth2, err := l.SignedTreeHead()
+	if err != nil {
+		t.Fatalf("SignedTreeHead() failed: %v", err)
+	}
+	if err := sth2.Verify(&l.key.PublicKey); err != nil || sth2.TreeSize != 1 {
+		t.Errorf("SignedTreeHead(): got %+v (verification error: %v), want tree size 1", sth2, err)
+	}
+	if err := sth2.Verify(&newTestKey(t).PublicKey); err != ErrInvalidSignature {
+		t.Errorf("Verify() with other key: got [%v], want [%v]", err, ErrInvalidSignature)
+	}
+	tampered := *sth2
+	tampered.TreeSize = 0
+	if err := tampered.Verify(&l.key.PublicKey); err != ErrInvalidSignature {
+		t.Errorf("Verify() of tampered tree head: got [%v], want [%v]", err, ErrInvalidSignature)
+	}
+	tampered = *sth2
+	tampered.Signature = []byte("garbage")
+	if err := tampered.Verify(&l.key.PublicKey); err != ErrInvalidSignature {
+		t.Errorf("Verify() of garbage signature: got [%v], want [%v]", err, ErrInvalidSignature)
+	}
+}
+
+func TestReopenedLogHasSameTree(t *testing.T) {
+	filename := filepath.Join(newTempDir(), "translog")
+	key := newTestKey(t)
+	l, err := Open(filename, key)
+	if err != nil {
+		t.Fatalf("Open(%q) failed: %v", filename, err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := l.Append(Entry{Time: int64(i), ShareID: testShareID(i % 2), Operation: svalbardsrv.AuditRetrieveShare}); err != nil {
+			t.Fatalf("Append() failed: %v", err)
+		}
+	}
+	sth, err := l.SignedTreeHead()
+	if err != nil {
+		t.Fatalf("SignedTreeHead() failed: %v", err)
+	}
+	l.Close()
+	if l, err = Open(filename, key); err != nil {
+		t.Fatalf("Open(%q) again failed: %v", filename, err)
+	}
+	reopened, err := l.SignedTreeHead()
+	if err != nil || reopened.TreeSize != 7 || !bytes.Equal(reopened.RootHash, sth.RootHash) {
+		t.Errorf("SignedTreeHead() of reopened log: got %+v (error: %v), want root hash %x", reopened, err, sth.RootHash)
+	}
+	if entries := l.ShareEntries(testShareID(1)); len(entries) != 3 {
+		t.Errorf("ShareEntries() of reopened log: got %d entries, want 3", len(entries))
+	}
+
+	l.Close()
+
+	// A partial last entry is removed, and appending continues after the
+	// complete entries.
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile(%q) failed: %v", filename, err)
+	}
+	if err := ioutil.WriteFile(filename, content[:len(content)-5], 0600); err != nil {
+		t.Fatalf("WriteFile(%q) failed: %v", filename, err)
+	}
+	if l, err = Open(filename, key); err != nil {
+		t.Fatalf("Open() of log with a partial entry failed: %v", err)
+	}
+	if size := l.Size(); size != 6 {
+		t.Errorf("Size() of log with a partial entry: got %d, want 6", size)
+	}
+	if err := l.Append(Entry{Time: 7, ShareID: testShareID(0), Operation: svalbardsrv.AuditRetrieveShare}); err != nil {
+		t.Fatalf("Append() failed: %v", err)
+	}
+	l.Close()
+	if l, err = Open(filename, key); err != nil {
+		t.Fatalf("Open(%q) after appending failed: %v", filename, err)
+	}
+	defer l.Close()
+	if size := l.Size(); size != 7 {
+		t.Errorf("Size() after appending: got %d, want 7", size)
+	}
+}
+
+func TestAuditRecordsSuccessfulOperations(t *testing.T) {
+	l := newTestLog(t)
+	now := time.Unix(1500000000, 0)
+	ip := net.ParseIP("192.0.2.1")
+	events := []svalbardsrv.AuditEvent{
+		{now, svalbardsrv.AuditGetStorageToken, testShareID(1), "req1", ip, http.StatusOK},
+		{now, svalbardsrv.AuditStoreShare, testShareID(1), "", ip, http.StatusOK},
+		{now, svalbardsrv.AuditRetrieveShare, testShareID(1), "", ip, http.StatusForbidden},
+		{now, svalbardsrv.AuditGetRetrievalToken, "", "req2", ip, http.StatusBadRequest},
+		{now, svalbardsrv.AuditRetrieveShare, testShareID(1), "", ip, http.StatusOK},
+		{now, svalbardsrv.AuditDeleteShare, testShareID(2), "", ip, http.StatusOK},
+	}
+	for _, event := range events {
+		if err := l.Audit(event); err != nil {
+			t.Fatalf("Audit(%v) failed: %v", event, err)
+		}
+	}
+	var got []Entry
+	for _, leaf := range l.ShareEntries(testShareID(1)) {
+		var entry Entry
+		if err := json.Unmarshal(leaf.LeafInput, &entry); err != nil {
+			t.Fatalf("Invalid leaf input %s: %v", leaf.LeafInput, err)
+		}
+		got = append(got, entry)
+	}
+	want := []Entry{
+		{now.Unix(), testShareID(1), svalbardsrv.AuditGetStorageToken},
+		{now.Unix(), testShareID(1), svalbardsrv.AuditStoreShare},
+		{now.Unix(), testShareID(1), svalbardsrv.AuditRetrieveShare},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("ShareEntries(): got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("ShareEntries()[%d]: got %v, want %v", i, got[i], want[i])
+		}
+	}
+	if size := l.Size(); size != 4 {
+		t.Errorf("Size(): got %d, want 4", size)
+	}
+	// Only share ids are recorded, no request ids or client IP addresses.
+	content, err := ioutil.ReadFile(l.file.Name())
+	if err != nil {
+		t.Fatalf("ReadFile() failed: %v", err)
+	}
+	if strings.Contains(string(content), "req1") || strings.Contains(string(content), "192.0.2.1") {
+		t.Errorf("Log contains request ids or client IP addresses: %s", content)
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	l := newTestLog(t)
+	for i := 0; i < 3; i++ {
+		if err := l.Append(Entry{Time: int64(i), ShareID: testShareID(i % 2), Operation: svalbardsrv.AuditStoreShare}); err != nil {
+			t.Fatalf("Append() failed: %v", err)
+		}
+	}
+	var tests = []struct {
+		handler  http.HandlerFunc
+		method   string
+		query    string
+		status   int
+		respBody string // a prefix of the expected body
+	}{
+		{l.SignedTreeHeadHandler, "GET", "", http.StatusOK, `{"tree_size":3,`},
+		{l.SignedTreeHeadHandler, "POST", "", http.StatusBadRequest, "expected GET request"},
+		{l.GetEntriesHandler, "GET", "start=1&end=2", http.StatusOK, `{"entries":[{"leaf_index":1,"leaf_input":`},
+		{l.GetEntriesHandler, "GET", "start=2&end=3", http.StatusBadRequest, ErrInvalidLeafIndex.Error()},
+		{l.GetEntriesHandler, "GET", "start=2&end=1", http.StatusBadRequest, ErrInvalidLeafIndex.Error()},
+		{l.GetEntriesHandler, "GET", "start=0", http.StatusBadRequest, ErrInvalidLeafIndex.Error()},
+		{l.EntriesHandler, "GET", "share_id=" + testShareID(0), http.StatusOK, `{"entries":[{"leaf_index":0,"leaf_input":`},
+		{l.EntriesHandler, "GET", "share_id=" + testShareID(7), http.StatusOK, `{"entries":[]}`},
+		{l.EntriesHandler, "GET", "share_id=abc", http.StatusBadRequest, ErrInvalidShareID.Error()},
+		{l.InclusionProofHandler, "GET", "leaf_index=1&tree_size=3", http.StatusOK, `{"leaf_index":1,"audit_path":["`},
+		{l.InclusionProofHandler, "GET", "leaf_index=0&tree_size=1", http.StatusOK, `{"leaf_index":0,"audit_path":[]}`},
+		{l.InclusionProofHandler, "GET", "leaf_index=3&tree_size=3", http.StatusBadRequest, ErrInvalidLeafIndex.Error()},
+		{l.InclusionProofHandler, "GET", "leaf_index=1&tree_size=4", http.StatusBadRequest, ErrInvalidTreeSize.Error()},
+		{l.InclusionProofHandler, "GET", "leaf_index=x&tree_size=3", http.StatusBadRequest, ErrInvalidLeafIndex.Error()},
+		{l.ConsistencyProofHandler, "GET", "first=1&second=3", http.StatusOK, `{"consistency":["`},
+		{l.ConsistencyProofHandler, "GET", "first=3&second=3", http.StatusOK, `{"consistency":[]}`},
+		{l.ConsistencyProofHandler, "GET", "first=3&second=1", http.StatusBadRequest, ErrInvalidTreeSize.Error()},
+		{l.ConsistencyProofHandler, "GET", "first=1", http.StatusBadRequest, ErrInvalidTreeSize.Error()},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.handler(w, httptest.NewRequest(tt.method, "http://svalbard.example.com/translog?"+tt.query, nil))
+		if w.Code != tt.status {
+			t.Errorf("%s %s status: got [%v], want [%v]", tt.method, tt.query, w.Code, tt.status)
+		}
+		if body := w.Body.String(); !strings.HasPrefix(body, tt.respBody) {
+			t.Errorf("%s %s body: got [%v], want prefix [%v]", tt.method, tt.query, body, tt.respBody)
+		}
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	key := newTestKey(t)
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey() failed: %v", err)
+	}
+	privatePEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if der, err = x509.MarshalPKIXPublicKey(&key.PublicKey); err != nil {
+		t.Fatalf("MarshalPKIXPublicKey() failed: %v", err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	parsedKey, err := ParsePrivateKey(privatePEM)
+	if err != nil || parsedKey.D.Cmp(key.D) != 0 {
+		t.Errorf("ParsePrivateKey(): got %v (error: %v), want the key", parsedKey, err)
+	}
+	parsedPublicKey, err := ParsePublicKey(publicPEM)
+	if err != nil || parsedPublicKey.X.Cmp(key.X) != 0 || parsedPublicKey.Y.Cmp(key.Y) != 0 {
+		t.Errorf("ParsePublicKey(): got %v (error: %v), want the public key", parsedPublicKey, err)
+	}
+	if _, err := ParsePrivateKey(publicPEM); err != ErrInvalidKey {
+		t.Errorf("ParsePrivateKey() of public key: got [%v], want [%v]", err, ErrInvalidKey)
+	}
+	if _, err := ParsePublicKey(privatePEM); err != ErrInvalidKey {
+		t.Errorf("ParsePublicKey() of private key: got [%v], want [%v]", err, ErrInvalidKey)
+	}
+	if _, err := ParsePublicKey([]byte("garbage")); err != ErrInvalidKey {
+		t.Errorf("ParsePublicKey() of garbage: got [%v], want [%v]", err, ErrInvalidKey)
+	}
+}
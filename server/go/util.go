@@ -20,6 +20,10 @@ package util
 import (
 	"crypto/rand"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
 )
 
 // Errors returned upon failures.
@@ -27,6 +31,20 @@ var (
 	ErrWrongStringLength = errors.New("length must be positive")
 )
 
+// ReadSecret returns the secret in 'source', which is either the name of
+// a file, or "env:" followed by the name of an environment variable.
+func ReadSecret(source string) ([]byte, error) {
+	if strings.HasPrefix(source, "env:") {
+		name := strings.TrimPrefix(source, "env:")
+		secret := os.Getenv(name)
+		if secret == "" {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+		return []byte(secret), nil
+	}
+	return ioutil.ReadFile(source)
+}
+
 const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
 // RandomString returns a random string of specified length,
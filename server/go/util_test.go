@@ -17,6 +17,9 @@
 package util
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"regexp"
 	"testing"
 )
@@ -56,3 +59,32 @@ func TestRandomStringErrors(t *testing.T) {
 		t.Errorf("For negative length expected ErrWrongStringLength (%v)", ErrWrongStringLength)
 	}
 }
+
+func TestReadSecret(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "svalbard_util")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(filename, []byte("file secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("SVALBARD_TEST_SECRET", "env secret")
+	defer os.Unsetenv("SVALBARD_TEST_SECRET")
+	var tests = []struct {
+		source string
+		secret string
+		ok     bool
+	}{
+		{filename, "file secret", true},
+		{"env:SVALBARD_TEST_SECRET", "env secret", true},
+		{"env:SVALBARD_TEST_MISSING_SECRET", "", false},
+		{filepath.Join(dir, "missing"), "", false},
+	}
+	for _, tt := range tests {
+		secret, err := ReadSecret(tt.source)
+		if string(secret) != tt.secret || (err == nil) != tt.ok {
+			t.Errorf("ReadSecret(%q): got [%q, %v], want [%q, success: %v]", tt.source, secret, err, tt.secret, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+// Package webhookchannel implements the svalbardsrv.SecondaryChannel interface
+// by POSTing signed JSON payloads to configured HTTP endpoints (webhooks).
+// This enables bridging the tokens into external messaging systems,
+// like chat bots or pager tools.
+package webhookchannel
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/svalbard/server/go/msgtemplate"
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+// Names of the HTTP headers that carry the signature of a payload.
+const (
+	TimestampHeader = "X-Svalbard-Timestamp"
+	SignatureHeader = "X-Svalbard-Signature"
+)
+
+// signatureVersion is the prefix of the value of SignatureHeader,
+// identifying the signing scheme.
+const signatureVersion = "v1="
+
+// Default values of the parameters of a Channel.
+const (
+	DefaultRetryDelay = 500 * time.Millisecond
+	DefaultTimeout    = 10 * time.Second
+	DefaultMaxAge     = 5 * time.Minute
+)
+
+// Errors returned upon failures.
+var (
+	ErrMissingKey       = errors.New("missing webhook signing key")
+	ErrMissingURLs      = errors.New("missing webhook urls")
+	ErrInvalidURL       = errors.New("invalid webhook url")
+	ErrNegativeRetries  = errors.New("number of retries must not be negative")
+	ErrDeliveryFailed   = errors.New("webhook delivery failed")
+	ErrMissingSignature = errors.New("missing webhook signature")
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrInvalidTimestamp = errors.New("invalid webhook timestamp")
+	ErrStaleTimestamp   = errors.New("stale webhook timestamp")
+	ErrReplayedRequest  = errors.New("replayed webhook request")
+	ErrInvalidPayload   = errors.New("invalid webhook payload")
+)
+
+// Config contains the parameters of a Channel.
+type Config struct {
+	// URLs maps an owner_id_type (case-insensitive) to the URL of the webhook
+	// that handles the recipients of that type.
+	URLs map[string]string
+	// Key is the secret used to sign the payloads with HMAC-SHA256.
+	// The receivers must use the same key to verify the signatures.
+	Key []byte
+	// MaxRetries is the number of additional delivery attempts made after
+	// a failed one.
+	MaxRetries int
+	// RetryDelay is the delay before the first retry, it is doubled for every
+	// subsequent retry.  If zero, DefaultRetryDelay is used.
+	RetryDelay time.Duration
+	// Client is used for sending the requests.  If nil, a client with
+	// DefaultTimeout is used.
+	Client *http.Client
+	// Templates are used for rendering human-readable messages.  If nil,
+	// the messages contain only the line generated by
+	// svalbardsrv.GetMsgWithToken.
+	Templates *msgtemplate.Set
+}
+
+// Payload is the JSON-encoded body of the requests sent to the webhooks.
+// DeliveryID is a random id of the message, which is the same in all the
+// delivery attempts of the message, so receivers can recognize messages that
+// they have handled already (e.g. if the response to an attempt was lost).
+// Attempt numbers the attempts from 1, so every attempt is signed differently.
+type Payload struct {
+	RecipientIDType string `json:"recipient_id_type"`
+	Recipient       string `json:"recipient"`
+	RequestID       string `json:"request_id"`
+	Message         string `json:"message"`
+	Locale          string `json:"locale,omitempty"`
+	DeliveryID      string `json:"delivery_id"`
+	Attempt         int    `json:"attempt"`
+}
+
+// Channel is a svalbardsrv.SecondaryChannel implementation that delivers
+// the messages to webhooks.
+type Channel struct {
+	urls       map[string]string
+	key        []byte
+	maxRetries int
+	retryDelay time.Duration
+	client     *http.Client
+	templates  *msgtemplate.Set
+	now        func() time.Time
+}
+
+// NewChannel returns a new Channel configured according to 'config'.
+func NewChannel(config Config) (*Channel, error) {
+	if len(config.Key) == 0 {
+		return nil, ErrMissingKey
+	}
+	if len(config.URLs) == 0 {
+		return nil, ErrMissingURLs
+	}
+	if config.MaxRetries < 0 {
+		return nil, ErrNegativeRetries
+	}
+	urls := make(map[string]string)
+	for idType, hookURL := range config.URLs {
+		u, err := url.Parse(hookURL)
+		if idType == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, ErrInvalidURL
+		}
+		urls[strings.ToUpper(idType)] = hookURL
+	}
+	retryDelay := config.RetryDelay
+	if retryDelay == 0 {
+		retryDelay = DefaultRetryDelay
+	}
+	client := config.Client
+	if client == nil {
+		client = &http.Client{Timeout: DefaultTimeout}
+	}
+	return &Channel{
+		urls:       urls,
+		key:        append([]byte(nil), config.Key...),
+		maxRetries: config.MaxRetries,
+		retryDelay: retryDelay,
+		client:     client,
+		templates:  config.Templates,
+		now:        time.Now,
+	}, nil
+}
+
+// Send sends 'data' to the recipient identified by 'recipientID', by POSTing
+// a signed payload to the webhook configured for recipientID.IDType.
+// Failed deliveries are retried as configured.  If all attempts fail,
+// it returns ErrDeliveryFailed.
+func (c *Channel) Send(recipientID svalbardsrv.RecipientID, data svalbardsrv.TokenMsgData) error {
+	hookURL, ok := c.urls[strings.ToUpper(recipientID.IDType)]
+	if !ok {
+		return svalbardsrv.ErrUnsupportedOwnerIDType
+	}
+	msg, err := c.message(recipientID, data)
+	if err != nil {
+		return err
+	}
+	deliveryID, err := newDeliveryID()
+	if err != nil {
+		return err
+	}
+	payload := Payload{
+		RecipientIDType: recipientID.IDType,
+		Recipient:       recipientID.ID,
+		RequestID:       data.ReqID,
+		Message:         msg,
+		Locale:          data.Locale,
+		DeliveryID:      deliveryID,
+	}
+	delay := c.retryDelay
+	for attempt := 0; ; attempt++ {
+		payload.Attempt = attempt + 1
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return ErrInvalidPayload
+		}
+		retry, err := c.post(hookURL, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= c.maxRetries {
+			return ErrDeliveryFailed
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// SupportedOwnerIDTypes returns the sorted list of owner id types
+// for which a webhook is configured.
+func (c *Channel) SupportedOwnerIDTypes() []string {
+	idTypes := make([]string, 0, len(c.urls))
+	for idType := range c.urls {
+		idTypes = append(idTypes, idType)
+	}
+	sort.Strings(idTypes)
+	return idTypes
+}
+
+// newDeliveryID returns a new random id of a delivery.
+func newDeliveryID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// message returns the message with token to be sent to 'recipientID'.
+func (c *Channel) message(recipientID svalbardsrv.RecipientID, data svalbardsrv.TokenMsgData) (string, error) {
+	if c.templates == nil {
+		return svalbardsrv.GetMsgWithToken(data)
+	}
+	return c.templates.Render(recipientID, data)
+}
+
+// post makes a single delivery attempt of 'body' to 'hookURL'.
+// It returns whether a failed attempt is worth retrying.
+func (c *Channel) post(hookURL string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", hookURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(c.now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(c.key, timestamp, body))
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	// Client errors (except for throttling) will not go away by retrying.
+	retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, ErrDeliveryFailed
+}
+
+// Sign returns the value of SignatureHeader for the given 'timestamp'
+// (the value of TimestampHeader) and 'body' of a request.
+func Sign(key []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signatureVersion + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verifier checks the signatures of the requests received by a webhook,
+// and rejects stale or replayed requests.  It is intended to be used
+// by the receivers of the payloads sent by Channel.  Retries of a delivery
+// are not replays, as every attempt is signed differently; receivers should
+// acknowledge the payloads whose DeliveryID they have handled already
+// without handling them again.
+type Verifier struct {
+	key    []byte
+	maxAge time.Duration
+	now    func() time.Time
+
+	// Signatures of the accepted requests, mapped to their timestamps.
+	seenMutex sync.Mutex
+	seen      map[string]time.Time
+}
+
+// NewVerifier returns a Verifier that accepts requests signed with 'key'
+// whose timestamps differ from the current time by at most 'maxAge'.
+// If 'maxAge' is zero, DefaultMaxAge is used.
+func NewVerifier(key []byte, maxAge time.Duration) (*Verifier, error) {
+	if len(key) == 0 {
+		return nil, ErrMissingKey
+	}
+	if maxAge == 0 {
+		maxAge = DefaultMaxAge
+	}
+	return &Verifier{
+		key:    append([]byte(nil), key...),
+		maxAge: maxAge,
+		now:    time.Now,
+		seen:   make(map[string]time.Time),
+	}, nil
+}
+
+// Verify checks that the request 'r' carries a valid, fresh signature that
+// has not been seen before, and returns the decoded payload of the request.
+// It consumes the body of the request.
+func (v *Verifier) Verify(r *http.Request) (Payload, error) {
+	if r.Method != "POST" {
+		return Payload{}, svalbardsrv.ErrExpectedPostRequest
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Payload{}, ErrInvalidPayload
+	}
+	return v.VerifyBody(r.Header.Get(TimestampHeader), r.Header.Get(SignatureHeader), body)
+}
+
+// VerifyBody is like Verify, but takes the values of the relevant
+// headers and the body of a request directly.
+func (v *Verifier) VerifyBody(timestamp, signature string, body []byte) (Payload, error) {
+	if timestamp == "" || signature == "" {
+		return Payload{}, ErrMissingSignature
+	}
+	expected := Sign(v.key, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return Payload{}, ErrInvalidSignature
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return Payload{}, ErrInvalidTimestamp
+	}
+	now := v.now()
+	signedAt := time.Unix(seconds, 0)
+	if signedAt.Before(now.Add(-v.maxAge)) || signedAt.After(now.Add(v.maxAge)) {
+		return Payload{}, ErrStaleTimestamp
+	}
+	if err := v.markSeen(signature, signedAt, now); err != nil {
+		return Payload{}, err
+	}
+	var payload Payload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return Payload{}, ErrInvalidPayload
+	}
+	return payload, nil
+}
+
+// markSeen records 'signature' as accepted, unless it has been accepted
+// before.  Signatures older than maxAge are forgotten, as the corresponding
+// requests are rejected as stale anyway.
+func (v *Verifier) markSeen(signature string, signedAt, now time.Time) error {
+	v.seenMutex.Lock()
+	defer v.seenMutex.Unlock()
+	for s, t := range v.seen {
+		if t.Before(now.Add(-v.maxAge)) {
+			delete(v.seen, s)
+		}
+	}
+	if _, ok := v.seen[signature]; ok {
+		return ErrReplayedRequest
+	}
+	v.seen[signature] = signedAt
+	return nil
+}
@@ -0,0 +1,310 @@
+// Copyright 2018 The Svalbard Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+///////////////////////////////////////////////////////////////////////////////
+
+package webhookchannel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/svalbard/server/go/msgtemplate"
+	"github.com/google/svalbard/server/go/svalbardsrv"
+)
+
+var testKey = []byte("some webhook signing key")
+
+// testHook is a webhook that verifies and records the received payloads.
+// It fails the first 'failures' requests with the status 'failureStatus'.
+type testHook struct {
+	verifier      *Verifier
+	failures      int
+	failureStatus int
+
+	mutex    sync.Mutex
+	requests int
+	payloads []Payload
+}
+
+func (h *testHook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.requests++
+	if h.requests <= h.failures {
+		http.Error(w, "failure", h.failureStatus)
+		return
+	}
+	payload, err := h.verifier.Verify(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	h.payloads = append(h.payloads, payload)
+}
+
+// received returns the number of requests and the payloads received so far.
+func (h *testHook) received() (int, []Payload) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.requests, append([]Payload(nil), h.payloads...)
+}
+
+func newTestHook(failures, failureStatus int, t *testing.T) (*testHook, *httptest.Server) {
+	verifier, err := NewVerifier(testKey, time.Minute)
+	if err != nil {
+		t.Fatalf("NewVerifier() failed: %v", err)
+	}
+	hook := &testHook{verifier: verifier, failures: failures, failureStatus: failureStatus}
+	return hook, httptest.NewServer(hook)
+}
+
+func newTestChannel(hookURL string, maxRetries int, t *testing.T) *Channel {
+	c, err := NewChannel(Config{
+		URLs:       map[string]string{"chat": hookURL},
+		Key:        testKey,
+		MaxRetries: maxRetries,
+		RetryDelay: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewChannel() failed: %v", err)
+	}
+	return c
+}
+
+func TestSendDeliversSignedPayloads(t *testing.T) {
+	hook, srv := newTestHook(0, 0, t)
+	defer srv.Close()
+	c := newTestChannel(srv.URL, 0, t)
+	var tests = []struct {
+		recipient svalbardsrv.RecipientID
+		data      svalbardsrv.TokenMsgData
+	}{
+		{svalbardsrv.RecipientID{"chat", "alice"}, svalbardsrv.TokenMsgData{ReqID: "req42", Token: "asdfie"}},
+		{svalbardsrv.RecipientID{"CHAT", "Bob"}, svalbardsrv.TokenMsgData{ReqID: "26g3", Token: "AEUHE"}},
+		{svalbardsrv.RecipientID{"Chat", "Bob"}, svalbardsrv.TokenMsgData{ReqID: "636328", Token: "yqggyod"}},
+	}
+	for i, tt := range tests {
+		if err := c.Send(tt.recipient, tt.data); err != nil {
+			t.Errorf("Send(%v, %v) unexpected error: %v", tt.recipient, tt.data, err)
+			continue
+		}
+		_, payloads := hook.received()
+		if len(payloads) != i+1 {
+			t.Fatalf("Send(%v, %v) delivered %d payloads in total, want %d",
+				tt.recipient, tt.data, len(payloads), i+1)
+		}
+		msg, _ := svalbardsrv.GetMsgWithToken(tt.data)
+		got := payloads[i]
+		if len(got.DeliveryID) != 32 {
+			t.Errorf("Send(%v, %v) delivery id: got [%v], want 32 hex digits", tt.recipient, tt.data, got.DeliveryID)
+		}
+		want := Payload{RecipientIDType: tt.recipient.IDType, Recipient: tt.recipient.ID, RequestID: tt.data.ReqID, Message: msg,
+			DeliveryID: got.DeliveryID, Attempt: 1}
+		if got != want {
+			t.Errorf("Send(%v, %v) payload: got [%v], want [%v]", tt.recipient, tt.data, got, want)
+		}
+	}
+}
+
+func TestSendDeliversLocalizedMessages(t *testing.T) {
+	hook, srv := newTestHook(0, 0, t)
+	defer srv.Close()
+	c, err := NewChannel(Config{
+		URLs:      map[string]string{"chat": srv.URL, "sms": srv.URL},
+		Key:       testKey,
+		Templates: msgtemplate.New(),
+	})
+	if err != nil {
+		t.Fatalf("NewChannel() failed: %v", err)
+	}
+	var tests = []struct {
+		recipient svalbardsrv.RecipientID
+		locale    string
+		want      string
+	}{
+		{svalbardsrv.RecipientID{IDType: "chat", ID: "alice"}, "",
+			"Your Svalbard retrieval code for request req42 is asdfie.\n" +
+				"If you did not request it, please ignore this message.\nSVBD:req42:asdfie"},
+		{svalbardsrv.RecipientID{IDType: "sms", ID: "alice"}, "en-US",
+			"Svalbard retrieval code: asdfie\nSVBD:req42:asdfie"},
+		{svalbardsrv.RecipientID{IDType: "chat", ID: "alice"}, "de_CH",
+			"Ihr Svalbard-Code für die Abfrage (Anfrage req42) lautet asdfie.\n" +
+				"Falls Sie ihn nicht angefordert haben, ignorieren Sie bitte diese Nachricht.\nSVBD:req42:asdfie"},
+	}
+	for i, tt := range tests {
+		data := svalbardsrv.TokenMsgData{ReqID: "req42", Token: "asdfie", Op: svalbardsrv.OpRetrieveShare, Locale: tt.locale}
+		if err := c.Send(tt.recipient, data); err != nil {
+			t.Fatalf("Send(%v, %v) unexpected error: %v", tt.recipient, data, err)
+		}
+		_, payloads := hook.received()
+		if got := payloads[i]; got.Message != tt.want || got.Locale != tt.locale {
+			t.Errorf("Send(%v, %v) payload: got message [%v] in locale [%v], want [%v] in locale [%v]",
+				tt.recipient, data, got.Message, got.Locale, tt.want, tt.locale)
+		}
+		if parsed, err := svalbardsrv.ParseMsgWithToken(payloads[i].Message); err != nil || parsed.Token != "asdfie" {
+			t.Errorf("ParseMsgWithToken() of the message for %v: got %v (error: %v), want token asdfie",
+				tt.recipient, parsed, err)
+		}
+	}
+}
+
+func TestSendRetriesFailedDeliveries(t *testing.T) {
+	var tests = []struct {
+		failures      int
+		failureStatus int
+		maxRetries    int
+		requests      int
+		err           error
+	}{
+		{0, 0, 0, 1, nil},
+		{2, http.StatusInternalServerError, 2, 3, nil},
+		{2, http.StatusTooManyRequests, 3, 3, nil},
+		{3, http.StatusServiceUnavailable, 2, 3, ErrDeliveryFailed},
+		{1, http.StatusBadGateway, 0, 1, ErrDeliveryFailed},
+		// Client errors are not retried.
+		{1, http.StatusBadRequest, 3, 1, ErrDeliveryFailed},
+		{1, http.StatusNotFound, 3, 1, ErrDeliveryFailed},
+	}
+	for _, tt := range tests {
+		hook, srv := newTestHook(tt.failures, tt.failureStatus, t)
+		c := newTestChannel(srv.URL, tt.maxRetries, t)
+		err := c.Send(svalbardsrv.RecipientID{"chat", "alice"}, svalbardsrv.TokenMsgData{ReqID: "req42", Token: "asdfie"})
+		srv.Close()
+		if err != tt.err {
+			t.Errorf("Send() with %+v: got error [%v], want [%v]", tt, err, tt.err)
+		}
+		if requests, _ := hook.received(); requests != tt.requests {
+			t.Errorf("Send() with %+v: got %d requests, want %d", tt, requests, tt.requests)
+		}
+	}
+}
+
+func TestSendRetriesHandledDeliveries(t *testing.T) {
+	// The hook handles the first attempt, but its response gets lost.
+	hook, srv := newTestHook(0, 0, t)
+	defer srv.Close()
+	lost := 0
+	lossy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hook.ServeHTTP(w, r)
+		if lost++; lost == 1 {
+			panic(http.ErrAbortHandler)
+		}
+	}))
+	defer lossy.Close()
+	c := newTestChannel(lossy.URL, 1, t)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	if err := c.Send(svalbardsrv.RecipientID{"chat", "alice"}, svalbardsrv.TokenMsgData{ReqID: "req42", Token: "asdfie"}); err != nil {
+		t.Fatalf("Send() with a lost response: got error [%v], want [nil]", err)
+	}
+	// The retry within the same second is not rejected as a replay, and
+	// carries the same delivery id.
+	requests, payloads := hook.received()
+	if requests != 2 || len(payloads) != 2 {
+		t.Fatalf("Send() with a lost response: got %d requests and %d payloads, want 2 and 2", requests, len(payloads))
+	}
+	if payloads[0].DeliveryID != payloads[1].DeliveryID || payloads[0].Attempt != 1 || payloads[1].Attempt != 2 {
+		t.Errorf("Send() with a lost response: got payloads %+v, want the same delivery id in attempts 1 and 2", payloads)
+	}
+}
+
+func TestSendFailsForUnreachableHook(t *testing.T) {
+	_, srv := newTestHook(0, 0, t)
+	hookURL := srv.URL
+	srv.Close()
+	c := newTestChannel(hookURL, 1, t)
+	err := c.Send(svalbardsrv.RecipientID{"chat", "alice"}, svalbardsrv.TokenMsgData{ReqID: "req42", Token: "asdfie"})
+	if err != ErrDeliveryFailed {
+		t.Errorf("Send() to unreachable hook: got error [%v], want [%v]", err, ErrDeliveryFailed)
+	}
+}
+
+func TestSendRejectsUnsupportedOwnerIDTypes(t *testing.T) {
+	hook, srv := newTestHook(0, 0, t)
+	defer srv.Close()
+	c := newTestChannel(srv.URL, 0, t)
+	for _, idType := range []string{"SMS", "email", "FILE", ""} {
+		err := c.Send(svalbardsrv.RecipientID{idType, "alice"}, svalbardsrv.TokenMsgData{ReqID: "req42", Token: "asdfie"})
+		if err != svalbardsrv.ErrUnsupportedOwnerIDType {
+			t.Errorf("Send() with owner id type [%v]: got error [%v], want [%v]",
+				idType, err, svalbardsrv.ErrUnsupportedOwnerIDType)
+		}
+	}
+	if requests, _ := hook.received(); requests != 0 {
+		t.Errorf("Unexpected requests to the hook: %d", requests)
+	}
+}
+
+func TestNewChannelValidatesConfig(t *testing.T) {
+	var tests = []struct {
+		config Config
+		err    error
+	}{
+		{Config{URLs: map[string]string{"chat": "https://example.com/hook"}, Key: testKey}, nil},
+		{Config{URLs: map[string]string{"chat": "https://example.com/hook"}}, ErrMissingKey},
+		{Config{Key: testKey}, ErrMissingURLs},
+		{Config{URLs: map[string]string{"chat": "example.com/hook"}, Key: testKey}, ErrInvalidURL},
+		{Config{URLs: map[string]string{"chat": "ftp://example.com/hook"}, Key: testKey}, ErrInvalidURL},
+		{Config{URLs: map[string]string{"": "https://example.com/hook"}, Key: testKey}, ErrInvalidURL},
+		{Config{URLs: map[string]string{"chat": "https://example.com/hook"}, Key: testKey, MaxRetries: -1},
+			ErrNegativeRetries},
+	}
+	for _, tt := range tests {
+		if _, err := NewChannel(tt.config); err != tt.err {
+			t.Errorf("NewChannel(%+v): got error [%v], want [%v]", tt.config, err, tt.err)
+		}
+	}
+}
+
+func TestVerifierRejectsInvalidRequests(t *testing.T) {
+	v, err := NewVerifier(testKey, time.Minute)
+	if err != nil {
+		t.Fatalf("NewVerifier() failed: %v", err)
+	}
+	now := time.Now()
+	v.now = func() time.Time { return now }
+	body := []byte(`{"recipient_id_type":"chat","recipient":"alice","request_id":"req42","message":"SVBD:req42:asdfie"}`)
+	fresh := strconv.FormatInt(now.Unix(), 10)
+	stale := strconv.FormatInt(now.Add(-2*time.Minute).Unix(), 10)
+	future := strconv.FormatInt(now.Add(2*time.Minute).Unix(), 10)
+	var tests = []struct {
+		desc      string
+		timestamp string
+		signature string
+		body      []byte
+		err       error
+	}{
+		{"valid request", fresh, Sign(testKey, fresh, body), body, nil},
+		{"replayed request", fresh, Sign(testKey, fresh, body), body, ErrReplayedRequest},
+		{"missing timestamp", "", Sign(testKey, fresh, body), body, ErrMissingSignature},
+		{"missing signature", fresh, "", body, ErrMissingSignature},
+		{"wrong key", fresh, Sign([]byte("another key"), fresh, body), body, ErrInvalidSignature},
+		{"modified body", fresh, Sign(testKey, fresh, body), append([]byte(" "), body...), ErrInvalidSignature},
+		{"modified timestamp", stale, Sign(testKey, fresh, body), body, ErrInvalidSignature},
+		{"stale timestamp", stale, Sign(testKey, stale, body), body, ErrStaleTimestamp},
+		{"future timestamp", future, Sign(testKey, future, body), body, ErrStaleTimestamp},
+		{"invalid timestamp", "yesterday", Sign(testKey, "yesterday", body), body, ErrInvalidTimestamp},
+		{"invalid payload", fresh, Sign(testKey, fresh, []byte("{")), []byte("{"), ErrInvalidPayload},
+	}
+	for _, tt := range tests {
+		if _, err := v.VerifyBody(tt.timestamp, tt.signature, tt.body); err != tt.err {
+			t.Errorf("VerifyBody() of %s: got error [%v], want [%v]", tt.desc, err, tt.err)
+		}
+	}
+}